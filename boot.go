@@ -1,29 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
 	_ "github.com/docker/distribution/registry/storage/driver/s3-aws"
 	"github.com/drycc/builder/pkg"
+	"github.com/drycc/builder/pkg/buildqueue"
 	"github.com/drycc/builder/pkg/cleaner"
 	"github.com/drycc/builder/pkg/conf"
+	"github.com/drycc/builder/pkg/controller"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/githttp"
 	"github.com/drycc/builder/pkg/gitreceive"
 	"github.com/drycc/builder/pkg/healthsrv"
 	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/release"
 	"github.com/drycc/builder/pkg/sshd"
+	"github.com/drycc/builder/pkg/storage"
 	"github.com/drycc/builder/pkg/sys"
+	"github.com/drycc/builder/pkg/tunables"
+	"github.com/drycc/builder/pkg/warmer"
 	pkglog "github.com/drycc/pkg/log"
 	"github.com/kelseyhightower/envconfig"
 )
 
+// version is the version of the builder, set at build time with -X main.version.
+var version = "dev"
+
+// commit is the git commit the builder is built from, set at build time with -X main.commit.
+var commit = ""
+
 const (
 	serverConfAppName     = "drycc-builder-server"
 	gitReceiveConfAppName = "drycc-builder-git-receive"
+	secretsConfAppName    = "drycc-builder-secrets"
 	gitHomeDir            = "/home/git"
 )
 
@@ -31,13 +54,141 @@ func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
+// configureController tunes the connections to the controller with the config of appName.
+func configureController(appName string) {
+	transportConf := new(controller.TransportConfig)
+	if err := envconfig.Process(appName, transportConf); err != nil {
+		log.Printf("Error getting the controller transport config for %s [%s]", appName, err)
+		os.Exit(1)
+	}
+	controller.Configure(*transportConf)
+}
+
+// configureSecrets reads the secrets of the builder from the store configured for appName, and
+// returns the interval at which the store is read again.
+func configureSecrets(appName string) time.Duration {
+	secretsConf := new(conf.SecretsConfig)
+	if err := envconfig.Process(appName, secretsConf); err != nil {
+		log.Printf("Error getting the secret store config for %s [%s]", appName, err)
+		os.Exit(1)
+	}
+	if err := conf.ConfigureSecrets(*secretsConf); err != nil {
+		log.Printf("Error configuring the secret store (%s)", err)
+		os.Exit(1)
+	}
+	return time.Duration(secretsConf.CacheTTLSec) * time.Second
+}
+
+// applyTunables overrides the config of the git-receive hook with the tunables of builds the
+// server last accepted. Pushes go on with their env when they can't be applied.
+func applyTunables() {
+	keys, err := tunables.Apply(filepath.Join(gitHomeDir, tunables.SnapshotFile), gitReceiveConfAppName)
+	if err != nil {
+		log.Printf("Error applying the tunables of builds (%s)", err)
+	} else if len(keys) > 0 {
+		pkglog.Debug("Applied the tunables %s", strings.Join(keys, ", "))
+	}
+}
+
+// hookConfig returns the config of the git-receive hook the next push reads, with the tunables of
+// builds applied, except for the settings the server sets for each push.
+func hookConfig() (*gitreceive.Config, error) {
+	cnf := new(gitreceive.Config)
+	if err := tunables.Resolve(cnf, gitReceiveConfAppName, filepath.Join(gitHomeDir, tunables.SnapshotFile)); err != nil {
+		return nil, err
+	}
+	return cnf, nil
+}
+
+// checkConfig checks the config of the server and of the git-receive hook, with the tunables of
+// builds applied, and that the storage and the controller can be reached. The settings the server
+// sets for each push are stood in for.
+func checkConfig() []gitreceive.ConfigCheck {
+	var checks []gitreceive.ConfigCheck
+	srvConf := new(sshd.Config)
+	srvErr := envconfig.Process(serverConfAppName, srvConf)
+	checks = append(checks, gitreceive.ConfigCheck{Name: "server config", Err: srvErr})
+
+	snapshot, err := tunables.ReadSnapshot(filepath.Join(gitHomeDir, tunables.SnapshotFile))
+	if err == nil && snapshot != nil && snapshot.Error != "" {
+		err = fmt.Errorf("the latest change was rejected (%s)", snapshot.Error)
+	}
+	checks = append(checks, gitreceive.ConfigCheck{Name: "tunables", Err: err})
+	applyTunables()
+
+	for key, value := range map[string]string{
+		"GIT_HOME":             gitHomeDir,
+		"SSH_CONNECTION":       "127.0.0.1 0 127.0.0.1 0",
+		"SSH_ORIGINAL_COMMAND": "git-receive-pack 'config-check.git'",
+		"REPOSITORY":           "config-check.git",
+		"USERNAME":             "config-check",
+		"FINGERPRINT":          "config-check",
+	} {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+	cnf := new(gitreceive.Config)
+	err = envconfig.Process(gitReceiveConfAppName, cnf)
+	checks = append(checks, gitreceive.ConfigCheck{Name: "git-receive config", Err: err})
+	if err != nil {
+		return checks
+	}
+	checks = append(checks, gitreceive.CheckConfig(cnf)...)
+	if srvErr == nil {
+		tokens, err := controller.NewHookTokens(controller.Routes{}, srvConf.HookTokenMode, srvConf.HookTokenTTL())
+		if err == nil {
+			err = tokens.CheckTTL(cnf.LongestBuild())
+		}
+		checks = append(checks, gitreceive.ConfigCheck{Name: "hook tokens", Err: err})
+	}
+
+	if drivers, err := envStorageDrivers(); err != nil {
+		checks = append(checks, gitreceive.ConfigCheck{Name: "object storage", Err: err})
+	} else {
+		checks = append(checks, gitreceive.CheckStorage(drivers)...)
+	}
+	configureController(gitReceiveConfAppName)
+	return append(checks, gitreceive.CheckController(cnf))
+}
+
+// storageDrivers returns the storages of the classes of objects the builder keeps, main for the
+// classes without a storage of their own. With expire, it also sets the expiration of the objects
+// of the classes that have one.
+func storageDrivers(main storagedriver.StorageDriver, expire bool) (storage.Drivers, error) {
+	drivers := storage.NewDrivers(main)
+	classes := map[string]*storagedriver.StorageDriver{
+		conf.CacheStorageClass: &drivers.Cache,
+		conf.LogStorageClass:   &drivers.Logs,
+	}
+	for class, driver := range classes {
+		params, days, err := conf.GetClassStorageParams(class)
+		if err != nil {
+			return drivers, fmt.Errorf("reading the parameters of the %s storage (%s)", class, err)
+		} else if params == nil {
+			continue
+		}
+		if *driver, err = factory.Create("s3", params); err != nil {
+			return drivers, fmt.Errorf("creating the driver of the %s storage (%s)", class, err)
+		}
+		if expire && days > 0 {
+			if err := storage.SetExpiration(params, days); err != nil {
+				return drivers, fmt.Errorf("setting the expiration of the %s storage (%s)", class, err)
+			}
+		}
+	}
+	return drivers, nil
+}
+
 func main() {
 	if os.Getenv("DRYCC_DEBUG") == "true" {
 		pkglog.DefaultLogger.SetDebug(true)
 		log.Printf("Running in debug mode")
 	}
+	secretsTTL := configureSecrets(secretsConfAppName)
 
 	app := cli.NewApp()
+	app.Version = version
 
 	app.Commands = []cli.Command{
 		{
@@ -50,9 +201,41 @@ func main() {
 					pkglog.Err("getting config for %s [%s]", serverConfAppName, err)
 					os.Exit(1)
 				}
+				cnf.BuilderVersion, cnf.BuilderCommit = version, commit
+				configureController(serverConfAppName)
+				routes, err := controller.ParseRoutes(cnf.ControllerRoutes, cnf.ControllerHost, cnf.ControllerPort)
+				if err != nil {
+					log.Printf("Error reading the controller routes (%s)", err)
+					os.Exit(1)
+				}
+				tokens, err := controller.NewHookTokens(routes, cnf.HookTokenMode, cnf.HookTokenTTL())
+				if err != nil {
+					log.Printf("Error reading the hook token configuration (%s)", err)
+					os.Exit(1)
+				}
+				// the token of a push is minted when it starts, so it must outlive its build
+				if hc, err := hookConfig(); err != nil {
+					log.Printf("Error reading the git-receive config (%s)", err)
+					os.Exit(1)
+				} else if err := tokens.CheckTTL(hc.LongestBuild()); err != nil {
+					log.Printf("Error checking the TTL of the hook tokens (%s)", err)
+					os.Exit(1)
+				}
+				// the drivers of the server are created once, it restarts to use rotated storage
+				// credentials while the hooks read them for every push
+				secretRotatedCh := make(chan string, 1)
+				conf.OnSecretRotation(func(name string) {
+					if name == conf.StorageSecret {
+						select {
+						case secretRotatedCh <- name:
+						default:
+						}
+					}
+				})
+				go conf.WatchSecrets(secretsTTL, conf.BuilderKeySecret, conf.StorageSecret)
 				fs := sys.RealFS()
 				env := sys.RealEnv()
-				pushLock := sshd.NewInMemoryRepositoryLock(cnf.GitLockTimeout())
+				limiter := sshd.NewLimiter(cnf.Limits())
 				circ := sshd.NewCircuit()
 
 				storageParams, err := conf.GetStorageParams(env)
@@ -68,30 +251,108 @@ func main() {
 					os.Exit(1)
 				}
 
+				drivers, err := storageDrivers(storageDriver, true)
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+
+				repos, err := git.NewRepoStore(cnf.RepoStorage, storageDriver, cnf.ExternalGitURL)
+				if err != nil {
+					log.Printf("Error creating the repo storage (%s)", err)
+					os.Exit(1)
+				}
+
 				kubeClient, err := k8s.NewInCluster()
 				if err != nil {
 					log.Printf("Error getting kubernetes client [%s]", err)
 					os.Exit(1)
 				}
-				log.Printf("Starting health check server on port %d", cnf.HealthSrvPort)
+				pushLock, err := sshd.NewRepositoryLock(cnf, kubeClient.CoordinationV1().Leases(cnf.PodNamespace))
+				if err != nil {
+					log.Printf("Error creating the git lock (%s)", err)
+					os.Exit(1)
+				}
+				log.Printf("Starting health check server on %s", cnf.HealthSrvAddr())
 				healthSrvCh := make(chan error)
 				go func() {
-					if err := healthsrv.Start(cnf, kubeClient.CoreV1().Namespaces(), storageDriver, circ); err != nil {
+					if err := healthsrv.Start(cnf, gitHomeDir, kubeClient.CoreV1().Namespaces(), storageDriver, drivers.Artifacts, circ, hookConfig); err != nil {
 						healthSrvCh <- err
 					}
 				}()
 				log.Printf("Starting deleted app cleaner")
 				cleanerErrCh := make(chan error)
 				go func() {
-					if err := cleaner.Run(gitHomeDir, kubeClient.CoreV1().Namespaces(), fs, cnf.CleanerPollSleepDuration(), storageDriver); err != nil {
+					if err := cleaner.Run(gitHomeDir, repos, kubeClient.CoreV1().Namespaces(), fs, cnf.CleanerPollSleepDuration(), drivers, cnf.StorageKeyShardLength); err != nil {
 						cleanerErrCh <- err
 					}
 				}()
 
-				log.Printf("Starting SSH server on %s:%d", cnf.SSHHostIP, cnf.SSHHostPort)
+				log.Printf("Starting expired debug pod cleaner")
+				go cleaner.RunDebugPodGC(hookConfig, kubeClient, cnf.CleanerPollSleepDuration())
+
+				log.Printf("Starting stale build artifact cleaner")
+				go cleaner.RunBuildArtifactGC(gitHomeDir, cnf.BuildTmpDir, cnf.BuildArtifactTTL(), cnf.BuildArtifactGCInterval())
+
+				log.Printf("Watching the tunables of builds in %s", cnf.TunablesPath)
+				go tunables.Watch(cnf.TunablesPath, filepath.Join(gitHomeDir, tunables.SnapshotFile), cnf.TunablesReloadInterval(), func(values map[string]string) error {
+					return tunables.Validate(new(gitreceive.Config), values)
+				})
+
+				log.Printf("Starting pending release publisher")
+				releaseQueueErrCh := make(chan error)
+				go func() {
+					clientFor, err := routes.Clients()
+					if err != nil {
+						releaseQueueErrCh <- err
+						return
+					}
+					if err := release.Run(storageDriver, pushLock, clientFor, cnf.ReleaseQueuePollSleepDuration(), cnf.ReleaseQueueMaxAge()); err != nil {
+						releaseQueueErrCh <- err
+					}
+				}()
+
+				buildQueueErrCh := make(chan error)
+				window, err := buildqueue.ParseWindow(cnf.OffPeakWindow)
+				if err != nil {
+					log.Printf("Error reading OFF_PEAK_WINDOW (%s)", err)
+					os.Exit(1)
+				}
+				if window != nil {
+					log.Printf("Starting off-peak build runner in %s UTC", window)
+					go func() {
+						run := func(b buildqueue.Build) error {
+							return runQueuedBuild(gitHomeDir, repos, tokens, b)
+						}
+						buildQueueErrCh <- buildqueue.Run(storageDriver, window, pushLock, run, cnf.BuildQueuePollSleepDuration(), cnf.BuildQueueMaxAge())
+					}()
+				}
+
+				warmerErrCh := make(chan error)
+				if cnf.WarmImages {
+					log.Printf("Starting image warmer")
+					go func() {
+						images := func() ([]string, error) { return warmer.Images(warmer.StackConfigs, cnf.StackCatalogPath) }
+						warmerErrCh <- warmer.Run(kubeClient, cnf.PodNamespace, images, cnf.BuilderPodNodeSelector, cnf.WarmImagesInterval())
+					}()
+				}
+
+				gitHTTPErrCh := make(chan error)
+				if cnf.GitHTTPEnabled {
+					log.Printf("Starting git HTTP server on %s", cnf.GitHTTPAddr())
+					go func() {
+						auth := &githttp.ControllerAuthenticator{Routes: routes}
+						srv := githttp.NewServer(gitHomeDir, repos, auth, pushLock, limiter)
+						srv.HookTokens = tokens
+						srv.TarballMaxBytes, srv.TarballMaxExtractedBytes = cnf.TarballMaxBytes, cnf.TarballMaxExtractedBytes
+						gitHTTPErrCh <- githttp.Serve(srv, cnf.GitHTTPAddr(), cnf.GitHTTPTLSCertFile, cnf.GitHTTPTLSKeyFile)
+					}()
+				}
+
+				log.Printf("Starting SSH server on %s", cnf.SSHAddr())
 				sshCh := make(chan int)
 				go func() {
-					sshCh <- pkg.RunBuilder(cnf, gitHomeDir, circ, pushLock)
+					sshCh <- pkg.RunBuilder(cnf, gitHomeDir, repos, circ, pushLock, limiter, storageDriver, tokens)
 				}()
 
 				select {
@@ -104,6 +365,21 @@ func main() {
 				case err := <-cleanerErrCh:
 					log.Printf("Error running the deleted app cleaner (%s)", err)
 					os.Exit(1)
+				case err := <-releaseQueueErrCh:
+					log.Printf("Error running the pending release publisher (%s)", err)
+					os.Exit(1)
+				case err := <-buildQueueErrCh:
+					log.Printf("Error running the off-peak build runner (%s)", err)
+					os.Exit(1)
+				case err := <-warmerErrCh:
+					log.Printf("Error running the image warmer (%s)", err)
+					os.Exit(1)
+				case err := <-gitHTTPErrCh:
+					log.Printf("Error running the git HTTP server (%s)", err)
+					os.Exit(1)
+				case name := <-secretRotatedCh:
+					log.Printf("The %s secret rotated, restarting to use it", name)
+					os.Exit(1)
 				}
 			},
 		},
@@ -112,12 +388,15 @@ func main() {
 			Aliases: []string{"gr"},
 			Usage:   "Run the git-receive hook",
 			Action: func(c *cli.Context) {
+				applyTunables()
 				cnf := new(gitreceive.Config)
 				if err := envconfig.Process(gitReceiveConfAppName, cnf); err != nil {
 					log.Printf("Error getting config for %s [%s]", gitReceiveConfAppName, err)
 					os.Exit(1)
 				}
 				cnf.CheckDurations()
+				cnf.BuilderVersion = version
+				configureController(gitReceiveConfAppName)
 				fs := sys.RealFS()
 				env := sys.RealEnv()
 				storageParams, err := conf.GetStorageParams(env)
@@ -133,13 +412,299 @@ func main() {
 					os.Exit(1)
 				}
 
-				if err := gitreceive.Run(cnf, fs, env, storageDriver); err != nil {
+				drivers, err := storageDrivers(storageDriver, false)
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+
+				if err := gitreceive.Run(cnf, fs, env, drivers); err != nil {
 					log.Printf("Error running git receive hook [%s]", err)
+					// the last line of a failed push tells wrappers what kind of error it was
+					fmt.Fprintln(os.Stderr, gitreceive.ErrorLine(err))
+					os.Exit(gitreceive.ExitCode(err))
+				}
+			},
+		},
+		{
+			Name:  "self-test",
+			Usage: "Push a sample app to <app> as <user>, build it against the storage, cluster and controller of the builder and check that it's released",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 2 {
+					log.Printf("Usage: self-test <app> <user>")
+					os.Exit(1)
+				}
+				applyTunables()
+				cnf := new(gitreceive.Config)
+				if err := envconfig.Process(gitReceiveConfAppName, cnf); err != nil {
+					log.Printf("Error getting config for %s [%s]", gitReceiveConfAppName, err)
+					os.Exit(1)
+				}
+				cnf.CheckDurations()
+				cnf.BuilderVersion = version
+				configureController(gitReceiveConfAppName)
+				drivers, err := envStorageDrivers()
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				released, err := gitreceive.SelfTest(cnf, drivers, c.Args()[0], c.Args()[1])
+				if err != nil {
+					log.Printf("Self-test failed (%s)", err)
+					os.Exit(1)
+				}
+				log.Printf("Self-test passed, %s", released)
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Check the configuration of the builder",
+			Subcommands: []cli.Command{
+				{
+					Name:  "check",
+					Usage: "Check the configuration of the builder and that its storage and controller can be reached, and print a report",
+					Action: func(c *cli.Context) {
+						if !gitreceive.WriteConfigReport(os.Stdout, checkConfig()) {
+							os.Exit(1)
+						}
+					},
+				},
+			},
+		},
+		{
+			Name:  "migrate-storage-keys",
+			Usage: "Move the build caches to the keys sharded with STORAGE_KEY_SHARD_LENGTH",
+			Action: func(c *cli.Context) {
+				var cnf struct {
+					ShardLength int `envconfig:"STORAGE_KEY_SHARD_LENGTH" default:"0"`
+				}
+				if err := envconfig.Process(serverConfAppName, &cnf); err != nil {
+					log.Printf("Error getting config for %s [%s]", serverConfAppName, err)
+					os.Exit(1)
+				}
+				storageParams, err := conf.GetStorageParams(sys.RealEnv())
+				if err != nil {
+					log.Printf("Error getting storage parameters (%s)", err)
+					os.Exit(1)
+				}
+				storageDriver, err := factory.Create("s3", storageParams)
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				drivers, err := storageDrivers(storageDriver, false)
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				moved, err := gitreceive.MigrateStorageKeys(drivers.Cache, cnf.ShardLength)
+				if err != nil {
+					log.Printf("Error migrating the storage keys (%s)", err)
+					os.Exit(1)
+				}
+				log.Printf("Moved %d build caches", moved)
+			},
+		},
+		{
+			Name:  "assemble-source",
+			Usage: "Assemble the source archive of a build from its de-duplicated files, in builder pods",
+			Action: func(c *cli.Context) {
+				var cnf struct {
+					IndexPath   string `envconfig:"SOURCE_INDEX_PATH" required:"true"`
+					TarPath     string `envconfig:"TAR_PATH" required:"true"`
+					WaitTimeout int    `envconfig:"TAR_WAIT_TIMEOUT" default:"0"`
+				}
+				if err := envconfig.Process("", &cnf); err != nil {
+					log.Printf("Error getting config for assemble-source [%s]", err)
+					os.Exit(1)
+				}
+				storageParams, err := conf.GetStorageParams(sys.RealEnv())
+				if err != nil {
+					log.Printf("Error getting storage parameters (%s)", err)
+					os.Exit(1)
+				}
+				storageDriver, err := factory.Create("s3", storageParams)
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				wait := time.Duration(cnf.WaitTimeout) * time.Second
+				if err := gitreceive.AssembleSource(context.Background(), storageDriver, cnf.IndexPath, cnf.TarPath, wait); err != nil {
+					log.Printf("Error assembling the source (%s)", err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "extract-source",
+			Usage: "Extract the source archive of a build for the static analyzers, in analysis pods",
+			Action: func(c *cli.Context) {
+				var cnf struct {
+					TarPath     string `envconfig:"TAR_PATH" required:"true"`
+					SourceDir   string `envconfig:"SOURCE_DIR" required:"true"`
+					Compression string `envconfig:"DRYCC_COMPRESSION" default:"gzip"`
+				}
+				if err := envconfig.Process("", &cnf); err != nil {
+					log.Printf("Error getting config for extract-source [%s]", err)
+					os.Exit(1)
+				}
+				storageDriver, err := podStorageDriver()
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				if err := gitreceive.ExtractSource(storageDriver, cnf.TarPath, cnf.Compression, cnf.SourceDir); err != nil {
+					log.Printf("Error extracting the source (%s)", err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "upload-analysis",
+			Usage: "Upload the SARIF logs of the static analyzers, in analysis pods",
+			Action: func(c *cli.Context) {
+				var cnf struct {
+					AnalysisDir  string `envconfig:"ANALYSIS_DIR" required:"true"`
+					AnalysisPath string `envconfig:"ANALYSIS_PATH" required:"true"`
+				}
+				if err := envconfig.Process("", &cnf); err != nil {
+					log.Printf("Error getting config for upload-analysis [%s]", err)
+					os.Exit(1)
+				}
+				storageDriver, err := podStorageDriver()
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				if err := gitreceive.UploadAnalysis(storageDriver, cnf.AnalysisDir, cnf.AnalysisPath); err != nil {
+					log.Printf("Error uploading the analysis (%s)", err)
 					os.Exit(1)
 				}
 			},
 		},
+		{
+			Name:  "export-heroku-slug",
+			Usage: "Export the slug of the last build of <app> to <slug.tgz> in the Heroku slug format, and print its Heroku description",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 2 {
+					log.Printf("Usage: export-heroku-slug <app> <slug.tgz>")
+					os.Exit(1)
+				}
+				drivers, err := envStorageDrivers()
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				file, err := os.Create(c.Args()[1])
+				if err != nil {
+					log.Printf("Error creating the slug file (%s)", err)
+					os.Exit(1)
+				}
+				slug, err := gitreceive.ExportHerokuSlug(context.Background(), drivers.Artifacts, c.Args()[0], file)
+				if err == nil {
+					err = file.Close()
+				}
+				if err != nil {
+					log.Printf("Error exporting the slug (%s)", err)
+					os.Exit(1)
+				}
+				data, err := json.MarshalIndent(slug, "", "  ")
+				if err != nil {
+					log.Printf("Error describing the slug (%s)", err)
+					os.Exit(1)
+				}
+				fmt.Println(string(data))
+			},
+		},
+		{
+			Name:  "import-heroku-slug",
+			Usage: "Import the Heroku slug <slug.tgz> described by <slug.json> as a build of <app>, released by the next push of its commit",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 3 {
+					log.Printf("Usage: import-heroku-slug <app> <slug.tgz> <slug.json>")
+					os.Exit(1)
+				}
+				var cnf struct {
+					ShardLength int `envconfig:"STORAGE_KEY_SHARD_LENGTH" default:"0"`
+				}
+				if err := envconfig.Process(serverConfAppName, &cnf); err != nil {
+					log.Printf("Error getting config for %s [%s]", serverConfAppName, err)
+					os.Exit(1)
+				}
+				drivers, err := envStorageDrivers()
+				if err != nil {
+					log.Printf("Error creating storage driver (%s)", err)
+					os.Exit(1)
+				}
+				data, err := ioutil.ReadFile(c.Args()[2])
+				if err != nil {
+					log.Printf("Error reading the slug description (%s)", err)
+					os.Exit(1)
+				}
+				slug := new(gitreceive.HerokuSlug)
+				if err := json.Unmarshal(data, slug); err != nil {
+					log.Printf("Error reading the slug description (%s)", err)
+					os.Exit(1)
+				}
+				file, err := os.Open(c.Args()[1])
+				if err != nil {
+					log.Printf("Error opening the slug (%s)", err)
+					os.Exit(1)
+				}
+				defer file.Close()
+				if err := gitreceive.ImportHerokuSlug(context.Background(), drivers.Artifacts, c.Args()[0], slug, file, cnf.ShardLength); err != nil {
+					log.Printf("Error importing the slug (%s)", err)
+					os.Exit(1)
+				}
+				log.Printf("Imported the slug, push commit %s to release it", slug.Commit)
+			},
+		},
 	}
 
 	app.Run(os.Args)
 }
+
+// envStorageDrivers returns the drivers of the storages of the builder, from the storage
+// parameters of its environment.
+func envStorageDrivers() (storage.Drivers, error) {
+	storageParams, err := conf.GetStorageParams(sys.RealEnv())
+	if err != nil {
+		return storage.Drivers{}, err
+	}
+	storageDriver, err := factory.Create("s3", storageParams)
+	if err != nil {
+		return storage.Drivers{}, err
+	}
+	return storageDrivers(storageDriver, false)
+}
+
+// podStorageDriver returns the driver of the object storage whose credentials are mounted in the
+// pods the builder runs, such as analysis pods.
+func podStorageDriver() (storagedriver.StorageDriver, error) {
+	storageParams, err := conf.GetStorageParams(sys.RealEnv())
+	if err != nil {
+		return nil, err
+	}
+	return factory.Create("s3", storageParams)
+}
+
+// runQueuedBuild builds the push of b that was queued off-peak, with the pre-receive hook of its
+// repository in gitHome, authenticated to the controller with a token minted by tokens. A failed
+// build returns the last line of its output, which tells what kind of error it was.
+func runQueuedBuild(gitHome string, repos git.RepoStore, tokens *controller.HookTokens, b buildqueue.Build) error {
+	hookEnv, err := tokens.Env(b.App, b.Username)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	input := fmt.Sprintf("%s %s %s", b.OldRev, b.NewRev, b.Ref)
+	err = git.RunPreReceiveHook(gitHome, b.Repository, repos, append(b.HookEnv(), hookEnv...), input, &out)
+	pkglog.Debug("Output of the queued build %s:\n%s", b.Ticket, out.String())
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if last := strings.TrimPrefix(lines[len(lines)-1], "\x1b[1G"); last != "" {
+			return fmt.Errorf("%s (%s)", last, err)
+		}
+	}
+	return err
+}
@@ -12,9 +12,11 @@ require (
 	github.com/drycc/pkg v0.0.0-20200811173146-1f2b2781a852
 	github.com/gorilla/mux v1.7.4 // indirect
 	github.com/kelseyhightower/envconfig v1.2.0
+	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/pborman/uuid v1.2.0
 	github.com/sirupsen/logrus v1.6.0 // indirect
 	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
 	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.18.6
 	k8s.io/apimachinery v0.18.6
@@ -0,0 +1,156 @@
+// Package buildcost estimates what builds cost, from the resources their pods request, how long
+// the pods run and a price table set by the operator, for platform teams to charge the build
+// capacity back to the teams of the apps.
+package buildcost
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// bytesPerGiB is the number of bytes of a GiB of memory.
+const bytesPerGiB = 1 << 30
+
+// Prices is the price table builds are costed with, read from a JSON file, usually mounted from a
+// ConfigMap.
+type Prices struct {
+	// Currency is the currency of the prices, e.g. "USD".
+	Currency string `json:"currency"`
+	// CPUCoreHour is the price of a CPU core for an hour.
+	CPUCoreHour float64 `json:"cpuCoreHour"`
+	// MemoryGiBHour is the price of a GiB of memory for an hour.
+	MemoryGiBHour float64 `json:"memoryGiBHour"`
+	// DefaultCPU and DefaultMemory are the resources costed for the containers that neither
+	// request nor limit them, e.g. "1" and "1Gi".
+	DefaultCPU    string `json:"defaultCPU,omitempty"`
+	DefaultMemory string `json:"defaultMemory,omitempty"`
+
+	defaultCPU, defaultMemory resource.Quantity
+}
+
+// LoadPrices reads the price table at path. It returns nil if there is none.
+func LoadPrices(path string) (*Prices, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p := new(Prices)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("build prices %s are malformed (%s)", path, err)
+	}
+	if p.Currency == "" {
+		return nil, fmt.Errorf("build prices %s have no currency", path)
+	}
+	if p.CPUCoreHour < 0 || p.MemoryGiBHour < 0 {
+		return nil, fmt.Errorf("build prices %s have a negative price", path)
+	}
+	if p.defaultCPU, err = parseQuantity(p.DefaultCPU); err != nil {
+		return nil, fmt.Errorf("build prices %s have an invalid defaultCPU %q (%s)", path, p.DefaultCPU, err)
+	}
+	if p.defaultMemory, err = parseQuantity(p.DefaultMemory); err != nil {
+		return nil, fmt.Errorf("build prices %s have an invalid defaultMemory %q (%s)", path, p.DefaultMemory, err)
+	}
+	return p, nil
+}
+
+func parseQuantity(raw string) (resource.Quantity, error) {
+	if raw == "" {
+		return resource.Quantity{}, nil
+	}
+	return resource.ParseQuantity(raw)
+}
+
+// Estimate is the approximate cost of the pods of a build, and the resources it's computed from.
+type Estimate struct {
+	Cost             float64 `json:"cost"`
+	CPUCoreSeconds   float64 `json:"cpuCoreSeconds"`
+	MemoryGiBSeconds float64 `json:"memoryGiBSeconds"`
+	PodSeconds       float64 `json:"podSeconds"`
+	Pods             int     `json:"pods"`
+}
+
+// Add returns the sum of e and o.
+func (e Estimate) Add(o Estimate) Estimate {
+	return Estimate{
+		Cost:             e.Cost + o.Cost,
+		CPUCoreSeconds:   e.CPUCoreSeconds + o.CPUCoreSeconds,
+		MemoryGiBSeconds: e.MemoryGiBSeconds + o.MemoryGiBSeconds,
+		PodSeconds:       e.PodSeconds + o.PodSeconds,
+		Pods:             e.Pods + o.Pods,
+	}
+}
+
+// Pod estimates the cost of pod, which ran from its start until its last container terminated,
+// or until now if one is still running. Each container is costed by its requests, or by its limits
+// if it has no requests, like the scheduler reserves capacity for it.
+func (p *Prices) Pod(pod *corev1.Pod, now time.Time) Estimate {
+	if pod == nil || pod.Status.StartTime == nil {
+		return Estimate{}
+	}
+	seconds := podEnd(pod, now).Sub(pod.Status.StartTime.Time).Seconds()
+	if seconds < 0 {
+		seconds = 0
+	}
+	cpu := p.podResource(pod, corev1.ResourceCPU, p.defaultCPU)
+	memory := p.podResource(pod, corev1.ResourceMemory, p.defaultMemory)
+	e := Estimate{
+		CPUCoreSeconds:   float64(cpu.MilliValue()) / 1000 * seconds,
+		MemoryGiBSeconds: float64(memory.Value()) / bytesPerGiB * seconds,
+		PodSeconds:       seconds,
+		Pods:             1,
+	}
+	e.Cost = e.CPUCoreSeconds/3600*p.CPUCoreHour + e.MemoryGiBSeconds/3600*p.MemoryGiBHour
+	return e
+}
+
+// podEnd returns when the last container of pod terminated, or now if one isn't terminated.
+func podEnd(pod *corev1.Pod, now time.Time) time.Time {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return now
+	}
+	var end time.Time
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			return now
+		}
+		if terminated.FinishedAt.After(end) {
+			end = terminated.FinishedAt.Time
+		}
+	}
+	return end
+}
+
+// podResource returns the amount of name the pod reserves: the sum over its containers, or the
+// largest of its init containers if that's more, since they run one at a time before them.
+func (p *Prices) podResource(pod *corev1.Pod, name corev1.ResourceName, def resource.Quantity) resource.Quantity {
+	var sum resource.Quantity
+	for _, c := range pod.Spec.Containers {
+		sum.Add(containerResource(c, name, def))
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if q := containerResource(c, name, def); q.Cmp(sum) > 0 {
+			sum = q
+		}
+	}
+	return sum
+}
+
+func containerResource(c corev1.Container, name corev1.ResourceName, def resource.Quantity) resource.Quantity {
+	if q, ok := c.Resources.Requests[name]; ok {
+		return q
+	}
+	if q, ok := c.Resources.Limits[name]; ok {
+		return q
+	}
+	return def
+}
@@ -0,0 +1,107 @@
+package buildcost
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadPrices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcost")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "prices.json")
+
+	prices, err := LoadPrices(path)
+	assert.NoErr(t, err)
+	assert.True(t, prices == nil, "prices without a price table")
+
+	for _, bad := range []string{
+		`{"cpuCoreHour": 0.04}`,
+		`{"currency": "USD", "cpuCoreHour": -1}`,
+		`{"currency": "USD", "defaultMemory": "lots"}`,
+		`{"currency": `,
+	} {
+		assert.NoErr(t, ioutil.WriteFile(path, []byte(bad), 0644))
+		_, err := LoadPrices(path)
+		assert.True(t, err != nil, "accepted the price table "+bad)
+	}
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"currency": "USD", "cpuCoreHour": 0.04, "memoryGiBHour": 0.005, "defaultCPU": "500m"}`), 0644))
+	prices, err = LoadPrices(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, prices.defaultCPU.MilliValue(), int64(500), "default CPU")
+}
+
+func TestPricesPod(t *testing.T) {
+	prices := &Prices{Currency: "USD", CPUCoreHour: 0.04, MemoryGiBHour: 0.01, defaultCPU: resource.MustParse("1")}
+	start := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+			}}},
+			Containers: []corev1.Container{
+				{Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+					Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4"), corev1.ResourceMemory: resource.MustParse("2Gi")},
+				}},
+				{},
+			},
+		},
+		Status: corev1.PodStatus{
+			StartTime: &metav1.Time{Time: start},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{FinishedAt: metav1.Time{Time: start.Add(30 * time.Minute)}}}},
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{FinishedAt: metav1.Time{Time: start.Add(time.Hour)}}}},
+			},
+		},
+	}
+
+	// 3 cores, the requests of the first container and the default of the second, and the 8GiB of
+	// the init container, for an hour
+	e := prices.Pod(pod, start.Add(2*time.Hour))
+	assert.Equal(t, e.PodSeconds, 3600.0, "pod seconds")
+	assert.Equal(t, e.CPUCoreSeconds, 3*3600.0, "CPU core seconds")
+	assert.Equal(t, e.MemoryGiBSeconds, 8*3600.0, "memory GiB seconds")
+	assert.True(t, e.Cost > 0.1999 && e.Cost < 0.2001, "cost")
+
+	pod.Status.ContainerStatuses[1].State = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	e = prices.Pod(pod, start.Add(2*time.Hour))
+	assert.Equal(t, e.PodSeconds, 7200.0, "pod seconds of a running pod")
+	assert.Equal(t, prices.Pod(&corev1.Pod{}, start), Estimate{}, "estimate of a pod that didn't start")
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcost")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, LedgerFile)
+
+	var buf bytes.Buffer
+	assert.NoErr(t, WriteMetrics(&buf, path))
+	assert.Equal(t, buf.String(), "", "metrics without costed builds")
+
+	build := Estimate{Cost: 0.5, CPUCoreSeconds: 60, MemoryGiBSeconds: 30, PodSeconds: 60, Pods: 1}
+	assert.NoErr(t, Record(path, "myapp", "USD", build))
+	assert.NoErr(t, Record(path, "myapp", "USD", build))
+	assert.NoErr(t, Record(path, "another", "USD", build))
+	totals, err := Totals(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, totals, []AppCosts{
+		{App: "another", Currency: "USD", Builds: 1, Estimate: build},
+		{App: "myapp", Currency: "USD", Builds: 2, Estimate: build.Add(build)},
+	}, "totals")
+
+	assert.NoErr(t, WriteMetrics(&buf, path))
+	assert.True(t, strings.Contains(buf.String(), `builder_build_cost_total{app="myapp",currency="USD"} 1`+"\n"), "cost metric")
+	assert.True(t, strings.Contains(buf.String(), `builder_builds_costed_total{app="another",currency="USD"} 1`+"\n"), "builds metric")
+}
@@ -0,0 +1,133 @@
+package buildcost
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// LedgerFile is the name of the ledger of the costs of the builds, in the git home. The builds
+// run in the pre-receive hooks, which record their costs for the server to report them.
+const LedgerFile = ".build-costs.json"
+
+// AppCosts are the totals of the builds of an app costed in a currency.
+type AppCosts struct {
+	App      string `json:"app"`
+	Currency string `json:"currency"`
+	Builds   int    `json:"builds"`
+	Estimate
+}
+
+// ledger is the content of the ledger file.
+type ledger struct {
+	Apps []AppCosts `json:"apps"`
+}
+
+// Record adds the estimate e of a build of app, in currency, to the ledger at path. Concurrent
+// builds lock the ledger while they update it.
+func Record(path, app, currency string, e Estimate) error {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("locking %s (%s)", path, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	l, err := readLedger(path)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range l.Apps {
+		if l.Apps[i].App == app && l.Apps[i].Currency == currency {
+			l.Apps[i].Builds++
+			l.Apps[i].Estimate = l.Apps[i].Estimate.Add(e)
+			found = true
+		}
+	}
+	if !found {
+		l.Apps = append(l.Apps, AppCosts{App: app, Currency: currency, Builds: 1, Estimate: e})
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Totals returns the totals of the builds of each app recorded in the ledger at path, sorted by
+// app and currency.
+func Totals(path string) ([]AppCosts, error) {
+	l, err := readLedger(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(l.Apps, func(i, j int) bool {
+		if l.Apps[i].App != l.Apps[j].App {
+			return l.Apps[i].App < l.Apps[j].App
+		}
+		return l.Apps[i].Currency < l.Apps[j].Currency
+	})
+	return l.Apps, nil
+}
+
+func readLedger(path string) (*ledger, error) {
+	l := new(ledger)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("the build cost ledger %s is malformed (%s)", path, err)
+	}
+	return l, nil
+}
+
+// WriteMetrics writes the totals of the ledger at path to w in the Prometheus text format. It
+// writes nothing if no build was costed.
+func WriteMetrics(w io.Writer, path string) error {
+	totals, err := Totals(path)
+	if err != nil || len(totals) == 0 {
+		return err
+	}
+	metrics := []struct {
+		name, help string
+		value      func(AppCosts) float64
+	}{
+		{"builder_builds_costed_total", "Builds whose cost was estimated.", func(c AppCosts) float64 { return float64(c.Builds) }},
+		{"builder_build_cost_total", "Estimated cost of the builds, in the currency of the price table.", func(c AppCosts) float64 { return c.Cost }},
+		{"builder_build_cpu_core_seconds_total", "CPU core seconds reserved by the builder pods.", func(c AppCosts) float64 { return c.CPUCoreSeconds }},
+		{"builder_build_memory_gib_seconds_total", "GiB seconds of memory reserved by the builder pods.", func(c AppCosts) float64 { return c.MemoryGiBSeconds }},
+		{"builder_build_pod_seconds_total", "Seconds the builder pods ran.", func(c AppCosts) float64 { return c.PodSeconds }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", m.name)
+		for _, c := range totals {
+			fmt.Fprintf(w, "%s{app=%q,currency=%q} %g\n", m.name, c.App, c.Currency, m.value(c))
+		}
+	}
+	return nil
+}
@@ -5,8 +5,10 @@
 package pkg
 
 import (
-	"fmt"
+	"time"
 
+	"github.com/drycc/builder/pkg/controller"
+	"github.com/drycc/builder/pkg/git"
 	"github.com/drycc/builder/pkg/sshd"
 	"github.com/drycc/pkg/log"
 )
@@ -24,16 +26,48 @@ const (
 // is SSH. Builder listens for new Git commands and then sends those on to
 // Git.
 //
+// The status of the builds queued off-peak is looked up in store, and push sessions are recorded
+// to it if session recording is enabled. The hooks of pushes authenticate to the controller with
+// the tokens minted by tokens, or with the builder key if it's nil.
+//
 // Run returns on of the Status* status code constants.
-func RunBuilder(cnf *sshd.Config, gitHomeDir string, sshServerCircuit *sshd.Circuit, pushLock sshd.RepositoryLock) int {
-	address := fmt.Sprintf("%s:%d", cnf.SSHHostIP, cnf.SSHHostPort)
-	cfg, err := sshd.Configure(cnf)
+func RunBuilder(cnf *sshd.Config, gitHomeDir string, repos git.RepoStore, sshServerCircuit *sshd.Circuit, pushLock sshd.RepositoryLock, limiter *sshd.Limiter, store sshd.ObjectStore, tokens *controller.HookTokens) int {
+	address := cnf.SSHAddr()
+	cfg, err := sshd.Configure(cnf, limiter)
 	if err != nil {
 		log.Err("SSH server configuration failed: %s", err)
 		return StatusLocalError
 	}
-	receivetype := "gitreceive"
-	if err := sshd.Serve(cfg, sshServerCircuit, gitHomeDir, pushLock, address, receivetype); err != nil {
+	recorder, err := sshd.NewSessionRecorder(cnf, store)
+	if err != nil {
+		log.Err("SSH session recording configuration failed: %s", err)
+		return StatusLocalError
+	}
+	if recorder != nil {
+		log.Info("Recording push sessions")
+		go recorder.RunRetention(time.Hour)
+	}
+	proxy, err := sshd.NewProxyProtocol(cnf)
+	if err != nil {
+		log.Err("SSH server configuration failed: %s", err)
+		return StatusLocalError
+	}
+	if proxy != nil {
+		log.Info("Reading the address of SSH clients from the PROXY protocol header")
+	}
+	opts := sshd.ServeOptions{
+		Addr:        address,
+		GitHome:     gitHomeDir,
+		Repos:       repos,
+		PushLock:    pushLock,
+		Limiter:     limiter,
+		Store:       store,
+		Recorder:    recorder,
+		Tokens:      tokens,
+		Proxy:       proxy,
+		ReceiveType: "gitreceive",
+	}
+	if err := sshd.Serve(cfg, sshServerCircuit, opts); err != nil {
 		log.Err("SSH server failed: %s", err)
 		return StatusLocalError
 	}
@@ -0,0 +1,253 @@
+// Package buildqueue keeps the builds pushers scheduled off-peak, and runs them during the
+// off-peak window of the builder.
+package buildqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+)
+
+// Prefix is the object storage prefix under which queued builds are stored.
+const Prefix = "/builds/queued"
+
+// The statuses of queued builds.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Build is a push whose build was queued to run off-peak. Its ticket identifies it to the pusher.
+type Build struct {
+	Ticket      string `json:"ticket"`
+	App         string `json:"app"`
+	Repository  string `json:"repository"`
+	Username    string `json:"username"`
+	Fingerprint string `json:"fingerprint"`
+	// Connection is the SSH_CONNECTION of the push.
+	Connection  string            `json:"connection"`
+	OldRev      string            `json:"oldRev"`
+	NewRev      string            `json:"newRev"`
+	Ref         string            `json:"ref"`
+	Sha         string            `json:"sha"`
+	PushOptions map[string]string `json:"pushOptions,omitempty"`
+
+	Status   string    `json:"status"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Error is the error the build failed with.
+	Error string `json:"error,omitempty"`
+}
+
+// NewTicket returns a new ticket ID.
+func NewTicket() string {
+	return strings.Split(uuid.New(), "-")[0]
+}
+
+// Key returns the object storage key b is stored under.
+func (b Build) Key() string {
+	return path.Join(Prefix, b.Ticket+".json")
+}
+
+// Describe returns a line telling the pusher what happened to b.
+func (b Build) Describe() string {
+	desc := fmt.Sprintf("%s: git-%s of %s, queued by %s at %s, %s", b.Ticket, b.Sha, b.App, b.Username, b.Queued.Format(time.RFC3339), b.Status)
+	switch b.Status {
+	case StatusRunning:
+		desc += " since " + b.Started.Format(time.RFC3339)
+	case StatusSucceeded, StatusFailed:
+		desc += " at " + b.Finished.Format(time.RFC3339)
+	}
+	if b.Error != "" {
+		desc += " (" + b.Error + ")"
+	}
+	return desc
+}
+
+// HookEnv returns the environment the pre-receive hook runs the build of b with: the one of its
+// push, with its push options and schedule=now, for the build not to be queued again.
+func (b Build) HookEnv() []string {
+	env := git.ReceiveEnv(b.Repository, "git-receive-pack", b.Fingerprint, b.Username, b.Connection)
+	keys := make([]string, 0, len(b.PushOptions))
+	for k := range b.PushOptions {
+		if k != "schedule" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	opts := []string{"schedule=now"}
+	for _, k := range keys {
+		if v := b.PushOptions[k]; v != "" {
+			opts = append(opts, k+"="+v)
+		} else {
+			opts = append(opts, k)
+		}
+	}
+	env = append(env, "GIT_PUSH_OPTION_COUNT="+strconv.Itoa(len(opts)))
+	for i, opt := range opts {
+		env = append(env, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, opt))
+	}
+	return env
+}
+
+// Store is the subset of a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// the queue needs.
+type Store interface {
+	GetContent(ctx context.Context, path string) ([]byte, error)
+	PutContent(ctx context.Context, path string, content []byte) error
+	List(ctx context.Context, path string) ([]string, error)
+	Delete(ctx context.Context, path string) error
+}
+
+// Enqueue durably stores b, queued if it has no status yet.
+func Enqueue(store Store, b Build) error {
+	if b.Status == "" {
+		b.Status = StatusQueued
+	}
+	if b.Queued.IsZero() {
+		b.Queued = time.Now().UTC()
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return store.PutContent(context.Background(), b.Key(), data)
+}
+
+// Get returns the build of ticket, or nil if there's none.
+func Get(store Store, ticket string) (*Build, error) {
+	data, err := store.GetContent(context.Background(), Build{Ticket: ticket}.Key())
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	b := new(Build)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("decoding the queued build %s (%s)", ticket, err)
+	}
+	return b, nil
+}
+
+// All returns all the builds of the queue, the oldest first.
+func All(store Store) ([]Build, error) {
+	keys, err := store.List(context.Background(), Prefix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var builds []Build
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		data, err := store.GetContent(context.Background(), key)
+		if err != nil {
+			log.Err("Build queue error reading %s (%s)", key, err)
+			continue
+		}
+		var b Build
+		if err := json.Unmarshal(data, &b); err != nil {
+			log.Err("Build queue error decoding %s (%s)", key, err)
+			continue
+		}
+		builds = append(builds, b)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Queued.Before(builds[j].Queued) })
+	return builds, nil
+}
+
+// Lock is the subset of a (github.com/drycc/builder/pkg/sshd).RepositoryLock the queue needs, for
+// queued builds not to run along with pushes of their app, or twice in replicas of the builder.
+type Lock interface {
+	Lock(repoName string) error
+	Unlock(repoName string) error
+}
+
+// processQueue runs the queued builds one after the other, as long as now is in window. Builds
+// that ended more than maxAge ago are removed from the queue.
+func processQueue(store Store, window *Window, lock Lock, run func(Build) error, now func() time.Time, maxAge time.Duration) error {
+	builds, err := All(store)
+	if err != nil {
+		return err
+	}
+	for _, b := range builds {
+		switch b.Status {
+		case StatusSucceeded, StatusFailed:
+			if now().Sub(b.Finished) > maxAge {
+				if err := store.Delete(context.Background(), b.Key()); err != nil {
+					log.Err("Build queue error deleting %s (%s)", b.Key(), err)
+				}
+			}
+			continue
+		case StatusRunning:
+			// the replica running it went away
+			if now().Sub(b.Started) <= maxAge {
+				continue
+			}
+		}
+		if !window.Contains(now()) {
+			continue
+		}
+		if err := lock.Lock(b.App); err != nil {
+			log.Debug("Build queue skipping %s, %s is locked (%s)", b.Ticket, b.App, err)
+			continue
+		}
+		runQueued(store, b, run, now)
+		if err := lock.Unlock(b.App); err != nil {
+			log.Err("Build queue error unlocking %s (%s)", b.App, err)
+		}
+	}
+	return nil
+}
+
+// runQueued runs b with run, unless another replica already did, and stores how it ended.
+func runQueued(store Store, b Build, run func(Build) error, now func() time.Time) {
+	current, err := Get(store, b.Ticket)
+	if err != nil || current == nil || current.Status != b.Status {
+		return
+	}
+	log.Info("Build queue running %s (git-%s of %s)", b.Ticket, b.Sha, b.App)
+	b.Status, b.Started, b.Error = StatusRunning, now().UTC(), ""
+	if err := Enqueue(store, b); err != nil {
+		log.Err("Build queue error updating %s (%s)", b.Key(), err)
+		return
+	}
+	err = run(b)
+	b.Status, b.Finished = StatusSucceeded, now().UTC()
+	if err != nil {
+		log.Err("Build queue build %s failed (%s)", b.Ticket, err)
+		b.Status, b.Error = StatusFailed, err.Error()
+	}
+	if err := Enqueue(store, b); err != nil {
+		log.Err("Build queue error updating %s (%s)", b.Key(), err)
+	}
+}
+
+// Run runs the queued builds with run during window, checking the queue every pollSleepDuration
+// until the process exits. Builds that ended are kept for their status to be looked up for maxAge.
+// Errors are logged rather than returned.
+func Run(store Store, window *Window, lock Lock, run func(Build) error, pollSleepDuration, maxAge time.Duration) error {
+	for {
+		if err := processQueue(store, window, lock, run, time.Now, maxAge); err != nil {
+			log.Err("Build queue error listing queued builds (%s)", err)
+		}
+		time.Sleep(pollSleepDuration)
+	}
+}
@@ -0,0 +1,101 @@
+package buildqueue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+type fakeLock map[string]bool
+
+func (l fakeLock) Lock(repo string) error {
+	if l[repo] {
+		return errors.New("locked")
+	}
+	l[repo] = true
+	return nil
+}
+
+func (l fakeLock) Unlock(repo string) error {
+	delete(l, repo)
+	return nil
+}
+
+func TestEnqueueGet(t *testing.T) {
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	b, err := Get(store, "missing")
+	assert.NoErr(t, err)
+	assert.True(t, b == nil, "missing build")
+
+	ticket := NewTicket()
+	assert.Equal(t, len(ticket), 8, "length of the ticket")
+	assert.NoErr(t, Enqueue(store, Build{Ticket: ticket, App: "myapp", Sha: "abc1234"}))
+	b, err = Get(store, ticket)
+	assert.NoErr(t, err)
+	assert.Equal(t, b.Status, StatusQueued, "status")
+	assert.False(t, b.Queued.IsZero(), "queued time not set")
+	assert.True(t, strings.HasPrefix(b.Describe(), ticket+": git-abc1234 of myapp"), "description "+b.Describe())
+}
+
+func TestHookEnv(t *testing.T) {
+	b := Build{Repository: "myapp.git", Username: "alice", PushOptions: map[string]string{"schedule": "off-peak", "clear-cache": "", "env:LOG_LEVEL": "debug"}}
+	env := b.HookEnv()
+	assert.Equal(t, env[len(env)-4:], []string{
+		"GIT_PUSH_OPTION_COUNT=3",
+		"GIT_PUSH_OPTION_0=schedule=now",
+		"GIT_PUSH_OPTION_1=clear-cache",
+		"GIT_PUSH_OPTION_2=env:LOG_LEVEL=debug",
+	}, "push options")
+	assert.Equal(t, env[0], "RECEIVE_USER=alice", "user")
+}
+
+func TestProcessQueue(t *testing.T) {
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	window, err := ParseWindow("22:00-06:00")
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, Enqueue(store, Build{Ticket: "ok", App: "ok", Queued: now.Add(-3 * time.Hour)}))
+	assert.NoErr(t, Enqueue(store, Build{Ticket: "broken", App: "broken", Queued: now.Add(-2 * time.Hour)}))
+	assert.NoErr(t, Enqueue(store, Build{Ticket: "locked", App: "locked", Queued: now.Add(-time.Hour)}))
+	assert.NoErr(t, Enqueue(store, Build{Ticket: "old", App: "old", Status: StatusSucceeded, Finished: now.Add(-48 * time.Hour)}))
+
+	var ran []string
+	run := func(b Build) error {
+		ran = append(ran, b.Ticket)
+		if b.App == "broken" {
+			return errors.New("push rejected")
+		}
+		return nil
+	}
+	lock := fakeLock{"locked": true}
+	assert.NoErr(t, processQueue(store, window, lock, run, clock, 24*time.Hour))
+	assert.Equal(t, ran, []string{"ok", "broken"}, "builds run")
+
+	builds, err := All(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(builds), 3, "builds kept")
+	statuses := map[string]string{}
+	for _, b := range builds {
+		statuses[b.Ticket] = b.Status
+	}
+	assert.Equal(t, statuses, map[string]string{"ok": StatusSucceeded, "broken": StatusFailed, "locked": StatusQueued}, "statuses")
+	broken, err := Get(store, "broken")
+	assert.NoErr(t, err)
+	assert.Equal(t, broken.Error, "push rejected", "error")
+
+	// out of the window, queued builds wait
+	ran = nil
+	delete(lock, "locked")
+	now = time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	assert.NoErr(t, processQueue(store, window, lock, run, clock, 24*time.Hour))
+	assert.Equal(t, len(ran), 0, "builds run out of the window")
+}
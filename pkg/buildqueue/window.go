@@ -0,0 +1,68 @@
+package buildqueue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily period of time, in UTC, e.g. 22:00-06:00.
+type Window struct {
+	start, end time.Duration
+}
+
+// ParseWindow parses a window given as HH:MM-HH:MM in UTC. The window ends the next day if its
+// end is before its start. An empty window is nil.
+func ParseWindow(s string) (*Window, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("%q isn't a window like 22:00-06:00", s)
+	}
+	w := new(Window)
+	for i, d := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(bounds[i]))
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a window like 22:00-06:00 (%s)", s, err)
+		}
+		*d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("the window %q is empty", s)
+	}
+	return w, nil
+}
+
+// String returns w as HH:MM-HH:MM.
+func (w *Window) String() string {
+	clock := func(d time.Duration) string { return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60) }
+	return clock(w.start) + "-" + clock(w.end)
+}
+
+// Contains returns true if t is in w. A nil window contains no time.
+func (w *Window) Contains(t time.Time) bool {
+	if w == nil {
+		return false
+	}
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// Next returns the time the next occurrence of w starts after t, or t if it's in w.
+func (w *Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Add(w.start)
+	if next.Before(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
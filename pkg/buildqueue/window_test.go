@@ -0,0 +1,43 @@
+package buildqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("22:00-06:30")
+	assert.NoErr(t, err)
+	assert.Equal(t, w.String(), "22:00-06:30", "window")
+	w, err = ParseWindow("")
+	assert.NoErr(t, err)
+	assert.True(t, w == nil, "empty window")
+
+	for _, s := range []string{"22:00", "22-06", "25:00-06:00", "06:00-06:00"} {
+		_, err := ParseWindow(s)
+		assert.True(t, err != nil, "parsed "+s)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse(time.RFC3339, "2024-05-01T"+clock+":00Z")
+		return t
+	}
+	overnight, err := ParseWindow("22:00-06:00")
+	assert.NoErr(t, err)
+	for clock, in := range map[string]bool{"21:59": false, "22:00": true, "23:30": true, "00:00": true, "05:59": true, "06:00": false, "12:00": false} {
+		assert.Equal(t, overnight.Contains(at(clock)), in, clock)
+	}
+	daytime, err := ParseWindow("12:00-13:00")
+	assert.NoErr(t, err)
+	assert.True(t, daytime.Contains(at("12:30")), "12:30 in 12:00-13:00")
+	assert.False(t, daytime.Contains(at("13:30")), "13:30 in 12:00-13:00")
+	assert.False(t, (*Window)(nil).Contains(at("12:30")), "nil window contains a time")
+
+	assert.Equal(t, overnight.Next(at("12:00")), at("22:00"), "next start the same day")
+	assert.Equal(t, overnight.Next(at("23:00")), at("23:00"), "next start in the window")
+	assert.Equal(t, daytime.Next(at("14:00")), at("12:00").AddDate(0, 0, 1), "next start the next day")
+}
@@ -0,0 +1,167 @@
+// Package buildstats keeps the history of the builds of each app in the object storage, and
+// computes statistics of it, for teams to notice when their builds regress.
+package buildstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+// KeyPattern is the template for the object storage key of the build history of an app.
+const KeyPattern = "home/%s/build-stats.json"
+
+// The history of an app keeps its last maxBuilds builds, of the last maxAge at most.
+const (
+	maxBuilds = 500
+	maxAge    = 90 * 24 * time.Hour
+)
+
+// The cache outcomes of builds.
+const (
+	// CacheHit is a build that started with the build cache of its app.
+	CacheHit = "hit"
+	// CacheMiss is a build that started without one, because there was none yet or it was cleared.
+	CacheMiss = "miss"
+)
+
+// Build is the record of a build in the history of its app.
+type Build struct {
+	Sha      string    `json:"sha"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"durationSeconds"`
+	// FailureReason is the kind of error the build failed with, infra, user, policy or timeout,
+	// empty if it succeeded.
+	FailureReason string `json:"failureReason,omitempty"`
+	// Size is the size of the slug in bytes, zero if it's unknown or the build has none.
+	Size int64 `json:"sizeBytes,omitempty"`
+	// Cache is CacheHit or CacheMiss, empty for builds that don't use a cache.
+	Cache string `json:"cache,omitempty"`
+}
+
+// Succeeded returns true if b didn't fail.
+func (b Build) Succeeded() bool {
+	return b.FailureReason == ""
+}
+
+// History is the history of the builds of an app, from the oldest to the latest.
+type History struct {
+	App    string  `json:"app"`
+	Builds []Build `json:"builds"`
+}
+
+// Load returns the history of app stored in getter, empty if it has none yet.
+func Load(getter storage.ObjectGetter, app string) (*History, error) {
+	h := &History{App: app}
+	data, err := getter.GetContent(context.Background(), fmt.Sprintf(KeyPattern, app))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return h, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading the build history of %s (%s)", app, err)
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, fmt.Errorf("the build history of %s is malformed (%s)", app, err)
+	}
+	return h, nil
+}
+
+// Add adds b to h, and forgets the builds that are too old or too many as of now.
+func (h *History) Add(b Build, now time.Time) {
+	h.Builds = append(h.Builds, b)
+	first := 0
+	if len(h.Builds) > maxBuilds {
+		first = len(h.Builds) - maxBuilds
+	}
+	for first < len(h.Builds) && now.Sub(h.Builds[first].Finished) > maxAge {
+		first++
+	}
+	h.Builds = h.Builds[first:]
+}
+
+// Save stores h in putter, for its app.
+func (h *History) Save(putter storage.ObjectPutter) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := putter.PutContent(context.Background(), fmt.Sprintf(KeyPattern, h.App), data); err != nil {
+		return fmt.Errorf("storing the build history of %s (%s)", h.App, err)
+	}
+	return nil
+}
+
+// Stats are the statistics of the builds of an app that finished since a time.
+type Stats struct {
+	App      string    `json:"app"`
+	Since    time.Time `json:"since"`
+	Builds   int       `json:"builds"`
+	Failures int       `json:"failures"`
+	// FailureReasons counts the failed builds by the kind of error they failed with.
+	FailureReasons map[string]int `json:"failureReasons,omitempty"`
+	// The durations are those of the builds that succeeded, in seconds.
+	MedianDuration float64 `json:"medianDurationSeconds"`
+	P90Duration    float64 `json:"p90DurationSeconds"`
+	MedianSize     int64   `json:"medianSizeBytes,omitempty"`
+	// CacheHitRate is the share of the cached builds that started with a cache, from 0 to 1, nil
+	// if no build used a cache.
+	CacheHitRate *float64 `json:"cacheHitRate,omitempty"`
+}
+
+// Stats returns the statistics of the builds of h that finished since.
+func (h *History) Stats(since time.Time) Stats {
+	s := Stats{App: h.App, Since: since}
+	var durations []float64
+	var sizes []float64
+	cached, hits := 0, 0
+	for _, b := range h.Builds {
+		if b.Finished.Before(since) {
+			continue
+		}
+		s.Builds++
+		if !b.Succeeded() {
+			s.Failures++
+			if s.FailureReasons == nil {
+				s.FailureReasons = make(map[string]int)
+			}
+			s.FailureReasons[b.FailureReason]++
+			continue
+		}
+		durations = append(durations, b.Duration)
+		if b.Size > 0 {
+			sizes = append(sizes, float64(b.Size))
+		}
+		if b.Cache != "" {
+			cached++
+			if b.Cache == CacheHit {
+				hits++
+			}
+		}
+	}
+	s.MedianDuration = percentile(durations, 50)
+	s.P90Duration = percentile(durations, 90)
+	s.MedianSize = int64(percentile(sizes, 50))
+	if cached > 0 {
+		rate := float64(hits) / float64(cached)
+		s.CacheHitRate = &rate
+	}
+	return s
+}
+
+// percentile returns the nearest-rank pth percentile of values, zero if there are none.
+func percentile(values []float64, p int) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,49 @@
+package buildstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+func TestHistory(t *testing.T) {
+	storagedriver.PathRegexp = storage.KeyRegexp
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	h, err := Load(store, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(h.Builds), 0, "builds of a new app")
+
+	now := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	h.Add(Build{Sha: "old", Finished: now.Add(-100 * 24 * time.Hour)}, now.Add(-100*24*time.Hour))
+	h.Add(Build{Sha: "1", Finished: now.Add(-40 * 24 * time.Hour), Duration: 600}, now)
+	h.Add(Build{Sha: "2", Finished: now.Add(-3 * time.Hour), Duration: 100, Size: 3000, Cache: CacheMiss}, now)
+	h.Add(Build{Sha: "3", Finished: now.Add(-2 * time.Hour), Duration: 120, Size: 1000, Cache: CacheHit}, now)
+	h.Add(Build{Sha: "4", Finished: now.Add(-time.Hour), Duration: 10, FailureReason: "user"}, now)
+	h.Add(Build{Sha: "5", Finished: now, Duration: 90, Cache: CacheHit}, now)
+	assert.Equal(t, len(h.Builds), 5, "builds kept")
+	assert.NoErr(t, h.Save(store))
+
+	h, err = Load(store, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, h.Builds[0].Sha, "1", "oldest build kept")
+	stats := h.Stats(now.Add(-30 * 24 * time.Hour))
+	assert.Equal(t, stats.Builds, 4, "builds")
+	assert.Equal(t, stats.Failures, 1, "failures")
+	assert.Equal(t, stats.FailureReasons, map[string]int{"user": 1}, "failure reasons")
+	assert.Equal(t, stats.MedianDuration, 100.0, "median duration")
+	assert.Equal(t, stats.P90Duration, 120.0, "p90 duration")
+	assert.Equal(t, stats.MedianSize, int64(1000), "median size")
+	assert.True(t, stats.CacheHitRate != nil, "no cache hit rate")
+	assert.Equal(t, *stats.CacheHitRate, 2.0/3, "cache hit rate")
+
+	for i := 0; i < maxBuilds; i++ {
+		h.Add(Build{Finished: now}, now)
+	}
+	assert.Equal(t, len(h.Builds), maxBuilds, "builds kept")
+}
@@ -0,0 +1,184 @@
+package cleaner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// buildDirName is the directory of each repo in which builds check their source out.
+const buildDirName = "build"
+
+// The totals of the build artifacts removed since the builder started.
+var (
+	removedArtifacts int64
+	reclaimedBytes   int64
+)
+
+// BuildArtifactStats returns the number of stale build artifacts removed since the builder
+// started, and the number of bytes they took.
+func BuildArtifactStats() (removed, reclaimed int64) {
+	return atomic.LoadInt64(&removedArtifacts), atomic.LoadInt64(&reclaimedBytes)
+}
+
+// entries returns the paths of the entries of dir, none if it doesn't exist.
+func entries(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		paths = append(paths, filepath.Join(dir, info.Name()))
+	}
+	return paths, nil
+}
+
+// sourceArchives returns the paths of the source archives written to the repo at repoDir.
+func sourceArchives(repoDir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, info := range infos {
+		if !info.IsDir() && (strings.HasSuffix(info.Name(), ".tar.gz") || strings.HasSuffix(info.Name(), ".tar.zst")) {
+			archives = append(archives, filepath.Join(repoDir, info.Name()))
+		}
+	}
+	return archives, nil
+}
+
+// buildArtifacts returns the paths of the build artifacts: the source archives written to the
+// repos in gitHome, and the entries of their build directories left behind by builds that didn't
+// clean up after themselves. The build directories are in the repos, or under buildTmpDir if it's
+// set, where those of the repos deleted since are listed too.
+func buildArtifacts(gitHome, buildTmpDir string) []string {
+	var artifacts []string
+	repos, err := localDirs(gitHome, dirHasGitSuffix)
+	if err != nil {
+		log.Err("Cleaner error listing local git directories (%s)", err)
+	}
+	for _, repo := range repos {
+		archives, err := sourceArchives(filepath.Join(gitHome, repo))
+		if err != nil {
+			log.Err("Cleaner error listing the build artifacts of %s (%s)", repo, err)
+			continue
+		}
+		artifacts = append(artifacts, archives...)
+		if buildTmpDir == "" {
+			leftovers, err := entries(filepath.Join(gitHome, repo, buildDirName))
+			if err != nil {
+				log.Err("Cleaner error listing the build artifacts of %s (%s)", repo, err)
+			}
+			artifacts = append(artifacts, leftovers...)
+		}
+	}
+	if buildTmpDir == "" {
+		return artifacts
+	}
+	for _, buildDir := range repoBuildDirs(buildTmpDir) {
+		leftovers, err := entries(buildDir)
+		if err != nil {
+			log.Err("Cleaner error listing the build artifacts in %s (%s)", buildDir, err)
+			continue
+		}
+		artifacts = append(artifacts, leftovers...)
+	}
+	return artifacts
+}
+
+// usage returns the size of the file or directory at path and the time it, or any file under
+// it, was last modified.
+func usage(path string) (int64, time.Time, error) {
+	var size int64
+	var modTime time.Time
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+		return nil
+	})
+	return size, modTime, err
+}
+
+// repoBuildDirs returns the paths of the build directories of repos under buildTmpDir.
+func repoBuildDirs(buildTmpDir string) []string {
+	repos, err := localDirs(buildTmpDir, dirHasGitSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		log.Err("Cleaner error listing the build directories in %s (%s)", buildTmpDir, err)
+	}
+	var buildDirs []string
+	for _, repo := range repos {
+		buildDirs = append(buildDirs, filepath.Join(buildTmpDir, repo))
+	}
+	return buildDirs
+}
+
+// removeStaleBuildArtifacts removes the build artifacts that weren't modified for ttl, returning
+// how many were removed and the bytes they took, and the build directories under buildTmpDir left
+// empty by the repos deleted from gitHome. Errors are logged, so that one artifact can't keep the
+// others from being removed.
+func removeStaleBuildArtifacts(gitHome, buildTmpDir string, ttl time.Duration, now time.Time) (int64, int64) {
+	var removed, reclaimed int64
+	for _, artifact := range buildArtifacts(gitHome, buildTmpDir) {
+		size, modTime, err := usage(artifact)
+		if err != nil {
+			log.Err("Cleaner error reading build artifact %s (%s)", artifact, err)
+			continue
+		}
+		if now.Sub(modTime) < ttl {
+			continue
+		}
+		if err := os.RemoveAll(artifact); err != nil {
+			log.Err("Cleaner error removing build artifact %s (%s)", artifact, err)
+			continue
+		}
+		log.Debug("Cleaner removed build artifact %s (%d bytes)", artifact, size)
+		removed++
+		reclaimed += size
+	}
+	if buildTmpDir != "" {
+		removeDeletedBuildDirs(gitHome, buildTmpDir)
+	}
+	atomic.AddInt64(&removedArtifacts, removed)
+	atomic.AddInt64(&reclaimedBytes, reclaimed)
+	return removed, reclaimed
+}
+
+// removeDeletedBuildDirs removes the empty build directories under buildTmpDir of the repos that
+// aren't in gitHome anymore.
+func removeDeletedBuildDirs(gitHome, buildTmpDir string) {
+	for _, buildDir := range repoBuildDirs(buildTmpDir) {
+		if _, err := os.Stat(filepath.Join(gitHome, filepath.Base(buildDir))); !os.IsNotExist(err) {
+			continue
+		}
+		// only empty directories are removed, builds of a repo pushed again meanwhile go on
+		if err := os.Remove(buildDir); err == nil {
+			log.Debug("Cleaner removed the build directory %s of a deleted repo", buildDir)
+		}
+	}
+}
+
+// RunBuildArtifactGC removes the build artifacts of the repos in gitHome, with their build
+// directories under buildTmpDir if it's set, that weren't modified for ttl, and those of the repos
+// deleted since, at startup, then every interval, until the process exits.
+func RunBuildArtifactGC(gitHome, buildTmpDir string, ttl, interval time.Duration) {
+	for {
+		if removed, reclaimed := removeStaleBuildArtifacts(gitHome, buildTmpDir, ttl, time.Now()); removed > 0 {
+			log.Info("Cleaner removed %d stale build artifacts, reclaiming %d bytes", removed, reclaimed)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,85 @@
+package cleaner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestRemoveStaleBuildArtifacts(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(gitHome)
+	repoDir := filepath.Join(gitHome, "app.git")
+	staleDir := filepath.Join(repoDir, buildDirName, "tmp123")
+	freshDir := filepath.Join(repoDir, buildDirName, "tmp456")
+	for _, dir := range []string{filepath.Join(repoDir, "objects"), staleDir, freshDir} {
+		assert.NoErr(t, os.MkdirAll(dir, 0755))
+	}
+	files := map[string]string{
+		filepath.Join(staleDir, "Procfile"):    "web: app",
+		filepath.Join(freshDir, "Procfile"):    "web: app",
+		filepath.Join(repoDir, "app.tar.gz"):   "1234567890",
+		filepath.Join(repoDir, "HEAD"):         "ref: refs/heads/master",
+		filepath.Join(repoDir, "objects", "x"): "object",
+	}
+	for path, data := range files {
+		assert.NoErr(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	for _, path := range []string{repoDir, staleDir, filepath.Join(staleDir, "Procfile"), filepath.Join(repoDir, "app.tar.gz"), filepath.Join(repoDir, "HEAD"), filepath.Join(repoDir, "objects", "x")} {
+		assert.NoErr(t, os.Chtimes(path, old, old))
+	}
+
+	removedBefore, reclaimedBefore := BuildArtifactStats()
+	removed, reclaimed := removeStaleBuildArtifacts(gitHome, "", time.Hour, now)
+	assert.Equal(t, removed, int64(2), "removed artifacts")
+	assert.Equal(t, reclaimed, int64(len("web: app")+len("1234567890")), "reclaimed bytes")
+	removedAfter, reclaimedAfter := BuildArtifactStats()
+	assert.Equal(t, removedAfter-removedBefore, removed, "removed artifacts stat")
+	assert.Equal(t, reclaimedAfter-reclaimedBefore, reclaimed, "reclaimed bytes stat")
+
+	for _, path := range []string{staleDir, filepath.Join(repoDir, "app.tar.gz")} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path+" wasn't removed")
+	}
+	for _, path := range []string{filepath.Join(freshDir, "Procfile"), filepath.Join(repoDir, "HEAD"), filepath.Join(repoDir, "objects", "x")} {
+		_, err := os.Stat(path)
+		assert.NoErr(t, err)
+	}
+}
+
+func TestRemoveStaleBuildArtifactsInBuildTmpDir(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(gitHome)
+	buildTmpDir := filepath.Join(gitHome, "builds")
+	staleDir := filepath.Join(buildTmpDir, "app.git", "tmp123")
+	assert.NoErr(t, os.MkdirAll(filepath.Join(gitHome, "app.git"), 0755))
+	assert.NoErr(t, os.MkdirAll(staleDir, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(staleDir, "Procfile"), []byte("web: app"), 0644))
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	for _, path := range []string{staleDir, filepath.Join(staleDir, "Procfile")} {
+		assert.NoErr(t, os.Chtimes(path, old, old))
+	}
+
+	// the build directories of deleted repos are removed too
+	deletedDir := filepath.Join(buildTmpDir, "deleted.git")
+	assert.NoErr(t, os.MkdirAll(filepath.Join(deletedDir, "tmp789"), 0755))
+	assert.NoErr(t, os.Chtimes(filepath.Join(deletedDir, "tmp789"), old, old))
+
+	removed, _ := removeStaleBuildArtifacts(gitHome, buildTmpDir, time.Hour, now)
+	assert.Equal(t, removed, int64(2), "removed artifacts")
+	for _, path := range []string{staleDir, deletedDir} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path+" wasn't removed")
+	}
+	_, err = os.Stat(filepath.Join(buildTmpDir, "app.git"))
+	assert.NoErr(t, err)
+}
@@ -13,8 +13,11 @@ import (
 
 	//"github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/git"
 	"github.com/drycc/builder/pkg/gitreceive"
 	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/release"
+	"github.com/drycc/builder/pkg/storage"
 	"github.com/drycc/builder/pkg/sys"
 	"github.com/drycc/pkg/log"
 	corev1 "k8s.io/api/core/v1"
@@ -87,26 +90,65 @@ func dirHasGitSuffix(dir string) bool {
 	return strings.HasSuffix(dir, dotGitSuffix)
 }
 
-func deleteFromObjectStore(app string, storageDriver storagedriver.StorageDriver) error {
+func deleteFromObjectStore(app string, shardLength int, drivers storage.Drivers) error {
+	// artifacts may be kept under both the flat and the sharded key scheme
+	prefixes := []string{""}
+	if prefix := gitreceive.StorageKeyPrefix(app, shardLength); prefix != "" {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range prefixes {
+		if err := deleteArtifacts(app, prefix, drivers); err != nil {
+			return err
+		}
+	}
+
+	if err := release.Drop(drivers.Artifacts, app); err != nil {
+		return err
+	}
+
+	manifestKey := fmt.Sprintf(gitreceive.ManifestKeyPattern, app)
+	if _, err := drivers.Artifacts.Stat(context.Background(), manifestKey); err == nil {
+		log.Info("Cleaner deleting build manifest %s for app %s", manifestKey, app)
+		if err := drivers.Artifacts.Delete(context.Background(), manifestKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	cacheKey := fmt.Sprintf(gitreceive.CacheKeyPattern, app)
+// deleteArtifacts deletes the build cache and the slug files of app whose keys start with prefix.
+func deleteArtifacts(app, prefix string, drivers storage.Drivers) error {
+	cacheKey := prefix + fmt.Sprintf(gitreceive.CacheKeyPattern, app)
 
 	// if cache file exists, delete it
-	if _, err := storageDriver.Stat(context.Background(), cacheKey); err == nil {
+	if _, err := drivers.Cache.Stat(context.Background(), cacheKey); err == nil {
 		log.Info("Cleaner deleting cache %s for app %s", cacheKey, app)
-		if err := storageDriver.Delete(context.Background(), cacheKey); err != nil {
+		if err := drivers.Cache.Delete(context.Background(), cacheKey); err != nil {
+			return err
+		}
+	}
+
+	storageDriver := drivers.Artifacts
+
+	// the file blobs of the sources are shared by all the builds of app
+	blobsKey := prefix + fmt.Sprintf(gitreceive.BlobsKeyPattern, app)
+	if _, err := storageDriver.Stat(context.Background(), blobsKey); err == nil {
+		log.Info("Cleaner deleting source blobs %s for app %s", blobsKey, app)
+		if err := storageDriver.Delete(context.Background(), blobsKey); err != nil {
 			return err
 		}
 	}
 
 	// delete all slug files matching app
-	objs, err := storageDriver.List(context.Background(), "home")
-	if err != nil {
+	objs, err := storageDriver.List(context.Background(), prefix+"home")
+	if _, ok := err.(storagedriver.PathNotFoundError); ok && prefix != "" {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
 	// regex needs prepended / to match output of List()
-	gitRegex, err := regexp.Compile(`^/` + fmt.Sprintf(gitreceive.GitKeyPattern, app, ".{8}") + "$")
+	gitRegex, err := regexp.Compile(`^/` + prefix + fmt.Sprintf(gitreceive.GitKeyPattern, app, ".{8}") + "$")
 	if err != nil {
 		return err
 	}
@@ -124,7 +166,7 @@ func deleteFromObjectStore(app string, storageDriver storagedriver.StorageDriver
 
 // Run starts the deleted app cleaner. Every pollSleepDuration, it compares the result of nsLister.List with the directories in the top level of gitHome on the local file system.
 // On any error, it uses log messages to output a human readable description of what happened.
-func Run(gitHome string, nsLister k8s.NamespaceLister, fs sys.FS, pollSleepDuration time.Duration, storageDriver storagedriver.StorageDriver) error {
+func Run(gitHome string, repos git.RepoStore, nsLister k8s.NamespaceLister, fs sys.FS, pollSleepDuration time.Duration, drivers storage.Drivers, shardLength int) error {
 	for {
 		nsList, err := nsLister.List(context.TODO(), metav1.ListOptions{})
 		if err != nil {
@@ -147,7 +189,10 @@ func Run(gitHome string, nsLister k8s.NamespaceLister, fs sys.FS, pollSleepDurat
 			if err := fs.RemoveAll(dirToDelete); err != nil {
 				log.Err("Cleaner error removing local files for deleted app %s (%s)", dirToDelete, err)
 			}
-			if err := deleteFromObjectStore(appToDelete, storageDriver); err != nil {
+			if err := repos.Delete(appToDelete + dotGitSuffix); err != nil {
+				log.Err("Cleaner error removing the repo of deleted app %s (%s)", appToDelete, err)
+			}
+			if err := deleteFromObjectStore(appToDelete, shardLength, drivers); err != nil {
 				log.Err("Cleaner error removing object store files for deleted app %s (%s)", appToDelete, err)
 			}
 		}
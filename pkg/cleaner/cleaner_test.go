@@ -38,16 +38,26 @@ func TestLocalDirs(t *testing.T) {
 	assert.NoErr(t, err)
 
 	expectedPackages := map[string]int{
+		"buildcost":  1,
+		"buildqueue": 1,
+		"buildstats": 1,
 		"cleaner":    1,
 		"conf":       1,
 		"controller": 1,
 		"git":        1,
+		"githttp":    1,
 		"gitreceive": 1,
+		"golden":     1,
 		"healthsrv":  1,
 		"k8s":        1,
+		"registry":   1,
+		"release":    1,
 		"sshd":       1,
 		"storage":    1,
 		"sys":        1,
+		"testing":    1,
+		"tunables":   1,
+		"warmer":     1,
 	}
 
 	actualPackages := map[string]int{}
@@ -0,0 +1,28 @@
+package cleaner
+
+import (
+	"time"
+
+	"github.com/drycc/builder/pkg/gitreceive"
+	"github.com/drycc/pkg/log"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RunDebugPodGC deletes the pods failed builds were kept in for debugging, with their secrets,
+// once they expired, and the network policies of builds no pod uses anymore, every interval until
+// the process exits. Their cluster is the build cluster of the git-receive config conf returns,
+// that of client if it has none. Errors are logged rather than returned.
+func RunDebugPodGC(conf func() (*gitreceive.Config, error), client kubernetes.Interface, interval time.Duration) {
+	for {
+		if c, err := conf(); err != nil {
+			log.Err("Cleaner error reading the git-receive config (%s)", err)
+		} else if err := gitreceive.DeleteExpiredDebugPods(c, client, time.Now()); err != nil {
+			log.Err("Cleaner error deleting expired debug pods (%s)", err)
+		} else if c.BuilderPodNetworkPolicy {
+			if err := gitreceive.DeleteOrphanedNetworkPolicies(c, client, time.Now()); err != nil {
+				log.Err("Cleaner error deleting orphaned network policies (%s)", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -3,6 +3,10 @@ package conf
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/drycc/builder/pkg/sys"
@@ -15,14 +19,49 @@ const (
 	gcsKey              = "key.json"
 )
 
+// HookTokenEnvVar is the environment variable the builder passes the pre-receive hook the token
+// scoped to the app and the user of the push in, see GetBuilderKey.
+const HookTokenEnvVar = "DRYCC_HOOK_TOKEN"
+
 // BuilderKeyLocation holds the path of the builder key secret.
 var BuilderKeyLocation = "/var/run/secrets/api/auth/builder-key"
 
+// StorageClassLocation holds the directories of the credentials of the storage of each class of
+// objects that isn't kept in the main object storage.
+var StorageClassLocation = "/var/run/secrets/drycc/storage"
+
+// The classes of objects that can be kept in a storage of their own, apart from the build
+// artifacts: the build caches and the audit log.
+const (
+	CacheStorageClass = "cache"
+	LogStorageClass   = "logs"
+)
+
+// expirationDaysParam is the file of the credentials of a storage class holding the number of days
+// its objects are kept.
+const expirationDaysParam = "expiration-days"
+
 // Parameters is map which contains storage params
 type Parameters map[string]interface{}
 
-// GetBuilderKey returns the key to be used as token to interact with drycc-controller
+// GetBuilderKey returns the key to be used as token to interact with drycc-controller. The token
+// scoped to the push being built, in HookTokenEnvVar, is used instead of the builder key if it's
+// set. The key is read from the configured secret store, see ConfigureSecrets, on every call for
+// a rotated key to be picked up.
 func GetBuilderKey() (string, error) {
+	if token := os.Getenv(HookTokenEnvVar); token != "" {
+		return token, nil
+	}
+	return ReadBuilderKey()
+}
+
+// ReadBuilderKey returns the builder key itself, even in the hooks of pushes given a token of
+// their own, for secrets that must be the same across pushes. It's read like GetBuilderKey.
+func ReadBuilderKey() (string, error) {
+	if store := secretStore(); store != nil {
+		builderKey, err := secretValue(store, BuilderKeySecret, BuilderKeySecret)
+		return strings.Trim(builderKey, "\n"), err
+	}
 	builderKeyBytes, err := ioutil.ReadFile(BuilderKeyLocation)
 	if err != nil {
 		return "", fmt.Errorf("couldn't get builder key from %s (%s)", BuilderKeyLocation, err)
@@ -31,10 +70,94 @@ func GetBuilderKey() (string, error) {
 	return builderKey, nil
 }
 
-// GetStorageParams returns the credentials required for connecting to object storage
+// GetStorageParams returns the credentials required for connecting to object storage, read from
+// the configured secret store.
 func GetStorageParams(env sys.Env) (Parameters, error) {
+	params, err := storageCreds()
+	if err != nil {
+		return nil, err
+	}
+	params["bucket"] = params["builder-bucket"]
+	mHost := env.Get(minioHostEnvVar)
+	mPort := env.Get(minioPortEnvVar)
+	params["region"] = "us-east-1"
+	params["regionendpoint"] = "http://" + net.JoinHostPort(mHost, mPort)
+	params["secure"] = false
+	return params, nil
+}
+
+// GetPromotionStorageParams returns the parameters of the object storage builds are promoted to,
+// read from the files in dir. Files named registry-* are the credentials of the registry images
+// are promoted to and are left out.
+func GetPromotionStorageParams(dir string) (Parameters, error) {
+	params, err := readParams(dir)
+	if err != nil {
+		return nil, err
+	}
+	for key := range params {
+		if strings.HasPrefix(key, "registry-") {
+			delete(params, key)
+		}
+	}
+	if bucket, ok := params["builder-bucket"]; ok {
+		params["bucket"] = bucket
+		delete(params, "builder-bucket")
+	}
+	if _, ok := params["region"]; !ok {
+		params["region"] = "us-east-1"
+	}
+	return params, nil
+}
+
+// GetClassStorageParams returns the parameters of the storage of the objects of class, read from
+// the files of its directory in StorageClassLocation like GetPromotionStorageParams, and the number
+// of days its objects are kept, 0 for ever. The parameters are nil if the class is kept in the main
+// object storage.
+func GetClassStorageParams(class string) (Parameters, int, error) {
+	dir := filepath.Join(StorageClassLocation, class)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	params, err := GetPromotionStorageParams(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the directory of an optional secret that doesn't exist is empty
+	if _, ok := params["bucket"]; !ok {
+		return nil, 0, nil
+	}
+	days := 0
+	if value, ok := params[expirationDaysParam]; ok {
+		delete(params, expirationDaysParam)
+		if days, err = strconv.Atoi(strings.TrimSpace(fmt.Sprint(value))); err != nil || days < 0 {
+			return nil, 0, fmt.Errorf("invalid %s of the %s storage %q", expirationDaysParam, class, value)
+		}
+	}
+	return params, days, nil
+}
+
+// storageCreds returns the credentials of the object storage, from the StorageSecret of the
+// configured secret store or from the files in storageCredLocation.
+func storageCreds() (Parameters, error) {
+	store := secretStore()
+	if store == nil {
+		return readParams(storageCredLocation)
+	}
+	values, err := store.Secret(StorageSecret)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the %s secret (%s)", StorageSecret, err)
+	}
+	params := make(Parameters, len(values))
+	for key, value := range values {
+		params[key] = value
+	}
+	return params, nil
+}
+
+// readParams returns the contents of the files in dir, keyed by file name.
+func readParams(dir string) (Parameters, error) {
 	params := make(map[string]interface{})
-	files, err := ioutil.ReadDir(storageCredLocation)
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -43,22 +166,16 @@ func GetStorageParams(env sys.Env) (Parameters, error) {
 		if file.IsDir() || file.Name() == "..data" {
 			continue
 		}
-		data, err := ioutil.ReadFile(storageCredLocation + file.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
 		if err != nil {
 			return nil, err
 		}
 		//GCS expect the to have the location of the service account credential json file
 		if file.Name() == gcsKey {
-			params["keyfile"] = storageCredLocation + file.Name()
+			params["keyfile"] = filepath.Join(dir, file.Name())
 		} else {
 			params[file.Name()] = string(data)
 		}
 	}
-	params["bucket"] = params["builder-bucket"]
-	mHost := env.Get(minioHostEnvVar)
-	mPort := env.Get(minioPortEnvVar)
-	params["region"] = "us-east-1"
-	params["regionendpoint"] = fmt.Sprintf("http://%s:%s", mHost, mPort)
-	params["secure"] = false
 	return params, nil
 }
@@ -103,9 +103,52 @@ func TestGetControllerClient(t *testing.T) {
 	key, err := GetBuilderKey()
 	assert.NoErr(t, err)
 	assert.Equal(t, key, string(data), "data")
+
+	// the builder key itself is read even in the hooks of pushes given a token
+	os.Setenv(HookTokenEnvVar, "scopedtoken")
+	defer os.Unsetenv(HookTokenEnvVar)
+	key, err = ReadBuilderKey()
+	assert.NoErr(t, err)
+	assert.Equal(t, key, string(data), "builder key with a hook token")
 }
 
 func TestGetBuilderKeyError(t *testing.T) {
 	_, err := GetBuilderKey()
 	assert.True(t, err != nil, "no error received when there should have been")
 }
+
+func TestGetBuilderKeyHookToken(t *testing.T) {
+	os.Setenv(HookTokenEnvVar, "scopedtoken")
+	defer os.Unsetenv(HookTokenEnvVar)
+	key, err := GetBuilderKey()
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "scopedtoken", "key")
+}
+
+func TestGetPromotionStorageParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promotion")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"accesskey":         "access",
+		"builder-bucket":    "builds",
+		"regionendpoint":    "https://storage.example.com",
+		"registry-username": "user",
+		"registry-password": "pass",
+	}
+	for name, content := range files {
+		assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	params, err := GetPromotionStorageParams(dir)
+	assert.NoErr(t, err)
+	assert.Equal(t, params, Parameters{
+		"accesskey":      "access",
+		"bucket":         "builds",
+		"regionendpoint": "https://storage.example.com",
+		"region":         "us-east-1",
+	}, "params")
+
+	_, err = GetPromotionStorageParams(filepath.Join(dir, "missing"))
+	assert.True(t, err != nil, "no error reading a missing directory")
+}
@@ -0,0 +1,207 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// ServiceAccountTokenLocation holds the path of the token of the service account of the builder,
+// which it logs in to Vault with.
+var ServiceAccountTokenLocation = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultStore reads secrets from the KV version 2 secrets engine of Vault.
+type vaultStore struct {
+	addr, mount, prefix       string
+	role, authPath, tokenPath string
+	client                    *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+func newVaultStore(c SecretsConfig) *vaultStore {
+	return &vaultStore{
+		addr:      strings.TrimSuffix(c.VaultAddr, "/"),
+		mount:     strings.Trim(c.VaultMount, "/"),
+		prefix:    c.Prefix,
+		role:      c.VaultRole,
+		authPath:  strings.Trim(c.VaultAuthPath, "/"),
+		tokenPath: c.VaultTokenPath,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Secret is the SecretStore interface implementation. A Kubernetes login is renewed once if Vault
+// denies its token, which may have expired.
+func (v *vaultStore) Secret(name string) (map[string]string, error) {
+	values, status, err := v.read(name)
+	if status == http.StatusForbidden && v.role != "" {
+		v.mu.Lock()
+		v.token = ""
+		v.mu.Unlock()
+		values, _, err = v.read(name)
+	}
+	return values, err
+}
+
+// read returns the values of the secret name, and the status Vault answered with.
+func (v *vaultStore) read(name string) (map[string]string, int, error) {
+	token, err := v.login()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s/data/%s%s", v.addr, v.mount, v.prefix, name), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if status, err := v.do(req, &secret); err != nil {
+		return nil, status, err
+	}
+	values := make(map[string]string, len(secret.Data.Data))
+	for key, value := range secret.Data.Data {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, http.StatusOK, nil
+}
+
+// login returns the token to read secrets with: the one in tokenPath, re-read on every call for
+// an agent to renew it, or the one Vault returned to the Kubernetes login as role.
+func (v *vaultStore) login() (string, error) {
+	if v.role == "" {
+		data, err := ioutil.ReadFile(v.tokenPath)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get the Vault token from %s (%s)", v.tokenPath, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" {
+		return v.token, nil
+	}
+	jwt, err := ioutil.ReadFile(ServiceAccountTokenLocation)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get the service account token from %s (%s)", ServiceAccountTokenLocation, err)
+	}
+	body, err := json.Marshal(map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/auth/%s/login", v.addr, v.authPath), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if _, err := v.do(req, &login); err != nil {
+		return "", fmt.Errorf("logging in to Vault as %s (%s)", v.role, err)
+	}
+	v.token = login.Auth.ClientToken
+	return v.token, nil
+}
+
+// do sends req to Vault and decodes its response into out.
+func (v *vaultStore) do(req *http.Request, out interface{}) (int, error) {
+	res, err := v.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, fmt.Errorf("Vault answered %s to %s", res.Status, req.URL.Path)
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return res.StatusCode, fmt.Errorf("decoding the Vault response (%s)", err)
+	}
+	return res.StatusCode, nil
+}
+
+// secretsManagerAPI is the subset of the AWS Secrets Manager client the builder needs.
+type secretsManagerAPI interface {
+	GetSecretValue(*secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// awsStore reads secrets from AWS Secrets Manager, in the region and with the credentials of the
+// environment. A secret is a JSON object of its keys and values, or a string that's the value of
+// the key named like the secret.
+type awsStore struct {
+	client secretsManagerAPI
+	prefix string
+}
+
+func newAWSStore(prefix string) (*awsStore, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &awsStore{client: secretsmanager.New(sess), prefix: prefix}, nil
+}
+
+// Secret is the SecretStore interface implementation.
+func (a *awsStore) Secret(name string) (map[string]string, error) {
+	out, err := a.client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(a.prefix + name)})
+	if err != nil {
+		return nil, err
+	}
+	value := string(out.SecretBinary)
+	if out.SecretString != nil {
+		value = *out.SecretString
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		values = map[string]string{name: value}
+	}
+	return values, nil
+}
+
+// csiStore reads the secrets the Secrets Store CSI driver mounts in dir. The driver updates the
+// files when the secrets rotate.
+type csiStore struct {
+	dir string
+}
+
+// Secret is the SecretStore interface implementation.
+func (c csiStore) Secret(name string) (map[string]string, error) {
+	path := filepath.Join(c.dir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name: string(data)}, nil
+	}
+	params, err := readParams(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(params))
+	for key, value := range params {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,201 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// The secrets the builder reads from its secret store.
+const (
+	// BuilderKeySecret holds the builder key, as its builder-key key.
+	BuilderKeySecret = "builder-key"
+	// StorageSecret holds the credentials of the object storage, keyed like the files of the
+	// objectstore secret.
+	StorageSecret = "objectstore"
+)
+
+// The secret stores the builder can read its secrets from.
+const (
+	// FileSecrets reads the secrets from the files Kubernetes mounts, at BuilderKeyLocation and
+	// storageCredLocation.
+	FileSecrets = "file"
+	// VaultSecrets reads the secrets from the KV version 2 secrets engine of HashiCorp Vault.
+	VaultSecrets = "vault"
+	// AWSSecrets reads the secrets from AWS Secrets Manager.
+	AWSSecrets = "aws-secrets-manager"
+	// CSISecrets reads the secrets from the files the Secrets Store CSI driver mounts.
+	CSISecrets = "csi"
+)
+
+// SecretsConfig is the configuration of the secret store of the builder.
+type SecretsConfig struct {
+	// Store is the secret store, FileSecrets by default.
+	Store string `envconfig:"SECRET_STORE" default:"file"`
+	// Prefix is prepended to the names of the secrets in the Vault and AWS Secrets Manager stores,
+	// e.g. the AWS secret drycc/builder/objectstore.
+	Prefix string `envconfig:"SECRET_STORE_PREFIX" default:"drycc/builder/"`
+	// CacheTTLSec is how long a secret is read from the cache before it's fetched again, which is
+	// when its rotation is noticed.
+	CacheTTLSec int `envconfig:"SECRET_STORE_CACHE_TTL_SEC" default:"300"`
+
+	VaultAddr string `envconfig:"VAULT_ADDR" default:""`
+	// VaultMount is the mount path of the KV secrets engine.
+	VaultMount string `envconfig:"VAULT_KV_MOUNT" default:"secret"`
+	// VaultRole logs in with the Kubernetes auth method, as the service account of the builder,
+	// if it's set. Otherwise, the token in VaultTokenPath is used.
+	VaultRole      string `envconfig:"VAULT_ROLE" default:""`
+	VaultAuthPath  string `envconfig:"VAULT_AUTH_PATH" default:"kubernetes"`
+	VaultTokenPath string `envconfig:"VAULT_TOKEN_PATH" default:"/var/run/secrets/vault/token"`
+
+	// CSIDir is where the Secrets Store CSI driver mounts the secrets, each as a file holding
+	// its value or as a directory holding a file per key.
+	CSIDir string `envconfig:"CSI_SECRETS_DIR" default:"/mnt/secrets-store"`
+}
+
+// SecretStore is where the builder reads its secrets from.
+type SecretStore interface {
+	// Secret returns the keys and values of the secret name.
+	Secret(name string) (map[string]string, error)
+}
+
+// secrets is the cached secret store of the builder, nil while it reads the files mounted by
+// Kubernetes.
+var (
+	secretsLock sync.Mutex
+	secrets     *cachedSecrets
+)
+
+// ConfigureSecrets reads the secrets of the builder from the store of c from now on.
+func ConfigureSecrets(c SecretsConfig) error {
+	var store SecretStore
+	switch c.Store {
+	case "", FileSecrets:
+	case VaultSecrets:
+		if c.VaultAddr == "" {
+			return fmt.Errorf("VAULT_ADDR is required by the %s secret store", VaultSecrets)
+		}
+		store = newVaultStore(c)
+	case AWSSecrets:
+		var err error
+		if store, err = newAWSStore(c.Prefix); err != nil {
+			return fmt.Errorf("creating the AWS Secrets Manager client (%s)", err)
+		}
+	case CSISecrets:
+		store = csiStore{dir: c.CSIDir}
+	default:
+		return fmt.Errorf("unknown secret store %q, use %s, %s, %s or %s", c.Store, FileSecrets, VaultSecrets, AWSSecrets, CSISecrets)
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets = nil
+	if store != nil {
+		secrets = newCachedSecrets(store, time.Duration(c.CacheTTLSec)*time.Second)
+	}
+	return nil
+}
+
+// OnSecretRotation calls f with the name of each secret whose value changed when it was fetched
+// again from the store. Secrets read from files aren't watched.
+func OnSecretRotation(f func(name string)) {
+	if s := secretStore(); s != nil {
+		s.onRotation(f)
+	}
+}
+
+// WatchSecrets fetches the secrets names every interval, for their rotation to be noticed even
+// if they aren't read, until the process exits. It returns right away if the secrets are read
+// from files.
+func WatchSecrets(interval time.Duration, names ...string) {
+	s := secretStore()
+	if s == nil {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		for _, name := range names {
+			if _, err := s.Secret(name); err != nil {
+				log.Err("Failed to fetch the %s secret: %s", name, err)
+			}
+		}
+	}
+}
+
+func secretStore() *cachedSecrets {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	return secrets
+}
+
+type cachedSecret struct {
+	values  map[string]string
+	fetched time.Time
+}
+
+// cachedSecrets caches the secrets of a store for ttl, and calls the rotation callbacks when a
+// secret fetched again changed.
+type cachedSecrets struct {
+	store SecretStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	cache     map[string]cachedSecret
+	callbacks []func(name string)
+}
+
+func newCachedSecrets(store SecretStore, ttl time.Duration) *cachedSecrets {
+	return &cachedSecrets{store: store, ttl: ttl, now: time.Now, cache: make(map[string]cachedSecret)}
+}
+
+func (c *cachedSecrets) onRotation(f func(name string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, f)
+}
+
+// Secret is the SecretStore interface implementation. The cached value of a secret is returned,
+// past its TTL, if the store can't be reached.
+func (c *cachedSecrets) Secret(name string) (map[string]string, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[name]
+	c.mu.Unlock()
+	if ok && c.now().Sub(cached.fetched) < c.ttl {
+		return cached.values, nil
+	}
+	values, err := c.store.Secret(name)
+	if err != nil {
+		if ok {
+			log.Err("Failed to fetch the %s secret, using its cached value: %s", name, err)
+			return cached.values, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cache[name] = cachedSecret{values: values, fetched: c.now()}
+	callbacks := c.callbacks
+	c.mu.Unlock()
+	if ok && !reflect.DeepEqual(cached.values, values) {
+		log.Info("The %s secret rotated", name)
+		for _, f := range callbacks {
+			f(name)
+		}
+	}
+	return values, nil
+}
+
+// secretValue returns the value of key in the secret name of s.
+func secretValue(s SecretStore, name, key string) (string, error) {
+	values, err := s.Secret(name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get the %s secret (%s)", name, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("the %s secret has no %s key", name, key)
+	}
+	return value, nil
+}
@@ -0,0 +1,153 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/drycc/builder/pkg/sys"
+)
+
+// fakeSecretStore is a SecretStore of values, failing with err if it's set.
+type fakeSecretStore struct {
+	values  map[string]map[string]string
+	err     error
+	fetches int
+}
+
+func (f *fakeSecretStore) Secret(name string) (map[string]string, error) {
+	f.fetches++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.values[name], nil
+}
+
+func TestCachedSecrets(t *testing.T) {
+	store := &fakeSecretStore{values: map[string]map[string]string{BuilderKeySecret: {BuilderKeySecret: "key1"}}}
+	now := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	cache := newCachedSecrets(store, time.Minute)
+	cache.now = func() time.Time { return now }
+	var rotated []string
+	cache.onRotation(func(name string) { rotated = append(rotated, name) })
+
+	key, err := secretValue(cache, BuilderKeySecret, BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "key1", "key")
+	store.values[BuilderKeySecret] = map[string]string{BuilderKeySecret: "key2"}
+	key, err = secretValue(cache, BuilderKeySecret, BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "key1", "cached key")
+	assert.Equal(t, store.fetches, 1, "fetches")
+	assert.Equal(t, len(rotated), 0, "rotations before the TTL")
+
+	now = now.Add(time.Minute)
+	key, err = secretValue(cache, BuilderKeySecret, BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "key2", "rotated key")
+	assert.Equal(t, rotated, []string{BuilderKeySecret}, "rotations")
+
+	// the cached value outlives an outage of the store
+	now = now.Add(time.Minute)
+	store.err = errors.New("unavailable")
+	key, err = secretValue(cache, BuilderKeySecret, BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "key2", "key during an outage")
+	_, err = secretValue(cache, StorageSecret, "accesskey")
+	assert.True(t, err != nil, "no error fetching an uncached secret during an outage")
+}
+
+func TestConfigureSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, BuilderKeySecret), []byte("csikey\n"), 0644))
+	assert.NoErr(t, os.Mkdir(filepath.Join(dir, StorageSecret), 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, StorageSecret, "builder-bucket"), []byte("builds"), 0644))
+
+	assert.NoErr(t, ConfigureSecrets(SecretsConfig{Store: CSISecrets, CSIDir: dir, CacheTTLSec: 60}))
+	defer ConfigureSecrets(SecretsConfig{Store: FileSecrets})
+	key, err := GetBuilderKey()
+	assert.NoErr(t, err)
+	assert.Equal(t, key, "csikey", "builder key")
+	params, err := GetStorageParams(sys.NewFakeEnv())
+	assert.NoErr(t, err)
+	assert.Equal(t, params["bucket"], "builds", "bucket")
+
+	assert.True(t, ConfigureSecrets(SecretsConfig{Store: "keychain"}) != nil, "unknown store accepted")
+	assert.True(t, ConfigureSecrets(SecretsConfig{Store: VaultSecrets}) != nil, "vault store without an address accepted")
+}
+
+func TestVaultStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	ServiceAccountTokenLocation = filepath.Join(dir, "token")
+	assert.NoErr(t, ioutil.WriteFile(ServiceAccountTokenLocation, []byte("jwt"), 0644))
+
+	logins := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			assert.NoErr(t, json.NewDecoder(r.Body).Decode(&login))
+			assert.Equal(t, login, map[string]string{"role": "builder", "jwt": "jwt"}, "login")
+			logins++
+			w.Write([]byte(`{"auth": {"client_token": "vaulttoken"}}`))
+		case "/v1/secret/data/drycc/builder/builder-key":
+			if logins == 1 {
+				// the first token expired
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			assert.Equal(t, r.Header.Get("X-Vault-Token"), "vaulttoken", "token")
+			w.Write([]byte(`{"data": {"data": {"builder-key": "vaultkey"}, "metadata": {"version": 2}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	store := newVaultStore(SecretsConfig{VaultAddr: srv.URL + "/", VaultMount: "secret", Prefix: "drycc/builder/", VaultRole: "builder", VaultAuthPath: "kubernetes"})
+	values, err := store.Secret(BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, values, map[string]string{BuilderKeySecret: "vaultkey"}, "values")
+	assert.Equal(t, logins, 2, "logins")
+	_, err = store.Secret(StorageSecret)
+	assert.True(t, err != nil, "no error reading a missing secret")
+}
+
+// fakeSecretsManager is a secretsManagerAPI of secrets.
+type fakeSecretsManager map[string]string
+
+func (f fakeSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := f[*in.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func TestAWSStore(t *testing.T) {
+	store := &awsStore{prefix: "drycc/builder/", client: fakeSecretsManager{
+		"drycc/builder/builder-key": "awskey",
+		"drycc/builder/objectstore": `{"accesskey": "AKIA", "secretkey": "secret"}`,
+	}}
+	values, err := store.Secret(BuilderKeySecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, values, map[string]string{BuilderKeySecret: "awskey"}, "plain secret")
+	values, err = store.Secret(StorageSecret)
+	assert.NoErr(t, err)
+	assert.Equal(t, values, map[string]string{"accesskey": "AKIA", "secretkey": "secret"}, "JSON secret")
+	_, err = store.Secret("missing")
+	assert.True(t, err != nil, "no error reading a missing secret")
+}
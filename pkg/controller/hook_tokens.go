@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/drycc/builder/pkg/conf"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/pkg/log"
+)
+
+// The modes of the tokens the pre-receive hook authenticates to the controller with.
+const (
+	// HookTokensGlobal authenticates every build with the builder key, which may publish releases
+	// for any app.
+	HookTokensGlobal = "global"
+	// HookTokensScoped authenticates each build with a token the controller mints for the app and
+	// the user of the push, which expires after its TTL. Pushes fail if the token can't be minted.
+	HookTokensScoped = "scoped"
+	// HookTokensPreferScoped mints scoped tokens like HookTokensScoped, but falls back to the
+	// builder key for the apps of the controllers that don't mint them yet.
+	HookTokensPreferScoped = "prefer-scoped"
+)
+
+// hookTokensPath is the path of the hook minting scoped hook tokens.
+const hookTokensPath = "/v2/hooks/tokens/"
+
+// hookTokenRequest is the request of a scoped hook token.
+type hookTokenRequest struct {
+	App  string `json:"app"`
+	User string `json:"user"`
+	TTL  int    `json:"ttl"`
+}
+
+// hookTokenResponse is the token the controller minted for a hookTokenRequest.
+type hookTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// HookTokens mints the hook tokens scoped to the app and the user of a push, for a leaked token
+// not to publish releases for other apps.
+type HookTokens struct {
+	routes Routes
+	mode   string
+	ttl    time.Duration
+}
+
+// NewHookTokens returns the HookTokens minted by the controllers of routes in mode, that expire
+// after ttl, or nil in the HookTokensGlobal mode.
+func NewHookTokens(routes Routes, mode string, ttl time.Duration) (*HookTokens, error) {
+	switch mode {
+	case "", HookTokensGlobal:
+		return nil, nil
+	case HookTokensScoped, HookTokensPreferScoped:
+	default:
+		return nil, fmt.Errorf("unknown hook token mode %q, use %s, %s or %s", mode, HookTokensGlobal, HookTokensScoped, HookTokensPreferScoped)
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("the TTL of the hook tokens must be at least a second")
+	}
+	return &HookTokens{routes: routes, mode: mode, ttl: ttl}, nil
+}
+
+// CheckTTL returns an error if the tokens could expire before the end of a build that can take up
+// to longest, or that can take any time if longest is 0. Tokens are minted when a push starts, and
+// aren't renewed.
+func (t *HookTokens) CheckTTL(longest time.Duration) error {
+	if t == nil {
+		return nil
+	}
+	if longest <= 0 {
+		return fmt.Errorf("builds have no timeout, set one shorter than the %s TTL of the hook tokens", t.ttl)
+	}
+	if longest > t.ttl {
+		return fmt.Errorf("builds can take up to %s, longer than the %s TTL of the hook tokens", longest, t.ttl)
+	}
+	return nil
+}
+
+// Env returns the environment passing the pre-receive hook of a push of app by user the token
+// scoped to them, as conf.HookTokenEnvVar, or nil if it authenticates with the builder key.
+func (t *HookTokens) Env(app, user string) ([]string, error) {
+	if t == nil {
+		return nil, nil
+	}
+	token, err := t.mint(app, user)
+	if _, ok := err.(drycc.ErrNotFound); ok && t.mode == HookTokensPreferScoped {
+		log.Info("The controller of %s doesn't mint hook tokens, building with the builder key", app)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("minting the hook token of %s (%s)", app, err)
+	}
+	return []string{conf.HookTokenEnvVar + "=" + token}, nil
+}
+
+// mint asks the controller of app, authenticated with the builder key, for a token scoped to app
+// and user.
+func (t *HookTokens) mint(app, user string) (string, error) {
+	client, err := t.routes.New(app)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(hookTokenRequest{App: app, User: user, TTL: int(t.ttl.Seconds())})
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Request("POST", hookTokensPath, body)
+	if CheckAPICompat(client, err) != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var minted hookTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&minted); err != nil {
+		return "", fmt.Errorf("decoding the hook token response (%s)", err)
+	}
+	if minted.Token == "" {
+		return "", fmt.Errorf("the controller returned an empty token")
+	}
+	return minted.Token, nil
+}
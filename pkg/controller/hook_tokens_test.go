@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	builderconf "github.com/drycc/builder/pkg/conf"
+)
+
+// hookTokenRoutes returns the routes of every app to srv, with the builder key "builderkey" in
+// dir.
+func hookTokenRoutes(t *testing.T, srv *httptest.Server, dir string) Routes {
+	builderconf.BuilderKeyLocation = filepath.Join(dir, "builder-key")
+	assert.NoErr(t, ioutil.WriteFile(builderconf.BuilderKeyLocation, []byte("builderkey\n"), 0644))
+	u, err := url.Parse(srv.URL)
+	assert.NoErr(t, err)
+	routes, err := ParseRoutes("", u.Hostname(), u.Port())
+	assert.NoErr(t, err)
+	return routes
+}
+
+func TestNewHookTokens(t *testing.T) {
+	for _, mode := range []string{"", HookTokensGlobal} {
+		tokens, err := NewHookTokens(Routes{}, mode, time.Hour)
+		assert.NoErr(t, err)
+		assert.True(t, tokens == nil, "global mode minted tokens")
+	}
+	_, err := NewHookTokens(Routes{}, "per-app", time.Hour)
+	assert.True(t, err != nil, "unknown mode accepted")
+	_, err = NewHookTokens(Routes{}, HookTokensScoped, 0)
+	assert.True(t, err != nil, "zero TTL accepted")
+
+	var tokens *HookTokens
+	env, err := tokens.Env("myapp", "alice")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(env), 0, "env of the global mode")
+}
+
+func TestHookTokensCheckTTL(t *testing.T) {
+	tokens, err := NewHookTokens(Routes{}, HookTokensScoped, time.Hour)
+	assert.NoErr(t, err)
+	assert.NoErr(t, tokens.CheckTTL(45*time.Minute))
+	assert.True(t, tokens.CheckTTL(2*time.Hour) != nil, "accepted builds outliving their token")
+	assert.True(t, tokens.CheckTTL(0) != nil, "accepted builds without a timeout")
+
+	var global *HookTokens
+	assert.NoErr(t, global.CheckTTL(0))
+}
+
+func TestHookTokensEnv(t *testing.T) {
+	var got hookTokenRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, hookTokensPath, "path")
+		assert.Equal(t, r.Header.Get("X-Drycc-Builder-Auth"), "builderkey", "builder key")
+		assert.NoErr(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "scopedtoken"}`))
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "hook-tokens")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	tokens, err := NewHookTokens(hookTokenRoutes(t, srv, dir), HookTokensScoped, 10*time.Minute)
+	assert.NoErr(t, err)
+	env, err := tokens.Env("myapp", "alice")
+	assert.NoErr(t, err)
+	assert.Equal(t, env, []string{"DRYCC_HOOK_TOKEN=scopedtoken"}, "env")
+	assert.Equal(t, got, hookTokenRequest{App: "myapp", User: "alice", TTL: 600}, "request")
+}
+
+func TestHookTokensFallback(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "hook-tokens")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	routes := hookTokenRoutes(t, srv, dir)
+
+	tokens, err := NewHookTokens(routes, HookTokensPreferScoped, time.Minute)
+	assert.NoErr(t, err)
+	env, err := tokens.Env("myapp", "alice")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(env), 0, "env falling back to the builder key")
+
+	tokens, err = NewHookTokens(routes, HookTokensScoped, time.Minute)
+	assert.NoErr(t, err)
+	_, err = tokens.Env("myapp", "alice")
+	assert.True(t, err != nil, "scoped mode fell back to the builder key")
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+// Endpoint is the host and port of a controller.
+type Endpoint struct {
+	Host string
+	Port string
+}
+
+type route struct {
+	pattern  string
+	endpoint Endpoint
+}
+
+// Routes route apps to the controllers they belong to, for one builder to serve the apps of
+// several controllers. Apps that no route matches belong to the default controller.
+type Routes struct {
+	routes  []route
+	Default Endpoint
+}
+
+// ParseRoutes returns the Routes of spec, comma separated "<pattern>=<host>:<port>" routes whose
+// pattern matches the names of the apps of the controller at host:port (see path.Match), e.g.
+// "team-a-*=drycc-controller.team-a:80". Routes are tried in order, apps no route matches belong
+// to the controller at host and port.
+func ParseRoutes(spec, host, port string) (Routes, error) {
+	r := Routes{Default: Endpoint{Host: host, Port: port}}
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		eq := strings.Index(raw, "=")
+		if eq < 0 {
+			return r, fmt.Errorf("invalid controller route %q, use <app pattern>=<host>:<port>", raw)
+		}
+		pattern := strings.TrimSpace(raw[:eq])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return r, fmt.Errorf("invalid app pattern %q of the controller route %q", pattern, raw)
+		}
+		host, port, err := net.SplitHostPort(strings.TrimSpace(raw[eq+1:]))
+		if err != nil || host == "" || port == "" {
+			return r, fmt.Errorf("invalid controller of the route %q, use <host>:<port>", raw)
+		}
+		r.routes = append(r.routes, route{pattern: pattern, endpoint: Endpoint{Host: host, Port: port}})
+	}
+	return r, nil
+}
+
+// For returns the controller of app.
+func (r Routes) For(app string) Endpoint {
+	for _, rt := range r.routes {
+		if ok, _ := path.Match(rt.pattern, app); ok {
+			return rt.endpoint
+		}
+	}
+	return r.Default
+}
+
+// Endpoints returns each controller apps are routed to once, the default one first.
+func (r Routes) Endpoints() []Endpoint {
+	endpoints := []Endpoint{r.Default}
+	seen := map[Endpoint]bool{r.Default: true}
+	for _, rt := range r.routes {
+		if !seen[rt.endpoint] {
+			seen[rt.endpoint] = true
+			endpoints = append(endpoints, rt.endpoint)
+		}
+	}
+	return endpoints
+}
+
+// New creates a new SDK client of the controller of app, configured as the builder.
+func (r Routes) New(app string) (*drycc.Client, error) {
+	e := r.For(app)
+	return New(e.Host, e.Port)
+}
+
+// Clients creates a client of each controller of r, configured as the builder, and returns a func
+// returning the client of the controller of an app.
+func (r Routes) Clients() (func(app string) *drycc.Client, error) {
+	clients := make(map[Endpoint]*drycc.Client)
+	for _, e := range r.Endpoints() {
+		client, err := New(e.Host, e.Port)
+		if err != nil {
+			return nil, err
+		}
+		clients[e] = client
+	}
+	return func(app string) *drycc.Client {
+		return clients[r.For(app)]
+	}, nil
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("team-a-*=ctl-a:80, team-b-*=ctl-b:8000,team-a-legacy=ctl-b:8000", "ctl", "80")
+	assert.NoErr(t, err)
+	assert.Equal(t, routes.For("team-a-web"), Endpoint{Host: "ctl-a", Port: "80"}, "team-a endpoint")
+	assert.Equal(t, routes.For("team-a-legacy"), Endpoint{Host: "ctl-a", Port: "80"}, "first matching route")
+	assert.Equal(t, routes.For("team-b-api"), Endpoint{Host: "ctl-b", Port: "8000"}, "team-b endpoint")
+	assert.Equal(t, routes.For("other"), Endpoint{Host: "ctl", Port: "80"}, "default endpoint")
+	assert.Equal(t, routes.Endpoints(), []Endpoint{{"ctl", "80"}, {"ctl-a", "80"}, {"ctl-b", "8000"}}, "endpoints")
+
+	routes, err = ParseRoutes("", "ctl", "80")
+	assert.NoErr(t, err)
+	assert.Equal(t, routes.Endpoints(), []Endpoint{{"ctl", "80"}}, "endpoints")
+
+	for _, spec := range []string{"team-a-*", "=ctl-a:80", "[=ctl-a:80", "team-a-*=ctl-a", "team-a-*=:80"} {
+		if _, err := ParseRoutes(spec, "ctl", "80"); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	drycc "github.com/drycc/controller-sdk-go"
+	"golang.org/x/net/http2"
+)
+
+// TransportConfig tunes the connections of the SDK clients to the controller, which share a pool
+// of connections instead of opening one per request.
+type TransportConfig struct {
+	KeepAliveSec        int  `envconfig:"CONTROLLER_KEEP_ALIVE_SEC" default:"30"`
+	IdleConnTimeoutSec  int  `envconfig:"CONTROLLER_IDLE_CONN_TIMEOUT_SEC" default:"90"`
+	MaxIdleConns        int  `envconfig:"CONTROLLER_MAX_IDLE_CONNS" default:"100"`
+	MaxIdleConnsPerHost int  `envconfig:"CONTROLLER_MAX_IDLE_CONNS_PER_HOST" default:"16"`
+	DisableKeepAlives   bool `envconfig:"CONTROLLER_DISABLE_KEEP_ALIVES" default:"false"`
+	// HTTP2 talks HTTP/2 with prior knowledge to the controller, which must accept cleartext
+	// HTTP/2 (h2c).
+	HTTP2 bool `envconfig:"CONTROLLER_HTTP2_ENABLED" default:"false"`
+}
+
+// DefaultTransportConfig is the TransportConfig of the shared client until Configure is called.
+var DefaultTransportConfig = TransportConfig{
+	KeepAliveSec:        30,
+	IdleConnTimeoutSec:  90,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 16,
+}
+
+var (
+	sharedClientLock sync.Mutex
+	sharedClient     *http.Client
+)
+
+// newTransport returns the transport of the shared client configured with conf.
+func newTransport(conf TransportConfig) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(conf.KeepAliveSec) * time.Second,
+	}
+	if conf.HTTP2 {
+		// the controller URL is plain http, so HTTP/2 is spoken over TCP without TLS
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		}
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		DisableKeepAlives:   conf.DisableKeepAlives,
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(conf.IdleConnTimeoutSec) * time.Second,
+	}
+}
+
+// Configure replaces the shared client of the SDK clients created from now on with one configured
+// with conf. It's meant to be called once, at startup.
+func Configure(conf TransportConfig) {
+	sharedClientLock.Lock()
+	defer sharedClientLock.Unlock()
+	sharedClient = &http.Client{Transport: newTransport(conf)}
+}
+
+// httpClient returns the client shared by all SDK clients, configured with DefaultTransportConfig
+// if Configure wasn't called.
+func httpClient() *http.Client {
+	sharedClientLock.Lock()
+	defer sharedClientLock.Unlock()
+	if sharedClient == nil {
+		sharedClient = &http.Client{Transport: newTransport(DefaultTransportConfig)}
+	}
+	return sharedClient
+}
+
+// contextTransport sends the requests of a client with ctx, so that they're canceled with it.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// WithContext returns a copy of client whose requests are canceled once ctx is done, for the SDK
+// takes no context. The copy shares the connections of client, but the controller version its
+// requests learn is only recorded in the copy.
+func WithContext(ctx context.Context, client *drycc.Client) *drycc.Client {
+	if client == nil {
+		return nil
+	}
+	base := http.DefaultTransport
+	hc := http.DefaultClient
+	if client.HTTPClient != nil {
+		hc = client.HTTPClient
+		if hc.Transport != nil {
+			base = hc.Transport
+		}
+	}
+	c := *client
+	c.HTTPClient = &http.Client{
+		Transport:     contextTransport{ctx: ctx, base: base},
+		CheckRedirect: hc.CheckRedirect,
+		Jar:           hc.Jar,
+		Timeout:       hc.Timeout,
+	}
+	return &c
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// controllerServer starts a server answering every request with the HTTP version it was made
+// with, and counts the connections made to it.
+func controllerServer(handler http.Handler) (*httptest.Server, *int32) {
+	conns := new(int32)
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, conns
+}
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func get(t *testing.T, srv *httptest.Server) string {
+	u, err := url.Parse(srv.URL)
+	assert.NoErr(t, err)
+	client, err := NewForUser(u.Hostname(), u.Port(), "token")
+	assert.NoErr(t, err)
+	res, err := client.HTTPClient.Get(srv.URL)
+	assert.NoErr(t, err)
+	defer res.Body.Close()
+	return res.Proto
+}
+
+func TestSharedClientReusesConnections(t *testing.T) {
+	Configure(DefaultTransportConfig)
+	defer Configure(DefaultTransportConfig)
+	srv, conns := controllerServer(protoHandler())
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, get(t, srv), "HTTP/1.1", "protocol")
+	}
+	assert.Equal(t, atomic.LoadInt32(conns), int32(1), "number of connections")
+}
+
+func TestSharedClientWithoutKeepAlives(t *testing.T) {
+	conf := DefaultTransportConfig
+	conf.DisableKeepAlives = true
+	Configure(conf)
+	defer Configure(DefaultTransportConfig)
+	srv, conns := controllerServer(protoHandler())
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		get(t, srv)
+	}
+	assert.Equal(t, atomic.LoadInt32(conns), int32(3), "number of connections")
+}
+
+func TestSharedClientHTTP2(t *testing.T) {
+	conf := DefaultTransportConfig
+	conf.HTTP2 = true
+	Configure(conf)
+	defer Configure(DefaultTransportConfig)
+	srv, conns := controllerServer(h2c.NewHandler(protoHandler(), &http2.Server{}))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, get(t, srv), "HTTP/2.0", "protocol")
+	}
+	assert.Equal(t, atomic.LoadInt32(conns), int32(1), "number of connections")
+}
+
+func TestClientsShareHTTPClient(t *testing.T) {
+	first, err := NewForUser("127.0.0.1", "80", "token")
+	assert.NoErr(t, err)
+	second, err := NewForUser("127.0.0.1", "80", "other")
+	assert.NoErr(t, err)
+	assert.True(t, first.HTTPClient == second.HTTPClient, "clients don't share their HTTP client")
+}
+
+func TestWithContext(t *testing.T) {
+	srv, _ := controllerServer(protoHandler())
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	assert.NoErr(t, err)
+	client, err := NewForUser(u.Hostname(), u.Port(), "token")
+	assert.NoErr(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := WithContext(ctx, client)
+	res, err := bound.HTTPClient.Get(srv.URL)
+	assert.NoErr(t, err)
+	res.Body.Close()
+	cancel()
+	_, err = bound.HTTPClient.Get(srv.URL)
+	assert.True(t, err != nil, "request sent after the context was canceled")
+	res, err = client.HTTPClient.Get(srv.URL)
+	assert.NoErr(t, err)
+	res.Body.Close()
+}
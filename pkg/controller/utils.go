@@ -2,20 +2,30 @@ package controller
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/drycc/builder/pkg/conf"
 	drycc "github.com/drycc/controller-sdk-go"
 	"github.com/drycc/pkg/log"
 )
 
+// controllerURL returns the URL of the controller at host and port. host may be an IPv6 literal.
+func controllerURL(host, port string) string {
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
 // New creates a new SDK client configured as the builder.
 func New(host, port string) (*drycc.Client, error) {
 
-	client, err := drycc.New(true, fmt.Sprintf("http://%s:%s/", host, port), "")
+	client, err := drycc.New(true, controllerURL(host, port), "")
 	if err != nil {
 		return client, err
 	}
 	client.UserAgent = "drycc-builder"
+	client.HTTPClient = httpClient()
 
 	builderKey, err := conf.GetBuilderKey()
 	if err != nil {
@@ -26,6 +36,17 @@ func New(host, port string) (*drycc.Client, error) {
 	return client, nil
 }
 
+// NewForUser creates a new SDK client that acts as the user that token belongs to.
+func NewForUser(host, port, token string) (*drycc.Client, error) {
+	client, err := drycc.New(true, controllerURL(host, port), token)
+	if err != nil {
+		return client, err
+	}
+	client.UserAgent = "drycc-builder"
+	client.HTTPClient = httpClient()
+	return client, nil
+}
+
 // CheckAPICompat checks for API compatibility errors and warns about them.
 func CheckAPICompat(c *drycc.Client, err error) error {
 	if err == drycc.ErrAPIMismatch {
@@ -38,3 +59,31 @@ func CheckAPICompat(c *drycc.Client, err error) error {
 
 	return err
 }
+
+// CompatibleAPI returns the range of the controller API versions the builder is compatible with,
+// from min, the version of its SDK, up to below, the next major version, excluded.
+func CompatibleAPI() (min, below string) {
+	major, _ := strconv.Atoi(strings.SplitN(drycc.APIVersion, ".", 2)[0])
+	return drycc.APIVersion, fmt.Sprintf("%d.0", major+1)
+}
+
+// IsUnavailable returns true if err indicates that the controller couldn't be reached or is
+// temporarily unable to serve requests, as opposed to having rejected the request.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *url.Error:
+		return true
+	case net.Error:
+		return true
+	default:
+		for _, code := range []string{"(502)", "(503)", "(504)"} {
+			if strings.HasPrefix(e.Error(), "Unknown Error "+code) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -46,6 +47,12 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestControllerURL(t *testing.T) {
+	assert.Equal(t, controllerURL("10.0.0.1", "80"), "http://10.0.0.1:80/", "IPv4 URL")
+	assert.Equal(t, controllerURL("fd00::1", "80"), "http://[fd00::1]:80/", "IPv6 URL")
+	assert.Equal(t, controllerURL("drycc-controller", "80"), "http://drycc-controller:80/", "hostname URL")
+}
+
 func TestNewWithInvalidBuilderKeyPath(t *testing.T) {
 	host := "127.0.0.1"
 	port := "80"
@@ -66,3 +73,12 @@ func TestCheckAPICompat(t *testing.T) {
 		t.Error("expected error to be returned, got nil")
 	}
 }
+
+func TestIsUnavailable(t *testing.T) {
+	assert.False(t, IsUnavailable(nil), "nil error reported as unavailable")
+	assert.False(t, IsUnavailable(drycc.ErrForbidden), "forbidden reported as unavailable")
+	assert.False(t, IsUnavailable(errors.New("Unknown Error (400): bad request")), "400 reported as unavailable")
+	assert.True(t, IsUnavailable(errors.New("Unknown Error (503): unavailable")), "503 not reported as unavailable")
+	urlErr := &url.Error{Op: "Post", URL: "http://controller/", Err: errors.New("connection refused")}
+	assert.True(t, IsUnavailable(urlErr), "connection error not reported as unavailable")
+}
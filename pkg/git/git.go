@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"github.com/drycc/pkg/log"
 	"golang.org/x/crypto/ssh"
@@ -40,12 +41,29 @@ boot git-receive | strip_remote_prefix
 
 var preReceiveHookTpl = template.Must(template.New("hooks").Parse(preReceiveHookTplStr))
 
-// Receive receives a Git repo.
-// This will only work for git-receive-pack.
+// ReceiveTrace is the trace of a receive. Its ID is passed to the hook as TRACE_ID, for the
+// build to be tied to the transport, and Receive fills in the size and durations of the receive.
+type ReceiveTrace struct {
+	ID string
+	// PackBytes is the size of the pack, and the commands, received from the client, in
+	// PackDuration.
+	PackBytes    int64
+	PackDuration time.Duration
+	// HookDuration is how long git took to run the hook once the pack was received.
+	HookDuration time.Duration
+}
+
+// Receive receives a Git repo, kept in repos.
+// This will only work for git-receive-pack. term is the terminal type of the client, empty if it
+// didn't request a pty. hookEnv is added to the environment of the hook, and trace, if it's not
+// nil, is filled in with the size and durations of the receive.
 func Receive(
 	repo, operation, gitHome string,
+	repos RepoStore,
 	channel ssh.Channel,
-	fingerprint, username, conndata, receivetype string) error {
+	fingerprint, username, conndata, receivetype, term string,
+	hookEnv []string,
+	trace *ReceiveTrace) error {
 
 	log.Info("receiving git repo name: %s, operation: %s, fingerprint: %s, user: %s", repo, operation, fingerprint, username)
 
@@ -53,17 +71,7 @@ func Receive(
 		channel.Write([]byte("OK"))
 		return nil
 	}
-	repoPath := filepath.Join(gitHome, repo)
-	log.Info("creating repo directory %s", repoPath)
-	if _, err := createRepo(repoPath); err != nil {
-		err = fmt.Errorf("Did not create new repo (%s)", err)
-
-		return err
-	}
-
-	log.Info("writing pre-receive hook under %s", repoPath)
-	if err := createPreReceiveHook(gitHome, repoPath); err != nil {
-		err = fmt.Errorf("Did not write pre-receive hook (%s)", err)
+	if err := PrepareRepo(gitHome, repo, repos); err != nil {
 		return err
 	}
 
@@ -73,14 +81,17 @@ func Receive(
 	var errbuff bytes.Buffer
 
 	cmd.Dir = gitHome
-	cmd.Env = []string{
-		fmt.Sprintf("RECEIVE_USER=%s", username),
-		fmt.Sprintf("RECEIVE_REPO=%s", repo),
-		fmt.Sprintf("RECEIVE_FINGERPRINT=%s", fingerprint),
-		fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s '%s'", operation, repo),
-		fmt.Sprintf("SSH_CONNECTION=%s", conndata),
+	env := append(ReceiveEnv(repo, operation, fingerprint, username, conndata), hookEnv...)
+	if term != "" {
+		// the client requested a pty, builds render their output for its terminal
+		env = append(env, "RECEIVE_TERM="+term)
+	}
+	if trace == nil {
+		trace = new(ReceiveTrace)
+	} else if trace.ID != "" {
+		env = append(env, "TRACE_ID="+trace.ID)
 	}
-	cmd.Env = append(cmd.Env, os.Environ()...)
+	cmd.Env = append(env, os.Environ()...)
 
 	log.Debug("Working Dir: %s", cmd.Dir)
 	log.Debug("Environment: %s", strings.Join(cmd.Env, ","))
@@ -97,14 +108,20 @@ func Receive(
 		return err
 	}
 
-	if _, err := io.Copy(inpipe, channel); err != nil {
+	start := time.Now()
+	n, err := io.Copy(inpipe, channel)
+	trace.PackBytes, trace.PackDuration = n, time.Since(start)
+	if err != nil {
 		err = fmt.Errorf("Failed to write git objects into the git pre-receive hook (%s)", err)
 		return err
 	}
 
 	fmt.Println("Waiting for git-receive to run.")
 	fmt.Println("Waiting for deploy.")
-	if err := cmd.Wait(); err != nil {
+	start = time.Now()
+	err = cmd.Wait()
+	trace.HookDuration = time.Since(start)
+	if err != nil {
 		err = fmt.Errorf("Failed to run git pre-receive hook: %s (%s)", errbuff.Bytes(), err)
 		return err
 	}
@@ -113,10 +130,68 @@ func Receive(
 		return errors.New(errbuff.String())
 	}
 	log.Info("Deploy complete.")
+	if err := repos.Save(repo, filepath.Join(gitHome, repo)); err != nil {
+		log.Err("Failed to save repo %s: %s", repo, err)
+	}
+
+	return nil
+}
+
+// PrepareRepo loads the repo named repo from repos to gitHome, creates it if needed, and installs
+// the configuration and the pre-receive hook that run a build for every push.
+func PrepareRepo(gitHome, repo string, repos RepoStore) error {
+	repoPath := filepath.Join(gitHome, repo)
+	if err := repos.Load(repo, repoPath); err != nil {
+		return fmt.Errorf("Did not load repo (%s)", err)
+	}
+	log.Info("creating repo directory %s", repoPath)
+	if _, err := createRepo(repoPath); err != nil {
+		return fmt.Errorf("Did not create new repo (%s)", err)
+	}
 
+	if err := configureRepo(repoPath); err != nil {
+		return fmt.Errorf("Did not configure repo (%s)", err)
+	}
+
+	log.Info("writing pre-receive hook under %s", repoPath)
+	if err := createPreReceiveHook(gitHome, repoPath); err != nil {
+		return fmt.Errorf("Did not write pre-receive hook (%s)", err)
+	}
 	return nil
 }
 
+// RunPreReceiveHook runs the pre-receive hook of repo, loaded from repos to gitHome, for the push
+// of input, a line like "<old-rev> <new-rev> <ref>", without receiving anything. It's how pushes
+// that were already received are built later. env is the environment of the push, see ReceiveEnv,
+// and the output of the hook is written to out.
+func RunPreReceiveHook(gitHome, repo string, repos RepoStore, env []string, input string, out io.Writer) error {
+	if err := PrepareRepo(gitHome, repo, repos); err != nil {
+		return err
+	}
+	repoPath := filepath.Join(gitHome, repo)
+	cmd := exec.Command(filepath.Join(repoPath, "hooks", "pre-receive"))
+	cmd.Dir = repoPath
+	cmd.Env = append(env, os.Environ()...)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to run git pre-receive hook (%s)", err)
+	}
+	return nil
+}
+
+// ReceiveEnv returns the environment variables that the pre-receive hook expects git to run with.
+// conndata is in the format of the SSH_CONNECTION environment variable.
+func ReceiveEnv(repo, operation, fingerprint, username, conndata string) []string {
+	return []string{
+		fmt.Sprintf("RECEIVE_USER=%s", username),
+		fmt.Sprintf("RECEIVE_REPO=%s", repo),
+		fmt.Sprintf("RECEIVE_FINGERPRINT=%s", fingerprint),
+		fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s '%s'", operation, repo),
+		fmt.Sprintf("SSH_CONNECTION=%s", conndata),
+	}
+}
+
 var createLock sync.Mutex
 
 // createRepo creates a new Git repo if it is not present already.
@@ -155,6 +230,25 @@ func createRepo(repoPath string) (bool, error) {
 	return false, err
 }
 
+// repoConfig is the git configuration applied to every repo before a receive.
+var repoConfig = map[string]string{
+	// lets users pass options such as `git push -o image=...` through to the pre-receive hook
+	"receive.advertisePushOptions": "true",
+}
+
+// configureRepo applies repoConfig to the repo at repoPath. It's applied on every receive so
+// that repos created by older builders pick up new settings.
+func configureRepo(repoPath string) error {
+	for key, value := range repoConfig {
+		cmd := exec.Command("git", "config", key, value)
+		cmd.Dir = repoPath
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("setting %s (%s: %s)", key, err, out)
+		}
+	}
+	return nil
+}
+
 // createPreReceiveHook renders preReceiveHookTpl to repoPath/hooks/pre-receive
 func createPreReceiveHook(gitHome, repoPath string) error {
 	writePath := filepath.Join(repoPath, "hooks", "pre-receive")
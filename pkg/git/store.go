@@ -0,0 +1,422 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/pkg/log"
+)
+
+// The kinds of repo storage.
+const (
+	// VolumeRepoStorage keeps repos only under the git home, which must be a persistent volume
+	// shared by all replicas for more than one replica to run.
+	VolumeRepoStorage = "volume"
+	// ObjectRepoStorage syncs repos with the object storage.
+	ObjectRepoStorage = "object"
+	// ExternalRepoStorage mirrors repos to and from an external git service.
+	ExternalRepoStorage = "external"
+)
+
+const (
+	// RepoKeyPattern is the template for the key of the archive of an app's repo in the object
+	// storage.
+	RepoKeyPattern = "/home/%s/repo.tar.gz"
+	// repoSumFile is the file in a local repo holding the checksum of the archive it was last
+	// synced with.
+	repoSumFile = "drycc-repo.sha256"
+	// repoURLPlaceholder is replaced with the name of a repo in the URL of the external git service.
+	repoURLPlaceholder = "{repo}"
+	// loadedRefsFile is the file in a local repo holding its refs as they were last loaded from,
+	// or saved to, the external git service.
+	loadedRefsFile = "drycc-loaded-refs"
+)
+
+// RepoStore keeps the bare repos pushes are received into. Git always works on a local copy of a
+// repo under the git home: a RepoStore brings it up to date before a push is received and
+// persists it afterwards, so that the next push to the repo can be received by any replica.
+type RepoStore interface {
+	// Load brings the local copy of repo at path up to date. It's not an error for repo not to
+	// exist yet.
+	Load(repo, path string) error
+	// Save persists the local copy of repo at path after a push to it was received.
+	Save(repo, path string) error
+	// Delete removes repo from the store.
+	Delete(repo string) error
+}
+
+// NewRepoStore returns the RepoStore for the repo storage kind. driver is the object storage and
+// externalURL the URL of repos on an external git service, with "{repo}" standing for the repo
+// name.
+func NewRepoStore(kind string, driver storagedriver.StorageDriver, externalURL string) (RepoStore, error) {
+	switch kind {
+	case VolumeRepoStorage, "":
+		return VolumeStore{}, nil
+	case ObjectRepoStorage:
+		return ObjectStore{Driver: driver}, nil
+	case ExternalRepoStorage:
+		if !strings.Contains(externalURL, repoURLPlaceholder) {
+			return nil, fmt.Errorf("the external git URL %q doesn't contain %s", externalURL, repoURLPlaceholder)
+		}
+		return ExternalStore{URL: externalURL}, nil
+	}
+	return nil, fmt.Errorf("unknown repo storage %q", kind)
+}
+
+// appName returns the name of the app the repo repo belongs to.
+func appName(repo string) string {
+	return strings.TrimSuffix(repo, ".git")
+}
+
+// VolumeStore is the RepoStore of repos kept only under the git home.
+type VolumeStore struct{}
+
+// Load is the RepoStore interface implementation. The local copy is the repo.
+func (VolumeStore) Load(repo, path string) error { return nil }
+
+// Save is the RepoStore interface implementation. The local copy is the repo.
+func (VolumeStore) Save(repo, path string) error { return nil }
+
+// Delete is the RepoStore interface implementation. The cleaner removes the local copy.
+func (VolumeStore) Delete(repo string) error { return nil }
+
+// ObjectStore is the RepoStore of repos archived in the object storage.
+type ObjectStore struct {
+	Driver storagedriver.StorageDriver
+}
+
+func (s ObjectStore) key(repo string) string {
+	return fmt.Sprintf(RepoKeyPattern, appName(repo))
+}
+
+// Load is the RepoStore interface implementation. The archived repo is streamed to a file next
+// to the local copy, which is replaced with it unless it was last synced with the same archive.
+// The caller must hold the lock of repo, for the local copy not to be replaced while it's used.
+func (s ObjectStore) Load(repo, path string) error {
+	rc, err := s.Driver.Reader(context.Background(), s.key(repo), 0)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("downloading repo %s (%s)", repo, err)
+	}
+	defer rc.Close()
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+repo+".tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), rc); err != nil {
+		return fmt.Errorf("downloading repo %s (%s)", repo, err)
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if local, err := ioutil.ReadFile(filepath.Join(path, repoSumFile)); err == nil && string(local) == sum {
+		return nil
+	}
+
+	log.Info("loading repo %s from the object storage", repo)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), "."+repo)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := extractRepo(f, tmpDir); err != nil {
+		return fmt.Errorf("extracting repo %s (%s)", repo, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, repoSumFile), []byte(sum), 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, path)
+}
+
+// Save is the RepoStore interface implementation. The repo is archived straight to the object
+// storage.
+func (s ObjectStore) Save(repo, path string) error {
+	fw, err := s.Driver.Writer(context.Background(), s.key(repo), false)
+	if err != nil {
+		return fmt.Errorf("uploading repo %s (%s)", repo, err)
+	}
+	h := sha256.New()
+	if err := archiveRepo(path, io.MultiWriter(fw, h)); err != nil {
+		fw.Cancel()
+		return fmt.Errorf("archiving repo %s (%s)", repo, err)
+	}
+	if err := fw.Commit(); err != nil {
+		return fmt.Errorf("uploading repo %s (%s)", repo, err)
+	}
+	if err := fw.Close(); err != nil {
+		return fmt.Errorf("uploading repo %s (%s)", repo, err)
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	return ioutil.WriteFile(filepath.Join(path, repoSumFile), []byte(sum), 0644)
+}
+
+// Delete is the RepoStore interface implementation.
+func (s ObjectStore) Delete(repo string) error {
+	err := s.Driver.Delete(context.Background(), s.key(repo))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// skipArchived returns true for the files of a local repo that aren't archived: the checksum of
+// the last sync, and what builds leave at the top of the repo.
+func skipArchived(rel string, fi os.FileInfo) bool {
+	if strings.Contains(rel, string(filepath.Separator)) {
+		return false
+	}
+	return rel == repoSumFile || rel == "build" || (!fi.IsDir() && (strings.HasSuffix(rel, ".tar.gz") || strings.HasSuffix(rel, ".tar.zst")))
+}
+
+// archiveRepo writes the gzipped tar archive of the repo at path to w.
+func archiveRepo(path string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skipArchived(rel, fi) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractRepo extracts the gzipped tar archive of a repo read from r into dir.
+func extractRepo(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside of the repo", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ExternalStore is the RepoStore of repos mirrored to an external git service.
+type ExternalStore struct {
+	// URL is the URL of repos, with "{repo}" standing for the repo name.
+	URL string
+}
+
+func (s ExternalStore) url(repo string) string {
+	return strings.Replace(s.URL, repoURLPlaceholder, repo, -1)
+}
+
+// redacted returns the URL of repo with its password, if it has one, masked, to be logged.
+func (s ExternalStore) redacted(repo string) string {
+	u, err := url.Parse(s.url(repo))
+	if err != nil || u.User == nil {
+		return s.url(repo)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// run runs git with args in dir, returning an error with its output, with the URL of repo
+// redacted, if it fails.
+func (s ExternalStore) run(repo, dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.Replace(out, []byte(s.url(repo)), []byte(s.redacted(repo)), -1)
+		return out, fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// Load is the RepoStore interface implementation. Repos the git service reports missing are left
+// to be created by the first push, but any other failure to clone fails the push, since saving a
+// new repo would overwrite the one the git service couldn't be reached for.
+func (s ExternalStore) Load(repo, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		out, err := s.run(repo, "", "clone", "--mirror", s.url(repo), path)
+		if err != nil {
+			os.RemoveAll(path)
+			if !repoNotFound(out) {
+				return fmt.Errorf("cloning %s from %s (%s)", repo, s.redacted(repo), err)
+			}
+			log.Info("%s isn't on %s yet, starting a new repo", repo, s.redacted(repo))
+			return nil
+		}
+	} else if _, err := s.run(repo, path, "fetch", "--prune", s.url(repo), "+refs/*:refs/*"); err != nil {
+		return fmt.Errorf("fetching %s from %s (%s)", repo, s.redacted(repo), err)
+	}
+	return writeLoadedRefs(path)
+}
+
+// Save is the RepoStore interface implementation. Only the refs the push changed since the repo
+// was loaded are pushed, each only if the git service still has it as it was loaded, so that the
+// refs others pushed to the git service in the meantime are never overwritten or deleted.
+func (s ExternalStore) Save(repo, path string) error {
+	loaded, err := readRefs(filepath.Join(path, loadedRefsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := s.run(repo, path, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return fmt.Errorf("listing the refs of %s (%s)", repo, err)
+	}
+	current := parseRefs(out)
+	args := []string{"push", "--porcelain", s.url(repo)}
+	var refspecs []string
+	for ref, sha := range current {
+		if loaded[ref] != sha {
+			args = append(args, "--force-with-lease="+ref+":"+loaded[ref])
+			refspecs = append(refspecs, ref+":"+ref)
+		}
+	}
+	for ref, sha := range loaded {
+		if _, ok := current[ref]; !ok {
+			args = append(args, "--force-with-lease="+ref+":"+sha)
+			refspecs = append(refspecs, ":"+ref)
+		}
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	sort.Strings(refspecs)
+	if _, err := s.run(repo, path, append(args, refspecs...)...); err != nil {
+		return fmt.Errorf("pushing %s to %s (%s)", repo, s.redacted(repo), err)
+	}
+	return writeLoadedRefs(path)
+}
+
+// Delete is the RepoStore interface implementation. Repos are never deleted from the git service,
+// which owns them.
+func (s ExternalStore) Delete(repo string) error {
+	log.Info("not deleting %s from %s", repo, s.redacted(repo))
+	return nil
+}
+
+// repoNotFound returns true if the output of a failed clone says the git service has no such
+// repo, rather than that it couldn't be reached or refused access.
+func repoNotFound(out []byte) bool {
+	msg := strings.ToLower(string(out))
+	for _, notFound := range []string{"not found", "does not exist", "could not be found", "does not appear to be a git repository"} {
+		if strings.Contains(msg, notFound) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLoadedRefs records the refs of the repo at path as they were loaded from the git service,
+// for the next Save to tell which refs the push changed.
+func writeLoadedRefs(path string) error {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = path
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("listing the refs of %s (%s)", path, err)
+	}
+	return ioutil.WriteFile(filepath.Join(path, loadedRefsFile), out, 0644)
+}
+
+// readRefs reads the refs written by writeLoadedRefs at path.
+func readRefs(path string) (map[string]string, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(out), nil
+}
+
+// parseRefs parses the "<sha> <ref>" lines of git for-each-ref.
+func parseRefs(out []byte) map[string]string {
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs
+}
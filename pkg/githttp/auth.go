@@ -0,0 +1,51 @@
+package githttp
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/drycc/builder/pkg/controller"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/controller-sdk-go/api"
+)
+
+// ControllerAuthenticator authenticates users with their controller API token, as printed by
+// `drycc auth:token`, as the password. The username is ignored in favor of the token's owner. The
+// token is checked by the controller of the app pushed to.
+type ControllerAuthenticator struct {
+	Routes controller.Routes
+}
+
+// Authenticate is the Authenticator interface implementation.
+func (a *ControllerAuthenticator) Authenticate(username, password, app string) (string, error) {
+	if password == "" {
+		return "", errUnauthorized
+	}
+	e := a.Routes.For(app)
+	client, err := controller.NewForUser(e.Host, e.Port, password)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Request("GET", "/v2/auth/whoami/", nil)
+	if err == drycc.ErrUnauthorized {
+		return "", errUnauthorized
+	} else if err != nil && !drycc.IsErrAPIMismatch(err) {
+		return "", err
+	}
+	defer res.Body.Close()
+	user := api.User{}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		return "", err
+	}
+
+	// the controller only shows apps to users with access to them
+	res, err = client.Request("GET", fmt.Sprintf("/v2/apps/%s/", app), nil)
+	if _, ok := err.(drycc.ErrNotFound); ok || err == drycc.ErrForbidden {
+		return "", errForbidden
+	} else if err != nil && !drycc.IsErrAPIMismatch(err) {
+		return "", err
+	}
+	res.Body.Close()
+	return user.Username, nil
+}
@@ -0,0 +1,242 @@
+// Package githttp implements a smart HTTP git server, as an alternative to the SSH server for
+// networks that block SSH. Pushes run the same pre-receive hook, and therefore the same builds, as
+// pushes over SSH.
+//
+// See https://git-scm.com/docs/http-protocol
+package githttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/drycc/builder/pkg/controller"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/sshd"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	receivePack = "git-receive-pack"
+	uploadPack  = "git-upload-pack"
+)
+
+var (
+	errUnauthorized = errors.New("invalid username or token")
+	errForbidden    = errors.New("user has no permission to build the app")
+)
+
+// routeRegexp matches the smart HTTP endpoints of a repo: refs discovery and the pack services.
+var routeRegexp = regexp.MustCompile(`^/([a-z0-9-]+)\.git/(info/refs|git-receive-pack|git-upload-pack)$`)
+
+// Authenticator checks the credentials of a request for an app.
+type Authenticator interface {
+	// Authenticate returns the name of the user that password belongs to, errUnauthorized if the
+	// credentials are invalid or errForbidden if the user may not push to app.
+	Authenticate(username, password, app string) (string, error)
+}
+
+// Server serves the git repos under GitHome, kept in Repos, over HTTP.
+type Server struct {
+	GitHome  string
+	Repos    git.RepoStore
+	Auth     Authenticator
+	PushLock sshd.RepositoryLock
+	Limiter  *sshd.Limiter
+	// HookTokens mints the tokens the hooks of pushes authenticate to the controller with. They
+	// authenticate with the builder key if it's nil.
+	HookTokens *controller.HookTokens
+	// TarballMaxBytes is the largest tarball accepted, and TarballMaxExtractedBytes the most its
+	// content may take once decompressed, no limit if they're 0.
+	TarballMaxBytes          int64
+	TarballMaxExtractedBytes int64
+	// Backend runs git http-backend for a request. It's only replaced in tests.
+	Backend func(w http.ResponseWriter, r *http.Request, env []string)
+	// PreReceive runs the pre-receive hook of a repo for a tarball build. It's only replaced in
+	// tests.
+	PreReceive func(out io.Writer, repoPath, stdin string, env []string) error
+}
+
+// NewServer returns a Server for the repos under gitHome, kept in repos.
+func NewServer(gitHome string, repos git.RepoStore, auth Authenticator, pushLock sshd.RepositoryLock, limiter *sshd.Limiter) *Server {
+	s := &Server{GitHome: gitHome, Repos: repos, Auth: auth, PushLock: pushLock, Limiter: limiter}
+	s.Backend = s.httpBackend
+	s.PreReceive = preReceive
+	return s
+}
+
+// service returns the git service requested by r, given the last part of its path.
+func service(r *http.Request, endpoint string) string {
+	if endpoint == "info/refs" {
+		return r.URL.Query().Get("service")
+	}
+	return endpoint
+}
+
+// ServeHTTP is the http.Handler interface implementation.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if match := tarballRouteRegexp.FindStringSubmatch(r.URL.Path); match != nil {
+		app, ip := match[1], remoteIP(r)
+		if user, ok := s.authenticate(w, r, app, ip); ok {
+			s.serveTarball(w, r, app, user, ip)
+		}
+		return
+	}
+	match := routeRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+	app, svc := match[1], service(r, match[2])
+	if svc != receivePack && svc != uploadPack {
+		// dumb HTTP isn't supported
+		http.Error(w, "only smart HTTP is supported", http.StatusForbidden)
+		return
+	}
+
+	ip := remoteIP(r)
+	user, ok := s.authenticate(w, r, app, ip)
+	if !ok {
+		return
+	}
+
+	if svc == receivePack && r.Method == http.MethodPost {
+		if err := s.Limiter.AllowPush(ip, user); err != nil {
+			log.Info("Rejected push of %s by %s: %s", app, user, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+	// every request loads the local copy of the repo, which may replace it, so each one holds the
+	// lock of the repo, like over SSH, for none to replace the copy another one is serving
+	if err := s.PushLock.Lock(app); err != nil {
+		http.Error(w, "Another git push is ongoing", http.StatusConflict)
+		return
+	}
+	defer s.PushLock.Unlock(app)
+
+	repo := app + ".git"
+	if svc == receivePack {
+		if err := git.PrepareRepo(s.GitHome, repo, s.Repos); err != nil {
+			log.Err("Failed to prepare %s: %s", repo, err)
+			http.Error(w, "unable to prepare the repository", http.StatusInternalServerError)
+			return
+		}
+	} else if err := s.Repos.Load(repo, filepath.Join(s.GitHome, repo)); err != nil {
+		log.Err("Failed to load %s: %s", repo, err)
+		http.Error(w, "unable to load the repository", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("receiving git repo name: %s, operation: %s, user: %s over HTTP", repo, svc, user)
+	env := append(git.ReceiveEnv(repo, svc, "", user, connData(r)), "REMOTE_USER="+user)
+	if svc == receivePack && r.Method == http.MethodPost {
+		hookEnv, err := s.HookTokens.Env(app, user)
+		if err != nil {
+			log.Err("Failed to authorize the hook of %s: %s", repo, err)
+			http.Error(w, "unable to authorize the build", http.StatusServiceUnavailable)
+			return
+		}
+		env = append(env, hookEnv...)
+	}
+	s.Backend(w, r, env)
+	if svc == receivePack && r.Method == http.MethodPost {
+		if err := s.Repos.Save(repo, filepath.Join(s.GitHome, repo)); err != nil {
+			log.Err("Failed to save repo %s: %s", repo, err)
+		}
+	}
+}
+
+// authenticate returns the user the credentials of r, sent from ip, belong to if they may push to
+// app. Otherwise, it responds to r with the reason they may not.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, app, ip string) (string, bool) {
+	if s.Limiter.Banned(ip) {
+		http.Error(w, "too many authentication failures", http.StatusTooManyRequests)
+		return "", false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Drycc"`)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	user, err := s.Auth.Authenticate(username, password, app)
+	switch err {
+	case nil:
+	case errUnauthorized:
+		if s.Limiter.AuthFailed(ip) {
+			log.Info("Banning %s after repeated authentication failures", ip)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Drycc"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	case errForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", false
+	default:
+		log.Err("Failed to authenticate %s over HTTP: %s", username, err)
+		http.Error(w, "unable to authenticate with the controller", http.StatusServiceUnavailable)
+		return "", false
+	}
+	return user, true
+}
+
+// httpBackend serves r with git http-backend, running git hooks with env.
+func (s *Server) httpBackend(w http.ResponseWriter, r *http.Request, env []string) {
+	handler := &cgi.Handler{
+		Path: "/usr/bin/git",
+		Args: []string{"http-backend"},
+		Dir:  s.GitHome,
+		Env: append(env,
+			"GIT_PROJECT_ROOT="+s.GitHome,
+			"GIT_HTTP_EXPORT_ALL=1",
+		),
+		// the pre-receive hook needs the builder's configuration
+		InheritEnv: inheritedEnv(),
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// inheritedEnv returns the names of all environment variables of the builder.
+func inheritedEnv() []string {
+	var names []string
+	for _, kv := range os.Environ() {
+		names = append(names, strings.SplitN(kv, "=", 2)[0])
+	}
+	return names
+}
+
+// remoteIP returns the IP of the client that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// connData returns the connection of r in the format of the SSH_CONNECTION environment variable.
+func connData(r *http.Request) string {
+	rhost, rport, _ := net.SplitHostPort(r.RemoteAddr)
+	lhost, lport := "", ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		lhost, lport, _ = net.SplitHostPort(addr.String())
+	}
+	return fmt.Sprintf("%s %s %s %s", rhost, rport, lhost, lport)
+}
+
+// Serve serves s on addr until it fails. If certFile and keyFile are set, it serves HTTPS.
+func Serve(s *Server, addr, certFile, keyFile string) error {
+	log.Info("Listening for git over HTTP on %s", addr)
+	if certFile != "" && keyFile != "" {
+		return http.ListenAndServeTLS(addr, certFile, keyFile, s)
+	}
+	return http.ListenAndServe(addr, s)
+}
@@ -0,0 +1,193 @@
+package githttp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/sshd"
+)
+
+type fakeAuthenticator map[string]string
+
+// Authenticate accepts the tokens in f, which belong to users with access to any app but
+// "forbidden".
+func (f fakeAuthenticator) Authenticate(username, password, app string) (string, error) {
+	user, ok := f[password]
+	if !ok {
+		return "", errUnauthorized
+	}
+	if app == "forbidden" {
+		return "", errForbidden
+	}
+	return user, nil
+}
+
+func newTestingServer(t *testing.T) (*Server, *[]string, func()) {
+	gitHome, err := ioutil.TempDir("", "githttp")
+	assert.NoErr(t, err)
+	var backendEnv []string
+	srv := NewServer(gitHome, git.VolumeStore{}, fakeAuthenticator{"token": "alice"}, sshd.NewInMemoryRepositoryLock(0), nil)
+	srv.Backend = func(w http.ResponseWriter, r *http.Request, env []string) {
+		backendEnv = env
+		w.WriteHeader(http.StatusOK)
+	}
+	return srv, &backendEnv, func() { os.RemoveAll(gitHome) }
+}
+
+func request(srv *Server, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.SetBasicAuth("git", token)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeHTTPRoutes(t *testing.T) {
+	srv, _, cleanup := newTestingServer(t)
+	defer cleanup()
+
+	assert.Equal(t, request(srv, "GET", "/", "token").Code, http.StatusNotFound, "root")
+	assert.Equal(t, request(srv, "GET", "/../etc.git/info/refs", "token").Code, http.StatusNotFound, "path traversal")
+	assert.Equal(t, request(srv, "GET", "/app.git/info/refs", "token").Code, http.StatusForbidden, "dumb HTTP")
+	assert.Equal(t, request(srv, "GET", "/app.git/HEAD", "token").Code, http.StatusNotFound, "dumb HTTP files")
+}
+
+func TestServeHTTPAuth(t *testing.T) {
+	srv, _, cleanup := newTestingServer(t)
+	defer cleanup()
+
+	path := "/app.git/info/refs?service=git-upload-pack"
+	w := request(srv, "GET", path, "")
+	assert.Equal(t, w.Code, http.StatusUnauthorized, "no credentials")
+	assert.True(t, w.Header().Get("WWW-Authenticate") != "", "no authentication challenge")
+	assert.Equal(t, request(srv, "GET", path, "wrong").Code, http.StatusUnauthorized, "wrong token")
+	assert.Equal(t, request(srv, "GET", "/forbidden.git/info/refs?service=git-upload-pack", "token").Code, http.StatusForbidden, "forbidden app")
+	assert.Equal(t, request(srv, "GET", path, "token").Code, http.StatusOK, "valid token")
+}
+
+func TestServeHTTPReceivePack(t *testing.T) {
+	srv, env, cleanup := newTestingServer(t)
+	defer cleanup()
+
+	w := request(srv, "POST", "/app.git/git-receive-pack", "token")
+	assert.Equal(t, w.Code, http.StatusOK, "push")
+	_, err := os.Stat(srv.GitHome + "/app.git/hooks/pre-receive")
+	assert.NoErr(t, err)
+	joined := strings.Join(*env, "\n")
+	assert.True(t, strings.Contains(joined, "RECEIVE_USER=alice"), "user not passed to the hook")
+	assert.True(t, strings.Contains(joined, "SSH_ORIGINAL_COMMAND=git-receive-pack 'app.git'"), "command not passed to the hook")
+
+	// a push to an app that's already being pushed to is rejected
+	assert.NoErr(t, srv.PushLock.Lock("app"))
+	assert.Equal(t, request(srv, "POST", "/app.git/git-receive-pack", "token").Code, http.StatusConflict, "concurrent push")
+	// and so is a fetch, whose load of the repo would replace the one being pushed to
+	assert.Equal(t, request(srv, "GET", "/app.git/info/refs?service=git-upload-pack", "token").Code, http.StatusConflict, "fetch during a push")
+	assert.NoErr(t, srv.PushLock.Unlock("app"))
+	assert.Equal(t, request(srv, "GET", "/app.git/info/refs?service=git-upload-pack", "token").Code, http.StatusOK, "fetch")
+	assert.Equal(t, request(srv, "GET", "/app.git/info/refs?service=git-upload-pack", "token").Code, http.StatusOK, "fetch after a fetch")
+}
+
+// testTarball returns a gzipped tarball of files, keyed by name.
+func testTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		assert.NoErr(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		assert.NoErr(t, err)
+	}
+	assert.NoErr(t, tw.Close())
+	assert.NoErr(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestServeHTTPTarball(t *testing.T) {
+	srv, _, cleanup := newTestingServer(t)
+	defer cleanup()
+	var stdin string
+	var env []string
+	fail := false
+	srv.PreReceive = func(out io.Writer, repoPath, in string, e []string) error {
+		stdin, env = in, e
+		fmt.Fprintln(out, "building")
+		if fail {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	post := func(path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.SetBasicAuth("git", "token")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, request(srv, "GET", "/app/tarball", "token").Code, http.StatusMethodNotAllowed, "GET")
+	assert.Equal(t, request(srv, "POST", "/app/tarball", "").Code, http.StatusUnauthorized, "no credentials")
+	assert.Equal(t, post("/app/tarball", []byte("not a tarball")).Code, http.StatusBadRequest, "invalid tarball")
+
+	tarball := testTarball(t, map[string]string{"app-1.0/Procfile": "web: bin/web", "app-1.0/bin/web": "#!/bin/sh"})
+	w := post("/app/tarball?version=1.0&option=dry-run", tarball)
+	assert.Equal(t, w.Code, http.StatusOK, "tarball")
+	assert.Equal(t, w.Body.String(), "building\n", "build output")
+	fields := strings.Fields(stdin)
+	assert.Equal(t, len(fields), 3, "fields of the hook input")
+	assert.Equal(t, fields[0], zeroSha, "old revision")
+	assert.Equal(t, fields[2], tarballRef, "ref")
+	joined := strings.Join(env, "\n")
+	assert.True(t, strings.Contains(joined, "RECEIVE_USER=alice"), "user not passed to the hook")
+	assert.True(t, strings.Contains(joined, "GIT_PUSH_OPTION_0=dry-run"), "option not passed to the hook")
+
+	repoPath := filepath.Join(srv.GitHome, "app.git")
+	assert.Equal(t, revParse(repoPath, tarballRef), fields[1], "master after the build")
+	files, err := gitCmd(repoPath, nil, "ls-tree", "-r", "--name-only", fields[1]).Output()
+	assert.NoErr(t, err)
+	assert.Equal(t, string(files), "Procfile\nbin/web\n", "files of the commit")
+
+	// a failed build leaves master where it was
+	fail = true
+	w = post("/app/tarball", testTarball(t, map[string]string{"Procfile": "web: bin/other"}))
+	assert.True(t, strings.Contains(w.Body.String(), "error: the build of the tarball failed"), "failure not reported")
+	assert.Equal(t, strings.Fields(stdin)[0], fields[1], "old revision of the second build")
+	assert.Equal(t, revParse(repoPath, tarballRef), fields[1], "master after a failed build")
+}
+
+func TestServeHTTPTarballTooLarge(t *testing.T) {
+	srv, _, cleanup := newTestingServer(t)
+	defer cleanup()
+	srv.PreReceive = func(out io.Writer, repoPath, in string, e []string) error {
+		return nil
+	}
+	post := func(body []byte) int {
+		req := httptest.NewRequest("POST", "/app/tarball", bytes.NewReader(body))
+		req.SetBasicAuth("git", "token")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	tarball := testTarball(t, map[string]string{"Procfile": strings.Repeat("web: bin/web\n", 1000)})
+
+	srv.TarballMaxBytes = int64(len(tarball)) - 1
+	assert.Equal(t, post(tarball), http.StatusRequestEntityTooLarge, "tarball over the size limit")
+	srv.TarballMaxBytes, srv.TarballMaxExtractedBytes = int64(len(tarball)), 4096
+	assert.Equal(t, post(tarball), http.StatusRequestEntityTooLarge, "tarball over the extracted size limit")
+	srv.TarballMaxExtractedBytes = 1 << 20
+	assert.Equal(t, post(tarball), http.StatusOK, "tarball within the limits")
+}
@@ -0,0 +1,258 @@
+package githttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// tarballRef is the branch that tarball builds are committed to, like pushes of master.
+	tarballRef = "refs/heads/master"
+	// zeroSha is the revision git passes to hooks for refs that don't exist yet.
+	zeroSha = "0000000000000000000000000000000000000000"
+)
+
+// errTarballTooLarge is returned for tarballs larger than the limits of the server.
+var errTarballTooLarge = errors.New("the tarball is too large")
+
+// tarballRouteRegexp matches the endpoint that builds an app from a gzipped tarball of its
+// source, for sources that don't live in a git repo.
+var tarballRouteRegexp = regexp.MustCompile(`^/([a-z0-9-]+)/tarball$`)
+
+// serveTarball builds app, for user, from the gzipped tarball in the body of r. The tarball is
+// committed to the master branch of the app's repo and run through the pre-receive hook, like a
+// push of that commit, with the build output streamed back. Query parameters named option are
+// passed to the build as push options.
+func (s *Server) serveTarball(w http.ResponseWriter, r *http.Request, app, user, ip string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "tarballs must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.Limiter.AllowPush(ip, user); err != nil {
+		log.Info("Rejected tarball of %s by %s: %s", app, user, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := s.PushLock.Lock(app); err != nil {
+		http.Error(w, "Another git push is ongoing", http.StatusConflict)
+		return
+	}
+	defer s.PushLock.Unlock(app)
+	repo := app + ".git"
+	if err := git.PrepareRepo(s.GitHome, repo, s.Repos); err != nil {
+		log.Err("Failed to prepare %s: %s", repo, err)
+		http.Error(w, "unable to prepare the repository", http.StatusInternalServerError)
+		return
+	}
+
+	repoPath := filepath.Join(s.GitHome, repo)
+	oldRev := revParse(repoPath, tarballRef)
+	body := io.Reader(r.Body)
+	if s.TarballMaxBytes > 0 {
+		body = &countingReader{r: http.MaxBytesReader(w, r.Body, s.TarballMaxBytes)}
+	}
+	newRev, err := commitTarball(repoPath, body, oldRev, user, r.URL.Query().Get("version"), s.TarballMaxExtractedBytes)
+	if c, ok := body.(*countingReader); ok && err != nil && c.n >= s.TarballMaxBytes {
+		err = errTarballTooLarge
+	}
+	if err != nil {
+		log.Info("Rejected tarball of %s by %s: %s", app, user, err)
+		status := http.StatusBadRequest
+		if err == errTarballTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	log.Info("receiving tarball of %s as %s, user: %s over HTTP", repo, newRev, user)
+	hookEnv, err := s.HookTokens.Env(app, user)
+	if err != nil {
+		log.Err("Failed to authorize the hook of %s: %s", repo, err)
+		http.Error(w, "unable to authorize the build", http.StatusServiceUnavailable)
+		return
+	}
+	env := append(git.ReceiveEnv(repo, receivePack, "", user, connData(r)), pushOptionsEnv(r.URL.Query()["option"])...)
+	env = append(env, hookEnv...)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	out := &flushWriter{w: w}
+	if oldRev == "" {
+		oldRev = zeroSha
+	}
+	if err := s.PreReceive(out, repoPath, fmt.Sprintf("%s %s %s\n", oldRev, newRev, tarballRef), env); err != nil {
+		log.Info("Build of the tarball of %s by %s failed: %s", app, user, err)
+		fmt.Fprintf(out, "error: the build of the tarball failed (%s)\n", err)
+		return
+	}
+	if err := gitCmd(repoPath, nil, "update-ref", tarballRef, newRev).Run(); err != nil {
+		log.Err("Failed to update %s of %s: %s", tarballRef, repo, err)
+		fmt.Fprintf(out, "error: the tarball was built but %s wasn't updated (%s)\n", tarballRef, err)
+		return
+	}
+	if err := s.Repos.Save(repo, repoPath); err != nil {
+		log.Err("Failed to save repo %s: %s", repo, err)
+	}
+}
+
+// preReceive runs the pre-receive hook of the repo at repoPath like git does, with stdin as its
+// input and env added to its environment, writing its output to out.
+func preReceive(out io.Writer, repoPath, stdin string, env []string) error {
+	cmd := exec.Command(filepath.Join(repoPath, "hooks", "pre-receive"))
+	cmd.Dir = repoPath
+	cmd.Env = append(append(os.Environ(), env...), "GIT_DIR=.")
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// pushOptionsEnv returns the environment variables git passes push options to hooks with.
+func pushOptionsEnv(options []string) []string {
+	if len(options) == 0 {
+		return nil
+	}
+	env := []string{fmt.Sprintf("GIT_PUSH_OPTION_COUNT=%d", len(options))}
+	for i, option := range options {
+		env = append(env, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, option))
+	}
+	return env
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// commitTarball extracts the gzipped tarball read from r and commits it to the repo at repoPath,
+// as a child of parent if it's set, by user. If the tarball has a single top-level directory, as
+// tarballs of releases often do, its content is committed instead. Tarballs whose decompressed
+// archive is larger than maxExtracted, unless it's 0, are rejected with errTarballTooLarge. It
+// returns the sha of the commit, which no ref points to yet.
+func commitTarball(repoPath string, r io.Reader, parent, user, version string, maxExtracted int64) (string, error) {
+	dir, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	workTree, index := filepath.Join(dir, "src"), filepath.Join(dir, "index")
+	if err := os.Mkdir(workTree, 0755); err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("extracting the tarball (%s)", err)
+	}
+	// the archive is decompressed here, so that tar can be cut off once it's past maxExtracted
+	archive := &countingReader{r: gz}
+	if maxExtracted > 0 {
+		archive.r = io.LimitReader(gz, maxExtracted+1)
+	}
+	// tar refuses members outside of the directory it extracts to
+	tarCmd := exec.Command("tar", "-xf", "-", "--no-same-owner", "-C", workTree)
+	tarCmd.Stdin = archive
+	out, err := tarCmd.CombinedOutput()
+	if maxExtracted > 0 && archive.n > maxExtracted {
+		return "", errTarballTooLarge
+	} else if err != nil {
+		return "", fmt.Errorf("extracting the tarball (%s: %s)", err, strings.TrimSpace(string(out)))
+	}
+	if workTree, err = tarballRoot(workTree); err != nil {
+		return "", err
+	}
+
+	env := []string{"GIT_WORK_TREE=" + workTree, "GIT_INDEX_FILE=" + index}
+	addCmd := gitCmd(repoPath, env, "add", "--all", ".")
+	addCmd.Dir = workTree
+	if out, err := addCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("adding the tarball to the repository (%s: %s)", err, strings.TrimSpace(string(out)))
+	}
+	tree, err := gitCmd(repoPath, env, "write-tree").Output()
+	if err != nil {
+		return "", fmt.Errorf("writing the tree of the tarball (%s)", err)
+	}
+	message := "Build of a tarball"
+	if version != "" {
+		message = "Build of the tarball of " + version
+	}
+	args := []string{"commit-tree", strings.TrimSpace(string(tree)), "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	env = append(env,
+		"GIT_AUTHOR_NAME="+user, "GIT_AUTHOR_EMAIL="+user,
+		"GIT_COMMITTER_NAME="+user, "GIT_COMMITTER_EMAIL="+user,
+	)
+	sha, err := gitCmd(repoPath, env, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("committing the tarball (%s)", err)
+	}
+	return strings.TrimSpace(string(sha)), nil
+}
+
+// tarballRoot returns the directory the tarball extracted to dir has its source in: its only
+// entry if that's a directory, or dir itself.
+func tarballRoot(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("the tarball is empty")
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// revParse returns the sha ref of the repo at repoPath points to, or nothing if it doesn't exist.
+func revParse(repoPath, ref string) string {
+	sha, err := gitCmd(repoPath, nil, "rev-parse", "--verify", "--quiet", ref).Output()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(sha))
+}
+
+// gitCmd returns a git command on the bare repo at repoPath, with env added to its environment.
+func gitCmd(repoPath string, env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(append(os.Environ(), env...), "GIT_DIR="+repoPath)
+	return cmd
+}
+
+// flushWriter flushes every write to w, so that the build output is streamed to the client.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,536 @@
+package gitreceive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AnalysisKeyPattern is the template for the object storage key of the directory of the SARIF
+	// results of the static analysis of a commit of an app.
+	AnalysisKeyPattern = "home/%s/analysis/%s"
+	// analysisThresholdKey is the app config key setting the lowest level of the analysis results
+	// rejecting a build, overriding ANALYSIS_THRESHOLD.
+	analysisThresholdKey = "DRYCC_ANALYSIS_THRESHOLD"
+	// analysisAnnotation counts the results of each analyzer of the build of a release, as
+	// analyzer:errors/warnings/notes, e.g. gosec:0/2/1,semgrep:0/0/0.
+	analysisAnnotation = "builder.drycc.cc/analysis"
+	// analysisRejectedReason is the reason of the event recorded when a build is rejected for its
+	// analysis results.
+	analysisRejectedReason = "AnalysisRejected"
+	// analysisFindingsShown is the number of the results rejecting a build shown to the pusher.
+	analysisFindingsShown = 10
+
+	// sarifOutputEnv tells analyzers the file they write their SARIF log to, and sbomOutputEnv
+	// the SBOM generator the file it writes the SBOM to.
+	sarifOutputEnv    = "SARIF_OUTPUT"
+	sbomOutputEnv     = "SBOM_OUTPUT"
+	sbomName          = "sbom.json"
+	sourceDirEnv      = "SOURCE_DIR"
+	analysisDirEnv    = "ANALYSIS_DIR"
+	analysisPathEnv   = "ANALYSIS_PATH"
+	analysisWorkspace = "analysis-workspace"
+	workspacePath     = "/workspace"
+	sourcePath        = workspacePath + "/source"
+)
+
+// sarifLevels ranks the levels of SARIF results, from the lowest.
+var sarifLevels = []string{"none", "note", "warning", "error"}
+
+// analyzerNameRegexp matches the names analyzers can have, which name their containers.
+var analyzerNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,48}[a-z0-9])?$`)
+
+// analyzer is a static analysis tool the source of builds is checked with. Its command runs in
+// its image, in the directory of the source, and writes a SARIF log to the file in $SARIF_OUTPUT.
+// It exits with 0 when it wrote the log, whatever the results.
+type analyzer struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Command []string `json:"command"`
+}
+
+// analyzerList is the JSON document listing the analyzers, usually mounted from a ConfigMap. SBOM
+// is the analyzer generating the SBOM of the dependencies of the source instead, a CycloneDX or
+// SPDX JSON document written to the file in $SBOM_OUTPUT, for their licenses to be checked.
+type analyzerList struct {
+	Analyzers []analyzer `json:"analyzers"`
+	SBOM      *analyzer  `json:"sbom"`
+}
+
+// loadAnalyzers returns the analyzers listed at path, none if there's no file.
+func loadAnalyzers(path string) (*analyzerList, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &analyzerList{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := new(analyzerList)
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("the analyzers %s are malformed (%s)", path, err)
+	}
+	seen := make(map[string]bool)
+	all := list.Analyzers
+	if list.SBOM != nil {
+		all = append(all[:len(all):len(all)], *list.SBOM)
+	}
+	for _, a := range all {
+		switch {
+		case !analyzerNameRegexp.MatchString(a.Name):
+			return nil, fmt.Errorf("an analyzer in %s has an invalid name %q", path, a.Name)
+		case seen[a.Name]:
+			return nil, fmt.Errorf("the analyzer %s is in %s twice", a.Name, path)
+		case a.Image == "" || len(a.Command) == 0:
+			return nil, fmt.Errorf("the analyzer %s in %s needs an image and a command", a.Name, path)
+		}
+		seen[a.Name] = true
+	}
+	return list, nil
+}
+
+// levelRank returns the rank of the SARIF level in sarifLevels.
+func levelRank(level string) (int, error) {
+	for i, l := range sarifLevels {
+		if l == level {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, use one of %s", level, strings.Join(sarifLevels, ", "))
+}
+
+// sourceAnalysis is the static analysis of the source of a build.
+type sourceAnalysis struct {
+	analyzers []analyzer
+	// sbom generates the SBOM whose licenses are checked, if it's set.
+	sbom     *analyzer
+	licenses *licensePolicy
+	// image is the builder image extracting the source for the analyzers and uploading their
+	// results.
+	image string
+	// threshold is the lowest level of the results rejecting the build, none to never reject it.
+	threshold string
+}
+
+// newSourceAnalysis returns the analysis of the builds of the app with appConf, nil if there are
+// no analyzers.
+func newSourceAnalysis(conf *Config, appConf dryccAPI.Config) (*sourceAnalysis, error) {
+	list, err := loadAnalyzers(conf.AnalyzersPath)
+	if err != nil {
+		return nil, err
+	}
+	if list.SBOM == nil && configString(appConf, licenseDenyKey) != "" {
+		log.Info("WARNING: %s is ignored, the builder has no SBOM generator to check the licenses with", licenseDenyKey)
+	}
+	if len(list.Analyzers) == 0 && list.SBOM == nil {
+		return nil, nil
+	}
+	switch {
+	case conf.SourceAssemblerImage == "":
+		return nil, fmt.Errorf("static analysis needs SOURCE_ASSEMBLER_IMAGE")
+	case conf.PresignedURLs:
+		return nil, fmt.Errorf("static analysis can't be used with PRESIGNED_URLS_ENABLED, the analysis pod needs the storage credentials")
+	}
+	if _, err := levelRank(conf.AnalysisThreshold); err != nil {
+		return nil, fmt.Errorf("invalid ANALYSIS_THRESHOLD (%s)", err)
+	}
+	threshold := conf.AnalysisThreshold
+	if value := configString(appConf, analysisThresholdKey); value != "" {
+		if _, err := levelRank(value); err != nil {
+			return nil, userError(fmt.Errorf("invalid %s (%s)", analysisThresholdKey, err))
+		}
+		threshold = value
+	}
+	analysis := &sourceAnalysis{analyzers: list.Analyzers, sbom: list.SBOM, image: conf.SourceAssemblerImage, threshold: threshold}
+	if list.SBOM != nil {
+		if analysis.licenses, err = newLicensePolicy(conf, appConf); err != nil {
+			return nil, err
+		}
+	}
+	return analysis, nil
+}
+
+// names returns the names of the analyzers of a, and of its SBOM generator.
+func (a *sourceAnalysis) names() string {
+	var names []string
+	for _, an := range a.analyzers {
+		names = append(names, an.Name)
+	}
+	if a.sbom != nil {
+		names = append(names, a.sbom.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func analysisPodName(appName, shortSha string) string {
+	uid := uuid.New()[:8]
+	// pod names cannot exceed 63 characters in length
+	if len(appName) > 36 {
+		appName = appName[:36]
+	}
+	return fmt.Sprintf("analysis-%s-%s-%s", appName, shortSha, uid)
+}
+
+// pod returns the pod named name analyzing the source at tarKey, compressed with comp, in
+// namespace. An init container extracts the source, the analyzers and the SBOM generator run one
+// after the other in init containers of their own, and the last container uploads their results
+// under analysisKey.
+func (a *sourceAnalysis) pod(
+	name,
+	namespace,
+	tarKey,
+	analysisKey string,
+	comp compression,
+	pullPolicy corev1.PullPolicy,
+	nodeSelector map[string]string) *corev1.Pod {
+
+	pod := buildPod(false, name, namespace, pullPolicy, nodeSelector, nil)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         analysisWorkspace,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	workspace := corev1.VolumeMount{Name: analysisWorkspace, MountPath: workspacePath}
+	store := pod.Spec.Containers[0].VolumeMounts[0]
+
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:            "extract-source",
+		Image:           a.image,
+		ImagePullPolicy: pullPolicy,
+		Command:         []string{"/usr/bin/boot", "extract-source"},
+		Env: []corev1.EnvVar{
+			{Name: tarPath, Value: tarKey},
+			{Name: sourceDirEnv, Value: sourcePath},
+			{Name: compressionKey, Value: comp.name},
+		},
+		VolumeMounts: []corev1.VolumeMount{store, workspace},
+	})
+	for _, an := range a.analyzers {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+			Name:            "analyze-" + an.Name,
+			Image:           an.Image,
+			ImagePullPolicy: pullPolicy,
+			Command:         an.Command,
+			WorkingDir:      sourcePath,
+			Env:             []corev1.EnvVar{{Name: sarifOutputEnv, Value: fmt.Sprintf("%s/%s.sarif", workspacePath, an.Name)}},
+			VolumeMounts:    []corev1.VolumeMount{workspace},
+		})
+	}
+	if a.sbom != nil {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+			Name:            "analyze-" + a.sbom.Name,
+			Image:           a.sbom.Image,
+			ImagePullPolicy: pullPolicy,
+			Command:         a.sbom.Command,
+			WorkingDir:      sourcePath,
+			Env:             []corev1.EnvVar{{Name: sbomOutputEnv, Value: workspacePath + "/" + sbomName}},
+			VolumeMounts:    []corev1.VolumeMount{workspace},
+		})
+	}
+	uploader := &pod.Spec.Containers[0]
+	uploader.Name = "upload-analysis"
+	uploader.Image = a.image
+	uploader.Command = []string{"/usr/bin/boot", "upload-analysis"}
+	uploader.VolumeMounts = append(uploader.VolumeMounts, workspace)
+	addEnvToPod(pod, analysisDirEnv, workspacePath)
+	addEnvToPod(pod, analysisPathEnv, analysisKey)
+	return &pod
+}
+
+// analysisStore is the subset of a (github.com/docker/distribution/registry/storage/driver).StorageDriver
+// needed to read the results of analysis pods and store the license reports.
+type analysisStore interface {
+	storage.ObjectGetter
+	storage.ObjectPutter
+}
+
+// run analyzes the source of the build of appName at tarKey with a pod in namespace, like the
+// builder pod pod, and returns the results of each analyzer and the license report of the SBOM,
+// if there's an SBOM generator. They're kept in the storage.
+func (a *sourceAnalysis) run(
+	ctx context.Context,
+	conf *Config,
+	kubeClient kubernetes.Interface,
+	store analysisStore,
+	pod *corev1.Pod,
+	appName,
+	shortSha,
+	tarKey string,
+	comp compression) ([]analysisReport, *licenseReport, error) {
+
+	analysisKey := fmt.Sprintf(AnalysisKeyPattern, appName, shortSha)
+	analysisPod := a.pod(analysisPodName(appName, shortSha), pod.Namespace, tarKey, analysisKey, comp,
+		pod.Spec.Containers[0].ImagePullPolicy, pod.Spec.NodeSelector)
+	setPodSecurity(analysisPod, conf.PodSecurityLevel, conf.BuilderPodRunAsUser)
+
+	pods := kubeClient.CoreV1().Pods(pod.Namespace)
+	if _, err := pods.Create(ctx, analysisPod, metav1.CreateOptions{}); err != nil {
+		return nil, nil, fmt.Errorf("creating the analysis pod (%s)", err)
+	}
+	defer func() {
+		if err := pods.Delete(context.Background(), analysisPod.Name, metav1.DeleteOptions{}); err != nil {
+			log.Info("unable to delete the analysis pod %s (%s)", analysisPod.Name, err)
+		}
+	}()
+	waiter := k8s.NewPodWaiter(kubeClient, pod.Namespace)
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waiter.Start(waitCtx)
+	var ended *corev1.Pod
+	err := pusherTerminal.during(msgAnalyzing, conf.SessionIdleInterval(), func() (err error) {
+		ended, err = waitForPodEnd(waitCtx, waiter, analysisPod.Name, conf.BuilderPodWaitDuration())
+		return err
+	}, a.names())
+	if err != nil {
+		return nil, nil, fmt.Errorf("running the analysis pod %s (%s)", analysisPod.Name, err)
+	}
+	if ended.Status.Phase != corev1.PodSucceeded {
+		return nil, nil, fmt.Errorf("the analysis pod %s failed%s", analysisPod.Name, failedContainer(ended))
+	}
+
+	reports := make([]analysisReport, len(a.analyzers))
+	for i, an := range a.analyzers {
+		key := fmt.Sprintf("%s/%s.sarif", analysisKey, an.Name)
+		data, err := store.GetContent(context.Background(), key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("the analyzer %s wrote no SARIF log (%s)", an.Name, err)
+		}
+		findings, err := parseSARIF(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading the SARIF log of the analyzer %s (%s)", an.Name, err)
+		}
+		reports[i] = analysisReport{analyzer: an.Name, findings: findings}
+	}
+	if a.sbom == nil {
+		return reports, nil, nil
+	}
+	data, err := store.GetContent(context.Background(), analysisKey+"/"+sbomName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the SBOM generator %s wrote no SBOM (%s)", a.sbom.Name, err)
+	}
+	licenses, err := newLicenseReport(data, a.licenses)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the SBOM of %s (%s)", a.sbom.Name, err)
+	}
+	if err := licenses.store(store, analysisKey); err != nil {
+		return nil, nil, err
+	}
+	return reports, licenses, nil
+}
+
+// failedContainer describes the container that failed in pod, if one of them did.
+func failedContainer(pod *corev1.Pod) string {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, s := range statuses {
+			if t := s.State.Terminated; t != nil && t.ExitCode != 0 {
+				return fmt.Sprintf(" in %s (exit code %d)", s.Name, t.ExitCode)
+			}
+		}
+	}
+	return ""
+}
+
+// check shows the results of reports, and rejects the build if some of them are at or above the
+// threshold of a.
+func (a *sourceAnalysis) check(reports []analysisReport, recorder *buildRecorder) error {
+	threshold, _ := levelRank(a.threshold)
+	var rejecting []analysisFinding
+	for _, r := range reports {
+		counts := r.counts()
+		pusherTerminal.info(msgAnalysisResult, r.analyzer, counts["error"], counts["warning"], counts["note"])
+		for _, f := range r.findings {
+			if rank, _ := levelRank(f.Level); threshold > 0 && rank >= threshold {
+				rejecting = append(rejecting, f)
+			}
+		}
+	}
+	if len(rejecting) == 0 {
+		return nil
+	}
+	for i, f := range rejecting {
+		if i == analysisFindingsShown {
+			break
+		}
+		pusherTerminal.info(msgAnalysisFinding, f.Level, f.Rule, f.Location, f.Message)
+	}
+	recorder.warn(analysisRejectedReason, "the static analysis found %d results at or above the %s level", len(rejecting), a.threshold)
+	return policyError(fmt.Errorf("push rejected, the static analysis found %d results at or above the %s level", len(rejecting), a.threshold))
+}
+
+// analysisFinding is a result of a SARIF log.
+type analysisFinding struct {
+	Tool     string
+	Rule     string
+	Level    string
+	Message  string
+	Location string
+}
+
+// analysisReport holds the results of an analyzer.
+type analysisReport struct {
+	analyzer string
+	findings []analysisFinding
+}
+
+// counts returns the number of results of r at each level.
+func (r analysisReport) counts() map[string]int {
+	counts := make(map[string]int)
+	for _, f := range r.findings {
+		counts[f.Level]++
+	}
+	return counts
+}
+
+// analysisCounts returns the value of the analysisAnnotation of reports.
+func analysisCounts(reports []analysisReport) string {
+	values := make([]string, len(reports))
+	for i, r := range reports {
+		counts := r.counts()
+		values[i] = fmt.Sprintf("%s:%d/%d/%d", r.analyzer, counts["error"], counts["warning"], counts["note"])
+	}
+	return strings.Join(values, ",")
+}
+
+// sarifLog is the subset of a SARIF 2.1.0 log the results are read from.
+type sarifLog struct {
+	Version string `json:"version"`
+	Runs    []struct {
+		Tool struct {
+			Driver struct {
+				Name  string `json:"name"`
+				Rules []struct {
+					ID                   string `json:"id"`
+					DefaultConfiguration struct {
+						Level string `json:"level"`
+					} `json:"defaultConfiguration"`
+				} `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID    string `json:"ruleId"`
+			RuleIndex *int   `json:"ruleIndex"`
+			Level     string `json:"level"`
+			Message   struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine int `json:"startLine"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+// parseSARIF returns the results of the SARIF log data. Results without a level have the default
+// level of their rule, or warning.
+func parseSARIF(data []byte) ([]analysisFinding, error) {
+	sarif := new(sarifLog)
+	if err := json.Unmarshal(data, sarif); err != nil {
+		return nil, err
+	}
+	if sarif.Version == "" {
+		return nil, fmt.Errorf("the log has no SARIF version")
+	}
+	var findings []analysisFinding
+	for _, run := range sarif.Runs {
+		driver := run.Tool.Driver
+		for _, res := range run.Results {
+			f := analysisFinding{Tool: driver.Name, Rule: res.RuleID, Level: res.Level, Message: res.Message.Text}
+			for i, rule := range driver.Rules {
+				if (res.RuleIndex != nil && *res.RuleIndex == i) || (res.RuleIndex == nil && rule.ID == res.RuleID) {
+					if f.Rule == "" {
+						f.Rule = rule.ID
+					}
+					if f.Level == "" {
+						f.Level = rule.DefaultConfiguration.Level
+					}
+					break
+				}
+			}
+			if f.Level == "" {
+				f.Level = "warning"
+			}
+			if _, err := levelRank(f.Level); err != nil {
+				return nil, fmt.Errorf("a result of %s has an %s", driver.Name, err)
+			}
+			if len(res.Locations) > 0 {
+				loc := res.Locations[0].PhysicalLocation
+				f.Location = loc.ArtifactLocation.URI
+				if loc.Region.StartLine > 0 {
+					f.Location += fmt.Sprintf(":%d", loc.Region.StartLine)
+				}
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// ExtractSource extracts the source archive at tarKey, compressed as compressionName says, into
+// dir. Analysis pods run it in an init container, before the analyzers.
+func ExtractSource(getter storage.ObjectGetter, tarKey, compressionName, dir string) error {
+	storagedriver.PathRegexp = storagePathRegexp
+	data, err := getter.GetContent(context.Background(), tarKey)
+	if err != nil {
+		return fmt.Errorf("downloading the source %s (%s)", tarKey, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	comp, err := newCompression(compressionName, 0)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("tar", append(comp.extractArgs(), "-", "-C", dir)...)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("extracting the source (%s)", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// UploadAnalysis uploads the SARIF logs the analyzers wrote in dir, and the SBOM, under
+// analysisKey. Analysis pods run it once the analyzers are done.
+func UploadAnalysis(putter storage.ObjectPutter, dir, analysisKey string) error {
+	storagedriver.PathRegexp = storagePathRegexp
+	files, err := filepath.Glob(filepath.Join(dir, "*.sarif"))
+	if err != nil {
+		return err
+	}
+	if sbom := filepath.Join(dir, sbomName); fileExists(sbom) {
+		files = append(files, sbom)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key := analysisKey + "/" + filepath.Base(file)
+		if err := putter.PutContent(context.Background(), key, data); err != nil {
+			return fmt.Errorf("uploading %s (%s)", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package gitreceive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testSARIF = `{
+  "version": "2.1.0",
+  "runs": [{
+    "tool": {"driver": {"name": "gosec", "rules": [
+      {"id": "G101", "defaultConfiguration": {"level": "error"}},
+      {"id": "G104"}
+    ]}},
+    "results": [
+      {"ruleId": "G101", "message": {"text": "hardcoded credentials"},
+       "locations": [{"physicalLocation": {"artifactLocation": {"uri": "main.go"}, "region": {"startLine": 12}}}]},
+      {"ruleId": "G104", "message": {"text": "errors unhandled"}},
+      {"ruleId": "G107", "level": "note", "message": {"text": "url provided to HTTP request as taint input"}}
+    ]
+  }]
+}`
+
+func TestParseSARIF(t *testing.T) {
+	findings, err := parseSARIF([]byte(testSARIF))
+	assert.NoErr(t, err)
+	assert.Equal(t, len(findings), 3, "findings")
+	assert.Equal(t, findings[0], analysisFinding{Tool: "gosec", Rule: "G101", Level: "error", Message: "hardcoded credentials", Location: "main.go:12"}, "finding with the level of its rule")
+	assert.Equal(t, findings[1].Level, "warning", "default level")
+	assert.Equal(t, findings[2].Level, "note", "level of the result")
+
+	report := analysisReport{analyzer: "gosec", findings: findings}
+	assert.Equal(t, analysisCounts([]analysisReport{report, {analyzer: "semgrep"}}), "gosec:1/1/1,semgrep:0/0/0", "counts")
+
+	_, err = parseSARIF([]byte(`{"runs": []}`))
+	assert.True(t, err != nil, "parsed a log without a version")
+	_, err = parseSARIF([]byte(`{"version": "2.1.0", "runs": [{"results": [{"level": "fatal"}]}]}`))
+	assert.True(t, err != nil, "parsed a result with an unknown level")
+}
+
+func TestSourceAnalysisCheck(t *testing.T) {
+	findings, err := parseSARIF([]byte(testSARIF))
+	assert.NoErr(t, err)
+	reports := []analysisReport{{analyzer: "gosec", findings: findings}}
+
+	out := captureOutput(func() {
+		err = (&sourceAnalysis{threshold: "error"}).check(reports, nil)
+	})
+	assert.True(t, err != nil && KindOf(err) == ErrPolicy, "build with errors accepted")
+	assert.True(t, strings.Contains(out, "gosec found 1 errors, 1 warnings and 1 notes"), "output "+out)
+	assert.True(t, strings.Contains(out, "error G101 at main.go:12: hardcoded credentials"), "output "+out)
+	assert.NoErr(t, (&sourceAnalysis{threshold: "none"}).check(reports, nil))
+	assert.NoErr(t, (&sourceAnalysis{threshold: "error"}).check([]analysisReport{{analyzer: "semgrep"}}, nil))
+}
+
+func TestNewSourceAnalysis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "analyzers")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "analyzers.json")
+	conf := &Config{AnalyzersPath: path, AnalysisThreshold: "error", SourceAssemblerImage: "drycc/builder"}
+
+	analysis, err := newSourceAnalysis(conf, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.True(t, analysis == nil, "analysis without analyzers")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"analyzers": [{"name": "gosec", "image": "securego/gosec", "command": ["gosec", "./..."]}]}`), 0644))
+	analysis, err = newSourceAnalysis(conf, dryccAPI.Config{Values: map[string]interface{}{analysisThresholdKey: "warning"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, analysis.threshold, "warning", "threshold of the app")
+	_, err = newSourceAnalysis(conf, dryccAPI.Config{Values: map[string]interface{}{analysisThresholdKey: "fatal"}})
+	assert.True(t, err != nil && KindOf(err) == ErrUser, "invalid threshold of the app")
+	_, err = newSourceAnalysis(&Config{AnalyzersPath: path, AnalysisThreshold: "error"}, dryccAPI.Config{})
+	assert.True(t, err != nil, "analysis without SOURCE_ASSEMBLER_IMAGE")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"analyzers": [{"name": "Gosec", "image": "securego/gosec", "command": ["gosec"]}]}`), 0644))
+	_, err = newSourceAnalysis(conf, dryccAPI.Config{})
+	assert.True(t, err != nil, "analyzer with an invalid name")
+}
+
+func TestAnalysisPod(t *testing.T) {
+	analysis := &sourceAnalysis{
+		analyzers: []analyzer{{Name: "gosec", Image: "securego/gosec", Command: []string{"gosec", "./..."}}},
+		image:     "drycc/builder",
+	}
+	pod := analysis.pod("analysis-myapp", "drycc", "home/myapp:git-abc1234/tar", "home/myapp/analysis/abc1234",
+		compression{name: ZstdCompression}, corev1.PullAlways, map[string]string{"pool": "build"})
+	assert.Equal(t, len(pod.Spec.InitContainers), 2, "init containers")
+	extract, gosec := pod.Spec.InitContainers[0], pod.Spec.InitContainers[1]
+	assert.Equal(t, extract.Command, []string{"/usr/bin/boot", "extract-source"}, "command of the extractor")
+	assert.Equal(t, extract.Env[2], corev1.EnvVar{Name: compressionKey, Value: ZstdCompression}, "compression")
+	assert.Equal(t, gosec.Name, "analyze-gosec", "name of the analyzer")
+	assert.Equal(t, gosec.WorkingDir, sourcePath, "working dir of the analyzer")
+	assert.Equal(t, gosec.Env, []corev1.EnvVar{{Name: sarifOutputEnv, Value: "/workspace/gosec.sarif"}}, "env of the analyzer")
+	assert.Equal(t, len(gosec.VolumeMounts), 1, "analyzers don't mount the storage credentials")
+	assert.Equal(t, podEnv(pod, analysisPathEnv), "home/myapp/analysis/abc1234", "analysis path")
+	assert.Equal(t, pod.Spec.NodeSelector, map[string]string{"pool": "build"}, "node selector")
+}
+
+func TestExtractSourceAndUploadAnalysis(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	dir, err := ioutil.TempDir("", "analysis")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	assert.NoErr(t, os.MkdirAll(src, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(src, "main.go"), []byte("package main\n"), 0644))
+	tarball := filepath.Join(dir, "src.tgz")
+	assert.NoErr(t, run(repoCmd(src, "tar", "-czf", tarball, ".")))
+	data, err := ioutil.ReadFile(tarball)
+	assert.NoErr(t, err)
+	assert.NoErr(t, driver.PutContent(context.Background(), "home/myapp:git-abc1234/tar", data))
+
+	workspace := filepath.Join(dir, "workspace")
+	assert.NoErr(t, ExtractSource(driver, "home/myapp:git-abc1234/tar", GzipCompression, filepath.Join(workspace, "source")))
+	_, err = os.Stat(filepath.Join(workspace, "source", "main.go"))
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(workspace, "gosec.sarif"), []byte(testSARIF), 0644))
+	assert.NoErr(t, UploadAnalysis(driver, workspace, "home/myapp/analysis/abc1234"))
+	got, err := driver.GetContent(context.Background(), "home/myapp/analysis/abc1234/gosec.sarif")
+	assert.NoErr(t, err)
+	assert.Equal(t, string(got), testSARIF, "uploaded log")
+}
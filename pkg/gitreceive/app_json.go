@@ -0,0 +1,214 @@
+package gitreceive
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	appJSONName = "app.json"
+	// secretGenerator is the env generator that sets a variable to a random secret.
+	secretGenerator = "secret"
+)
+
+// AppJSON is the part of a Heroku style app.json manifest the builder understands.
+//
+// See https://devcenter.heroku.com/articles/app-json-schema
+type AppJSON struct {
+	Name    string                `json:"name"`
+	Env     map[string]AppJSONEnv `json:"env"`
+	Addons  []AppJSONAddon        `json:"addons"`
+	Scripts map[string]string     `json:"scripts"`
+}
+
+// AppJSONEnv describes a config var the app needs.
+type AppJSONEnv struct {
+	Description string `json:"description"`
+	Value       string `json:"value"`
+	Generator   string `json:"generator"`
+	// Required defaults to true, as it does on Heroku.
+	Required *bool `json:"required"`
+}
+
+// UnmarshalJSON accepts both the object form of a config var and a plain string value.
+func (e *AppJSONEnv) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		e.Value = value
+		return nil
+	}
+	type env AppJSONEnv
+	return json.Unmarshal(data, (*env)(e))
+}
+
+func (e AppJSONEnv) required() bool {
+	return e.Required == nil || *e.Required
+}
+
+// AppJSONAddon is an add-on the app needs.
+type AppJSONAddon struct {
+	Plan string `json:"plan"`
+	As   string `json:"as"`
+}
+
+// UnmarshalJSON accepts both the object form of an add-on and a plain plan name.
+func (a *AppJSONAddon) UnmarshalJSON(data []byte) error {
+	var plan string
+	if err := json.Unmarshal(data, &plan); err == nil {
+		a.Plan = plan
+		return nil
+	}
+	type addon AppJSONAddon
+	return json.Unmarshal(data, (*addon)(a))
+}
+
+// readAppJSON reads the app.json in dirName. It returns nil if there is none.
+func readAppJSON(dirName string) (*AppJSON, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dirName, appJSONName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s (%s)", appJSONName, err)
+	}
+	a := new(AppJSON)
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("%s is malformed (%s)", appJSONName, err)
+	}
+	return a, nil
+}
+
+// check compares a with the app's config. It returns the config vars the app is missing that a
+// has a default value or a generator for, and the warnings the pusher should see about what the
+// builder can't set up itself. Required config vars missing a default are an error.
+func (a *AppJSON) check(config api.Config) (map[string]string, []string, error) {
+	if a == nil {
+		return nil, nil, nil
+	}
+	defaults := make(map[string]string)
+	var missing []string
+	for _, key := range sortedEnvKeys(a.Env) {
+		if _, ok := config.Values[key]; ok {
+			continue
+		}
+		env := a.Env[key]
+		switch {
+		case env.Generator == secretGenerator:
+			secret, err := generateSecret()
+			if err != nil {
+				return nil, nil, err
+			}
+			defaults[key] = secret
+		case env.Value != "":
+			defaults[key] = env.Value
+		case env.required():
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("%s requires config %s, set it with `drycc config:set`", appJSONName, strings.Join(missing, ", "))
+	}
+
+	var warnings []string
+	for _, addon := range a.Addons {
+		warnings = append(warnings, fmt.Sprintf("%s lists the add-on %s, which has to be provisioned and configured separately", appJSONName, addon.Plan))
+	}
+	if script, ok := a.Scripts["postdeploy"]; ok {
+		warnings = append(warnings, fmt.Sprintf("%s has a postdeploy script, which isn't run automatically, run it with `drycc run %s`", appJSONName, script))
+	}
+	return defaults, warnings, nil
+}
+
+func sortedEnvKeys(env map[string]AppJSONEnv) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// generateSecret returns a random, hex encoded, 256 bit secret.
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating a secret (%s)", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// applyAppJSON reads the app.json in dirName, prints its warnings and adds the config defaults it
+// declares to appConf, so that they're available to the build. The defaults are returned to be
+// set on the app along with the release, with the sorted keys of those that are generated
+// secrets. Secrets are only generated for the keys appConf doesn't have, so that they're never
+// rotated by a push. If the controller can't set config along with releases, setConfig is false
+// and defaults fail the push, telling the pusher how to set them.
+func applyAppJSON(dirName string, appConf *api.Config, setConfig bool) (map[string]string, []string, error) {
+	a, err := readAppJSON(dirName)
+	if err != nil || a == nil {
+		return nil, nil, err
+	}
+	defaults, warnings, err := a.check(*appConf)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, warning := range warnings {
+		log.Info("WARNING: %s", warning)
+	}
+	if len(defaults) == 0 {
+		return nil, nil, nil
+	}
+	keys := make([]string, 0, len(defaults))
+	for k := range defaults {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if !setConfig {
+		return nil, nil, unsetConfigError(a, keys)
+	}
+	if appConf.Values == nil {
+		appConf.Values = make(map[string]interface{}, len(defaults))
+	}
+	for k, v := range defaults {
+		appConf.Values[k] = v
+	}
+	log.Info("Setting config %s from %s", strings.Join(keys, ", "), appJSONName)
+	var secrets []string
+	for _, k := range keys {
+		if a.Env[k].Generator == secretGenerator {
+			secrets = append(secrets, k)
+		}
+	}
+	return defaults, secrets, nil
+}
+
+// unsetConfigError returns the error of the config keys a declares that the app doesn't have,
+// when the controller can't set them along with the release.
+func unsetConfigError(a *AppJSON, keys []string) error {
+	settings := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if a.Env[k].Generator == secretGenerator {
+			settings = append(settings, k+"=$(openssl rand -hex 32)")
+		} else {
+			settings = append(settings, k+"="+shellQuote(a.Env[k].Value))
+		}
+	}
+	return fmt.Errorf("%s declares config %s that the app doesn't have, and the controller can't set it along with the release; set it with `drycc config:set %s` and push again", appJSONName, strings.Join(keys, ", "), strings.Join(settings, " "))
+}
+
+// shellQuote returns s quoted for a POSIX shell, unless it only has characters that needn't be.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:@%+,=") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
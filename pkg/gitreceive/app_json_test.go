@@ -0,0 +1,87 @@
+package gitreceive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/controller-sdk-go/api"
+)
+
+const appJSONFixture = `{
+  "name": "example",
+  "env": {
+    "WEB_CONCURRENCY": "2",
+    "LOG_LEVEL": {"description": "verbosity", "value": "info"},
+    "SECRET_KEY": {"description": "signing key", "generator": "secret"},
+    "OPTIONAL": {"description": "not needed", "required": false},
+    "API_TOKEN": {"description": "token for the API"}
+  },
+  "addons": ["heroku-postgresql", {"plan": "heroku-redis:hobby-dev"}],
+  "scripts": {"postdeploy": "bundle exec rake db:seed"}
+}`
+
+func TestAppJSONCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appjson")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := readAppJSON(dir)
+	assert.NoErr(t, err)
+	assert.True(t, a == nil, "read an app.json that doesn't exist")
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, appJSONName), []byte(appJSONFixture), 0644))
+	a, err = readAppJSON(dir)
+	assert.NoErr(t, err)
+	assert.Equal(t, a.Addons[1].Plan, "heroku-redis:hobby-dev", "add-on plan")
+
+	_, _, err = a.check(api.Config{})
+	assert.True(t, err != nil, "required config without a default didn't fail")
+
+	config := api.Config{Values: map[string]interface{}{"API_TOKEN": "token", "LOG_LEVEL": "debug"}}
+	defaults, warnings, err := a.check(config)
+	assert.NoErr(t, err)
+	assert.Equal(t, defaults["WEB_CONCURRENCY"], "2", "string default")
+	assert.Equal(t, len(defaults["SECRET_KEY"]), 64, "generated secret length")
+	_, ok := defaults["LOG_LEVEL"]
+	assert.False(t, ok, "existing config overridden")
+	_, ok = defaults["OPTIONAL"]
+	assert.False(t, ok, "optional config without a default set")
+	assert.Equal(t, len(warnings), 3, "number of warnings")
+}
+
+func TestApplyAppJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appjson")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, appJSONName), []byte(`{"env": {"FOO": "bar", "KEY": {"generator": "secret"}}}`), 0644))
+
+	appConf := api.Config{}
+	defaults, secrets, err := applyAppJSON(dir, &appConf, true)
+	assert.NoErr(t, err)
+	assert.Equal(t, defaults["FOO"], "bar", "default")
+	assert.Equal(t, secrets, []string{"KEY"}, "generated secrets")
+	assert.Equal(t, appConf.Values["FOO"], "bar", "build config")
+
+	// secrets the app has aren't generated again
+	key := appConf.Values["KEY"]
+	defaults, secrets, err = applyAppJSON(dir, &appConf, true)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(defaults), 0, "number of defaults")
+	assert.Equal(t, len(secrets), 0, "number of generated secrets")
+	assert.Equal(t, appConf.Values["KEY"], key, "secret")
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, appJSONName), []byte(`{"env": [}`), 0644))
+	_, _, err = applyAppJSON(dir, &appConf, true)
+	assert.True(t, err != nil, "malformed app.json didn't fail")
+
+	// controllers that don't set config along with releases leave it to the pusher
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, appJSONName), []byte(`{"env": {"FOO": "bar", "NAME": "my app", "TOKEN": {"generator": "secret"}}}`), 0644))
+	appConf = api.Config{Values: map[string]interface{}{"FOO": "baz"}}
+	_, _, err = applyAppJSON(dir, &appConf, false)
+	assert.Err(t, err, errors.New("app.json declares config NAME, TOKEN that the app doesn't have, and the controller can't set it along with the release; set it with `drycc config:set NAME='my app' TOKEN=$(openssl rand -hex 32)` and push again"))
+	assert.Equal(t, len(appConf.Values), 1, "number of config values")
+}
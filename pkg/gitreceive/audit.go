@@ -0,0 +1,190 @@
+package gitreceive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// AuditKeyPattern is the template for the keys of the audit records of an app in the object
+	// storage. Records are kept outside of the app's home, so that they outlive the app.
+	AuditKeyPattern = "audit/%s/%s-%s-%s.json"
+	// auditOutcomeDryRun is the outcome of dry-run pushes, which never reach a release.
+	auditOutcomeDryRun = "DryRun"
+	// auditSignatureHeader is the header holding the HMAC-SHA256 of audit webhook requests.
+	auditSignatureHeader = "X-Drycc-Signature"
+	auditWebhookTimeout  = 10 * time.Second
+)
+
+// auditEntry is the audit record of the push of a ref: who pushed what to which app, from where,
+// what the builder decided about it and how it ended.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	App         string    `json:"app"`
+	Username    string    `json:"username"`
+	Fingerprint string    `json:"fingerprint"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	// TraceID is the ID of the transport trace of the SSH session of the push, if it has one.
+	TraceID string `json:"traceId,omitempty"`
+	Ref     string `json:"ref"`
+	OldRev  string `json:"oldRev"`
+	NewRev  string `json:"newRev"`
+	// PushOptions holds the push options, with the values of env options redacted.
+	PushOptions PushOptions `json:"pushOptions,omitempty"`
+	// Decisions lists the policies applied to the build, e.g. config keys kept from it.
+	Decisions []string `json:"decisions,omitempty"`
+	// Signature is the result of the verification of the signature of the push, if it's checked.
+	Signature *signatureResult `json:"signature,omitempty"`
+	// Outcome is the last phase of the build, or DryRun.
+	Outcome string `json:"outcome"`
+	Message string `json:"message,omitempty"`
+	Release int    `json:"release,omitempty"`
+}
+
+// newAuditEntry returns the audit record of the push of ref from oldRev to newRev.
+func newAuditEntry(conf *Config, oldRev, newRev, ref string, pushOpts PushOptions) *auditEntry {
+	remoteAddr := conf.SSHConnection
+	if fields := strings.Fields(conf.SSHConnection); len(fields) > 0 {
+		remoteAddr = fields[0]
+	}
+	return &auditEntry{
+		Time:        time.Now().UTC(),
+		App:         conf.App(),
+		Username:    conf.Username,
+		Fingerprint: conf.Fingerprint,
+		RemoteAddr:  remoteAddr,
+		TraceID:     conf.TraceID,
+		Ref:         ref,
+		OldRev:      oldRev,
+		NewRev:      newRev,
+		PushOptions: auditedPushOptions(pushOpts),
+	}
+}
+
+// auditedPushOptions returns pushOpts with the values of env:KEY=VALUE options, which hold the
+// build env, replaced, so that only their keys are recorded.
+func auditedPushOptions(pushOpts PushOptions) PushOptions {
+	audited := make(PushOptions, len(pushOpts))
+	for opt, value := range pushOpts {
+		if strings.HasPrefix(opt, envPushOptionPrefix) {
+			value = "[REDACTED]"
+		}
+		audited[opt] = value
+	}
+	return audited
+}
+
+// auditSink is where audit records are written. Records are only ever added, never changed.
+type auditSink interface {
+	write(e *auditEntry, data []byte) error
+}
+
+// storageAuditSink writes each audit record to its own object in the object storage.
+type storageAuditSink struct {
+	driver storagedriver.StorageDriver
+}
+
+func (s storageAuditSink) write(e *auditEntry, data []byte) error {
+	sha := e.NewRev
+	if len(sha) > 8 {
+		sha = sha[:8]
+	}
+	key := fmt.Sprintf(AuditKeyPattern, e.App, e.Time.Format("20060102T150405.000000000Z"), sha, uuid.New()[:8])
+	return s.driver.PutContent(context.Background(), key, data)
+}
+
+// webhookAuditSink posts each audit record to a URL. If secret is set, requests are signed with it.
+type webhookAuditSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (s webhookAuditSink) write(e *auditEntry, data []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(data)
+		req.Header.Set(auditSignatureHeader, fmt.Sprintf("sha256=%x", mac.Sum(nil)))
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("the audit webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// newAuditSinks returns the audit sinks enabled in conf. Webhook requests are signed with the
+// secret in conf.AuditWebhookSecretFile, if it exists.
+func newAuditSinks(conf *Config, driver storagedriver.StorageDriver) ([]auditSink, error) {
+	var sinks []auditSink
+	if conf.AuditStorage {
+		sinks = append(sinks, storageAuditSink{driver: driver})
+	}
+	if conf.AuditWebhookURL != "" {
+		secret, err := ioutil.ReadFile(conf.AuditWebhookSecretFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading the audit webhook secret (%s)", err)
+		}
+		sinks = append(sinks, webhookAuditSink{
+			url:    conf.AuditWebhookURL,
+			secret: strings.TrimSpace(string(secret)),
+			client: &http.Client{Timeout: auditWebhookTimeout},
+		})
+	}
+	return sinks, nil
+}
+
+// decide records a policy applied to the build. A nil *auditEntry records nothing.
+func (e *auditEntry) decide(decision string) {
+	if e != nil {
+		e.Decisions = append(e.Decisions, decision)
+	}
+}
+
+// phase records that the build entered phase.
+func (e *auditEntry) phase(phase, message string) {
+	if e != nil {
+		e.Outcome = phase
+		e.Message = message
+	}
+}
+
+// write writes e to all sinks. Failures are logged, never returned, so that an unavailable audit
+// sink doesn't fail pushes.
+func (e *auditEntry) write(sinks []auditSink) {
+	if e == nil || len(sinks) == 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Info("unable to write the audit record of the push (%s)", err)
+		return
+	}
+	for _, sink := range sinks {
+		if err := sink.write(e, data); err != nil {
+			log.Info("unable to write the audit record of the push (%s)", err)
+		}
+	}
+}
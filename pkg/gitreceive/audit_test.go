@@ -0,0 +1,97 @@
+package gitreceive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestNewAuditEntry(t *testing.T) {
+	conf := &Config{Repository: "app.git", Username: "me", Fingerprint: "ab:cd", SSHConnection: "10.0.0.1 51234 10.0.0.2 2223", TraceID: "5f3a9c1e"}
+	pushOpts := PushOptions{"rebuild": "", "env:DATABASE_URL": "postgres://app:secret@db/app"}
+	e := newAuditEntry(conf, "0000", "12345678abcdef", "refs/heads/master", pushOpts)
+	assert.Equal(t, e.App, "app", "app")
+	assert.Equal(t, e.PushOptions, PushOptions{"rebuild": "", "env:DATABASE_URL": "[REDACTED]"}, "push options")
+	assert.Equal(t, pushOpts["env:DATABASE_URL"], "postgres://app:secret@db/app", "push options of the build")
+	assert.Equal(t, e.RemoteAddr, "10.0.0.1", "remote address")
+	assert.Equal(t, e.Fingerprint, "ab:cd", "fingerprint")
+	assert.Equal(t, e.TraceID, "5f3a9c1e", "trace ID")
+
+	// the audit record follows the build
+	r := newBuildRecorder(conf, nil, nil, "12345678")
+	r.audit = e
+	r.record(buildPhaseStarted, "me pushed refs/heads/master")
+	r.warn(envFilteredReason, "config keys kept from the build: AWS_SECRET_ACCESS_KEY")
+	r.released(3, "released v%d", 3)
+	assert.Equal(t, e.Outcome, buildPhaseReleased, "outcome")
+	assert.Equal(t, e.Release, 3, "release")
+	assert.Equal(t, e.Decisions, []string{"config keys kept from the build: AWS_SECRET_ACCESS_KEY"}, "decisions")
+}
+
+func TestStorageAuditSink(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	conf := &Config{Repository: "app.git", AuditStorage: true}
+	e := newAuditEntry(conf, "0000", "12345678abcdef", "refs/heads/master", nil)
+	sinks, err := newAuditSinks(conf, driver)
+	assert.NoErr(t, err)
+	e.write(sinks)
+	e.write(sinks)
+
+	// records are never overwritten
+	keys, err := driver.List(context.Background(), "audit/app")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(keys), 2, "number of records")
+	data, err := driver.GetContent(context.Background(), keys[0])
+	assert.NoErr(t, err)
+	var got auditEntry
+	assert.NoErr(t, json.Unmarshal(data, &got))
+	assert.Equal(t, got.NewRev, "12345678abcdef", "new rev")
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	var body []byte
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get(auditSignatureHeader)
+	}))
+	defer srv.Close()
+
+	secretFile, err := ioutil.TempFile("", "webhook-secret")
+	assert.NoErr(t, err)
+	defer os.Remove(secretFile.Name())
+	_, err = secretFile.WriteString("s3cr3t\n")
+	assert.NoErr(t, err)
+	secretFile.Close()
+
+	conf := &Config{Repository: "app.git", AuditWebhookURL: srv.URL, AuditWebhookSecretFile: secretFile.Name()}
+	e := newAuditEntry(conf, "0000", "12345678abcdef", "refs/heads/master", nil)
+	e.phase(buildPhaseFailed, "boom")
+	sinks, err := newAuditSinks(conf, nil)
+	assert.NoErr(t, err)
+	e.write(sinks)
+
+	var got auditEntry
+	assert.NoErr(t, json.Unmarshal(body, &got))
+	assert.Equal(t, got.Outcome, buildPhaseFailed, "outcome")
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	assert.Equal(t, signature, fmt.Sprintf("sha256=%x", mac.Sum(nil)), "signature")
+
+	sink := webhookAuditSink{url: srv.URL + "/missing", client: http.DefaultClient}
+	srv.Config.Handler = http.NotFoundHandler()
+	assert.True(t, sink.write(e, body) != nil, "wrote to a webhook that answered 404")
+}
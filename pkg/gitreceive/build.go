@@ -2,24 +2,26 @@ package gitreceive
 
 import (
 	"bytes"
-	ctx "context"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/drycc/builder/pkg/controller"
 	"github.com/drycc/builder/pkg/git"
 	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/registry"
+	"github.com/drycc/builder/pkg/release"
 	"github.com/drycc/builder/pkg/storage"
-	"github.com/drycc/builder/pkg/sys"
+	drycc "github.com/drycc/controller-sdk-go"
 	dryccAPI "github.com/drycc/controller-sdk-go/api"
 	"github.com/drycc/controller-sdk-go/hooks"
 	"github.com/drycc/pkg/log"
@@ -30,6 +32,9 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
+// storagePathRegexp allows the ':' in slug keys and keys without a leading '/'.
+var storagePathRegexp = storage.KeyRegexp
+
 // repoCmd returns exec.Command(first, others...) with its current working directory repoDir
 func repoCmd(repoDir, first string, others ...string) *exec.Cmd {
 	cmd := exec.Command(first, others...)
@@ -49,18 +54,15 @@ func run(cmd *exec.Cmd) error {
 	return cmd.Run()
 }
 
-func build(
-	conf *Config,
-	storageDriver storagedriver.StorageDriver,
-	//kubeClient *client.Client,
-	kubeClient *kubernetes.Clientset,
-	fs sys.FS,
-	env sys.Env,
-	builderKey,
-	rawGitSha string) error {
+// build builds the commit rawGitSha of the app and releases it, recording its phases with
+// recorder.
+func (b *Builder) build(ctx context.Context, rawGitSha string, pushOpts PushOptions, recorder *buildRecorder) error {
+	conf, kubeClient, promoter, presigners := b.conf, b.kubeClient, b.promoter, b.presigners
 
 	// Rewrite regular expression, compatible with slug type
-	storagedriver.PathRegexp = regexp.MustCompile(`^([A-Za-z0-9._:-]*(/[A-Za-z0-9._:-]+)*)+$`)
+	storagedriver.PathRegexp = storagePathRegexp
+	// build caches may be kept in a storage of their own
+	storageDriver, cacheDriver := b.drivers.Artifacts, b.drivers.Cache
 
 	dockerBuilderImagePullPolicy, err := k8s.PullPolicyFromString(conf.DockerBuilderImagePullPolicy)
 	if err != nil {
@@ -81,10 +83,13 @@ func build(
 	appName := conf.App()
 
 	repoDir := filepath.Join(conf.GitHome, repo)
-	buildDir := filepath.Join(repoDir, "build")
+	buildDir := buildDirectory(conf, repo, repoDir)
+	info := newBuildInfo(conf, repoDir, gitSha)
 
-	slugName := fmt.Sprintf("%s:git-%s", appName, gitSha.Short())
-	if err := os.MkdirAll(buildDir, os.ModeDir); err != nil {
+	if err := checkDiskSpace(conf, repoDir, buildDir, gitSha.Full()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
 		return fmt.Errorf("making the build directory %s (%s)", buildDir, err)
 	}
 
@@ -98,135 +103,476 @@ func build(
 		}
 	}()
 
-	client, err := controller.New(conf.ControllerHost, conf.ControllerPort)
+	routes, err := controller.ParseRoutes(conf.ControllerRoutes, conf.ControllerHost, conf.ControllerPort)
 	if err != nil {
 		return err
 	}
+	client, err := routes.New(appName)
+	if err != nil {
+		return err
+	}
+	// requests to the controller are canceled with the build, and bound by its deadline
+	client = controller.WithContext(ctx, client)
 
 	// Get the application config from the controller, so we can check for a custom buildpack URL
 	appConf, err := hooks.GetAppConfig(client, conf.Username, appName)
 	if controller.CheckAPICompat(client, err) != nil {
 		return err
 	}
+	// the config as fetched, before the build adds to it, to tell whether it changed meanwhile
+	fetchedConf := appConf
+	fetchedConf.Values = make(map[string]interface{}, len(appConf.Values))
+	for k, v := range appConf.Values {
+		fetchedConf.Values[k] = v
+	}
+	pusherTerminal.setLanguage(pushOpts, appConf)
+	profile, err := selectBuildProfile(conf.BuildProfilesPath, appConf)
+	if err != nil {
+		return userError(err)
+	}
+	if profile != nil {
+		pusherTerminal.info(msgBuildProfile, profile.Name)
+		conf = profile.configure(conf)
+		appConf = profile.appConfig(appConf)
+	}
+	strategy, err := releaseStrategy(conf, client, pushOpts)
+	if err != nil {
+		return userError(err)
+	}
+	if _, err := configuredPodSecurityRank(conf.PodSecurityLevel); err != nil {
+		return err
+	}
+	slugRunner, err := slugRunnerImage(conf, appConf)
+	if err != nil {
+		return policyError(err)
+	}
 
-	_, disableCaching := appConf.Values["DRYCC_DISABLE_CACHE"]
-	slugBuilderInfo := NewSlugBuilderInfo(appName, gitSha.Short(), disableCaching)
-
-	if slugBuilderInfo.DisableCaching() {
-		log.Debug("caching disabled for app %s", appName)
-		// If cache file exists, delete it
-		if _, err := storageDriver.Stat(context.Background(), slugBuilderInfo.CacheKey()); err == nil {
-			log.Debug("deleting cache %s for app %s", slugBuilderInfo.CacheKey(), appName)
-			if err := storageDriver.Delete(context.Background(), slugBuilderInfo.CacheKey()); err != nil {
-				return err
-			}
+	dryRun := pushOpts.Bool(dryRunPushOption)
+	debugTTL, err := buildDebugTTL(conf, pushOpts, appConf)
+	if err != nil {
+		return userError(err)
+	}
+	memoryLimit, err := builderMemoryLimit(conf, appConf)
+	if err != nil {
+		return userError(err)
+	}
+	if err := checkSignature(conf, repoDir, signedRev(recorder, gitSha.Full()), appConf, recorder); err != nil {
+		return err
+	}
+	window, err := offPeakWindow(conf, pushOpts, appConf)
+	if err != nil {
+		return userError(err)
+	}
+	if window != nil && !dryRun {
+		return b.queueBuild(window, gitSha, pushOpts, recorder)
+	}
+	if rawRef, ok := pushOpts.Get(imagePushOption); ok {
+		return importImage(ctx, conf, client, kubeClient, storageDriver, appConf, rawRef, gitSha, info, strategy, recorder, dryRun)
+	}
+	if !pushOpts.Bool(rebuildPushOption) {
+		promoted, err := getPromotedManifest(ctx, storageDriver, appName, gitSha.Short())
+		if err != nil {
+			return fmt.Errorf("reading the promoted build of %s (%s)", gitSha.Short(), err)
+		}
+		if promoted != nil && dryRun {
+			log.Info("Dry run, git-%s was promoted from another cluster and would be released without rebuilding", promoted.Sha)
+			return verifyPromoted(storageDriver, promoted)
+		} else if promoted != nil {
+			return releasePromoted(ctx, conf, client, kubeClient, storageDriver, appConf, promoted, info, strategy, slugRunner, recorder)
 		}
 	}
 
-	// build a tarball from the new objects
-	appTgz := fmt.Sprintf("%s.tar.gz", appName)
-	gitArchiveCmd := repoCmd(repoDir, "git", "archive", "--format=tar.gz", fmt.Sprintf("--output=%s", appTgz), gitSha.Short())
-	gitArchiveCmd.Stdout = os.Stdout
-	gitArchiveCmd.Stderr = os.Stderr
-	if err := run(gitArchiveCmd); err != nil {
-		return fmt.Errorf("running %s (%s)", strings.Join(gitArchiveCmd.Args, " "), err)
+	_, disableCaching := appConf.Values["DRYCC_DISABLE_CACHE"]
+	slugBuilderInfo := NewShardedSlugBuilderInfo(appName, gitSha.Short(), disableCaching, conf.StorageKeyShardLength)
+	comp, err := newCompression(conf.ArtifactCompression, conf.ArtifactCompressionLevel)
+	if err != nil {
+		return err
+	}
+	slugBuilderInfo.slugName = comp.slugName()
+	if err := checkSourceDedup(conf, comp); err != nil {
+		return err
+	}
+	analysis, err := newSourceAnalysis(conf, appConf)
+	if err != nil {
+		return err
 	}
-	absAppTgz := fmt.Sprintf("%s/%s", repoDir, appTgz)
 
-	// untar the archive into the temp dir
-	tarCmd := repoCmd(repoDir, "tar", "-xzf", appTgz, "-C", fmt.Sprintf("%s/", tmpDir))
-	tarCmd.Stdout = os.Stdout
-	tarCmd.Stderr = os.Stderr
-	if err := run(tarCmd); err != nil {
-		return fmt.Errorf("running %s (%s)", strings.Join(tarCmd.Args, " "), err)
+	clearCache := pushOpts.Bool(clearCachePushOption)
+	enabledCaches, err := enabledDependencyCaches(conf.DependencyCaches)
+	if err != nil {
+		return err
 	}
 
-	stack := getStack(tmpDir, appConf)
+	pusherTerminal.step(1)
+	// check the new objects out and build a tarball of them, while the build cache is inspected
+	// and the registry details are looked up
+	var steps stepGroup
+	var archive *sourceArchive
+	steps.run(func() (err error) {
+		archive, err = checkoutSource(conf.SourceCheckout, repoDir, appName, gitSha.Short(), tmpDir, comp)
+		return err
+	})
+	var cache cacheInspection
+	if !dryRun {
+		// the cache is deleted if caching is disabled or cleared
+		purge := slugBuilderInfo.DisableCaching() || clearCache
+		steps.run(func() (err error) {
+			cache, err = inspectCache(ctx, cacheDriver, slugBuilderInfo.CacheKey(), purge, b.now())
+			return err
+		})
+	}
+	// only container builds push to the registry, the stack isn't known before the checkout
+	var registryEnv map[string]string
+	var registryErr error
+	steps.run(func() error {
+		registryEnv, registryErr = getRegistryEnv(kubeClient.CoreV1(), conf.RegistryLocation, conf.PodNamespace)
+		return nil
+	})
+	err = pusherTerminal.during(msgCheckingOut, conf.SessionIdleInterval(), steps.wait)
+	defer archive.remove()
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		cache.tell()
+		if !slugBuilderInfo.DisableCaching() {
+			recorder.buildStats().cached(cache.hit)
+		}
+	}
 
-	appTgzdata, err := ioutil.ReadFile(absAppTgz)
+	setConfig, err := controllerSupports(client, conf.ReleaseConfigAPIVersion)
 	if err != nil {
-		return fmt.Errorf("error while reading file %s: (%s)", appTgz, err)
+		return fmt.Errorf("invalid release config API version %q (%s)", conf.ReleaseConfigAPIVersion, err)
+	}
+	configDefaults, generatedSecrets, err := applyAppJSON(tmpDir, &appConf, setConfig)
+	if err != nil {
+		return userError(err)
+	}
+	if err := checkProcfile(tmpDir, appName); err != nil {
+		return userError(err)
+	}
+	services, err := readBuildServices(tmpDir)
+	if err != nil {
+		return userError(err)
+	}
+	smoke, err := readSmokeTest(tmpDir)
+	if err != nil {
+		return userError(err)
 	}
 
-	log.Debug("Uploading tar to %s", slugBuilderInfo.TarKey())
+	detected, err := getStack(tmpDir, appConf)
+	if err != nil {
+		return userError(err)
+	}
+	stack, err := resolveStack(conf.StackCatalogPath, detected, appConf, b.now())
+	if err != nil {
+		return err
+	}
+	if err := checkStackPodSecurity(conf.PodSecurityLevel, stack); err != nil {
+		return policyError(err)
+	}
+	if stack["name"] == "container" && slugRunner != "" {
+		log.Info("WARNING: %s is ignored, container builds don't run with the slugrunner", slugRunnerImageKey)
+		slugRunner = ""
+	}
+	if stack["name"] == "container" {
+		if err := checkDockerfile(conf, tmpDir, appConf); err != nil {
+			return userError(err)
+		}
+	}
+	if stack["name"] == "container" && len(services) > 0 {
+		log.Info("WARNING: the build services of %s are ignored, only buildpack builds run with them", dryccYAMLName)
+		services = nil
+	}
 
-	if err := storageDriver.PutContent(context.Background(), slugBuilderInfo.TarKey(), appTgzdata); err != nil {
-		return fmt.Errorf("uploading %s to %s (%v)", absAppTgz, slugBuilderInfo.TarKey(), err)
+	scanner, err := newMalwareScanner(conf.MalwareScannerURL, conf.MalwareScanTimeout())
+	if err != nil {
+		return err
+	}
+	if err := scanSource(conf, scanner, appName, archive, recorder); err != nil {
+		return err
+	}
+
+	// with de-duplication, only the files the storage doesn't have yet are uploaded, and builder
+	// pods assemble the archive from them
+	tarSum := archive.sum
+	var deduped *dedupedSource
+	if conf.SourceDedup {
+		if deduped, err = dedupArchive(conf, archive, slugBuilderInfo.BlobsKey(), comp); err != nil {
+			return err
+		}
+		if deduped != nil {
+			tarSum = deduped.index.SHA256
+		}
+	}
+	var upload *sourceUpload
+	if !dryRun {
+		if deduped != nil {
+			log.Debug("Uploading source blobs to %s", slugBuilderInfo.BlobsKey())
+			upload = uploadSourceBlobs(ctx, storageDriver, slugBuilderInfo.SourceIndexKey(), deduped)
+		} else {
+			log.Debug("Uploading tar to %s", slugBuilderInfo.TarKey())
+			upload = uploadSource(ctx, storageDriver, slugBuilderInfo.TarKey(), archive)
+		}
+		// never leave an upload running behind a failed build
+		defer upload.wait()
+	}
+
+	envFilter, err := newEnvFilter(conf.BuildEnvAllow, conf.BuildEnvDeny)
+	if err != nil {
+		return err
+	}
+	buildEnv, filtered := envFilter.apply(appConf.Values)
+	if len(filtered) > 0 {
+		log.Info("Not passing config keys denied by the builder to the build: %s", strings.Join(filtered, ", "))
+		recorder.warn(envFilteredReason, "config keys kept from the build: %s", strings.Join(filtered, ", "))
+	}
+	pushEnv, err := pushOptionEnv(pushOpts, conf.BuildEnvPushOptions, envFilter)
+	if err != nil {
+		return err
+	}
+	if len(pushEnv) > 0 {
+		pusherTerminal.info(msgPushEnv, strings.Join(sortedKeys(pushEnv), ", "))
+		for key, value := range pushEnv {
+			buildEnv[key] = value
+		}
 	}
 
 	var pod *corev1.Pod
-	var buildPodName string
+	var buildPodName, envSecretName, platformImageName string
+	var envSecret *buildEnvSecret
+	var depCaches []dependencyCache
 	image := appName
+	platforms, err := buildPlatforms(appConf)
+	if err != nil {
+		return err
+	}
 
 	builderPodNodeSelector, err := buildBuilderPodNodeSelector(conf.BuilderPodNodeSelector)
 	if err != nil {
 		return fmt.Errorf("error build builder pod node selector %s", err)
 	}
+	cluster, err := newBuildCluster(conf, kubeClient)
+	if err != nil {
+		return err
+	}
+	if cluster.remote {
+		if err := checkRemoteBuild(conf, stack["name"]); err != nil {
+			return policyError(err)
+		}
+	}
 
+	podSpecs := PodSpecBuilder{
+		Namespace:    cluster.namespace,
+		NodeSelector: builderPodNodeSelector,
+		StorageType:  conf.StorageType,
+		Debug:        conf.Debug,
+	}
+	needs := podSecurityNeeds{stack: stack}
 	if strings.Contains(stack["name"], "container") {
 		buildPodName = dockerBuilderPodName(appName, gitSha.Short())
+		imageName, err := renderImageName(imageNameTemplate(conf, appConf), imageNameVars{
+			app:       appName,
+			sha:       gitSha.Short(),
+			ref:       recorder.ref(),
+			timestamp: b.now(),
+		})
+		if err != nil {
+			return err
+		}
+		name, tag := splitImageName(imageName)
 		registryLocation := conf.RegistryLocation
-		registryEnv := make(map[string]string)
+		if registryErr != nil {
+			return fmt.Errorf("error getting private registry details %s", registryErr)
+		}
 		if registryLocation != "on-cluster" {
-			registryEnv, err = getRegistryDetails(kubeClient.CoreV1(), &image, registryLocation, conf.PodNamespace)
+			image = registryImage(registryEnv, name) + ":" + tag
+			if err := checkImageReference(image); err != nil {
+				return err
+			}
+		} else {
+			if imageName != fmt.Sprintf("%s:git-%s", appName, gitSha.Short()) {
+				// the controller names images of the on-cluster registry app:git-<short sha> itself
+				image = imageName
+			}
+			token, err := registryToken(conf, appName, name, b.now())
 			if err != nil {
-				return fmt.Errorf("error getting private registry details %s", err)
+				return err
+			}
+			if token != "" {
+				registryEnv["DRYCC_REGISTRY_TOKEN"] = token
 			}
-			image = image + ":git-" + gitSha.Short()
 		}
 		registryEnv["DRYCC_REGISTRY_LOCATION"] = registryLocation
+		buildKit, err := newBuildKitOptions(conf, appConf, name)
+		if err != nil {
+			return err
+		}
 
-		pod = dockerBuilderPod(
-			conf.Debug,
-			buildPodName,
-			conf.PodNamespace,
-			appConf.Values,
-			slugBuilderInfo.TarKey(),
-			gitSha.Short(),
-			slugName,
-			conf.StorageType,
-			stack["image"],
-			conf.RegistryHost,
-			conf.RegistryPort,
-			registryEnv,
-			dockerBuilderImagePullPolicy,
-			builderPodNodeSelector,
-		)
+		pod = podSpecs.DockerBuilderPod(DockerBuilderOptions{
+			PodOptions: PodOptions{
+				Name:       buildPodName,
+				Image:      stack["image"],
+				PullPolicy: dockerBuilderImagePullPolicy,
+				Env:        buildEnv,
+				TarKey:     slugBuilderInfo.TarKey(),
+				ShortSha:   gitSha.Short(),
+			},
+			ImageName:    imageName,
+			RegistryHost: conf.RegistryHost,
+			RegistryPort: conf.RegistryPort,
+			RegistryEnv:  registryEnv,
+		})
+		buildKit.setPod(pod)
+		needs = newPodSecurityNeeds(conf, stack, registryEnv, buildKit)
+		platformImageName = imageName
 	} else {
 		buildPodName = slugBuilderPodName(appName, gitSha.Short())
+		if len(platforms) > 0 {
+			log.Info("WARNING: %s is ignored, buildpack builds build for the platform of their node", buildPlatformsKey)
+			platforms = nil
+		}
 
 		cacheKey := ""
 		if !slugBuilderInfo.DisableCaching() {
 			cacheKey = slugBuilderInfo.CacheKey()
 		}
-		envSecretName := fmt.Sprintf("%s-build-env", appName)
-		err = createAppEnvConfigSecret(kubeClient.CoreV1().Secrets(conf.PodNamespace), envSecretName, appConf.Values)
-		if err != nil {
-			return fmt.Errorf("error creating/updating secret %s: (%s)", envSecretName, err)
+		envSecretName = fmt.Sprintf("%s-build-env", appName)
+		envSecret = &buildEnvSecret{
+			secrets:    cluster.client.CoreV1().Secrets(cluster.namespace),
+			name:       envSecretName,
+			env:        buildEnv,
+			shortLived: conf.ShortLivedEnvSecrets,
+			recorder:   recorder,
 		}
-		defer func() {
-			if err := kubeClient.CoreV1().Secrets(conf.PodNamespace).Delete(ctx.TODO(), envSecretName, metav1.DeleteOptions{}); err != nil {
-				log.Info("unable to delete secret %s (%s)", envSecretName, err)
+		if !dryRun {
+			defer envSecret.delete()
+		}
+		pod = podSpecs.SlugBuilderPod(SlugBuilderOptions{
+			PodOptions: PodOptions{
+				Name:       buildPodName,
+				Image:      stack["image"],
+				PullPolicy: slugBuilderImagePullPolicy,
+				Env:        buildEnv,
+				TarKey:     slugBuilderInfo.TarKey(),
+				ShortSha:   gitSha.Short(),
+			},
+			EnvSecretName: envSecretName,
+			PutKey:        slugBuilderInfo.PushKey(),
+			CacheKey:      cacheKey,
+		})
+		// only buildpacks run with the dependency caches
+		depCaches = usedDependencyCaches(enabledCaches, tmpDir)
+		mountDependencyCaches(pod, appName, depCaches, clearCache)
+	}
+
+	// builder pods verify the tarball against this digest before building from it
+	addEnvToPod(*pod, tarSha256, tarSum)
+	if asyncSourceUpload(conf, pod.Spec.Containers[0].Image) {
+		// the tarball may still be uploading when the pod starts
+		addEnvToPod(*pod, tarWaitTimeout, strconv.Itoa(int(conf.BuilderPodWaitDuration().Seconds())))
+	}
+	if !memoryLimit.IsZero() {
+		setMemoryLimit(pod, memoryLimit)
+	}
+	if profile != nil {
+		profile.setPodResources(pod)
+	}
+	if err := setPodNetwork(conf, pod); err != nil {
+		return err
+	}
+	comp.setPodEnv(pod)
+	if deduped != nil {
+		addSourceAssembler(pod, conf.SourceAssemblerImage, slugBuilderInfo.SourceIndexKey())
+	}
+	level := needs.resolve(conf.PodSecurityLevel)
+	if err := checkNamespacePodSecurity(cluster.client.CoreV1().Namespaces(), cluster.namespace, level, needs); err != nil {
+		return policyError(err)
+	}
+	if level != conf.PodSecurityLevel {
+		log.Debug("running the builder pod at the %s PodSecurity level", level)
+		resolved := *conf
+		resolved.PodSecurityLevel = level
+		conf = &resolved
+	}
+	setPodSecurity(pod, conf.PodSecurityLevel, conf.BuilderPodRunAsUser)
+	if conf.BuilderPodAntiAffinity {
+		spreadBuilderPods(pod)
+	}
+
+	if dryRun {
+		plan := dryRunPlan{Stack: stack, Image: image, Pod: pod, Config: configDefaults, Strategy: strategy, SlugRunner: slugRunner}
+		if stack["name"] != "container" {
+			plan.Image = slugBuilderInfo.AbsoluteSlugObjectKey()
+		}
+		if !slugBuilderInfo.DisableCaching() {
+			plan.CacheKey = slugBuilderInfo.CacheKey()
+			if plan.CacheSize, err = cacheUsage(ctx, cacheDriver, plan.CacheKey); err != nil {
+				log.Debug("unable to measure the cache %s (%s)", plan.CacheKey, err)
 			}
-		}()
-		pod = slugbuilderPod(
-			conf.Debug,
-			buildPodName,
-			conf.PodNamespace,
-			appConf.Values,
-			envSecretName,
-			slugBuilderInfo.TarKey(),
-			slugBuilderInfo.PushKey(),
-			cacheKey,
-			gitSha.Short(),
-			conf.StorageType,
-			stack["image"],
-			slugBuilderImagePullPolicy,
-			builderPodNodeSelector,
-		)
-	}
-
-	log.Info("Starting build... but first, coffee!")
+		}
+		plan.print()
+		return nil
+	}
+
+	// the build cluster needs its own copy of the object storage credentials unless the pod gets
+	// presigned URLs
+	if cluster.remote && presigners == nil {
+		err := syncSecret(kubeClient.CoreV1().Secrets(conf.PodNamespace), cluster.client.CoreV1().Secrets(cluster.namespace), objectStore)
+		if err != nil {
+			return err
+		}
+	}
+	claims := cluster.client.CoreV1().PersistentVolumeClaims(cluster.namespace)
+	if err := provisionDependencyCaches(claims, appName, depCaches, conf.DependencyCacheSize, conf.DependencyCacheStorageClass); err != nil {
+		return err
+	}
+
+	releaseSlot, err := waitForBuildSlot(ctx, conf, kubeClient.CoordinationV1().Leases(conf.PodNamespace), appName, gitSha.Short())
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+	// the builds on each node are counted once the build got its slot, right before its pod starts
+	if conf.MaxBuildsPerNode > 0 {
+		busy, err := busyNodes(cluster.client.CoreV1().Pods(cluster.namespace), conf.MaxBuildsPerNode)
+		if err != nil {
+			log.Info("unable to count the builds on each node (%s)", err)
+		} else if len(busy) > 0 {
+			log.Debug("nodes running %d builds already: %s", conf.MaxBuildsPerNode, strings.Join(busy, ", "))
+			avoidNodes(pod, busy)
+		}
+	}
+	// sign the URLs once the build got its slot, for them to last the whole build
+	if presigners != nil {
+		if err := presignPod(pod, presigners, slugBuilderInfo, presignedURLTTL(conf)); err != nil {
+			return err
+		}
+	}
+
+	if conf.BuilderPodNetworkPolicy {
+		policies := cluster.client.NetworkingV1().NetworkPolicies(cluster.namespace)
+		removePolicy, err := isolateBuilderPod(conf, policies, pod, appName, appConf)
+		if err != nil {
+			return err
+		}
+		defer removePolicy()
+	}
+	if len(services) > 0 {
+		servicesPod := buildServicesPod(buildServicesPodName(appName, gitSha.Short()), cluster.namespace, appName, services, builderPodNodeSelector)
+		host, stopServices, err := startBuildServices(ctx, cluster.client, servicesPod, conf.BuilderPodWaitDuration(), conf.SessionIdleInterval())
+		if err != nil {
+			return err
+		}
+		defer stopServices()
+		// the build env is handed to the slugbuilder when its pod starts
+		for key, value := range buildServicesEnv(services, host) {
+			buildEnv[key] = value
+		}
+	}
+
+	pusherTerminal.step(2)
+	pusherTerminal.info(msgStartingBuild)
 	log.Debug("Use image %s: %s", stack["name"], stack["image"])
 	log.Debug("Starting pod %s", buildPodName)
 	json, err := prettyPrintJSON(pod)
@@ -236,92 +582,412 @@ func build(
 		log.Debug("Error creating json representation of pod spec: %v", err)
 	}
 
-	podsInterface := kubeClient.CoreV1().Pods(conf.PodNamespace)
+	podsInterface := cluster.client.CoreV1().Pods(cluster.namespace)
+	runPod := func(pod *corev1.Pod) (*corev1.Pod, error) {
+		return runBuilderPod(ctx, conf, cluster.client, pod, envSecret, upload, stack["name"], pusherTerminal.out, recorder)
+	}
+	newName := func() string {
+		return newBuilderPodName(stack["name"], appName, gitSha.Short())
+	}
+	var buildPod *corev1.Pod
+	if len(platforms) > 0 {
+		names := make([]string, len(platforms))
+		pods := make([]*corev1.Pod, len(platforms))
+		for i, p := range platforms {
+			names[i] = p.String()
+			pods[i] = platformPod(pod, appName, gitSha.Short(), platformImageName, p)
+		}
+		pusherTerminal.info(msgBuildingFor, strings.Join(names, ", "))
+		ran, ended, err := runPlatformBuilds(pods, platforms, func(pod *corev1.Pod, p registry.Platform, out io.Writer) (*corev1.Pod, *corev1.Pod, error) {
+			return runRescheduled(conf, pod, func() string {
+				return platformPodName(appName, gitSha.Short(), p)
+			}, func(pod *corev1.Pod) (*corev1.Pod, error) {
+				return runBuilderPod(ctx, conf, cluster.client, pod, envSecret, upload, stack["name"], out, recorder)
+			}, recorder)
+		})
+		if err != nil {
+			return err
+		}
+		// the first failed build is the one reported, and kept for debugging
+		pod, buildPod = ran[0], ended[0]
+		for i := range ended {
+			if buildPodError(ended[i]) != nil {
+				pod, buildPod = ran[i], ended[i]
+				break
+			}
+		}
+	} else if pod, buildPod, err = runRescheduled(conf, pod, newName, runPod, recorder); err != nil {
+		return err
+	} else if oomKilled(buildPod) {
+		if retryLimit, ok := oomRetryLimit(conf, memoryLimit); ok {
+			pusherTerminal.info(msgOOMRetry, memoryLimit.String(), retryLimit.String())
+			pod = retryPod(pod, newName(), retryLimit)
+			if pod, buildPod, err = runRescheduled(conf, pod, newName, runPod, recorder); err != nil {
+				return err
+			}
+			if !oomKilled(buildPod) {
+				pusherTerminal.info(msgOOMLimit, memoryLimit.String(), buildMemoryKey, retryLimit.String())
+			}
+		}
+	}
 
-	newPod, err := podsInterface.Create(ctx.TODO(), pod, metav1.CreateOptions{})
+	recorder.buildCost().report(conf.GitHome, appName)
+
+	if err := buildPodError(buildPod); err != nil {
+		if debugTTL > 0 {
+			secrets := cluster.client.CoreV1().Secrets(cluster.namespace)
+			if err := keepFailedBuild(podsInterface, secrets, pod, envSecretName, buildEnv, debugTTL); err != nil {
+				log.Info("unable to keep the failed build for debugging (%s)", err)
+			}
+		}
+		return err
+	}
+	log.Debug("Done")
+
+	// the source is analyzed once it built, while its archive is still in the storage
+	if analysis != nil {
+		reports, licenses, err := analysis.run(ctx, conf, cluster.client, storageDriver, pod, appName, gitSha.Short(), slugBuilderInfo.TarKey(), comp)
+		if err != nil {
+			return err
+		}
+		info.analysis = analysisCounts(reports)
+		if err := analysis.check(reports, recorder); err != nil {
+			return err
+		}
+		if err := analysis.checkLicenses(licenses, recorder); err != nil {
+			return err
+		}
+	}
+
+	if stack["name"] != "container" {
+		err := pusherTerminal.during(msgVerifyingSlug, conf.SessionIdleInterval(), func() error {
+			return verifySlug(storageDriver, slugBuilderInfo.AbsoluteSlugObjectKey())
+		})
+		if err != nil {
+			return err
+		}
+		if fi, err := storageDriver.Stat(ctx, slugBuilderInfo.AbsoluteSlugObjectKey()); err == nil {
+			recorder.buildStats().sized(fi.Size())
+		}
+	}
+
+	procType, err := getProcFile(ctx, storageDriver, tmpDir, slugBuilderInfo.AbsoluteProcfileKey(), stack)
 	if err != nil {
-		return fmt.Errorf("creating builder pod (%s)", err)
+		return err
+	}
+	// the Procfile of the repo was checked before building, the buildpack's wasn't
+	if err := validateProcessTypes(procType, appName); err != nil {
+		return userError(err)
 	}
 
-	pw := k8s.NewPodWatcher(*kubeClient, conf.PodNamespace)
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	go pw.Controller.Run(stopCh)
+	pusherTerminal.info(msgBuildComplete)
+	recorder.record(buildPhaseBuilt, "build pod %s succeeded", buildPod.Name)
+	if deduped != nil {
+		deleteAssembledSource(storageDriver, slugBuilderInfo.TarKey())
+	}
 
-	if err := waitForPod(pw, newPod.Namespace, newPod.Name, conf.SessionIdleInterval(), conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
-		return fmt.Errorf("watching events for builder pod startup (%s)", err)
+	var imageDigest string
+	// the release phase runs the slug of slug builds, and the image of container builds by digest
+	releasePhaseImage := slugBuilderInfo.AbsoluteSlugObjectKey()
+	if stack["name"] != "container" {
+		image = slugBuilderInfo.AbsoluteSlugObjectKey()
+	} else {
+		var built *builtImage
+		if len(platforms) > 0 {
+			built, info.platformDigests, err = pushImageIndex(conf, kubeClient.CoreV1().Secrets(conf.PodNamespace), image, gitSha.Short(), platforms)
+		} else {
+			built, err = resolveBuiltImage(conf, kubeClient.CoreV1().Secrets(conf.PodNamespace), image, gitSha.Short())
+		}
+		if err != nil {
+			return err
+		}
+		copies, err := pushImageCopies(conf, built)
+		if err != nil {
+			return err
+		}
+		imageDigest = built.digest
+		info.imageDigests = append([]string{built.String()}, copies...)
+		releasePhaseImage = built.String()
+		if len(procType) == 0 {
+			if procType, configDefaults, err = synthesizeProcessTypes(built, appConf, configDefaults); err != nil {
+				return err
+			}
+		}
 	}
+	promoter.promoteBuild(ctx, conf, kubeClient.CoreV1().Secrets(conf.PodNamespace), storageDriver,
+		newBuildManifest(appName, gitSha.Short(), 0, stack["name"], image, procType, appConf.Values))
+
+	// a canceled build mustn't start releasing
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	currentConf, err := checkConfigDrift(conf, func() (dryccAPI.Config, error) {
+		return hooks.GetAppConfig(client, conf.Username, appName)
+	}, fetchedConf, recorder)
+	if err != nil {
+		return err
+	}
+	processes, err := runReleasePhase(ctx, conf, kubeClient, currentConf, configDefaults, procType,
+		appName, gitSha.Short(), stack["name"], releasePhaseImage, slugRunner, recorder)
+	if err != nil {
+		return err
+	}
+	pusherTerminal.step(3)
+	pusherTerminal.info(msgLaunching)
+	info.stackImage = podImage(buildPod)
+	summary := recorder.buildSummary()
+	summary.built(stack["name"], releaseImage(conf, image, imageDigest), imageDigest, info.platformDigests, processes)
+	summary.logs(pod.Namespace, pod.Name)
+	version, err := createBuild(ctx, conf, client, storageDriver, release.Request{
+		Username:    conf.Username,
+		App:         appName,
+		Image:       releaseImage(conf, image, imageDigest),
+		Stack:       stack["name"],
+		Sha:         gitSha.Short(),
+		Procfile:    processes,
+		Dockerfile:  stack["name"] == "container",
+		Config:      configDefaults,
+		Secrets:     generatedSecrets,
+		Annotations: info.annotations(b.now()),
+		Strategy:    strategy,
+		SlugRunner:  slugRunner,
+	})
+	if err == errReleaseDeferred {
+		recorder.record(buildPhaseDeferred, "the controller is unavailable, the release is pending")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recorder.released(version, "released v%d", version)
+	printDeployed(appName, version)
+	summarizeRelease(ctx, storageDriver, newBuildManifest(appName, gitSha.Short(), version, stack["name"], image, procType, appConf.Values))
+	if err := runSmokeTest(ctx, conf, kubeClient, client, smoke, currentConf, configDefaults,
+		appName, gitSha.Short(), stack["name"], releasePhaseImage, slugRunner, version, recorder); err != nil {
+		return err
+	}
+
+	pusherTerminal.during(msgCompactingRepo, conf.SessionIdleInterval(), func() error {
+		run(repoCmd(repoDir, "git", "gc"))
+		return nil
+	})
+
+	return nil
+}
+
+// runBuilderPod starts pod with kubeClient, the client of the build cluster, streams its logs to the pusher, within the
+// limits of conf, and returns it once it ended. envSecret is the secret the pod reads the app config from, nil if it doesn't need one. The secret is
+// created while upload, the upload of the source the pod builds, finishes, and the pod once both
+// are done or, with async source uploads, right away. The pod is deleted if the upload fails, or
+// if ctx is done before it ended.
+func runBuilderPod(
+	ctx context.Context,
+	conf *Config,
+	kubeClient kubernetes.Interface,
+	pod *corev1.Pod,
+	envSecret *buildEnvSecret,
+	upload *sourceUpload,
+	stackName string,
+	out io.Writer,
+	recorder *buildRecorder) (*corev1.Pod, error) {
+
+	var steps stepGroup
+	steps.run(func() error { return envSecret.create(ctx) })
+	async := upload == nil || asyncSourceUpload(conf, pod.Spec.Containers[0].Image)
+	if async {
+		if err := steps.wait(); err != nil {
+			return nil, err
+		}
+	} else {
+		steps.run(upload.wait)
+		if err := pusherTerminal.during(msgUploadingSource, conf.SessionIdleInterval(), steps.wait); err != nil {
+			return nil, err
+		}
+		upload.tell()
+	}
+	pods := kubeClient.CoreV1().Pods(pod.Namespace)
+	newPod, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating builder pod (%s)", err)
+	}
+	// the pod was created first so that it's scheduled while the upload finishes
+	if upload != nil && async {
+		if err := pusherTerminal.during(msgUploadingSource, conf.SessionIdleInterval(), upload.wait); err != nil {
+			pods.Delete(context.Background(), newPod.Name, metav1.DeleteOptions{})
+			return nil, err
+		}
+		upload.tell()
+	}
+	// a canceled build stops its pod, with a context of its own since ctx is done
+	defer func() {
+		if ctx.Err() != nil {
+			log.Info("deleting builder pod %s of the canceled build", newPod.Name)
+			pods.Delete(context.Background(), newPod.Name, metav1.DeleteOptions{})
+		}
+	}()
+	recorder.record(buildPhaseBuilding, "building %s with pod %s", stackName, newPod.Name)
+
+	waiter := k8s.NewPodWaiter(kubeClient, newPod.Namespace)
+	waitCtx, stopWaiter := context.WithCancel(ctx)
+	defer stopWaiter()
+	waiter.Start(waitCtx)
+
+	pullCtx, stopPulls := context.WithCancel(waitCtx)
+	pulls := watchImagePulls(pullCtx, kubeClient.CoreV1().Events(newPod.Namespace), newPod.Name)
+	err = waitForPod(waitCtx, waiter, pulls, newPod.Name, conf.SessionIdleInterval(), conf.BuilderPodWaitDuration(), conf.BuilderPodPullTimeout(), recorder)
+	stopPulls()
+	if err != nil {
+		if _, ok := err.(podLostError); ok {
+			deleteLostPod(pods, newPod)
+			return nil, err
+		}
+		if KindOf(err) == ErrTimeout {
+			pods.Delete(context.Background(), newPod.Name, metav1.DeleteOptions{})
+			return nil, err
+		}
+		return nil, fmt.Errorf("watching events for builder pod startup (%s)", err)
+	}
+	envSecret.started()
 
 	req := kubeClient.CoreV1().RESTClient().Get().Namespace(newPod.Namespace).Name(newPod.Name).Resource("pods").SubResource("log").VersionedParams(
 		&corev1.PodLogOptions{
 			Follow: true,
 		}, scheme.ParameterCodec)
 
-	rc, err := req.Stream(ctx.TODO())
+	rc, err := req.Stream(ctx)
 	if err != nil {
-		return fmt.Errorf("attempting to stream logs (%s)", err)
+		return nil, fmt.Errorf("attempting to stream logs (%s)", err)
 	}
 	defer rc.Close()
+	// the logs of a pod lost with its node can hang, they're cut off once the pod is lost
+	lost := make(chan error, 1)
+	go func() {
+		if _, err := waiter.Wait(waitCtx, newPod.Name, podLostCondition); err != nil {
+			if _, ok := err.(podLostError); ok {
+				lost <- err
+				rc.Close()
+			}
+		}
+	}()
 
-	size, err := io.Copy(os.Stdout, rc)
+	logs := newBuildLog(conf, out)
+	size, err := io.Copy(logs, rc)
+	if logs.finish() {
+		logs.storeTail(recorder.logStorage(), conf.App(), newPod.Name)
+	}
+	select {
+	case err := <-lost:
+		deleteLostPod(pods, newPod)
+		return nil, err
+	default:
+	}
 	if err != nil {
-		return fmt.Errorf("fetching builder logs (%s)", err)
+		return nil, fmt.Errorf("fetching builder logs (%s)", err)
 	}
 	log.Debug("size of streamed logs %v", size)
 
-	log.Debug(
-		"Waiting for the %s/%s pod to end. Checking every %s for %s",
-		newPod.Namespace,
-		newPod.Name,
-		conf.BuilderPodTickDuration(),
-		conf.BuilderPodWaitDuration(),
-	)
-	// check the state and exit code of the build pod.
-	// if the code is not 0 return error
-	if err := waitForPodEnd(pw, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
-		return fmt.Errorf("error getting builder pod status (%s)", err)
+	log.Debug("Waiting up to %s for the %s/%s pod to end", conf.BuilderPodWaitDuration(), newPod.Namespace, newPod.Name)
+	buildPod, err := waitForPodEnd(waitCtx, waiter, newPod.Name, conf.BuilderPodWaitDuration())
+	if _, ok := err.(podLostError); ok {
+		deleteLostPod(pods, newPod)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting builder pod status (%s)", err)
 	}
 	log.Debug("Done")
-	log.Debug("Checking for builder pod exit code")
-	buildPod, err := kubeClient.CoreV1().Pods(newPod.Namespace).Get(ctx.TODO(), newPod.Name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("error getting builder pod status (%s)", err)
-	}
+	recorder.buildCost().add(buildPod)
+	return buildPod, nil
+}
 
-	for _, containerStatus := range buildPod.Status.ContainerStatuses {
-		state := containerStatus.State.Terminated
-		if state.ExitCode != 0 {
-			return fmt.Errorf("build pod exited with code %d, stopping build", state.ExitCode)
+// verifySlug checks the slug at slugKey against the digest the slugbuilder recorded for it, so a
+// partially uploaded or corrupted slug never gets released.
+func verifySlug(reader storage.ObjectReader, slugKey string) error {
+	verified, err := storage.VerifyChecksum(reader, slugKey)
+	if err != nil {
+		if _, ok := err.(storage.ErrChecksumMismatch); ok {
+			return fmt.Errorf("refusing to release a corrupted slug (%s)", err)
 		}
+		return fmt.Errorf("verifying slug %s (%s)", slugKey, err)
 	}
-	log.Debug("Done")
+	if !verified {
+		log.Info("WARNING: the slugbuilder recorded no checksum of %s, releasing it unverified", slugKey)
+	}
+	return nil
+}
 
-	procType, err := getProcFile(storageDriver, tmpDir, slugBuilderInfo.AbsoluteProcfileKey(), stack)
+// errReleaseDeferred is returned by createBuild when the release was queued to be published once
+// the controller is available again.
+var errReleaseDeferred = errors.New("release deferred until the controller is available")
+
+// createBuild publishes req to the controller, printing progress while the controller deploys it.
+// It returns the version of the new release. If the controller is unavailable and deferred
+// releases are enabled, req is queued and errReleaseDeferred is returned. With async releases,
+// the deploy is followed until it's over or the release timeout elapses.
+func createBuild(ctx context.Context, conf *Config, client *drycc.Client, queue release.Store, req release.Request) (int, error) {
+	async, err := asyncReleases(conf, client)
 	if err != nil {
+		return 0, err
+	}
+	var submitted release.Submission
+	err = pusherTerminal.during(msgWaitingForDeploy, conf.SessionIdleInterval(), func() (err error) {
+		if async {
+			submitted, err = release.Submit(ctx, client, req)
+			return err
+		}
+		submitted.Deployed = true
+		submitted.Version, err = release.Publish(ctx, client, req)
 		return err
+	})
+	if err != nil {
+		// the controller may have released the build before the request was canceled, queuing
+		// it could publish it twice
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("the build was canceled while publishing the release, which may have been created (%s)", err)
+		}
+		if conf.DeferredReleases && controller.IsUnavailable(err) {
+			req.LastError = err.Error()
+			qErr := release.Enqueue(queue, req)
+			if qErr == nil {
+				log.Info("The build succeeded, but the controller is unavailable (%s)", err)
+				pusherTerminal.info(msgReleasePending, req.App, req.Sha)
+				if len(req.Secrets) > 0 {
+					log.Info("WARNING: the secrets generated for %s aren't kept with the pending release, push again once it's released to set them", strings.Join(req.Secrets, ", "))
+				}
+				return 0, errReleaseDeferred
+			}
+			log.Info("unable to queue the release of %s (%s)", req.App, qErr)
+		}
+		return 0, fmt.Errorf("The controller returned an error when publishing the release: %s", err)
 	}
-
-	log.Info("Build complete.")
-
-	quit := progress("...", conf.SessionIdleInterval())
-	log.Info("Launching App...")
-	if stack["name"] != "container" {
-		image = slugBuilderInfo.AbsoluteSlugObjectKey()
+	// an older pending release would roll the app back once published
+	if err := release.Drop(queue, req.App); err != nil {
+		log.Info("unable to drop the pending release of %s (%s)", req.App, err)
 	}
-	release, err := hooks.CreateBuild(client, conf.Username, conf.App(), image, stack["name"], gitSha.Short(), procType, stack["name"] == "container")
-	quit <- true
-	<-quit
-	if controller.CheckAPICompat(client, err) != nil {
-		return fmt.Errorf("The controller returned an error when publishing the release: %s", err)
+	if !submitted.Deployed {
+		return submitted.Version, trackRelease(ctx, conf, client, req.App, submitted.Version)
 	}
+	return submitted.Version, nil
+}
 
-	log.Info("Done, %s:v%d deployed to Workflow\n", appName, release)
-	log.Info("Use 'drycc open' to view this application in your browser\n")
-	log.Info("To learn more, use 'drycc help' or visit https://drycc.com/\n")
-
-	run(repoCmd(repoDir, "git", "gc"))
+// asyncReleases returns true if releases are deployed in the background by the controller of
+// client, which only the controllers from conf.AsyncReleasesAPIVersion do.
+func asyncReleases(conf *Config, client *drycc.Client) (bool, error) {
+	if !conf.AsyncReleases {
+		return false, nil
+	}
+	supported, err := controllerSupports(client, conf.AsyncReleasesAPIVersion)
+	if err != nil {
+		return false, fmt.Errorf("invalid async releases API version %q (%s)", conf.AsyncReleasesAPIVersion, err)
+	}
+	if !supported {
+		log.Debug("the controller (API %s) doesn't deploy releases in the background", client.ControllerAPIVersion)
+	}
+	return supported, nil
+}
 
-	return nil
+func printDeployed(appName string, version int) {
+	pusherTerminal.info(msgDeployed, appName, version)
+	pusherTerminal.info(msgOpenHint)
+	pusherTerminal.info(msgHelpHint)
 }
 
 func buildBuilderPodNodeSelector(config string) (map[string]string, error) {
@@ -350,7 +1016,7 @@ func prettyPrintJSON(data interface{}) (string, error) {
 	return formatted.String(), nil
 }
 
-func getProcFile(getter storage.ObjectGetter, dirName, procfileKey string, stack map[string]string) (dryccAPI.ProcessType, error) {
+func getProcFile(ctx context.Context, getter storage.ObjectGetter, dirName, procfileKey string, stack map[string]string) (dryccAPI.ProcessType, error) {
 	procType := dryccAPI.ProcessType{}
 	if _, err := os.Stat(fmt.Sprintf("%s/Procfile", dirName)); err == nil {
 		rawProcFile, err := ioutil.ReadFile(fmt.Sprintf("%s/Procfile", dirName))
@@ -366,7 +1032,7 @@ func getProcFile(getter storage.ObjectGetter, dirName, procfileKey string, stack
 		return procType, nil
 	}
 	log.Debug("Procfile not present. Getting it from the buildpack")
-	rawProcFile, err := getter.GetContent(context.Background(), procfileKey)
+	rawProcFile, err := getter.GetContent(ctx, procfileKey)
 	if err != nil {
 		return nil, fmt.Errorf("error in reading %s (%s)", procfileKey, err)
 	}
@@ -0,0 +1,96 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// cacheStat is the size of a build cache and when it was last updated. A missing cache has a zero
+// cacheStat.
+type cacheStat struct {
+	size    int64
+	updated time.Time
+}
+
+func (s cacheStat) missing() bool { return s.updated.IsZero() }
+
+// statCache returns the cacheStat of the cache under key, which is an object or a directory of
+// them.
+func statCache(ctx context.Context, driver storagedriver.StorageDriver, key string) (cacheStat, error) {
+	fi, err := driver.Stat(ctx, key)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return cacheStat{}, nil
+	} else if err != nil {
+		return cacheStat{}, err
+	}
+	if !fi.IsDir() {
+		return cacheStat{size: fi.Size(), updated: fi.ModTime()}, nil
+	}
+	var stat cacheStat
+	err = driver.Walk(ctx, key, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			stat.size += fi.Size()
+			if fi.ModTime().After(stat.updated) {
+				stat.updated = fi.ModTime()
+			}
+		}
+		return nil
+	})
+	return stat, err
+}
+
+// formatAge returns d, the age of something, in its largest whole unit, abbreviated so that it
+// reads in every language of the message catalog, e.g. "3d".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dd", d/(24*time.Hour))
+}
+
+// cacheInspection is what inspectCache found out about a build cache.
+type cacheInspection struct {
+	// hit is true if the build starts with the cache.
+	hit     bool
+	cleared bool
+	size    int64
+	age     time.Duration
+}
+
+// tell tells the pusher the size and age of the cache, or that it was cleared.
+func (c cacheInspection) tell() {
+	switch {
+	case c.hit:
+		pusherTerminal.info(msgBuildCache, formatSize(c.size), formatAge(c.age), clearCachePushOption)
+	case c.cleared:
+		pusherTerminal.info(msgCacheCleared, formatSize(c.size))
+	}
+}
+
+// inspectCache returns the size and age of the build cache under key, deleting it first if purge.
+// It runs along with other steps, so nothing is told to the pusher until tell is called.
+func inspectCache(ctx context.Context, driver storagedriver.StorageDriver, key string, purge bool, now time.Time) (cacheInspection, error) {
+	stat, err := statCache(ctx, driver, key)
+	if err != nil || stat.missing() {
+		// a cache that can't be inspected is built again
+		return cacheInspection{}, nil
+	}
+	c := cacheInspection{size: stat.size, age: now.Sub(stat.updated)}
+	if !purge {
+		c.hit = true
+		return c, nil
+	}
+	if err := driver.Delete(ctx, key); err != nil {
+		return c, fmt.Errorf("deleting the build cache %s (%s)", key, err)
+	}
+	c.cleared = true
+	return c, nil
+}
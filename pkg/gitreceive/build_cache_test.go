@@ -0,0 +1,61 @@
+package gitreceive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestStatCache(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	key := NewSlugBuilderInfo("app", "12345678", false).CacheKey()
+
+	stat, err := statCache(context.Background(), driver, key)
+	assert.NoErr(t, err)
+	assert.True(t, stat.missing(), "a missing cache isn't missing")
+
+	before := time.Now()
+	assert.NoErr(t, driver.PutContent(context.Background(), key, []byte("1234")))
+	stat, err = statCache(context.Background(), driver, key)
+	assert.NoErr(t, err)
+	assert.Equal(t, stat.size, int64(4), "size of the cache")
+	assert.False(t, stat.updated.Before(before), "the cache was updated before it was written")
+}
+
+func TestInspectCache(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	key := NewSlugBuilderInfo("app", "12345678", false).CacheKey()
+
+	c, err := inspectCache(context.Background(), driver, key, true, time.Now())
+	assert.NoErr(t, err)
+	assert.False(t, c.hit, "hit a missing cache")
+	assert.NoErr(t, driver.PutContent(context.Background(), key, []byte("1234")))
+	c, err = inspectCache(context.Background(), driver, key, false, time.Now())
+	assert.NoErr(t, err)
+	assert.True(t, c.hit, "missed the cache")
+	assert.Equal(t, c.size, int64(4), "cache size")
+	_, err = driver.Stat(context.Background(), key)
+	assert.NoErr(t, err)
+
+	c, err = inspectCache(context.Background(), driver, key, true, time.Now())
+	assert.NoErr(t, err)
+	assert.False(t, c.hit, "hit a purged cache")
+	assert.True(t, c.cleared, "the purged cache isn't cleared")
+	_, err = driver.Stat(context.Background(), key)
+	assert.True(t, err != nil, "the purged cache is still there")
+}
+
+func TestFormatAge(t *testing.T) {
+	assert.Equal(t, formatAge(42*time.Second), "42s", "seconds")
+	assert.Equal(t, formatAge(90*time.Minute), "1h", "hours")
+	assert.Equal(t, formatAge(5*time.Minute), "5m", "minutes")
+	assert.Equal(t, formatAge(80*time.Hour), "3d", "days")
+}
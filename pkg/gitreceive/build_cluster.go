@@ -0,0 +1,72 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// buildCluster is the cluster builder pods run in: the cluster of the builder or, to keep builds
+// from competing with the apps for resources, a dedicated build cluster. Releases always go to the
+// controller of the builder's cluster.
+type buildCluster struct {
+	client    kubernetes.Interface
+	namespace string
+	// remote is set for a dedicated build cluster.
+	remote bool
+}
+
+// newBuildCluster returns the build cluster of conf, the cluster of local unless a kubeconfig of a
+// dedicated build cluster is configured.
+func newBuildCluster(conf *Config, local kubernetes.Interface) (*buildCluster, error) {
+	if conf.BuildClusterKubeconfig == "" {
+		return &buildCluster{client: local, namespace: conf.PodNamespace}, nil
+	}
+	client, err := k8s.NewForKubeconfig(conf.BuildClusterKubeconfig, conf.BuildClusterContext)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the build cluster with %s (%s)", conf.BuildClusterKubeconfig, err)
+	}
+	namespace := conf.BuildClusterNamespace
+	if namespace == "" {
+		namespace = conf.PodNamespace
+	}
+	return &buildCluster{client: client, namespace: namespace, remote: true}, nil
+}
+
+// checkRemoteBuild returns an error if a build with stackName can't run in a dedicated build
+// cluster: container builds push their image to the registry, which the build cluster can only
+// reach if it's off-cluster.
+func checkRemoteBuild(conf *Config, stackName string) error {
+	if stackName == "container" && conf.RegistryLocation == "on-cluster" {
+		return fmt.Errorf("container builds can't run in the build cluster, which can't reach the on-cluster registry")
+	}
+	return nil
+}
+
+// syncSecret copies the secret name from the builder's namespace in from to the build cluster, for
+// builder pods to mount it there. A copy that already exists is updated.
+func syncSecret(from, to typedcorev1.SecretInterface, name string) error {
+	secret, err := from.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading secret %s (%s)", name, err)
+	}
+	cp := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secret.Name, Labels: secret.Labels},
+		Type:       secret.Type,
+		Data:       secret.Data,
+	}
+	_, err = to.Create(context.TODO(), cp, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = to.Update(context.TODO(), cp, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("copying secret %s to the build cluster (%s)", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestNewBuildCluster(t *testing.T) {
+	cluster, err := newBuildCluster(&Config{PodNamespace: "drycc"}, nil)
+	assert.NoErr(t, err)
+	assert.False(t, cluster.remote, "remote without a kubeconfig")
+	assert.Equal(t, cluster.namespace, "drycc", "namespace")
+
+	_, err = newBuildCluster(&Config{PodNamespace: "drycc", BuildClusterKubeconfig: "/does/not/exist"}, nil)
+	assert.True(t, err != nil, "connected with a missing kubeconfig")
+}
+
+func TestCheckRemoteBuild(t *testing.T) {
+	assert.NoErr(t, checkRemoteBuild(&Config{RegistryLocation: "on-cluster"}, "heroku-20"))
+	assert.NoErr(t, checkRemoteBuild(&Config{RegistryLocation: "off-cluster"}, "container"))
+	err := checkRemoteBuild(&Config{RegistryLocation: "on-cluster"}, "container")
+	assert.Err(t, err, errors.New("container builds can't run in the build cluster, which can't reach the on-cluster registry"))
+}
+
+func TestSyncSecret(t *testing.T) {
+	from := &k8s.FakeSecret{
+		FnGet: func(name string) (*corev1.Secret, error) {
+			return &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "drycc", ResourceVersion: "42"},
+				Data:       map[string][]byte{"accesskey": []byte("key")},
+			}, nil
+		},
+	}
+	var created, updated *corev1.Secret
+	to := &k8s.FakeSecret{
+		FnCreate: func(secret *corev1.Secret) (*corev1.Secret, error) {
+			created = secret
+			return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, secret.Name)
+		},
+		FnUpdate: func(secret *corev1.Secret) (*corev1.Secret, error) {
+			updated = secret
+			return secret, nil
+		},
+	}
+	assert.NoErr(t, syncSecret(from, to, objectStore))
+	assert.Equal(t, created.Name, objectStore, "name of the copy")
+	assert.Equal(t, created.ResourceVersion, "", "resource version of the copy")
+	assert.Equal(t, string(updated.Data["accesskey"]), "key", "data of the updated copy")
+
+	to.FnCreate = func(secret *corev1.Secret) (*corev1.Secret, error) {
+		return nil, errors.New("forbidden")
+	}
+	err := syncSecret(from, to, objectStore)
+	assert.Err(t, err, errors.New("copying secret objectstorage-keyfile to the build cluster (forbidden)"))
+}
@@ -0,0 +1,41 @@
+package gitreceive
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// shaPushOption builds an older commit of the pushed ref instead of its tip, e.g.
+// "-o sha=1a2b3c4d" to redeploy a known-good revision.
+const shaPushOption = "sha"
+
+// buildCommit returns the full SHA of the commit to build for the push of newRev to the repo at
+// repoDir: the commit given with the sha push option, which must be reachable from newRev, or else
+// newRev itself.
+func buildCommit(repoDir, newRev string, pushOpts PushOptions) (string, error) {
+	sha, ok := pushOpts.Get(shaPushOption)
+	if !ok {
+		return newRev, nil
+	}
+	if sha == "" {
+		return "", fmt.Errorf("the %s push option needs a commit, e.g. -o %s=1a2b3c4d", shaPushOption, shaPushOption)
+	}
+	if newRev == zeroRev {
+		return "", fmt.Errorf("the %s push option can't be used when deleting a ref", shaPushOption)
+	}
+	out, err := repoCmd(repoDir, "git", "rev-parse", "--verify", "--quiet", sha+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s isn't a commit of the repo", sha)
+	}
+	commit := strings.TrimSpace(string(out))
+	// in the pre-receive hook, the pushed commits are readable but refs aren't updated yet, so
+	// reachability is checked from the pushed revision itself
+	err = repoCmd(repoDir, "git", "merge-base", "--is-ancestor", commit, newRev).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", fmt.Errorf("commit %s isn't reachable from the pushed revision %s", sha, newRev)
+	} else if err != nil {
+		return "", fmt.Errorf("checking whether %s is reachable from %s (%s)", sha, newRev, err)
+	}
+	return commit, nil
+}
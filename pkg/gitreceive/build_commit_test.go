@@ -0,0 +1,57 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestBuildCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(home)
+	work := filepath.Join(home, "work")
+	repoDir := filepath.Join(home, "app.git")
+	git := func(args ...string) string {
+		args = append([]string{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	assert.NoErr(t, os.MkdirAll(work, 0755))
+	git("init")
+	git("commit", "--allow-empty", "-m", "first")
+	first := git("rev-parse", "HEAD")
+	git("commit", "--allow-empty", "-m", "second")
+	second := git("rev-parse", "HEAD")
+	git("checkout", "-b", "other", first)
+	git("commit", "--allow-empty", "-m", "other")
+	other := git("rev-parse", "HEAD")
+	out, err := exec.Command("git", "clone", "--bare", work, repoDir).CombinedOutput()
+	assert.True(t, err == nil, string(out))
+
+	commit, err := buildCommit(repoDir, second, PushOptions{})
+	assert.NoErr(t, err)
+	assert.Equal(t, commit, second, "commit without the push option")
+
+	commit, err = buildCommit(repoDir, second, PushOptions{shaPushOption: first[:8]})
+	assert.NoErr(t, err)
+	assert.Equal(t, commit, first, "commit of the push option")
+
+	_, err = buildCommit(repoDir, second, PushOptions{shaPushOption: other[:8]})
+	assert.True(t, err != nil, "commits unreachable from the pushed revision must be rejected")
+	_, err = buildCommit(repoDir, second, PushOptions{shaPushOption: "deadbeef"})
+	assert.True(t, err != nil, "unknown commits must be rejected")
+	_, err = buildCommit(repoDir, second, PushOptions{shaPushOption: ""})
+	assert.True(t, err != nil, "the push option needs a commit")
+	_, err = buildCommit(repoDir, zeroRev, PushOptions{shaPushOption: first})
+	assert.True(t, err != nil, "deleted refs have no commit to build")
+}
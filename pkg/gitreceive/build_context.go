@@ -0,0 +1,68 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// errBuildCanceled is returned by builds that were canceled before they ended.
+var errBuildCanceled = userError(errors.New("the build was canceled"))
+
+// cancelSignals cancel builds: the pusher hanging up closes the output of the hook (SIGPIPE,
+// SIGHUP), and the builder stopping interrupts or terminates it.
+var cancelSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE}
+
+// newBuildContext returns the context of a build, which ends after conf.BuildTimeout, or when the
+// hook gets one of cancelSignals. The returned func must be called once the build ended.
+func newBuildContext(conf *Config) (context.Context, context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, cancelSignals...)
+	ctx, cancel := withCancelSignals(context.Background(), conf.BuildTimeout(), signals)
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// withCancelSignals returns a context derived from parent, which ends after timeout, if it isn't
+// 0, or once a signal is received from signals.
+func withCancelSignals(parent context.Context, timeout time.Duration, signals <-chan os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancelParent := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelParent()
+		}
+	}
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Info("canceling the build (%s)", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// buildContextError returns why ctx, the context of a build, ended in place of err, the error
+// it ended the build with, if it did.
+func buildContextError(ctx context.Context, conf *Config, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return timeoutError(fmt.Errorf("the build took longer than %s and was canceled", conf.BuildTimeout()))
+	case context.Canceled:
+		return errBuildCanceled
+	}
+	return err
+}
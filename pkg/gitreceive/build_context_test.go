@@ -0,0 +1,45 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestWithCancelSignals(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	ctx, cancel := withCancelSignals(context.Background(), 0, signals)
+	defer cancel()
+	assert.NoErr(t, ctx.Err())
+	signals <- syscall.SIGPIPE
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the build wasn't canceled by the signal")
+	}
+	assert.Err(t, ctx.Err(), context.Canceled)
+
+	ctx, cancel = withCancelSignals(context.Background(), 10*time.Millisecond, make(chan os.Signal))
+	defer cancel()
+	<-ctx.Done()
+	assert.Err(t, ctx.Err(), context.DeadlineExceeded)
+}
+
+func TestBuildContextError(t *testing.T) {
+	conf := &Config{BuildTimeoutMSec: 60000}
+	failed := errors.New("creating builder pod (forbidden)")
+	assert.Err(t, buildContextError(context.Background(), conf, failed), failed)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Err(t, buildContextError(canceled, conf, failed), errBuildCanceled)
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	assert.Err(t, buildContextError(expired, conf, failed), timeoutError(errors.New("the build took longer than 1m0s and was canceled")))
+}
@@ -0,0 +1,40 @@
+package gitreceive
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/drycc/builder/pkg/buildcost"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// buildCost adds up the estimated cost of the builder pods of a build, retries and platforms
+// included. A nil *buildCost costs nothing.
+type buildCost struct {
+	prices   *buildcost.Prices
+	now      func() time.Time
+	estimate buildcost.Estimate
+}
+
+// add adds the cost of pod, which ended.
+func (c *buildCost) add(pod *corev1.Pod) {
+	if c == nil || pod == nil {
+		return
+	}
+	c.estimate = c.estimate.Add(c.prices.Pod(pod, c.now()))
+}
+
+// report shows the pusher the cost of the build of app, and records it in the ledger of the git
+// home for the metrics of the builder.
+func (c *buildCost) report(gitHome, app string) {
+	if c == nil || c.estimate.Pods == 0 {
+		return
+	}
+	e := c.estimate
+	duration := time.Duration(e.PodSeconds) * time.Second
+	pusherTerminal.info(msgBuildCost, e.Cost, c.prices.Currency, e.CPUCoreSeconds/3600, e.MemoryGiBSeconds/3600, duration)
+	if err := buildcost.Record(filepath.Join(gitHome, buildcost.LedgerFile), app, c.prices.Currency, e); err != nil {
+		log.Info("unable to record the cost of the build (%s)", err)
+	}
+}
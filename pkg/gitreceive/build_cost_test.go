@@ -0,0 +1,53 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/buildcost"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildCost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-cost")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	start := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("2Gi")},
+		}}}},
+		Status: corev1.PodStatus{
+			StartTime: &metav1.Time{Time: start},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{FinishedAt: metav1.Time{Time: start.Add(10 * time.Minute)}}}},
+			},
+		},
+	}
+
+	var recorder *buildRecorder
+	recorder.buildCost().add(pod)
+	recorder.buildCost().report(dir, "myapp")
+	totals, err := buildcost.Totals(filepath.Join(dir, buildcost.LedgerFile))
+	assert.NoErr(t, err)
+	assert.Equal(t, len(totals), 0, "totals of builds that aren't costed")
+
+	recorder = &buildRecorder{cost: &buildCost{prices: &buildcost.Prices{Currency: "EUR", CPUCoreHour: 0.06}, now: time.Now}}
+	// the pod of a build that ran out of memory, then its retry
+	recorder.buildCost().add(pod)
+	recorder.buildCost().add(pod)
+	recorder.buildCost().report(dir, "myapp")
+	totals, err = buildcost.Totals(filepath.Join(dir, buildcost.LedgerFile))
+	assert.NoErr(t, err)
+	assert.Equal(t, len(totals), 1, "totals")
+	assert.Equal(t, totals[0].Builds, 1, "builds")
+	assert.Equal(t, totals[0].Pods, 2, "pods")
+	assert.Equal(t, totals[0].PodSeconds, 1200.0, "pod seconds")
+	assert.True(t, totals[0].Cost > 0.0199 && totals[0].Cost < 0.0201, "cost")
+}
@@ -0,0 +1,188 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// debugOnFailurePushOption keeps a failed build around for debugging. It takes an optional
+	// TTL, e.g. "-o debug-on-failure=1h".
+	debugOnFailurePushOption = "debug-on-failure"
+	// buildDebugTTLKey is the app config key that keeps every failed build of the app around for
+	// debugging, for the TTL it's set to.
+	buildDebugTTLKey = "DRYCC_BUILD_DEBUG_TTL"
+	// debugPodLabel marks the pods failed builds are kept in, for them to be deleted once they
+	// expired.
+	debugPodLabel = "builder.drycc.cc/debug-pod"
+)
+
+// podCreator is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).PodInterface needed
+// to keep a failed build around.
+type podCreator interface {
+	Create(ctx context.Context, pod *corev1.Pod, opts metav1.CreateOptions) (*corev1.Pod, error)
+}
+
+// secretCreator is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).SecretInterface
+// needed to keep a failed build around.
+type secretCreator interface {
+	Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error)
+}
+
+// buildDebugTTL returns how long a failed build should be kept for debugging, or 0 if it
+// shouldn't be. The push option takes precedence over the app config, TTLs that aren't given
+// default to the configured one and none is longer than the configured maximum.
+func buildDebugTTL(conf *Config, pushOpts PushOptions, appConf dryccAPI.Config) (time.Duration, error) {
+	raw, ok := pushOpts.Get(debugOnFailurePushOption)
+	if !ok {
+		if raw = configString(appConf, buildDebugTTLKey); raw == "" {
+			return 0, nil
+		}
+	}
+	ttl := conf.DebugPodTTL()
+	if b, err := strconv.ParseBool(raw); err == nil && !b {
+		return 0, nil
+	} else if err != nil && raw != "" {
+		if ttl, err = time.ParseDuration(raw); err != nil {
+			return 0, fmt.Errorf("invalid debug TTL %q, use a duration such as 30m (%s)", raw, err)
+		}
+	}
+	if ttl <= 0 {
+		return 0, nil
+	}
+	if max := conf.DebugPodMaxTTL(); ttl > max {
+		log.Info("A failed build can be kept for %s at most", max)
+		ttl = max
+	}
+	return ttl, nil
+}
+
+// debugPodName returns the name of the pod a failed build of the builder pod podName is kept in.
+// It's as long as podName, which is already short enough for a label value.
+func debugPodName(podName string) string {
+	return strings.Replace(podName, "build-", "debug-", 1)
+}
+
+// newDebugPod returns a copy of the failed builder pod that idles instead of building, and stops
+// after ttl. The app env secret envSecretName is replaced with the secret named after the copy.
+func newDebugPod(pod *corev1.Pod, envSecretName string, ttl time.Duration) *corev1.Pod {
+	debug := pod.DeepCopy()
+	debug.ObjectMeta = metav1.ObjectMeta{
+		Name:      debugPodName(pod.Name),
+		Namespace: pod.Namespace,
+		Labels:    map[string]string{"heritage": debugPodName(pod.Name), debugPodLabel: "true"},
+	}
+	debug.Status = corev1.PodStatus{}
+	seconds := int64(ttl / time.Second)
+	debug.Spec.ActiveDeadlineSeconds = &seconds
+	// the caches were already cleared for the build
+	debug.Spec.InitContainers = nil
+	for i := range debug.Spec.Containers {
+		debug.Spec.Containers[i].Command = []string{"sleep", strconv.FormatInt(seconds, 10)}
+		debug.Spec.Containers[i].Args = nil
+	}
+	for i, vol := range debug.Spec.Volumes {
+		if envSecretName != "" && vol.Secret != nil && vol.Secret.SecretName == envSecretName {
+			debug.Spec.Volumes[i].Secret.SecretName = debug.Name
+		}
+	}
+	return debug
+}
+
+// keepFailedBuild starts a copy of the failed builder pod, with the same image, environment and
+// mounts, that operators with access to the namespace of the builder pods can exec into until ttl
+// runs out. Slug builds get a copy of the app env secret, which is deleted along with the copy of
+// the pod, by the cleaner once it expired.
+func keepFailedBuild(
+	pods podCreator,
+	secrets secretCreator,
+	pod *corev1.Pod,
+	envSecretName string,
+	env map[string]interface{},
+	ttl time.Duration) error {
+
+	debug, err := pods.Create(context.TODO(), newDebugPod(pod, envSecretName, ttl), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("creating debug pod (%s)", err)
+	}
+	if envSecretName != "" {
+		secret := appEnvConfigSecret(debug.Name, env)
+		secret.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "v1", Kind: "Pod", Name: debug.Name, UID: debug.UID},
+		}
+		if _, err := secrets.Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating secret %s of the debug pod (%s)", debug.Name, err)
+		}
+	}
+	log.Info("The failed build is kept in pod %s for %s. To debug it, someone with access to the %s namespace of the builder pods, usually an operator of the cluster, runs:", debug.Name, ttl, debug.Namespace)
+	log.Info("    kubectl exec -it -n %s %s -- /bin/bash", debug.Namespace, debug.Name)
+	log.Info("The pod has the environment and storage credentials of the build, the pushed code is at %s.", podEnv(debug, tarPath))
+	log.Info("Delete it once you're done with `kubectl delete pod -n %s %s`.", debug.Namespace, debug.Name)
+	return nil
+}
+
+// DeleteExpiredDebugPods deletes the pods failed builds were kept in, in the build cluster of conf,
+// once they stopped or their TTL ran out at now, along with the copies of the app env secrets
+// they mount. local is the cluster of the builder.
+func DeleteExpiredDebugPods(conf *Config, local kubernetes.Interface, now time.Time) error {
+	cluster, err := newBuildCluster(conf, local)
+	if err != nil {
+		return err
+	}
+	pods := cluster.client.CoreV1().Pods(cluster.namespace)
+	list, err := pods.List(context.TODO(), metav1.ListOptions{LabelSelector: debugPodLabel + "=true"})
+	if err != nil {
+		return fmt.Errorf("listing debug pods (%s)", err)
+	}
+	for _, pod := range list.Items {
+		if !debugPodExpired(&pod, now) {
+			continue
+		}
+		log.Info("Deleting expired debug pod %s", pod.Name)
+		if err := pods.Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Err("Error deleting debug pod %s (%s)", pod.Name, err)
+			continue
+		}
+		// the secret is owned by the pod, but the garbage collector may take a while
+		err := cluster.client.CoreV1().Secrets(cluster.namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Err("Error deleting the secret of debug pod %s (%s)", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// debugPodExpired returns true if the debug pod stopped, or its TTL, its active deadline, ran out
+// at now.
+func debugPodExpired(pod *corev1.Pod, now time.Time) bool {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return true
+	}
+	if pod.Spec.ActiveDeadlineSeconds == nil {
+		return false
+	}
+	return now.Sub(pod.CreationTimestamp.Time) > time.Duration(*pod.Spec.ActiveDeadlineSeconds)*time.Second
+}
+
+// podEnv returns the value of the env var key of the first container of pod.
+func podEnv(pod *corev1.Pod, key string) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	for _, env := range pod.Spec.Containers[0].Env {
+		if env.Name == key {
+			return env.Value
+		}
+	}
+	return ""
+}
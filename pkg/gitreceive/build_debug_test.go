@@ -0,0 +1,124 @@
+package gitreceive
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakePodCreator struct {
+	created []*corev1.Pod
+}
+
+func (f *fakePodCreator) Create(ctx context.Context, pod *corev1.Pod, opts metav1.CreateOptions) (*corev1.Pod, error) {
+	created := pod.DeepCopy()
+	created.UID = types.UID("1234")
+	f.created = append(f.created, created)
+	return created, nil
+}
+
+type fakeSecretCreator struct {
+	created []*corev1.Secret
+}
+
+func (f *fakeSecretCreator) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
+	f.created = append(f.created, secret)
+	return secret, nil
+}
+
+func TestBuildDebugTTL(t *testing.T) {
+	conf := &Config{DebugPodTTLMSec: 1800000, DebugPodMaxTTLMSec: 7200000}
+	cases := []struct {
+		opts     PushOptions
+		config   map[string]interface{}
+		expected time.Duration
+	}{
+		{PushOptions{}, nil, 0},
+		{PushOptions{debugOnFailurePushOption: ""}, nil, 30 * time.Minute},
+		{PushOptions{debugOnFailurePushOption: "true"}, nil, 30 * time.Minute},
+		{PushOptions{debugOnFailurePushOption: "false"}, map[string]interface{}{buildDebugTTLKey: "1h"}, 0},
+		{PushOptions{debugOnFailurePushOption: "10m"}, nil, 10 * time.Minute},
+		{PushOptions{debugOnFailurePushOption: "10h"}, nil, 2 * time.Hour},
+		{PushOptions{}, map[string]interface{}{buildDebugTTLKey: "1h"}, time.Hour},
+	}
+	for _, c := range cases {
+		ttl, err := buildDebugTTL(conf, c.opts, dryccAPI.Config{Values: c.config})
+		assert.NoErr(t, err)
+		assert.Equal(t, ttl, c.expected, "TTL")
+	}
+	_, err := buildDebugTTL(conf, PushOptions{debugOnFailurePushOption: "soon"}, dryccAPI.Config{})
+	assert.True(t, err != nil, "parsed an invalid TTL")
+}
+
+func TestKeepFailedBuild(t *testing.T) {
+	env := map[string]interface{}{"FOO": "bar"}
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.SlugBuilderPod(SlugBuilderOptions{PodOptions: PodOptions{Name: "slugbuild-app-12345678-abcdefgh", Image: "drycc/slugbuilder", PullPolicy: corev1.PullAlways, Env: env, TarKey: "tar", ShortSha: "12345678"}, EnvSecretName: "app-build-env", PutKey: "put", CacheKey: "cache"})
+	pods := &fakePodCreator{}
+	secrets := &fakeSecretCreator{}
+	assert.NoErr(t, keepFailedBuild(pods, secrets, pod, "app-build-env", env, 10*time.Minute))
+
+	assert.Equal(t, len(pods.created), 1, "number of pods created")
+	debug := pods.created[0]
+	assert.Equal(t, debug.Name, "slugdebug-app-12345678-abcdefgh", "pod name")
+	assert.Equal(t, debug.Labels["heritage"], debug.Name, "heritage label")
+	assert.Equal(t, debug.Labels[debugPodLabel], "true", "debug pod label")
+	assert.Equal(t, *debug.Spec.ActiveDeadlineSeconds, int64(600), "active deadline")
+	assert.Equal(t, debug.Spec.Containers[0].Command, []string{"sleep", "600"}, "command")
+	assert.Equal(t, debug.Spec.Containers[0].Image, "drycc/slugbuilder", "image")
+	assert.Equal(t, podEnv(debug, tarPath), "tar", "tar path")
+	for _, vol := range debug.Spec.Volumes {
+		if vol.Name == "app-build-env" {
+			assert.Equal(t, vol.Secret.SecretName, debug.Name, "env secret")
+		}
+	}
+	assert.Equal(t, pod.Spec.Containers[0].Command == nil, true, "builder pod was modified")
+
+	assert.Equal(t, len(secrets.created), 1, "number of secrets created")
+	assert.Equal(t, secrets.created[0].Name, debug.Name, "secret name")
+	assert.Equal(t, string(secrets.created[0].Data["FOO"]), "bar", "secret data")
+	assert.Equal(t, secrets.created[0].OwnerReferences[0].UID, types.UID("1234"), "secret owner")
+}
+
+func TestDeleteExpiredDebugPods(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	seconds := int64(600)
+	debugPod := func(name string, created time.Time, phase corev1.PodPhase) runtime.Object {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "drycc", Labels: map[string]string{debugPodLabel: "true"}, CreationTimestamp: metav1.NewTime(created)},
+			Spec:       corev1.PodSpec{ActiveDeadlineSeconds: &seconds},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+	secret := func(name string) runtime.Object {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "drycc"}}
+	}
+	client := fake.NewSimpleClientset(
+		debugPod("slugdebug-running", now.Add(-time.Minute), corev1.PodRunning), secret("slugdebug-running"),
+		debugPod("slugdebug-failed", now.Add(-time.Minute), corev1.PodFailed), secret("slugdebug-failed"),
+		debugPod("slugdebug-expired", now.Add(-time.Hour), corev1.PodRunning),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "slugbuild-app", Namespace: "drycc", CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))}},
+	)
+	assert.NoErr(t, DeleteExpiredDebugPods(&Config{PodNamespace: "drycc"}, client, now))
+
+	pods, err := client.CoreV1().Pods("drycc").List(context.TODO(), metav1.ListOptions{})
+	assert.NoErr(t, err)
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, names, []string{"slugbuild-app", "slugdebug-running"}, "pods left")
+	secrets, err := client.CoreV1().Secrets("drycc").List(context.TODO(), metav1.ListOptions{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(secrets.Items), 1, "secrets left")
+	assert.Equal(t, secrets.Items[0].Name, "slugdebug-running", "secret left")
+}
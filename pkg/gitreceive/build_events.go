@@ -0,0 +1,276 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The phases a build goes through. Each one is recorded as the reason of a Kubernetes Event and,
+// if build resources are enabled, as the phase of the build's Build resource.
+const (
+	buildPhaseStarted  = "Started"
+	buildPhaseBuilding = "Building"
+	buildPhaseBuilt    = "Built"
+	buildPhaseReleased = "Released"
+	buildPhaseDeferred = "Deferred"
+	buildPhaseFailed   = "Failed"
+	buildPhaseQueued   = "Queued"
+)
+
+const eventSourceComponent = "drycc-builder"
+
+// BuildResource is the group, version and resource of the Build custom resource definition
+// installed by the chart.
+var BuildResource = schema.GroupVersionResource{Group: "builder.drycc.cc", Version: "v1alpha1", Resource: "builds"}
+
+// eventCreator is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).EventInterface the
+// build recorder needs.
+type eventCreator interface {
+	Create(ctx context.Context, event *corev1.Event, opts metav1.CreateOptions) (*corev1.Event, error)
+}
+
+// buildResourceClient is the subset of a (k8s.io/client-go/dynamic).ResourceInterface the build
+// recorder needs.
+type buildResourceClient interface {
+	Create(ctx context.Context, obj *unstructured.Unstructured, opts metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error)
+}
+
+// buildRecorder records the phase transitions of a single build so that they can be observed with
+// kubectl. Recording is best effort: failures are logged and never fail the build. A nil
+// *buildRecorder records nothing.
+type buildRecorder struct {
+	events    eventCreator
+	builds    buildResourceClient
+	namespace string
+	podName   string
+	app       string
+	sha       string
+	username  string
+	// refName is the ref whose push started the build, "" if it's unknown.
+	refName string
+	// object is the object events are attached to: the Build resource once it exists, otherwise
+	// the builder pod.
+	object *corev1.ObjectReference
+	// audit is the audit record of the push, which follows the phases and warnings of the build.
+	audit *auditEntry
+	// summary is the summary of the build, which follows its phases too, if it's set.
+	summary *buildSummary
+	// notifier is told about the phases and warnings of the build too, if it's set.
+	notifier Notifier
+	// cost estimates the cost of the builder pods of the build, if it's set.
+	cost *buildCost
+	// stats records the build in the history of its app, if it's set.
+	stats *buildStats
+	// logs stores the end of the logs of builder pods that were cut off, if it's set.
+	logs storage.ObjectPutter
+}
+
+// newBuildRecorder returns a recorder for the build of sha. builds may be nil, in which case no
+// Build resource is maintained.
+func newBuildRecorder(conf *Config, events eventCreator, builds buildResourceClient, sha string) *buildRecorder {
+	r := &buildRecorder{
+		events:    events,
+		builds:    builds,
+		namespace: conf.PodNamespace,
+		podName:   conf.PodName,
+		app:       conf.App(),
+		sha:       sha,
+		username:  conf.Username,
+	}
+	if r.podName != "" {
+		r.object = &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: r.namespace, Name: r.podName}
+	}
+	return r
+}
+
+// buildResourceName returns the name of the Build resource of the given app and commit.
+func buildResourceName(app, sha string) string {
+	return fmt.Sprintf("%s-%s", app, sha)
+}
+
+// record records that the build entered phase, with a human readable message.
+func (r *buildRecorder) record(phase, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	r.audit.phase(phase, message)
+	r.summary.phase(phase, message, time.Now())
+	if r.notifier != nil {
+		r.notifier.Phase(r.app, r.sha, phase, message)
+	}
+	if r.builds != nil {
+		if err := r.updateBuild(phase, message); err != nil {
+			log.Debug("unable to update the build resource of %s (%s)", r.app, err)
+		}
+	}
+	eventType := corev1.EventTypeNormal
+	if phase == buildPhaseFailed {
+		eventType = corev1.EventTypeWarning
+	}
+	r.event(eventType, phase, message)
+}
+
+// warn records a warning about the build that doesn't change its phase.
+func (r *buildRecorder) warn(reason, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	r.audit.decide(message)
+	if r.notifier != nil {
+		r.notifier.Warning(r.app, r.sha, reason, message)
+	}
+	r.event(corev1.EventTypeWarning, reason, message)
+}
+
+// ref returns the ref whose push started the build, or "" if it's unknown.
+func (r *buildRecorder) ref() string {
+	if r == nil {
+		return ""
+	}
+	return r.refName
+}
+
+// buildSummary returns the summary of the build, nil if it isn't summarized.
+func (r *buildRecorder) buildSummary() *buildSummary {
+	if r == nil {
+		return nil
+	}
+	return r.summary
+}
+
+// buildCost returns the cost estimate of the build, nil if it isn't costed.
+func (r *buildRecorder) buildCost() *buildCost {
+	if r == nil {
+		return nil
+	}
+	return r.cost
+}
+
+// buildStats returns the record of the build in the history of its app, nil if it isn't
+// recorded.
+func (r *buildRecorder) buildStats() *buildStats {
+	if r == nil {
+		return nil
+	}
+	return r.stats
+}
+
+// logStorage returns where the end of the logs of builder pods that were cut off are stored, nil
+// if they aren't.
+func (r *buildRecorder) logStorage() storage.ObjectPutter {
+	if r == nil {
+		return nil
+	}
+	return r.logs
+}
+
+// released records that the build was released as version.
+func (r *buildRecorder) released(version int, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	if r.audit != nil {
+		r.audit.Release = version
+	}
+	if r.summary != nil {
+		r.summary.Release = version
+	}
+	r.record(buildPhaseReleased, format, args...)
+}
+
+func (r *buildRecorder) event(eventType, reason, message string) {
+	if r.events == nil || r.object == nil {
+		return
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", r.object.Name, now.UnixNano()),
+			Namespace: r.namespace,
+			Labels:    map[string]string{"app": r.app, "heritage": "drycc"},
+		},
+		InvolvedObject: *r.object,
+		Reason:         reason,
+		Message:        fmt.Sprintf("%s (git-%s): %s", r.app, r.sha, message),
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := r.events.Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		log.Debug("unable to record the %s event of %s (%s)", reason, r.app, err)
+	}
+}
+
+// updateBuild creates the Build resource when the build starts and updates its status afterwards.
+func (r *buildRecorder) updateBuild(phase, message string) error {
+	name := buildResourceName(r.app, r.sha)
+	status := map[string]interface{}{
+		"phase":   phase,
+		"message": message,
+		"updated": time.Now().UTC().Format(time.RFC3339),
+	}
+	if phase == buildPhaseStarted {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": BuildResource.GroupVersion().String(),
+			"kind":       "Build",
+			"metadata": map[string]interface{}{
+				"name":   name,
+				"labels": map[string]interface{}{"app": r.app, "heritage": "drycc"},
+			},
+			"spec": map[string]interface{}{
+				"app":      r.app,
+				"sha":      r.sha,
+				"username": r.username,
+			},
+			"status": status,
+		}}
+		created, err := r.builds.Create(context.Background(), obj, metav1.CreateOptions{})
+		if err == nil {
+			r.setObject(created)
+			return nil
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		// the same commit was pushed again, so start over with the existing resource
+	}
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	patched, err := r.builds.Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	r.setObject(patched)
+	return nil
+}
+
+func (r *buildRecorder) setObject(obj *unstructured.Unstructured) {
+	if obj == nil {
+		return
+	}
+	r.object = &corev1.ObjectReference{
+		Kind:       "Build",
+		APIVersion: BuildResource.GroupVersion().String(),
+		Namespace:  r.namespace,
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+	}
+}
@@ -0,0 +1,100 @@
+package gitreceive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fakeEvents struct {
+	events []*corev1.Event
+}
+
+func (f *fakeEvents) Create(ctx context.Context, event *corev1.Event, opts metav1.CreateOptions) (*corev1.Event, error) {
+	f.events = append(f.events, event)
+	return event, nil
+}
+
+type fakeBuilds struct {
+	exists  bool
+	created []*unstructured.Unstructured
+	patches []string
+}
+
+func (f *fakeBuilds) Create(ctx context.Context, obj *unstructured.Unstructured, opts metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if f.exists {
+		return nil, apierrors.NewAlreadyExists(BuildResource.GroupResource(), obj.GetName())
+	}
+	f.created = append(f.created, obj)
+	return obj, nil
+}
+
+func (f *fakeBuilds) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	f.patches = append(f.patches, string(data))
+	obj := &unstructured.Unstructured{}
+	obj.SetName(name)
+	return obj, nil
+}
+
+func TestBuildRecorderEvents(t *testing.T) {
+	events := &fakeEvents{}
+	conf := &Config{Repository: "myapp.git", PodNamespace: "drycc", PodName: "drycc-builder-abc", Username: "me"}
+	r := newBuildRecorder(conf, events, nil, "12345678")
+	r.record(buildPhaseStarted, "me pushed %s", "refs/heads/master")
+	r.record(buildPhaseFailed, "boom")
+
+	assert.Equal(t, len(events.events), 2, "number of events")
+	started := events.events[0]
+	assert.Equal(t, started.Reason, buildPhaseStarted, "reason")
+	assert.Equal(t, started.Type, corev1.EventTypeNormal, "type")
+	assert.Equal(t, started.InvolvedObject.Name, "drycc-builder-abc", "involved object")
+	assert.Equal(t, started.Message, "myapp (git-12345678): me pushed refs/heads/master", "message")
+	assert.Equal(t, events.events[1].Type, corev1.EventTypeWarning, "failure type")
+}
+
+func TestBuildRecorderResources(t *testing.T) {
+	events := &fakeEvents{}
+	builds := &fakeBuilds{}
+	conf := &Config{Repository: "myapp", PodNamespace: "drycc", Username: "me"}
+	r := newBuildRecorder(conf, events, builds, "12345678")
+	r.record(buildPhaseStarted, "started")
+	r.record(buildPhaseReleased, "released v%d", 2)
+
+	assert.Equal(t, len(builds.created), 1, "number of created builds")
+	assert.Equal(t, builds.created[0].GetName(), "myapp-12345678", "build name")
+	assert.Equal(t, len(builds.patches), 1, "number of patches")
+	// without a pod name, events are attached to the build resource
+	assert.Equal(t, len(events.events), 2, "number of events")
+	assert.Equal(t, events.events[0].InvolvedObject.Kind, "Build", "involved object kind")
+
+	builds = &fakeBuilds{exists: true}
+	r = newBuildRecorder(conf, nil, builds, "12345678")
+	r.record(buildPhaseStarted, "started")
+	assert.Equal(t, len(builds.patches), 1, "existing builds are patched")
+}
+
+func TestBuildRecorderWarn(t *testing.T) {
+	events := &fakeEvents{}
+	builds := &fakeBuilds{}
+	conf := &Config{Repository: "myapp", PodNamespace: "drycc", PodName: "drycc-builder-abc", Username: "me"}
+	r := newBuildRecorder(conf, events, builds, "12345678")
+	r.warn(envFilteredReason, "config keys kept from the build: %s", "AWS_SECRET_ACCESS_KEY")
+
+	assert.Equal(t, len(events.events), 1, "number of events")
+	assert.Equal(t, events.events[0].Reason, envFilteredReason, "reason")
+	assert.Equal(t, events.events[0].Type, corev1.EventTypeWarning, "type")
+	// warnings don't change the phase of the build
+	assert.Equal(t, len(builds.created)+len(builds.patches), 0, "build resource updates")
+}
+
+func TestNilBuildRecorder(t *testing.T) {
+	var r *buildRecorder
+	r.record(buildPhaseStarted, "started")
+	r.warn(envFilteredReason, "filtered")
+}
@@ -0,0 +1,114 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// exitCodeKilled is the exit code of a process killed with SIGKILL, usually by the OOM killer.
+const exitCodeKilled = 137
+
+const (
+	reasonOOMKilled = "OOMKilled"
+	reasonEvicted   = "Evicted"
+)
+
+// The messages builds failed for a known cause are reported with.
+const (
+	msgDetectFailed = "no buildpack could detect the app's language, add a file the buildpack recognizes or set BUILDPACK_URL with `drycc config:set`"
+	msgPushDenied   = "the registry denied the push of the image, check the credentials and permissions of the registry"
+	msgDiskFull     = "the builder ran out of disk space, disable the build cache with `drycc config:set DRYCC_DISABLE_CACHE=1` or make the app smaller"
+	msgKilled       = "the builder was killed, usually because it ran out of memory, raise its limit with `drycc config:set " + buildMemoryKey + "=<quantity>`"
+)
+
+// failureCause is a known cause of builder failures, recognized by any of the lowercase patterns
+// in the termination message of the builder.
+type failureCause struct {
+	patterns []string
+	msg      string
+}
+
+// failureCauses are the causes builders that wrote a termination message are checked against, in
+// order.
+var failureCauses = []failureCause{
+	{[]string{"no space left on device"}, msgDiskFull},
+	{[]string{"unable to select a buildpack", "no buildpack"}, msgDetectFailed},
+	{[]string{"denied: ", "unauthorized: "}, msgPushDenied},
+}
+
+// buildPodError returns the error a finished builder pod failed with, or nil if it succeeded. The
+// error tells the user what to do about known failures, and includes the termination message of
+// the builder.
+func buildPodError(pod *corev1.Pod) error {
+	if pod.Status.Reason == reasonEvicted {
+		msg := fmt.Sprintf("the builder was evicted (%s)", pod.Status.Message)
+		if strings.Contains(pod.Status.Message, string(corev1.ResourceEphemeralStorage)) {
+			msg = fmt.Sprintf("%s; %s", msgDiskFull, pod.Status.Message)
+		}
+		return fmt.Errorf("build failed: %s", msg)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		state := status.State.Terminated
+		if state == nil {
+			if pod.Status.Phase == corev1.PodFailed {
+				return fmt.Errorf("build failed: builder container %s didn't run (%s)", status.Name, pod.Status.Message)
+			}
+			continue
+		}
+		if state.ExitCode == 0 {
+			continue
+		}
+		return userError(fmt.Errorf("build failed: %s", exitMessage(state)))
+	}
+	return nil
+}
+
+// exitMessage returns the message a builder that terminated in state is reported with, after its
+// cause: the reason it terminated for, or its termination message.
+func exitMessage(state *corev1.ContainerStateTerminated) string {
+	termMsg := strings.TrimSpace(state.Message)
+	msg := ""
+	switch {
+	case state.Reason == reasonOOMKilled:
+		msg = fmt.Sprintf("the builder ran out of memory, raise its limit with `drycc config:set %s=<quantity>`", buildMemoryKey)
+	case state.ExitCode == exitCodeKilled:
+		msg = msgKilled
+	default:
+		msg = failureCauseOf(termMsg)
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("build pod exited with code %d", state.ExitCode)
+	} else {
+		msg = fmt.Sprintf("%s (exit code %d)", msg, state.ExitCode)
+	}
+	if termMsg != "" {
+		msg = fmt.Sprintf("%s: %s", msg, termMsg)
+	}
+	return msg
+}
+
+// failureCauseOf returns the message of the known cause of failure termMsg tells about, "" if
+// there's none.
+func failureCauseOf(termMsg string) string {
+	lower := strings.ToLower(termMsg)
+	for _, cause := range failureCauses {
+		for _, pattern := range cause.patterns {
+			if strings.Contains(lower, pattern) {
+				return cause.msg
+			}
+		}
+	}
+	return ""
+}
+
+// oomKilled returns true if a container of pod was killed for running out of memory.
+func oomKilled(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if state := status.State.Terminated; state != nil && state.Reason == reasonOOMKilled {
+			return true
+		}
+	}
+	return false
+}
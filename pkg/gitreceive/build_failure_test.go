@@ -0,0 +1,50 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func terminatedPod(exitCode int32, reason, message string) *corev1.Pod {
+	return &corev1.Pod{
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name: slugBuilderName,
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode, Reason: reason, Message: message},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestBuildPodError(t *testing.T) {
+	pod := terminatedPod(0, "Completed", "")
+	pod.Status.Phase = corev1.PodSucceeded
+	assert.NoErr(t, buildPodError(pod))
+
+	cases := map[*corev1.Pod]string{
+		terminatedPod(1, "Error", ""):           "build failed: build pod exited with code 1",
+		terminatedPod(137, reasonOOMKilled, ""): "build failed: the builder ran out of memory, raise its limit with `drycc config:set DRYCC_BUILD_MEMORY=<quantity>` (exit code 137)",
+		terminatedPod(137, "Error", ""):         "build failed: " + msgKilled + " (exit code 137)",
+		terminatedPod(1, "Error", "Unable to select a buildpack\n"): "build failed: " +
+			msgDetectFailed + " (exit code 1): Unable to select a buildpack",
+		terminatedPod(1, "Error", "denied: requested access to the resource is denied"): "build failed: " +
+			msgPushDenied + " (exit code 1): denied: requested access to the resource is denied",
+		terminatedPod(2, "Error", "write /tmp/slug.tgz: no space left on device"): "build failed: " +
+			msgDiskFull + " (exit code 2): write /tmp/slug.tgz: no space left on device",
+		{Status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: reasonEvicted, Message: "The node was low on resource: ephemeral-storage."}}: "build failed: " +
+			msgDiskFull + "; The node was low on resource: ephemeral-storage.",
+		{Status: corev1.PodStatus{Phase: corev1.PodFailed, Message: "image can't be pulled", ContainerStatuses: []corev1.ContainerStatus{{Name: "builder"}}}}: "build failed: builder container builder didn't run (image can't be pulled)",
+	}
+	for pod, expected := range cases {
+		err := buildPodError(pod)
+		assert.True(t, err != nil, "failed pod wasn't an error")
+		assert.Equal(t, err.Error(), expected, "error")
+	}
+}
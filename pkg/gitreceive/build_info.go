@@ -0,0 +1,87 @@
+package gitreceive
+
+import (
+	"strings"
+	"time"
+
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The annotations tracing a release back to its build. They're sent to the controller with the
+// build, for it to set on the pods of the release.
+const (
+	gitShaAnnotation         = "builder.drycc.cc/git-sha"
+	committerAnnotation      = "builder.drycc.cc/committer"
+	buildTimeAnnotation      = "builder.drycc.cc/build-time"
+	builderVersionAnnotation = "builder.drycc.cc/builder-version"
+	stackImageAnnotation     = "builder.drycc.cc/stack-image"
+)
+
+// buildInfo describes how a release was built.
+type buildInfo struct {
+	sha            string
+	committer      string
+	builderVersion string
+	// stackImage is the image, by digest if known, of the stack that built the release. It's
+	// empty for releases that weren't built here.
+	stackImage string
+	// imageDigests are the images of a container build by tag and digest, in every registry it
+	// was pushed to.
+	imageDigests []string
+	// platformDigests are the images of each platform of a multi-platform container build, as
+	// platform=digest pairs.
+	platformDigests []string
+	// analysis counts the results of each analyzer of the static analysis of the source, as
+	// analyzer:errors/warnings/notes.
+	analysis string
+}
+
+// newBuildInfo returns the buildInfo of the build of gitSha in the repo at repoDir.
+func newBuildInfo(conf *Config, repoDir string, gitSha *git.SHA) buildInfo {
+	info := buildInfo{sha: gitSha.Full(), builderVersion: conf.BuilderVersion}
+	out, err := repoCmd(repoDir, "git", "show", "-s", "--format=%cn <%ce>", gitSha.Full()).Output()
+	if err != nil {
+		log.Debug("unable to read the committer of %s (%s)", gitSha.Short(), err)
+	} else {
+		info.committer = strings.TrimSpace(string(out))
+	}
+	return info
+}
+
+// podImage returns the image the first container of pod ran, by digest if the kubelet reported it.
+func podImage(pod *corev1.Pod) string {
+	if len(pod.Status.ContainerStatuses) > 0 {
+		// e.g. docker-pullable://drycc/slugbuilder@sha256:...
+		if id := pod.Status.ContainerStatuses[0].ImageID; strings.Contains(id, "@") {
+			if i := strings.Index(id, "://"); i >= 0 {
+				id = id[i+len("://"):]
+			}
+			return id
+		}
+	}
+	if len(pod.Spec.Containers) > 0 {
+		return pod.Spec.Containers[0].Image
+	}
+	return ""
+}
+
+// annotations returns the annotations of b for a release built at buildTime.
+func (b buildInfo) annotations(buildTime time.Time) map[string]string {
+	annotations := map[string]string{buildTimeAnnotation: buildTime.UTC().Format(time.RFC3339)}
+	for key, value := range map[string]string{
+		gitShaAnnotation:          b.sha,
+		committerAnnotation:       b.committer,
+		builderVersionAnnotation:  b.builderVersion,
+		stackImageAnnotation:      b.stackImage,
+		imageDigestsAnnotation:    strings.Join(b.imageDigests, ","),
+		platformDigestsAnnotation: strings.Join(b.platformDigests, ","),
+		analysisAnnotation:        b.analysis,
+	} {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
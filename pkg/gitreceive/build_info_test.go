@@ -0,0 +1,33 @@
+package gitreceive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPodImage(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Image: "drycc/slugbuilder:canary"}}}}
+	assert.Equal(t, podImage(pod), "drycc/slugbuilder:canary", "image without status")
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{ImageID: "docker-pullable://drycc/slugbuilder@sha256:abc"}}
+	assert.Equal(t, podImage(pod), "drycc/slugbuilder@sha256:abc", "image by digest")
+	pod.Status.ContainerStatuses[0].ImageID = "sha256:abc"
+	assert.Equal(t, podImage(pod), "drycc/slugbuilder:canary", "image without digest")
+}
+
+func TestBuildInfoAnnotations(t *testing.T) {
+	buildTime := time.Date(2020, 8, 13, 3, 57, 13, 0, time.UTC)
+	info := buildInfo{sha: "12345678abcdef", committer: "Jane <jane@example.com>", builderVersion: "v1.2.3"}
+	assert.Equal(t, info.annotations(buildTime), map[string]string{
+		gitShaAnnotation:         "12345678abcdef",
+		committerAnnotation:      "Jane <jane@example.com>",
+		buildTimeAnnotation:      "2020-08-13T03:57:13Z",
+		builderVersionAnnotation: "v1.2.3",
+	}, "annotations")
+	info.stackImage = "drycc/slugbuilder@sha256:abc"
+	assert.Equal(t, info.annotations(buildTime)[stackImageAnnotation], "drycc/slugbuilder@sha256:abc", "stack image")
+	info.imageDigests = []string{"localhost:5555/app:git-12345678@sha256:abc", "ecr.example.com/prod/app:git-12345678@sha256:abc"}
+	assert.Equal(t, info.annotations(buildTime)[imageDigestsAnnotation], "localhost:5555/app:git-12345678@sha256:abc,ecr.example.com/prod/app:git-12345678@sha256:abc", "image digests")
+}
@@ -0,0 +1,174 @@
+package gitreceive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/pkg/log"
+)
+
+// LogTailKeyPattern is the template for the log storage key of the end of the log of a builder
+// pod of an app that was cut off.
+const LogTailKeyPattern = "home/%s/logs/%s.log"
+
+// buildLog streams the log of a builder pod to the pusher within the limits of the config. Lines
+// longer than maxLine are cut. Once maxBytes were streamed, only one line in every sample is
+// shown, with how many were skipped, and the end of the log, the last tail bytes of it, is shown
+// once it's over. A limit of 0 disables it.
+type buildLog struct {
+	out      io.Writer
+	t        *terminal
+	maxLine  int
+	maxBytes int64
+	sample   int
+	tail     *tailBuffer
+
+	// line is the line being written, up to maxLine, with cut the number of bytes cut from it.
+	line []byte
+	cut  int
+	// streamed is the number of bytes shown within maxBytes, past the number of lines beyond it,
+	// and skipped and skippedBytes those of them that weren't sampled.
+	streamed     int64
+	past         int
+	skipped      int
+	skippedBytes int64
+}
+
+// newBuildLog returns the log of a builder pod, streamed to out with the limits of conf.
+func newBuildLog(conf *Config, out io.Writer) *buildLog {
+	return &buildLog{
+		out:      out,
+		t:        pusherTerminal,
+		maxLine:  conf.BuildLogMaxLineLength,
+		maxBytes: conf.BuildLogMaxBytes,
+		sample:   conf.BuildLogSampleLines,
+		tail:     newTailBuffer(conf.BuildLogTailBytes),
+	}
+}
+
+// Write writes p to the log, a line at a time.
+func (l *buildLog) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		end := bytes.IndexByte(rest, '\n')
+		chunk := rest
+		if end >= 0 {
+			chunk, rest = rest[:end], rest[end+1:]
+		} else {
+			rest = nil
+		}
+		if l.maxLine > 0 && len(l.line)+len(chunk) > l.maxLine {
+			keep := l.maxLine - len(l.line)
+			l.line = append(l.line, chunk[:keep]...)
+			l.cut += len(chunk) - keep
+		} else {
+			l.line = append(l.line, chunk...)
+		}
+		if end >= 0 {
+			if err := l.writeLine(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// writeLine shows the current line, unless it's past maxBytes and not sampled, and keeps it in
+// the tail.
+func (l *buildLog) writeLine() error {
+	line := l.line
+	if l.cut > 0 {
+		line = append(line, fmt.Sprintf(" "+l.t.text(msgBuildLogLineCut), formatSize(int64(l.cut)))...)
+	}
+	line = append(line, '\n')
+	l.line, l.cut = l.line[:0], 0
+	l.tail.Write(line)
+
+	if l.maxBytes <= 0 || l.streamed+int64(len(line)) <= l.maxBytes {
+		l.streamed += int64(len(line))
+		_, err := l.out.Write(line)
+		return err
+	}
+	if l.past == 0 {
+		if _, err := fmt.Fprintf(l.out, l.t.text(msgBuildLogLimit)+"\n", formatSize(l.maxBytes), l.sample); err != nil {
+			return err
+		}
+	}
+	l.past++
+	if l.sample > 0 && l.past%l.sample == 0 {
+		if _, err := fmt.Fprintf(l.out, l.t.text(msgBuildLogSkipped)+"\n", l.skipped, formatSize(l.skippedBytes)); err != nil {
+			return err
+		}
+		_, err := l.out.Write(line)
+		return err
+	}
+	l.skipped++
+	l.skippedBytes += int64(len(line))
+	return nil
+}
+
+// finish writes the last line of the log, if it doesn't end with a newline, and shows the end of
+// the log if lines were skipped. It returns true if they were.
+func (l *buildLog) finish() bool {
+	if len(l.line) > 0 || l.cut > 0 {
+		l.writeLine()
+	}
+	if l.skipped == 0 {
+		return false
+	}
+	tail := l.tail.Bytes()
+	fmt.Fprintf(l.out, l.t.text(msgBuildLogTail)+"\n", l.skipped, formatSize(l.skippedBytes), formatSize(int64(len(tail))))
+	l.out.Write(tail)
+	return true
+}
+
+// storeTail stores the end of the log of the builder pod named pod of app in the log storage,
+// for the build to be diagnosed once the pod is gone. Failures are logged, never returned.
+func (l *buildLog) storeTail(putter storage.ObjectPutter, app, pod string) {
+	if putter == nil || len(l.tail.Bytes()) == 0 {
+		return
+	}
+	key := fmt.Sprintf(LogTailKeyPattern, app, pod)
+	if err := putter.PutContent(context.Background(), key, l.tail.Bytes()); err != nil {
+		log.Info("unable to store the end of the build log (%s)", err)
+		return
+	}
+	fmt.Fprintf(l.out, l.t.text(msgBuildLogStored)+"\n", key)
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	if b.size <= 0 {
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	// the buffer is trimmed once it doubled, for writes not to copy it every time, keeping the byte
+	// before the tail to tell whether it starts a line
+	if len(b.buf) > 2*b.size {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.size-1:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns the last size bytes written, from the start of the first whole line among them.
+func (b *tailBuffer) Bytes() []byte {
+	if len(b.buf) <= b.size {
+		return b.buf
+	}
+	tail := b.buf[len(b.buf)-b.size:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 && b.buf[len(b.buf)-b.size-1] != '\n' {
+		tail = tail[i+1:]
+	}
+	return tail
+}
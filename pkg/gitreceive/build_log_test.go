@@ -0,0 +1,76 @@
+package gitreceive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestBuildLogWithinLimits(t *testing.T) {
+	var out bytes.Buffer
+	logs := newBuildLog(&Config{BuildLogMaxLineLength: 12, BuildLogMaxBytes: 1024, BuildLogSampleLines: 10, BuildLogTailBytes: 64}, &out)
+	// lines are cut whatever the writes they're split over
+	for _, chunk := range []string{"step 1\nstep", " 2: a very long line\n", "done"} {
+		n, err := logs.Write([]byte(chunk))
+		assert.NoErr(t, err)
+		assert.Equal(t, n, len(chunk), "written bytes")
+	}
+	assert.False(t, logs.finish(), "lines were skipped")
+	assert.Equal(t, out.String(), "step 1\nstep 2: a ve [12 B cut]\ndone\n", "log")
+}
+
+func TestBuildLogPastLimit(t *testing.T) {
+	var out bytes.Buffer
+	logs := newBuildLog(&Config{BuildLogMaxBytes: 20, BuildLogSampleLines: 3, BuildLogTailBytes: 16}, &out)
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(logs, "line %d\n", i)
+	}
+	assert.True(t, logs.finish(), "no lines were skipped")
+	expected := []string{
+		"line 1",
+		"line 2",
+		"The build log passed 20 B, only one line in 3 is shown from now on, and its end once the build is over",
+		"... 2 lines (14 B) skipped so far",
+		"line 5",
+		"... 4 lines (28 B) skipped so far",
+		"line 8",
+		"6 lines (43 B) of the build log were skipped, here are its last 15 B:",
+		"line 9",
+		"line 10",
+	}
+	assert.Equal(t, strings.Split(strings.TrimSpace(out.String()), "\n"), expected, "log")
+}
+
+func TestBuildLogStoreTail(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+
+	var out bytes.Buffer
+	logs := newBuildLog(&Config{BuildLogMaxBytes: 1, BuildLogTailBytes: 1024}, &out)
+	fmt.Fprint(logs, "error: out of luck\n")
+	assert.True(t, logs.finish(), "no lines were skipped")
+	logs.storeTail(store, "myapp", "slugbuild-myapp-abc123")
+	tail, err := store.GetContent(context.Background(), "home/myapp/logs/slugbuild-myapp-abc123.log")
+	assert.NoErr(t, err)
+	assert.Equal(t, string(tail), "error: out of luck\n", "stored tail")
+	assert.True(t, strings.HasSuffix(out.String(), "The end of the build log is stored as home/myapp/logs/slugbuild-myapp-abc123.log\n"), "the pusher wasn't told where the tail is stored")
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := newTailBuffer(8)
+	assert.Equal(t, string(tail.Bytes()), "", "empty tail")
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		tail.Write([]byte(line))
+	}
+	// the partial line at the start of the last 8 bytes is dropped
+	assert.Equal(t, string(tail.Bytes()), "four\n", "tail")
+	tail.Write([]byte("ab\n"))
+	assert.Equal(t, string(tail.Bytes()), "four\nab\n", "tail")
+}
@@ -0,0 +1,175 @@
+package gitreceive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	builderconf "github.com/drycc/builder/pkg/conf"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+// ManifestKeyPattern is the template for the object storage key of an app's latest build
+// manifest.
+const ManifestKeyPattern = "home/%s/manifest.json"
+
+// configDigestKey returns the key of the digests of config values in build manifests.
+var configDigestKey = builderconf.ReadBuilderKey
+
+// BuildManifest records what was released by a build, so the next build can tell the user what
+// changed. Config values are stored as HMACs keyed by the builder key, so that no secrets end up
+// in object storage, nor digests of them that could be checked against guesses.
+type BuildManifest struct {
+	App          string               `json:"app"`
+	Sha          string               `json:"sha"`
+	Release      int                  `json:"release"`
+	Stack        string               `json:"stack"`
+	Image        string               `json:"image"`
+	ProcessTypes dryccAPI.ProcessType `json:"processTypes"`
+	// ConfigDigests are the digests of the config values of the app, by name, "" if the builder
+	// key couldn't be read.
+	ConfigDigests map[string]string `json:"configDigests"`
+	Created       time.Time         `json:"created"`
+	// Checksum is the digest of the slug or image, only recorded for promoted builds.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func newBuildManifest(app, sha string, release int, stack, image string, procType dryccAPI.ProcessType, config map[string]interface{}) *BuildManifest {
+	m := &BuildManifest{
+		App:           app,
+		Sha:           sha,
+		Release:       release,
+		Stack:         stack,
+		Image:         image,
+		ProcessTypes:  procType,
+		ConfigDigests: make(map[string]string, len(config)),
+		Created:       time.Now().UTC(),
+	}
+	key, err := configDigestKey()
+	if err != nil {
+		log.Debug("unable to read the builder key, changes of config values won't be reported (%s)", err)
+	}
+	for k, v := range config {
+		m.ConfigDigests[k] = configDigest(key, k, v)
+	}
+	return m
+}
+
+// configDigest returns the HMAC of the value v of the config name, keyed by key, or "" without a
+// key. The name is part of it, so that equal values of different names can't be told apart.
+func configDigest(key, name string, v interface{}) string {
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s=%v", name, v)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getBuildManifest returns the manifest of the last build of app, or nil if there is none.
+func getBuildManifest(ctx context.Context, getter storage.ObjectGetter, app string) (*BuildManifest, error) {
+	data, err := getter.GetContent(ctx, fmt.Sprintf(ManifestKeyPattern, app))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := new(BuildManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func putBuildManifest(ctx context.Context, putter storage.ObjectPutter, m *BuildManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return putter.PutContent(ctx, fmt.Sprintf(ManifestKeyPattern, m.App), data)
+}
+
+// diffManifests describes, one line per change, how cur differs from prev.
+func diffManifests(prev, cur *BuildManifest) []string {
+	var lines []string
+	if prev.Stack != cur.Stack {
+		lines = append(lines, fmt.Sprintf("stack changed: %s -> %s", prev.Stack, cur.Stack))
+	}
+	// slug and dockerfile builds get a new image on every push, named after the commit, so only
+	// imported images are worth mentioning
+	if prev.Image != cur.Image && cur.Stack == "container" && !strings.Contains(cur.Image, cur.Sha) {
+		lines = append(lines, fmt.Sprintf("image changed: %s -> %s", prev.Image, cur.Image))
+	}
+	lines = append(lines, diffKeys("process type", stringKeys(prev.ProcessTypes), stringKeys(cur.ProcessTypes), nil)...)
+	changed := func(k string) bool {
+		return prev.ConfigDigests[k] != "" && cur.ConfigDigests[k] != "" && prev.ConfigDigests[k] != cur.ConfigDigests[k]
+	}
+	lines = append(lines, diffKeys("config", stringKeys(prev.ConfigDigests), stringKeys(cur.ConfigDigests), changed)...)
+	return lines
+}
+
+// diffKeys describes the keys added to and removed from prev, as well as those both share that
+// changed reports as changed, if it's not nil.
+func diffKeys(kind string, prev, cur []string, changed func(string) bool) []string {
+	var lines []string
+	prevSet := make(map[string]struct{}, len(prev))
+	for _, k := range prev {
+		prevSet[k] = struct{}{}
+	}
+	curSet := make(map[string]struct{}, len(cur))
+	for _, k := range cur {
+		curSet[k] = struct{}{}
+		if _, ok := prevSet[k]; !ok {
+			lines = append(lines, fmt.Sprintf("+ %s %s", kind, k))
+		} else if changed != nil && changed(k) {
+			lines = append(lines, fmt.Sprintf("~ %s %s", kind, k))
+		}
+	}
+	for _, k := range prev {
+		if _, ok := curSet[k]; !ok {
+			lines = append(lines, fmt.Sprintf("- %s %s", kind, k))
+		}
+	}
+	return lines
+}
+
+func stringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// summarizeRelease prints how the release described by cur differs from the previous one and
+// records cur as the latest manifest. Failures are logged, never returned, since the release has
+// already happened.
+func summarizeRelease(ctx context.Context, driver storagedriver.StorageDriver, cur *BuildManifest) {
+	prev, err := getBuildManifest(ctx, driver, cur.App)
+	if err != nil {
+		log.Debug("unable to read the previous build manifest of %s (%s)", cur.App, err)
+	} else if prev != nil {
+		if lines := diffManifests(prev, cur); len(lines) > 0 {
+			log.Info("Changes since v%d:", prev.Release)
+			for _, line := range lines {
+				log.Info("    %s", line)
+			}
+		} else {
+			log.Info("No process type, config or stack changes since v%d", prev.Release)
+		}
+	}
+	if err := putBuildManifest(ctx, driver, cur); err != nil {
+		log.Debug("unable to store the build manifest of %s (%s)", cur.App, err)
+	}
+}
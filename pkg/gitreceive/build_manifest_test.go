@@ -0,0 +1,87 @@
+package gitreceive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+// withConfigDigestKey makes key the key of config digests until the returned func is called.
+func withConfigDigestKey(key string) func() {
+	orig := configDigestKey
+	configDigestKey = func() (string, error) { return key, nil }
+	return func() { configDigestKey = orig }
+}
+
+func TestDiffManifests(t *testing.T) {
+	defer withConfigDigestKey("builder-key")()
+	prev := newBuildManifest("app", "12345678", 2, "heroku-18", "app:git-12345678",
+		dryccAPI.ProcessType{"web": "./web", "clock": "./clock"},
+		map[string]interface{}{"FOO": "bar", "GONE": "x", "SAME": 1})
+	cur := newBuildManifest("app", "87654321", 3, "heroku-20", "app:git-87654321",
+		dryccAPI.ProcessType{"web": "./web2", "worker": "./worker"},
+		map[string]interface{}{"FOO": "baz", "NEW": "y", "SAME": 1})
+
+	expected := []string{
+		"stack changed: heroku-18 -> heroku-20",
+		"+ process type worker",
+		"- process type clock",
+		"~ config FOO",
+		"+ config NEW",
+		"- config GONE",
+	}
+	assert.Equal(t, diffManifests(prev, cur), expected, "diff")
+	assert.Equal(t, len(diffManifests(cur, cur)), 0, "number of changes against itself")
+
+	// without the builder key, only the names of config values are compared
+	restore := withConfigDigestKey("")
+	keyless := newBuildManifest("app", "87654321", 3, "heroku-20", "app:git-87654321", nil, map[string]interface{}{"FOO": "qux", "NEW": "y", "SAME": 1})
+	restore()
+	for _, line := range diffManifests(cur, keyless) {
+		assert.False(t, line == "~ config FOO", "reported a change of a value without the builder key")
+	}
+
+	prev.Stack, cur.Stack = "container", "container"
+	cur.Image = "quay.io/org/app:v2"
+	assert.Equal(t, diffManifests(prev, cur)[0], "image changed: app:git-12345678 -> quay.io/org/app:v2", "image change")
+
+	cur.Image = "app:main-87654321-20261017120000"
+	for _, line := range diffManifests(prev, cur) {
+		assert.False(t, strings.HasPrefix(line, "image changed"), "mentioned the new image of a build")
+	}
+}
+
+func TestBuildManifestStorage(t *testing.T) {
+	defer withConfigDigestKey("builder-key")()
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	m, err := getBuildManifest(context.Background(), driver, "app")
+	assert.NoErr(t, err)
+	assert.True(t, m == nil, "found a manifest before one was stored")
+
+	cur := newBuildManifest("app", "12345678", 2, "heroku-18", "app:git-12345678", nil, map[string]interface{}{"FOO": "bar"})
+	summarizeRelease(context.Background(), driver, cur)
+	m, err = getBuildManifest(context.Background(), driver, "app")
+	assert.NoErr(t, err)
+	assert.Equal(t, m.Release, 2, "release")
+	assert.Equal(t, m.ConfigDigests, cur.ConfigDigests, "config digests")
+	data := string(mustMarshal(t, m))
+	assert.False(t, strings.Contains(data, "bar"), "config value stored")
+	assert.False(t, strings.Contains(data, fmt.Sprintf("%x", sha256.Sum256([]byte("bar")))), "unkeyed digest of a config value stored")
+	assert.False(t, m.ConfigDigests["FOO"] == configDigest("other-key", "FOO", "bar"), "digest independent of the builder key")
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	assert.NoErr(t, err)
+	return data
+}
@@ -0,0 +1,190 @@
+package gitreceive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/drycc/builder/pkg/registry"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// buildPlatformsKey is the app config key listing the platforms container builds build the
+	// image for, separated by commas, e.g. linux/amd64,linux/arm64.
+	buildPlatformsKey = "DRYCC_BUILD_PLATFORMS"
+	// buildPlatformEnv tells the dockerbuilder the platform it builds for.
+	buildPlatformEnv = "BUILD_PLATFORM"
+	// platformDigestsAnnotation lists the image of each platform of a multi-platform build, as
+	// platform=digest pairs.
+	platformDigestsAnnotation = "builder.drycc.cc/platform-digests"
+
+	archNodeLabel = "kubernetes.io/arch"
+	osNodeLabel   = "kubernetes.io/os"
+)
+
+// buildPlatforms returns the platforms of the DRYCC_BUILD_PLATFORMS of appConf, none if it isn't
+// set.
+func buildPlatforms(appConf dryccAPI.Config) ([]registry.Platform, error) {
+	var platforms []registry.Platform
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(configString(appConf, buildPlatformsKey), ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		p, err := registry.ParsePlatform(s)
+		if err != nil {
+			return nil, userError(fmt.Errorf("invalid %s (%s)", buildPlatformsKey, err))
+		}
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			platforms = append(platforms, p)
+		}
+	}
+	return platforms, nil
+}
+
+// platformTag returns the tag the image built for p is pushed as, tag followed by the
+// architecture and variant of p, e.g. git-abc1234-arm64.
+func platformTag(tag string, p registry.Platform) string {
+	return tag + "-" + p.Architecture + p.Variant
+}
+
+// platformPodName returns the name of a builder pod of appName building shortSha for p.
+func platformPodName(appName, shortSha string, p registry.Platform) string {
+	suffix := "-" + p.Architecture + p.Variant
+	// dockerBuilderPodName truncates app names to 33 characters, the suffix must survive it
+	if max := 33 - len(suffix); len(appName) > max {
+		appName = appName[:max]
+	}
+	return dockerBuilderPodName(appName+suffix, shortSha)
+}
+
+// platformPod returns a copy of pod, the builder pod of appName building shortSha as imageName,
+// building the image for p on a node of p instead.
+func platformPod(pod *corev1.Pod, appName, shortSha, imageName string, p registry.Platform) *corev1.Pod {
+	platform := renamedPod(pod, platformPodName(appName, shortSha, p))
+	if platform.Spec.NodeSelector == nil {
+		platform.Spec.NodeSelector = make(map[string]string)
+	}
+	platform.Spec.NodeSelector[osNodeLabel] = p.OS
+	platform.Spec.NodeSelector[archNodeLabel] = p.Architecture
+	name, tag := splitImageName(imageName)
+	env := platform.Spec.Containers[0].Env
+	for i := range env {
+		if env[i].Name == "IMG_NAME" {
+			env[i].Value = name + ":" + platformTag(tag, p)
+		}
+	}
+	addEnvToPod(*platform, buildPlatformEnv, p.String())
+	return platform
+}
+
+// platformWriter writes the build output of a platform to w, each line prefixed with the
+// platform. Only whole lines are written, under mut, so that the output of builds running at
+// once doesn't interleave.
+type platformWriter struct {
+	mut    *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *platformWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// flush writes the last line, if it doesn't end with a newline.
+func (p *platformWriter) flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *platformWriter) writeLine(line []byte) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	_, err := fmt.Fprintf(p.w, "[%s] %s", p.prefix, line)
+	return err
+}
+
+// runPlatformBuilds runs the builder pods of platforms, pods, all at once with run, which writes
+// the output of the pod of a platform to out. It returns the pods that ran last and the state they
+// ended in, in the order of pods, or the first error.
+func runPlatformBuilds(
+	pods []*corev1.Pod,
+	platforms []registry.Platform,
+	run func(pod *corev1.Pod, p registry.Platform, out io.Writer) (*corev1.Pod, *corev1.Pod, error)) ([]*corev1.Pod, []*corev1.Pod, error) {
+
+	ran := make([]*corev1.Pod, len(pods))
+	ended := make([]*corev1.Pod, len(pods))
+	errs := make([]error, len(pods))
+	mut := new(sync.Mutex)
+	var wg sync.WaitGroup
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out := &platformWriter{mut: mut, w: pusherTerminal.out, prefix: platforms[i].String()}
+			ran[i], ended[i], errs[i] = run(pods[i], platforms[i], out)
+			out.flush()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ran, ended, nil
+}
+
+// pushImageIndex pushes the manifest list of the images built for platforms, as the image of the
+// container build of sha, named image as passed to the controller. It returns the image, whose
+// process types are read from the image of the first platform, and the platform=digest pairs of
+// the images of the list.
+func pushImageIndex(conf *Config, secrets typedcorev1.SecretInterface, image, sha string, platforms []registry.Platform) (*builtImage, []string, error) {
+	ref, err := builtImageReference(conf, image, sha)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, err := newImageClient(conf, secrets, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs := make([]registry.Reference, len(platforms))
+	for i, p := range platforms {
+		refs[i] = *ref
+		refs[i].Tag = platformTag(ref.Tag, p)
+	}
+	var index *registry.Manifest
+	var digest string
+	err = pusherTerminal.during(msgPushingIndex, conf.SessionIdleInterval(), func() (err error) {
+		index, digest, err = images.PutIndex(*ref, platforms, refs)
+		return err
+	}, ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pushing the manifest list of %s (%s)", ref, err)
+	}
+	images.Platform = platforms[0]
+	digests := make([]string, len(index.Manifests))
+	for i, desc := range index.Manifests {
+		digests[i] = fmt.Sprintf("%s=%s", desc.Platform, desc.Digest)
+	}
+	return &builtImage{ref: ref, images: images, digest: digest}, digests, nil
+}
@@ -0,0 +1,72 @@
+package gitreceive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/registry"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestBuildPlatforms(t *testing.T) {
+	platforms, err := buildPlatforms(dryccAPI.Config{Values: map[string]interface{}{buildPlatformsKey: "linux/amd64, linux/arm64,linux/amd64"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, platforms, []registry.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}, "platforms")
+
+	platforms, err = buildPlatforms(dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(platforms), 0, "platforms without the config")
+	_, err = buildPlatforms(dryccAPI.Config{Values: map[string]interface{}{buildPlatformsKey: "arm64"}})
+	assert.True(t, err != nil && KindOf(err) == ErrUser, "invalid platform")
+}
+
+func TestPlatformPod(t *testing.T) {
+	pod := PodSpecBuilder{Namespace: "drycc", NodeSelector: map[string]string{"pool": "build"}, StorageType: "minio"}.DockerBuilderPod(DockerBuilderOptions{PodOptions: PodOptions{Name: "dockerbuild-myapp", Image: "drycc/dockerbuilder", PullPolicy: corev1.PullAlways, TarKey: "tar", ShortSha: "abc1234"}, ImageName: "myapp:git-abc1234", RegistryHost: "localhost", RegistryPort: "5555"})
+	arm := registry.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	platform := platformPod(pod, "myapp", "abc1234", "myapp:git-abc1234", arm)
+	assert.True(t, strings.HasPrefix(platform.Name, "dockerbuild-myapp-armv7-abc1234-"), "name "+platform.Name)
+	assert.Equal(t, platform.Spec.NodeSelector, map[string]string{"pool": "build", osNodeLabel: "linux", archNodeLabel: "arm"}, "node selector")
+	assert.Equal(t, podEnv(platform, "IMG_NAME"), "myapp:git-abc1234-armv7", "image name")
+	assert.Equal(t, podEnv(platform, buildPlatformEnv), "linux/arm/v7", "platform")
+	assert.Equal(t, podEnv(pod, "IMG_NAME"), "myapp:git-abc1234", "image name of the original pod")
+
+	long := platformPodName(strings.Repeat("a", 40), "abc1234", arm)
+	assert.True(t, len(long) <= 63 && strings.Contains(long, "-armv7-"), "name "+long)
+}
+
+func TestRunPlatformBuilds(t *testing.T) {
+	out := new(bytes.Buffer)
+	term := pusherTerminal
+	pusherTerminal = &terminal{out: out, messages: builtinMessages}
+	defer func() { pusherTerminal = term }()
+	platforms := []registry.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	pods := []*corev1.Pod{{}, {}}
+	for i := range pods {
+		pods[i].Name = platforms[i].Architecture
+	}
+
+	ran, ended, err := runPlatformBuilds(pods, platforms, func(pod *corev1.Pod, p registry.Platform, out io.Writer) (*corev1.Pod, *corev1.Pod, error) {
+		fmt.Fprintf(out, "step 1\nstep")
+		fmt.Fprintf(out, " 2 of %s", p.Architecture)
+		return pod, pod, nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, ran[1].Name, "arm64", "pod of the second platform")
+	assert.Equal(t, ended[0].Name, "amd64", "pod of the first platform")
+	assert.True(t, strings.Contains(out.String(), "[linux/arm64] step 1\n"), "output "+out.String())
+	assert.True(t, strings.Contains(out.String(), "[linux/arm64] step 2 of arm64\n"), "output "+out.String())
+
+	_, _, err = runPlatformBuilds(pods, platforms, func(pod *corev1.Pod, p registry.Platform, out io.Writer) (*corev1.Pod, *corev1.Pod, error) {
+		if p.Architecture == "arm64" {
+			return nil, nil, podLostError{reason: "evicted"}
+		}
+		return pod, pod, nil
+	})
+	_, ok := err.(podLostError)
+	assert.True(t, ok, "error of the failed platform")
+}
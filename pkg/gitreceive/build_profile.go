@@ -0,0 +1,173 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// buildProfileKey is the app config key selecting the build profile of the app, e.g. "large".
+const buildProfileKey = "DRYCC_BUILD_PROFILE"
+
+// BuildProfiles are the named presets of the builds of apps, read from a JSON file, usually
+// mounted from a ConfigMap.
+type BuildProfiles struct {
+	Profiles []BuildProfile `json:"profiles"`
+}
+
+// BuildProfile tunes the builds of the apps selecting it. Its settings replace the builder's
+// defaults, while the stack settings are defaults of the app config, so that apps can still
+// override them.
+type BuildProfile struct {
+	Name string `json:"name"`
+	// CPU is the CPU request and limit of the builder pod, e.g. "2".
+	CPU string `json:"cpu,omitempty"`
+	// Memory is the memory limit of the builder pod, e.g. "4Gi", which is still capped by the
+	// builder's maximum.
+	Memory string `json:"memory,omitempty"`
+	// NodeSelector is added to the node selector of the builder pod.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// TimeoutSec is how long the builder pod may take to start and to build, in seconds.
+	TimeoutSec   int    `json:"timeoutSec,omitempty"`
+	Stack        string `json:"stack,omitempty"`
+	StackChannel string `json:"stackChannel,omitempty"`
+	StackVersion string `json:"stackVersion,omitempty"`
+}
+
+// loadBuildProfiles reads the profiles at path. It returns nil if there are none.
+func loadBuildProfiles(path string) (*BuildProfiles, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	profiles := new(BuildProfiles)
+	if err := json.Unmarshal(data, profiles); err != nil {
+		return nil, fmt.Errorf("build profiles %s are malformed (%s)", path, err)
+	}
+	for _, p := range profiles.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("a build profile in %s has no name", path)
+		}
+		if _, err := parseMemory(p.CPU); err != nil { // any quantity parses the same way
+			return nil, fmt.Errorf("build profile %s in %s has an invalid cpu %q (%s)", p.Name, path, p.CPU, err)
+		}
+		if _, err := parseMemory(p.Memory); err != nil {
+			return nil, fmt.Errorf("build profile %s in %s has an invalid memory %q (%s)", p.Name, path, p.Memory, err)
+		}
+		if p.TimeoutSec < 0 {
+			return nil, fmt.Errorf("build profile %s in %s has a negative timeoutSec", p.Name, path)
+		}
+	}
+	return profiles, nil
+}
+
+func (p *BuildProfiles) names() []string {
+	var names []string
+	for _, profile := range p.Profiles {
+		names = append(names, profile.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *BuildProfiles) profile(name string) *BuildProfile {
+	for i := range p.Profiles {
+		if p.Profiles[i].Name == name {
+			return &p.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// selectBuildProfile returns the profile the app config selects with buildProfileKey among the
+// profiles at path, or nil if it doesn't select one.
+func selectBuildProfile(path string, appConf dryccAPI.Config) (*BuildProfile, error) {
+	name := configString(appConf, buildProfileKey)
+	if name == "" {
+		return nil, nil
+	}
+	profiles, err := loadBuildProfiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if profiles == nil || len(profiles.Profiles) == 0 {
+		return nil, fmt.Errorf("unknown %s %q, the builder has no build profiles", buildProfileKey, name)
+	}
+	profile := profiles.profile(name)
+	if profile == nil {
+		return nil, fmt.Errorf("unknown %s %q, use one of %s", buildProfileKey, name, strings.Join(profiles.names(), ", "))
+	}
+	return profile, nil
+}
+
+// configure returns a copy of conf with the builder's defaults replaced by the settings of p.
+func (p *BuildProfile) configure(conf *Config) *Config {
+	profiled := *conf
+	if p.Memory != "" {
+		profiled.BuilderPodMemoryLimit = p.Memory
+	}
+	if p.TimeoutSec > 0 {
+		profiled.BuilderPodWaitDurationMSec = p.TimeoutSec * 1000
+	}
+	// in the format of BUILDER_POD_NODE_SELECTOR, where the last value of a label wins
+	var selector []string
+	if conf.BuilderPodNodeSelector != "" {
+		selector = append(selector, conf.BuilderPodNodeSelector)
+	}
+	labels := make([]string, 0, len(p.NodeSelector))
+	for label := range p.NodeSelector {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		selector = append(selector, label+":"+p.NodeSelector[label])
+	}
+	profiled.BuilderPodNodeSelector = strings.Join(selector, ",")
+	return &profiled
+}
+
+// appConfig returns a copy of appConf with the stack settings of p added where the app doesn't
+// set them.
+func (p *BuildProfile) appConfig(appConf dryccAPI.Config) dryccAPI.Config {
+	values := make(map[string]interface{}, len(appConf.Values)+3)
+	for k, v := range appConf.Values {
+		values[k] = v
+	}
+	for key, val := range map[string]string{
+		stackKey:        p.Stack,
+		stackChannelKey: p.StackChannel,
+		stackVersionKey: p.StackVersion,
+	} {
+		if _, ok := values[key]; !ok && val != "" {
+			values[key] = val
+		}
+	}
+	appConf.Values = values
+	return appConf
+}
+
+// setPodResources sets the CPU request and limit of the builder container of pod.
+func (p *BuildProfile) setPodResources(pod *corev1.Pod) {
+	if p.CPU == "" || len(pod.Spec.Containers) == 0 {
+		return
+	}
+	cpu := resource.MustParse(p.CPU)
+	res := &pod.Spec.Containers[0].Resources
+	if res.Limits == nil {
+		res.Limits = corev1.ResourceList{}
+	}
+	if res.Requests == nil {
+		res.Requests = corev1.ResourceList{}
+	}
+	res.Limits[corev1.ResourceCPU] = cpu
+	res.Requests[corev1.ResourceCPU] = cpu
+}
@@ -0,0 +1,97 @@
+package gitreceive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testBuildProfiles = `{
+  "profiles": [
+    {"name": "large", "cpu": "2", "memory": "8Gi", "nodeSelector": {"pool": "build-large"}, "timeoutSec": 3600},
+    {"name": "legacy", "stack": "heroku-20", "stackChannel": "edge"}
+  ]
+}`
+
+func writeBuildProfiles(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "build-profiles")
+	assert.NoErr(t, err)
+	path := filepath.Join(dir, "profiles.json")
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func TestSelectBuildProfile(t *testing.T) {
+	path := writeBuildProfiles(t, testBuildProfiles)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	profile, err := selectBuildProfile(path, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.True(t, profile == nil, "selected a profile without DRYCC_BUILD_PROFILE")
+
+	appConf := dryccAPI.Config{Values: map[string]interface{}{buildProfileKey: "large"}}
+	profile, err = selectBuildProfile(path, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, profile.Name, "large", "profile")
+
+	appConf.Values[buildProfileKey] = "huge"
+	_, err = selectBuildProfile(path, appConf)
+	assert.Err(t, err, errors.New(`unknown DRYCC_BUILD_PROFILE "huge", use one of large, legacy`))
+
+	_, err = selectBuildProfile(filepath.Join(filepath.Dir(path), "missing.json"), appConf)
+	assert.Err(t, err, errors.New(`unknown DRYCC_BUILD_PROFILE "huge", the builder has no build profiles`))
+
+	invalid := writeBuildProfiles(t, `{"profiles": [{"name": "large", "memory": "lots"}]}`)
+	defer os.RemoveAll(filepath.Dir(invalid))
+	appConf.Values[buildProfileKey] = "large"
+	_, err = selectBuildProfile(invalid, appConf)
+	assert.True(t, err != nil, "selected a profile with an invalid memory")
+}
+
+func TestBuildProfileConfigure(t *testing.T) {
+	profile := &BuildProfile{Memory: "8Gi", TimeoutSec: 3600, NodeSelector: map[string]string{"pool": "build-large", "arch": "amd64"}}
+	conf := &Config{BuilderPodMemoryLimit: "1Gi", BuilderPodMaxMemoryLimit: "4Gi", BuilderPodWaitDurationMSec: 900000, BuilderPodNodeSelector: "pool:build"}
+	profiled := profile.configure(conf)
+	assert.Equal(t, conf.BuilderPodMemoryLimit, "1Gi", "the builder's config was changed")
+	assert.Equal(t, profiled.BuilderPodWaitDuration().Seconds(), float64(3600), "timeout")
+
+	limit, err := builderMemoryLimit(profiled, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, limit.String(), "4Gi", "profile memory above the maximum")
+
+	selector, err := buildBuilderPodNodeSelector(profiled.BuilderPodNodeSelector)
+	assert.NoErr(t, err)
+	assert.Equal(t, selector, map[string]string{"pool": "build-large", "arch": "amd64"}, "node selector")
+
+	profiled = (&BuildProfile{}).configure(conf)
+	assert.Equal(t, *profiled, *conf, "config of an empty profile")
+}
+
+func TestBuildProfileAppConfig(t *testing.T) {
+	profile := &BuildProfile{Stack: "heroku-20", StackChannel: "edge"}
+	appConf := dryccAPI.Config{Values: map[string]interface{}{stackKey: "container"}}
+	profiled := profile.appConfig(appConf)
+	assert.Equal(t, configString(profiled, stackKey), "container", "the app's stack was overridden")
+	assert.Equal(t, configString(profiled, stackChannelKey), "edge", "stack channel")
+	_, ok := profiled.Values[stackVersionKey]
+	assert.False(t, ok, "set an empty stack version")
+	_, ok = appConf.Values[stackChannelKey]
+	assert.False(t, ok, "the app config was changed")
+}
+
+func TestBuildProfileSetPodResources(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "builder"}}}}
+	(&BuildProfile{}).setPodResources(pod)
+	assert.True(t, pod.Spec.Containers[0].Resources.Limits == nil, "set the resources without a cpu")
+
+	(&BuildProfile{CPU: "2"}).setPodResources(pod)
+	res := pod.Spec.Containers[0].Resources
+	assert.Equal(t, res.Limits.Cpu().String(), "2", "cpu limit")
+	assert.Equal(t, res.Requests.Cpu().String(), "2", "cpu request")
+}
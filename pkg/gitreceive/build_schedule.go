@@ -0,0 +1,78 @@
+package gitreceive
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drycc/builder/pkg/buildqueue"
+	"github.com/drycc/builder/pkg/git"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// schedulePushOption tells when the build of a push runs, ScheduleOffPeak or ScheduleNow, e.g.
+	// -o schedule=off-peak.
+	schedulePushOption = "schedule"
+	// buildScheduleKey is the app config key scheduling the builds of the app pushed without the
+	// schedule push option.
+	buildScheduleKey = "DRYCC_BUILD_SCHEDULE"
+
+	// ScheduleOffPeak queues builds to run in the OFF_PEAK_WINDOW, and ScheduleNow runs them
+	// right away.
+	ScheduleOffPeak = "off-peak"
+	ScheduleNow     = "now"
+)
+
+// offPeakWindow returns the window the build of a push with pushOpts, of the app with appConf,
+// is queued to run in, or nil if it runs right away.
+func offPeakWindow(conf *Config, pushOpts PushOptions, appConf dryccAPI.Config) (*buildqueue.Window, error) {
+	schedule, ok := pushOpts.Get(schedulePushOption)
+	if !ok {
+		schedule = configString(appConf, buildScheduleKey)
+	}
+	switch schedule {
+	case "", ScheduleNow:
+		return nil, nil
+	case ScheduleOffPeak:
+	default:
+		return nil, fmt.Errorf("unknown build schedule %q, use %s or %s", schedule, ScheduleOffPeak, ScheduleNow)
+	}
+	window, err := buildqueue.ParseWindow(conf.OffPeakWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OFF_PEAK_WINDOW (%s)", err)
+	} else if window == nil {
+		return nil, fmt.Errorf("off-peak builds are disabled on this builder")
+	}
+	return window, nil
+}
+
+// queueBuild queues the build of gitSha to run in window, and tells the pusher the ticket
+// identifying it.
+func (b *Builder) queueBuild(window *buildqueue.Window, gitSha *git.SHA, pushOpts PushOptions, recorder *buildRecorder) error {
+	conf := b.conf
+	queued := buildqueue.Build{
+		Ticket:      buildqueue.NewTicket(),
+		App:         conf.App(),
+		Repository:  conf.Repository,
+		Username:    conf.Username,
+		Fingerprint: conf.Fingerprint,
+		Connection:  conf.SSHConnection,
+		OldRev:      zeroRev,
+		NewRev:      gitSha.Full(),
+		Ref:         recorder.ref(),
+		Sha:         gitSha.Short(),
+		PushOptions: pushOpts,
+		Queued:      b.now().UTC(),
+	}
+	if recorder != nil && recorder.audit != nil {
+		queued.OldRev, queued.NewRev = recorder.audit.OldRev, recorder.audit.NewRev
+	}
+	if err := buildqueue.Enqueue(b.drivers.Artifacts, queued); err != nil {
+		return fmt.Errorf("queueing the build of git-%s (%s)", gitSha.Short(), err)
+	}
+	log.Debug("queued the build of git-%s as %s", gitSha.Short(), queued.Key())
+	pusherTerminal.info(msgBuildQueued, gitSha.Short(), window, window.Next(b.now()).Format(time.RFC3339), queued.Ticket)
+	recorder.record(buildPhaseQueued, "queued as %s to run in the off-peak window %s", queued.Ticket, window)
+	return nil
+}
@@ -0,0 +1,70 @@
+package gitreceive
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/buildqueue"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"k8s.io/client-go/kubernetes"
+)
+
+func TestOffPeakWindow(t *testing.T) {
+	conf := &Config{OffPeakWindow: "22:00-06:00"}
+	offPeak := dryccAPI.Config{Values: map[string]interface{}{buildScheduleKey: ScheduleOffPeak}}
+
+	window, err := offPeakWindow(conf, PushOptions{}, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.True(t, window == nil, "build scheduled without a push option or config")
+	window, err = offPeakWindow(conf, PushOptions{schedulePushOption: ScheduleOffPeak}, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, window.String(), "22:00-06:00", "window of the push option")
+	window, err = offPeakWindow(conf, PushOptions{}, offPeak)
+	assert.NoErr(t, err)
+	assert.True(t, window != nil, "build of an off-peak app not scheduled")
+	window, err = offPeakWindow(conf, PushOptions{schedulePushOption: ScheduleNow}, offPeak)
+	assert.NoErr(t, err)
+	assert.True(t, window == nil, "build pushed with schedule=now scheduled")
+
+	_, err = offPeakWindow(conf, PushOptions{schedulePushOption: "tonight"}, dryccAPI.Config{})
+	assert.True(t, err != nil, "unknown schedule")
+	_, err = offPeakWindow(&Config{}, PushOptions{}, offPeak)
+	assert.True(t, err != nil, "off-peak build without a window")
+}
+
+func TestQueueBuild(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	conf := &Config{Repository: "myapp.git", Username: "alice", SSHConnection: "10.0.0.1 5555 10.0.0.2 2223"}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	b, err := NewBuilder(conf, WithStorage(storage.NewDrivers(driver)), WithKubeClient(&kubernetes.Clientset{}), WithClock(func() time.Time { return now }))
+	assert.NoErr(t, err)
+	window, err := buildqueue.ParseWindow("22:00-06:00")
+	assert.NoErr(t, err)
+	gitSha, err := git.NewSha("abc1234def5678abc1234def5678abc1234def56")
+	assert.NoErr(t, err)
+
+	out := captureOutput(func() {
+		err = b.queueBuild(window, gitSha, PushOptions{schedulePushOption: ScheduleOffPeak}, nil)
+	})
+	assert.NoErr(t, err)
+	assert.True(t, strings.Contains(out, "to run in the off-peak window 22:00-06:00 UTC, from 2024-05-01T22:00:00Z"), "output "+out)
+
+	builds, err := buildqueue.All(driver)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(builds), 1, "queued builds")
+	queued := builds[0]
+	assert.True(t, strings.Contains(out, "as ticket "+queued.Ticket), "output "+out)
+	assert.Equal(t, queued.App, "myapp", "app")
+	assert.Equal(t, queued.Sha, "abc1234d", "sha")
+	assert.Equal(t, queued.NewRev, gitSha.Full(), "new rev")
+	assert.Equal(t, queued.Status, buildqueue.StatusQueued, "status")
+	assert.Equal(t, queued.Connection, conf.SSHConnection, "connection")
+}
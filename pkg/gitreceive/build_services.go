@@ -0,0 +1,232 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// dryccYAMLName is the file at the root of the repo that declares how the app is built.
+	dryccYAMLName = "drycc.yaml"
+	// maxBuildServices is the number of services a build can declare.
+	maxBuildServices = 4
+	// buildServicesLabel marks the pods running the services of builds, by app.
+	buildServicesLabel = "builder.drycc.cc/build-services"
+)
+
+// serviceNameRegexp matches the names of build services, which name their container and the
+// environment variables pointing to them.
+var serviceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,30}[a-z0-9])?$`)
+
+// dryccYAML is the part of a drycc.yaml the builder reads.
+type dryccYAML struct {
+	Build struct {
+		Services []buildService `yaml:"services"`
+	} `yaml:"build"`
+	Release struct {
+		SmokeTest *smokeTest `yaml:"smoke_test"`
+	} `yaml:"release"`
+}
+
+// buildService is a service, such as a database, that runs for the duration of a build, for the
+// build to run tests against it. It's reachable from the build at the <NAME>_HOST and <NAME>_PORT
+// environment variables, and build env values in which "{host}" and "{port}" stand for them.
+type buildService struct {
+	Name     string            `yaml:"name"`
+	Image    string            `yaml:"image"`
+	Port     int               `yaml:"port"`
+	Command  []string          `yaml:"command"`
+	Env      map[string]string `yaml:"env"`
+	BuildEnv map[string]string `yaml:"build_env"`
+}
+
+// envPrefix returns the prefix of the environment variables pointing to s.
+func (s buildService) envPrefix() string {
+	return strings.ToUpper(strings.Replace(s.Name, "-", "_", -1))
+}
+
+// readDryccYAML returns the drycc.yaml in dirName, empty if there's no such file.
+func readDryccYAML(dirName string) (*dryccYAML, error) {
+	d := new(dryccYAML)
+	raw, err := ioutil.ReadFile(filepath.Join(dirName, dryccYAMLName))
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error in reading %s (%s)", dryccYAMLName, err)
+	}
+	if err := yaml.Unmarshal(raw, d); err != nil {
+		return nil, fmt.Errorf("%s is malformed (%s)", dryccYAMLName, err)
+	}
+	return d, nil
+}
+
+// readBuildServices returns the services declared in the drycc.yaml in dirName, none if there's
+// no such file.
+func readBuildServices(dirName string) ([]buildService, error) {
+	d, err := readDryccYAML(dirName)
+	if err != nil {
+		return nil, err
+	}
+	services := d.Build.Services
+	if len(services) > maxBuildServices {
+		return nil, fmt.Errorf("%s declares %d build services, builds can have %d at most", dryccYAMLName, len(services), maxBuildServices)
+	}
+	names := make(map[string]bool, len(services))
+	for _, s := range services {
+		if !serviceNameRegexp.MatchString(s.Name) {
+			return nil, fmt.Errorf("invalid build service name %q, names are up to 32 lowercase letters, digits and dashes, starting with a letter", s.Name)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("the build service %s is declared twice", s.Name)
+		}
+		names[s.Name] = true
+		if s.Image == "" {
+			return nil, fmt.Errorf("the build service %s has no image", s.Name)
+		}
+		if s.Port < 1 || s.Port > 65535 {
+			return nil, fmt.Errorf("the build service %s must have the port it listens on", s.Name)
+		}
+	}
+	return services, nil
+}
+
+// buildServicesEnv returns the environment variables pointing the build to services, run by a
+// pod with the IP host.
+func buildServicesEnv(services []buildService, host string) map[string]string {
+	env := make(map[string]string)
+	for _, s := range services {
+		port := strconv.Itoa(s.Port)
+		env[s.envPrefix()+"_HOST"] = host
+		env[s.envPrefix()+"_PORT"] = port
+		for key, value := range s.BuildEnv {
+			env[key] = strings.NewReplacer("{host}", host, "{port}", port).Replace(value)
+		}
+	}
+	return env
+}
+
+func buildServicesPodName(appName, shortSha string) string {
+	uid := uuid.New()[:8]
+	// pod names cannot exceed 63 characters in length
+	if len(appName) > 36 {
+		appName = appName[:36]
+	}
+	return fmt.Sprintf("services-%s-%s-%s", appName, shortSha, uid)
+}
+
+// buildServicesPod returns the pod running services for a build of app, named name in namespace.
+// Each service is ready once it accepts connections on its port.
+func buildServicesPod(name, namespace, app string, services []buildService, nodeSelector map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"heritage":         name,
+				buildServicesLabel: app,
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			NodeSelector:  nodeSelector,
+		},
+	}
+	for _, s := range services {
+		container := corev1.Container{
+			Name:    s.Name,
+			Image:   s.Image,
+			Command: s.Command,
+			Ports:   []corev1.ContainerPort{{ContainerPort: int32(s.Port)}},
+			ReadinessProbe: &corev1.Probe{
+				Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(s.Port)},
+				},
+				PeriodSeconds: 2,
+			},
+		}
+		for key, value := range s.Env {
+			container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: value})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod
+}
+
+// servicesReady is the condition of a pod whose services are all ready. It fails if one of them
+// ended or the pod was deleted.
+func servicesReady(t k8s.PodTransition) (bool, error) {
+	if t.Deleted() {
+		return true, fmt.Errorf("the pod was deleted")
+	}
+	for _, status := range t.Pod.Status.ContainerStatuses {
+		if state := status.State.Terminated; state != nil {
+			return true, fmt.Errorf("the %s service exited with code %d (%s)", status.Name, state.ExitCode, state.Reason)
+		}
+	}
+	if t.To == corev1.PodFailed || t.To == corev1.PodSucceeded {
+		return true, fmt.Errorf("the pod ended (%s)", t.Pod.Status.Message)
+	}
+	for _, condition := range t.Pod.Status.Conditions {
+		if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+			return t.Pod.Status.PodIP != "", nil
+		}
+	}
+	return false, nil
+}
+
+// startBuildServices starts pod, the services of a build, with kubeClient and waits up to timeout
+// for them to be ready. It returns the IP of the pod, and a func deleting it once the build ended.
+func startBuildServices(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	pod *corev1.Pod,
+	timeout,
+	interval time.Duration) (string, func(), error) {
+
+	pods := kubeClient.CoreV1().Pods(pod.Namespace)
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return "", nil, fmt.Errorf("creating the build services pod (%s)", err)
+	}
+	stop := func() { deleteServicesPod(pods, pod.Name) }
+
+	waiter := k8s.NewPodWaiter(kubeClient, pod.Namespace)
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	waiter.Start(waitCtx)
+	var ready *corev1.Pod
+	err := pusherTerminal.during(msgStartingServices, interval, func() (err error) {
+		ready, err = waiter.Wait(waitCtx, pod.Name, servicesReady)
+		return err
+	}, len(pod.Spec.Containers))
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("starting the build services (%s)", err)
+	}
+	return ready.Status.PodIP, stop, nil
+}
+
+// deleteServicesPod deletes the build services pod name right away, the data of the services is
+// thrown away.
+func deleteServicesPod(pods typedcorev1.PodInterface, name string) {
+	grace := int64(0)
+	if err := pods.Delete(context.Background(), name, metav1.DeleteOptions{GracePeriodSeconds: &grace}); err != nil {
+		log.Info("unable to delete the build services pod %s (%s)", name, err)
+	}
+}
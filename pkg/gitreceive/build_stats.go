@@ -0,0 +1,90 @@
+package gitreceive
+
+import (
+	"math"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/buildstats"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// statsWindow is how far back the builds a build is compared with go.
+	statsWindow = 30 * 24 * time.Hour
+	// statsMinBuilds is how many builds of the window a build is compared with at least.
+	statsMinBuilds = 3
+	// statsMinChange is the smallest change of the duration of a build, in percent, that's reported.
+	statsMinChange = 5
+)
+
+// buildStats records a build in the build history of its app. A nil *buildStats records nothing.
+type buildStats struct {
+	started time.Time
+	build   buildstats.Build
+}
+
+// cached records whether the build started with the build cache of its app.
+func (s *buildStats) cached(hit bool) {
+	if s == nil {
+		return
+	}
+	s.build.Cache = buildstats.CacheMiss
+	if hit {
+		s.build.Cache = buildstats.CacheHit
+	}
+}
+
+// sized records the size of the slug of the build.
+func (s *buildStats) sized(size int64) {
+	if s != nil {
+		s.build.Size = size
+	}
+}
+
+// finish records the build of app, which ended now with err, in its history in store. The pusher
+// of a build that succeeded is told how its duration compares with the median of the last builds.
+// Failures are logged, never returned.
+func (s *buildStats) finish(store storagedriver.StorageDriver, app string, err error, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.build.Finished = now
+	s.build.Duration = now.Sub(s.started).Seconds()
+	if err != nil {
+		s.build.FailureReason = string(KindOf(err))
+	}
+	history, loadErr := buildstats.Load(store, app)
+	if loadErr != nil {
+		log.Info("unable to update the build history (%s)", loadErr)
+		return
+	}
+	if err == nil {
+		stats := history.Stats(now.Add(-statsWindow))
+		if stats.Builds-stats.Failures >= statsMinBuilds && stats.MedianDuration > 0 {
+			reportDuration(s.build.Duration, stats.MedianDuration)
+		}
+	}
+	history.Add(s.build, now)
+	if err := history.Save(store); err != nil {
+		log.Info("unable to update the build history (%s)", err)
+	}
+}
+
+// reportDuration tells the pusher how the duration of the build compares with the median of the
+// builds of the window, both in seconds, unless they're about the same.
+func reportDuration(duration, median float64) {
+	change := int(math.Round((duration - median) / median * 100))
+	took, typical := formatDuration(duration), formatDuration(median)
+	switch {
+	case change >= statsMinChange:
+		pusherTerminal.info(msgBuildSlower, took, change, typical)
+	case change <= -statsMinChange:
+		pusherTerminal.info(msgBuildFaster, took, -change, typical)
+	}
+}
+
+// formatDuration formats seconds to the second, e.g. "1m40s".
+func formatDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
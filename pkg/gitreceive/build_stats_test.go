@@ -0,0 +1,47 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/buildstats"
+)
+
+func TestBuildStats(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	now := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	var recorder *buildRecorder
+	recorder.buildStats().cached(true)
+	recorder.buildStats().finish(store, "myapp", nil, now)
+	history, err := buildstats.Load(store, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(history.Builds), 0, "builds recorded without stats")
+
+	for i, d := range []time.Duration{time.Minute, 2 * time.Minute, time.Minute} {
+		stats := &buildStats{started: now.Add(-d), build: buildstats.Build{Sha: "1234567"}}
+		stats.cached(i > 0)
+		stats.sized(1024)
+		stats.finish(store, "myapp", nil, now)
+	}
+	stats := &buildStats{started: now.Add(-time.Minute)}
+	stats.finish(store, "myapp", policyError(errors.New("too large")), now)
+
+	history, err = buildstats.Load(store, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(history.Builds), 4, "builds recorded")
+	assert.Equal(t, history.Builds[0], buildstats.Build{Sha: "1234567", Finished: now, Duration: 60, Size: 1024, Cache: buildstats.CacheMiss}, "first build")
+	assert.Equal(t, history.Builds[1].Cache, buildstats.CacheHit, "cache of the second build")
+	assert.Equal(t, history.Builds[3].FailureReason, string(ErrPolicy), "failure reason")
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, formatDuration(100.4), "1m40s", "duration")
+	assert.Equal(t, formatDuration(0), "0s", "zero duration")
+}
@@ -0,0 +1,116 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// SummaryKeyPattern is the template for the object storage key of the summary of the build of
+	// a commit of an app.
+	SummaryKeyPattern = "home/%s/builds/%s.json"
+	// latestSummary is the name the summary of the last build of an app is also stored as, in
+	// place of the commit.
+	latestSummary = "latest"
+)
+
+// buildSummary is the machine readable summary of a build, for pipelines reacting to the builds
+// of the builder, such as GitOps controllers.
+type buildSummary struct {
+	App      string `json:"app"`
+	Sha      string `json:"sha"`
+	Ref      string `json:"ref,omitempty"`
+	Username string `json:"username"`
+	// Outcome is the last phase of the build, Released, Deferred or Failed.
+	Outcome string `json:"outcome"`
+	Message string `json:"message,omitempty"`
+	Release int    `json:"release,omitempty"`
+	Stack   string `json:"stack,omitempty"`
+	// Image is the image or slug released, with Digest the digest of images. PlatformDigests are
+	// the images of each platform of multi-platform builds, as platform=digest pairs.
+	Image           string               `json:"image,omitempty"`
+	Digest          string               `json:"digest,omitempty"`
+	PlatformDigests []string             `json:"platformDigests,omitempty"`
+	ProcessTypes    dryccAPI.ProcessType `json:"processTypes,omitempty"`
+	// Phases are the phases the build went through, with the time each started.
+	Phases   []summaryPhase `json:"phases"`
+	Duration float64        `json:"durationSeconds"`
+	// Log is where the output of the build can be read, while its builder pod is kept.
+	Log *summaryLog `json:"log,omitempty"`
+}
+
+type summaryPhase struct {
+	Phase   string    `json:"phase"`
+	Started time.Time `json:"started"`
+}
+
+type summaryLog struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+// newBuildSummary returns the summary of the build of sha, started now.
+func newBuildSummary(conf *Config, sha string) *buildSummary {
+	return &buildSummary{App: conf.App(), Sha: sha, Username: conf.Username}
+}
+
+// phase records that the build entered phase at t. A nil *buildSummary records nothing.
+func (s *buildSummary) phase(phase, message string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.Phases = append(s.Phases, summaryPhase{Phase: phase, Started: t.UTC()})
+	s.Outcome, s.Message = phase, message
+	s.Duration = t.Sub(s.Phases[0].Started).Seconds()
+}
+
+// built records what the build built: the image or slug of stack, released as image, with its
+// digest and the digests of its platforms, if it's a container image.
+func (s *buildSummary) built(stack, image, digest string, platformDigests []string, procType dryccAPI.ProcessType) {
+	if s == nil {
+		return
+	}
+	s.Stack, s.Image, s.Digest, s.PlatformDigests, s.ProcessTypes = stack, image, digest, platformDigests, procType
+}
+
+// logs records that the output of the build is the log of pod in namespace.
+func (s *buildSummary) logs(namespace, pod string) {
+	if s != nil {
+		s.Log = &summaryLog{Namespace: namespace, Pod: pod}
+	}
+}
+
+// released returns true if the build was released, or will be once the controller is available.
+func (s *buildSummary) released() bool {
+	return s.Outcome == buildPhaseReleased || s.Outcome == buildPhaseDeferred
+}
+
+// write stores s in the object storage, as the summary of its commit and of the last build of
+// its app, and commits the summaries of released builds to repo, if it's set. Failures are logged,
+// never returned, so that the builds don't fail once released.
+func (s *buildSummary) write(putter storage.ObjectPutter, repo *gitOpsRepo) {
+	if s == nil {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Info("unable to write the summary of the build (%s)", err)
+		return
+	}
+	for _, name := range []string{s.Sha, latestSummary} {
+		if err := putter.PutContent(context.Background(), fmt.Sprintf(SummaryKeyPattern, s.App, name), data); err != nil {
+			log.Info("unable to store the summary of the build (%s)", err)
+		}
+	}
+	if repo != nil && s.released() {
+		if err := repo.commit(s, data); err != nil {
+			log.Info("WARNING: unable to commit the summary of the build to %s (%s)", repo.url, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestBuildSummary(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	conf := &Config{Repository: "app.git", Username: "me"}
+
+	// the summary follows the build
+	r := newBuildRecorder(conf, nil, nil, "abc1234")
+	r.summary = newBuildSummary(conf, "abc1234")
+	r.record(buildPhaseStarted, "me pushed refs/heads/main")
+	r.record(buildPhaseBuilt, "build pod dockerbuild-app succeeded")
+	r.buildSummary().built("container", "quay.io/org/app@sha256:1234", "sha256:1234", []string{"linux/arm64=sha256:5678"}, dryccAPI.ProcessType{"web": "serve"})
+	r.buildSummary().logs("drycc", "dockerbuild-app")
+	r.released(4, "released v%d", 4)
+	s := r.summary
+	assert.Equal(t, s.Outcome, buildPhaseReleased, "outcome")
+	assert.Equal(t, s.Release, 4, "release")
+	assert.Equal(t, len(s.Phases), 3, "phases")
+	assert.True(t, s.released(), "not released")
+
+	s.write(driver, nil)
+	for _, name := range []string{"abc1234", latestSummary} {
+		data, err := driver.GetContent(context.Background(), fmt.Sprintf(SummaryKeyPattern, "app", name))
+		assert.NoErr(t, err)
+		var got buildSummary
+		assert.NoErr(t, json.Unmarshal(data, &got))
+		assert.Equal(t, got.Digest, "sha256:1234", "digest")
+		assert.Equal(t, got.Log.Pod, "dockerbuild-app", "log pod")
+	}
+
+	var none *buildRecorder
+	none.buildSummary().built("container", "", "", nil, nil)
+	none.buildSummary().write(driver, nil)
+}
+
+func TestGitOpsRepoCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	work, remote := filepath.Join(dir, "work"), filepath.Join(dir, "remote.git")
+	git := func(args ...string) string {
+		args = append([]string{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	assert.NoErr(t, os.MkdirAll(work, 0755))
+	git("init", "--initial-branch=main")
+	git("commit", "--allow-empty", "-m", "first")
+	out, err := exec.Command("git", "clone", "--bare", work, remote).CombinedOutput()
+	assert.True(t, err == nil, string(out))
+
+	repo := newGitOpsRepo(&Config{GitOpsRepo: remote, GitOpsBranch: "main", GitOpsPath: "apps/{{app}}/build.json", GitOpsCredsPath: dir})
+	s := &buildSummary{App: "app", Sha: "abc1234", Release: 4, Outcome: buildPhaseReleased, Phases: []summaryPhase{{Phase: buildPhaseStarted, Started: time.Now()}}}
+	assert.NoErr(t, repo.commit(s, []byte(`{"app":"app"}`)))
+	// committing the same summary again changes nothing
+	assert.NoErr(t, repo.commit(s, []byte(`{"app":"app"}`)))
+
+	git("pull", "--quiet", remote, "main")
+	data, err := ioutil.ReadFile(filepath.Join(work, "apps", "app", "build.json"))
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "{\"app\":\"app\"}\n", "summary")
+	assert.Equal(t, git("log", "-1", "--format=%s"), "Release app v4, built from git-abc1234", "commit message")
+	assert.Equal(t, git("rev-list", "--count", "HEAD"), "2", "commits")
+
+	repo.path = "../{{app}}.json"
+	assert.True(t, repo.commit(s, nil) != nil, "committed outside of the repo")
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/drycc/controller-sdk-go/api"
 	"github.com/drycc/pkg/log"
 	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
@@ -38,7 +39,6 @@ type podSelectorBuildCase struct {
 func TestBuild(t *testing.T) {
 	config := &Config{}
 	env := sys.NewFakeEnv()
-	fs := sys.NewFakeFS()
 	// NOTE(bacongobbler): there's a little easter egg here... ;)
 	sha := "0462cef5812ce31fe12f25596ff68dc614c708af"
 
@@ -59,32 +59,36 @@ func TestBuild(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	b, err := NewBuilder(config, WithStorage(storage.NewDrivers(storageDriver)), WithKubeClient(&kubernetes.Clientset{}), WithEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if err := build(config, storageDriver, nil, fs, env, "foo", sha); err == nil {
+	if err := b.build(context.Background(), sha, PushOptions{}, nil); err == nil {
 		t.Error("expected running build() without setting config.DockerBuilderImagePullPolicy to fail")
 	}
 
 	config.DockerBuilderImagePullPolicy = "Always"
-	if err := build(config, storageDriver, nil, fs, env, "foo", sha); err == nil {
+	if err := b.build(context.Background(), sha, PushOptions{}, nil); err == nil {
 		t.Error("expected running build() without setting config.SlugBuilderImagePullPolicy to fail")
 	}
 
 	config.SlugBuilderImagePullPolicy = "Always"
 
-	err = build(config, storageDriver, nil, fs, env, "foo", "abc123")
+	err = b.build(context.Background(), "abc123", PushOptions{}, nil)
 	expected := "git sha abc123 was invalid"
 	if err.Error() != expected {
 		t.Errorf("expected '%s', got '%v'", expected, err.Error())
 	}
 
-	if err := build(config, storageDriver, nil, fs, env, "foo", sha); err == nil {
+	if err := b.build(context.Background(), sha, PushOptions{}, nil); err == nil {
 		t.Error("expected running build() without valid controller client info to fail")
 	}
 
 	config.ControllerHost = "localhost"
 	config.ControllerPort = "1234"
 
-	if err := build(config, storageDriver, nil, fs, env, "foo", sha); err == nil {
+	if err := b.build(context.Background(), sha, PushOptions{}, nil); err == nil {
 		t.Error("expected running build() without a valid builder key to fail")
 	}
 
@@ -94,7 +98,7 @@ func TestBuild(t *testing.T) {
 		t.Fatalf("error creating %s (%s)", builderconf.BuilderKeyLocation, err)
 	}
 
-	if err := build(config, storageDriver, nil, fs, env, "foo", sha); err == nil {
+	if err := b.build(context.Background(), sha, PushOptions{}, nil); err == nil {
 		t.Error("expected running build() without a valid controller connection to fail")
 	}
 }
@@ -125,7 +129,9 @@ func TestGetProcFileFromRepoSuccess(t *testing.T) {
 	config.Values = map[string]interface{}{
 		"DRYCC_STACK": "heroku-18",
 	}
-	procType, err := getProcFile(getter, tmpDir, objKey, getStack(tmpDir, config))
+	stack, stackErr := getStack(tmpDir, config)
+	assert.NoErr(t, stackErr)
+	procType, err := getProcFile(context.Background(), getter, tmpDir, objKey, stack)
 	actualData := api.ProcessType{}
 	yaml.Unmarshal(data, &actualData)
 	assert.NoErr(t, err)
@@ -151,7 +157,9 @@ func TestGetProcFileFromRepoFailure(t *testing.T) {
 	config.Values = map[string]interface{}{
 		"DRYCC_STACK": "heroku-18",
 	}
-	_, err = getProcFile(getter, tmpDir, objKey, getStack(tmpDir, config))
+	stack, stackErr := getStack(tmpDir, config)
+	assert.NoErr(t, stackErr)
+	_, err = getProcFile(context.Background(), getter, tmpDir, objKey, stack)
 
 	assert.True(t, err != nil, "no error received when there should have been")
 }
@@ -169,7 +177,9 @@ func TestGetProcFileFromServerSuccess(t *testing.T) {
 		"DRYCC_STACK": "heroku-18",
 	}
 
-	procType, err := getProcFile(getter, "", objKey, getStack(tmpDir, config))
+	stack, stackErr := getStack(tmpDir, config)
+	assert.NoErr(t, stackErr)
+	procType, err := getProcFile(context.Background(), getter, "", objKey, stack)
 	actualData := api.ProcessType{}
 	yaml.Unmarshal(data, &actualData)
 	assert.NoErr(t, err)
@@ -188,7 +198,9 @@ func TestGetProcFileFromServerFailure(t *testing.T) {
 	config.Values = map[string]interface{}{
 		"DRYCC_STACK": "heroku-18",
 	}
-	_, err := getProcFile(getter, "", objKey, getStack(tmpDir, config))
+	stack, stackErr := getStack(tmpDir, config)
+	assert.NoErr(t, stackErr)
+	_, err := getProcFile(context.Background(), getter, "", objKey, stack)
 	assert.Err(t, err, fmt.Errorf("error in reading %s (%s)", objKey, expectedErr))
 	assert.True(t, err != nil, "no error received when there should have been")
 }
@@ -7,9 +7,19 @@ import (
 	"github.com/drycc/pkg/log"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+const (
+	// stackKey is the app config key setting the stack explicitly.
+	stackKey = "DRYCC_STACK"
+	// buildpackURLKey is the app config key selecting a custom buildpack.
+	buildpackURLKey = "BUILDPACK_URL"
+	// buildpacksFile lists the buildpacks of an app.
+	buildpacksFile = ".buildpacks"
+)
+
 // defaultStacks is default stacks json, order represents priority
 var defaultStacks = `[
     {
@@ -36,6 +46,17 @@ var Stacks []map[string]string
 
 // initStack load stack by config
 func initStack() error {
+	stacks, err := readStacks()
+	if err == nil {
+		Stacks = stacks
+	}
+	return err
+}
+
+// readStacks returns the stacks of the images.json of the slugbuilder and dockerbuilder, by
+// priority, or the default stacks if they can't be read.
+func readStacks() ([]map[string]string, error) {
+	var stacks []map[string]string
 	data, err := ioutil.ReadFile("/etc/slugbuilder/images.json")
 	if err == nil {
 		var stacksSlugbuilder []map[string]string
@@ -47,36 +68,66 @@ func initStack() error {
 				err = json.Unmarshal(data, &stacksDockerbuilder)
 				if err == nil {
 					// Stacks order represents priority
-					Stacks = stacksDockerbuilder
-					Stacks = append(Stacks, stacksSlugbuilder...)
+					stacks = stacksDockerbuilder
+					stacks = append(stacks, stacksSlugbuilder...)
 				}
-				return nil
+				return stacks, nil
 			}
 		}
 	}
-	return json.Unmarshal([]byte(defaultStacks), &Stacks)
+	err = json.Unmarshal([]byte(defaultStacks), &stacks)
+	return stacks, err
+}
+
+// stackNames returns the names of the available stacks, by priority.
+func stackNames() []string {
+	names := make([]string, 0, len(Stacks))
+	for _, stack := range Stacks {
+		names = append(names, stack["name"])
+	}
+	return names
+}
+
+// buildpacksRequested returns how the app asks for buildpacks explicitly, or "" if it doesn't.
+func buildpacksRequested(dirName string, config api.Config) string {
+	if configString(config, buildpackURLKey) != "" {
+		return buildpackURLKey
+	}
+	if _, err := os.Stat(filepath.Join(dirName, buildpacksFile)); err == nil {
+		return "./" + buildpacksFile
+	}
+	return ""
 }
 
-func getStack(dirName string, config api.Config) map[string]string {
+// getStack returns the stack to build the source in dirName with: the one set with DRYCC_STACK,
+// otherwise the first container stack if there is a Dockerfile, the first heroku stack if there is
+// a Procfile, or else the stack with the highest priority. It tells the pusher why the stack was
+// chosen. A Dockerfile in an app that asks for buildpacks is ambiguous, the stack has to be set
+// then.
+func getStack(dirName string, config api.Config) (map[string]string, error) {
 	if len(Stacks) == 0 {
 		initStack()
 	}
 	log.Debug("Stacks: %s", Stacks)
 	log.Debug("Config values %s", config.Values)
-	if stackInterface, ok := config.Values["DRYCC_STACK"]; ok {
-		if strStack, ok := stackInterface.(string); ok {
-			for _, stack := range Stacks {
-				if stack["name"] == strStack {
-					return stack
-				}
+	if name := configString(config, stackKey); name != "" {
+		for _, stack := range Stacks {
+			if stack["name"] == name {
+				pusherTerminal.info(msgStackOverride, name, stackKey)
+				return stack, nil
 			}
 		}
+		return nil, fmt.Errorf("%s=%s isn't an available stack, use one of: %s", stackKey, name, strings.Join(stackNames(), ", "))
 	}
 
 	if _, err := os.Stat(fmt.Sprintf("%s/Dockerfile", dirName)); err == nil {
+		if requested := buildpacksRequested(dirName, config); requested != "" {
+			return nil, fmt.Errorf("the app has a Dockerfile but asks for buildpacks with %s, set the stack to build it with `drycc config:set %s=<stack>`, one of: %s", requested, stackKey, strings.Join(stackNames(), ", "))
+		}
 		for _, stack := range Stacks {
 			if strings.Contains(stack["name"], "container") {
-				return stack
+				pusherTerminal.info(msgStackDockerfile, stack["name"])
+				return stack, nil
 			}
 		}
 	}
@@ -84,9 +135,11 @@ func getStack(dirName string, config api.Config) map[string]string {
 	if _, err := os.Stat(fmt.Sprintf("%s/Procfile", dirName)); err == nil {
 		for _, stack := range Stacks {
 			if strings.Contains(stack["name"], "heroku") {
-				return stack
+				pusherTerminal.info(msgStackBuildpacks, stack["name"])
+				return stack, nil
 			}
 		}
 	}
-	return Stacks[0]
+	pusherTerminal.info(msgStackDefault, Stacks[0]["name"])
+	return Stacks[0], nil
 }
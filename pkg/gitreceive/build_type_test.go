@@ -1,15 +1,23 @@
 package gitreceive
 
 import (
-	"github.com/drycc/controller-sdk-go/api"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/controller-sdk-go/api"
 )
 
 func TestGetStack(t *testing.T) {
 	tmpDir := os.TempDir()
 	config := api.Config{}
-	stack := getStack(tmpDir, config)
+	stack, err := getStack(tmpDir, config)
+	if err != nil {
+		t.Fatalf("detecting the stack (%s)", err)
+	}
 	if stack["name"] != "container" {
 		t.Fatalf("expected procfile build, got %s", stack)
 	}
@@ -17,7 +25,10 @@ func TestGetStack(t *testing.T) {
 		t.Fatalf("error creating %s/Dockerfile (%s)", tmpDir, err)
 	}
 
-	stack = getStack(tmpDir, config)
+	stack, err = getStack(tmpDir, config)
+	if err != nil {
+		t.Fatalf("detecting the stack (%s)", err)
+	}
 	if stack["name"] != "container" {
 		t.Fatalf("expected dockerfile build, got %s", stack)
 	}
@@ -37,7 +48,10 @@ func TestGetStack(t *testing.T) {
 	config.Values = map[string]interface{}{
 		"DRYCC_STACK": "heroku-18",
 	}
-	stack = getStack(tmpDir, config)
+	stack, err = getStack(tmpDir, config)
+	if err != nil {
+		t.Fatalf("detecting the stack (%s)", err)
+	}
 	if stack["name"] != "heroku-18" {
 		t.Fatalf("expected procfile build, got %s", stack)
 	}
@@ -45,8 +59,61 @@ func TestGetStack(t *testing.T) {
 	config.Values = map[string]interface{}{
 		"DRYCC_STACK": "container",
 	}
-	stack = getStack(tmpDir, config)
+	stack, err = getStack(tmpDir, config)
+	if err != nil {
+		t.Fatalf("detecting the stack (%s)", err)
+	}
 	if stack["name"] != "container" {
 		t.Fatalf("expected Dockerfile build, got %s", stack)
 	}
 }
+
+func TestGetStackReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tmpdir")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	detect := func() (map[string]string, string) {
+		var stack map[string]string
+		output := captureOutput(func() {
+			stack, err = getStack(tmpDir, api.Config{})
+		})
+		assert.NoErr(t, err)
+		return stack, output
+	}
+
+	stack, output := detect()
+	assert.True(t, strings.Contains(output, "No Dockerfile or Procfile; using the default "+stack["name"]+" stack"), output)
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(tmpDir, "Procfile"), []byte("web: app"), 0644))
+	stack, output = detect()
+	assert.Equal(t, stack["name"], "heroku-20", "stack")
+	assert.True(t, strings.Contains(output, "No Dockerfile; using buildpacks with the heroku-20 stack"), output)
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(tmpDir, "Dockerfile"), []byte("FROM scratch"), 0644))
+	stack, output = detect()
+	assert.Equal(t, stack["name"], "container", "stack")
+	assert.True(t, strings.Contains(output, "Detected Dockerfile at ./Dockerfile → container stack"), output)
+}
+
+func TestGetStackErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tmpdir")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	_, err = getStack(tmpDir, api.Config{Values: map[string]interface{}{stackKey: "heroku-12"}})
+	assert.True(t, err != nil, "unknown stacks must be rejected")
+	assert.True(t, strings.Contains(err.Error(), "container, heroku-20, heroku-18, heroku-16"), err.Error())
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(tmpDir, "Dockerfile"), []byte("FROM scratch"), 0644))
+	_, err = getStack(tmpDir, api.Config{Values: map[string]interface{}{buildpackURLKey: "https://github.com/heroku/heroku-buildpack-go"}})
+	assert.True(t, err != nil, "a Dockerfile with BUILDPACK_URL is ambiguous")
+	assert.True(t, strings.Contains(err.Error(), buildpackURLKey), err.Error())
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(tmpDir, buildpacksFile), []byte("https://github.com/heroku/heroku-buildpack-go"), 0644))
+	_, err = getStack(tmpDir, api.Config{})
+	assert.True(t, err != nil, "a Dockerfile with .buildpacks is ambiguous")
+
+	stack, err := getStack(tmpDir, api.Config{Values: map[string]interface{}{stackKey: "heroku-18"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, stack["name"], "heroku-18", "stack set explicitly")
+}
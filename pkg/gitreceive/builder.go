@@ -0,0 +1,219 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/drycc/builder/pkg/buildcost"
+	"github.com/drycc/builder/pkg/buildstats"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/builder/pkg/sys"
+	"github.com/drycc/pkg/log"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Notifier is told about the phases builds go through, Started, Building, Built, Released,
+// Deferred, Queued or Failed, and the warnings about them, as they're recorded. Dry runs aren't
+// notified.
+type Notifier interface {
+	// Phase is called when the build of app at sha enters phase.
+	Phase(app, sha, phase, message string)
+	// Warning is called with a warning about the build of app at sha that doesn't change its phase.
+	Warning(app, sha, reason, message string)
+}
+
+// Builder builds and releases the pushes of the app of its Config. It's the pipeline the
+// git-receive hook runs, for other programs to embed it.
+type Builder struct {
+	conf       *Config
+	drivers    storage.Drivers
+	kubeClient kubernetes.Interface
+	env        sys.Env
+	notifier   Notifier
+	now        func() time.Time
+
+	events     eventCreator
+	builds     buildResourceClient
+	promoter   *promoter
+	presigners *presigners
+	auditSinks []auditSink
+	gitOps     *gitOpsRepo
+	prices     *buildcost.Prices
+}
+
+// Option configures a Builder.
+type Option func(*Builder)
+
+// WithStorage makes the Builder store sources, slugs and caches in drivers. It's required.
+func WithStorage(drivers storage.Drivers) Option {
+	return func(b *Builder) {
+		b.drivers = drivers
+	}
+}
+
+// WithKubeClient makes the Builder run builder pods with client, instead of a client of the
+// cluster it runs in.
+func WithKubeClient(client kubernetes.Interface) Option {
+	return func(b *Builder) {
+		b.kubeClient = client
+	}
+}
+
+// WithNotifier makes the Builder tell n about the phases of its builds.
+func WithNotifier(n Notifier) Option {
+	return func(b *Builder) {
+		b.notifier = n
+	}
+}
+
+// WithClock makes the Builder tell the time with now, instead of time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(b *Builder) {
+		b.now = now
+	}
+}
+
+// WithEnv makes the Builder read the environment from env, instead of the environment of the
+// process.
+func WithEnv(env sys.Env) Option {
+	return func(b *Builder) {
+		b.env = env
+	}
+}
+
+// NewBuilder returns a Builder for conf, configured by opts.
+func NewBuilder(conf *Config, opts ...Option) (*Builder, error) {
+	b := &Builder{conf: conf, env: sys.RealEnv(), now: time.Now}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.drivers.Artifacts == nil {
+		return nil, errors.New("the builder needs a storage")
+	}
+	if b.kubeClient == nil {
+		kubeClient, err := k8s.NewInCluster()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't reach the api server (%s)", err)
+		}
+		b.kubeClient = kubeClient
+	}
+	if conf.BuildEvents {
+		b.events = b.kubeClient.CoreV1().Events(conf.PodNamespace)
+	}
+	if conf.BuildResources {
+		dynClient, err := k8s.NewDynamicInCluster()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't reach the api server (%s)", err)
+		}
+		b.builds = dynClient.Resource(BuildResource).Namespace(conf.PodNamespace)
+	}
+
+	var err error
+	if b.promoter, err = newPromoter(conf); err != nil {
+		return nil, err
+	}
+	if b.auditSinks, err = newAuditSinks(conf, b.drivers.Logs); err != nil {
+		return nil, err
+	}
+	if b.presigners, err = newPresigners(conf, b.env); err != nil {
+		return nil, err
+	}
+	b.gitOps = newGitOpsRepo(conf)
+	if b.prices, err = buildcost.LoadPrices(conf.BuildPricesPath); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Receive handles the push of newRev, replacing oldRev, to refName: it checks the push, builds
+// and releases it, and audits it.
+func (b *Builder) Receive(oldRev, newRev, refName string, pushOpts PushOptions) error {
+	commit, commitErr := buildCommit(b.repoDir(), newRev, pushOpts)
+	if commitErr != nil {
+		commit = newRev
+	}
+	recorder := b.newRecorder(commit, refName, pushOpts)
+	recorder.audit = newAuditEntry(b.conf, oldRev, newRev, refName, pushOpts)
+	if recorder.summary != nil {
+		recorder.summary.Ref = refName
+	}
+	recorder.record(buildPhaseStarted, "%s pushed %s", b.conf.Username, refName)
+	err := userError(commitErr)
+	if err == nil {
+		err = checkLargeFiles(b.conf, b.repoDir(), newRev, recorder)
+	}
+	if err == nil {
+		if commit != newRev {
+			log.Info("Building git-%s instead of the tip of %s", recorder.sha, refName)
+			recorder.audit.decide(fmt.Sprintf("built %s instead of %s", commit, newRev))
+		}
+		ctx, cancel := newBuildContext(b.conf)
+		err = b.build(ctx, commit, pushOpts, recorder)
+		if err != nil {
+			err = buildContextError(ctx, b.conf, err)
+		}
+		cancel()
+	}
+	if err != nil {
+		recorder.record(buildPhaseFailed, "%s", err)
+	} else if pushOpts.Bool(dryRunPushOption) {
+		recorder.audit.phase(auditOutcomeDryRun, "")
+	}
+	recorder.audit.write(b.auditSinks)
+	recorder.summary.write(b.drivers.Artifacts, b.gitOps)
+	recorder.stats.finish(b.drivers.Artifacts, b.conf.App(), err, b.now())
+	return err
+}
+
+// Check checks the push of newRev before it's built, and returns the commit to build: newRev,
+// unless the push options ask for another one.
+func (b *Builder) Check(newRev string, pushOpts PushOptions) (string, error) {
+	commit, err := buildCommit(b.repoDir(), newRev, pushOpts)
+	if err != nil {
+		return "", userError(err)
+	}
+	return commit, checkLargeFiles(b.conf, b.repoDir(), newRev, b.newRecorder(commit, "", pushOpts))
+}
+
+// Build builds commit, pushed to refName, and releases it, until ctx is done.
+func (b *Builder) Build(ctx context.Context, commit, refName string, pushOpts PushOptions) error {
+	return b.build(ctx, commit, pushOpts, b.newRecorder(commit, refName, pushOpts))
+}
+
+// repoDir returns the directory of the repository the Builder builds.
+func (b *Builder) repoDir() string {
+	return filepath.Join(b.conf.GitHome, b.conf.Repository)
+}
+
+// newRecorder returns the recorder of the build of commit, pushed to refName. Dry runs are only
+// audited, but know their ref all the same, so that they render image names as builds would.
+func (b *Builder) newRecorder(commit, refName string, pushOpts PushOptions) *buildRecorder {
+	sha := commit
+	if gitSha, err := git.NewSha(commit); err == nil {
+		sha = gitSha.Short()
+	}
+	if pushOpts.Bool(dryRunPushOption) {
+		recorder := newBuildRecorder(b.conf, nil, nil, sha)
+		recorder.refName = refName
+		return recorder
+	}
+	recorder := newBuildRecorder(b.conf, b.events, b.builds, sha)
+	recorder.refName = refName
+	recorder.notifier = b.notifier
+	recorder.logs = b.drivers.Logs
+	if b.conf.BuildSummaries || b.conf.GitOpsRepo != "" {
+		recorder.summary = newBuildSummary(b.conf, sha)
+	}
+	if b.prices != nil {
+		recorder.cost = &buildCost{prices: b.prices, now: b.now}
+	}
+	if b.conf.BuildStats {
+		recorder.stats = &buildStats{started: b.now(), build: buildstats.Build{Sha: sha}}
+	}
+	return recorder
+}
@@ -0,0 +1,96 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// buildMemoryKey is the app config key setting the memory limit of the app's builds, e.g. "2Gi".
+const buildMemoryKey = "DRYCC_BUILD_MEMORY"
+
+// parseMemory parses the memory quantity raw. An empty quantity is zero, meaning no limit.
+func parseMemory(raw string) (resource.Quantity, error) {
+	if raw == "" {
+		return resource.Quantity{}, nil
+	}
+	return resource.ParseQuantity(raw)
+}
+
+// builderMemoryLimit returns the memory limit of the builder pod of an app: its buildMemoryKey
+// config if it's set, otherwise the configured default, but never more than the configured
+// maximum. A zero limit means the builder pod has none.
+func builderMemoryLimit(conf *Config, appConf dryccAPI.Config) (resource.Quantity, error) {
+	limit, err := parseMemory(conf.BuilderPodMemoryLimit)
+	if err != nil {
+		return limit, fmt.Errorf("invalid builder pod memory limit %q (%s)", conf.BuilderPodMemoryLimit, err)
+	}
+	if raw := configString(appConf, buildMemoryKey); raw != "" {
+		if limit, err = resource.ParseQuantity(raw); err != nil {
+			return limit, fmt.Errorf("invalid %s %q, use a quantity such as 2Gi (%s)", buildMemoryKey, raw, err)
+		}
+	}
+	max, err := parseMemory(conf.BuilderPodMaxMemoryLimit)
+	if err != nil {
+		return limit, fmt.Errorf("invalid builder pod maximum memory limit %q (%s)", conf.BuilderPodMaxMemoryLimit, err)
+	}
+	if !max.IsZero() && (limit.IsZero() || limit.Cmp(max) > 0) {
+		if !limit.IsZero() {
+			log.Info("WARNING: builds can use %s of memory at most", max.String())
+		}
+		limit = max
+	}
+	return limit, nil
+}
+
+// setMemoryLimit sets the memory limit of the builder container of pod.
+func setMemoryLimit(pod *corev1.Pod, limit resource.Quantity) {
+	if len(pod.Spec.Containers) == 0 {
+		return
+	}
+	res := &pod.Spec.Containers[0].Resources
+	if res.Limits == nil {
+		res.Limits = corev1.ResourceList{}
+	}
+	res.Limits[corev1.ResourceMemory] = limit
+	// a request larger than the limit would make the pod invalid
+	if req, ok := res.Requests[corev1.ResourceMemory]; ok && req.Cmp(limit) > 0 {
+		res.Requests[corev1.ResourceMemory] = limit
+	}
+}
+
+// oomRetryLimit returns the memory limit to retry a build that ran out of memory with limit, and
+// false if it shouldn't be retried. Builds are only retried if retries are enabled, the builder
+// had a limit and a larger one is allowed.
+func oomRetryLimit(conf *Config, limit resource.Quantity) (resource.Quantity, bool) {
+	if !conf.OOMRetry || limit.IsZero() || conf.OOMRetryMultiplier <= 1 {
+		return limit, false
+	}
+	retry := resource.NewQuantity(int64(float64(limit.Value())*conf.OOMRetryMultiplier), resource.BinarySI)
+	if max, err := parseMemory(conf.BuilderPodMaxMemoryLimit); err == nil && !max.IsZero() && retry.Cmp(max) > 0 {
+		*retry = max
+	}
+	if retry.Cmp(limit) <= 0 {
+		return limit, false
+	}
+	return *retry, true
+}
+
+// retryPod returns a copy of pod named name, with the memory limit limit.
+func retryPod(pod *corev1.Pod, name string, limit resource.Quantity) *corev1.Pod {
+	retry := renamedPod(pod, name)
+	setMemoryLimit(retry, limit)
+	return retry
+}
+
+// newBuilderPodName returns a new name for the builder pod of a build with the stack stackName.
+func newBuilderPodName(stackName, appName, shortSha string) string {
+	if strings.Contains(stackName, "container") {
+		return dockerBuilderPodName(appName, shortSha)
+	}
+	return slugBuilderPodName(appName, shortSha)
+}
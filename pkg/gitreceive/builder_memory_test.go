@@ -0,0 +1,71 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestBuilderMemoryLimit(t *testing.T) {
+	conf := &Config{BuilderPodMemoryLimit: "1Gi", BuilderPodMaxMemoryLimit: "4Gi"}
+	limit, err := builderMemoryLimit(conf, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, limit.String(), "1Gi", "default limit")
+
+	appConf := dryccAPI.Config{Values: map[string]interface{}{buildMemoryKey: "2Gi"}}
+	limit, err = builderMemoryLimit(conf, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, limit.String(), "2Gi", "app limit")
+
+	appConf.Values[buildMemoryKey] = "8Gi"
+	limit, err = builderMemoryLimit(conf, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, limit.String(), "4Gi", "limit above the maximum")
+
+	appConf.Values[buildMemoryKey] = "lots"
+	_, err = builderMemoryLimit(conf, appConf)
+	assert.True(t, err != nil, "parsed an invalid limit")
+
+	limit, err = builderMemoryLimit(&Config{}, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.True(t, limit.IsZero(), "limit without any configured")
+}
+
+func TestOOMRetryLimit(t *testing.T) {
+	conf := &Config{OOMRetry: true, OOMRetryMultiplier: 2, BuilderPodMaxMemoryLimit: "3Gi"}
+	limit, ok := oomRetryLimit(conf, resource.MustParse("1Gi"))
+	assert.True(t, ok, "build wasn't retried")
+	assert.Equal(t, limit.String(), "2Gi", "retry limit")
+
+	limit, ok = oomRetryLimit(conf, resource.MustParse("2Gi"))
+	assert.True(t, ok, "build wasn't retried")
+	assert.Equal(t, limit.String(), "3Gi", "retry limit bounded by the maximum")
+
+	_, ok = oomRetryLimit(conf, resource.MustParse("3Gi"))
+	assert.False(t, ok, "retried a build already at the maximum")
+	_, ok = oomRetryLimit(conf, resource.Quantity{})
+	assert.False(t, ok, "retried a build without a limit")
+	conf.OOMRetry = false
+	_, ok = oomRetryLimit(conf, resource.MustParse("1Gi"))
+	assert.False(t, ok, "retried a build with retries disabled")
+}
+
+func TestRetryPod(t *testing.T) {
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.SlugBuilderPod(SlugBuilderOptions{PodOptions: PodOptions{Name: "slugbuild-app-12345678-abcdefgh", Image: "drycc/slugbuilder", PullPolicy: corev1.PullAlways, TarKey: "tar", ShortSha: "12345678"}, EnvSecretName: "app-build-env", PutKey: "put", CacheKey: "cache"})
+	setMemoryLimit(pod, resource.MustParse("1Gi"))
+	retry := retryPod(pod, "slugbuild-app-12345678-hgfedcba", resource.MustParse("2Gi"))
+	assert.Equal(t, retry.Labels["heritage"], "slugbuild-app-12345678-hgfedcba", "heritage label")
+	memory := retry.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]
+	assert.Equal(t, memory.String(), "2Gi", "retry limit")
+	memory = pod.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]
+	assert.Equal(t, memory.String(), "1Gi", "original limit")
+	assert.Equal(t, pod.Labels["heritage"], "slugbuild-app-12345678-abcdefgh", "original heritage label")
+}
+
+func TestOOMKilled(t *testing.T) {
+	assert.True(t, oomKilled(terminatedPod(137, reasonOOMKilled, "")), "OOMKilled pod")
+	assert.False(t, oomKilled(terminatedPod(1, "Error", "")), "failed pod")
+}
@@ -0,0 +1,64 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/storage"
+	"k8s.io/client-go/kubernetes"
+)
+
+type fakeNotifier struct {
+	phases   []string
+	warnings []string
+}
+
+func (n *fakeNotifier) Phase(app, sha, phase, message string) {
+	n.phases = append(n.phases, app+" "+sha+" "+phase+": "+message)
+}
+
+func (n *fakeNotifier) Warning(app, sha, reason, message string) {
+	n.warnings = append(n.warnings, app+" "+sha+" "+reason+": "+message)
+}
+
+func TestNewBuilder(t *testing.T) {
+	_, err := NewBuilder(&Config{}, WithKubeClient(&kubernetes.Clientset{}))
+	assert.Err(t, err, errors.New("the builder needs a storage"))
+
+	storageDriver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, err := NewBuilder(&Config{Repository: "app.git", GitHome: "/home/git"},
+		WithStorage(storage.NewDrivers(storageDriver)),
+		WithKubeClient(&kubernetes.Clientset{}),
+		WithClock(func() time.Time { return now }))
+	assert.NoErr(t, err)
+	assert.Equal(t, b.now(), now, "time of the builder")
+	assert.Equal(t, b.repoDir(), "/home/git/app.git", "repo of the builder")
+}
+
+func TestBuilderNotifier(t *testing.T) {
+	storageDriver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	notifier := new(fakeNotifier)
+	b, err := NewBuilder(&Config{Repository: "app.git"},
+		WithStorage(storage.NewDrivers(storageDriver)),
+		WithKubeClient(&kubernetes.Clientset{}),
+		WithNotifier(notifier))
+	assert.NoErr(t, err)
+
+	recorder := b.newRecorder("0462cef5812ce31fe12f25596ff68dc614c708af", "refs/heads/master", PushOptions{})
+	recorder.record(buildPhaseStarted, "%s pushed %s", "alice", "refs/heads/master")
+	recorder.warn(largeFilesReason, "pushed %d file(s)", 1)
+	assert.Equal(t, notifier.phases, []string{"app 0462cef5 Started: alice pushed refs/heads/master"}, "phases")
+	assert.Equal(t, notifier.warnings, []string{"app 0462cef5 " + largeFilesReason + ": pushed 1 file(s)"}, "warnings")
+
+	// dry runs are only audited
+	dryRun := b.newRecorder("0462cef5812ce31fe12f25596ff68dc614c708af", "refs/heads/master", PushOptions{dryRunPushOption: "1"})
+	dryRun.record(buildPhaseStarted, "dry run")
+	assert.Equal(t, len(notifier.phases), 1, "phases notified")
+	assert.Equal(t, dryRun.ref(), recorder.ref(), "ref of a dry run")
+}
@@ -0,0 +1,119 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// buildTargetKey is the app config key selecting the stage of a multi-stage Dockerfile that
+	// BuildKit builds.
+	buildTargetKey = "DRYCC_BUILD_TARGET"
+	// buildKitCacheKey is the app config key selecting how BuildKit caches the layers of the app's
+	// builds, one of buildKitCacheModes.
+	buildKitCacheKey = "DRYCC_BUILDKIT_CACHE"
+	// buildKitCacheTag is the tag the BuildKit cache of an app is kept at, in the repository of
+	// its images.
+	buildKitCacheTag = "buildcache"
+
+	// buildKitCacheRegistry exports the cache of every stage to the cache image, buildKitCacheInline
+	// embeds the cache of the final stage in the pushed image, also tagged as the cache image.
+	buildKitCacheRegistry = "registry"
+	buildKitCacheInline   = "inline"
+	buildKitCacheOff      = "off"
+
+	seccompUnconfined  = "unconfined"
+	apparmorAnnotation = "container.apparmor.security.beta.kubernetes.io/"
+	apparmorUnconfined = "unconfined"
+)
+
+var buildKitCacheModes = []string{buildKitCacheRegistry, buildKitCacheInline, buildKitCacheOff}
+
+// buildKitOptions are the BuildKit settings of a container build, passed to the dockerbuilder pod.
+type buildKitOptions struct {
+	// host is the address of the buildkitd to build with, or "" to run one in the builder pod.
+	host     string
+	cache    string
+	cacheRef string
+	target   string
+}
+
+// newBuildKitOptions returns the BuildKit settings of the container build of the image repo of
+// the app, nil if the builder doesn't build with BuildKit.
+func newBuildKitOptions(conf *Config, appConf dryccAPI.Config, repo string) (*buildKitOptions, error) {
+	target := configString(appConf, buildTargetKey)
+	if !conf.BuildKit {
+		if target != "" {
+			log.Info("WARNING: %s is ignored, the builder doesn't build with BuildKit", buildTargetKey)
+		}
+		return nil, nil
+	}
+	cache := conf.BuildKitCache
+	if appCache := configString(appConf, buildKitCacheKey); appCache != "" {
+		if !contains(buildKitCacheModes, appCache) {
+			return nil, userError(fmt.Errorf("invalid %s %q, use one of %s", buildKitCacheKey, appCache, strings.Join(buildKitCacheModes, ", ")))
+		}
+		cache = appCache
+	}
+	if !contains(buildKitCacheModes, cache) {
+		return nil, fmt.Errorf("invalid BuildKit cache mode %q, use one of %s", cache, strings.Join(buildKitCacheModes, ", "))
+	}
+	if conf.BuildKitHost == "" {
+		rank, err := configuredPodSecurityRank(conf.PodSecurityLevel)
+		if err != nil {
+			return nil, err
+		}
+		if rank > 0 {
+			return nil, policyError(fmt.Errorf("building with BuildKit runs buildkitd in the builder pod, which the %s PodSecurity level of the builder doesn't allow; set BUILDKIT_HOST to build with a buildkitd of the cluster instead", conf.PodSecurityLevel))
+		}
+	}
+	if _, ok := appConf.Values["DRYCC_DISABLE_CACHE"]; ok {
+		cache = buildKitCacheOff
+	}
+	opts := &buildKitOptions{host: conf.BuildKitHost, cache: cache, target: target}
+	if cache != buildKitCacheOff {
+		opts.cacheRef = repo + ":" + buildKitCacheTag
+	}
+	return opts, nil
+}
+
+// setPod makes the dockerbuilder pod build with o. Daemonless builds run buildkitd rootless in
+// the pod, without the seccomp and AppArmor profiles it can't run with.
+func (o *buildKitOptions) setPod(pod *corev1.Pod) {
+	if o == nil {
+		return
+	}
+	addEnvToPod(*pod, "DRYCC_BUILDKIT", "true")
+	if o.host != "" {
+		addEnvToPod(*pod, "BUILDKIT_HOST", o.host)
+	} else {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[seccompPodAnnotation] = seccompUnconfined
+		for _, c := range pod.Spec.Containers {
+			pod.Annotations[apparmorAnnotation+c.Name] = apparmorUnconfined
+		}
+	}
+	addEnvToPod(*pod, "BUILDKIT_CACHE", o.cache)
+	if o.cacheRef != "" {
+		addEnvToPod(*pod, "BUILDKIT_CACHE_REF", o.cacheRef)
+	}
+	if o.target != "" {
+		addEnvToPod(*pod, "BUILDKIT_TARGET", o.target)
+	}
+}
+
+// contains returns true if list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
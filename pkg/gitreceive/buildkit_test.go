@@ -0,0 +1,68 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNewBuildKitOptions(t *testing.T) {
+	conf := &Config{BuildKitCache: buildKitCacheRegistry, PodSecurityLevel: PrivilegedPodSecurity}
+	opts, err := newBuildKitOptions(conf, dryccAPI.Config{Values: map[string]interface{}{buildTargetKey: "prod"}}, "myapp")
+	assert.NoErr(t, err)
+	assert.True(t, opts == nil, "BuildKit options without BuildKit")
+
+	conf.BuildKit = true
+	opts, err = newBuildKitOptions(conf, dryccAPI.Config{Values: map[string]interface{}{buildTargetKey: "prod"}}, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, *opts, buildKitOptions{cache: buildKitCacheRegistry, cacheRef: "myapp:buildcache", target: "prod"}, "options")
+
+	opts, err = newBuildKitOptions(conf, dryccAPI.Config{Values: map[string]interface{}{buildKitCacheKey: "inline"}}, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, opts.cache, buildKitCacheInline, "cache of the app")
+	opts, err = newBuildKitOptions(conf, dryccAPI.Config{Values: map[string]interface{}{"DRYCC_DISABLE_CACHE": "1"}}, "myapp")
+	assert.NoErr(t, err)
+	assert.Equal(t, opts.cacheRef, "", "cache ref with the cache disabled")
+
+	_, err = newBuildKitOptions(conf, dryccAPI.Config{Values: map[string]interface{}{buildKitCacheKey: "local"}}, "myapp")
+	assert.True(t, err != nil && KindOf(err) == ErrUser, "invalid cache mode of the app")
+
+	// buildkitd can't run in the builder pod below the privileged level, a buildkitd of the cluster can
+	conf.PodSecurityLevel = BaselinePodSecurity
+	_, err = newBuildKitOptions(conf, dryccAPI.Config{}, "myapp")
+	assert.True(t, err != nil && KindOf(err) == ErrPolicy, "daemonless build at the baseline level")
+	conf.BuildKitHost = "tcp://buildkitd:1234"
+	_, err = newBuildKitOptions(conf, dryccAPI.Config{}, "myapp")
+	assert.NoErr(t, err)
+}
+
+func TestBuildKitOptionsSetPod(t *testing.T) {
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.DockerBuilderPod(DockerBuilderOptions{PodOptions: PodOptions{Name: "dockerbuild-myapp", Image: "drycc/dockerbuilder", PullPolicy: corev1.PullAlways, TarKey: "tar", ShortSha: "abc1234"}, ImageName: "myapp:git-abc1234", RegistryHost: "localhost", RegistryPort: "5555"})
+	(&buildKitOptions{cache: buildKitCacheRegistry, cacheRef: "myapp:buildcache", target: "prod"}).setPod(pod)
+	for key, value := range map[string]string{
+		"DRYCC_BUILDKIT":     "true",
+		"BUILDKIT_CACHE":     "registry",
+		"BUILDKIT_CACHE_REF": "myapp:buildcache",
+		"BUILDKIT_TARGET":    "prod",
+	} {
+		v, err := envValueFromKey(pod, key)
+		assert.NoErr(t, err)
+		assert.Equal(t, v, value, key)
+	}
+	assert.Equal(t, pod.Annotations[seccompPodAnnotation], seccompUnconfined, "seccomp profile")
+	assert.Equal(t, pod.Annotations[apparmorAnnotation+dockerBuilderName], apparmorUnconfined, "AppArmor profile")
+
+	pod = PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.DockerBuilderPod(DockerBuilderOptions{PodOptions: PodOptions{Name: "dockerbuild-myapp", Image: "drycc/dockerbuilder", PullPolicy: corev1.PullAlways, TarKey: "tar", ShortSha: "abc1234"}, ImageName: "myapp:git-abc1234", RegistryHost: "localhost", RegistryPort: "5555"})
+	(&buildKitOptions{host: "tcp://buildkitd:1234", cache: buildKitCacheOff}).setPod(pod)
+	host, err := envValueFromKey(pod, "BUILDKIT_HOST")
+	assert.NoErr(t, err)
+	assert.Equal(t, host, "tcp://buildkitd:1234", "host")
+	_, err = envValueFromKey(pod, "BUILDKIT_CACHE_REF")
+	assert.True(t, err != nil, "cache ref with the cache off")
+	assert.Equal(t, len(pod.Annotations), 0, "annotations of a build with a buildkitd of the cluster")
+
+	var none *buildKitOptions
+	none.setPod(pod)
+}
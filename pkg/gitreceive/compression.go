@@ -0,0 +1,112 @@
+package gitreceive
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The compressions of the source archives and slugs.
+const (
+	// GzipCompression is the default, understood by every builder image.
+	GzipCompression = "gzip"
+	// ZstdCompression is much faster than gzip for large apps, but needs builder images that
+	// support it.
+	ZstdCompression = "zstd"
+)
+
+const (
+	// compressionKey is the env var telling builder pods how the source archive at TAR_PATH is
+	// compressed, and how to compress the slugs and caches they upload.
+	compressionKey = "DRYCC_COMPRESSION"
+	// compressionLevelKey is the env var passing the compression level to builder pods.
+	compressionLevelKey = "DRYCC_COMPRESSION_LEVEL"
+	slugZstdName        = "slug.tar.zst"
+)
+
+// compression is how build artifacts are compressed, at level or, if it's 0, at the default
+// level of the algorithm.
+type compression struct {
+	name  string
+	level int
+}
+
+// newCompression returns the compression name at level, which must be between 1 and 9 for gzip
+// and 1 and 19 for zstd, or 0.
+func newCompression(name string, level int) (compression, error) {
+	maxLevel := 9
+	switch name {
+	case GzipCompression, "":
+		name = GzipCompression
+	case ZstdCompression:
+		maxLevel = 19
+	default:
+		return compression{}, fmt.Errorf("unknown compression %q, use %s or %s", name, GzipCompression, ZstdCompression)
+	}
+	if level < 0 || level > maxLevel {
+		return compression{}, fmt.Errorf("invalid %s compression level %d, use 1 to %d", name, level, maxLevel)
+	}
+	return compression{name: name, level: level}, nil
+}
+
+func (c compression) zstd() bool { return c.name == ZstdCompression }
+
+// ext returns the extension of the source archives compressed with c.
+func (c compression) ext() string {
+	if c.zstd() {
+		return "tar.zst"
+	}
+	return "tar.gz"
+}
+
+// slugName returns the name of the slugs compressed with c.
+func (c compression) slugName() string {
+	if c.zstd() {
+		return slugZstdName
+	}
+	return slugTGZName
+}
+
+// archiveCmd returns the git command writing the archive of rev, compressed with c, to the file
+// output, or to its stdout if output is empty. git has no zstd format, so it's added as a tar
+// filter.
+func (c compression) archiveCmd(repoDir, rev, output string) *exec.Cmd {
+	var args []string
+	if c.zstd() {
+		filter := "zstd -q -T0 -c"
+		if c.level > 0 {
+			filter += " -" + strconv.Itoa(c.level)
+		}
+		args = append(args, "-c", "tar.tar.zst.command="+filter)
+	}
+	args = append(args, "archive", "--format="+c.ext())
+	if !c.zstd() && c.level > 0 {
+		args = append(args, "-"+strconv.Itoa(c.level))
+	}
+	if output != "" {
+		args = append(args, "--output="+output)
+	}
+	return repoCmd(repoDir, "git", append(args, rev)...)
+}
+
+// extractArgs returns the arguments of tar extracting an archive compressed with c.
+func (c compression) extractArgs() []string {
+	if c.zstd() {
+		return []string{"-I", "zstd", "-xf"}
+	}
+	return []string{"-xzf"}
+}
+
+// setPodEnv tells the builder pod how its source is compressed, and how to compress what it
+// uploads. Pods using the default gzip compression aren't told anything, so that they work with
+// builder images that don't know about compressions.
+func (c compression) setPodEnv(pod *corev1.Pod) {
+	if c.zstd() || c.level > 0 {
+		addEnvToPod(*pod, compressionKey, c.name)
+	}
+	if c.level > 0 {
+		addEnvToPod(*pod, compressionLevelKey, strconv.Itoa(c.level))
+	}
+}
@@ -0,0 +1,86 @@
+package gitreceive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNewCompression(t *testing.T) {
+	comp, err := newCompression("", 0)
+	assert.NoErr(t, err)
+	assert.Equal(t, comp, compression{name: GzipCompression}, "default compression")
+	comp, err = newCompression(ZstdCompression, 19)
+	assert.NoErr(t, err)
+	assert.Equal(t, comp.slugName(), slugZstdName, "slug name")
+	assert.Equal(t, comp.ext(), "tar.zst", "extension")
+
+	_, err = newCompression("brotli", 0)
+	assert.True(t, err != nil, "unknown compressions must be rejected")
+	_, err = newCompression(GzipCompression, 10)
+	assert.True(t, err != nil, "gzip levels stop at 9")
+}
+
+func TestCompressionPodEnv(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{}}}}
+	compression{name: GzipCompression}.setPodEnv(pod)
+	assert.Equal(t, len(pod.Spec.Containers[0].Env), 0, "env of default compression")
+
+	compression{name: ZstdCompression, level: 3}.setPodEnv(pod)
+	assert.Equal(t, podEnv(pod, compressionKey), ZstdCompression, compressionKey)
+	assert.Equal(t, podEnv(pod, compressionLevelKey), "3", compressionLevelKey)
+}
+
+func TestCheckoutSourceZstd(t *testing.T) {
+	for _, tool := range []string{"git", "zstd"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not installed")
+		}
+	}
+	home, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(home)
+	work := filepath.Join(home, "work")
+	repoDir := filepath.Join(home, "app.git")
+	assert.NoErr(t, os.MkdirAll(work, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(work, "Procfile"), []byte("web: ./web"), 0644))
+	for _, args := range [][]string{
+		{"init", work},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "test"},
+		{"clone", "--bare", work, repoDir},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+	}
+	rev, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
+	assert.NoErr(t, err)
+
+	comp := compression{name: ZstdCompression, level: 5}
+	for _, mode := range []string{ArchiveCheckout, WorktreeCheckout} {
+		dir, err := ioutil.TempDir(home, "tmp")
+		assert.NoErr(t, err)
+		archive, err := checkoutSource(mode, repoDir, "app", strings.TrimSpace(string(rev)), dir, comp)
+		assert.NoErr(t, err)
+		data, err := ioutil.ReadFile(archive.path)
+		assert.NoErr(t, err)
+		procfile, err := ioutil.ReadFile(filepath.Join(dir, "Procfile"))
+		assert.NoErr(t, err)
+		assert.Equal(t, string(procfile), "web: ./web", mode+" Procfile")
+
+		list := exec.Command("tar", "-I", "zstd", "-tf", "-")
+		list.Stdin = bytes.NewReader(data)
+		out, err := list.CombinedOutput()
+		assert.True(t, err == nil, mode+" archive isn't a zstd tarball: "+string(out))
+		assert.True(t, strings.Contains(string(out), "Procfile"), string(out))
+	}
+	_, err = os.Stat(filepath.Join(repoDir, "app.tar.zst"))
+	assert.NoErr(t, err)
+}
@@ -16,9 +16,11 @@ type Config struct {
 	// k8s service discovery env vars
 	ControllerHost   string `envconfig:"DRYCC_CONTROLLER_SERVICE_HOST" required:"true"`
 	ControllerPort   string `envconfig:"DRYCC_CONTROLLER_SERVICE_PORT" required:"true"`
+	ControllerRoutes string `envconfig:"CONTROLLER_ROUTES" default:""`
 	RegistryHost     string `envconfig:"DRYCC_REGISTRY_PROXY_HOST" required:"true"`
 	RegistryPort     string `envconfig:"DRYCC_REGISTRY_PROXY_PORT" required:"true"`
 	RegistryLocation string `envconfig:"DRYCC_REGISTRY_LOCATION" default:"on-cluster"`
+	StorageHost      string `envconfig:"DRYCC_MINIO_SERVICE_HOST" default:""`
 
 	GitHome                       string `envconfig:"GIT_HOME" required:"true"`
 	SSHConnection                 string `envconfig:"SSH_CONNECTION" required:"true"`
@@ -27,10 +29,12 @@ type Config struct {
 	Username                      string `envconfig:"USERNAME" required:"true"`
 	Fingerprint                   string `envconfig:"FINGERPRINT" required:"true"`
 	PodNamespace                  string `envconfig:"POD_NAMESPACE" required:"true"`
+	PodName                       string `envconfig:"POD_NAME" default:""`
 	StorageRegion                 string `envconfig:"STORAGE_REGION" default:"us-east-1"`
 	Debug                         bool   `envconfig:"DRYCC_DEBUG" default:"false"`
 	BuilderPodTickDurationMSec    int    `envconfig:"BUILDER_POD_TICK_DURATION" default:"100"`
 	BuilderPodWaitDurationMSec    int    `envconfig:"BUILDER_POD_WAIT_DURATION" default:"900000"` // 15 minutes
+	BuilderPodPullTimeoutMSec     int    `envconfig:"BUILDER_POD_PULL_TIMEOUT" default:"600000"`  // 10 minutes
 	ObjectStorageTickDurationMSec int    `envconfig:"OBJECT_STORAGE_TICK_DURATION" default:"500"`
 	ObjectStorageWaitDurationMSec int    `envconfig:"OBJECT_STORAGE_WAIT_DURATION" default:"300000"` // 5 minutes
 	SessionIdleIntervalMsec       int    `envconfig:"SESSION_IDLE_INTERVAL" default:"10000"`         // 10 seconds
@@ -38,6 +42,220 @@ type Config struct {
 	DockerBuilderImagePullPolicy  string `envconfig:"DOCKERBUILDER_IMAGE_PULL_POLICY" default:"Always"`
 	StorageType                   string `envconfig:"BUILDER_STORAGE" default:"minio"`
 	BuilderPodNodeSelector        string `envconfig:"BUILDER_POD_NODE_SELECTOR" default:""`
+	PodSecurityLevel              string `envconfig:"POD_SECURITY_LEVEL" default:"privileged"`
+	BuilderPodRunAsUser           int64  `envconfig:"BUILDER_POD_RUN_AS_USER" default:"1000"`
+	BuilderPodAntiAffinity        bool   `envconfig:"BUILDER_POD_ANTI_AFFINITY_ENABLED" default:"false"`
+	MaxBuildsPerNode              int    `envconfig:"MAX_BUILDS_PER_NODE" default:"0"`
+	DeferredReleases              bool   `envconfig:"DEFERRED_RELEASES_ENABLED" default:"true"`
+	BuildEvents                   bool   `envconfig:"BUILD_EVENTS_ENABLED" default:"true"`
+	BuildResources                bool   `envconfig:"BUILD_RESOURCES_ENABLED" default:"false"`
+	PromotionEnabled              bool   `envconfig:"PROMOTION_ENABLED" default:"false"`
+	PromotionCredsPath            string `envconfig:"PROMOTION_CREDS_PATH" default:"/var/run/secrets/drycc/promotion"`
+	PromotionRegistry             string `envconfig:"PROMOTION_REGISTRY" default:""`
+	StackCatalogPath              string `envconfig:"STACK_CATALOG_PATH" default:"/etc/drycc/stacks/catalog.json"`
+	BuildProfilesPath             string `envconfig:"BUILD_PROFILES_PATH" default:"/etc/drycc/build-profiles/profiles.json"`
+	BuildPricesPath               string `envconfig:"BUILD_PRICES_PATH" default:"/etc/drycc/build-prices/prices.json"`
+	BuildStats                    bool   `envconfig:"BUILD_STATS_ENABLED" default:"true"`
+	BuilderVersion                string `ignored:"true"` // set by main
+	BuildEnvAllow                 string `envconfig:"BUILD_ENV_ALLOW" default:""`
+	BuildEnvDeny                  string `envconfig:"BUILD_ENV_DENY" default:""`
+	BuildEnvPushOptions           string `envconfig:"BUILD_ENV_PUSH_OPTIONS" default:""`
+	ShortLivedEnvSecrets          bool   `envconfig:"SHORT_LIVED_ENV_SECRETS_ENABLED" default:"false"`
+	AuditStorage                  bool   `envconfig:"AUDIT_STORAGE_ENABLED" default:"false"`
+	AuditWebhookURL               string `envconfig:"AUDIT_WEBHOOK_URL" default:""`
+	AuditWebhookSecretFile        string `envconfig:"AUDIT_WEBHOOK_SECRET_FILE" default:"/var/run/secrets/drycc/builder/audit/webhook-secret"`
+	LargeFileWarningSize          string `envconfig:"LARGE_FILE_WARNING_SIZE" default:"10Mi"`
+	LargeFileMaxSize              string `envconfig:"LARGE_FILE_MAX_SIZE" default:""`
+	SignedPushes                  string `envconfig:"SIGNED_PUSHES" default:"off"`
+	TrustedGPGKeysPath            string `envconfig:"TRUSTED_GPG_KEYS_PATH" default:"/var/run/secrets/drycc/builder/signers/gpg-keys.asc"`
+	AllowedSSHSignersPath         string `envconfig:"ALLOWED_SSH_SIGNERS_PATH" default:"/var/run/secrets/drycc/builder/signers/allowed_signers"`
+	SourceCheckout                string `envconfig:"SOURCE_CHECKOUT" default:"archive"`
+	AsyncSourceUpload             bool   `envconfig:"ASYNC_SOURCE_UPLOAD_ENABLED" default:"false"`
+	AsyncSourceUploadMinVersion   string `envconfig:"ASYNC_SOURCE_UPLOAD_MIN_VERSION" default:""`
+	SourceDedup                   bool   `envconfig:"SOURCE_DEDUP_ENABLED" default:"false"`
+	SourceMemoryLimit             string `envconfig:"SOURCE_MEMORY_LIMIT" default:"256Mi"`
+	SourceAssemblerImage          string `envconfig:"SOURCE_ASSEMBLER_IMAGE" default:""`
+	PresignedURLs                 bool   `envconfig:"PRESIGNED_URLS_ENABLED" default:"false"`
+	ReleaseStrategyAPIVersion     string `envconfig:"RELEASE_STRATEGY_API_VERSION" default:"2.4"`
+	SlugRunnerImageAllowlist      string `envconfig:"SLUGRUNNER_IMAGE_ALLOWLIST" default:""`
+	SlugRunnerImage               string `envconfig:"SLUGRUNNER_IMAGE" default:"drycc/slugrunner:canary"`
+	ConfigDrift                   string `envconfig:"CONFIG_DRIFT" default:"warn"`
+	StorageKeyShardLength         int    `envconfig:"STORAGE_KEY_SHARD_LENGTH" default:"0"`
+	DiskSpaceMargin               string `envconfig:"DISK_SPACE_MARGIN" default:"100Mi"`
+	BuildTmpDir                   string `envconfig:"BUILD_TMP_DIR" default:""`
+	ArtifactCompression           string `envconfig:"ARTIFACT_COMPRESSION" default:"gzip"`
+	ArtifactCompressionLevel      int    `envconfig:"ARTIFACT_COMPRESSION_LEVEL" default:"0"`
+	DependencyCaches              string `envconfig:"DEPENDENCY_CACHES" default:""`
+	DependencyCacheSize           string `envconfig:"DEPENDENCY_CACHE_SIZE" default:"2Gi"`
+	DependencyCacheStorageClass   string `envconfig:"DEPENDENCY_CACHE_STORAGE_CLASS" default:""`
+	DebugPodTTLMSec               int    `envconfig:"DEBUG_POD_TTL" default:"1800000"`      // 30 minutes
+	DebugPodMaxTTLMSec            int    `envconfig:"DEBUG_POD_MAX_TTL" default:"14400000"` // 4 hours
+
+	// BuilderPodMemoryLimit is the memory limit of builder pods, apps can change it up to
+	// BuilderPodMaxMemoryLimit. OOMKilled builds are retried once, with their limit multiplied by
+	// OOMRetryMultiplier, if OOMRetry is set.
+	BuilderPodMemoryLimit    string  `envconfig:"BUILDER_POD_MEMORY_LIMIT" default:""`
+	BuilderPodMaxMemoryLimit string  `envconfig:"BUILDER_POD_MAX_MEMORY_LIMIT" default:""`
+	OOMRetry                 bool    `envconfig:"OOM_RETRY_ENABLED" default:"false"`
+	OOMRetryMultiplier       float64 `envconfig:"OOM_RETRY_MULTIPLIER" default:"2"`
+
+	// BuilderPodLostRetries is the number of times a build is rescheduled when its builder pod is
+	// evicted, deleted or lost with its node.
+	BuilderPodLostRetries int `envconfig:"BUILDER_POD_LOST_RETRIES" default:"2"`
+
+	// RegistryMirrors maps registries to the mirrors stack images are pulled from instead, e.g.
+	// "docker.io=mirror.example.com/hub". Builder pods reach the internet through the
+	// BuilderPodHTTPProxy and BuilderPodHTTPSProxy proxies, except for BuilderPodNoProxy. With
+	// BuilderPodNetworkPolicy, a network policy limits their egress to these, the pods of their
+	// namespace and the comma separated destinations of BuilderPodEgressAllow, plus those apps ask
+	// for among BuilderPodEgressAppAllow, CIDRs and host name patterns, e.g.
+	// "10.20.0.0/16,*.internal.example.com".
+	RegistryMirrors          string `envconfig:"REGISTRY_MIRRORS" default:""`
+	BuilderPodHTTPProxy      string `envconfig:"BUILDER_POD_HTTP_PROXY" default:""`
+	BuilderPodHTTPSProxy     string `envconfig:"BUILDER_POD_HTTPS_PROXY" default:""`
+	BuilderPodNoProxy        string `envconfig:"BUILDER_POD_NO_PROXY" default:""`
+	BuilderPodNetworkPolicy  bool   `envconfig:"BUILDER_POD_NETWORK_POLICY_ENABLED" default:"false"`
+	BuilderPodEgressAllow    string `envconfig:"BUILDER_POD_EGRESS_ALLOW" default:""`
+	BuilderPodEgressAppAllow string `envconfig:"BUILDER_POD_EGRESS_APP_ALLOW" default:""`
+
+	// Term is the terminal type of the pusher, set if the SSH session of the push requested a pty.
+	// BuildOutputColor renders the build output for the pusher's terminal ("auto"), for a TTY
+	// ("always") or as plain lines ("never").
+	Term             string `envconfig:"RECEIVE_TERM" default:""`
+	BuildOutputColor string `envconfig:"BUILD_OUTPUT_COLOR" default:"auto"`
+
+	// TraceID is the ID of the transport trace of the SSH session of the push, for its audit
+	// record to be tied to the logged trace.
+	TraceID string `envconfig:"TRACE_ID" default:""`
+
+	// MessageCatalogPath is the path of the catalog of the messages shown to pushers, in addition
+	// to the built-in languages.
+	MessageCatalogPath string `envconfig:"MESSAGE_CATALOG_PATH" default:"/etc/drycc/messages/catalog.json"`
+
+	// MaxConcurrentBuilds is the number of builds that run at once across all builders, 0 for no
+	// limit. Builds waiting for a slot are ordered by the priority of their class in
+	// BuildPriorityClasses ("production:100,staging:50"), then by the slots their team uses for its
+	// weight in BuildTeamWeights ("team-a:3,team-b:1"). Apps are mapped to classes and teams by
+	// the first of the app name patterns of BuildAppPriorities ("*-prod=production") and
+	// BuildAppTeams ("team-a-*=team-a") they match, and apps no team pattern matches build for the
+	// user that pushed.
+	MaxConcurrentBuilds  int    `envconfig:"MAX_CONCURRENT_BUILDS" default:"0"`
+	BuildPriorityClasses string `envconfig:"BUILD_PRIORITY_CLASSES" default:""`
+	BuildTeamWeights     string `envconfig:"BUILD_TEAM_WEIGHTS" default:""`
+	BuildAppPriorities   string `envconfig:"BUILD_APP_PRIORITIES" default:""`
+	BuildAppTeams        string `envconfig:"BUILD_APP_TEAMS" default:""`
+	BuildQueuePollMSec   int    `envconfig:"BUILD_QUEUE_POLL_INTERVAL" default:"5000"` // 5 seconds
+	BuildTicketTTLMSec   int    `envconfig:"BUILD_TICKET_TTL" default:"60000"`         // 1 minute
+
+	// BuildClusterKubeconfig is the kubeconfig of a dedicated cluster builder pods run in instead,
+	// using its BuildClusterContext context or the current one, in its BuildClusterNamespace
+	// namespace or POD_NAMESPACE. The apps are still released to the controller of this cluster.
+	BuildClusterKubeconfig string `envconfig:"BUILD_CLUSTER_KUBECONFIG" default:""`
+	BuildClusterContext    string `envconfig:"BUILD_CLUSTER_CONTEXT" default:""`
+	BuildClusterNamespace  string `envconfig:"BUILD_CLUSTER_NAMESPACE" default:""`
+
+	// MalwareScannerURL is the scanner source tarballs are checked with before they're uploaded,
+	// clamd://host:port or icap://host:port/service, none if it's empty. Scans taking longer than
+	// MalwareScanTimeoutMSec fail the push.
+	MalwareScannerURL      string `envconfig:"MALWARE_SCANNER_URL" default:""`
+	MalwareScanTimeoutMSec int    `envconfig:"MALWARE_SCAN_TIMEOUT" default:"300000"` // 5 minutes
+
+	// AsyncReleases asks the controllers whose API is at least AsyncReleasesAPIVersion to deploy
+	// releases in the background, and follows their deploy by polling them every
+	// ReleasePollIntervalMSec, for ReleaseTimeoutMSec at most. A deploy still running then isn't
+	// canceled, the push ends without waiting for it. Releases are deployed before the controller
+	// answers if AsyncReleasesAPIVersion is empty, the default.
+	AsyncReleases           bool   `envconfig:"ASYNC_RELEASES_ENABLED" default:"false"`
+	AsyncReleasesAPIVersion string `envconfig:"ASYNC_RELEASES_API_VERSION" default:""`
+	ReleasePollIntervalMSec int    `envconfig:"RELEASE_POLL_INTERVAL" default:"2000"` // 2 seconds
+	ReleaseTimeoutMSec      int    `envconfig:"RELEASE_TIMEOUT" default:"600000"`     // 10 minutes
+
+	// ReleaseConfigAPIVersion is the controller API version from which the build hook sets the
+	// config defaults of app.json along with the release. Pushes needing them fail, telling the
+	// pusher to set them, with older controllers or if it's empty, the default.
+	ReleaseConfigAPIVersion string `envconfig:"RELEASE_CONFIG_API_VERSION" default:""`
+
+	// BuildTimeoutMSec is the longest a build can take, from the push to the release,
+	// unlimited if it's 0. Slower builds are canceled.
+	BuildTimeoutMSec int `envconfig:"BUILD_TIMEOUT" default:"0"`
+
+	// BuildLogMaxLineLength cuts the lines of the logs of builder pods longer than it, in bytes,
+	// and BuildLogMaxBytes is how much of the log of a builder pod is streamed to the pusher. Past
+	// it, only one line in every BuildLogSampleLines is shown, then the last BuildLogTailBytes of
+	// the log once the pod ended, which are also stored in the log storage at
+	// home/<app>/logs/<pod>.log. A limit of 0 disables it.
+	BuildLogMaxLineLength int   `envconfig:"BUILD_LOG_MAX_LINE_LENGTH" default:"4096"`
+	BuildLogMaxBytes      int64 `envconfig:"BUILD_LOG_MAX_BYTES" default:"104857600"` // 100 MiB
+	BuildLogSampleLines   int   `envconfig:"BUILD_LOG_SAMPLE_LINES" default:"1000"`
+	BuildLogTailBytes     int   `envconfig:"BUILD_LOG_TAIL_BYTES" default:"65536"` // 64 KiB
+
+	// ImageNameTemplate is the template of the names of the images of container builds, e.g.
+	// {{app}}:{{branch}}-{{sha}}-{{timestamp}}. Apps can override it with their
+	// DRYCC_IMAGE_NAME_TEMPLATE config.
+	ImageNameTemplate string `envconfig:"IMAGE_NAME_TEMPLATE" default:"{{app}}:git-{{sha}}"`
+
+	// RegistryTokens gives the builder pods of container builds a token of the on-cluster registry,
+	// signed with the PEM encoded EC or RSA key at RegistryTokenKeyPath, which grants only the push
+	// and pull of the repository of their image and expires after RegistryTokenTTLSec. The
+	// registry must use token authentication, trusting the certificate of the key for tokens of
+	// RegistryTokenIssuer for RegistryTokenService.
+	RegistryTokens       bool   `envconfig:"REGISTRY_TOKENS_ENABLED" default:"false"`
+	RegistryTokenKeyPath string `envconfig:"REGISTRY_TOKEN_KEY_PATH" default:"/var/run/secrets/drycc/registry-token/tls.key"`
+	RegistryTokenIssuer  string `envconfig:"REGISTRY_TOKEN_ISSUER" default:"drycc-builder"`
+	RegistryTokenService string `envconfig:"REGISTRY_TOKEN_SERVICE" default:"drycc-registry"`
+	RegistryTokenTTLSec  int    `envconfig:"REGISTRY_TOKEN_TTL_SEC" default:"3600"`
+
+	// ImageDestinations are the registries, optionally followed by a repository prefix, that the
+	// images of container builds are pushed to in addition to the registry of the cluster, e.g.
+	// 123456789012.dkr.ecr.us-east-1.amazonaws.com/prod. Their credentials are read from the docker
+	// config.json in ImageDestinationsCredsPath.
+	ImageDestinations          string `envconfig:"IMAGE_DESTINATIONS" default:""`
+	ImageDestinationsCredsPath string `envconfig:"IMAGE_DESTINATIONS_CREDS_PATH" default:"/var/run/secrets/drycc/image-destinations"`
+
+	// BuildSummaries stores a JSON summary of each build in the object storage, at
+	// home/<app>/builds/<sha>.json and home/<app>/builds/latest.json. With GitOpsRepo, the
+	// summaries of released builds are also committed to GitOpsPath, where {{app}} is the app, on
+	// the GitOpsBranch of the repo, pushed with the SSH key in GitOpsCredsPath.
+	BuildSummaries  bool   `envconfig:"BUILD_SUMMARIES_ENABLED" default:"false"`
+	GitOpsRepo      string `envconfig:"GITOPS_REPO" default:""`
+	GitOpsBranch    string `envconfig:"GITOPS_BRANCH" default:"main"`
+	GitOpsPath      string `envconfig:"GITOPS_PATH" default:"apps/{{app}}/build.json"`
+	GitOpsCredsPath string `envconfig:"GITOPS_CREDS_PATH" default:"/var/run/secrets/drycc/builder/gitops"`
+
+	// BuildKit builds container images with BuildKit, using the buildkitd at BuildKitHost, e.g.
+	// tcp://buildkitd.drycc.svc:1234, or one running in each builder pod if it's empty. Build
+	// caches are exported as BuildKitCache says, "registry", "inline" or "off", unless apps change
+	// it with their DRYCC_BUILDKIT_CACHE config.
+	BuildKit      bool   `envconfig:"BUILDKIT_ENABLED" default:"false"`
+	BuildKitHost  string `envconfig:"BUILDKIT_HOST" default:""`
+	BuildKitCache string `envconfig:"BUILDKIT_CACHE" default:"registry"`
+
+	// DockerfileLint checks the Dockerfiles of container builds before their builder pods are
+	// started, failing the pushes of Dockerfiles that can't be built and warning about common
+	// mistakes, except for the rules of DockerfileLintIgnore, e.g. DL3007,DL3020, and those apps
+	// ignore with their DRYCC_DOCKERFILE_LINT_IGNORE config.
+	DockerfileLint       bool   `envconfig:"DOCKERFILE_LINT_ENABLED" default:"true"`
+	DockerfileLintIgnore string `envconfig:"DOCKERFILE_LINT_IGNORE" default:""`
+
+	// AnalyzersPath lists the static analyzers, such as semgrep or gosec, that check the source
+	// of each build before it's released, in a pod getting the source with SourceAssemblerImage.
+	// Builds with SARIF results at or above AnalysisThreshold, "error", "warning", "note" or
+	// "none" to never reject them, are rejected unless apps change it with their
+	// DRYCC_ANALYSIS_THRESHOLD config.
+	AnalyzersPath     string `envconfig:"ANALYZERS_PATH" default:"/etc/drycc/analyzers/analyzers.json"`
+	AnalysisThreshold string `envconfig:"ANALYSIS_THRESHOLD" default:"error"`
+
+	// LicenseDeny are the patterns of the SPDX license IDs the dependencies of builds can't have,
+	// e.g. GPL-3.0*,AGPL-*, read from the SBOM the sbom analyzer of AnalyzersPath generates. Apps
+	// add patterns of their own with their DRYCC_LICENSE_DENY config. Builds with denied licenses
+	// are rejected, or only warned about if LicensePolicy is "warn".
+	LicenseDeny   string `envconfig:"LICENSE_DENY" default:""`
+	LicensePolicy string `envconfig:"LICENSE_POLICY" default:"reject"`
+
+	// OffPeakWindow is the daily window, in UTC, e.g. 22:00-06:00, the builds pushed with
+	// -o schedule=off-peak, or of apps with the DRYCC_BUILD_SCHEDULE=off-peak config, are queued
+	// to run in. Off-peak builds are refused if it's empty.
+	OffPeakWindow string `envconfig:"OFF_PEAK_WINDOW" default:""`
 }
 
 // App returns the application name represented by c. The app name is the same as c.Repository
@@ -51,7 +269,8 @@ func (c Config) App() string {
 }
 
 // BuilderPodTickDuration returns the size of the interval used to check for
-// the end of the execution of a Pod building an application.
+// the end of the execution of a Pod building an application. Builder pods are
+// watched rather than polled, so it's only kept for compatibility.
 func (c Config) BuilderPodTickDuration() time.Duration {
 	return time.Duration(time.Duration(c.BuilderPodTickDurationMSec) * time.Millisecond)
 }
@@ -62,6 +281,12 @@ func (c Config) BuilderPodWaitDuration() time.Duration {
 	return time.Duration(time.Duration(c.BuilderPodWaitDurationMSec) * time.Millisecond)
 }
 
+// BuilderPodPullTimeout returns the maximum time the pull of an image of a builder pod may take,
+// or 0 if pulls can take as long as the pod takes to start.
+func (c Config) BuilderPodPullTimeout() time.Duration {
+	return time.Duration(time.Duration(c.BuilderPodPullTimeoutMSec) * time.Millisecond)
+}
+
 // ObjectStorageTickDuration returns the size of the interval used to check for
 // the end of an operation that involves the object storage.
 func (c Config) ObjectStorageTickDuration() time.Duration {
@@ -74,6 +299,64 @@ func (c Config) ObjectStorageWaitDuration() time.Duration {
 	return time.Duration(time.Duration(c.ObjectStorageWaitDurationMSec) * time.Millisecond)
 }
 
+// DebugPodTTL returns how long a failed build is kept for debugging when no TTL was asked for.
+func (c Config) DebugPodTTL() time.Duration {
+	return time.Duration(time.Duration(c.DebugPodTTLMSec) * time.Millisecond)
+}
+
+// DebugPodMaxTTL returns the longest a failed build can be kept for debugging.
+func (c Config) DebugPodMaxTTL() time.Duration {
+	return time.Duration(time.Duration(c.DebugPodMaxTTLMSec) * time.Millisecond)
+}
+
+// BuildQueuePollInterval returns how often a build waiting for a slot checks the queue.
+func (c Config) BuildQueuePollInterval() time.Duration {
+	return time.Duration(time.Duration(c.BuildQueuePollMSec) * time.Millisecond)
+}
+
+// BuildTicketTTL returns how long the ticket of a build outlives the last time it was renewed.
+func (c Config) BuildTicketTTL() time.Duration {
+	return time.Duration(time.Duration(c.BuildTicketTTLMSec) * time.Millisecond)
+}
+
+// MalwareScanTimeout returns the longest a malware scan of the source can take.
+func (c Config) MalwareScanTimeout() time.Duration {
+	return time.Duration(time.Duration(c.MalwareScanTimeoutMSec) * time.Millisecond)
+}
+
+// BuildTimeout returns the longest a build can take, 0 for no limit.
+func (c Config) BuildTimeout() time.Duration {
+	return time.Duration(time.Duration(c.BuildTimeoutMSec) * time.Millisecond)
+}
+
+// RegistryTokenTTL returns how long the registry tokens of builds are valid.
+func (c Config) RegistryTokenTTL() time.Duration {
+	return time.Duration(c.RegistryTokenTTLSec) * time.Second
+}
+
+// ReleasePollInterval returns how often the state of a release deployed in the background is
+// polled.
+func (c Config) ReleasePollInterval() time.Duration {
+	return time.Duration(time.Duration(c.ReleasePollIntervalMSec) * time.Millisecond)
+}
+
+// LongestBuild returns the longest a build can take, from the push to the end of its release,
+// including the wait for a build slot and for its pod, or 0 if builds have no timeout.
+func (c Config) LongestBuild() time.Duration {
+	if c.BuildTimeout() <= 0 {
+		return 0
+	}
+	if c.AsyncReleases {
+		return c.BuildTimeout() + c.ReleaseTimeout()
+	}
+	return c.BuildTimeout()
+}
+
+// ReleaseTimeout returns the longest the deploy of a release is followed.
+func (c Config) ReleaseTimeout() time.Duration {
+	return time.Duration(time.Duration(c.ReleaseTimeoutMSec) * time.Millisecond)
+}
+
 // SessionIdleInterval returns the ticker interval to wait for status
 func (c Config) SessionIdleInterval() time.Duration {
 	return time.Duration(time.Duration(c.SessionIdleIntervalMsec) * time.Millisecond)
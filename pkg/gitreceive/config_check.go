@@ -0,0 +1,166 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/buildcost"
+	"github.com/drycc/builder/pkg/buildqueue"
+	"github.com/drycc/builder/pkg/controller"
+	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+// connectionCheckTimeout is how long the storage is given to answer a config check.
+const connectionCheckTimeout = 10 * time.Second
+
+// ConfigCheck is the outcome of a check of the config of the builder, which passed if Err is nil.
+type ConfigCheck struct {
+	Name string
+	Err  error
+}
+
+// CheckConfig checks the settings of conf that pushes only read once they reach a build, for
+// misconfigurations to be caught before they fail the first push.
+func CheckConfig(conf *Config) []ConfigCheck {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"image pull policies", func() error {
+			for _, policy := range []string{conf.SlugBuilderImagePullPolicy, conf.DockerBuilderImagePullPolicy} {
+				if _, err := k8s.PullPolicyFromString(policy); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"builder pod node selector", func() error {
+			_, err := buildBuilderPodNodeSelector(conf.BuilderPodNodeSelector)
+			return err
+		}},
+		{"durations", func() error {
+			if conf.BuilderPodTickDurationMSec >= conf.BuilderPodWaitDurationMSec {
+				return fmt.Errorf("BUILDER_POD_TICK_DURATION isn't shorter than BUILDER_POD_WAIT_DURATION")
+			}
+			if conf.ObjectStorageTickDurationMSec >= conf.ObjectStorageWaitDurationMSec {
+				return fmt.Errorf("OBJECT_STORAGE_TICK_DURATION isn't shorter than OBJECT_STORAGE_WAIT_DURATION")
+			}
+			return nil
+		}},
+		{"build log limits", func() error {
+			if conf.BuildLogMaxLineLength < 0 || conf.BuildLogMaxBytes < 0 || conf.BuildLogSampleLines < 0 || conf.BuildLogTailBytes < 0 {
+				return fmt.Errorf("the BUILD_LOG limits can't be negative")
+			}
+			return nil
+		}},
+		{"memory limits", func() error {
+			for _, raw := range []string{conf.BuilderPodMemoryLimit, conf.BuilderPodMaxMemoryLimit, conf.DependencyCacheSize, conf.DiskSpaceMargin} {
+				if _, err := parseMemory(raw); err != nil {
+					return fmt.Errorf("invalid quantity %q (%s)", raw, err)
+				}
+			}
+			_, err := sourceMemoryLimit(conf)
+			return err
+		}},
+		{"registry token key", func() error {
+			_, err := registryToken(conf, "check", "check", time.Now())
+			return err
+		}},
+		{"controller routes", func() error {
+			_, err := controller.ParseRoutes(conf.ControllerRoutes, conf.ControllerHost, conf.ControllerPort)
+			return err
+		}},
+		{"registry mirrors", func() error {
+			_, err := parseRegistryMirrors(conf.RegistryMirrors)
+			return err
+		}},
+		{"async source upload", func() error {
+			if conf.AsyncSourceUploadMinVersion == "" {
+				return nil
+			}
+			_, err := parseImageVersion(conf.AsyncSourceUploadMinVersion)
+			return err
+		}},
+		{"off-peak window", func() error {
+			_, err := buildqueue.ParseWindow(conf.OffPeakWindow)
+			return err
+		}},
+		{"stack catalog", func() error {
+			_, err := loadStackCatalog(conf.StackCatalogPath)
+			return err
+		}},
+		{"build profiles", func() error {
+			_, err := loadBuildProfiles(conf.BuildProfilesPath)
+			return err
+		}},
+		{"build prices", func() error {
+			_, err := buildcost.LoadPrices(conf.BuildPricesPath)
+			return err
+		}},
+		{"message catalog", func() error {
+			_, err := loadMessageCatalog(conf.MessageCatalogPath)
+			return err
+		}},
+		{"static analyzers", func() error {
+			_, err := loadAnalyzers(conf.AnalyzersPath)
+			return err
+		}},
+	}
+	results := make([]ConfigCheck, 0, len(checks))
+	for _, c := range checks {
+		results = append(results, ConfigCheck{Name: c.name, Err: c.check()})
+	}
+	return results
+}
+
+// CheckStorage checks that the storages of drivers can be reached.
+func CheckStorage(drivers storage.Drivers) []ConfigCheck {
+	results := []ConfigCheck{{Name: "object storage", Err: checkStorage(drivers.Artifacts)}}
+	if drivers.Cache != drivers.Artifacts {
+		results = append(results, ConfigCheck{Name: "cache storage", Err: checkStorage(drivers.Cache)})
+	}
+	if drivers.Logs != drivers.Artifacts {
+		results = append(results, ConfigCheck{Name: "log storage", Err: checkStorage(drivers.Logs)})
+	}
+	return results
+}
+
+// CheckController checks that the controller of conf can be reached.
+func CheckController(conf *Config) ConfigCheck {
+	client, err := controller.New(conf.ControllerHost, conf.ControllerPort)
+	if err == nil {
+		err = controller.CheckAPICompat(client, client.Healthcheck())
+	}
+	return ConfigCheck{Name: "controller", Err: err}
+}
+
+// checkStorage returns an error if the root of driver can't be listed.
+func checkStorage(driver storagedriver.StorageDriver) error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionCheckTimeout)
+	defer cancel()
+	if _, err := driver.List(ctx, "/"); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteConfigReport writes a line telling whether each of checks passed to w, and returns true if
+// they all did.
+func WriteConfigReport(w io.Writer, checks []ConfigCheck) bool {
+	passed := true
+	for _, c := range checks {
+		if c.Err != nil {
+			passed = false
+			fmt.Fprintf(w, "FAIL  %s (%s)\n", c.Name, c.Err)
+		} else {
+			fmt.Fprintf(w, "PASS  %s\n", c.Name)
+		}
+	}
+	return passed
+}
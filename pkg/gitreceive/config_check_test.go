@@ -0,0 +1,53 @@
+package gitreceive
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestCheckConfig(t *testing.T) {
+	conf := &Config{
+		ControllerHost:                "drycc-controller",
+		ControllerPort:                "80",
+		SlugBuilderImagePullPolicy:    "Always",
+		DockerBuilderImagePullPolicy:  "IfNotPresent",
+		BuilderPodNodeSelector:        "pool:build",
+		BuilderPodTickDurationMSec:    100,
+		BuilderPodWaitDurationMSec:    900000,
+		ObjectStorageTickDurationMSec: 500,
+		ObjectStorageWaitDurationMSec: 300000,
+		SourceMemoryLimit:             "256Mi",
+		StackCatalogPath:              "/nonexistent/catalog.json",
+		BuildProfilesPath:             "/nonexistent/profiles.json",
+		BuildPricesPath:               "/nonexistent/prices.json",
+		MessageCatalogPath:            "/nonexistent/messages.json",
+		AnalyzersPath:                 "/nonexistent/analyzers.json",
+	}
+	var out bytes.Buffer
+	assert.True(t, WriteConfigReport(&out, CheckConfig(conf)), "the config failed its check:\n"+out.String())
+
+	conf.DockerBuilderImagePullPolicy = "Sometimes"
+	conf.BuilderPodNodeSelector = "pool=build"
+	conf.BuilderPodMemoryLimit = "lots"
+	out.Reset()
+	assert.False(t, WriteConfigReport(&out, CheckConfig(conf)), "a misconfiguration passed its check")
+	var failed []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "FAIL") {
+			failed = append(failed, line[:strings.Index(line, " (")])
+		}
+	}
+	assert.Equal(t, failed, []string{"FAIL  image pull policies", "FAIL  builder pod node selector", "FAIL  memory limits"}, "failed checks")
+}
+
+func TestCheckStorage(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, checkStorage(store))
+}
@@ -0,0 +1,69 @@
+package gitreceive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// configDriftReason is the reason of the event recorded when the config of the app changed
+	// while it was being built.
+	configDriftReason = "ConfigDrift"
+	// The ways a change of the config during a build is handled: the build is released with a
+	// warning, or the push fails for the app to be built again with the new config.
+	configDriftWarn = "warn"
+	configDriftFail = "fail"
+)
+
+// configChanges returns the keys of the config values added, removed or changed from before to
+// after, marked like the changes since the last release.
+func configChanges(before, after map[string]interface{}) []string {
+	keys := func(values map[string]interface{}) []string {
+		names := make([]string, 0, len(values))
+		for k := range values {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return names
+	}
+	changed := func(k string) bool { return fmt.Sprintf("%v", before[k]) != fmt.Sprintf("%v", after[k]) }
+	return diffKeys("config", keys(before), keys(after), changed)
+}
+
+// checkConfigDrift fetches the config of the app again with fetch, right before it's released,
+// and compares it with before, the config it was built with. A change is reported to the pusher
+// and recorded, and fails the push if the builder is configured to. It returns the current
+// config, or before if it can't be fetched.
+func checkConfigDrift(
+	conf *Config,
+	fetch func() (dryccAPI.Config, error),
+	before dryccAPI.Config,
+	recorder *buildRecorder) (dryccAPI.Config, error) {
+
+	after, err := fetch()
+	if err != nil {
+		log.Debug("unable to fetch the config again to check it didn't change (%s)", err)
+		return before, nil
+	}
+	// the uuid of the config changes with every change, but older controllers don't set it
+	if before.UUID != "" && before.UUID == after.UUID {
+		return after, nil
+	}
+	changes := configChanges(before.Values, after.Values)
+	if len(changes) == 0 {
+		return after, nil
+	}
+	if conf.ConfigDrift == configDriftFail {
+		return after, policyError(fmt.Errorf("the config changed during the build (%s), push again to build with the new config", strings.Join(changes, ", ")))
+	}
+	log.Info("WARNING: the config changed during the build, which didn't see these changes:")
+	for _, change := range changes {
+		log.Info("    %s", change)
+	}
+	recorder.warn(configDriftReason, "the config changed during the build: %s", strings.Join(changes, ", "))
+	return after, nil
+}
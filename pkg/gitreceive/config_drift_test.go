@@ -0,0 +1,40 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestConfigChanges(t *testing.T) {
+	before := map[string]interface{}{"A": "1", "B": "2", "C": 3}
+	after := map[string]interface{}{"A": "1", "B": "two", "D": "4"}
+	assert.Equal(t, configChanges(before, after), []string{"~ config B", "+ config D", "- config C"}, "changes")
+	assert.Equal(t, len(configChanges(before, before)), 0, "changes of the same config")
+}
+
+func TestCheckConfigDrift(t *testing.T) {
+	before := dryccAPI.Config{UUID: "1", Values: map[string]interface{}{"DATABASE_URL": "postgres://old"}}
+	changed := dryccAPI.Config{UUID: "2", Values: map[string]interface{}{"DATABASE_URL": "postgres://new"}}
+	fetch := func(c dryccAPI.Config, err error) func() (dryccAPI.Config, error) {
+		return func() (dryccAPI.Config, error) { return c, err }
+	}
+
+	current, err := checkConfigDrift(&Config{ConfigDrift: configDriftWarn}, fetch(changed, nil), before, nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, current.UUID, "2", "current config after a warning")
+
+	_, err = checkConfigDrift(&Config{ConfigDrift: configDriftFail}, fetch(changed, nil), before, nil)
+	assert.Err(t, err, policyError(errors.New("the config changed during the build (~ config DATABASE_URL), push again to build with the new config")))
+
+	// a change that doesn't touch the values, e.g. of the memory limits, doesn't matter to builds
+	limits := dryccAPI.Config{UUID: "3", Values: before.Values}
+	_, err = checkConfigDrift(&Config{ConfigDrift: configDriftFail}, fetch(limits, nil), before, nil)
+	assert.NoErr(t, err)
+
+	current, err = checkConfigDrift(&Config{ConfigDrift: configDriftFail}, fetch(dryccAPI.Config{}, errors.New("unavailable")), before, nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, current.UUID, "1", "config when it can't be fetched")
+}
@@ -2,6 +2,9 @@ package gitreceive
 
 import (
 	"testing"
+	"time"
+
+	"github.com/arschles/assert"
 )
 
 type checkCase struct {
@@ -44,3 +47,12 @@ func TestCheckDurations(t *testing.T) {
 		}
 	}
 }
+
+func TestLongestBuild(t *testing.T) {
+	cnf := Config{ReleaseTimeoutMSec: 600000}
+	assert.Equal(t, cnf.LongestBuild(), time.Duration(0), "unlimited builds")
+	cnf.BuildTimeoutMSec = 3600000
+	assert.Equal(t, cnf.LongestBuild(), time.Hour, "builds")
+	cnf.AsyncReleases = true
+	assert.Equal(t, cnf.LongestBuild(), time.Hour+10*time.Minute, "builds followed by their deploy")
+}
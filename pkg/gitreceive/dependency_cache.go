@@ -0,0 +1,160 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// clearCachePushOption empties the build caches of the app before building it, e.g.
+// "-o clear-cache" after a corrupted download.
+const clearCachePushOption = "clear-cache"
+
+// dependencyCache is the cache directory of a language package manager, kept in a persistent
+// volume of each app between builds.
+type dependencyCache struct {
+	name string
+	// path is where the volume is mounted in slugbuilder pods.
+	path string
+	// env is the env var pointing the package manager to path, if it has one.
+	env string
+	// markers are the files of the apps using the package manager.
+	markers []string
+}
+
+// dependencyCaches are the dependency caches the builder knows about.
+var dependencyCaches = []dependencyCache{
+	{name: "maven", path: "/root/.m2/repository", markers: []string{"pom.xml"}},
+	{name: "npm", path: "/root/.npm", env: "npm_config_cache", markers: []string{"package.json"}},
+	{name: "pip", path: "/root/.cache/pip", env: "PIP_CACHE_DIR", markers: []string{"requirements.txt", "Pipfile", "setup.py", "pyproject.toml"}},
+	{name: "go", path: "/root/go/pkg/mod", env: "GOMODCACHE", markers: []string{"go.mod"}},
+}
+
+// claimClient is the subset of a
+// (k8s.io/client-go/kubernetes/typed/core/v1).PersistentVolumeClaimInterface needed to provision
+// the dependency caches.
+type claimClient interface {
+	Create(ctx context.Context, claim *corev1.PersistentVolumeClaim, opts metav1.CreateOptions) (*corev1.PersistentVolumeClaim, error)
+}
+
+// enabledDependencyCaches returns the dependency caches named in the comma separated config, e.g.
+// "maven,npm".
+func enabledDependencyCaches(config string) ([]dependencyCache, error) {
+	var enabled []dependencyCache
+	for _, name := range strings.Split(config, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, cache := range dependencyCaches {
+			if cache.name == name {
+				enabled = append(enabled, cache)
+				found = true
+			}
+		}
+		if !found {
+			var names []string
+			for _, cache := range dependencyCaches {
+				names = append(names, cache.name)
+			}
+			return nil, fmt.Errorf("unknown dependency cache %q, use %s", name, strings.Join(names, ", "))
+		}
+	}
+	return enabled, nil
+}
+
+// usedDependencyCaches returns the caches of the package managers the source in dir uses.
+func usedDependencyCaches(caches []dependencyCache, dir string) []dependencyCache {
+	var used []dependencyCache
+	for _, cache := range caches {
+		for _, marker := range cache.markers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				used = append(used, cache)
+				break
+			}
+		}
+	}
+	return used
+}
+
+// dependencyCacheClaimName returns the name of the claim of the cache of appName.
+func dependencyCacheClaimName(appName string, cache dependencyCache) string {
+	return fmt.Sprintf("%s-%s-cache", appName, cache.name)
+}
+
+// provisionDependencyCaches creates the claims of the caches of appName that don't exist yet, of
+// the given size and storage class, or the default class if it's empty.
+func provisionDependencyCaches(claims claimClient, appName string, caches []dependencyCache, size, storageClass string) error {
+	if len(caches) == 0 {
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return fmt.Errorf("invalid dependency cache size %q (%s)", size, err)
+	}
+	for _, cache := range caches {
+		claim := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   dependencyCacheClaimName(appName, cache),
+				Labels: map[string]string{"heritage": "drycc", "app": appName},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+				},
+			},
+		}
+		if storageClass != "" {
+			claim.Spec.StorageClassName = &storageClass
+		}
+		_, err := claims.Create(context.TODO(), claim, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("creating the %s cache volume of %s (%s)", cache.name, appName, err)
+		}
+	}
+	return nil
+}
+
+// mountDependencyCaches mounts the claims of the caches of appName into the builder container of
+// pod. If clear is set, an init container empties them first.
+func mountDependencyCaches(pod *corev1.Pod, appName string, caches []dependencyCache, clear bool) {
+	if len(caches) == 0 || len(pod.Spec.Containers) == 0 {
+		return
+	}
+	var mounts []corev1.VolumeMount
+	var paths []string
+	for _, cache := range caches {
+		name := dependencyCacheClaimName(appName, cache)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: cache.path})
+		paths = append(paths, cache.path)
+		if cache.env != "" {
+			addEnvToPod(*pod, cache.env, cache.path)
+		}
+	}
+	builder := &pod.Spec.Containers[0]
+	builder.VolumeMounts = append(builder.VolumeMounts, mounts...)
+	if clear {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+			Name:            "clear-cache",
+			Image:           builder.Image,
+			ImagePullPolicy: builder.ImagePullPolicy,
+			Command:         append([]string{"find"}, append(paths, "-mindepth", "1", "-delete")...),
+			VolumeMounts:    mounts,
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeClaims struct {
+	created []*corev1.PersistentVolumeClaim
+	err     error
+}
+
+func (f *fakeClaims) Create(ctx context.Context, claim *corev1.PersistentVolumeClaim, opts metav1.CreateOptions) (*corev1.PersistentVolumeClaim, error) {
+	f.created = append(f.created, claim)
+	return claim, f.err
+}
+
+func TestEnabledDependencyCaches(t *testing.T) {
+	caches, err := enabledDependencyCaches("")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(caches), 0, "caches enabled by default")
+
+	caches, err = enabledDependencyCaches("npm, maven")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(caches), 2, "enabled caches")
+	assert.Equal(t, caches[0].name, "npm", "first cache")
+	assert.Equal(t, caches[1].name, "maven", "second cache")
+
+	_, err = enabledDependencyCaches("npm,cargo")
+	assert.Err(t, err, errors.New(`unknown dependency cache "cargo", use maven, npm, pip, go`))
+}
+
+func TestUsedDependencyCaches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dependency-caches")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, "Pipfile"), []byte(""), 0644))
+
+	used := usedDependencyCaches(dependencyCaches, dir)
+	assert.Equal(t, len(used), 2, "used caches")
+	assert.Equal(t, used[0].name, "npm", "first cache")
+	assert.Equal(t, used[1].name, "pip", "second cache")
+}
+
+func TestProvisionDependencyCaches(t *testing.T) {
+	claims := &fakeClaims{}
+	assert.NoErr(t, provisionDependencyCaches(claims, "app", nil, "lots", ""))
+	assert.Equal(t, len(claims.created), 0, "claims created without caches")
+
+	caches, _ := enabledDependencyCaches("npm,pip")
+	assert.NoErr(t, provisionDependencyCaches(claims, "app", caches, "5Gi", "fast"))
+	assert.Equal(t, len(claims.created), 2, "created claims")
+	claim := claims.created[0]
+	assert.Equal(t, claim.Name, "app-npm-cache", "claim name")
+	size := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, size.String(), "5Gi", "claim size")
+	assert.Equal(t, *claim.Spec.StorageClassName, "fast", "storage class")
+
+	claims = &fakeClaims{err: apierrors.NewAlreadyExists(schema.GroupResource{Resource: "persistentvolumeclaims"}, "app-npm-cache")}
+	assert.NoErr(t, provisionDependencyCaches(claims, "app", caches, "5Gi", ""))
+	assert.True(t, claims.created[0].Spec.StorageClassName == nil, "storage class without one configured")
+
+	claims = &fakeClaims{err: errors.New("forbidden")}
+	err := provisionDependencyCaches(claims, "app", caches, "5Gi", "")
+	assert.Err(t, err, errors.New("creating the npm cache volume of app (forbidden)"))
+	assert.True(t, provisionDependencyCaches(claims, "app", caches, "lots", "") != nil, "accepted an invalid size")
+}
+
+func TestMountDependencyCaches(t *testing.T) {
+	caches, _ := enabledDependencyCaches("maven,npm")
+	pod := buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	pod.Spec.Containers[0].Image = "drycc/slugbuilder"
+	mountDependencyCaches(&pod, "app", caches, false)
+	assert.Equal(t, len(pod.Spec.Volumes), 3, "volumes")
+	assert.Equal(t, pod.Spec.Volumes[1].PersistentVolumeClaim.ClaimName, "app-maven-cache", "claim")
+	mounts := pod.Spec.Containers[0].VolumeMounts
+	assert.Equal(t, mounts[len(mounts)-1], corev1.VolumeMount{Name: "app-npm-cache", MountPath: "/root/.npm"}, "mount")
+	assert.Equal(t, podEnv(&pod, "npm_config_cache"), "/root/.npm", "npm cache env")
+	assert.Equal(t, len(pod.Spec.InitContainers), 0, "init containers without clearing the caches")
+
+	pod = buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	pod.Spec.Containers[0].Image = "drycc/slugbuilder"
+	mountDependencyCaches(&pod, "app", caches, true)
+	clear := pod.Spec.InitContainers[0]
+	assert.Equal(t, clear.Image, "drycc/slugbuilder", "image of the init container")
+	assert.Equal(t, clear.Command, []string{"find", "/root/.m2/repository", "/root/.npm", "-mindepth", "1", "-delete"}, "command")
+	assert.Equal(t, len(clear.VolumeMounts), 2, "mounts of the init container")
+
+	debug := newDebugPod(&pod, "", 0)
+	assert.Equal(t, len(debug.Spec.InitContainers), 0, "init containers of the debug pod")
+}
@@ -0,0 +1,118 @@
+package gitreceive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/drycc/pkg/log"
+)
+
+// freeSpace returns the number of bytes available to the builder on the filesystem of path.
+var freeSpace = func(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// treeSize returns the total size of the files of rev in the repo at repoDir, as checked out.
+func treeSize(repoDir, rev string) (int64, error) {
+	out, err := repoCmd(repoDir, "git", "ls-tree", "-r", "-l", rev).Output()
+	if err != nil {
+		return 0, fmt.Errorf("listing the files of %s (%s)", rev, err)
+	}
+	var size int64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// <mode> <type> <object> <size>\t<path>, with a size of "-" for submodules
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "\t", 2)[0])
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("reading the size of a file of %s (%s)", rev, err)
+		}
+		size += n
+	}
+	return size, scanner.Err()
+}
+
+// requiredDiskSpace returns the disk space the checkout of a source of size bytes takes. The
+// archive, written to the repo by ArchiveCheckout, is at most as large as the source.
+func requiredDiskSpace(mode string, size int64) int64 {
+	if mode == WorktreeCheckout {
+		return size
+	}
+	return 2 * size
+}
+
+// buildDirectory returns the directory the builds of repo check their source out into: under
+// conf.BuildTmpDir if it's set, e.g. a fast local disk or a tmpfs, else in the repo at repoDir,
+// which the git home may keep on a slow network volume.
+func buildDirectory(conf *Config, repo, repoDir string) string {
+	if conf.BuildTmpDir != "" {
+		return filepath.Join(conf.BuildTmpDir, repo)
+	}
+	return filepath.Join(repoDir, "build")
+}
+
+// removeBuildLeftovers removes what earlier builds of the repo at repoDir left behind: the
+// checkouts in buildDir and the source archives. Pushes to a repo don't run concurrently, so none
+// of them is in use.
+func removeBuildLeftovers(repoDir, buildDir string) {
+	leftovers, _ := filepath.Glob(filepath.Join(buildDir, "*"))
+	archives, _ := filepath.Glob(filepath.Join(repoDir, "*.tar.*"))
+	for _, path := range append(leftovers, archives...) {
+		log.Debug("removing build leftover %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Debug("unable to remove build leftover %s (%s)", path, err)
+		}
+	}
+}
+
+// checkDiskSpace makes sure that the filesystems of the repo at repoDir, of buildDir and of the
+// temp directory have room for the checkout of rev into buildDir, plus conf.DiskSpaceMargin. If one
+// doesn't, the leftovers of earlier builds are removed before checking again, and the build fails
+// fast rather than running out of space halfway through.
+func checkDiskSpace(conf *Config, repoDir, buildDir, rev string) error {
+	margin, err := parseMemory(conf.DiskSpaceMargin)
+	if err != nil {
+		return fmt.Errorf("invalid disk space margin %q (%s)", conf.DiskSpaceMargin, err)
+	}
+	size, err := treeSize(repoDir, rev)
+	if err != nil {
+		// the check only saves time, the build itself reports a full disk
+		log.Debug("unable to estimate the size of the source (%s)", err)
+		return nil
+	}
+	needed := requiredDiskSpace(conf.SourceCheckout, size) + margin.Value()
+	dirs := []string{repoDir, os.TempDir()}
+	if conf.BuildTmpDir != "" {
+		// buildDir itself may not exist yet
+		dirs = append(dirs, conf.BuildTmpDir)
+	}
+	for _, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			log.Debug("unable to read the free space in %s (%s)", dir, err)
+			continue
+		}
+		if free >= needed {
+			continue
+		}
+		removeBuildLeftovers(repoDir, buildDir)
+		if free, err = freeSpace(dir); err == nil && free >= needed {
+			continue
+		}
+		return fmt.Errorf("not enough disk space in %s to build: %s free, about %s needed for a source of %s", dir, formatSize(free), formatSize(needed), formatSize(size))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(home)
+	work := filepath.Join(home, "work")
+	repoDir := filepath.Join(home, "app.git")
+	buildDir := filepath.Join(repoDir, "build")
+	assert.NoErr(t, os.MkdirAll(work, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(work, "Procfile"), []byte("web: ./web"), 0644))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(work, "web"), make([]byte, 1000), 0755))
+	for _, args := range [][]string{
+		{"init", work},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "test"},
+		{"clone", "--bare", work, repoDir},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+	}
+	out, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
+	assert.NoErr(t, err)
+	rev := strings.TrimSpace(string(out))
+
+	size, err := treeSize(repoDir, rev)
+	assert.NoErr(t, err)
+	assert.Equal(t, size, int64(1010), "size of the source")
+
+	// the disk is full until the leftovers of an earlier build are removed
+	leftover := filepath.Join(buildDir, "tmp123")
+	assert.NoErr(t, os.MkdirAll(leftover, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(repoDir, "app.tar.gz"), []byte("archive"), 0644))
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(string) (int64, error) {
+		if _, err := os.Stat(leftover); err == nil {
+			return 0, nil
+		}
+		return 2020, nil
+	}
+	conf := &Config{SourceCheckout: ArchiveCheckout}
+	assert.NoErr(t, checkDiskSpace(conf, repoDir, buildDir, rev))
+	_, err = os.Stat(filepath.Join(repoDir, "app.tar.gz"))
+	assert.True(t, os.IsNotExist(err), "the archive of an earlier build wasn't removed")
+
+	conf.DiskSpaceMargin = "1Ki"
+	err = checkDiskSpace(conf, repoDir, buildDir, rev)
+	assert.True(t, err != nil, "the margin doesn't fit")
+	assert.True(t, strings.Contains(err.Error(), "not enough disk space"), err.Error())
+
+	conf.SourceCheckout = WorktreeCheckout
+	conf.DiskSpaceMargin = "1000"
+	assert.NoErr(t, checkDiskSpace(conf, repoDir, buildDir, rev))
+
+	// a full BUILD_TMP_DIR fails the build too
+	conf.BuildTmpDir = filepath.Join(home, "builds")
+	freeSpace = func(dir string) (int64, error) {
+		if dir == conf.BuildTmpDir {
+			return 100, nil
+		}
+		return 1 << 30, nil
+	}
+	err = checkDiskSpace(conf, repoDir, buildDirectory(conf, "app.git", repoDir), rev)
+	assert.True(t, err != nil && strings.Contains(err.Error(), conf.BuildTmpDir), "the build directory doesn't fit")
+}
+
+func TestBuildDirectory(t *testing.T) {
+	conf := &Config{}
+	assert.Equal(t, buildDirectory(conf, "app.git", "/home/git/app.git"), "/home/git/app.git/build", "build directory in the repo")
+	conf.BuildTmpDir = "/var/lib/drycc/builds"
+	assert.Equal(t, buildDirectory(conf, "app.git", "/home/git/app.git"), "/var/lib/drycc/builds/app.git", "build directory under BUILD_TMP_DIR")
+}
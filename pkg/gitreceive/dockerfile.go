@@ -0,0 +1,391 @@
+package gitreceive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	dockerfileName = "Dockerfile"
+	// dockerfileLintIgnoreKey is the app config key listing the rules of the Dockerfile linter the
+	// app ignores, e.g. DL3007,DL3020.
+	dockerfileLintIgnoreKey = "DRYCC_DOCKERFILE_LINT_IGNORE"
+)
+
+// dockerfileInstructions are the instructions of Dockerfiles.
+var dockerfileInstructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true, "ENV": true,
+	"EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true, "MAINTAINER": true,
+	"ONBUILD": true, "RUN": true, "SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true,
+	"WORKDIR": true,
+}
+
+var (
+	dockerfileDirective = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+	dockerfileHeredoc   = regexp.MustCompile(`(?:^|\s)<<(-?)["']?([a-zA-Z_][a-zA-Z0-9_]*)["']?`)
+	dockerfilePort      = regexp.MustCompile(`^\d+(-\d+)?(/(tcp|udp|sctp))?$`)
+	archiveExtension    = regexp.MustCompile(`\.(tar|tar\.gz|tgz|tar\.bz2|tbz2|tar\.xz|txz|tar\.zst)$`)
+)
+
+// dockerfileInstruction is an instruction of a Dockerfile, with its flags, e.g. --from=build, and
+// its arguments.
+type dockerfileInstruction struct {
+	line  int
+	cmd   string
+	flags map[string]string
+	args  string
+	// unterminated is the heredoc of the instruction that isn't terminated, if it has one.
+	unterminated string
+}
+
+// heredocInstructions are the instructions whose arguments can start heredocs.
+var heredocInstructions = map[string]bool{"ADD": true, "COPY": true, "RUN": true}
+
+// checkDockerfile checks the Dockerfile in dirName, which the container build of the app of
+// appConf builds, so that a Dockerfile that can't be built fails the push before a builder pod is
+// started. The mistakes it finds that still build are printed as warnings, except for the rules
+// the builder or the app ignore.
+func checkDockerfile(conf *Config, dirName string, appConf dryccAPI.Config) error {
+	if !conf.DockerfileLint {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dirName, dockerfileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error in reading the %s (%s)", dockerfileName, err)
+	}
+	target := ""
+	if conf.BuildKit {
+		target = configString(appConf, buildTargetKey)
+	}
+	warnings, err := lintDockerfile(raw, target)
+	if err != nil {
+		return err
+	}
+	ignored := make(map[string]bool)
+	for _, rules := range []string{conf.DockerfileLintIgnore, configString(appConf, dockerfileLintIgnoreKey)} {
+		for _, rule := range strings.Split(rules, ",") {
+			ignored[strings.ToUpper(strings.TrimSpace(rule))] = true
+		}
+	}
+	for _, warning := range warnings {
+		if !ignored[warning.rule] {
+			log.Info("WARNING: %s line %d: %s %s", dockerfileName, warning.line, warning.rule, warning.message)
+		}
+	}
+	return nil
+}
+
+// dockerfileWarning is a mistake of a Dockerfile that still builds, found by the rule of the
+// hadolint rules of the same ID.
+type dockerfileWarning struct {
+	line    int
+	rule    string
+	message string
+}
+
+// lintDockerfile returns an error if the raw Dockerfile, built up to its target stage if target
+// is set, can't be built, and the warnings about the mistakes it still builds with otherwise.
+// Dockerfiles that use another frontend than the Dockerfile one, with a syntax directive, are
+// only parsed by it, and aren't checked.
+func lintDockerfile(raw []byte, target string) ([]dockerfileWarning, error) {
+	instructions, directives, err := parseDockerfile(raw)
+	if err != nil {
+		return nil, err
+	}
+	if syntax, ok := directives["syntax"]; ok && !strings.Contains(syntax, "docker/dockerfile") {
+		return nil, nil
+	}
+
+	var warnings []dockerfileWarning
+	warn := func(i dockerfileInstruction, rule, format string, args ...interface{}) {
+		warnings = append(warnings, dockerfileWarning{line: i.line, rule: rule, message: fmt.Sprintf(format, args...)})
+	}
+	stages := make(map[string]bool)
+	from := false
+	var cmds, entrypoints int
+	var user *dockerfileInstruction
+	for n, i := range instructions {
+		// heredocs the parser couldn't find the end of may not be heredocs at all
+		if i.unterminated != "" {
+			warn(i, "DL1000", "the heredoc %s isn't terminated, the rest of the %s is its content", i.unterminated, dockerfileName)
+		}
+		// only ARG instructions, whose arguments FROM can use, come before the first FROM
+		if !from && i.cmd != "FROM" && i.cmd != "ARG" {
+			return nil, fmt.Errorf("%s line %d: the first instruction must be FROM, not %s", dockerfileName, i.line, i.cmd)
+		}
+		if i.args == "" {
+			return nil, fmt.Errorf("%s line %d: %s has no arguments", dockerfileName, i.line, i.cmd)
+		}
+		switch i.cmd {
+		case "FROM":
+			fields := strings.Fields(i.args)
+			if len(fields) != 1 && (len(fields) != 3 || !strings.EqualFold(fields[1], "AS")) {
+				return nil, fmt.Errorf("%s line %d: FROM takes an image and an optional stage name, as in FROM <image> AS <name>", dockerfileName, i.line)
+			}
+			image := fields[0]
+			if !stages[strings.ToLower(image)] && image != "scratch" && !strings.Contains(image, "$") && !strings.Contains(image, "@") {
+				if tag := imageTag(image); tag == "" {
+					warn(i, "DL3006", "always tag the version of the image %s", image)
+				} else if tag == "latest" {
+					warn(i, "DL3007", "%s is a moving tag, pin the version of the image %s", tag, image)
+				}
+			}
+			if len(fields) == 3 {
+				stages[strings.ToLower(fields[2])] = true
+			}
+			from, cmds, entrypoints, user = true, 0, 0, nil
+		case "EXPOSE":
+			for _, port := range strings.Fields(i.args) {
+				if !strings.Contains(port, "$") && !dockerfilePort.MatchString(strings.ToLower(port)) {
+					return nil, fmt.Errorf("%s line %d: invalid port %q, use <port>[/<protocol>]", dockerfileName, i.line, port)
+				}
+			}
+		case "WORKDIR":
+			dir := strings.Trim(i.args, `"'`)
+			if !path.IsAbs(dir) && !strings.HasPrefix(dir, "$") {
+				warn(i, "DL3000", "use an absolute WORKDIR, not %s", dir)
+			}
+		case "USER":
+			user = &instructions[n]
+		case "CMD":
+			if cmds++; cmds == 2 {
+				warn(i, "DL4003", "only the last CMD of a stage takes effect")
+			}
+		case "ENTRYPOINT":
+			if entrypoints++; entrypoints == 2 {
+				warn(i, "DL4004", "only the last ENTRYPOINT of a stage takes effect")
+			}
+		case "MAINTAINER":
+			warn(i, "DL4000", "MAINTAINER is deprecated, use LABEL maintainer=... instead")
+		case "ADD":
+			if _, ok := i.flags["checksum"]; !ok && addsLocalFiles(i.args) {
+				warn(i, "DL3020", "use COPY instead of ADD for files and directories")
+			}
+		case "RUN":
+			for _, command := range shellCommands(i.args) {
+				switch {
+				case len(command) > 0 && command[0] == "sudo":
+					warn(i, "DL3004", "don't use sudo, RUN runs as root unless USER says otherwise")
+				case len(command) > 0 && command[0] == "cd":
+					warn(i, "DL3003", "use WORKDIR to change directories")
+				case len(command) > 1 && command[0] == "apt-get" && contains(command, "install") && !hasYesFlag(command):
+					warn(i, "DL3014", "apt-get install waits for a confirmation the build can't give, use apt-get install -y")
+				}
+			}
+		}
+	}
+	if !from {
+		return nil, fmt.Errorf("the %s has no FROM instruction", dockerfileName)
+	}
+	if target != "" && !stages[strings.ToLower(target)] {
+		return nil, fmt.Errorf("the %s has no stage named %s, which %s builds", dockerfileName, target, buildTargetKey)
+	}
+	if user != nil && target == "" {
+		name := strings.SplitN(user.args, ":", 2)[0]
+		if name == "root" || name == "0" {
+			warn(*user, "DL3002", "the image runs as root, switch to another USER at the end of the last stage")
+		}
+	}
+	return warnings, nil
+}
+
+// parseDockerfile returns the instructions of the raw Dockerfile, and its parser directives, such
+// as the escape character and the syntax. Dockerfiles of other frontends have no instructions.
+func parseDockerfile(raw []byte) ([]dockerfileInstruction, map[string]string, error) {
+	// like docker, ignore the byte order mark of files saved with one
+	raw = bytes.TrimPrefix(raw, []byte("\ufeff"))
+	lines := strings.Split(strings.Replace(string(raw), "\r\n", "\n", -1), "\n")
+	directives := make(map[string]string)
+	start := 0
+	for ; start < len(lines); start++ {
+		m := dockerfileDirective.FindStringSubmatch(lines[start])
+		if m == nil {
+			break
+		}
+		directives[strings.ToLower(m[1])] = m[2]
+	}
+	escape := `\`
+	if e, ok := directives["escape"]; ok {
+		if e != `\` && e != "`" {
+			return nil, nil, fmt.Errorf("%s line %d: invalid escape character %q, use \\ or `", dockerfileName, start, e)
+		}
+		escape = e
+	}
+	if syntax, ok := directives["syntax"]; ok && !strings.Contains(syntax, "docker/dockerfile") {
+		return nil, directives, nil
+	}
+
+	var instructions []dockerfileInstruction
+	for n := start; n < len(lines); n++ {
+		line := strings.TrimSpace(lines[n])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		first := n + 1
+		// lines ending with the escape character continue on the next one, skipping comments and
+		// empty lines
+		for strings.HasSuffix(line, escape) && n+1 < len(lines) {
+			n++
+			if next := strings.TrimSpace(lines[n]); next != "" && !strings.HasPrefix(next, "#") {
+				line = strings.TrimSuffix(line, escape) + " " + next
+			}
+		}
+		line = strings.TrimSuffix(line, escape)
+		fields := []string{line}
+		if end := strings.IndexAny(line, " \t"); end >= 0 {
+			fields = []string{line[:end], line[end+1:]}
+		}
+		i := dockerfileInstruction{line: first, cmd: strings.ToUpper(fields[0]), flags: make(map[string]string)}
+		if !dockerfileInstructions[i.cmd] {
+			return nil, nil, fmt.Errorf("%s line %d: unknown instruction %s", dockerfileName, first, fields[0])
+		}
+		if len(fields) > 1 {
+			i.args = strings.TrimSpace(fields[1])
+		}
+		for strings.HasPrefix(i.args, "--") {
+			fields := strings.Fields(i.args)
+			if len(fields) > 1 {
+				fields = []string{fields[0], strings.TrimSpace(i.args[len(fields[0]):])}
+			}
+			flag := strings.SplitN(strings.TrimPrefix(fields[0], "--"), "=", 2)
+			i.flags[flag[0]] = ""
+			if len(flag) > 1 {
+				i.flags[flag[0]] = flag[1]
+			}
+			i.args = ""
+			if len(fields) > 1 {
+				i.args = strings.TrimSpace(fields[1])
+			}
+		}
+		// the lines of heredocs, e.g. RUN <<EOF, are the content of the instruction
+		var heredocs [][]string
+		if heredocInstructions[i.cmd] {
+			heredocs = dockerfileHeredoc.FindAllStringSubmatch(withoutArithmetic(i.args), -1)
+		}
+		for _, m := range heredocs {
+			for n++; n < len(lines); n++ {
+				l := lines[n]
+				if m[1] == "-" {
+					l = strings.TrimLeft(l, "\t")
+				}
+				if l == m[2] {
+					break
+				}
+			}
+			if n == len(lines) {
+				i.unterminated = m[2]
+				break
+			}
+		}
+		instructions = append(instructions, i)
+	}
+	return instructions, directives, nil
+}
+
+// withoutArithmetic returns the shell command s without its arithmetic expansions, such as
+// $((1<<BITS)), whose shifts aren't heredocs.
+func withoutArithmetic(s string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "$((")
+		if start < 0 {
+			return b.String() + s
+		}
+		b.WriteString(s[:start])
+		depth, end := 0, len(s)
+		for j := start + 1; j < len(s); j++ {
+			if s[j] == '(' {
+				depth++
+			} else if s[j] == ')' {
+				if depth--; depth == 0 {
+					end = j + 1
+					break
+				}
+			}
+		}
+		b.WriteString(" ")
+		s = s[end:]
+	}
+}
+
+// imageTag returns the tag of image, "" if it has none.
+func imageTag(image string) string {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// addsLocalFiles returns true if the arguments of an ADD instruction only add files of the build
+// context that aren't archives, which ADD would extract.
+func addsLocalFiles(args string) bool {
+	var sources []string
+	if strings.HasPrefix(args, "[") {
+		var list []string
+		for _, s := range strings.Split(strings.Trim(args, "[]"), ",") {
+			list = append(list, strings.Trim(strings.TrimSpace(s), `"`))
+		}
+		sources = list
+	} else {
+		sources = strings.Fields(args)
+	}
+	if len(sources) < 2 {
+		return false
+	}
+	for _, source := range sources[:len(sources)-1] {
+		if strings.Contains(source, "://") || strings.HasPrefix(source, "git@") || archiveExtension.MatchString(source) {
+			return false
+		}
+	}
+	return true
+}
+
+// shellCommands returns the words of the commands of the shell form of a RUN instruction, split at
+// the operators chaining them.
+func shellCommands(args string) [][]string {
+	if strings.HasPrefix(args, "[") {
+		return nil
+	}
+	var commands [][]string
+	var command []string
+	for _, word := range strings.Fields(args) {
+		switch word {
+		case "&&", "||", ";", "|":
+			commands, command = append(commands, command), nil
+			continue
+		}
+		if strings.HasSuffix(word, ";") {
+			command = append(command, strings.TrimSuffix(word, ";"))
+			commands, command = append(commands, command), nil
+			continue
+		}
+		if unquoted, err := strconv.Unquote(word); err == nil {
+			word = unquoted
+		}
+		command = append(command, word)
+	}
+	return append(commands, command)
+}
+
+// hasYesFlag returns true if the apt-get command answers yes to its confirmations.
+func hasYesFlag(command []string) bool {
+	for _, word := range command {
+		if word == "--yes" || word == "--assume-yes" || strings.HasPrefix(word, "-") && !strings.HasPrefix(word, "--") && strings.Contains(word, "y") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package gitreceive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+// rules returns the rules of warnings, in order.
+func rules(warnings []dockerfileWarning) []string {
+	var ids []string
+	for _, w := range warnings {
+		ids = append(ids, w.rule)
+	}
+	return ids
+}
+
+func TestLintDockerfile(t *testing.T) {
+	warnings, err := lintDockerfile([]byte(`# syntax=docker/dockerfile:1
+ARG VERSION=1.21
+FROM golang:${VERSION} AS build
+WORKDIR /src
+# dependencies first
+RUN apt-get update \
+  # the build tools
+  && apt-get install -y make \
+  && rm -rf /var/lib/apt/lists/*
+RUN <<EOF
+cd /src
+make
+EOF
+COPY . .
+
+FROM scratch
+COPY --from=build /src/app /app
+EXPOSE 8080/tcp ${PORT}
+USER 1000
+CMD ["/app"]
+`), "build")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(warnings), 0, "warnings of a valid Dockerfile")
+
+	warnings, err = lintDockerfile([]byte(`MAINTAINER me
+`), "")
+	assert.Err(t, err, errors.New("Dockerfile line 1: the first instruction must be FROM, not MAINTAINER"))
+
+	warnings, err = lintDockerfile([]byte(`FROM ubuntu
+MAINTAINER me@example.com
+FROM node:latest AS web
+WORKDIR app
+ADD package.json /app/
+ADD https://example.com/app.tar.gz /app/
+RUN cd /app && sudo npm install
+RUN apt-get install curl
+CMD ["node"]
+CMD ["npm", "start"]
+FROM web
+USER root
+`), "")
+	assert.NoErr(t, err)
+	expected := []string{"DL3006", "DL4000", "DL3007", "DL3000", "DL3020", "DL3003", "DL3004", "DL3014", "DL4003", "DL3002"}
+	assert.Equal(t, rules(warnings), expected, "rules")
+	assert.Equal(t, warnings[0].line, 1, "line of the first warning")
+	assert.Equal(t, warnings[len(warnings)-1].line, 12, "line of the last warning")
+
+	// like docker, byte order marks, tabs and arithmetic shifts are fine, and heredocs the end of
+	// which isn't found only warned about
+	warnings, err = lintDockerfile([]byte("\ufeffFROM\talpine:3\nARG BITS=4\nRUN echo $((1<<BITS)) $(( (1 << 2) <<BITS ))\nRUN cat <<EOF\nmake\n"), "")
+	assert.NoErr(t, err)
+	assert.Equal(t, rules(warnings), []string{"DL1000"}, "rules")
+	assert.Equal(t, warnings[0].line, 4, "line of the unterminated heredoc")
+
+	// the checks of other frontends are theirs
+	warnings, err = lintDockerfile([]byte("# syntax=example.com/frontend\nBUILD app\n"), "")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(warnings), 0, "warnings of another frontend")
+}
+
+func TestLintDockerfileErrors(t *testing.T) {
+	for _, c := range []struct {
+		dockerfile string
+		target     string
+		err        string
+	}{
+		{"", "", "the Dockerfile has no FROM instruction"},
+		{"ARG VERSION\n", "", "the Dockerfile has no FROM instruction"},
+		{"FROM alpine:3\nRUNN make\n", "", "Dockerfile line 2: unknown instruction RUNN"},
+		{"FROM alpine:3\nWORKDIR\n", "", "Dockerfile line 2: WORKDIR has no arguments"},
+		{"FROM alpine:3 build\n", "", "Dockerfile line 1: FROM takes an image and an optional stage name, as in FROM <image> AS <name>"},
+		{"FROM alpine:3\nEXPOSE 80/http\n", "", `Dockerfile line 2: invalid port "80/http", use <port>[/<protocol>]`},
+		{"# escape=/\nFROM alpine:3\n", "", "Dockerfile line 1: invalid escape character \"/\", use \\ or `"},
+		{"FROM alpine:3 AS build\n", "test", "the Dockerfile has no stage named test, which DRYCC_BUILD_TARGET builds"},
+	} {
+		_, err := lintDockerfile([]byte(c.dockerfile), c.target)
+		assert.Err(t, err, errors.New(c.err))
+	}
+
+	// lines continue with the escape character of the escape directive
+	_, err := lintDockerfile([]byte("# escape=`\nFROM alpine:3\nRUN make `\n  install\n"), "")
+	assert.NoErr(t, err)
+}
+
+func TestCheckDockerfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfile")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{DockerfileLint: true, DockerfileLintIgnore: "DL3007"}
+	assert.NoErr(t, checkDockerfile(conf, dir, dryccAPI.Config{}))
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, dockerfileName), []byte("FROM alpine:latest\nRUNN make\n"), 0644))
+	assert.Err(t, checkDockerfile(conf, dir, dryccAPI.Config{}), errors.New("Dockerfile line 2: unknown instruction RUNN"))
+	conf.DockerfileLint = false
+	assert.NoErr(t, checkDockerfile(conf, dir, dryccAPI.Config{}))
+
+	// the target is only built, and checked, with BuildKit
+	conf = &Config{DockerfileLint: true}
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, dockerfileName), []byte("FROM alpine:3\n"), 0644))
+	appConf := dryccAPI.Config{Values: map[string]interface{}{buildTargetKey: "test"}}
+	assert.NoErr(t, checkDockerfile(conf, dir, appConf))
+	conf.BuildKit = true
+	assert.Err(t, checkDockerfile(conf, dir, appConf), errors.New("the Dockerfile has no stage named test, which DRYCC_BUILD_TARGET builds"))
+}
@@ -0,0 +1,107 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errDryRun rejects a dry-run push once its build was planned, so that git doesn't update the
+// pushed refs and the same commit can be pushed again for real.
+var errDryRun = userError(errors.New("dry run complete, nothing was built or released and the push was not applied"))
+
+// dryRunPlan is what a build would do. It's printed instead of building when the dry-run push
+// option is given.
+type dryRunPlan struct {
+	Stack map[string]string
+	// Image is the image or slug the build would release.
+	Image string
+	Pod   *corev1.Pod
+	// CacheKey is the key of the build cache, or "" if caching is disabled.
+	CacheKey  string
+	CacheSize int64
+	// Config lists the config defaults app.json would set.
+	Config map[string]string
+	// Strategy is the rollout strategy requested for the release, if any.
+	Strategy string
+	// SlugRunner is the slugrunner image the app pinned, if any.
+	SlugRunner string
+}
+
+// lines returns the plan as the lines printed to the pusher.
+func (p dryRunPlan) lines() []string {
+	stack := p.Stack["name"]
+	if version := p.Stack["version"]; version != "" {
+		stack = fmt.Sprintf("%s %s", stack, version)
+	}
+	lines := []string{
+		fmt.Sprintf("Stack: %s (%s)", stack, p.Stack["image"]),
+		fmt.Sprintf("Image: %s", p.Image),
+	}
+	if p.Pod != nil {
+		lines = append(lines, fmt.Sprintf("Builder pod: %s/%s", p.Pod.Namespace, p.Pod.Name))
+		if len(p.Pod.Spec.Containers) > 0 {
+			res := p.Pod.Spec.Containers[0].Resources
+			if len(res.Requests) == 0 && len(res.Limits) == 0 {
+				lines = append(lines, "Resources: no requests or limits")
+			} else {
+				lines = append(lines, fmt.Sprintf("Resources: requests %s, limits %s", formatResources(res.Requests), formatResources(res.Limits)))
+			}
+		}
+	}
+	if p.CacheKey == "" {
+		lines = append(lines, "Cache: disabled")
+	} else {
+		lines = append(lines, fmt.Sprintf("Cache: %s, %d bytes", p.CacheKey, p.CacheSize))
+	}
+	if len(p.Config) > 0 {
+		keys := make([]string, 0, len(p.Config))
+		for k := range p.Config {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		lines = append(lines, fmt.Sprintf("Config from %s: %s", appJSONName, strings.Join(keys, ", ")))
+	}
+	if p.Strategy != "" {
+		lines = append(lines, fmt.Sprintf("Release strategy: %s", p.Strategy))
+	}
+	if p.SlugRunner != "" {
+		lines = append(lines, fmt.Sprintf("Slugrunner: %s", p.SlugRunner))
+	}
+	return lines
+}
+
+func (p dryRunPlan) print() {
+	log.Info("Dry run, the build would use:")
+	for _, line := range p.lines() {
+		log.Info("    %s", line)
+	}
+}
+
+func formatResources(list corev1.ResourceList) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(list))
+	for name := range list {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		q := list[corev1.ResourceName(name)]
+		names[i] = fmt.Sprintf("%s=%s", name, q.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// cacheUsage returns the number of bytes stored under the cache key. A missing cache uses none.
+func cacheUsage(ctx context.Context, driver storagedriver.StorageDriver, key string) (int64, error) {
+	stat, err := statCache(ctx, driver, key)
+	return stat.size, err
+}
@@ -0,0 +1,63 @@
+package gitreceive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDryRunPlanLines(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "slugbuild-app-12345678", Namespace: "drycc"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{}}},
+	}
+	plan := dryRunPlan{
+		Stack:  map[string]string{"name": "heroku-20", "version": "20.2", "image": "drycc/slugrunner:20.2"},
+		Image:  "home/app:git-12345678/push/slug.tgz",
+		Pod:    pod,
+		Config: map[string]string{"SECRET_KEY": "s", "API_URL": "u"},
+	}
+	assert.Equal(t, plan.lines(), []string{
+		"Stack: heroku-20 20.2 (drycc/slugrunner:20.2)",
+		"Image: home/app:git-12345678/push/slug.tgz",
+		"Builder pod: drycc/slugbuild-app-12345678",
+		"Resources: no requests or limits",
+		"Cache: disabled",
+		"Config from app.json: API_URL, SECRET_KEY",
+	}, "plan")
+
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+		corev1.ResourceCPU:    resource.MustParse("500m"),
+	}
+	plan.CacheKey, plan.CacheSize, plan.Config, plan.Strategy = "home/app/cache", 42, nil, "canary"
+	plan.SlugRunner = "drycc/slugrunner:1.4.0.heroku-20"
+	lines := plan.lines()
+	assert.Equal(t, lines[3], "Resources: requests cpu=500m, memory=1Gi, limits none", "resources")
+	assert.Equal(t, lines[4], "Cache: home/app/cache, 42 bytes", "cache")
+	assert.Equal(t, lines[5], "Release strategy: canary", "strategy")
+	assert.Equal(t, lines[6], "Slugrunner: drycc/slugrunner:1.4.0.heroku-20", "slugrunner")
+}
+
+func TestCacheUsage(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	key := NewSlugBuilderInfo("app", "12345678", false).CacheKey()
+
+	size, err := cacheUsage(context.Background(), driver, key)
+	assert.NoErr(t, err)
+	assert.Equal(t, size, int64(0), "size of a missing cache")
+
+	assert.NoErr(t, driver.PutContent(context.Background(), key+"/a", []byte("1234")))
+	assert.NoErr(t, driver.PutContent(context.Background(), key+"/b/c", []byte("123456")))
+	size, err = cacheUsage(context.Background(), driver, key)
+	assert.NoErr(t, err)
+	assert.Equal(t, size, int64(10), "size of the cache")
+}
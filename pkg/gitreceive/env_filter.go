@@ -0,0 +1,84 @@
+package gitreceive
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// envFilteredReason is the reason of the event recorded when app config keys were kept from the
+// builder pod.
+const envFilteredReason = "EnvFiltered"
+
+// envFilter decides which app config keys are passed to builder pods. Keys are matched against
+// shell patterns (see path.Match), e.g. "AWS_*".
+type envFilter struct {
+	// allow lists the patterns of the keys passed to builder pods, all keys if empty.
+	allow []string
+	// deny lists the patterns of the keys never passed to builder pods, even if allowed.
+	deny []string
+}
+
+// splitPatterns returns the comma separated patterns in list, checking that they're valid.
+func splitPatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q (%s)", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// newEnvFilter returns the envFilter of the comma separated allow and deny patterns.
+func newEnvFilter(allow, deny string) (envFilter, error) {
+	var f envFilter
+	var err error
+	if f.allow, err = splitPatterns(allow); err != nil {
+		return envFilter{}, fmt.Errorf("reading the build env allow list (%s)", err)
+	}
+	if f.deny, err = splitPatterns(deny); err != nil {
+		return envFilter{}, fmt.Errorf("reading the build env deny list (%s)", err)
+	}
+	return f, nil
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		// patterns were checked by splitPatterns
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// passes returns true if key may be passed to builder pods.
+func (f envFilter) passes(key string) bool {
+	if len(f.allow) > 0 && !matchAny(f.allow, key) {
+		return false
+	}
+	return !matchAny(f.deny, key)
+}
+
+// apply returns the keys of env that may be passed to builder pods, and the sorted names of those
+// that were filtered out.
+func (f envFilter) apply(env map[string]interface{}) (map[string]interface{}, []string) {
+	passed := make(map[string]interface{}, len(env))
+	var filtered []string
+	for k, v := range env {
+		if f.passes(k) {
+			passed[k] = v
+		} else {
+			filtered = append(filtered, k)
+		}
+	}
+	sort.Strings(filtered)
+	return passed, filtered
+}
@@ -0,0 +1,38 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestEnvFilter(t *testing.T) {
+	env := map[string]interface{}{
+		"AWS_ACCESS_KEY_ID":     "id",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"DATABASE_URL":          "postgres://",
+		"NPM_TOKEN":             "token",
+	}
+
+	f, err := newEnvFilter("", "")
+	assert.NoErr(t, err)
+	passed, filtered := f.apply(env)
+	assert.Equal(t, passed, env, "env passed without patterns")
+	assert.Equal(t, len(filtered), 0, "number of filtered keys")
+
+	f, err = newEnvFilter("", "AWS_*, *_TOKEN")
+	assert.NoErr(t, err)
+	passed, filtered = f.apply(env)
+	assert.Equal(t, passed, map[string]interface{}{"DATABASE_URL": "postgres://"}, "env passed with a deny list")
+	assert.Equal(t, filtered, []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "NPM_TOKEN"}, "filtered keys")
+
+	// denied keys are filtered out even if allowed
+	f, err = newEnvFilter("AWS_*,NPM_TOKEN", "AWS_SECRET_*")
+	assert.NoErr(t, err)
+	passed, filtered = f.apply(env)
+	assert.Equal(t, passed, map[string]interface{}{"AWS_ACCESS_KEY_ID": "id", "NPM_TOKEN": "token"}, "env passed with both lists")
+	assert.Equal(t, filtered, []string{"AWS_SECRET_ACCESS_KEY", "DATABASE_URL"}, "filtered keys")
+
+	_, err = newEnvFilter("AWS_[", "")
+	assert.True(t, err != nil, "created a filter with an invalid pattern")
+}
@@ -0,0 +1,98 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// envSecretLeftReason is the reason of the event recorded when the build env secret couldn't
+	// be deleted.
+	envSecretLeftReason = "EnvSecretLeft"
+	// envSecretDeleteAttempts is the number of times the deletion of the build env secret is
+	// tried, backing off exponentially from envSecretDeleteBackoff.
+	envSecretDeleteAttempts = 5
+	envSecretDeleteBackoff  = 200 * time.Millisecond
+)
+
+// secretGetDeleter is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).SecretInterface
+// needed to delete a secret and check that it's gone.
+type secretGetDeleter interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// deleteSecret deletes the secret name and checks that it's gone, retrying attempts times with an
+// exponential backoff from interval.
+func deleteSecret(secrets secretGetDeleter, name string, attempts int, interval time.Duration) error {
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+			interval *= 2
+		}
+		err := secrets.Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			lastErr = err
+			continue
+		}
+		_, err = secrets.Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("the secret still exists")
+		}
+	}
+	return fmt.Errorf("deleting secret %s (%s)", name, lastErr)
+}
+
+// buildEnvSecret is the secret through which the app config is handed to slugbuilder pods. It
+// only exists while a build needs it: it's created before each builder pod and, if short lived,
+// deleted as soon as the pod started, once the kubelet copied it into the pod's volume. A nil
+// *buildEnvSecret does nothing.
+type buildEnvSecret struct {
+	secrets    typedcorev1.SecretInterface
+	name       string
+	env        map[string]interface{}
+	shortLived bool
+	recorder   *buildRecorder
+}
+
+// create creates the secret, or replaces the secret left by an earlier build, until ctx is done.
+func (s *buildEnvSecret) create(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	if err := createAppEnvConfigSecret(ctx, s.secrets, s.name, s.env); err != nil {
+		return fmt.Errorf("error creating/updating secret %s: (%s)", s.name, err)
+	}
+	return nil
+}
+
+// started is called once the builder pod started.
+func (s *buildEnvSecret) started() {
+	if s != nil && s.shortLived {
+		s.delete()
+	}
+}
+
+// delete deletes the secret, making sure it's gone. A secret that can't be deleted is reported to
+// the pusher and recorded as an event, so that it's not left unnoticed.
+func (s *buildEnvSecret) delete() {
+	if s == nil {
+		return
+	}
+	if err := deleteSecret(s.secrets, s.name, envSecretDeleteAttempts, envSecretDeleteBackoff); err != nil {
+		log.Info("WARNING: the secret holding the app config for the build was left behind (%s)", err)
+		s.recorder.warn(envSecretLeftReason, "the build env secret %s was left behind (%s)", s.name, err)
+	}
+}
@@ -0,0 +1,61 @@
+package gitreceive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestDeleteSecret(t *testing.T) {
+	gets := 0
+	secrets := &k8s.FakeSecret{
+		FnGet: func(name string) (*corev1.Secret, error) {
+			gets++
+			if gets < 3 {
+				// the deletion isn't visible yet
+				return &corev1.Secret{}, nil
+			}
+			return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+		},
+	}
+	assert.NoErr(t, deleteSecret(secrets, "app-build-env", 5, 0))
+	assert.Equal(t, gets, 3, "number of checks")
+
+	gets = 0
+	assert.True(t, deleteSecret(secrets, "app-build-env", 2, 0) != nil, "deleted a secret that still exists")
+	assert.Equal(t, gets, 2, "number of checks")
+}
+
+func TestBuildEnvSecret(t *testing.T) {
+	var created []*corev1.Secret
+	deleted := false
+	secrets := &k8s.FakeSecret{
+		FnCreate: func(secret *corev1.Secret) (*corev1.Secret, error) {
+			created = append(created, secret)
+			return secret, nil
+		},
+		FnGet: func(name string) (*corev1.Secret, error) {
+			deleted = true
+			return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+		},
+	}
+	s := &buildEnvSecret{secrets: secrets, name: "app-build-env", env: map[string]interface{}{"KEY": "value"}}
+	assert.NoErr(t, s.create(context.Background()))
+	assert.Equal(t, len(created), 1, "number of created secrets")
+	assert.Equal(t, string(created[0].Data["KEY"]), "value", "secret data")
+	s.started()
+	assert.False(t, deleted, "deleted the secret once the pod started")
+
+	s.shortLived = true
+	s.started()
+	assert.True(t, deleted, "didn't delete the short lived secret once the pod started")
+
+	var nilSecret *buildEnvSecret
+	assert.NoErr(t, nilSecret.create(context.Background()))
+	nilSecret.started()
+	nilSecret.delete()
+}
@@ -0,0 +1,108 @@
+package gitreceive
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind is the category of an error a push failed with, telling wrappers of the git-receive
+// hook whether pushing again may succeed.
+type ErrorKind string
+
+const (
+	// ErrUser is a mistake of the pusher, such as a malformed Procfile or a failed build, that
+	// pushing again without changes won't fix.
+	ErrUser ErrorKind = "user"
+	// ErrInfra is a failure of the builder or of a service it depends on, such as the controller or
+	// the object storage. Errors that weren't categorized are infra errors.
+	ErrInfra ErrorKind = "infra"
+	// ErrPolicy is a push rejected by a policy of the builder, such as the large files limit or the
+	// malware scan.
+	ErrPolicy ErrorKind = "policy"
+	// ErrTimeout is a build that took longer than it's allowed to.
+	ErrTimeout ErrorKind = "timeout"
+)
+
+// The exit codes of the git-receive hook by kind of error. They're stable, wrappers can rely on
+// them.
+const (
+	ExitInfra   = 1
+	ExitUser    = 2
+	ExitPolicy  = 3
+	ExitTimeout = 4
+)
+
+// errorLinePrefix starts the last line the git-receive hook prints when it fails.
+const errorLinePrefix = "drycc-builder-error:"
+
+var exitCodes = map[ErrorKind]int{
+	ErrInfra:   ExitInfra,
+	ErrUser:    ExitUser,
+	ErrPolicy:  ExitPolicy,
+	ErrTimeout: ExitTimeout,
+}
+
+// Retryable returns true if pushing again, without changes, may succeed after an error of kind k.
+func (k ErrorKind) Retryable() bool {
+	return k == ErrInfra || k == ErrTimeout
+}
+
+// kindError is an error of a known kind. Its message is the one of the error it categorizes.
+type kindError struct {
+	kind ErrorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// withKind returns err categorized as kind, nil if err is nil. An error that already has a kind
+// keeps it.
+func withKind(kind ErrorKind, err error) error {
+	var known *kindError
+	if err == nil || errors.As(err, &known) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+func userError(err error) error {
+	return withKind(ErrUser, err)
+}
+
+func policyError(err error) error {
+	return withKind(ErrPolicy, err)
+}
+
+func timeoutError(err error) error {
+	return withKind(ErrTimeout, err)
+}
+
+// KindOf returns the kind of err, ErrInfra if it wasn't categorized.
+func KindOf(err error) ErrorKind {
+	var known *kindError
+	if errors.As(err, &known) {
+		return known.kind
+	}
+	return ErrInfra
+}
+
+// ExitCode returns the code the git-receive hook exits with after err, 0 if err is nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[KindOf(err)]
+}
+
+// ErrorLine returns the line the git-receive hook prints last when it fails with err, for wrappers
+// to parse, e.g. "drycc-builder-error: kind=user exit=2 retryable=false".
+func ErrorLine(err error) string {
+	kind := KindOf(err)
+	return fmt.Sprintf("%s kind=%s exit=%d retryable=%t", errorLinePrefix, kind, exitCodes[kind], kind.Retryable())
+}
@@ -0,0 +1,39 @@
+package gitreceive
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestErrorKinds(t *testing.T) {
+	failed := errors.New("failed")
+	cases := []struct {
+		err       error
+		kind      ErrorKind
+		exitCode  int
+		retryable bool
+	}{
+		{failed, ErrInfra, ExitInfra, true},
+		{userError(failed), ErrUser, ExitUser, false},
+		{policyError(failed), ErrPolicy, ExitPolicy, false},
+		{timeoutError(failed), ErrTimeout, ExitTimeout, true},
+		// the kind an error was first given is kept
+		{userError(policyError(failed)), ErrPolicy, ExitPolicy, false},
+		{fmt.Errorf("pushing (%w)", userError(failed)), ErrUser, ExitUser, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, KindOf(c.err), c.kind, "kind of "+c.err.Error())
+		assert.Equal(t, ExitCode(c.err), c.exitCode, "exit code of "+c.err.Error())
+		assert.Equal(t, KindOf(c.err).Retryable(), c.retryable, "retryable "+c.err.Error())
+	}
+	assert.Equal(t, userError(failed).Error(), "failed", "message")
+	assert.Equal(t, ExitCode(nil), 0, "exit code without error")
+	assert.Nil(t, userError(nil), "kind of no error")
+	assert.Equal(t, ErrorLine(userError(failed)), "drycc-builder-error: kind=user exit=2 retryable=false", "error line")
+	assert.Equal(t, ErrorLine(failed), "drycc-builder-error: kind=infra exit=1 retryable=true", "error line")
+	assert.Equal(t, KindOf(errBuildCanceled), ErrUser, "kind of a canceled build")
+	assert.Equal(t, KindOf(errDryRun), ErrUser, "kind of a dry run")
+}
@@ -0,0 +1,44 @@
+package gitreceive
+
+import "sort"
+
+// Features returns the names of the optional features of builds that conf enables, sorted, for
+// clients to check the capabilities of the builder.
+func Features(conf *Config) []string {
+	enabled := map[string]bool{
+		"async-releases":          conf.AsyncReleases,
+		"async-source-upload":     conf.AsyncSourceUpload,
+		"audit-log":               conf.AuditStorage || conf.AuditWebhookURL != "",
+		"build-cluster":           conf.BuildClusterKubeconfig != "",
+		"build-events":            conf.BuildEvents,
+		"build-log-limits":        conf.BuildLogMaxBytes > 0,
+		"build-scheduling":        conf.MaxConcurrentBuilds > 0,
+		"build-stats":             conf.BuildStats,
+		"build-summaries":         conf.BuildSummaries,
+		"buildkit":                conf.BuildKit,
+		"deferred-releases":       conf.DeferredReleases,
+		"dependency-caches":       conf.DependencyCaches != "",
+		"dockerfile-lint":         conf.DockerfileLint,
+		"gitops":                  conf.GitOpsRepo != "",
+		"image-destinations":      conf.ImageDestinations != "",
+		"license-compliance":      conf.LicenseDeny != "",
+		"malware-scanning":        conf.MalwareScannerURL != "",
+		"network-policy":          conf.BuilderPodNetworkPolicy,
+		"off-peak-builds":         conf.OffPeakWindow != "",
+		"oom-retry":               conf.OOMRetry,
+		"presigned-urls":          conf.PresignedURLs,
+		"promotion":               conf.PromotionEnabled,
+		"registry-tokens":         conf.RegistryTokens,
+		"short-lived-env-secrets": conf.ShortLivedEnvSecrets,
+		"signed-pushes":           conf.SignedPushes != "" && conf.SignedPushes != signedPushesOff,
+		"source-dedup":            conf.SourceDedup,
+	}
+	var features []string
+	for name, on := range enabled {
+		if on {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
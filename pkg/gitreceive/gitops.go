@@ -0,0 +1,128 @@
+package gitreceive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// gitOpsKeyName and gitOpsKnownHostsName are the SSH private key the GitOps repo is pushed
+	// with, and the known hosts its host is checked against, in GITOPS_CREDS_PATH.
+	gitOpsKeyName        = "ssh-privatekey"
+	gitOpsKnownHostsName = "known_hosts"
+	// gitOpsPushAttempts is the number of times a summary is committed again on top of the
+	// commits pushed to the GitOps repo meanwhile.
+	gitOpsPushAttempts = 3
+	gitOpsAuthor       = "Drycc Builder"
+	gitOpsEmail        = "builder@drycc.cc"
+)
+
+// gitOpsRepo is the git repository build summaries are committed to, for GitOps controllers to
+// deploy the images they name.
+type gitOpsRepo struct {
+	url    string
+	branch string
+	// path is the template of the path of the summary of an app in the repo, with {{app}}.
+	path     string
+	credsDir string
+}
+
+// newGitOpsRepo returns the GITOPS_REPO of conf, nil if it isn't set.
+func newGitOpsRepo(conf *Config) *gitOpsRepo {
+	if conf.GitOpsRepo == "" {
+		return nil
+	}
+	return &gitOpsRepo{url: conf.GitOpsRepo, branch: conf.GitOpsBranch, path: conf.GitOpsPath, credsDir: conf.GitOpsCredsPath}
+}
+
+// summaryPath returns the path of the summary of app in the repo.
+func (g *gitOpsRepo) summaryPath(app string) (string, error) {
+	path := filepath.Clean(strings.Replace(g.path, "{{app}}", app, -1))
+	if filepath.IsAbs(path) || path == "." || strings.HasPrefix(path, "..") {
+		return "", fmt.Errorf("invalid GitOps path %s", g.path)
+	}
+	return path, nil
+}
+
+// git returns the git command with args running in dir, pushing with the SSH key of the repo if
+// there's one.
+func (g *gitOpsRepo) git(dir string, args ...string) *exec.Cmd {
+	cmd := repoCmd(dir, "git", args...)
+	cmd.Env = os.Environ()
+	if key := filepath.Join(g.credsDir, gitOpsKeyName); fileExists(key) {
+		ssh := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes", key)
+		if knownHosts := filepath.Join(g.credsDir, gitOpsKnownHostsName); fileExists(knownHosts) {
+			ssh += fmt.Sprintf(" -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", knownHosts)
+		} else {
+			ssh += " -o StrictHostKeyChecking=accept-new"
+		}
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+ssh)
+	}
+	return cmd
+}
+
+// commit commits data, the summary s, to the branch of the repo and pushes it. If the branch
+// moved meanwhile, the summary is committed again on top of it, up to gitOpsPushAttempts times.
+func (g *gitOpsRepo) commit(s *buildSummary, data []byte) error {
+	path, err := g.summaryPath(s.App)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Build %s git-%s", s.App, s.Sha)
+	if s.Release > 0 {
+		message = fmt.Sprintf("Release %s v%d, built from git-%s", s.App, s.Release, s.Sha)
+	}
+	for attempt := 0; attempt < gitOpsPushAttempts; attempt++ {
+		var done bool
+		if done, err = g.commitOnce(path, message, data); done {
+			return err
+		}
+	}
+	return err
+}
+
+// commitOnce commits data at path, on top of the branch of the repo, and pushes it. It returns
+// false with the error of the push if it failed, for the commit to be attempted again, and true
+// otherwise.
+func (g *gitOpsRepo) commitOnce(path, message string, data []byte) (bool, error) {
+	dir, err := ioutil.TempDir("", "gitops")
+	if err != nil {
+		return true, err
+	}
+	defer os.RemoveAll(dir)
+	if out, err := g.git("", "clone", "--quiet", "--depth", "1", "--branch", g.branch, g.url, dir).CombinedOutput(); err != nil {
+		return true, fmt.Errorf("cloning (%s)", strings.TrimSpace(string(out)))
+	}
+	file := filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return true, err
+	}
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		return true, err
+	}
+	if err := run(g.git(dir, "add", path)); err != nil {
+		return true, fmt.Errorf("adding %s (%s)", path, err)
+	}
+	// the same summary was committed already
+	if run(g.git(dir, "diff", "--cached", "--quiet")) == nil {
+		return true, nil
+	}
+	commit := g.git(dir, "-c", "user.name="+gitOpsAuthor, "-c", "user.email="+gitOpsEmail, "commit", "--quiet", "-m", message)
+	if out, err := commit.CombinedOutput(); err != nil {
+		return true, fmt.Errorf("committing (%s)", strings.TrimSpace(string(out)))
+	}
+	if out, err := g.git(dir, "push", "--quiet", "origin", "HEAD:"+g.branch).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("pushing (%s)", strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// fileExists returns true if there's a file at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,92 @@
+package gitreceive
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// clock tells the time and ticks. Heartbeats use it, so that they're tested without waiting.
+type clock interface {
+	Now() time.Time
+	// Tick returns a channel receiving the time every d, and the function stopping it.
+	Tick(d time.Duration) (<-chan time.Time, func())
+}
+
+// realClock is the clock of the system.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// heartbeat shows the pusher that the push is alive while its long phases run, such as waiting
+// for the builder pod, pushing images or deploying the release. Every beat tells which phase is
+// in progress, for how long, and for how long the push has been running. All the phases of a
+// push share the heartbeat of its terminal, and run one at a time.
+type heartbeat struct {
+	t       *terminal
+	clock   clock
+	started time.Time
+}
+
+// newHeartbeat returns the heartbeat of t for a push started now, as told by c.
+func newHeartbeat(t *terminal, c clock) *heartbeat {
+	return &heartbeat{t: t, clock: c, started: c.Now()}
+}
+
+// phase shows that the message id, formatted with args, is in progress until the returned
+// function is called, which returns once the phase was cleared. On a TTY, a spinner is animated in
+// place; elsewhere, a beat is printed every interval, which also keeps the SSH session of the push
+// alive.
+func (h *heartbeat) phase(id string, interval time.Duration, args ...interface{}) func() {
+	t := h.t
+	msg := t.text(id)
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	start := h.clock.Now()
+	tick := interval
+	if t.tty {
+		tick = spinnerInterval
+		fmt.Fprintf(t.out, "%s %s\n", t.color(log.Cyan, spinnerFrames[0]), msg)
+	}
+	ticks, stopTicks := h.clock.Tick(tick)
+	quit := make(chan bool)
+	go func() {
+		defer stopTicks()
+		for frame := 1; ; frame++ {
+			select {
+			case <-quit:
+				if t.tty {
+					// builder output is piped line by line, so lines are rewritten rather than returned to
+					fmt.Fprintf(t.out, "%s%s (%s)\n", lineUpAndClear, msg, h.since(start))
+				}
+				close(quit)
+				return
+			case <-ticks:
+				beat := fmt.Sprintf(t.text(msgHeartbeat), msg, h.since(start), h.since(h.started))
+				if t.tty {
+					fmt.Fprintf(t.out, "%s%s %s\n", lineUpAndClear, t.color(log.Cyan, spinnerFrames[frame%len(spinnerFrames)]), beat)
+				} else {
+					fmt.Fprintln(t.out, beat)
+				}
+			}
+		}
+	}()
+	return func() {
+		quit <- true
+		<-quit
+	}
+}
+
+// since returns the time elapsed since start, to the second.
+func (h *heartbeat) since(start time.Time) time.Duration {
+	return h.clock.Now().Sub(start).Round(time.Second)
+}
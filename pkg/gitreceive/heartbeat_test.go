@@ -0,0 +1,68 @@
+package gitreceive
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+// fakeClock is a clock that only moves when told to, and ticks when a test sends on ticks.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Tick(time.Duration) (<-chan time.Time, func()) {
+	return c.ticks, func() {}
+}
+
+// advance moves c by d, then ticks.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.ticks <- now
+}
+
+func TestHeartbeat(t *testing.T) {
+	out := new(bytes.Buffer)
+	term := &terminal{out: out, messages: builtinMessages}
+	c := &fakeClock{now: time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC), ticks: make(chan time.Time)}
+	beat := newHeartbeat(term, c)
+
+	c.now = c.now.Add(time.Minute)
+	end := beat.phase(msgWaitingForPod, 10*time.Second)
+	c.advance(10 * time.Second)
+	c.advance(10 * time.Second)
+	end()
+	end = beat.phase(msgPullingImage, 10*time.Second, "drycc/base")
+	c.advance(10 * time.Second)
+	end()
+	assert.Equal(t, out.String(), "Waiting for the builder pod to start (10s, 1m10s since the push started)\n"+
+		"Waiting for the builder pod to start (20s, 1m20s since the push started)\n"+
+		"Pulling the image drycc/base (10s, 1m30s since the push started)\n", "beats")
+
+	out.Reset()
+	term.tty = true
+	end = beat.phase(msgWaitingForPod, time.Hour)
+	c.advance(time.Second)
+	c.advance(time.Second)
+	end()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Equal(t, len(lines), 4, out.String())
+	assert.True(t, strings.HasPrefix(lines[1], lineUpAndClear), "the spinner isn't animated in place")
+	assert.True(t, strings.HasSuffix(lines[2], "Waiting for the builder pod to start (2s, 1m32s since the push started)"), lines[2])
+	assert.Equal(t, lines[3], lineUpAndClear+"Waiting for the builder pod to start (2s)", "last line")
+}
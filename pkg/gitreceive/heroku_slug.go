@@ -0,0 +1,318 @@
+package gitreceive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+// herokuSlugRoot is the directory Heroku slugs keep the app in, and extract to /app.
+const herokuSlugRoot = "./app/"
+
+var (
+	// herokuProcessTypeRegexp matches the process type names Heroku accepts.
+	herokuProcessTypeRegexp = regexp.MustCompile(`^[-\w]{1,128}$`)
+	// processTypeRegexp matches the process type names the controller accepts, which name
+	// Kubernetes objects.
+	processTypeRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// slugCommitRegexp matches the commits of imported slugs, full or as short as the builds name
+	// them.
+	slugCommitRegexp = regexp.MustCompile(`^[\da-f]{8,40}$`)
+)
+
+// HerokuSlug describes a slug in the format of the Heroku platform API, e.g. the body of a request
+// creating a slug. The slug itself is a gzipped tarball of the app in ./app.
+type HerokuSlug struct {
+	ProcessTypes map[string]string `json:"process_types"`
+	Stack        herokuStack       `json:"stack"`
+	Commit       string            `json:"commit,omitempty"`
+}
+
+// herokuStack is the name of a Heroku stack. The platform API takes stacks by name, but
+// describes them as objects with a name.
+type herokuStack string
+
+// UnmarshalJSON is the json.Unmarshaler interface implementation.
+func (s *herokuStack) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = herokuStack(name)
+		return nil
+	}
+	var stack struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &stack); err != nil {
+		return fmt.Errorf("the stack is neither a name nor an object with a name (%s)", err)
+	}
+	*s = herokuStack(stack.Name)
+	return nil
+}
+
+// herokuStackOf returns the Heroku stack of the slugs built with the stack named stack. Only
+// heroku-* stacks build slugs Heroku can run.
+func herokuStackOf(stack string) (string, error) {
+	if !strings.HasPrefix(stack, "heroku-") {
+		return "", fmt.Errorf("the %s stack has no Heroku counterpart", stack)
+	}
+	return stack, nil
+}
+
+// stackOfHeroku returns the stack slugs of the Heroku stack stack run with, one of the available
+// heroku-* stacks.
+func stackOfHeroku(stack string) (string, error) {
+	if len(Stacks) == 0 {
+		initStack()
+	}
+	var available []string
+	for _, name := range stackNames() {
+		if !strings.HasPrefix(name, "heroku-") {
+			continue
+		}
+		if name == stack {
+			return name, nil
+		}
+		available = append(available, name)
+	}
+	return "", fmt.Errorf("the Heroku stack %s isn't available, slugs can only be imported from %s", stack, strings.Join(available, ", "))
+}
+
+// processTypesToHeroku translates the process types of a build to the process types of a Heroku
+// slug.
+func processTypesToHeroku(procType dryccAPI.ProcessType) (map[string]string, error) {
+	processTypes := make(map[string]string, len(procType))
+	for name, command := range procType {
+		if !herokuProcessTypeRegexp.MatchString(name) {
+			return nil, fmt.Errorf("the process type %s isn't valid on Heroku", name)
+		}
+		processTypes[name] = command
+	}
+	return processTypes, nil
+}
+
+// processTypesFromHeroku translates the process types of a Heroku slug to the process types of a
+// build: names are lowercased, with their underscores replaced by dashes.
+func processTypesFromHeroku(processTypes map[string]string) (dryccAPI.ProcessType, error) {
+	procType := make(dryccAPI.ProcessType, len(processTypes))
+	from := make(map[string]string, len(processTypes))
+	names := make([]string, 0, len(processTypes))
+	for name := range processTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		translated := strings.Replace(strings.ToLower(name), "_", "-", -1)
+		if !processTypeRegexp.MatchString(translated) {
+			return nil, fmt.Errorf("the process type %s can't be translated, %s isn't a valid name", name, translated)
+		}
+		if other, ok := from[translated]; ok {
+			return nil, fmt.Errorf("the process types %s and %s both translate to %s", other, name, translated)
+		}
+		from[translated] = name
+		procType[translated] = processTypes[name]
+	}
+	if len(procType) == 0 {
+		return nil, fmt.Errorf("the slug has no process types")
+	}
+	return procType, nil
+}
+
+// rewriteSlug copies the slug tarball read from r to w, with the name of every entry rewritten by
+// rename. Entries rename returns "" for are left out.
+func rewriteSlug(r io.Reader, w io.Writer, rename func(name string) (string, error)) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading the slug (%s)", err)
+		}
+		name, err := rename(header.Name)
+		if err != nil {
+			return err
+		} else if name == "" {
+			continue
+		}
+		header.Name = name
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("writing %s (%s)", name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("writing %s (%s)", name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// slugReader returns the uncompressed tarball of the slug at key, which is compressed with zstd if
+// it's named like it.
+func slugReader(ctx context.Context, reader storage.ObjectReader, key string) (io.ReadCloser, error) {
+	rc, err := reader.Reader(ctx, key, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading the slug %s (%s)", key, err)
+	}
+	if strings.HasSuffix(key, "/"+slugZstdName) {
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = rc
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompressing the slug %s (%s)", key, err)
+		}
+		return &zstdSlugReader{ReadCloser: out, cmd: cmd, slug: rc}, nil
+	}
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("reading the slug %s (%s)", key, err)
+	}
+	return &gzipSlugReader{Reader: gz, slug: rc}, nil
+}
+
+type zstdSlugReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	slug io.Closer
+}
+
+func (z *zstdSlugReader) Close() error {
+	z.slug.Close()
+	return z.cmd.Wait()
+}
+
+type gzipSlugReader struct {
+	*gzip.Reader
+	slug io.Closer
+}
+
+func (g *gzipSlugReader) Close() error {
+	g.Reader.Close()
+	return g.slug.Close()
+}
+
+// ExportHerokuSlug writes the slug of the last build of app to w, in the format of Heroku slugs,
+// and returns its description for the Heroku platform API. Container builds can't be exported.
+func ExportHerokuSlug(ctx context.Context, reader storage.ObjectReader, app string, w io.Writer) (*HerokuSlug, error) {
+	storagedriver.PathRegexp = storagePathRegexp
+	m, err := getBuildManifest(ctx, reader, app)
+	if err != nil {
+		return nil, fmt.Errorf("reading the last build of %s (%s)", app, err)
+	} else if m == nil {
+		return nil, fmt.Errorf("%s has no build to export", app)
+	}
+	stack, err := herokuStackOf(m.Stack)
+	if err != nil {
+		return nil, fmt.Errorf("the last build of %s can't be exported (%s)", app, err)
+	}
+	processTypes, err := processTypesToHeroku(m.ProcessTypes)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := storage.VerifyChecksum(reader, m.Image); err != nil {
+		return nil, fmt.Errorf("verifying the slug %s (%s)", m.Image, err)
+	} else if !ok {
+		// slugs built before checksums were recorded can still be exported
+		log.Debug("the slug %s has no checksum", m.Image)
+	}
+	rc, err := slugReader(ctx, reader, m.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	gz := gzip.NewWriter(w)
+	err = rewriteSlug(rc, gz, func(name string) (string, error) {
+		return herokuSlugRoot + strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/"), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return &HerokuSlug{ProcessTypes: processTypes, Stack: herokuStack(stack), Commit: m.Sha}, nil
+}
+
+// ImportHerokuSlug stores the Heroku slug read from r, described by slug, as a build of app at the
+// commit of the slug, which can be its full or short sha, with keys sharded with shardLength. The build is stored like a build promoted
+// from another cluster: pushing the commit releases it without rebuilding, after its release
+// phase if it has one.
+func ImportHerokuSlug(ctx context.Context, writer storage.ObjectWriter, app string, slug *HerokuSlug, r io.Reader, shardLength int) error {
+	storagedriver.PathRegexp = storagePathRegexp
+	if !slugCommitRegexp.MatchString(slug.Commit) {
+		return fmt.Errorf("the slug must have the sha of its commit, not %q", slug.Commit)
+	}
+	sha := slug.Commit[:8]
+	stack, err := stackOfHeroku(string(slug.Stack))
+	if err != nil {
+		return err
+	}
+	procType, err := processTypesFromHeroku(slug.ProcessTypes)
+	if err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("reading the slug (%s)", err)
+	}
+	key := NewShardedSlugBuilderInfo(app, sha, false, shardLength).AbsoluteSlugObjectKey()
+	fw, err := writer.Writer(ctx, key, false)
+	if err != nil {
+		return fmt.Errorf("uploading the slug to %s (%s)", key, err)
+	}
+	h := sha256.New()
+	out := gzip.NewWriter(io.MultiWriter(fw, h))
+	err = rewriteSlug(gz, out, func(name string) (string, error) {
+		name = "./" + strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+		if name == "./" || name == "./app" {
+			return "", nil
+		} else if !strings.HasPrefix(name, herokuSlugRoot) {
+			return "", fmt.Errorf("the slug has %s outside of %s", name, herokuSlugRoot)
+		}
+		return "./" + strings.TrimPrefix(name, herokuSlugRoot), nil
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fw.Cancel()
+		return err
+	}
+	if err := fw.Commit(); err != nil {
+		return fmt.Errorf("uploading the slug to %s (%s)", key, err)
+	}
+	if err := fw.Close(); err != nil {
+		return fmt.Errorf("uploading the slug to %s (%s)", key, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := storage.PutChecksum(writer, key, sum); err != nil {
+		return fmt.Errorf("uploading checksum of %s (%s)", key, err)
+	}
+
+	m := newBuildManifest(app, sha, 0, stack, key, procType, nil)
+	m.Checksum = sum
+	if err := putPromotedManifest(ctx, writer, m); err != nil {
+		return fmt.Errorf("storing the imported build (%s)", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package gitreceive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+// testSlug returns a gzipped slug tarball of files, keyed by name, after the root entry root.
+func testSlug(t *testing.T, root string, files ...[2]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.NoErr(t, tw.WriteHeader(&tar.Header{Name: root, Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, file := range files {
+		assert.NoErr(t, tw.WriteHeader(&tar.Header{Name: file[0], Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(file[1]))}))
+		_, err := tw.Write([]byte(file[1]))
+		assert.NoErr(t, err)
+	}
+	assert.NoErr(t, tw.Close())
+	assert.NoErr(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestHerokuSlugExportImport(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	slug := testSlug(t, "./", [2]string{"./Procfile", "web: bin/web"}, [2]string{"./bin/web", "#!/bin/sh"})
+	assert.NoErr(t, driver.PutContent(context.Background(), info.AbsoluteSlugObjectKey(), slug))
+	sum, err := storage.SHA256(bytes.NewReader(slug))
+	assert.NoErr(t, err)
+	assert.NoErr(t, storage.PutChecksum(driver, info.AbsoluteSlugObjectKey(), sum))
+	m := newBuildManifest("app", "12345678", 3, "heroku-20", info.AbsoluteSlugObjectKey(), dryccAPI.ProcessType{"web": "bin/web", "worker-queue": "bin/worker"}, nil)
+	assert.NoErr(t, putBuildManifest(context.Background(), driver, m))
+
+	var exported bytes.Buffer
+	described, err := ExportHerokuSlug(context.Background(), driver, "app", &exported)
+	assert.NoErr(t, err)
+	assert.Equal(t, described, &HerokuSlug{
+		ProcessTypes: map[string]string{"web": "bin/web", "worker-queue": "bin/worker"},
+		Stack:        "heroku-20",
+		Commit:       "12345678",
+	}, "description of the exported slug")
+	assert.Equal(t, archiveFiles(t, exported.Bytes()), map[string]string{
+		"./app/":         "",
+		"./app/Procfile": "web: bin/web",
+		"./app/bin/web":  "#!/bin/sh",
+	}, "files of the exported slug")
+
+	// the description round-trips through the JSON of the Heroku platform API
+	data, err := json.Marshal(described)
+	assert.NoErr(t, err)
+	imported := new(HerokuSlug)
+	assert.NoErr(t, json.Unmarshal(data, imported))
+	assert.NoErr(t, ImportHerokuSlug(context.Background(), driver, "other", imported, bytes.NewReader(exported.Bytes()), 0))
+
+	promoted, err := getPromotedManifest(context.Background(), driver, "other", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, promoted.Stack, "heroku-20", "stack of the imported build")
+	assert.Equal(t, promoted.ProcessTypes, dryccAPI.ProcessType{"web": "bin/web", "worker-queue": "bin/worker"}, "process types of the imported build")
+	assert.Equal(t, promoted.Image, NewSlugBuilderInfo("other", "12345678", false).AbsoluteSlugObjectKey(), "slug of the imported build")
+	assert.NoErr(t, verifyPromoted(driver, promoted))
+	content, err := driver.GetContent(context.Background(), promoted.Image)
+	assert.NoErr(t, err)
+	assert.Equal(t, archiveFiles(t, content), archiveFiles(t, slug), "files of the imported slug")
+}
+
+func TestImportHerokuSlugErrors(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	slug := &HerokuSlug{ProcessTypes: map[string]string{"web": "bin/web"}, Stack: "heroku-20", Commit: "12345678"}
+
+	outside := testSlug(t, "./", [2]string{"./etc/passwd", "root"})
+	err = ImportHerokuSlug(context.Background(), driver, "app", slug, bytes.NewReader(outside), 0)
+	assert.Err(t, err, errors.New("the slug has ./etc/passwd outside of ./app/"))
+
+	slug.Stack = "cedar-14"
+	err = ImportHerokuSlug(context.Background(), driver, "app", slug, bytes.NewReader(nil), 0)
+	assert.True(t, err != nil, "imported a slug of an unavailable stack")
+
+	slug.Stack, slug.Commit = "heroku-20", "main"
+	err = ImportHerokuSlug(context.Background(), driver, "app", slug, bytes.NewReader(nil), 0)
+	assert.Err(t, err, errors.New(`the slug must have the sha of its commit, not "main"`))
+}
+
+func TestProcessTypesFromHeroku(t *testing.T) {
+	procType, err := processTypesFromHeroku(map[string]string{"web": "bin/web", "Worker_Queue": "bin/worker", "release": "bin/migrate"})
+	assert.NoErr(t, err)
+	assert.Equal(t, procType, dryccAPI.ProcessType{"web": "bin/web", "worker-queue": "bin/worker", "release": "bin/migrate"}, "process types")
+
+	_, err = processTypesFromHeroku(map[string]string{"worker_queue": "a", "worker-queue": "b"})
+	assert.Err(t, err, errors.New("the process types worker-queue and worker_queue both translate to worker-queue"))
+	_, err = processTypesFromHeroku(map[string]string{})
+	assert.Err(t, err, errors.New("the slug has no process types"))
+}
+
+func TestHerokuStack(t *testing.T) {
+	var slug HerokuSlug
+	assert.NoErr(t, json.Unmarshal([]byte(`{"stack": {"id": "ee582d3c", "name": "heroku-18"}}`), &slug))
+	assert.Equal(t, slug.Stack, herokuStack("heroku-18"), "stack described as an object")
+	_, err := herokuStackOf("container")
+	assert.Err(t, err, errors.New("the container stack has no Heroku counterpart"))
+	stack, err := stackOfHeroku("heroku-18")
+	assert.NoErr(t, err)
+	assert.Equal(t, stack, "heroku-18", "stack of heroku-18 slugs")
+}
@@ -0,0 +1,141 @@
+package gitreceive
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/drycc/builder/pkg/registry"
+)
+
+const (
+	// imageDigestsAnnotation lists the images of a container build, by tag and digest, in each
+	// registry it was pushed to, starting with the one it was built to.
+	imageDigestsAnnotation = "builder.drycc.cc/image-digests"
+	// dockerConfigName is the docker config file of the credentials of the image destinations.
+	dockerConfigName = "config.json"
+)
+
+// imageDestination is a registry, optionally followed by a repository prefix, that the images of
+// container builds are pushed to in addition to the registry of the cluster, e.g.
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com/prod".
+type imageDestination struct {
+	prefix string
+	images *registry.Client
+}
+
+// dockerConfig is the part of a docker config file holding registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// readDockerCredentials returns the username and password of each registry host of the docker
+// config file in dir. It returns no credentials if there's no such file.
+func readDockerCredentials(dir string) (map[string][2]string, error) {
+	creds := make(map[string][2]string)
+	data, err := ioutil.ReadFile(filepath.Join(dir, dockerConfigName))
+	if os.IsNotExist(err) {
+		return creds, nil
+	} else if err != nil {
+		return nil, err
+	}
+	config := new(dockerConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("reading %s (%s)", dockerConfigName, err)
+	}
+	for host, auth := range config.Auths {
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("reading the credentials of %s (%s)", host, err)
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, fmt.Errorf("reading the credentials of %s (not a username:password pair)", host)
+			}
+			username, password = userPass[0], userPass[1]
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+		creds[host] = [2]string{username, password}
+	}
+	return creds, nil
+}
+
+// newImageDestinations returns the IMAGE_DESTINATIONS of conf, with the credentials of their
+// registry read from IMAGE_DESTINATIONS_CREDS_PATH.
+func newImageDestinations(conf *Config) ([]imageDestination, error) {
+	var prefixes []string
+	for _, prefix := range strings.Split(conf.ImageDestinations, ",") {
+		if prefix = strings.Trim(strings.TrimSpace(prefix), "/"); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	creds, err := readDockerCredentials(conf.ImageDestinationsCredsPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading the credentials of the image destinations (%s)", err)
+	}
+	dests := make([]imageDestination, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		host := strings.SplitN(prefix, "/", 2)[0]
+		if !strings.ContainsAny(host, ".:") && host != "localhost" {
+			return nil, fmt.Errorf("invalid image destination %s (it must start with a registry host)", prefix)
+		}
+		cred := creds[host]
+		dests = append(dests, imageDestination{prefix: prefix, images: registry.NewClient(cred[0], cred[1], false)})
+	}
+	return dests, nil
+}
+
+// pushToDestinations pushes the image ref points to to each of dests, as app with the tag of ref,
+// with copyImage, keeping the session alive every interval. It returns the images pushed, by tag
+// and digest, or the first error.
+func pushToDestinations(
+	ref registry.Reference,
+	app string,
+	dests []imageDestination,
+	interval time.Duration,
+	copyImage func(dest imageDestination, dst registry.Reference) (string, error)) ([]string, error) {
+
+	var pushed []string
+	for _, dest := range dests {
+		dst, err := registry.ParseReference(fmt.Sprintf("%s/%s:%s", dest.prefix, app, ref.Tag))
+		if err != nil {
+			return nil, err
+		}
+		var digest string
+		err = pusherTerminal.during(msgPushingImage, interval, func() (err error) {
+			digest, err = copyImage(dest, *dst)
+			return err
+		}, dst)
+		if err != nil {
+			return nil, fmt.Errorf("pushing the image to %s (%s)", dst, err)
+		}
+		pushed = append(pushed, fmt.Sprintf("%s@%s", dst, digest))
+	}
+	return pushed, nil
+}
+
+// pushImageCopies pushes the image of a container build, built, to the IMAGE_DESTINATIONS of conf.
+// It returns the copies by tag and digest, or nothing if there are no destinations.
+func pushImageCopies(conf *Config, built *builtImage) ([]string, error) {
+	dests, err := newImageDestinations(conf)
+	if err != nil || len(dests) == 0 {
+		return nil, err
+	}
+	return pushToDestinations(*built.ref, conf.App(), dests, conf.SessionIdleInterval(), func(dest imageDestination, dst registry.Reference) (string, error) {
+		return registry.CopyIndex(built.images, *built.ref, dest.images, dst)
+	})
+}
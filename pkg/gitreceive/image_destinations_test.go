@@ -0,0 +1,83 @@
+package gitreceive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/registry"
+)
+
+func TestNewImageDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-destinations")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	config := `{"auths": {
+		"https://123456789012.dkr.ecr.us-east-1.amazonaws.com": {"auth": "QVdTOnRva2Vu"},
+		"registry.example.com": {"username": "drycc", "password": "secret"}
+	}}`
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, dockerConfigName), []byte(config), 0644))
+	creds, err := readDockerCredentials(dir)
+	assert.NoErr(t, err)
+	assert.Equal(t, creds, map[string][2]string{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": {"AWS", "token"},
+		"registry.example.com":                         {"drycc", "secret"},
+	}, "credentials")
+
+	conf := &Config{
+		ImageDestinations:          "123456789012.dkr.ecr.us-east-1.amazonaws.com/prod, registry.example.com/",
+		ImageDestinationsCredsPath: dir,
+	}
+	dests, err := newImageDestinations(conf)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(dests), 2, "destinations")
+	assert.Equal(t, dests[0].prefix, "123456789012.dkr.ecr.us-east-1.amazonaws.com/prod", "prefix of the first destination")
+	assert.Equal(t, dests[1].prefix, "registry.example.com", "prefix of the second destination")
+
+	conf.ImageDestinations = "prod/app"
+	_, err = newImageDestinations(conf)
+	assert.Err(t, err, errors.New("invalid image destination prod/app (it must start with a registry host)"))
+
+	dests, err = newImageDestinations(&Config{ImageDestinationsCredsPath: dir})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(dests), 0, "destinations without IMAGE_DESTINATIONS")
+}
+
+func TestBuiltImageReference(t *testing.T) {
+	conf := &Config{RegistryLocation: "on-cluster", RegistryHost: "localhost", RegistryPort: "5555"}
+	ref, err := builtImageReference(conf, "app", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, ref.String(), "localhost:5555/app:git-12345678", "on-cluster image of the default template")
+	ref, err = builtImageReference(conf, "app:main-12345678", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, ref.String(), "localhost:5555/app:main-12345678", "on-cluster image")
+	conf.RegistryLocation = "off-cluster"
+	ref, err = builtImageReference(conf, "quay.io/org/app:git-12345678", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, ref.String(), "quay.io/org/app:git-12345678", "off-cluster image")
+}
+
+func TestPushToDestinations(t *testing.T) {
+	ref, err := registry.ParseReference("localhost:5555/app:git-12345678")
+	assert.NoErr(t, err)
+	dests := []imageDestination{{prefix: "ecr.example.com/prod"}, {prefix: "registry.example.com"}}
+	var copied []string
+	pushed, err := pushToDestinations(*ref, "app", dests, 0, func(dest imageDestination, dst registry.Reference) (string, error) {
+		copied = append(copied, dst.String())
+		return "sha256:abc", nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, copied, []string{"ecr.example.com/prod/app:git-12345678", "registry.example.com/app:git-12345678"}, "images copied")
+	assert.Equal(t, pushed, []string{
+		"ecr.example.com/prod/app:git-12345678@sha256:abc",
+		"registry.example.com/app:git-12345678@sha256:abc",
+	}, "images pushed")
+
+	_, err = pushToDestinations(*ref, "app", dests, 0, func(dest imageDestination, dst registry.Reference) (string, error) {
+		return "", errors.New("denied")
+	})
+	assert.Err(t, err, errors.New("pushing the image to ecr.example.com/prod/app:git-12345678 (denied)"))
+}
@@ -0,0 +1,87 @@
+package gitreceive
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/drycc/builder/pkg/registry"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// builtImage is the image of a container build, in the registry the build pushed it to.
+type builtImage struct {
+	ref    *registry.Reference
+	images *registry.Client
+	// digest is the digest of the manifest of the image.
+	digest string
+}
+
+// String is the fmt.Stringer interface implementation. It returns the reference of the image by
+// tag and digest.
+func (b *builtImage) String() string {
+	return fmt.Sprintf("%s@%s", b.ref, b.digest)
+}
+
+// builtImageReference returns the reference of the image of a container build of sha, given the
+// image name as passed to the controller.
+func builtImageReference(conf *Config, image, sha string) (*registry.Reference, error) {
+	rawRef := image
+	if conf.RegistryLocation == "on-cluster" {
+		rawRef = fmt.Sprintf("%s/%s", net.JoinHostPort(conf.RegistryHost, conf.RegistryPort), image)
+		// images named by the default template are passed to the controller without their tag
+		if !strings.Contains(image, ":") {
+			rawRef = fmt.Sprintf("%s:git-%s", rawRef, sha)
+		}
+	}
+	return registry.ParseReference(rawRef)
+}
+
+// resolveBuiltImage resolves the digest of the image of the container build of sha, named image
+// as passed to the controller, with the registry credentials in secrets.
+func resolveBuiltImage(conf *Config, secrets typedcorev1.SecretInterface, image, sha string) (*builtImage, error) {
+	ref, err := builtImageReference(conf, image, sha)
+	if err != nil {
+		return nil, err
+	}
+	images, err := newImageClient(conf, secrets, ref)
+	if err != nil {
+		return nil, err
+	}
+	raw, _, digest, err := images.RawManifest(*ref)
+	if err != nil {
+		return nil, fmt.Errorf("resolving the digest of %s (%s)", ref, err)
+	}
+	// registries should report the digest, but it's the digest of the manifest as stored anyway
+	if digest == "" {
+		digest = registry.Digest(raw)
+	}
+	return &builtImage{ref: ref, images: images, digest: digest}, nil
+}
+
+// pinnedImage returns the image reference rawRef pinned to digest, so that it's deployed as built
+// even if its tag is overwritten. It returns rawRef if it isn't a valid reference.
+func pinnedImage(rawRef, digest string) string {
+	ref, err := registry.ParseReference(rawRef)
+	if err != nil || digest == "" {
+		return rawRef
+	}
+	ref.Tag, ref.Digest = "", digest
+	return ref.String()
+}
+
+// releaseImage returns the image of a build as passed to the controller, pinned to digest. The
+// images of the on-cluster registry are passed without their registry, which the controller adds,
+// so only their tag is replaced.
+func releaseImage(conf *Config, image, digest string) string {
+	if conf.RegistryLocation != "on-cluster" {
+		return pinnedImage(image, digest)
+	}
+	if digest == "" {
+		return image
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + "@" + digest
+}
@@ -0,0 +1,45 @@
+package gitreceive
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/registry"
+)
+
+func TestResolveBuiltImage(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json"}`)
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", registry.MediaTypeManifest)
+		fmt.Fprintf(w, "%s", manifest)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	assert.NoErr(t, err)
+	host, port, err := net.SplitHostPort(u.Host)
+	assert.NoErr(t, err)
+
+	conf := &Config{RegistryLocation: "on-cluster", RegistryHost: host, RegistryPort: port}
+	built, err := resolveBuiltImage(conf, nil, "app", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, path, "/v2/app/manifests/git-12345678", "manifest path")
+	assert.Equal(t, built.digest, registry.Digest(manifest), "digest")
+	assert.Equal(t, built.String(), fmt.Sprintf("%s/app:git-12345678@%s", u.Host, registry.Digest(manifest)), "image by tag and digest")
+}
+
+func TestReleaseImage(t *testing.T) {
+	digest := "sha256:0123456789abcdef"
+	assert.Equal(t, pinnedImage("quay.io/org/app:git-12345678", digest), "quay.io/org/app@sha256:0123456789abcdef", "pinned image")
+	assert.Equal(t, pinnedImage("quay.io/org/app:git-12345678", ""), "quay.io/org/app:git-12345678", "image without a digest")
+	assert.Equal(t, releaseImage(&Config{RegistryLocation: "on-cluster"}, "app", digest), "app@sha256:0123456789abcdef", "on-cluster image")
+	assert.Equal(t, releaseImage(&Config{RegistryLocation: "on-cluster"}, "app/web:v1", digest), "app/web@sha256:0123456789abcdef", "tagged on-cluster image")
+	assert.Equal(t, releaseImage(&Config{RegistryLocation: "on-cluster"}, "app", ""), "app", "on-cluster image without a digest")
+	assert.Equal(t, releaseImage(&Config{RegistryLocation: "off-cluster"}, "quay.io/org/app:git-12345678", digest), "quay.io/org/app@sha256:0123456789abcdef", "off-cluster image")
+}
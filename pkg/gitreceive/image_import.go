@@ -0,0 +1,160 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/registry"
+	"github.com/drycc/builder/pkg/release"
+	drycc "github.com/drycc/controller-sdk-go"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// procfileLabel is the image label from which the process types of an imported image are read.
+// Its value uses the Procfile format, e.g. "web: ./server\nworker: ./worker".
+const procfileLabel = "cc.drycc.procfile"
+
+// newImageClient returns a registry client able to read ref. Credentials from the off-cluster
+// registry secret are only used when the image lives in that registry, the default registry if
+// the secret has no hostname, and the on-cluster registry is spoken to over plain HTTP, with a
+// registry token if they're enabled.
+func newImageClient(conf *Config, secrets typedcorev1.SecretInterface, ref *registry.Reference) (*registry.Client, error) {
+	insecure := ref.Host == net.JoinHostPort(conf.RegistryHost, conf.RegistryPort)
+	if conf.RegistryLocation != "off-cluster" {
+		client := registry.NewClient("", "", insecure)
+		if insecure {
+			// the on-cluster registry only accepts the tokens of the builder with registry tokens
+			token, err := registryToken(conf, conf.App(), ref.Repository, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			if token != "" {
+				client.UseToken(*ref, token)
+			}
+		}
+		return client, nil
+	}
+	details, err := getDetailsFromRegistrySecret(secrets, registrySecret)
+	if err != nil {
+		return nil, fmt.Errorf("error getting private registry details %s", err)
+	}
+	if credentialsHost(details) != ref.Host {
+		return registry.NewClient("", "", insecure), nil
+	}
+	return registry.NewClient(details["username"], details["password"], insecure), nil
+}
+
+// credentialsHost returns the host of the off-cluster registry the credentials of its secret
+// details are for.
+func credentialsHost(details map[string]string) string {
+	if details["hostname"] == "" {
+		return registry.DefaultHost
+	}
+	return details["hostname"]
+}
+
+// importImage registers the externally built image rawRef as a new release of the app, without
+// running a builder pod. The pushed commit is recorded as the source of the build. A dry run only
+// checks the image. The release is bound to ctx.
+func importImage(
+	ctx context.Context,
+	conf *Config,
+	client *drycc.Client,
+	kubeClient kubernetes.Interface,
+	storageDriver storagedriver.StorageDriver,
+	appConf dryccAPI.Config,
+	rawRef string,
+	gitSha *git.SHA,
+	info buildInfo,
+	strategy string,
+	recorder *buildRecorder,
+	dryRun bool) error {
+
+	ref, err := registry.ParseReference(rawRef)
+	if err != nil {
+		return err
+	}
+	imageClient, err := newImageClient(conf, kubeClient.CoreV1().Secrets(conf.PodNamespace), ref)
+	if err != nil {
+		return err
+	}
+	var imageConfig *registry.ImageConfig
+	err = pusherTerminal.during(msgCheckingImage, conf.SessionIdleInterval(), func() (err error) {
+		imageConfig, err = inspectImage(imageClient, ref)
+		return err
+	}, ref)
+	if err != nil {
+		return err
+	}
+	procType, err := imageProcfile(imageConfig)
+	if err != nil {
+		return err
+	}
+	if err := validateProcessTypes(procType, conf.App()); err != nil {
+		return userError(fmt.Errorf("label %s is invalid (%s)", procfileLabel, err))
+	}
+
+	if dryRun {
+		log.Info("Dry run, image %s would be released with process types %v", ref, procType)
+		return nil
+	}
+
+	pusherTerminal.info(msgImporting, ref)
+	version, err := createBuild(ctx, conf, client, storageDriver, release.Request{
+		Username:    conf.Username,
+		App:         conf.App(),
+		Image:       ref.String(),
+		Stack:       "container",
+		Sha:         gitSha.Short(),
+		Procfile:    procType,
+		Annotations: info.annotations(time.Now()),
+		Strategy:    strategy,
+	})
+	if err == errReleaseDeferred {
+		recorder.record(buildPhaseDeferred, "the controller is unavailable, the release is pending")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recorder.released(version, "released v%d from image %s", version, ref)
+	printDeployed(conf.App(), version)
+	summarizeRelease(ctx, storageDriver, newBuildManifest(conf.App(), gitSha.Short(), version, "container", ref.String(), procType, appConf.Values))
+	return nil
+}
+
+// inspectImage verifies that the image ref points to exists and returns its configuration.
+func inspectImage(client *registry.Client, ref *registry.Reference) (*registry.ImageConfig, error) {
+	if _, _, err := client.ImageManifest(*ref); err != nil {
+		return nil, fmt.Errorf("image %s can't be imported (%s)", ref, err)
+	}
+	config, err := client.ImageConfig(*ref)
+	if err != nil {
+		return nil, fmt.Errorf("reading the configuration of image %s (%s)", ref, err)
+	}
+	return config, nil
+}
+
+// imageProcfile returns the process types declared in the procfileLabel of an image. Images
+// without the label get no process types, so the controller runs their entrypoint.
+func imageProcfile(config *registry.ImageConfig) (dryccAPI.ProcessType, error) {
+	procType := dryccAPI.ProcessType{}
+	rawProcFile, ok := config.Config.Labels[procfileLabel]
+	if !ok {
+		cmd := append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+		log.Info("No %s label found, the image entrypoint [%s] will be run", procfileLabel, strings.Join(cmd, " "))
+		return procType, nil
+	}
+	if err := yaml.Unmarshal([]byte(rawProcFile), &procType); err != nil {
+		return nil, fmt.Errorf("label %s is malformed (%s)", procfileLabel, err)
+	}
+	return procType, nil
+}
@@ -0,0 +1,129 @@
+package gitreceive
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+const (
+	// defaultImageNameTemplate names images app:git-<short sha>, the name the controller expects
+	// of images of the on-cluster registry.
+	defaultImageNameTemplate = "{{app}}:git-{{sha}}"
+	// imageNameTemplateKey is the app config key overriding the IMAGE_NAME_TEMPLATE of the cluster
+	// for the images of the app.
+	imageNameTemplateKey = "DRYCC_IMAGE_NAME_TEMPLATE"
+	// imageTimestampFormat is the format of the {{timestamp}} of image names, which must be valid
+	// in tags.
+	imageTimestampFormat = "20060102150405"
+)
+
+var (
+	imagePlaceholderRegexp = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+	// branchInvalidChars are the characters of branch names that can't be in image names.
+	branchInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+)
+
+// imageNameVars are the values of the placeholders of image name templates.
+type imageNameVars struct {
+	app       string
+	sha       string
+	ref       string
+	timestamp time.Time
+}
+
+// branch returns the branch of the pushed ref, made valid in image names: it's lowercased and
+// each run of other characters than letters, digits, '_', '.' and '-' is replaced with a '-'.
+func (v imageNameVars) branch() string {
+	branch := strings.TrimPrefix(v.ref, "refs/heads/")
+	branch = branchInvalidChars.ReplaceAllString(strings.ToLower(branch), "-")
+	return strings.Trim(branch, "-.")
+}
+
+// imageNameTemplate returns the template of the names of the images of the app configured with
+// appConf: its DRYCC_IMAGE_NAME_TEMPLATE if it has one, or the one of the cluster.
+func imageNameTemplate(conf *Config, appConf dryccAPI.Config) string {
+	if value, ok := appConf.Values[imageNameTemplateKey]; ok && fmt.Sprint(value) != "" {
+		return fmt.Sprint(value)
+	}
+	if conf.ImageNameTemplate == "" {
+		return defaultImageNameTemplate
+	}
+	return conf.ImageNameTemplate
+}
+
+// renderImageName returns the image name, name:tag, that tmpl gives with vars. Templates must
+// set the tag and use {{sha}}, so that every commit gets an image of its own, and the name they
+// give must be valid in registries: lowercase repository paths, tags of up to 128 letters,
+// digits, '_', '.' and '-', and names of up to 255 characters. Its repository must be that of the
+// app, or one under it, since templates of apps could otherwise overwrite the images of others.
+func renderImageName(tmpl string, vars imageNameVars) (string, error) {
+	var unknown []string
+	hasSha := false
+	name := imagePlaceholderRegexp.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		switch key := imagePlaceholderRegexp.FindStringSubmatch(placeholder)[1]; key {
+		case "app":
+			return vars.app
+		case "sha":
+			hasSha = true
+			return vars.sha
+		case "branch":
+			return vars.branch()
+		case "timestamp":
+			return vars.timestamp.UTC().Format(imageTimestampFormat)
+		default:
+			unknown = append(unknown, placeholder)
+			return placeholder
+		}
+	})
+	switch {
+	case len(unknown) > 0:
+		return "", fmt.Errorf("invalid image name template %s (unknown placeholder %s)", tmpl, strings.Join(unknown, ", "))
+	case !hasSha:
+		return "", fmt.Errorf("invalid image name template %s (it must use {{sha}})", tmpl)
+	}
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid image name %s from template %s (%s)", name, tmpl, err)
+	}
+	// like docker, only take a first path component that looks like a host for a registry
+	if i := strings.Index(name, "/"); i != -1 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		return "", fmt.Errorf("invalid image name %s from template %s (it must not name a registry)", name, tmpl)
+	}
+	if _, ok := ref.(reference.Tagged); !ok {
+		return "", fmt.Errorf("invalid image name %s from template %s (it must set the tag)", name, tmpl)
+	}
+	if _, ok := ref.(reference.Digested); ok {
+		return "", fmt.Errorf("invalid image name %s from template %s (it must not set a digest)", name, tmpl)
+	}
+	if !inAppRepository(name, vars.app) {
+		return "", fmt.Errorf("invalid image name %s from template %s (its repository must be %s, or start with %s/)", name, tmpl, vars.app, vars.app)
+	}
+	return name, nil
+}
+
+// inAppRepository returns true if the repository of the image name name:tag is that of app, or
+// one under it.
+func inAppRepository(image, app string) bool {
+	name, _ := splitImageName(image)
+	return name == app || strings.HasPrefix(name, app+"/")
+}
+
+// splitImageName splits the image name name:tag into its name and tag.
+func splitImageName(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	return image[:i], image[i+1:]
+}
+
+// checkImageReference returns an error if ref, an image name with the registry host and
+// organization it's pushed to, is too long or otherwise invalid for the registry.
+func checkImageReference(ref string) error {
+	if _, err := reference.Parse(ref); err != nil {
+		return fmt.Errorf("invalid image name %s (%s)", ref, err)
+	}
+	return nil
+}
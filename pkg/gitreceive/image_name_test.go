@@ -0,0 +1,66 @@
+package gitreceive
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestRenderImageName(t *testing.T) {
+	vars := imageNameVars{
+		app:       "app",
+		sha:       "12345678",
+		ref:       "refs/heads/Feature/Login_Page",
+		timestamp: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+	}
+	name, err := renderImageName(defaultImageNameTemplate, vars)
+	assert.NoErr(t, err)
+	assert.Equal(t, name, "app:git-12345678", "image name of the default template")
+
+	name, err = renderImageName("{{app}}:{{ branch }}-{{sha}}-{{timestamp}}", vars)
+	assert.NoErr(t, err)
+	assert.Equal(t, name, "app:feature-login_page-12345678-20261017120000", "image name")
+
+	name, err = renderImageName("{{app}}/builds:{{sha}}", vars)
+	assert.NoErr(t, err)
+	assert.Equal(t, name, "app/builds:12345678", "image name with a repository path")
+	// the images of other apps can't be overwritten
+	_, err = renderImageName("builds/{{app}}:{{sha}}", vars)
+	assert.Err(t, err, errors.New("invalid image name builds/app:12345678 from template builds/{{app}}:{{sha}} (its repository must be app, or start with app/)"))
+	_, err = renderImageName("otherapp:git-{{sha}}", vars)
+	assert.Err(t, err, errors.New("invalid image name otherapp:git-12345678 from template otherapp:git-{{sha}} (its repository must be app, or start with app/)"))
+	_, err = renderImageName("{{app}}-other:git-{{sha}}", vars)
+	assert.True(t, err != nil, "rendered the repository of an app named after this one")
+
+	_, err = renderImageName("{{app}}:{{version}}-{{sha}}", vars)
+	assert.Err(t, err, errors.New("invalid image name template {{app}}:{{version}}-{{sha}} (unknown placeholder {{version}})"))
+	_, err = renderImageName("{{app}}:{{branch}}", vars)
+	assert.Err(t, err, errors.New("invalid image name template {{app}}:{{branch}} (it must use {{sha}})"))
+	_, err = renderImageName("{{app}}-{{sha}}", vars)
+	assert.Err(t, err, errors.New("invalid image name app-12345678 from template {{app}}-{{sha}} (it must set the tag)"))
+	_, err = renderImageName("quay.io/{{app}}:{{sha}}", vars)
+	assert.True(t, err != nil, "rendered an image name with a registry")
+	_, err = renderImageName("{{app}}/{{branch}}:{{sha}}", imageNameVars{app: "app", sha: "12345678", ref: "refs/heads/MAIN"})
+	assert.NoErr(t, err)
+	_, err = renderImageName("{{app}}:"+strings.Repeat("x", 128)+"{{sha}}", vars)
+	assert.True(t, err != nil, "rendered a tag longer than 128 characters")
+	_, err = renderImageName("App:{{sha}}", vars)
+	assert.True(t, err != nil, "rendered an uppercase repository")
+}
+
+func TestImageNameTemplate(t *testing.T) {
+	conf := &Config{ImageNameTemplate: "{{app}}:{{branch}}-{{sha}}"}
+	assert.Equal(t, imageNameTemplate(conf, dryccAPI.Config{}), "{{app}}:{{branch}}-{{sha}}", "template of the cluster")
+	appConf := dryccAPI.Config{Values: map[string]interface{}{imageNameTemplateKey: "{{app}}:{{sha}}-{{timestamp}}"}}
+	assert.Equal(t, imageNameTemplate(conf, appConf), "{{app}}:{{sha}}-{{timestamp}}", "template of the app")
+	assert.Equal(t, imageNameTemplate(&Config{}, dryccAPI.Config{}), defaultImageNameTemplate, "template without configuration")
+}
+
+func TestCheckImageReference(t *testing.T) {
+	assert.NoErr(t, checkImageReference("registry.example.com:5000/org/app:main-12345678"))
+	assert.True(t, checkImageReference("registry.example.com/"+strings.Repeat("a", 250)+":git-12345678") != nil, "accepted a name longer than 255 characters")
+}
@@ -0,0 +1,98 @@
+package gitreceive
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/drycc/builder/pkg/registry"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+const (
+	// portKey is the config key of the port the controller routes the web processes of an app to.
+	portKey = "PORT"
+	// imageWebProcess and imageWorkerProcess are the process types container builds without a
+	// Procfile run the command of their image as, depending on whether it exposes a port.
+	imageWebProcess    = "web"
+	imageWorkerProcess = "worker"
+)
+
+// imageProcessTypes synthesizes the process types of a container build without a Procfile from
+// the configuration of its image: its ENTRYPOINT and CMD run as a web process if it EXPOSEs a TCP
+// port, which is returned, or as a worker otherwise. Images without a command get no process
+// types, so the controller runs them as they are.
+func imageProcessTypes(config *registry.ImageConfig) (dryccAPI.ProcessType, string) {
+	cmd := append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+	if len(cmd) == 0 {
+		return dryccAPI.ProcessType{}, ""
+	}
+	port := exposedPort(config.Config.ExposedPorts)
+	if port == "" {
+		return dryccAPI.ProcessType{imageWorkerProcess: shellJoin(cmd)}, ""
+	}
+	return dryccAPI.ProcessType{imageWebProcess: shellJoin(cmd)}, port
+}
+
+// exposedPort returns the lowest TCP port of ports, keyed like "8080/tcp" or "8080" in image
+// configurations, or nothing if there's none.
+func exposedPort(ports map[string]struct{}) string {
+	var tcp []int
+	for key := range ports {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) == 2 && parts[1] != "tcp" {
+			continue
+		}
+		if port, err := strconv.Atoi(parts[0]); err == nil && port > 0 {
+			tcp = append(tcp, port)
+		}
+	}
+	if len(tcp) == 0 {
+		return ""
+	}
+	sort.Ints(tcp)
+	return strconv.Itoa(tcp[0])
+}
+
+// shellJoin joins args into a command line that a shell splits back into args.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, needsQuoting) < 0 {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// needsQuoting returns true if r isn't taken literally by a shell.
+func needsQuoting(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+}
+
+// synthesizeProcessTypes returns the process types of the container build built, which has no
+// Procfile, from the configuration of its image. The port the image exposes is added to
+// configDefaults, which may be nil, unless the app already has one in appConf.
+func synthesizeProcessTypes(built *builtImage, appConf dryccAPI.Config, configDefaults map[string]string) (dryccAPI.ProcessType, map[string]string, error) {
+	config, err := built.images.ImageConfig(*built.ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the configuration of image %s (%s)", built.ref, err)
+	}
+	procType, port := imageProcessTypes(config)
+	for name, command := range procType {
+		pusherTerminal.info(msgImageProcess, name, command)
+	}
+	if _, ok := appConf.Values[portKey]; port != "" && !ok {
+		if _, ok := configDefaults[portKey]; !ok {
+			if configDefaults == nil {
+				configDefaults = make(map[string]string, 1)
+			}
+			configDefaults[portKey] = port
+			pusherTerminal.info(msgImagePort, port)
+		}
+	}
+	return procType, configDefaults, nil
+}
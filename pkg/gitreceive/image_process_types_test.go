@@ -0,0 +1,32 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/registry"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestImageProcessTypes(t *testing.T) {
+	config := new(registry.ImageConfig)
+	config.Config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Config.Cmd = []string{"exec server --name 'app'"}
+	config.Config.ExposedPorts = map[string]struct{}{"9090/tcp": {}, "53/udp": {}, "8080": {}}
+	procType, port := imageProcessTypes(config)
+	assert.Equal(t, procType, dryccAPI.ProcessType{"web": `/bin/sh -c 'exec server --name '\''app'\'''`}, "process types of an image exposing ports")
+	assert.Equal(t, port, "8080", "port")
+
+	config.Config.ExposedPorts = map[string]struct{}{"53/udp": {}}
+	procType, port = imageProcessTypes(config)
+	assert.Equal(t, procType, dryccAPI.ProcessType{"worker": `/bin/sh -c 'exec server --name '\''app'\'''`}, "process types of an image exposing no TCP port")
+	assert.Equal(t, port, "", "port")
+
+	procType, _ = imageProcessTypes(new(registry.ImageConfig))
+	assert.Equal(t, len(procType), 0, "process types of an image without a command")
+}
+
+func TestShellJoin(t *testing.T) {
+	assert.Equal(t, shellJoin([]string{"bundle", "exec", "puma", "-p", "5000"}), "bundle exec puma -p 5000", "plain arguments")
+	assert.Equal(t, shellJoin([]string{"echo", "", "$HOME", "a b"}), `echo '' '$HOME' 'a b'`, "quoted arguments")
+}
@@ -0,0 +1,111 @@
+package gitreceive
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// imagePulledReason is the reason of the event recorded with the time the image of a builder
+	// pod took to pull.
+	imagePulledReason = "BuilderImagePulled"
+
+	// the reasons of the kubelet events about image pulls
+	pullingEventReason = "Pulling"
+	pulledEventReason  = "Pulled"
+	failedEventReason  = "Failed"
+	backOffEventReason = "BackOff"
+)
+
+// eventWatcher watches events, like the events client of a namespace.
+type eventWatcher interface {
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// imagePullEvent is a kubelet event about the pull of an image of a pod.
+type imagePullEvent struct {
+	reason  string
+	image   string
+	message string
+	// time is when the event first happened
+	time time.Time
+}
+
+// eventImage returns the image quoted in the message of a kubelet event, e.g. `Pulling image
+// "drycc/slugbuilder:canary"`.
+func eventImage(message string) string {
+	start := strings.Index(message, `"`)
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(message[start+1:], `"`)
+	if end < 0 {
+		return ""
+	}
+	return message[start+1 : start+1+end]
+}
+
+// imagePullEventOf returns the image pull event of e, if it's one.
+func imagePullEventOf(e *corev1.Event) (imagePullEvent, bool) {
+	switch e.Reason {
+	case pullingEventReason, pulledEventReason, failedEventReason, backOffEventReason:
+	default:
+		return imagePullEvent{}, false
+	}
+	pull := imagePullEvent{reason: e.Reason, image: eventImage(e.Message), message: e.Message, time: e.FirstTimestamp.Time}
+	if pull.time.IsZero() {
+		pull.time = e.EventTime.Time
+	}
+	if pull.time.IsZero() {
+		pull.time = time.Now()
+	}
+	return pull, pull.image != "" || e.Reason == failedEventReason
+}
+
+// watchImagePulls sends the image pull events of the pod name to the returned channel, until ctx
+// is done. Pulls aren't followed, nor their timeout enforced, if the events can't be watched,
+// which needs the list and watch permissions on events.
+func watchImagePulls(ctx context.Context, events eventWatcher, name string) <-chan imagePullEvent {
+	pulls := make(chan imagePullEvent)
+	w, err := events.Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("involvedObject.name", name).String(),
+	})
+	if err != nil {
+		log.Info("WARNING: unable to watch the events of the builder pod %s, its image pulls won't be followed (%s)", name, err)
+		close(pulls)
+		return pulls
+	}
+	go func() {
+		defer close(pulls)
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				event, isEvent := e.Object.(*corev1.Event)
+				if !isEvent || e.Type == watch.Deleted || event.InvolvedObject.Name != name {
+					continue
+				}
+				if pull, ok := imagePullEventOf(event); ok {
+					select {
+					case pulls <- pull:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return pulls
+}
@@ -0,0 +1,89 @@
+package gitreceive
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/k8s"
+	buildertesting "github.com/drycc/builder/pkg/testing"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImagePullEventOf(t *testing.T) {
+	pulling := &corev1.Event{Reason: "Pulling", Message: `Pulling image "drycc/slugbuilder:canary"`}
+	pull, ok := imagePullEventOf(pulling)
+	assert.True(t, ok, "not an image pull event")
+	assert.Equal(t, pull.image, "drycc/slugbuilder:canary", "image")
+	assert.False(t, pull.time.IsZero(), "no time")
+
+	_, ok = imagePullEventOf(&corev1.Event{Reason: "Scheduled", Message: `Successfully assigned drycc/slugbuild-app to "node-1"`})
+	assert.False(t, ok, "scheduling event read as an image pull")
+	pull, ok = imagePullEventOf(&corev1.Event{Reason: "Failed", Message: "Error: ErrImagePull"})
+	assert.True(t, ok && pull.image == "", "pull failure without an image")
+	assert.Equal(t, eventImage(`Pulling image "unterminated`), "", "image of an invalid message")
+}
+
+func TestWatchImagePulls(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := client.CoreV1().Events("drycc")
+	pulls := watchImagePulls(ctx, events, "slugbuild-app")
+	for i, e := range []corev1.Event{
+		{InvolvedObject: corev1.ObjectReference{Name: "other"}, Reason: "Pulling", Message: `Pulling image "other"`},
+		{InvolvedObject: corev1.ObjectReference{Name: "slugbuild-app"}, Reason: "Scheduled", Message: "Successfully assigned"},
+		{InvolvedObject: corev1.ObjectReference{Name: "slugbuild-app"}, Reason: "Pulling", Message: `Pulling image "drycc/slugbuilder"`},
+	} {
+		e.Name = string(rune('a' + i))
+		_, err := events.Create(ctx, &e, metav1.CreateOptions{})
+		assert.NoErr(t, err)
+	}
+	pull := <-pulls
+	assert.Equal(t, pull.reason, "Pulling", "reason")
+	assert.Equal(t, pull.image, "drycc/slugbuilder", "image")
+	cancel()
+	for range pulls {
+	}
+}
+
+func TestWaitForPodImagePull(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	script := buildertesting.NewPodScript()
+	script.Install(client)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	waiter := k8s.NewPodWaiter(client, "drycc")
+	waiter.Start(ctx)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "slugbuild-app", Namespace: "drycc"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "builder"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	_, err := client.CoreV1().Pods("drycc").Create(ctx, pod, metav1.CreateOptions{})
+	assert.NoErr(t, err)
+
+	// the pod starts once its image is pulled
+	pulls := make(chan imagePullEvent)
+	go func() {
+		pulls <- imagePullEvent{reason: pullingEventReason, image: "drycc/slugbuilder", time: time.Now()}
+		pulls <- imagePullEvent{reason: pulledEventReason, image: "drycc/slugbuilder", time: time.Now()}
+		script.Play("drycc", pod.Name, buildertesting.Ready("10.0.0.1"))
+	}()
+	assert.NoErr(t, waitForPod(ctx, waiter, pulls, pod.Name, time.Hour, 5*time.Second, time.Second, nil))
+
+	// the pull of an image that can't be pulled times out, however long the pod may take to start
+	pod.Name = "slugbuild-app2"
+	_, err = client.CoreV1().Pods("drycc").Create(ctx, pod, metav1.CreateOptions{})
+	assert.NoErr(t, err)
+	pulls = make(chan imagePullEvent, 2)
+	pulls <- imagePullEvent{reason: pullingEventReason, image: "drycc/missing", time: time.Now()}
+	pulls <- imagePullEvent{reason: backOffEventReason, image: "drycc/missing", message: `Back-off pulling image "drycc/missing"`}
+	err = waitForPod(ctx, waiter, pulls, pod.Name, time.Hour, 5*time.Second, 100*time.Millisecond, nil)
+	assert.True(t, err != nil && KindOf(err) == ErrTimeout, "the pull didn't time out")
+	assert.True(t, strings.Contains(err.Error(), "Back-off pulling"), "the error doesn't say why the pull failed")
+}
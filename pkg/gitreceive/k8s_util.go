@@ -2,8 +2,8 @@ package gitreceive
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/drycc/builder/pkg/k8s"
@@ -11,8 +11,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/util/wait"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
@@ -21,6 +19,7 @@ const (
 	dockerBuilderName = "drycc-dockerbuilder"
 
 	tarPath         = "TAR_PATH"
+	tarSha256       = "TAR_SHA256"
 	putPath         = "PUT_PATH"
 	cachePath       = "CACHE_PATH"
 	debugKey        = "DRYCC_DEBUG"
@@ -51,106 +50,6 @@ func slugBuilderPodName(appName, shortSha string) string {
 	return fmt.Sprintf("slugbuild-%s-%s-%s", appName, shortSha, uid)
 }
 
-func dockerBuilderPod(
-	debug bool,
-	name,
-	namespace string,
-	env map[string]interface{},
-	tarKey,
-	gitShortHash string,
-	imageName,
-	storageType,
-	image,
-	registryHost,
-	registryPort string,
-	registryEnv map[string]string,
-	pullPolicy corev1.PullPolicy,
-	nodeSelector map[string]string,
-	//) *api.Pod {
-) *corev1.Pod {
-
-	pod := buildPod(debug, name, namespace, pullPolicy, nodeSelector, env)
-
-	// inject application envvars as a special envvar which will be handled by dockerbuilder to
-	// inject them as build-time variables.
-	// NOTE(bacongobbler): docker-py takes buildargs as a json string in the form of
-	//
-	// {"KEY": "value"}
-	//
-	// So we need to translate the map into json.
-	if _, ok := env["DRYCC_DOCKER_BUILD_ARGS_ENABLED"]; ok {
-		dockerBuildArgs, _ := json.Marshal(env)
-		addEnvToPod(pod, "DOCKER_BUILD_ARGS", string(dockerBuildArgs))
-	}
-
-	pod.Spec.Containers[0].Name = dockerBuilderName
-	pod.Spec.Containers[0].Image = image
-
-	addEnvToPod(pod, tarPath, tarKey)
-	addEnvToPod(pod, sourceVersion, gitShortHash)
-	addEnvToPod(pod, "IMG_NAME", imageName)
-	addEnvToPod(pod, builderStorage, storageType)
-	// inject existing DRYCC_REGISTRY_PROXY_HOST and PORT info to dockerbuilder
-	// see https://github.com/drycc/dockerbuilder/issues/83
-	addEnvToPod(pod, "DRYCC_REGISTRY_PROXY_HOST", registryHost)
-	addEnvToPod(pod, "DRYCC_REGISTRY_PROXY_PORT", registryPort)
-
-	for key, value := range registryEnv {
-		addEnvToPod(pod, key, value)
-	}
-
-	return &pod
-}
-
-func slugbuilderPod(
-	debug bool,
-	name,
-	namespace string,
-	env map[string]interface{},
-	envSecretName string,
-	tarKey,
-	putKey,
-	cacheKey,
-	gitShortHash string,
-	storageType,
-	image string,
-	pullPolicy corev1.PullPolicy,
-	nodeSelector map[string]string,
-) *corev1.Pod {
-
-	pod := buildPod(debug, name, namespace, pullPolicy, nodeSelector, nil)
-
-	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
-		Name: envSecretName,
-		VolumeSource: corev1.VolumeSource{
-			Secret: &corev1.SecretVolumeSource{
-				SecretName: envSecretName,
-			},
-		},
-	})
-
-	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
-		Name:      envSecretName,
-		MountPath: envRoot,
-		ReadOnly:  true,
-	})
-
-	pod.Spec.Containers[0].Name = slugBuilderName
-	pod.Spec.Containers[0].Image = image
-
-	// If cacheKey is set, add it to environment
-	if cacheKey != "" {
-		addEnvToPod(pod, cachePath, cacheKey)
-	}
-
-	addEnvToPod(pod, tarPath, tarKey)
-	addEnvToPod(pod, putPath, putKey)
-	addEnvToPod(pod, sourceVersion, gitShortHash)
-	addEnvToPod(pod, builderStorage, storageType)
-
-	return &pod
-}
-
 func buildPod(
 	debug bool,
 	name,
@@ -173,7 +72,8 @@ func buildPod(
 			Name:      name,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"heritage": name,
+				"heritage":      name,
+				builderPodLabel: "true",
 			},
 		},
 	}
@@ -195,13 +95,14 @@ func buildPod(
 		},
 	}
 
-	if len(pod.Spec.Containers) > 0 {
-		for k, v := range env {
-			pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
-				Name:  k,
-				Value: fmt.Sprintf("%v", v),
-			})
-		}
+	// the env is sorted, for the specs of the same builds to be the same
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		addEnvToPod(pod, k, fmt.Sprintf("%v", env[k]))
 	}
 
 	if len(nodeSelector) > 0 {
@@ -224,9 +125,15 @@ func addEnvToPod(pod corev1.Pod, key, value string) {
 	}
 }
 
-// waitForPod waits for a pod in state running, succeeded or failed
-func waitForPod(pw *k8s.PodWatcher, ns, podName string, ticker, interval, timeout time.Duration) error {
-	condition := func(pod *corev1.Pod) (bool, error) {
+// waitForPod waits for a pod in state running, succeeded or failed. The images it pulls meanwhile,
+// as told by pulls, are shown with the time they take, and each of them must be pulled within
+// pullTimeout, unless it's 0.
+func waitForPod(ctx context.Context, waiter *k8s.PodWaiter, pulls <-chan imagePullEvent, podName string, ticker, timeout, pullTimeout time.Duration, recorder *buildRecorder) error {
+	condition := func(t k8s.PodTransition) (bool, error) {
+		if reason := lostReason(t); reason != "" {
+			return true, podLostError{reason: reason}
+		}
+		pod := t.Pod
 		if pod.Status.Phase == corev1.PodRunning {
 			return true, nil
 		}
@@ -234,72 +141,94 @@ func waitForPod(pw *k8s.PodWatcher, ns, podName string, ticker, interval, timeou
 			return true, nil
 		}
 		if pod.Status.Phase == corev1.PodFailed {
+			if err := buildPodError(pod); err != nil {
+				return true, err
+			}
 			return true, fmt.Errorf("Giving up; pod went into failed status: \n[%s]:%s", pod.Status.Reason, pod.Status.Message)
 		}
 		return false, nil
 	}
 
-	quit := progress("...", ticker)
-	err := waitForPodCondition(pw, ns, podName, condition, interval, timeout)
-	quit <- true
-	<-quit
-	return err
-}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := waiter.Wait(waitCtx, podName, condition)
+		done <- err
+	}()
 
-// waitForPodEnd waits for a pod in state succeeded or failed
-func waitForPodEnd(pw *k8s.PodWatcher, ns, podName string, interval, timeout time.Duration) error {
-	condition := func(pod *corev1.Pod) (bool, error) {
-		if pod.Status.Phase == corev1.PodSucceeded {
-			return true, nil
-		}
-		if pod.Status.Phase == corev1.PodFailed {
-			return true, nil
+	beat := pusherTerminal.heartbeat()
+	stop := beat.phase(msgWaitingForPod, ticker)
+	// the image being pulled, since when, and the last failure to pull it
+	var pulling, failure string
+	var pullStart time.Time
+	var pullDeadline <-chan time.Time
+	for {
+		select {
+		case err := <-done:
+			stop()
+			return err
+		case <-pullDeadline:
+			stop()
+			cancel()
+			<-done
+			err := fmt.Errorf("pulling the image %s took longer than %s", pulling, pullTimeout)
+			if failure != "" {
+				err = fmt.Errorf("pulling the image %s took longer than %s (%s)", pulling, pullTimeout, failure)
+			}
+			return timeoutError(err)
+		case pull, ok := <-pulls:
+			if !ok {
+				pulls = nil
+				continue
+			}
+			switch {
+			case pull.reason == pullingEventReason && pulling == "":
+				// pulls that are retried keep the deadline of the first attempt
+				stop()
+				pulling, failure, pullStart = pull.image, "", pull.time
+				stop = beat.phase(msgPullingImage, ticker, pulling)
+				if pullTimeout > 0 {
+					pullDeadline = time.After(pullTimeout - time.Since(pullStart))
+				}
+			case pull.reason == pulledEventReason && pull.image == pulling:
+				stop()
+				took := time.Since(pullStart).Round(time.Second)
+				pusherTerminal.info(msgImagePulled, pulling, took)
+				if recorder != nil {
+					recorder.event(corev1.EventTypeNormal, imagePulledReason, fmt.Sprintf("pulled the image %s in %s", pulling, took))
+				}
+				pulling, pullDeadline = "", nil
+				stop = beat.phase(msgWaitingForPod, ticker)
+			case pull.reason == failedEventReason || pull.reason == backOffEventReason:
+				failure = pull.message
+			}
 		}
-		return false, nil
 	}
-
-	return waitForPodCondition(pw, ns, podName, condition, interval, timeout)
 }
 
-// waitForPodCondition waits for a pod in state defined by a condition (func)
-func waitForPodCondition(pw *k8s.PodWatcher, ns, podName string, condition func(pod *corev1.Pod) (bool, error),
-	interval, timeout time.Duration) error {
-	return wait.PollImmediate(interval, timeout, func() (bool, error) {
-		pods, err := pw.Store.List(labels.Set{"heritage": podName}.AsSelector())
-		if err != nil || len(pods) == 0 {
-			return false, nil
-		}
-
-		done, err := condition(pods[0])
-		if err != nil {
-			return false, err
-		}
-		if done {
-			return true, nil
-		}
-
-		return false, nil
-	})
+// waitForPodEnd waits for a pod in state succeeded or failed, and returns it. It fails with a
+// podLostError if the pod was lost instead.
+func waitForPodEnd(ctx context.Context, waiter *k8s.PodWaiter, podName string, timeout time.Duration) (*corev1.Pod, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return waiter.Wait(waitCtx, podName, podLostCondition)
 }
 
-func progress(msg string, interval time.Duration) chan bool {
-	tick := time.Tick(interval)
-	quit := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-quit:
-				close(quit)
-				return
-			case <-tick:
-				fmt.Println(msg)
-			}
+func createAppEnvConfigSecret(ctx context.Context, secretsClient typedcorev1.SecretInterface, secretName string, env map[string]interface{}) error {
+	newSecret := appEnvConfigSecret(secretName, env)
+	if _, err := secretsClient.Create(ctx, newSecret, metav1.CreateOptions{}); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			_, err = secretsClient.Update(ctx, newSecret, metav1.UpdateOptions{})
+			return err
 		}
-	}()
-	return quit
+		return err
+	}
+	return nil
 }
 
-func createAppEnvConfigSecret(secretsClient typedcorev1.SecretInterface, secretName string, env map[string]interface{}) error {
+// appEnvConfigSecret returns the secret through which env is handed to the slugbuilder.
+func appEnvConfigSecret(secretName string, env map[string]interface{}) *corev1.Secret {
 	newSecret := new(corev1.Secret)
 	newSecret.Name = secretName
 	newSecret.Type = corev1.SecretTypeOpaque
@@ -307,12 +236,5 @@ func createAppEnvConfigSecret(secretsClient typedcorev1.SecretInterface, secretN
 	for k, v := range env {
 		newSecret.Data[k] = []byte(fmt.Sprintf("%v", v))
 	}
-	if _, err := secretsClient.Create(context.TODO(), newSecret, metav1.CreateOptions{}); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			_, err = secretsClient.Update(context.TODO(), newSecret, metav1.UpdateOptions{})
-			return err
-		}
-		return err
-	}
-	return nil
+	return newSecret
 }
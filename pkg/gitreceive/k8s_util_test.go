@@ -1,6 +1,7 @@
 package gitreceive
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -105,21 +106,25 @@ func TestBuildPod(t *testing.T) {
 	}
 
 	for _, build := range slugBuilds {
-		pod = slugbuilderPod(
-			build.debug,
-			build.name,
-			build.namespace,
-			build.env,
-			build.envSecretName,
-			build.tarKey,
-			build.putKey,
-			build.cacheKey,
-			build.gitShortHash,
-			build.storageType,
-			build.slugBuilderImage,
-			build.slugBuilderImagePullPolicy,
-			build.builderPodNodeSelector,
-		)
+		builder := PodSpecBuilder{
+			Namespace:    build.namespace,
+			NodeSelector: build.builderPodNodeSelector,
+			StorageType:  build.storageType,
+			Debug:        build.debug,
+		}
+		pod = builder.SlugBuilderPod(SlugBuilderOptions{
+			PodOptions: PodOptions{
+				Name:       build.name,
+				Image:      build.slugBuilderImage,
+				PullPolicy: build.slugBuilderImagePullPolicy,
+				Env:        build.env,
+				TarKey:     build.tarKey,
+				ShortSha:   build.gitShortHash,
+			},
+			EnvSecretName: build.envSecretName,
+			PutKey:        build.putKey,
+			CacheKey:      build.cacheKey,
+		})
 
 		if pod.ObjectMeta.Name != build.name {
 			t.Errorf("expected %v but returned %v ", build.name, pod.ObjectMeta.Name)
@@ -169,22 +174,26 @@ func TestBuildPod(t *testing.T) {
 	}
 	regEnv := map[string]string{"REG_LOC": "on-cluster"}
 	for _, build := range dockerBuilds {
-		pod = dockerBuilderPod(
-			build.debug,
-			build.name,
-			build.namespace,
-			build.env,
-			build.tarKey,
-			build.gitShortHash,
-			build.imgName,
-			build.storageType,
-			build.dockerBuilderImage,
-			"localhost",
-			"5555",
-			regEnv,
-			build.dockerBuilderImagePullPolicy,
-			build.builderPodNodeSelector,
-		)
+		builder := PodSpecBuilder{
+			Namespace:    build.namespace,
+			NodeSelector: build.builderPodNodeSelector,
+			StorageType:  build.storageType,
+			Debug:        build.debug,
+		}
+		pod = builder.DockerBuilderPod(DockerBuilderOptions{
+			PodOptions: PodOptions{
+				Name:       build.name,
+				Image:      build.dockerBuilderImage,
+				PullPolicy: build.dockerBuilderImagePullPolicy,
+				Env:        build.env,
+				TarKey:     build.tarKey,
+				ShortSha:   build.gitShortHash,
+			},
+			ImageName:    build.imgName,
+			RegistryHost: "localhost",
+			RegistryPort: "5555",
+			RegistryEnv:  regEnv,
+		})
 
 		if pod.ObjectMeta.Name != build.name {
 			t.Errorf("expected %v but returned %v ", build.name, pod.ObjectMeta.Name)
@@ -197,6 +206,7 @@ func TestBuildPod(t *testing.T) {
 		checkForEnv(t, pod, "TAR_PATH", build.tarKey)
 		checkForEnv(t, pod, "IMG_NAME", build.imgName)
 		checkForEnv(t, pod, "REG_LOC", "on-cluster")
+		checkForEnv(t, pod, "DRYCC_REGISTRY_PROXY_ADDR", "localhost:5555")
 		if _, ok := build.env["DRYCC_DOCKER_BUILD_ARGS_ENABLED"]; ok {
 			checkForEnv(t, pod, "DOCKER_BUILD_ARGS", `{"DRYCC_DOCKER_BUILD_ARGS_ENABLED":"1","KEY":"VALUE"}`)
 		}
@@ -246,7 +256,7 @@ func TestCreateAppEnvConfigSecretErr(t *testing.T) {
 			return &corev1.Secret{}, expectedErr
 		},
 	}
-	err := createAppEnvConfigSecret(secretsClient, "test", nil)
+	err := createAppEnvConfigSecret(context.Background(), secretsClient, "test", nil)
 	assert.Err(t, err, expectedErr)
 }
 
@@ -256,7 +266,7 @@ func TestCreateAppEnvConfigSecretSuccess(t *testing.T) {
 			return &corev1.Secret{}, nil
 		},
 	}
-	err := createAppEnvConfigSecret(secretsClient, "test", nil)
+	err := createAppEnvConfigSecret(context.Background(), secretsClient, "test", nil)
 	assert.NoErr(t, err)
 }
 
@@ -270,6 +280,6 @@ func TestCreateAppEnvConfigSecretAlreadyExists(t *testing.T) {
 			return &corev1.Secret{}, nil
 		},
 	}
-	err := createAppEnvConfigSecret(secretsClient, "test", nil)
+	err := createAppEnvConfigSecret(context.Background(), secretsClient, "test", nil)
 	assert.NoErr(t, err)
 }
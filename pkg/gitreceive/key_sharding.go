@@ -0,0 +1,94 @@
+package gitreceive
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/pkg/log"
+)
+
+// StorageKeyPrefix returns the prefix of the object storage keys of the build artifacts of
+// appName. With a shardLength of 0, artifacts share the flat "home/..." key scheme. Otherwise,
+// their keys start with the first shardLength hex digits of the SHA-256 of appName, e.g.
+// "3f/home/...", which spreads the apps over up to 16^shardLength prefixes, each with its own
+// request rate limit on S3.
+func StorageKeyPrefix(appName string, shardLength int) string {
+	if shardLength <= 0 {
+		return ""
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(appName)))
+	if shardLength > len(sum) {
+		shardLength = len(sum)
+	}
+	return sum[:shardLength] + "/"
+}
+
+// MigrateStorageKeys moves the build caches kept under the flat key scheme to their sharded keys
+// for shardLength, returning how many were moved. The artifacts of past builds are left where
+// they are, since the releases built from them refer to their slugs by key.
+func MigrateStorageKeys(driver storagedriver.StorageDriver, shardLength int) (int, error) {
+	if shardLength <= 0 {
+		return 0, nil
+	}
+	dirs, err := driver.List(context.Background(), "/home")
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("listing the apps in the object storage (%s)", err)
+	}
+	moved := 0
+	for _, dir := range dirs {
+		appName := path.Base(dir)
+		if strings.Contains(appName, ":") {
+			// the artifacts of a build
+			continue
+		}
+		from := fmt.Sprintf(CacheKeyPattern, appName)
+		to := StorageKeyPrefix(appName, shardLength) + from
+		fi, err := driver.Stat(context.Background(), from)
+		if err != nil {
+			continue
+		}
+		n, err := moveObjects(driver, fi, from, to)
+		if err != nil {
+			return moved, fmt.Errorf("moving the build cache of %s (%s)", appName, err)
+		}
+		if n > 0 {
+			log.Info("Moved the build cache of %s from %s to %s", appName, from, to)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// moveObjects moves the object from, or all the objects under it if it's a directory, to to,
+// returning how many were moved. Not all drivers can move directories at once.
+func moveObjects(driver storagedriver.StorageDriver, fi storagedriver.FileInfo, from, to string) (int, error) {
+	if !fi.IsDir() {
+		if err := driver.Move(context.Background(), from, to); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	var keys []string
+	err := driver.Walk(context.Background(), from, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			keys = append(keys, fi.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		rel := strings.TrimPrefix(strings.TrimPrefix(key, "/"), from)
+		if err := driver.Move(context.Background(), key, to+rel); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,47 @@
+package gitreceive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestMigrateStorageKeys(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	ctx := context.Background()
+
+	moved, err := MigrateStorageKeys(driver, 2)
+	assert.NoErr(t, err)
+	assert.Equal(t, moved, 0, "caches moved from an empty storage")
+
+	flat := NewSlugBuilderInfo("app", "12345678", false)
+	assert.NoErr(t, driver.PutContent(ctx, flat.CacheKey()+"/layers/a", []byte("a")))
+	assert.NoErr(t, driver.PutContent(ctx, flat.AbsoluteSlugObjectKey(), []byte("slug")))
+	assert.NoErr(t, driver.PutContent(ctx, NewSlugBuilderInfo("other", "12345678", false).CacheKey(), []byte("b")))
+	assert.NoErr(t, driver.PutContent(ctx, "home/nocache/manifest.json", []byte("{}")))
+
+	moved, err = MigrateStorageKeys(driver, 2)
+	assert.NoErr(t, err)
+	assert.Equal(t, moved, 2, "caches moved")
+
+	sharded := NewShardedSlugBuilderInfo("app", "12345678", false, 2)
+	data, err := driver.GetContent(ctx, sharded.CacheKey()+"/layers/a")
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "a", "moved cache")
+	data, err = driver.GetContent(ctx, NewShardedSlugBuilderInfo("other", "12345678", false, 2).CacheKey())
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "b", "moved cache")
+	_, err = driver.Stat(ctx, flat.CacheKey()+"/layers/a")
+	assert.True(t, err != nil, "the flat cache must be gone")
+	_, err = driver.Stat(ctx, flat.AbsoluteSlugObjectKey())
+	assert.NoErr(t, err)
+
+	moved, err = MigrateStorageKeys(driver, 2)
+	assert.NoErr(t, err)
+	assert.Equal(t, moved, 0, "caches moved twice")
+}
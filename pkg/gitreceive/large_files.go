@@ -0,0 +1,134 @@
+package gitreceive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/drycc/pkg/log"
+)
+
+// largeFilesReason is the reason of the event recorded when a push contains large files.
+const largeFilesReason = "LargeFiles"
+
+// zeroRev is the revision git passes to the pre-receive hook for refs that are created or deleted.
+const zeroRev = "0000000000000000000000000000000000000000"
+
+// pushedFile is a blob pushed to the repo.
+type pushedFile struct {
+	path string
+	size int64
+}
+
+// formatSize returns size in a human readable unit.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// parseBatchCheck returns the blobs of at least minSize in the output of git cat-file
+// --batch-check="%(objecttype) %(objectsize) %(rest)" fed with the output of git rev-list
+// --objects, largest first.
+func parseBatchCheck(out []byte, minSize int64) ([]pushedFile, error) {
+	var files []pushedFile
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) < 2 || fields[0] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("reading the size of a pushed file (%s)", err)
+		}
+		if size < minSize {
+			continue
+		}
+		f := pushedFile{size: size}
+		if len(fields) == 3 {
+			f.path = fields[2]
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+	return files, scanner.Err()
+}
+
+// largePushedFiles returns the files of at least minSize pushed to the repo at repoDir with newRev
+// that the repo didn't have yet. In the pre-receive hook, pushed objects are already readable
+// while refs still point to the old revisions.
+func largePushedFiles(repoDir, newRev string, minSize int64) ([]pushedFile, error) {
+	objects, err := repoCmd(repoDir, "git", "rev-list", "--objects", newRev, "--not", "--all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing the pushed objects (%s)", err)
+	}
+	batchCheck := repoCmd(repoDir, "git", "cat-file", "--batch-check=%(objecttype) %(objectsize) %(rest)")
+	batchCheck.Stdin = bytes.NewReader(objects)
+	out, err := batchCheck.Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading the size of the pushed objects (%s)", err)
+	}
+	return parseBatchCheck(out, minSize)
+}
+
+// checkLargeFiles warns the pusher about the files of newRev that are larger than the configured
+// warning size, and rejects the push if any is larger than the configured maximum.
+func checkLargeFiles(conf *Config, repoDir, newRev string, recorder *buildRecorder) error {
+	warnSize, err := parseMemory(conf.LargeFileWarningSize)
+	if err != nil {
+		return fmt.Errorf("invalid large file warning size %q (%s)", conf.LargeFileWarningSize, err)
+	}
+	maxSize, err := parseMemory(conf.LargeFileMaxSize)
+	if err != nil {
+		return fmt.Errorf("invalid large file maximum size %q (%s)", conf.LargeFileMaxSize, err)
+	}
+	if newRev == zeroRev || (warnSize.IsZero() && maxSize.IsZero()) {
+		return nil
+	}
+	minSize := warnSize.Value()
+	if warnSize.IsZero() || (!maxSize.IsZero() && maxSize.Value() < minSize) {
+		minSize = maxSize.Value()
+	}
+	var files []pushedFile
+	err = pusherTerminal.during(msgCheckingFiles, conf.SessionIdleInterval(), func() (err error) {
+		files, err = largePushedFiles(repoDir, newRev, minSize)
+		return err
+	})
+	if err != nil {
+		// the check is advisory unless there's a hard limit to enforce
+		if !maxSize.IsZero() {
+			return err
+		}
+		log.Debug("unable to check the pushed files for large ones (%s)", err)
+		return nil
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	var tooLarge []string
+	log.Info("WARNING: this push contains large files, which slow down every clone and build:")
+	for _, f := range files {
+		log.Info("    %s (%s)", f.path, formatSize(f.size))
+		if !maxSize.IsZero() && f.size > maxSize.Value() {
+			tooLarge = append(tooLarge, f.path)
+		}
+	}
+	log.Info("Remove them from the history, or keep them out of the repo with a .gitignore.")
+	recorder.warn(largeFilesReason, "pushed %d file(s) of more than %s", len(files), formatSize(minSize))
+	if len(tooLarge) > 0 {
+		return policyError(fmt.Errorf("files larger than %s aren't accepted: %s", formatSize(maxSize.Value()), strings.Join(tooLarge, ", ")))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, formatSize(512), "512 B", "bytes")
+	assert.Equal(t, formatSize(1536), "1.5 KiB", "kibibytes")
+	assert.Equal(t, formatSize(120*1024*1024), "120.0 MiB", "mebibytes")
+}
+
+func TestParseBatchCheck(t *testing.T) {
+	out := []byte(`commit 230 
+tree 100 
+blob 52428800 data/dump.sql
+blob 12 README.md
+blob 104857600 node_modules/big/index.js
+`)
+	files, err := parseBatchCheck(out, 1024)
+	assert.NoErr(t, err)
+	assert.Equal(t, files, []pushedFile{
+		{path: "node_modules/big/index.js", size: 104857600},
+		{path: "data/dump.sql", size: 52428800},
+	}, "large files")
+	_, err = parseBatchCheck([]byte("blob big README.md\n"), 1024)
+	assert.True(t, err != nil, "parsed an invalid size")
+}
+
+func TestCheckLargeFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repoDir, err := ioutil.TempDir("", "repo")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(repoDir)
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(repoDir, "big.bin"), make([]byte, 3000), 0644))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(repoDir, "small.txt"), []byte("small"), 0644))
+	for _, args := range [][]string{
+		{"init"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "test"},
+	} {
+		out, err := repoCmd(repoDir, "git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+	}
+	sha, err := repoCmd(repoDir, "git", "rev-parse", "HEAD").Output()
+	assert.NoErr(t, err)
+	newRev := strings.TrimSpace(string(sha))
+	// like in the pre-receive hook, no ref points to the pushed commit yet
+	out, err := repoCmd(repoDir, "git", "update-ref", "-d", "HEAD").CombinedOutput()
+	assert.True(t, err == nil, string(out))
+
+	files, err := largePushedFiles(repoDir, newRev, 2048)
+	assert.NoErr(t, err)
+	assert.Equal(t, files, []pushedFile{{path: "big.bin", size: 3000}}, "large files")
+
+	conf := &Config{LargeFileWarningSize: "2Ki"}
+	assert.NoErr(t, checkLargeFiles(conf, repoDir, newRev, nil))
+	conf.LargeFileMaxSize = "4Ki"
+	assert.NoErr(t, checkLargeFiles(conf, repoDir, newRev, nil))
+	conf.LargeFileMaxSize = "2Ki"
+	err = checkLargeFiles(conf, repoDir, newRev, nil)
+	assert.True(t, err != nil && strings.Contains(err.Error(), "big.bin"), "accepted a file over the maximum size")
+	assert.NoErr(t, checkLargeFiles(conf, repoDir, zeroRev, nil))
+}
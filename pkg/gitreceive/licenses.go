@@ -0,0 +1,250 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// licenseDenyKey is the app config key adding license patterns to LICENSE_DENY, separated by
+	// commas, e.g. GPL-3.0*,AGPL-*.
+	licenseDenyKey = "DRYCC_LICENSE_DENY"
+	// licenseReportName is the name of the license report in the directory of the analysis of a
+	// build.
+	licenseReportName = "licenses.json"
+	// licenseDeniedReason is the reason of the event recorded when dependencies of a build have
+	// denied licenses.
+	licenseDeniedReason = "LicenseDenied"
+
+	// LicensePolicyReject rejects the builds with dependencies whose licenses are denied, and
+	// LicensePolicyWarn only warns about them.
+	LicensePolicyReject = "reject"
+	LicensePolicyWarn   = "warn"
+)
+
+// licensePolicy tells which licenses the dependencies of builds can't have.
+type licensePolicy struct {
+	// deny are the lower case path.Match patterns of the denied SPDX license IDs.
+	deny []string
+	warn bool
+}
+
+// newLicensePolicy returns the policy of the builds of the app with appConf: the LICENSE_DENY
+// patterns of the builder and the DRYCC_LICENSE_DENY patterns of the app.
+func newLicensePolicy(conf *Config, appConf dryccAPI.Config) (*licensePolicy, error) {
+	policy := new(licensePolicy)
+	switch conf.LicensePolicy {
+	case LicensePolicyReject:
+	case LicensePolicyWarn:
+		policy.warn = true
+	default:
+		return nil, fmt.Errorf("unknown LICENSE_POLICY %q, use %s or %s", conf.LicensePolicy, LicensePolicyReject, LicensePolicyWarn)
+	}
+	var err error
+	if policy.deny, err = licensePatterns(policy.deny, conf.LicenseDeny); err != nil {
+		return nil, fmt.Errorf("invalid LICENSE_DENY (%s)", err)
+	}
+	if policy.deny, err = licensePatterns(policy.deny, configString(appConf, licenseDenyKey)); err != nil {
+		return nil, userError(fmt.Errorf("invalid %s (%s)", licenseDenyKey, err))
+	}
+	return policy, nil
+}
+
+// licensePatterns returns patterns with the lower case comma separated patterns of list added.
+func licensePatterns(patterns []string, list string) ([]string, error) {
+	added, err := splitPatterns(strings.ToLower(list))
+	return append(patterns, added...), err
+}
+
+// denies returns true if a dependency licensed under the SPDX license expression can't be used:
+// all the alternatives of an OR are denied, or one of the licenses of an AND. Dependencies
+// without a known license are allowed.
+func (p *licensePolicy) denies(expression string) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expression))
+	if len(tokens) == 0 {
+		return false
+	}
+	denied, _ := p.deniedOr(tokens)
+	return denied
+}
+
+// deniedOr evaluates the OR expression starting at tokens, returning the tokens left after it.
+func (p *licensePolicy) deniedOr(tokens []string) (bool, []string) {
+	denied, tokens := p.deniedAnd(tokens)
+	for len(tokens) > 0 && strings.EqualFold(tokens[0], "OR") {
+		var alternative bool
+		alternative, tokens = p.deniedAnd(tokens[1:])
+		denied = denied && alternative
+	}
+	return denied, tokens
+}
+
+// deniedAnd evaluates the AND expression starting at tokens, returning the tokens left after it.
+func (p *licensePolicy) deniedAnd(tokens []string) (bool, []string) {
+	denied, tokens := p.deniedLicense(tokens)
+	for len(tokens) > 0 && strings.EqualFold(tokens[0], "AND") {
+		var also bool
+		also, tokens = p.deniedLicense(tokens[1:])
+		denied = denied || also
+	}
+	return denied, tokens
+}
+
+// deniedLicense evaluates the license, optionally WITH an exception, or the parenthesized
+// expression starting at tokens, returning the tokens left after it.
+func (p *licensePolicy) deniedLicense(tokens []string) (bool, []string) {
+	if len(tokens) == 0 {
+		return false, tokens
+	}
+	if tokens[0] == "(" {
+		denied, rest := p.deniedOr(tokens[1:])
+		if len(rest) > 0 && rest[0] == ")" {
+			rest = rest[1:]
+		}
+		return denied, rest
+	}
+	denied, rest := matchAny(p.deny, strings.ToLower(tokens[0])), tokens[1:]
+	if len(rest) > 1 && strings.EqualFold(rest[0], "WITH") {
+		rest = rest[2:]
+	}
+	return denied, rest
+}
+
+// licensedPackage is a dependency of a build, with its SPDX license expression, empty if it's
+// unknown.
+type licensedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+// licenseReport lists the dependencies of a build and their licenses, and those that are denied.
+type licenseReport struct {
+	// Format is the format of the SBOM the report was made from, CycloneDX or SPDX.
+	Format   string            `json:"format"`
+	Deny     []string          `json:"deny,omitempty"`
+	Packages []licensedPackage `json:"packages"`
+	Denied   []licensedPackage `json:"denied,omitempty"`
+	// warn is true if the denied licenses don't reject the build.
+	warn bool
+}
+
+// sbomDocument is the subset of the CycloneDX and SPDX JSON documents the licenses are read from.
+type sbomDocument struct {
+	BOMFormat  string `json:"bomFormat"`
+	Components []struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Licenses []struct {
+			License *struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"license"`
+			Expression string `json:"expression"`
+		} `json:"licenses"`
+	} `json:"components"`
+
+	SPDXVersion string `json:"spdxVersion"`
+	Packages    []struct {
+		Name             string `json:"name"`
+		VersionInfo      string `json:"versionInfo"`
+		LicenseConcluded string `json:"licenseConcluded"`
+		LicenseDeclared  string `json:"licenseDeclared"`
+	} `json:"packages"`
+}
+
+// newLicenseReport returns the report of the licenses of the CycloneDX or SPDX JSON document data
+// under policy.
+func newLicenseReport(data []byte, policy *licensePolicy) (*licenseReport, error) {
+	doc := new(sbomDocument)
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	report := &licenseReport{Deny: policy.deny, warn: policy.warn}
+	switch {
+	case doc.BOMFormat == "CycloneDX":
+		report.Format = doc.BOMFormat
+		for _, c := range doc.Components {
+			var licenses []string
+			for _, l := range c.Licenses {
+				switch {
+				case l.Expression != "":
+					licenses = append(licenses, "("+l.Expression+")")
+				case l.License != nil && l.License.ID != "":
+					licenses = append(licenses, l.License.ID)
+				case l.License != nil && l.License.Name != "":
+					licenses = append(licenses, strings.Join(strings.Fields(l.License.Name), "-"))
+				}
+			}
+			report.Packages = append(report.Packages, licensedPackage{Name: c.Name, Version: c.Version, License: strings.Join(licenses, " AND ")})
+		}
+	case doc.SPDXVersion != "":
+		report.Format = "SPDX"
+		for _, p := range doc.Packages {
+			license := spdxLicense(p.LicenseConcluded)
+			if license == "" {
+				license = spdxLicense(p.LicenseDeclared)
+			}
+			report.Packages = append(report.Packages, licensedPackage{Name: p.Name, Version: p.VersionInfo, License: license})
+		}
+	default:
+		return nil, fmt.Errorf("the SBOM is neither a CycloneDX nor an SPDX JSON document")
+	}
+	for _, p := range report.Packages {
+		if policy.denies(p.License) {
+			report.Denied = append(report.Denied, p)
+		}
+	}
+	return report, nil
+}
+
+// spdxLicense returns the SPDX license field license, empty if it's NOASSERTION or NONE.
+func spdxLicense(license string) string {
+	if license == "NOASSERTION" || license == "NONE" {
+		return ""
+	}
+	return license
+}
+
+// store stores r as licenses.json under analysisKey.
+func (r *licenseReport) store(putter storage.ObjectPutter, analysisKey string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := analysisKey + "/" + licenseReportName
+	if err := putter.PutContent(context.Background(), key, data); err != nil {
+		return fmt.Errorf("storing the license report %s (%s)", key, err)
+	}
+	return nil
+}
+
+// checkLicenses shows the dependencies of report with denied licenses, and rejects the build if
+// there are some, unless the policy only warns about them. A nil report checks nothing.
+func (a *sourceAnalysis) checkLicenses(report *licenseReport, recorder *buildRecorder) error {
+	if report == nil {
+		return nil
+	}
+	pusherTerminal.info(msgLicenses, len(report.Packages), len(report.Denied))
+	if len(report.Denied) == 0 {
+		return nil
+	}
+	for i, p := range report.Denied {
+		if i == analysisFindingsShown {
+			break
+		}
+		pusherTerminal.info(msgDeniedLicense, p.Name, p.Version, p.License)
+	}
+	recorder.warn(licenseDeniedReason, "%d dependencies have denied licenses", len(report.Denied))
+	if report.warn {
+		log.Info("WARNING: %d dependencies have denied licenses", len(report.Denied))
+		return nil
+	}
+	return policyError(fmt.Errorf("push rejected, %d dependencies have denied licenses", len(report.Denied)))
+}
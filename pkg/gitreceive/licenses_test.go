@@ -0,0 +1,110 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLicensePolicy(t *testing.T) {
+	conf := &Config{LicenseDeny: "GPL-3.0*", LicensePolicy: LicensePolicyReject}
+	policy, err := newLicensePolicy(conf, dryccAPI.Config{Values: map[string]interface{}{licenseDenyKey: "agpl-*, LicenseRef-proprietary"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, policy.deny, []string{"gpl-3.0*", "agpl-*", "licenseref-proprietary"}, "patterns")
+
+	for expression, denied := range map[string]bool{
+		"":                                          false,
+		"MIT":                                       false,
+		"GPL-3.0-only":                              true,
+		"gpl-3.0-or-later":                          true,
+		"MIT OR GPL-3.0-only":                       false,
+		"GPL-3.0-only OR AGPL-3.0-only":             true,
+		"Apache-2.0 AND GPL-3.0-only":               true,
+		"GPL-3.0-only AND (MIT OR BSD-3-Clause)":    true,
+		"(MIT OR GPL-3.0-only) AND BSD-3-Clause":    false,
+		"GPL-3.0-only WITH GCC-exception-3.1":       true,
+		"GPL-2.0-only WITH Classpath-exception-2.0": false,
+	} {
+		assert.Equal(t, policy.denies(expression), denied, expression)
+	}
+
+	_, err = newLicensePolicy(&Config{LicensePolicy: "block"}, dryccAPI.Config{})
+	assert.True(t, err != nil, "unknown policy")
+	_, err = newLicensePolicy(conf, dryccAPI.Config{Values: map[string]interface{}{licenseDenyKey: "GPL-[3"}})
+	assert.True(t, err != nil && KindOf(err) == ErrUser, "invalid pattern of the app")
+}
+
+func TestLicenseReport(t *testing.T) {
+	policy := &licensePolicy{deny: []string{"gpl-3.0*"}}
+	cyclonedx := `{"bomFormat": "CycloneDX", "components": [
+		{"name": "left-pad", "version": "1.3.0", "licenses": [{"license": {"id": "MIT"}}]},
+		{"name": "readline", "version": "8.2", "licenses": [{"expression": "GPL-3.0-or-later"}]},
+		{"name": "internal", "licenses": [{"license": {"name": "Acme Internal"}}]}
+	]}`
+	report, err := newLicenseReport([]byte(cyclonedx), policy)
+	assert.NoErr(t, err)
+	assert.Equal(t, report.Format, "CycloneDX", "format")
+	assert.Equal(t, report.Packages[2].License, "Acme-Internal", "license without an ID")
+	assert.Equal(t, report.Denied, []licensedPackage{{Name: "readline", Version: "8.2", License: "(GPL-3.0-or-later)"}}, "denied")
+
+	spdx := `{"spdxVersion": "SPDX-2.3", "packages": [
+		{"name": "requests", "versionInfo": "2.31.0", "licenseConcluded": "NOASSERTION", "licenseDeclared": "Apache-2.0"},
+		{"name": "gnureadline", "versionInfo": "8.1", "licenseConcluded": "GPL-3.0-only"}
+	]}`
+	report, err = newLicenseReport([]byte(spdx), policy)
+	assert.NoErr(t, err)
+	assert.Equal(t, report.Packages[0].License, "Apache-2.0", "declared license")
+	assert.Equal(t, len(report.Denied), 1, "denied")
+
+	_, err = newLicenseReport([]byte(`{"packages": []}`), policy)
+	assert.True(t, err != nil, "report of an unknown document")
+
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, report.store(driver, "home/myapp/analysis/abc1234"))
+	data, err := driver.GetContent(context.Background(), "home/myapp/analysis/abc1234/"+licenseReportName)
+	assert.NoErr(t, err)
+	var stored licenseReport
+	assert.NoErr(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, stored.Denied[0].Name, "gnureadline", "stored report")
+}
+
+func TestCheckLicenses(t *testing.T) {
+	report := &licenseReport{
+		Packages: []licensedPackage{{Name: "left-pad", License: "MIT"}, {Name: "readline", Version: "8.2", License: "GPL-3.0-only"}},
+		Denied:   []licensedPackage{{Name: "readline", Version: "8.2", License: "GPL-3.0-only"}},
+	}
+	analysis := new(sourceAnalysis)
+	var err error
+	out := captureOutput(func() {
+		err = analysis.checkLicenses(report, nil)
+	})
+	assert.True(t, err != nil && KindOf(err) == ErrPolicy, "build with denied licenses accepted")
+	assert.True(t, strings.Contains(out, "readline 8.2 is licensed under GPL-3.0-only"), "output "+out)
+
+	report.warn = true
+	assert.NoErr(t, analysis.checkLicenses(report, nil))
+	assert.NoErr(t, analysis.checkLicenses(nil, nil))
+}
+
+func TestAnalysisPodSBOM(t *testing.T) {
+	analysis := &sourceAnalysis{
+		sbom:  &analyzer{Name: "syft", Image: "anchore/syft", Command: []string{"sh", "-c", "syft dir:. -o cyclonedx-json=$SBOM_OUTPUT"}},
+		image: "drycc/builder",
+	}
+	pod := analysis.pod("analysis-myapp", "drycc", "home/myapp:git-abc1234/tar", "home/myapp/analysis/abc1234",
+		compression{name: GzipCompression}, corev1.PullAlways, nil)
+	assert.Equal(t, len(pod.Spec.InitContainers), 2, "init containers")
+	syft := pod.Spec.InitContainers[1]
+	assert.Equal(t, syft.Name, "analyze-syft", "name of the SBOM generator")
+	assert.Equal(t, syft.Env, []corev1.EnvVar{{Name: sbomOutputEnv, Value: "/workspace/sbom.json"}}, "env of the SBOM generator")
+	assert.Equal(t, analysis.names(), "syft", "names")
+}
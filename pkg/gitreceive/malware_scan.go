@@ -0,0 +1,238 @@
+package gitreceive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// malwareFoundReason is the reason of the event recorded when a push is rejected for containing
+// malware.
+const malwareFoundReason = "MalwareFound"
+
+// scanChunkSize is the size of the chunks the source is streamed to scanners in.
+const scanChunkSize = 64 * 1024
+
+// malwareScanner scans the source tarballs of apps for known malware.
+type malwareScanner interface {
+	// scan returns the name of the malware found in r, or "" if r is clean.
+	scan(r io.Reader) (string, error)
+}
+
+// newMalwareScanner returns the scanner at rawURL, nil if it's empty. clamd://host:port streams
+// tarballs to a clamd daemon, e.g. a ClamAV sidecar, and icap://host:port/service sends them to
+// an ICAP server in RESPMOD requests.
+func newMalwareScanner(rawURL string, timeout time.Duration) (malwareScanner, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid malware scanner URL %q (%s)", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid malware scanner URL %q, it has no host", rawURL)
+	}
+	switch u.Scheme {
+	case "clamd":
+		return clamdScanner{addr: withDefaultPort(u.Host, "3310"), timeout: timeout}, nil
+	case "icap":
+		u.Host = withDefaultPort(u.Host, "1344")
+		return icapScanner{service: u, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown malware scanner %q, use clamd:// or icap://", u.Scheme)
+	}
+}
+
+// withDefaultPort returns host with port added, unless it has one already.
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// clamdScanner scans with the INSTREAM command of the clamd daemon at addr.
+type clamdScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (c clamdScanner) scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("connecting to clamd at %s (%s)", c.addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("sending the source to clamd (%s)", err)
+	}
+	buf := make([]byte, scanChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return "", fmt.Errorf("sending the source to clamd (%s)", werr)
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return "", fmt.Errorf("sending the source to clamd (%s)", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("reading the source (%s)", err)
+		}
+	}
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", fmt.Errorf("sending the source to clamd (%s)", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("reading the reply of clamd (%s)", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply returns the malware named in reply, the reply of clamd to INSTREAM, e.g.
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd couldn't scan the source (%s)", reply)
+	}
+}
+
+// icapScanner scans with RESPMOD requests to the ICAP service at service.
+type icapScanner struct {
+	service *url.URL
+	timeout time.Duration
+}
+
+// icapThreatHeaders are the headers ICAP servers name the malware they found in.
+var icapThreatHeaders = []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"}
+
+func (c icapScanner) scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", c.service.Host, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("connecting to the ICAP server at %s (%s)", c.service.Host, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	// the source is sent as the body of an HTTP response for the server to check
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", c.service)
+	fmt.Fprintf(w, "Host: %s\r\n", c.service.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	w.WriteString(resHdr)
+	body := httputil.NewChunkedWriter(w)
+	if _, err := io.CopyBuffer(body, r, make([]byte, scanChunkSize)); err != nil {
+		return "", fmt.Errorf("sending the source to the ICAP server (%s)", err)
+	}
+	body.Close()
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("sending the source to the ICAP server (%s)", err)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("reading the reply of the ICAP server (%s)", err)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("reading the reply of the ICAP server (%s)", err)
+	}
+	return parseICAPReply(status, header)
+}
+
+// parseICAPReply returns the malware named in the reply of an ICAP server with the given status
+// line and header. The server either doesn't modify a clean source (204) or replaces it (200).
+func parseICAPReply(status string, header textproto.MIMEHeader) (string, error) {
+	fields := strings.SplitN(status, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return "", fmt.Errorf("invalid reply of the ICAP server %q", status)
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid reply of the ICAP server %q", status)
+	}
+	switch code {
+	case 204:
+		return "", nil
+	case 200:
+		for _, key := range icapThreatHeaders {
+			if threat := header.Get(key); threat != "" {
+				return icapThreatName(threat), nil
+			}
+		}
+		return "unknown malware", nil
+	default:
+		return "", fmt.Errorf("the ICAP server couldn't scan the source (%s)", status)
+	}
+}
+
+// icapThreatName returns the name in threat, an X-Infection-Found header like
+// "Type=0; Resolution=2; Threat=Eicar-Signature;", or threat itself.
+func icapThreatName(threat string) string {
+	for _, param := range strings.Split(threat, ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "Threat") {
+			return kv[1]
+		}
+	}
+	return strings.TrimSpace(threat)
+}
+
+// scanSource rejects the push of appName if scanner finds malware in its source tarball. Scans
+// that fail reject the push too, the source can't be built unscanned.
+func scanSource(conf *Config, scanner malwareScanner, appName string, archive *sourceArchive, recorder *buildRecorder) error {
+	if scanner == nil {
+		return nil
+	}
+	var threat string
+	err := pusherTerminal.during(msgScanningSource, conf.SessionIdleInterval(), func() (err error) {
+		f, err := archive.open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		threat, err = scanner.scan(f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("scanning the source for malware (%s)", err)
+	}
+	if threat == "" {
+		return nil
+	}
+	log.Info("The malware scanner found %s in the source of %s", threat, appName)
+	recorder.warn(malwareFoundReason, "the source contains %s", threat)
+	return policyError(fmt.Errorf("push rejected, the source contains malware (%s)", threat))
+}
@@ -0,0 +1,159 @@
+package gitreceive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+type fakeScanner struct {
+	scanned []byte
+	threat  string
+	err     error
+}
+
+func (f *fakeScanner) scan(r io.Reader) (string, error) {
+	f.scanned, _ = ioutil.ReadAll(r)
+	return f.threat, f.err
+}
+
+// serveOnce accepts one connection on a local port and replies to it with handle.
+func serveOnce(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoErr(t, err)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestNewMalwareScanner(t *testing.T) {
+	scanner, err := newMalwareScanner("", time.Second)
+	assert.NoErr(t, err)
+	assert.True(t, scanner == nil, "scanner without a URL")
+
+	scanner, err = newMalwareScanner("clamd://clamav", time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, scanner.(clamdScanner).addr, "clamav:3310", "clamd address")
+
+	scanner, err = newMalwareScanner("icap://icap.example.com/avscan", time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, scanner.(icapScanner).service.String(), "icap://icap.example.com:1344/avscan", "ICAP service")
+
+	_, err = newMalwareScanner("http://scanner", time.Second)
+	assert.Err(t, err, errors.New(`unknown malware scanner "http", use clamd:// or icap://`))
+}
+
+func TestClamdScanner(t *testing.T) {
+	var received bytes.Buffer
+	addr := serveOnce(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if cmd, _ := r.ReadString('\x00'); cmd != "zINSTREAM\x00" {
+			return
+		}
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			io.CopyN(&received, r, int64(n))
+		}
+		conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+	})
+	source := strings.Repeat("x", scanChunkSize+10)
+	threat, err := clamdScanner{addr: addr, timeout: time.Second}.scan(strings.NewReader(source))
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "Eicar-Signature", "threat")
+	assert.Equal(t, received.String(), source, "scanned source")
+}
+
+func TestParseClamdReply(t *testing.T) {
+	threat, err := parseClamdReply("stream: OK")
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "", "threat of a clean source")
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	assert.Err(t, err, errors.New("clamd couldn't scan the source (INSTREAM size limit exceeded. ERROR)"))
+}
+
+func TestICAPScanner(t *testing.T) {
+	var request string
+	addr := serveOnce(t, func(conn net.Conn) {
+		var buf bytes.Buffer
+		r := bufio.NewReader(conn)
+		for !strings.HasSuffix(buf.String(), "\r\n0\r\n\r\n") {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			buf.WriteByte(b)
+		}
+		request = buf.String()
+		conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Signature;\r\n\r\n"))
+	})
+	scanner, err := newMalwareScanner("icap://"+addr+"/avscan", time.Second)
+	assert.NoErr(t, err)
+	threat, err := scanner.scan(strings.NewReader("source"))
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "Eicar-Signature", "threat")
+	assert.True(t, strings.HasPrefix(request, "RESPMOD icap://"+addr+"/avscan ICAP/1.0\r\n"), "request line")
+	assert.True(t, strings.Contains(request, "\r\n\r\n6\r\nsource\r\n0\r\n\r\n"), "chunked source")
+}
+
+func TestParseICAPReply(t *testing.T) {
+	threat, err := parseICAPReply("ICAP/1.0 204 No Content", textproto.MIMEHeader{})
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "", "threat of a clean source")
+
+	threat, err = parseICAPReply("ICAP/1.0 200 OK", textproto.MIMEHeader{"X-Virus-Id": {"Trojan.Agent"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "Trojan.Agent", "threat")
+
+	threat, err = parseICAPReply("ICAP/1.0 200 OK", textproto.MIMEHeader{})
+	assert.NoErr(t, err)
+	assert.Equal(t, threat, "unknown malware", "threat without a header")
+
+	_, err = parseICAPReply("ICAP/1.0 500 Server Error", textproto.MIMEHeader{})
+	assert.Err(t, err, errors.New("the ICAP server couldn't scan the source (ICAP/1.0 500 Server Error)"))
+}
+
+func TestScanSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	archive := testSourceArchive(t, dir, "source")
+	assert.NoErr(t, scanSource(&Config{}, nil, "app", archive, nil))
+
+	scanner := &fakeScanner{}
+	assert.NoErr(t, scanSource(&Config{}, scanner, "app", archive, nil))
+	assert.Equal(t, string(scanner.scanned), "source", "scanned source")
+
+	scanner = &fakeScanner{threat: "Eicar-Signature"}
+	err = scanSource(&Config{}, scanner, "app", archive, nil)
+	assert.Err(t, err, policyError(errors.New("push rejected, the source contains malware (Eicar-Signature)")))
+
+	scanner = &fakeScanner{err: errors.New("connection refused")}
+	err = scanSource(&Config{}, scanner, "app", archive, nil)
+	assert.Err(t, err, errors.New("scanning the source for malware (connection refused)"))
+}
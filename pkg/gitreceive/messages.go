@@ -0,0 +1,315 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// langPushOption selects the language of the messages of a push, e.g. "-o lang=zh".
+	langPushOption = "lang"
+	// buildLangKey is the app config key selecting the language of the messages of its pushes.
+	buildLangKey = "DRYCC_BUILD_LANG"
+
+	defaultLanguage = "en"
+)
+
+// The IDs of the messages shown to pushers, in the message catalog.
+const (
+	msgStepSource       = "step-source"
+	msgStepBuild        = "step-build"
+	msgStepRelease      = "step-release"
+	msgStep             = "step"
+	msgWaitingForPod    = "waiting-for-pod"
+	msgWaitingForDeploy = "waiting-for-deploy"
+	msgStartingBuild    = "starting-build"
+	msgOOMRetry         = "oom-retry"
+	msgOOMLimit         = "oom-limit"
+	msgBuildComplete    = "build-complete"
+	msgLaunching        = "launching"
+	msgReleasePending   = "release-pending"
+	msgDeployed         = "deployed"
+	msgOpenHint         = "open-hint"
+	msgHelpHint         = "help-hint"
+	msgImporting        = "importing"
+	msgReleasePromoted  = "release-promoted"
+	msgStackOverride    = "stack-override"
+	msgStackDockerfile  = "stack-dockerfile"
+	msgStackBuildpacks  = "stack-buildpacks"
+	msgStackDefault     = "stack-default"
+	msgCheckingFiles    = "checking-files"
+	msgCheckingOut      = "checking-out"
+	msgUploadingSource  = "uploading-source"
+	msgCheckingImage    = "checking-image"
+	msgVerifyingSlug    = "verifying-slug"
+	msgPromoting        = "promoting"
+	msgCompactingRepo   = "compacting-repo"
+	msgBuildProfile     = "build-profile"
+	msgScanningSource   = "scanning-source"
+	msgPodLost          = "pod-lost"
+	msgSourceDeduped    = "source-deduped"
+	msgBuildCache       = "build-cache"
+	msgCacheCleared     = "cache-cleared"
+	msgPushingImage     = "pushing-image"
+	msgImageProcess     = "image-process"
+	msgImagePort        = "image-port"
+	msgReleasePhase     = "release-phase"
+	msgStartingServices = "starting-services"
+	msgSignedBy         = "signed-by"
+	msgPullingImage     = "pulling-image"
+	msgImagePulled      = "image-pulled"
+	msgBuildingFor      = "building-for"
+	msgPushingIndex     = "pushing-index"
+	msgAnalyzing        = "analyzing"
+	msgAnalysisResult   = "analysis-result"
+	msgAnalysisFinding  = "analysis-finding"
+	msgLicenses         = "licenses"
+	msgDeniedLicense    = "denied-license"
+	msgPushEnv          = "push-env"
+	msgBuildQueued      = "build-queued"
+	msgBuildCost        = "build-cost"
+	msgBuildSlower      = "build-slower"
+	msgBuildFaster      = "build-faster"
+	msgSmokeTest        = "smoke-test"
+	msgSmokeTestPassed  = "smoke-test-passed"
+	msgRollingBack      = "rolling-back"
+	msgReleaseState     = "release-state"
+	msgStillDeploying   = "release-still-deploying"
+	msgHeartbeat        = "heartbeat"
+	msgBuildLogLineCut  = "build-log-line-cut"
+	msgBuildLogLimit    = "build-log-limit"
+	msgBuildLogSkipped  = "build-log-skipped"
+	msgBuildLogTail     = "build-log-tail"
+	msgBuildLogStored   = "build-log-stored"
+)
+
+// messageCatalog holds the messages shown to pushers in each language, as fmt formats keyed by
+// message ID. Translations keep the verbs of the English formats, in the same order.
+type messageCatalog map[string]map[string]string
+
+// builtinMessages is the catalog of the languages supported out of the box.
+var builtinMessages = messageCatalog{
+	"en": {
+		msgStepSource:       "Preparing the source",
+		msgStepBuild:        "Building",
+		msgStepRelease:      "Releasing",
+		msgStep:             "Step %d/%d: %s",
+		msgWaitingForPod:    "Waiting for the builder pod to start",
+		msgWaitingForDeploy: "Waiting for the controller to deploy the release",
+		msgStartingBuild:    "Starting build... but first, coffee!",
+		msgOOMRetry:         "The build ran out of memory with a limit of %s, retrying it once with %s",
+		msgOOMLimit:         "The build needed more than %s of memory, set its limit permanently with `drycc config:set %s=%s`",
+		msgBuildComplete:    "Build complete.",
+		msgLaunching:        "Launching App...",
+		msgReleasePending:   "The release of %s (git-%s) is pending and will be published once the controller is back\n",
+		msgDeployed:         "Done, %s:v%d deployed to Workflow\n",
+		msgOpenHint:         "Use 'drycc open' to view this application in your browser\n",
+		msgHelpHint:         "To learn more, use 'drycc help' or visit https://drycc.com/\n",
+		msgImporting:        "Importing image %s...",
+		msgReleasePromoted:  "git-%s was promoted from another cluster, releasing it without rebuilding",
+		msgStackOverride:    "Using the %s stack, set with %s",
+		msgStackDockerfile:  "Detected Dockerfile at ./Dockerfile → %s stack",
+		msgStackBuildpacks:  "No Dockerfile; using buildpacks with the %s stack",
+		msgStackDefault:     "No Dockerfile or Procfile; using the default %s stack",
+		msgCheckingFiles:    "Checking the pushed files",
+		msgCheckingOut:      "Checking out the source",
+		msgUploadingSource:  "Uploading the source",
+		msgCheckingImage:    "Checking image %s",
+		msgVerifyingSlug:    "Verifying the slug",
+		msgPromoting:        "Promoting git-%s",
+		msgCompactingRepo:   "Compacting the repository",
+		msgBuildProfile:     "Using the %s build profile",
+		msgScanningSource:   "Scanning the source for malware",
+		msgPodLost:          "The builder pod was %s, restarting the build (retry %d of %d)",
+		msgSourceDeduped:    "Uploaded %d of %d source files (%s), the others are stored already",
+		msgBuildCache:       "Using the build cache of %s, updated %s ago (push with -o %s to start without it)",
+		msgCacheCleared:     "Deleted the build cache of %s",
+		msgPushingImage:     "Pushing the image to %s",
+		msgImageProcess:     "No Procfile found, the %s process runs the command of the image: %s",
+		msgImagePort:        "Routing web traffic to port %s, exposed by the image",
+		msgReleasePhase:     "Running the release phase: %s",
+		msgStartingServices: "Starting %d build services",
+		msgSignedBy:         "Signed by %s with the %s key %s",
+		msgPullingImage:     "Pulling the image %s",
+		msgImagePulled:      "Pulled the image %s in %s",
+		msgBuildingFor:      "Building for %s at once",
+		msgPushingIndex:     "Pushing the manifest list of %s",
+		msgAnalyzing:        "Analyzing the source with %s",
+		msgAnalysisResult:   "%s found %d errors, %d warnings and %d notes",
+		msgAnalysisFinding:  "%s %s at %s: %s",
+		msgLicenses:         "Checked the licenses of %d dependencies, %d of them are denied",
+		msgDeniedLicense:    "%s %s is licensed under %s",
+		msgPushEnv:          "Building with %s from the push options",
+		msgBuildQueued:      "Queued the build of git-%s to run in the off-peak window %s UTC, from %s, as ticket %s. Look it up with: ssh <builder> build-status <ticket>",
+		msgBuildCost:        "The build cost about %.4f %s: %.2f CPU core hours and %.2f GiB hours of memory over %s",
+		msgBuildSlower:      "The build took %s, %d%% slower than the 30-day median of %s",
+		msgBuildFaster:      "The build took %s, %d%% faster than the 30-day median of %s",
+		msgSmokeTest:        "Running the smoke test of v%d: %s",
+		msgSmokeTestPassed:  "The smoke test passed",
+		msgRollingBack:      "Rolling %s back to v%d",
+		msgReleaseState:     "v%d %s: %s (%s)",
+		msgStillDeploying:   "v%d is still deploying after %s, follow it with `drycc releases:info v%d -a %s`",
+		msgHeartbeat:        "%s (%s, %s since the push started)",
+		msgBuildLogLineCut:  "[%s cut]",
+		msgBuildLogLimit:    "The build log passed %s, only one line in %d is shown from now on, and its end once the build is over",
+		msgBuildLogSkipped:  "... %d lines (%s) skipped so far",
+		msgBuildLogTail:     "%d lines (%s) of the build log were skipped, here are its last %s:",
+		msgBuildLogStored:   "The end of the build log is stored as %s",
+	},
+	"zh": {
+		msgStepSource:       "准备源代码",
+		msgStepBuild:        "构建",
+		msgStepRelease:      "发布",
+		msgStep:             "步骤 %d/%d：%s",
+		msgWaitingForPod:    "等待构建 pod 启动",
+		msgWaitingForDeploy: "等待控制器部署新版本",
+		msgStartingBuild:    "开始构建……先来杯咖啡吧！",
+		msgOOMRetry:         "构建在内存限制 %s 下内存不足，使用 %s 重试一次",
+		msgOOMLimit:         "构建需要超过 %s 的内存，可以用 `drycc config:set %s=%s` 永久设置其限制",
+		msgBuildComplete:    "构建完成。",
+		msgLaunching:        "正在启动应用……",
+		msgReleasePending:   "%s（git-%s）的发布已挂起，将在控制器恢复后发布\n",
+		msgDeployed:         "完成，%s:v%d 已部署到 Workflow\n",
+		msgOpenHint:         "使用 'drycc open' 在浏览器中查看此应用\n",
+		msgHelpHint:         "了解更多，请使用 'drycc help' 或访问 https://drycc.com/\n",
+		msgImporting:        "正在导入镜像 %s……",
+		msgReleasePromoted:  "git-%s 已从另一个集群提升，直接发布而不重新构建",
+		msgStackOverride:    "使用 %s 技术栈，由 %s 设置",
+		msgStackDockerfile:  "检测到 ./Dockerfile → %s 技术栈",
+		msgStackBuildpacks:  "没有 Dockerfile；使用 %s 技术栈的 buildpack 构建",
+		msgStackDefault:     "没有 Dockerfile 或 Procfile；使用默认的 %s 技术栈",
+		msgCheckingFiles:    "检查推送的文件",
+		msgCheckingOut:      "检出源代码",
+		msgUploadingSource:  "上传源代码",
+		msgCheckingImage:    "检查镜像 %s",
+		msgVerifyingSlug:    "校验 slug",
+		msgPromoting:        "提升 git-%s",
+		msgCompactingRepo:   "压缩仓库",
+		msgBuildProfile:     "使用 %s 构建配置",
+		msgScanningSource:   "扫描源代码中的恶意软件",
+		msgPodLost:          "构建 pod 丢失（%s），重新开始构建（第 %d 次重试，共 %d 次）",
+		msgSourceDeduped:    "上传了 %d 个源文件（共 %d 个，%s），其余文件已存储",
+		msgBuildCache:       "使用 %s 的构建缓存，%s 前更新（推送时加上 -o %s 可不使用缓存）",
+		msgCacheCleared:     "已删除 %s 的构建缓存",
+		msgPushingImage:     "推送镜像到 %s",
+		msgImageProcess:     "未找到 Procfile，%s 进程运行镜像的命令: %s",
+		msgImagePort:        "将 web 流量路由到镜像暴露的端口 %s",
+		msgReleasePhase:     "运行发布阶段: %s",
+		msgStartingServices: "启动 %d 个构建服务",
+		msgSignedBy:         "由 %s 使用 %s 密钥 %s 签名",
+		msgPullingImage:     "拉取镜像 %s",
+		msgImagePulled:      "拉取镜像 %s 用时 %s",
+		msgBuildingFor:      "同时为 %s 构建",
+		msgPushingIndex:     "推送 %s 的多平台清单",
+		msgAnalyzing:        "使用 %s 分析源代码",
+		msgAnalysisResult:   "%s 发现 %d 个错误、%d 个警告和 %d 个提示",
+		msgAnalysisFinding:  "%s %s 位于 %s: %s",
+		msgLicenses:         "已检查 %d 个依赖的许可证, 其中 %d 个被禁止",
+		msgDeniedLicense:    "%s %s 的许可证为 %s",
+		msgPushEnv:          "使用推送选项中的 %s 构建",
+		msgBuildQueued:      "git-%s 的构建已排队, 将在低峰时段 %s UTC 内运行, 最早于 %s, 工单号 %s. 查询状态: ssh <builder> build-status <工单号>",
+		msgBuildCost:        "本次构建的费用约为 %.4f %s: %.2f CPU 核时和 %.2f GiB 时的内存, 历时 %s",
+		msgBuildSlower:      "本次构建耗时 %s, 比近 30 天的中位数慢 %d%% (%s)",
+		msgBuildFaster:      "本次构建耗时 %s, 比近 30 天的中位数快 %d%% (%s)",
+		msgSmokeTest:        "运行 v%d 的冒烟测试: %s",
+		msgSmokeTestPassed:  "冒烟测试通过",
+		msgRollingBack:      "将 %s 回滚到 v%d",
+		msgReleaseState:     "v%d %s: %s (%s)",
+		msgStillDeploying:   "v%d 在 %s 后仍在部署, 可以用 `drycc releases:info v%d -a %s` 跟踪",
+		msgHeartbeat:        "%s（%s，推送已进行 %s）",
+		msgBuildLogLineCut:  "[已截断 %s]",
+		msgBuildLogLimit:    "构建日志已超过 %s, 此后每 %d 行只显示一行, 构建结束后显示日志末尾",
+		msgBuildLogSkipped:  "... 已跳过 %d 行 (%s)",
+		msgBuildLogTail:     "构建日志共跳过 %d 行 (%s), 以下是最后 %s:",
+		msgBuildLogStored:   "构建日志的末尾已保存为 %s",
+	},
+}
+
+// loadMessageCatalog returns the built-in catalog, with the messages of the catalog at path added
+// to it, if there is one. It's a JSON object of the messages of each language keyed by ID, usually
+// mounted from a ConfigMap.
+func loadMessageCatalog(path string) (messageCatalog, error) {
+	catalog := make(messageCatalog)
+	for lang, messages := range builtinMessages {
+		catalog[lang] = make(map[string]string)
+		for id, message := range messages {
+			catalog[lang][id] = message
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var custom messageCatalog
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("parsing the message catalog %s (%s)", path, err)
+	}
+	for lang, messages := range custom {
+		lang = strings.ToLower(lang)
+		if catalog[lang] == nil {
+			catalog[lang] = make(map[string]string)
+		}
+		for id, message := range messages {
+			catalog[lang][id] = message
+		}
+	}
+	return catalog, nil
+}
+
+// language returns the language of catalog matching lang, e.g. "zh" for "zh_CN.UTF-8", or "" if
+// there is none.
+func (c messageCatalog) language(lang string) string {
+	lang = strings.ToLower(strings.SplitN(lang, ".", 2)[0])
+	lang = strings.Replace(lang, "_", "-", -1)
+	if _, ok := c[lang]; ok {
+		return lang
+	}
+	if i := strings.Index(lang, "-"); i > 0 {
+		if _, ok := c[lang[:i]]; ok {
+			return lang[:i]
+		}
+	}
+	return ""
+}
+
+// setLanguage selects the language of the messages of t, from the push option or, if there is
+// none, from the app config. Unsupported languages fall back to English.
+func (t *terminal) setLanguage(pushOpts PushOptions, appConf dryccAPI.Config) {
+	lang, ok := pushOpts.Get(langPushOption)
+	if !ok {
+		value, ok := appConf.Values[buildLangKey]
+		if !ok {
+			return
+		}
+		lang = fmt.Sprint(value)
+	}
+	if t.lang = t.messages.language(lang); t.lang == "" {
+		log.Debug("no messages in %s, using %s", lang, defaultLanguage)
+		t.lang = defaultLanguage
+	}
+}
+
+// text returns the message id in the language of t, or in English if it's not translated. Messages
+// that aren't in the catalog are their own text.
+func (t *terminal) text(id string) string {
+	if message, ok := t.messages[t.lang][id]; ok {
+		return message
+	}
+	if message, ok := t.messages[defaultLanguage][id]; ok {
+		return message
+	}
+	return id
+}
+
+// info prints the message id, formatted with args.
+func (t *terminal) info(id string, args ...interface{}) {
+	log.Info(t.text(id), args...)
+}
@@ -0,0 +1,76 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestLoadMessageCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "messages")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "catalog.json")
+
+	catalog, err := loadMessageCatalog(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, catalog, builtinMessages, "catalog without a custom catalog")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{
+		"DE": {"build-complete": "Build abgeschlossen."},
+		"en": {"launching": "Launching..."}
+	}`), 0644))
+	catalog, err = loadMessageCatalog(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, catalog["de"][msgBuildComplete], "Build abgeschlossen.", "added message")
+	assert.Equal(t, catalog["en"][msgLaunching], "Launching...", "overridden message")
+	assert.Equal(t, catalog["en"][msgBuildComplete], "Build complete.", "built-in message")
+	assert.Equal(t, builtinMessages["en"][msgLaunching], "Launching App...", "built-in catalog")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"de": ["Build abgeschlossen."]}`), 0644))
+	_, err = loadMessageCatalog(path)
+	assert.True(t, err != nil, "loaded an invalid catalog")
+}
+
+func TestMessageCatalogLanguage(t *testing.T) {
+	for lang, expected := range map[string]string{
+		"zh":          "zh",
+		"ZH":          "zh",
+		"zh-CN":       "zh",
+		"zh_CN.UTF-8": "zh",
+		"en_US":       "en",
+		"fr":          "",
+		"":            "",
+	} {
+		assert.Equal(t, builtinMessages.language(lang), expected, lang)
+	}
+}
+
+func TestTerminalText(t *testing.T) {
+	term := &terminal{messages: messageCatalog{
+		"en": {msgBuildComplete: "Build complete.", msgLaunching: "Launching App..."},
+		"de": {msgBuildComplete: "Build abgeschlossen."},
+	}, lang: defaultLanguage}
+	assert.Equal(t, term.text(msgBuildComplete), "Build complete.", "English message")
+
+	term.setLanguage(PushOptions{}, dryccAPI.Config{Values: map[string]interface{}{buildLangKey: "de_DE"}})
+	assert.Equal(t, term.lang, "de", "language from the app config")
+	assert.Equal(t, term.text(msgBuildComplete), "Build abgeschlossen.", "translated message")
+	assert.Equal(t, term.text(msgLaunching), "Launching App...", "untranslated message")
+	assert.Equal(t, term.text("unknown"), "unknown", "message without an ID")
+
+	term.setLanguage(PushOptions{langPushOption: "en"}, dryccAPI.Config{Values: map[string]interface{}{buildLangKey: "de"}})
+	assert.Equal(t, term.lang, "en", "language from the push option")
+	term.setLanguage(PushOptions{langPushOption: "fr"}, dryccAPI.Config{})
+	assert.Equal(t, term.lang, defaultLanguage, "unsupported language")
+}
+
+func TestBuiltinMessagesTranslated(t *testing.T) {
+	for lang, messages := range builtinMessages {
+		assert.Equal(t, len(messages), len(builtinMessages[defaultLanguage]), lang+" messages")
+	}
+}
@@ -0,0 +1,273 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// buildEgressKey is the app config key listing the additional destinations the builder pods of
+	// the app can reach, e.g. "pypi.internal.example.com:443,10.20.0.0/16", among those the
+	// operator approved in BuilderPodEgressAppAllow.
+	buildEgressKey = "DRYCC_BUILD_EGRESS"
+	// buildEgressLabel selects the builder pods of a build in its network policy.
+	buildEgressLabel = "builder.drycc.cc/egress"
+)
+
+// networkPolicyClient is the subset of a
+// (k8s.io/client-go/kubernetes/typed/networking/v1).NetworkPolicyInterface needed to isolate
+// builder pods.
+type networkPolicyClient interface {
+	Create(ctx context.Context, policy *networkingv1.NetworkPolicy, opts metav1.CreateOptions) (*networkingv1.NetworkPolicy, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// egressDestination is a network builder pods can reach, on port or on every port if it's 0.
+type egressDestination struct {
+	cidrs []string
+	port  int
+}
+
+// parseEgressDestination parses entry, a CIDR, IP or host name with an optional port, e.g.
+// "10.0.0.0/8", "minio.example.com:9000" or "[fd00::1]:443". Host names are resolved with lookup,
+// once: the policy keeps the addresses they had when it was created, for the whole build.
+func parseEgressDestination(entry string, lookup func(string) ([]net.IP, error)) (egressDestination, error) {
+	host, port := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host, port = h, p
+	}
+	var dest egressDestination
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return dest, fmt.Errorf("invalid port in egress destination %q", entry)
+		}
+		dest.port = n
+	}
+	if _, cidr, err := net.ParseCIDR(host); err == nil {
+		dest.cidrs = []string{cidr.String()}
+		return dest, nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookup(host); err != nil {
+			return dest, fmt.Errorf("resolving egress destination %q (%s)", entry, err)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			dest.cidrs = append(dest.cidrs, ip.String()+"/32")
+		} else {
+			dest.cidrs = append(dest.cidrs, ip.String()+"/128")
+		}
+	}
+	return dest, nil
+}
+
+// egressEntries returns the destinations builder pods need to reach with conf: the proxies, the
+// registry mirrors and the destinations the builder allows every app, then, separately, the
+// destinations appConf asks for.
+func egressEntries(conf *Config, appConf dryccAPI.Config) ([]string, []string, error) {
+	var entries []string
+	for _, proxy := range []string{conf.BuilderPodHTTPProxy, conf.BuilderPodHTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, nil, fmt.Errorf("invalid builder pod proxy %q", proxy)
+		}
+		entries = append(entries, u.Host)
+	}
+	mirrors, err := parseRegistryMirrors(conf.RegistryMirrors)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mirror := range mirrors {
+		entries = append(entries, strings.SplitN(mirror, "/", 2)[0])
+	}
+	return append(entries, splitEgress(conf.BuilderPodEgressAllow)...), splitEgress(configString(appConf, buildEgressKey)), nil
+}
+
+// splitEgress returns the entries of the comma separated list.
+func splitEgress(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parseAppEgressDestination parses entry, a destination an app asked for, like
+// parseEgressDestination, if the operator approved it in approved: host names must match one of its
+// host name patterns (see path.Match), and CIDRs and IPs must be within one of its CIDRs.
+func parseAppEgressDestination(entry, approved string, lookup func(string) ([]net.IP, error)) (egressDestination, error) {
+	host := entry
+	if h, _, err := net.SplitHostPort(entry); err == nil {
+		host = h
+	}
+	_, _, cidrErr := net.ParseCIDR(host)
+	name := cidrErr != nil && net.ParseIP(host) == nil
+	var nets []*net.IPNet
+	approvedName := false
+	for _, a := range splitEgress(approved) {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			nets = append(nets, n)
+		} else if ok, _ := path.Match(a, host); ok && name {
+			approvedName = true
+		}
+	}
+	notApproved := policyError(fmt.Errorf("%s %s isn't among the destinations builds may reach, ask an administrator to approve it", buildEgressKey, entry))
+	if name && !approvedName {
+		return egressDestination{}, notApproved
+	}
+	dest, err := parseEgressDestination(entry, lookup)
+	if err != nil || name {
+		return dest, err
+	}
+	for _, cidr := range dest.cidrs {
+		if !withinAny(cidr, nets) {
+			return egressDestination{}, notApproved
+		}
+	}
+	return dest, nil
+}
+
+// withinAny returns true if the network cidr is within one of nets.
+func withinAny(cidr string, nets []*net.IPNet) bool {
+	_, c, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, bits := c.Mask.Size()
+	for _, n := range nets {
+		nOnes, nBits := n.Mask.Size()
+		if bits == nBits && ones >= nOnes && n.Contains(c.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildNetworkPolicy returns the network policy named name letting the builder pods labeled with
+// it reach DNS, the pods of their namespace, which run the registry and the object storage of the
+// cluster, and dests. Any other egress is denied.
+func buildNetworkPolicy(name, appName string, dests []egressDestination) *networkingv1.NetworkPolicy {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}}},
+		{To: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}},
+	}
+	for _, dest := range dests {
+		rule := networkingv1.NetworkPolicyEgressRule{}
+		for _, cidr := range dest.cidrs {
+			rule.To = append(rule.To, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+		}
+		if dest.port != 0 {
+			port := intstr.FromInt(dest.port)
+			rule.Ports = []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}}
+		}
+		egress = append(egress, rule)
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"heritage": "drycc", "app": appName, buildEgressLabel: name},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{buildEgressLabel: name}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		},
+	}
+}
+
+// isolateBuilderPod creates the network policy of the build of pod, and labels pod for it to apply.
+// The returned func deletes the policy once the build is over; policies it fails to delete are
+// left to DeleteOrphanedNetworkPolicies.
+func isolateBuilderPod(conf *Config, policies networkPolicyClient, pod *corev1.Pod, appName string, appConf dryccAPI.Config) (func(), error) {
+	entries, appEntries, err := egressEntries(conf, appConf)
+	if err != nil {
+		return nil, err
+	}
+	var dests []egressDestination
+	for _, entry := range entries {
+		dest, err := parseEgressDestination(entry, net.LookupIP)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	for _, entry := range appEntries {
+		dest, err := parseAppEgressDestination(entry, conf.BuilderPodEgressAppAllow, net.LookupIP)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	name := fmt.Sprintf("%s-egress", pod.Name)
+	policy := buildNetworkPolicy(name, appName, dests)
+	if _, err := policies.Create(context.TODO(), policy, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("creating the network policy of the build (%s)", err)
+	}
+	pod.Labels[buildEgressLabel] = name
+	return func() {
+		if err := policies.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Err("Error deleting the network policy %s (%s)", name, err)
+		}
+	}, nil
+}
+
+// DeleteOrphanedNetworkPolicies deletes the network policies of builds that no pod uses anymore,
+// which their build failed to delete, in the build cluster of conf, that of local if it has none.
+// Policies are created before their pods, so only those older than twice the time builds wait for
+// their pods are deleted.
+func DeleteOrphanedNetworkPolicies(conf *Config, local kubernetes.Interface, now time.Time) error {
+	cluster, err := newBuildCluster(conf, local)
+	if err != nil {
+		return err
+	}
+	policies := cluster.client.NetworkingV1().NetworkPolicies(cluster.namespace)
+	list, err := policies.List(context.TODO(), metav1.ListOptions{LabelSelector: buildEgressLabel})
+	if err != nil {
+		return fmt.Errorf("listing build network policies (%s)", err)
+	}
+	pods := cluster.client.CoreV1().Pods(cluster.namespace)
+	for _, policy := range list.Items {
+		if now.Sub(policy.CreationTimestamp.Time) < 2*conf.BuilderPodWaitDuration() {
+			continue
+		}
+		used, err := pods.List(context.TODO(), metav1.ListOptions{LabelSelector: buildEgressLabel + "=" + policy.Name})
+		if err != nil {
+			log.Err("Error listing the pods of network policy %s (%s)", policy.Name, err)
+			continue
+		}
+		if len(used.Items) > 0 {
+			continue
+		}
+		log.Info("Deleting orphaned network policy %s", policy.Name)
+		if err := policies.Delete(context.TODO(), policy.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Err("Error deleting network policy %s (%s)", policy.Name, err)
+		}
+	}
+	return nil
+}
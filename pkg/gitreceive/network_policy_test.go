@@ -0,0 +1,159 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeNetworkPolicies struct {
+	created []*networkingv1.NetworkPolicy
+	deleted []string
+	err     error
+}
+
+func (f *fakeNetworkPolicies) Create(ctx context.Context, policy *networkingv1.NetworkPolicy, opts metav1.CreateOptions) (*networkingv1.NetworkPolicy, error) {
+	f.created = append(f.created, policy)
+	return policy, f.err
+}
+
+func (f *fakeNetworkPolicies) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func TestParseEgressDestination(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		if host == "minio.example.com" {
+			return []net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	dest, err := parseEgressDestination("10.0.0.0/8", lookup)
+	assert.NoErr(t, err)
+	assert.Equal(t, dest, egressDestination{cidrs: []string{"10.0.0.0/8"}}, "CIDR")
+
+	dest, err = parseEgressDestination("10.1.2.3:443", lookup)
+	assert.NoErr(t, err)
+	assert.Equal(t, dest, egressDestination{cidrs: []string{"10.1.2.3/32"}, port: 443}, "IP and port")
+
+	dest, err = parseEgressDestination("minio.example.com:9000", lookup)
+	assert.NoErr(t, err)
+	assert.Equal(t, dest, egressDestination{cidrs: []string{"203.0.113.5/32", "2001:db8::5/128"}, port: 9000}, "host")
+
+	_, err = parseEgressDestination("10.1.2.3:http", lookup)
+	assert.Err(t, err, errors.New(`invalid port in egress destination "10.1.2.3:http"`))
+	_, err = parseEgressDestination("pypi.example.com", lookup)
+	assert.Err(t, err, errors.New(`resolving egress destination "pypi.example.com" (no such host)`))
+}
+
+func TestEgressEntries(t *testing.T) {
+	conf := &Config{
+		BuilderPodHTTPSProxy:  "http://proxy.example.com:3128",
+		RegistryMirrors:       "docker.io=mirror.example.com/hub",
+		BuilderPodEgressAllow: "10.0.0.0/8, ",
+	}
+	appConf := dryccAPI.Config{Values: map[string]interface{}{buildEgressKey: "pypi.example.com:443"}}
+	entries, appEntries, err := egressEntries(conf, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, entries, []string{"proxy.example.com:3128", "mirror.example.com", "10.0.0.0/8"}, "entries")
+	assert.Equal(t, appEntries, []string{"pypi.example.com:443"}, "app entries")
+}
+
+func TestParseAppEgressDestination(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.30.0.5")}, nil
+	}
+	approved := "10.30.0.0/16, *.internal.example.com"
+	dest, err := parseAppEgressDestination("pypi.internal.example.com:443", approved, lookup)
+	assert.NoErr(t, err)
+	assert.Equal(t, dest, egressDestination{cidrs: []string{"10.30.0.5/32"}, port: 443}, "approved host")
+	dest, err = parseAppEgressDestination("10.30.4.0/24", approved, lookup)
+	assert.NoErr(t, err)
+	assert.Equal(t, dest, egressDestination{cidrs: []string{"10.30.4.0/24"}}, "approved CIDR")
+	_, err = parseAppEgressDestination("10.30.0.9:5432", approved, lookup)
+	assert.NoErr(t, err)
+
+	for _, entry := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.31.0.1", "pypi.org:443", "internal.example.com"} {
+		_, err = parseAppEgressDestination(entry, approved, lookup)
+		assert.True(t, err != nil, "allowed "+entry)
+	}
+	_, err = parseAppEgressDestination("10.30.0.9", "", lookup)
+	assert.True(t, err != nil, "allowed a destination without approved destinations")
+}
+
+func TestIsolateBuilderPod(t *testing.T) {
+	pod := buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	policies := &fakeNetworkPolicies{}
+	conf := &Config{BuilderPodEgressAllow: "10.0.0.0/8:443"}
+	remove, err := isolateBuilderPod(conf, policies, &pod, "app", dryccAPI.Config{})
+	assert.NoErr(t, err)
+	policy := policies.created[0]
+	assert.Equal(t, policy.Name, "slugbuild-app-egress", "policy name")
+	assert.Equal(t, pod.Labels[buildEgressLabel], policy.Name, "pod label")
+	assert.Equal(t, policy.Spec.PodSelector.MatchLabels, map[string]string{buildEgressLabel: policy.Name}, "pod selector")
+	assert.Equal(t, policy.Spec.PolicyTypes, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, "policy types")
+	egress := policy.Spec.Egress
+	assert.Equal(t, len(egress), 3, "egress rules")
+	assert.Equal(t, egress[2].To[0].IPBlock.CIDR, "10.0.0.0/8", "allowed CIDR")
+	assert.Equal(t, egress[2].Ports[0].Port.IntValue(), 443, "allowed port")
+
+	remove()
+	assert.Equal(t, policies.deleted, []string{"slugbuild-app-egress"}, "deleted policies")
+
+	// apps only reach the destinations the operator approved
+	pod = buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	appConf := dryccAPI.Config{Values: map[string]interface{}{buildEgressKey: "0.0.0.0/0"}}
+	_, err = isolateBuilderPod(conf, &fakeNetworkPolicies{}, &pod, "app", appConf)
+	assert.True(t, err != nil, "created a policy with a destination that isn't approved")
+	conf.BuilderPodEgressAppAllow = "10.30.0.0/16"
+	appConf = dryccAPI.Config{Values: map[string]interface{}{buildEgressKey: "10.30.1.0/24"}}
+	_, err = isolateBuilderPod(conf, &fakeNetworkPolicies{}, &pod, "app", appConf)
+	assert.NoErr(t, err)
+
+	pod = buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	policies = &fakeNetworkPolicies{err: errors.New("forbidden")}
+	_, err = isolateBuilderPod(conf, policies, &pod, "app", dryccAPI.Config{})
+	assert.Err(t, err, errors.New("creating the network policy of the build (forbidden)"))
+	assert.Equal(t, pod.Labels[buildEgressLabel], "", "label of a pod without a policy")
+}
+
+func TestDeleteOrphanedNetworkPolicies(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	policy := func(name string, created time.Time) runtime.Object {
+		return &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "drycc",
+			Labels:            map[string]string{buildEgressLabel: name},
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+	client := fake.NewSimpleClientset(
+		policy("slugbuild-used-egress", now.Add(-time.Hour)),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "slugbuild-used", Namespace: "drycc", Labels: map[string]string{buildEgressLabel: "slugbuild-used-egress"}}},
+		policy("slugbuild-new-egress", now.Add(-time.Second)),
+		policy("slugbuild-orphaned-egress", now.Add(-time.Hour)),
+	)
+	conf := &Config{PodNamespace: "drycc", BuilderPodWaitDurationMSec: 300000}
+	assert.NoErr(t, DeleteOrphanedNetworkPolicies(conf, client, now))
+
+	list, err := client.NetworkingV1().NetworkPolicies("drycc").List(context.TODO(), metav1.ListOptions{})
+	assert.NoErr(t, err)
+	var names []string
+	for _, p := range list.Items {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, names, []string{"slugbuild-new-egress", "slugbuild-used-egress"}, "policies left")
+}
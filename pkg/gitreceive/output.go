@@ -0,0 +1,160 @@
+package gitreceive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// colorPushOption renders the build output for a TTY ("always") or as plain lines ("never"),
+	// whatever the terminal of the pusher.
+	colorPushOption = "color"
+	colorAuto       = "auto"
+	colorAlways     = "always"
+	colorNever      = "never"
+
+	// spinnerInterval is the interval at which spinners are animated on a TTY.
+	spinnerInterval = 100 * time.Millisecond
+	// progressBarWidth is the number of cells of progress bars.
+	progressBarWidth = 24
+)
+
+// The messages of the steps of a build, as shown to the pusher.
+var buildSteps = []string{msgStepSource, msgStepBuild, msgStepRelease}
+
+var (
+	ansiEscapes    = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+	spinnerFrames  = []string{"|", "/", "-", "\\"}
+	lineUpAndClear = "\x1b[1A\x1b[2K"
+)
+
+// plainWriter strips ANSI escape sequences from what's written to it.
+type plainWriter struct {
+	w io.Writer
+}
+
+func (p plainWriter) Write(b []byte) (int, error) {
+	if _, err := p.w.Write(ansiEscapes.ReplaceAll(b, nil)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// terminal renders the build output for the pusher, in their language. On a TTY, the output is
+// colored and progress is animated in place. Elsewhere, e.g. in CI, it's plain lines.
+type terminal struct {
+	out      io.Writer
+	errOut   io.Writer
+	tty      bool
+	messages messageCatalog
+	lang     string
+	beat     *heartbeat
+}
+
+// newTerminal returns the terminal of the pusher, writing to out and errOut. It's a TTY if the
+// SSH session of the push requested one, unless the color push option, or else conf.BuildOutputColor,
+// says otherwise.
+func newTerminal(conf *Config, pushOpts PushOptions, out, errOut io.Writer) (*terminal, error) {
+	mode := conf.BuildOutputColor
+	if opt, ok := pushOpts.Get(colorPushOption); ok {
+		mode = opt
+	}
+	messages, err := loadMessageCatalog(conf.MessageCatalogPath)
+	if err != nil {
+		return nil, err
+	}
+	t := &terminal{out: out, errOut: errOut, messages: messages, lang: defaultLanguage}
+	t.beat = newHeartbeat(t, realClock{})
+	t.setLanguage(pushOpts, dryccAPI.Config{})
+	switch mode {
+	case colorAuto, "":
+		t.tty = conf.Term != "" && conf.Term != "dumb"
+	case colorAlways:
+		t.tty = true
+	case colorNever:
+	default:
+		return nil, fmt.Errorf("invalid color %q, use %s, %s or %s", mode, colorAuto, colorAlways, colorNever)
+	}
+	if !t.tty {
+		t.out = plainWriter{out}
+		t.errOut = plainWriter{errOut}
+	}
+	return t, nil
+}
+
+// pusherTerminal is the terminal the build output is rendered for. Run sets it for every push.
+var pusherTerminal = &terminal{
+	out:      plainWriter{os.Stdout},
+	errOut:   plainWriter{os.Stderr},
+	messages: builtinMessages,
+	lang:     defaultLanguage,
+}
+
+// use makes t the terminal of the build output, including the messages of the log package.
+func (t *terminal) use() {
+	pusherTerminal = t
+	log.DefaultLogger.SetStdout(t.out)
+	log.DefaultLogger.SetStderr(t.errOut)
+}
+
+// heartbeat returns the heartbeat of the push of t. Terminals that weren't created for a push
+// get one started now.
+func (t *terminal) heartbeat() *heartbeat {
+	if t.beat == nil {
+		return newHeartbeat(t, realClock{})
+	}
+	return t.beat
+}
+
+// color returns s in color c on a TTY, as is elsewhere.
+func (t *terminal) color(c log.Color, s string) string {
+	if !t.tty {
+		return s
+	}
+	return c.String() + s + log.Default.String()
+}
+
+// progressBar returns a bar filled by done out of total.
+func progressBar(done, total int) string {
+	filled := progressBarWidth
+	if total > 0 && done < total {
+		filled = done * progressBarWidth / total
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled) + "]"
+}
+
+// step shows that the build started its nth step, counting from 1.
+func (t *terminal) step(n int) {
+	name := t.text(buildSteps[n-1])
+	if !t.tty {
+		t.info(msgStep, n, len(buildSteps), name)
+		return
+	}
+	fmt.Fprintf(t.out, "%s %d/%d %s\n", t.color(log.Cyan, progressBar(n-1, len(buildSteps))), n, len(buildSteps), t.color(log.Green, name))
+}
+
+// during shows that the message id, formatted with args, is in progress while f runs, and returns
+// the error of f. Phases that can stay silent for longer than interval run in it, so that strict
+// SSH servers and clients don't drop the push as idle. f must not print anything, since a spinner
+// rewrites the line above it. With a non-positive interval, f runs without any progress.
+func (t *terminal) during(id string, interval time.Duration, f func() error, args ...interface{}) error {
+	if interval <= 0 {
+		return f()
+	}
+	end := t.heartbeat().phase(id, interval, args...)
+	err := f()
+	end()
+	return err
+}
+
+// elapsed returns the time elapsed since start, to the second.
+func elapsed(start time.Time) time.Duration {
+	return time.Since(start).Round(time.Second)
+}
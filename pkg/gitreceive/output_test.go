@@ -0,0 +1,77 @@
+package gitreceive
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/pkg/log"
+)
+
+func TestNewTerminal(t *testing.T) {
+	for _, test := range []struct {
+		term, color, option string
+		tty                 bool
+	}{
+		{"", colorAuto, "", false},
+		{"dumb", colorAuto, "", false},
+		{"xterm-256color", colorAuto, "", true},
+		{"xterm-256color", "", "", true},
+		{"", colorAlways, "", true},
+		{"xterm-256color", colorNever, "", false},
+		{"", colorAuto, colorAlways, true},
+		{"xterm-256color", colorAlways, colorNever, false},
+	} {
+		opts := PushOptions{}
+		if test.option != "" {
+			opts[colorPushOption] = test.option
+		}
+		term, err := newTerminal(&Config{Term: test.term, BuildOutputColor: test.color}, opts, nil, nil)
+		assert.NoErr(t, err)
+		assert.Equal(t, term.tty, test.tty, test.term+" "+test.color+" "+test.option)
+	}
+	_, err := newTerminal(&Config{}, PushOptions{colorPushOption: "sometimes"}, nil, nil)
+	assert.True(t, err != nil, "created a terminal with an invalid color")
+}
+
+func TestPlainWriter(t *testing.T) {
+	out := new(bytes.Buffer)
+	n, err := plainWriter{out}.Write([]byte(log.Green.String() + "---> " + log.Default.String() + "Done" + lineUpAndClear))
+	assert.NoErr(t, err)
+	assert.Equal(t, n, len(log.Green.String()+"---> "+log.Default.String()+"Done"+lineUpAndClear), "bytes written")
+	assert.Equal(t, out.String(), "---> Done", "output")
+}
+
+func TestProgressBar(t *testing.T) {
+	assert.Equal(t, progressBar(0, 3), "["+strings.Repeat("-", 24)+"]", "empty bar")
+	assert.Equal(t, progressBar(1, 3), "["+strings.Repeat("#", 8)+strings.Repeat("-", 16)+"]", "bar")
+	assert.Equal(t, progressBar(3, 3), "["+strings.Repeat("#", 24)+"]", "full bar")
+}
+
+func TestTerminalStep(t *testing.T) {
+	out := new(bytes.Buffer)
+	term := &terminal{out: out, tty: true, messages: builtinMessages}
+	term.step(2)
+	assert.True(t, strings.Contains(out.String(), progressBar(1, 3)+log.Default.String()+" 2/3 "), out.String())
+	assert.True(t, strings.Contains(out.String(), "Building"), out.String())
+}
+
+func TestTerminalDuring(t *testing.T) {
+	out := new(bytes.Buffer)
+	term := &terminal{out: out, messages: builtinMessages}
+	err := term.during(msgPromoting, 10*time.Millisecond, func() error {
+		time.Sleep(35 * time.Millisecond)
+		return errors.New("copy failed")
+	}, "1a2b3c4d")
+	assert.Err(t, err, errors.New("copy failed"))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.True(t, len(lines) >= 2, out.String())
+	assert.Equal(t, lines[0], "Promoting git-1a2b3c4d (0s, 0s since the push started)", "keepalive line")
+
+	out.Reset()
+	assert.NoErr(t, term.during(msgVerifyingSlug, time.Hour, func() error { return nil }))
+	assert.Equal(t, out.String(), "", "output of a quick phase")
+}
@@ -0,0 +1,96 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// podLostReason is the reason of the event recorded when a builder pod is lost and rescheduled.
+	podLostReason = "BuilderPodLost"
+	// reasonNodeLost is the reason of the pods of nodes that stopped reporting their status.
+	reasonNodeLost = "NodeLost"
+)
+
+// podLostError is returned for builder pods that were lost before they ended, through no fault of
+// the build: evicted, deleted or left on a node that went away.
+type podLostError struct {
+	reason string
+}
+
+func (e podLostError) Error() string {
+	return fmt.Sprintf("the builder pod was %s", e.reason)
+}
+
+// lostReason returns why the pod of t was lost, or "" if it wasn't. Pods evicted for their
+// ephemeral storage aren't lost, they'd run out of it again.
+func lostReason(t k8s.PodTransition) string {
+	pod := t.Pod
+	switch {
+	case t.Deleted() || pod.DeletionTimestamp != nil:
+		return "deleted"
+	case t.To == corev1.PodUnknown || pod.Status.Reason == reasonNodeLost:
+		return "lost with its node"
+	case pod.Status.Reason == reasonEvicted && !strings.Contains(pod.Status.Message, string(corev1.ResourceEphemeralStorage)):
+		return fmt.Sprintf("evicted (%s)", strings.TrimSpace(pod.Status.Message))
+	}
+	return ""
+}
+
+// podLostCondition is met once the pod of t ended or was lost, and fails with a podLostError if it
+// was lost.
+func podLostCondition(t k8s.PodTransition) (bool, error) {
+	if reason := lostReason(t); reason != "" {
+		return true, podLostError{reason: reason}
+	}
+	return t.To == corev1.PodSucceeded || t.To == corev1.PodFailed, nil
+}
+
+// podDeleter is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).PodInterface needed to
+// delete lost pods.
+type podDeleter interface {
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// deleteLostPod deletes pod, which was lost, right away: its node may never confirm it stopped.
+func deleteLostPod(pods podDeleter, pod *corev1.Pod) {
+	grace := int64(0)
+	pods.Delete(context.TODO(), pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+}
+
+// renamedPod returns a copy of pod named name.
+func renamedPod(pod *corev1.Pod, name string) *corev1.Pod {
+	renamed := pod.DeepCopy()
+	renamed.Name = name
+	renamed.Labels["heritage"] = name
+	return renamed
+}
+
+// runRescheduled runs pod with run and, each time it's lost, runs a copy of it named with newName,
+// up to conf.BuilderPodLostRetries times. It returns the pod that ran last, and the state it ended
+// in.
+func runRescheduled(
+	conf *Config,
+	pod *corev1.Pod,
+	newName func() string,
+	run func(*corev1.Pod) (*corev1.Pod, error),
+	recorder *buildRecorder) (*corev1.Pod, *corev1.Pod, error) {
+
+	ended, err := run(pod)
+	for attempt := 1; attempt <= conf.BuilderPodLostRetries; attempt++ {
+		lost, ok := err.(podLostError)
+		if !ok {
+			break
+		}
+		pusherTerminal.info(msgPodLost, lost.reason, attempt, conf.BuilderPodLostRetries)
+		recorder.warn(podLostReason, "builder pod %s was %s, rescheduled", pod.Name, lost.reason)
+		pod = renamedPod(pod, newName())
+		ended, err = run(pod)
+	}
+	return pod, ended, err
+}
@@ -0,0 +1,69 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLostReason(t *testing.T) {
+	running := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: running, To: corev1.PodRunning}), "", "reason of a running pod")
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: running}), "deleted", "reason of a deleted pod")
+
+	now := metav1.Now()
+	terminating := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &now}}
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: terminating, To: corev1.PodRunning}), "deleted", "reason of a terminating pod")
+
+	unknown := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodUnknown}}
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: unknown, To: corev1.PodUnknown}), "lost with its node", "reason of a pod of a lost node")
+
+	evicted := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: reasonEvicted, Message: "The node was low on resource: memory. "}}
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: evicted, To: corev1.PodFailed}), "evicted (The node was low on resource: memory.)", "reason of an evicted pod")
+
+	evicted.Status.Message = "The node was low on resource: ephemeral-storage."
+	assert.Equal(t, lostReason(k8s.PodTransition{Pod: evicted, To: corev1.PodFailed}), "", "reason of a pod out of disk space")
+}
+
+func TestRunRescheduled(t *testing.T) {
+	pod := buildPod(false, "slugbuild-app-1", "drycc", corev1.PullAlways, nil, nil)
+	var ran []string
+	run := func(p *corev1.Pod) (*corev1.Pod, error) {
+		ran = append(ran, p.Name)
+		if len(ran) < 3 {
+			return nil, podLostError{reason: "lost with its node"}
+		}
+		return p, nil
+	}
+	names := []string{"slugbuild-app-2", "slugbuild-app-3"}
+	newName := func() string {
+		name := names[0]
+		names = names[1:]
+		return name
+	}
+	last, ended, err := runRescheduled(&Config{BuilderPodLostRetries: 2}, &pod, newName, run, nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, ran, []string{"slugbuild-app-1", "slugbuild-app-2", "slugbuild-app-3"}, "pods run")
+	assert.Equal(t, last.Name, "slugbuild-app-3", "last pod")
+	assert.Equal(t, last.Labels["heritage"], "slugbuild-app-3", "heritage of the last pod")
+	assert.Equal(t, ended.Name, "slugbuild-app-3", "ended pod")
+	assert.Equal(t, pod.Name, "slugbuild-app-1", "name of the original pod")
+
+	ran = nil
+	_, _, err = runRescheduled(&Config{}, &pod, newName, run, nil)
+	assert.Err(t, err, podLostError{reason: "lost with its node"})
+	assert.Equal(t, len(ran), 1, "pods run without retries")
+
+	ran = nil
+	failed := errors.New("creating builder pod (forbidden)")
+	_, _, err = runRescheduled(&Config{BuilderPodLostRetries: 2}, &pod, newName, func(p *corev1.Pod) (*corev1.Pod, error) {
+		ran = append(ran, p.Name)
+		return nil, failed
+	}, nil)
+	assert.Err(t, err, failed)
+	assert.Equal(t, len(ran), 1, "pods run after another failure")
+}
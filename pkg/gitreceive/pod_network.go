@@ -0,0 +1,101 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// registryMirrorsKey is the env var passing the registry mirrors to builder pods, for the
+	// dockerbuilder to pull base images from them.
+	registryMirrorsKey = "DRYCC_REGISTRY_MIRRORS"
+	dockerHub          = "docker.io"
+)
+
+// parseRegistryMirrors returns the mirror of each registry in config, e.g.
+// "docker.io=mirror.example.com/hub,quay.io=quay.example.com".
+func parseRegistryMirrors(config string) (map[string]string, error) {
+	mirrors := make(map[string]string)
+	if config == "" {
+		return mirrors, nil
+	}
+	for _, pair := range strings.Split(config, ",") {
+		kv := strings.Split(pair, "=")
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid registry mirrors %q, use registry=mirror pairs separated by commas", config)
+		}
+		mirrors[strings.TrimSpace(kv[0])] = strings.TrimSuffix(strings.TrimSpace(kv[1]), "/")
+	}
+	return mirrors, nil
+}
+
+// imageRegistry splits image into the registry it's pulled from and its path in it. Like docker,
+// images whose first component isn't a host come from Docker Hub.
+func imageRegistry(image string) (string, string) {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return dockerHub, "library/" + image
+	}
+	host := image[:i]
+	if host == "index.docker.io" {
+		return dockerHub, image[i+1:]
+	}
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHub, image
+	}
+	return host, image[i+1:]
+}
+
+// mirrorImage returns image as pulled from the mirror of its registry in mirrors, if it has one.
+func mirrorImage(image string, mirrors map[string]string) string {
+	registry, path := imageRegistry(image)
+	if mirror, ok := mirrors[registry]; ok {
+		return mirror + "/" + path
+	}
+	return image
+}
+
+// clusterNoProxy are the domains of the services of the cluster, which builder pods always reach
+// without the proxy.
+var clusterNoProxy = []string{".svc", ".cluster.local"}
+
+// setPodNetwork points pod to the registry mirrors and the proxies in conf.
+func setPodNetwork(conf *Config, pod *corev1.Pod) error {
+	mirrors, err := parseRegistryMirrors(conf.RegistryMirrors)
+	if err != nil {
+		return err
+	}
+	if len(mirrors) > 0 {
+		pod.Spec.Containers[0].Image = mirrorImage(pod.Spec.Containers[0].Image, mirrors)
+		addEnvToPod(*pod, registryMirrorsKey, conf.RegistryMirrors)
+	}
+
+	if conf.BuilderPodHTTPProxy == "" && conf.BuilderPodHTTPSProxy == "" {
+		return nil
+	}
+	// builds reach the registry, the object storage and the services of the cluster, which are
+	// never behind the proxy
+	var noProxy []string
+	seen := make(map[string]bool)
+	hosts := append(strings.Split(conf.BuilderPodNoProxy, ","), conf.RegistryHost, conf.StorageHost)
+	for _, host := range append(hosts, clusterNoProxy...) {
+		if host = strings.TrimSpace(host); host != "" && !seen[host] {
+			seen[host] = true
+			noProxy = append(noProxy, host)
+		}
+	}
+	for _, env := range [][2]string{
+		{"HTTP_PROXY", conf.BuilderPodHTTPProxy},
+		{"HTTPS_PROXY", conf.BuilderPodHTTPSProxy},
+		{"NO_PROXY", strings.Join(noProxy, ",")},
+	} {
+		if env[1] != "" {
+			// tools disagree on the case of these
+			addEnvToPod(*pod, env[0], env[1])
+			addEnvToPod(*pod, strings.ToLower(env[0]), env[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	mirrors, err := parseRegistryMirrors("")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(mirrors), 0, "number of mirrors")
+	mirrors, err = parseRegistryMirrors("docker.io=mirror.example.com/hub/, quay.io = quay.example.com:5000")
+	assert.NoErr(t, err)
+	assert.Equal(t, mirrors, map[string]string{"docker.io": "mirror.example.com/hub", "quay.io": "quay.example.com:5000"}, "mirrors")
+	for _, config := range []string{"docker.io", "docker.io=", "=mirror.example.com", "a=b=c"} {
+		_, err := parseRegistryMirrors(config)
+		assert.True(t, err != nil, "parsed "+config)
+	}
+}
+
+func TestMirrorImage(t *testing.T) {
+	mirrors := map[string]string{"docker.io": "mirror.example.com/hub", "quay.io": "quay.example.com"}
+	for image, expected := range map[string]string{
+		"alpine:3.12":                            "mirror.example.com/hub/library/alpine:3.12",
+		"drycc/slugbuilder:canary":               "mirror.example.com/hub/drycc/slugbuilder:canary",
+		"docker.io/drycc/slugbuilder":            "mirror.example.com/hub/drycc/slugbuilder",
+		"index.docker.io/drycc/slugbuilder":      "mirror.example.com/hub/drycc/slugbuilder",
+		"quay.io/drycc/dockerbuilder@sha256:abc": "quay.example.com/drycc/dockerbuilder@sha256:abc",
+		"registry.example.com/drycc/slugbuilder": "registry.example.com/drycc/slugbuilder",
+		"localhost:5000/slugbuilder":             "localhost:5000/slugbuilder",
+	} {
+		assert.Equal(t, mirrorImage(image, mirrors), expected, image)
+	}
+}
+
+func TestSetPodNetwork(t *testing.T) {
+	conf := &Config{RegistryHost: "10.0.0.1", StorageHost: "10.0.0.2"}
+	pod := buildPod(false, "build", "drycc", corev1.PullAlways, nil, nil)
+	pod.Spec.Containers[0].Image = "drycc/slugbuilder"
+	assert.NoErr(t, setPodNetwork(conf, &pod))
+	assert.Equal(t, pod.Spec.Containers[0].Image, "drycc/slugbuilder", "image")
+	assert.Equal(t, len(pod.Spec.Containers[0].Env), 0, "number of env vars")
+
+	conf.RegistryMirrors = "docker.io=mirror.example.com"
+	conf.BuilderPodHTTPSProxy = "http://proxy.example.com:3128"
+	conf.BuilderPodNoProxy = ".svc,.cluster.local"
+	assert.NoErr(t, setPodNetwork(conf, &pod))
+	assert.Equal(t, pod.Spec.Containers[0].Image, "mirror.example.com/drycc/slugbuilder", "image")
+	assert.Equal(t, podEnv(&pod, registryMirrorsKey), "docker.io=mirror.example.com", registryMirrorsKey)
+	assert.Equal(t, podEnv(&pod, "HTTP_PROXY"), "", "HTTP_PROXY")
+	assert.Equal(t, podEnv(&pod, "HTTPS_PROXY"), "http://proxy.example.com:3128", "HTTPS_PROXY")
+	assert.Equal(t, podEnv(&pod, "https_proxy"), "http://proxy.example.com:3128", "https_proxy")
+	assert.Equal(t, podEnv(&pod, "NO_PROXY"), ".svc,.cluster.local,10.0.0.1,10.0.0.2", "NO_PROXY")
+	assert.Equal(t, podEnv(&pod, "no_proxy"), ".svc,.cluster.local,10.0.0.1,10.0.0.2", "no_proxy")
+
+	// the registry, the object storage and the services of the cluster are always left out
+	conf.BuilderPodNoProxy = "internal.example.com"
+	pod = buildPod(false, "build", "drycc", corev1.PullAlways, nil, nil)
+	assert.NoErr(t, setPodNetwork(conf, &pod))
+	assert.Equal(t, podEnv(&pod, "NO_PROXY"), "internal.example.com,10.0.0.1,10.0.0.2,.svc,.cluster.local", "NO_PROXY")
+
+	conf.RegistryMirrors = "docker.io"
+	assert.True(t, setPodNetwork(conf, &pod) != nil, "set invalid registry mirrors")
+}
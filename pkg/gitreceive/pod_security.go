@@ -0,0 +1,220 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// The Kubernetes PodSecurity admission levels builder pods can comply with, from the least to the
+// most restrictive.
+const (
+	// PrivilegedPodSecurity leaves builder pods as they are.
+	PrivilegedPodSecurity = "privileged"
+	// BaselinePodSecurity gives builder pods the default seccomp profile of the container runtime.
+	BaselinePodSecurity = "baseline"
+	// RestrictedPodSecurity also runs builder pods as a non-root user, without any capability and
+	// without privilege escalation.
+	RestrictedPodSecurity = "restricted"
+	// AutoPodSecurity runs each builder pod at the most restrictive level its build can run at.
+	AutoPodSecurity = "auto"
+)
+
+// stackPodSecurityKey is the key of the stacks in the images.json of the slugbuilder and
+// dockerbuilder declaring the most restrictive level their builder runs at. Stacks without it run
+// at the baseline level.
+const stackPodSecurityKey = "podSecurity"
+
+const (
+	seccompPodAnnotation  = "seccomp.security.alpha.kubernetes.io/pod"
+	seccompRuntimeDefault = "runtime/default"
+)
+
+var podSecurityLevels = []string{PrivilegedPodSecurity, BaselinePodSecurity, RestrictedPodSecurity}
+
+// podSecurityRank returns how restrictive level is, from 0 for privileged, which is also the level
+// of an empty one.
+func podSecurityRank(level string) (int, error) {
+	if level == "" {
+		return 0, nil
+	}
+	for i, l := range podSecurityLevels {
+		if l == level {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown PodSecurity level %q, use one of %s", level, strings.Join(podSecurityLevels, ", "))
+}
+
+// configuredPodSecurityRank returns how restrictive the level configured for the builder is. The
+// auto level requires nothing of builds until it's resolved for each of them, like privileged.
+func configuredPodSecurityRank(level string) (int, error) {
+	if level == AutoPodSecurity {
+		return 0, nil
+	}
+	rank, err := podSecurityRank(level)
+	if err != nil {
+		return 0, fmt.Errorf("%s, or %s", err, AutoPodSecurity)
+	}
+	return rank, nil
+}
+
+// stackPodSecurity returns the most restrictive level the builder of stack runs at.
+func stackPodSecurity(stack map[string]string) string {
+	if level := stack[stackPodSecurityKey]; level != "" {
+		return level
+	}
+	return BaselinePodSecurity
+}
+
+// checkStackPodSecurity returns an error if the builder of stack can't run at level, naming the
+// stacks that can.
+func checkStackPodSecurity(level string, stack map[string]string) error {
+	rank, err := configuredPodSecurityRank(level)
+	if err != nil {
+		return err
+	}
+	stackRank, err := podSecurityRank(stackPodSecurity(stack))
+	if err != nil {
+		return fmt.Errorf("stack %s declares an invalid %s (%s)", stack["name"], stackPodSecurityKey, err)
+	}
+	if stackRank >= rank {
+		return nil
+	}
+	var compliant []string
+	for _, s := range Stacks {
+		if r, err := podSecurityRank(stackPodSecurity(s)); err == nil && r >= rank {
+			compliant = append(compliant, s["name"])
+		}
+	}
+	if len(compliant) == 0 {
+		return fmt.Errorf("the %s stack can't build at the %s PodSecurity level of the builder, and no stack can", stack["name"], level)
+	}
+	return fmt.Errorf("the %s stack can't build at the %s PodSecurity level of the builder, set one of %s with `drycc config:set %s=<stack>`", stack["name"], level, strings.Join(compliant, ", "), stackKey)
+}
+
+// setPodSecurity makes pod comply with level, running it as uid at the restricted level.
+func setPodSecurity(pod *corev1.Pod, level string, uid int64) {
+	rank, err := podSecurityRank(level)
+	if err != nil || rank == 0 {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	// the API server copies the annotation to the seccompProfile field of newer API versions
+	// before PodSecurity admission checks it
+	pod.Annotations[seccompPodAnnotation] = seccompRuntimeDefault
+	if level != RestrictedPodSecurity {
+		return
+	}
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	nonRoot, escalation := true, false
+	pod.Spec.SecurityContext.RunAsNonRoot = &nonRoot
+	pod.Spec.SecurityContext.RunAsUser = &uid
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			containers[i].SecurityContext = &corev1.SecurityContext{
+				AllowPrivilegeEscalation: &escalation,
+				Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+			}
+		}
+	}
+}
+
+// namespaceEnforceLabel is the label of a namespace naming the PodSecurity level it enforces.
+const namespaceEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+// podSecurityNeeds are what the build of a builder pod needs of its PodSecurity level.
+type podSecurityNeeds struct {
+	stack map[string]string
+	// plainHTTPRegistry is set for container builds pushing to a registry without TLS, such as the
+	// on-cluster registry, which the dockerbuilder trusts as root.
+	plainHTTPRegistry bool
+	// inPodBuildKit is set for builds running buildkitd in the builder pod, which it can't do
+	// with the seccomp and AppArmor profiles of the container runtime.
+	inPodBuildKit bool
+}
+
+// newPodSecurityNeeds returns the needs of a build with stack, pushing its image to the registry
+// of conf described by registryEnv if it's a container build, with buildKit.
+func newPodSecurityNeeds(conf *Config, stack map[string]string, registryEnv map[string]string, buildKit *buildKitOptions) podSecurityNeeds {
+	needs := podSecurityNeeds{stack: stack, inPodBuildKit: buildKit != nil && buildKit.host == ""}
+	if stack["name"] == "container" {
+		needs.plainHTTPRegistry = conf.RegistryLocation == "on-cluster" || registryEnv["DRYCC_REGISTRY_INSECURE"] == "true"
+	}
+	return needs
+}
+
+// maxLevel returns the most restrictive level the builder pod can run at, and why it can't run
+// at a more restrictive one.
+func (n podSecurityNeeds) maxLevel() (string, string) {
+	if n.inPodBuildKit {
+		return PrivilegedPodSecurity, "it runs buildkitd in the builder pod; set BUILDKIT_HOST to build with a buildkitd of the cluster instead"
+	}
+	level := stackPodSecurity(n.stack)
+	rank, err := podSecurityRank(level)
+	if err != nil {
+		return PrivilegedPodSecurity, fmt.Sprintf("the %s stack declares an invalid %s", n.stack["name"], stackPodSecurityKey)
+	}
+	if n.plainHTTPRegistry && rank > 1 {
+		return BaselinePodSecurity, "it pushes to a registry without TLS as root; use an off-cluster registry with TLS instead"
+	}
+	return level, fmt.Sprintf("the builder of the %s stack runs at the %s level at most", n.stack["name"], level)
+}
+
+// resolve returns the level the builder pod runs at with the configured level: the most
+// restrictive one it can run at with AutoPodSecurity, level otherwise.
+func (n podSecurityNeeds) resolve(level string) string {
+	if level == AutoPodSecurity {
+		level, _ = n.maxLevel()
+	}
+	return level
+}
+
+// complies returns the most restrictive level the builder pod running at level complies with.
+// Pods left as they are at the privileged level comply with the baseline level, unless their
+// build needs more.
+func (n podSecurityNeeds) complies(level string) string {
+	if rank, _ := podSecurityRank(level); rank > 0 {
+		return level
+	}
+	max, _ := n.maxLevel()
+	if rank, _ := podSecurityRank(max); rank > 1 {
+		return BaselinePodSecurity
+	}
+	return max
+}
+
+// checkNamespacePodSecurity is the preflight of a builder pod running at level in namespace. It
+// returns an error if the pod doesn't comply with the level the namespace enforces, which would
+// reject it, telling why. The check is skipped if the namespace can't be read.
+func checkNamespacePodSecurity(namespaces typedcorev1.NamespaceInterface, namespace, level string, needs podSecurityNeeds) error {
+	ns, err := namespaces.Get(context.TODO(), namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Debug("skipping the PodSecurity preflight, reading namespace %s failed (%s)", namespace, err)
+		return nil
+	}
+	enforced := ns.Labels[namespaceEnforceLabel]
+	enforcedRank, err := podSecurityRank(enforced)
+	if err != nil {
+		log.Debug("skipping the PodSecurity preflight, namespace %s enforces %s", namespace, err)
+		return nil
+	}
+	complies := needs.complies(level)
+	if rank, _ := podSecurityRank(complies); rank >= enforcedRank {
+		return nil
+	}
+	max, reason := needs.maxLevel()
+	if rank, _ := podSecurityRank(max); rank >= enforcedRank {
+		return fmt.Errorf("preflight: builder pods at the %s PodSecurity level of the builder would be rejected by namespace %s, which enforces the %s level; set POD_SECURITY_LEVEL to %s or %s", level, namespace, enforced, enforced, AutoPodSecurity)
+	}
+	return fmt.Errorf("preflight: namespace %s enforces the %s PodSecurity level, but the build needs the %s level because %s", namespace, enforced, max, reason)
+}
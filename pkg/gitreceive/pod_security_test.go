@@ -0,0 +1,108 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckStackPodSecurity(t *testing.T) {
+	defer func(stacks []map[string]string) { Stacks = stacks }(Stacks)
+	Stacks = []map[string]string{
+		{"name": "container", "image": "drycc/container:canary", stackPodSecurityKey: PrivilegedPodSecurity},
+		{"name": "heroku-20", "image": "drycc/slugrunner:canary.heroku-20", stackPodSecurityKey: RestrictedPodSecurity},
+		{"name": "heroku-18", "image": "drycc/slugrunner:canary.heroku-18"},
+	}
+
+	assert.NoErr(t, checkStackPodSecurity(PrivilegedPodSecurity, Stacks[0]))
+	assert.NoErr(t, checkStackPodSecurity(BaselinePodSecurity, Stacks[2]))
+	assert.NoErr(t, checkStackPodSecurity(RestrictedPodSecurity, Stacks[1]))
+	assert.NoErr(t, checkStackPodSecurity("", Stacks[0]))
+
+	err := checkStackPodSecurity(RestrictedPodSecurity, Stacks[2])
+	assert.Err(t, err, errors.New("the heroku-18 stack can't build at the restricted PodSecurity level of the builder, set one of heroku-20 with `drycc config:set DRYCC_STACK=<stack>`"))
+	err = checkStackPodSecurity(BaselinePodSecurity, Stacks[0])
+	assert.Err(t, err, errors.New("the container stack can't build at the baseline PodSecurity level of the builder, set one of heroku-20, heroku-18 with `drycc config:set DRYCC_STACK=<stack>`"))
+
+	err = checkStackPodSecurity("strict", Stacks[0])
+	assert.Err(t, err, errors.New(`unknown PodSecurity level "strict", use one of privileged, baseline, restricted, or auto`))
+	err = checkStackPodSecurity(BaselinePodSecurity, map[string]string{"name": "custom", stackPodSecurityKey: "root"})
+	assert.True(t, err != nil, "accepted a stack with an invalid level")
+}
+
+func TestSetPodSecurity(t *testing.T) {
+	newPod := func() *corev1.Pod {
+		pod := buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+		return &pod
+	}
+
+	pod := newPod()
+	setPodSecurity(pod, PrivilegedPodSecurity, 1000)
+	assert.Equal(t, *pod, *newPod(), "privileged pod")
+
+	pod = newPod()
+	setPodSecurity(pod, BaselinePodSecurity, 1000)
+	assert.Equal(t, pod.Annotations[seccompPodAnnotation], seccompRuntimeDefault, "seccomp profile")
+	assert.True(t, pod.Spec.SecurityContext == nil, "baseline pod runs as a set user")
+	assert.True(t, pod.Spec.Containers[0].SecurityContext == nil, "baseline container has a security context")
+
+	pod = newPod()
+	pod.Spec.InitContainers = []corev1.Container{{Name: "clear-cache"}}
+	setPodSecurity(pod, RestrictedPodSecurity, 2000)
+	assert.Equal(t, pod.Annotations[seccompPodAnnotation], seccompRuntimeDefault, "seccomp profile")
+	assert.True(t, *pod.Spec.SecurityContext.RunAsNonRoot, "restricted pod may run as root")
+	assert.Equal(t, *pod.Spec.SecurityContext.RunAsUser, int64(2000), "user")
+	sc := pod.Spec.Containers[0].SecurityContext
+	assert.False(t, *sc.AllowPrivilegeEscalation, "restricted container allows privilege escalation")
+	assert.Equal(t, sc.Capabilities.Drop, []corev1.Capability{"ALL"}, "dropped capabilities")
+	assert.Equal(t, pod.Spec.InitContainers[0].SecurityContext, sc, "security context of the init container")
+}
+
+func TestPodSecurityNeeds(t *testing.T) {
+	restricted := map[string]string{"name": "container", stackPodSecurityKey: RestrictedPodSecurity}
+	conf := &Config{RegistryLocation: "off-cluster"}
+
+	needs := newPodSecurityNeeds(conf, restricted, map[string]string{"DRYCC_REGISTRY_HOSTNAME": "quay.io"}, nil)
+	assert.Equal(t, needs.resolve(AutoPodSecurity), RestrictedPodSecurity, "off-cluster registry with TLS")
+	assert.Equal(t, needs.resolve(BaselinePodSecurity), BaselinePodSecurity, "configured level")
+	assert.Equal(t, needs.complies(PrivilegedPodSecurity), BaselinePodSecurity, "pods left as they are")
+
+	needs = newPodSecurityNeeds(conf, restricted, map[string]string{"DRYCC_REGISTRY_INSECURE": "true"}, nil)
+	assert.Equal(t, needs.resolve(AutoPodSecurity), BaselinePodSecurity, "off-cluster registry without TLS")
+	conf.RegistryLocation = "on-cluster"
+	needs = newPodSecurityNeeds(conf, restricted, nil, nil)
+	assert.Equal(t, needs.resolve(AutoPodSecurity), BaselinePodSecurity, "on-cluster registry")
+
+	needs = newPodSecurityNeeds(conf, restricted, nil, &buildKitOptions{})
+	assert.Equal(t, needs.resolve(AutoPodSecurity), PrivilegedPodSecurity, "buildkitd in the builder pod")
+	assert.Equal(t, needs.complies(PrivilegedPodSecurity), PrivilegedPodSecurity, "buildkitd pods left as they are")
+	needs = newPodSecurityNeeds(conf, restricted, nil, &buildKitOptions{host: "tcp://buildkitd:1234"})
+	assert.Equal(t, needs.resolve(AutoPodSecurity), BaselinePodSecurity, "buildkitd of the cluster")
+
+	// slug builds don't push to the registry
+	needs = newPodSecurityNeeds(conf, map[string]string{"name": "heroku-20", stackPodSecurityKey: RestrictedPodSecurity}, nil, nil)
+	assert.Equal(t, needs.resolve(AutoPodSecurity), RestrictedPodSecurity, "slug build")
+}
+
+func TestCheckNamespacePodSecurity(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "drycc",
+		Labels: map[string]string{namespaceEnforceLabel: RestrictedPodSecurity},
+	}})
+	namespaces := client.CoreV1().Namespaces()
+	restricted := podSecurityNeeds{stack: map[string]string{"name": "container", stackPodSecurityKey: RestrictedPodSecurity}}
+
+	assert.NoErr(t, checkNamespacePodSecurity(namespaces, "drycc", RestrictedPodSecurity, restricted))
+	assert.NoErr(t, checkNamespacePodSecurity(namespaces, "unknown", PrivilegedPodSecurity, restricted))
+
+	err := checkNamespacePodSecurity(namespaces, "drycc", PrivilegedPodSecurity, restricted)
+	assert.Err(t, err, errors.New("preflight: builder pods at the privileged PodSecurity level of the builder would be rejected by namespace drycc, which enforces the restricted level; set POD_SECURITY_LEVEL to restricted or auto"))
+
+	restricted.plainHTTPRegistry = true
+	err = checkNamespacePodSecurity(namespaces, "drycc", BaselinePodSecurity, restricted)
+	assert.Err(t, err, errors.New("preflight: namespace drycc enforces the restricted PodSecurity level, but the build needs the baseline level because it pushes to a registry without TLS as root; use an off-cluster registry with TLS instead"))
+}
@@ -0,0 +1,140 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodSpecBuilder builds the specs of the slugbuilder and dockerbuilder pods of builds, before the
+// builder adds what depends on the app and the cluster, such as resources, security contexts,
+// dependency caches and build services. Forks and templates maintaining their own builder pods
+// build them with it to check, with the golden files of the golden package, that their specs stay
+// the same across versions. The specs of the same options are always the same.
+type PodSpecBuilder struct {
+	// Namespace is the namespace of the pods.
+	Namespace string
+	// NodeSelector schedules the pods, on any node if it's empty.
+	NodeSelector map[string]string
+	// StorageType is the type of the object storage the pods read the source from, and write
+	// slugs and caches to, e.g. minio, s3, gcs or azure.
+	StorageType string
+	// Debug makes the pods log what they do.
+	Debug bool
+}
+
+// PodOptions are the options of the builder pods of every stack.
+type PodOptions struct {
+	// Name is the name of the pod.
+	Name string
+	// Image is the image of the builder, PullPolicy its pull policy.
+	Image      string
+	PullPolicy corev1.PullPolicy
+	// Env is the config of the app the pod builds.
+	Env map[string]interface{}
+	// TarKey is the object storage key of the tarball of the source, ShortSha the short SHA of
+	// the commit it's the source of.
+	TarKey   string
+	ShortSha string
+}
+
+// SlugBuilderOptions are the options of the slugbuilder pods of buildpack builds.
+type SlugBuilderOptions struct {
+	PodOptions
+	// EnvSecretName is the secret Env is mounted from, the slugbuilder doesn't get it as its env.
+	EnvSecretName string
+	// PutKey is the object storage key the slug is written to, and CacheKey that of the build
+	// cache, if the build uses one.
+	PutKey   string
+	CacheKey string
+}
+
+// DockerBuilderOptions are the options of the dockerbuilder pods of container builds.
+type DockerBuilderOptions struct {
+	PodOptions
+	// ImageName is the name the image built is pushed as.
+	ImageName string
+	// RegistryHost and RegistryPort are the address of the registry proxy of the cluster, and
+	// RegistryEnv the env telling the pod which registry to push to and how.
+	RegistryHost string
+	RegistryPort string
+	RegistryEnv  map[string]string
+}
+
+// SlugBuilderPod returns the spec of the slugbuilder pod of opts.
+func (b PodSpecBuilder) SlugBuilderPod(opts SlugBuilderOptions) *corev1.Pod {
+	pod := b.pod(opts.PodOptions, nil)
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: opts.EnvSecretName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: opts.EnvSecretName,
+			},
+		},
+	})
+
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      opts.EnvSecretName,
+		MountPath: envRoot,
+		ReadOnly:  true,
+	})
+
+	pod.Spec.Containers[0].Name = slugBuilderName
+
+	// If cacheKey is set, add it to environment
+	if opts.CacheKey != "" {
+		addEnvToPod(pod, cachePath, opts.CacheKey)
+	}
+
+	addEnvToPod(pod, tarPath, opts.TarKey)
+	addEnvToPod(pod, putPath, opts.PutKey)
+	addEnvToPod(pod, sourceVersion, opts.ShortSha)
+	addEnvToPod(pod, builderStorage, b.StorageType)
+
+	return &pod
+}
+
+// DockerBuilderPod returns the spec of the dockerbuilder pod of opts.
+func (b PodSpecBuilder) DockerBuilderPod(opts DockerBuilderOptions) *corev1.Pod {
+	pod := b.pod(opts.PodOptions, opts.Env)
+
+	// inject application envvars as a special envvar which will be handled by dockerbuilder to
+	// inject them as build-time variables.
+	// NOTE(bacongobbler): docker-py takes buildargs as a json string in the form of
+	//
+	// {"KEY": "value"}
+	//
+	// So we need to translate the map into json.
+	if _, ok := opts.Env["DRYCC_DOCKER_BUILD_ARGS_ENABLED"]; ok {
+		dockerBuildArgs, _ := json.Marshal(opts.Env)
+		addEnvToPod(pod, "DOCKER_BUILD_ARGS", string(dockerBuildArgs))
+	}
+
+	pod.Spec.Containers[0].Name = dockerBuilderName
+
+	addEnvToPod(pod, tarPath, opts.TarKey)
+	addEnvToPod(pod, sourceVersion, opts.ShortSha)
+	addEnvToPod(pod, "IMG_NAME", opts.ImageName)
+	addEnvToPod(pod, builderStorage, b.StorageType)
+	// inject existing DRYCC_REGISTRY_PROXY_HOST and PORT info to dockerbuilder
+	// see https://github.com/drycc/dockerbuilder/issues/83
+	addEnvToPod(pod, "DRYCC_REGISTRY_PROXY_HOST", opts.RegistryHost)
+	addEnvToPod(pod, "DRYCC_REGISTRY_PROXY_PORT", opts.RegistryPort)
+	// the host may be an IPv6 literal, which can't simply be joined to the port with a colon
+	addEnvToPod(pod, "DRYCC_REGISTRY_PROXY_ADDR", net.JoinHostPort(opts.RegistryHost, opts.RegistryPort))
+
+	for _, key := range sortedKeys(opts.RegistryEnv) {
+		addEnvToPod(pod, key, opts.RegistryEnv[key])
+	}
+
+	return &pod
+}
+
+// pod returns the pod of opts, with env as the env of its container.
+func (b PodSpecBuilder) pod(opts PodOptions, env map[string]interface{}) corev1.Pod {
+	pod := buildPod(b.Debug, opts.Name, b.Namespace, opts.PullPolicy, b.NodeSelector, env)
+	pod.Spec.Containers[0].Image = opts.Image
+	return pod
+}
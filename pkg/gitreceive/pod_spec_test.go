@@ -0,0 +1,49 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/drycc/builder/pkg/golden"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var goldenPodSpecs = PodSpecBuilder{
+	Namespace:    "drycc",
+	NodeSelector: map[string]string{"pool": "build"},
+	StorageType:  "minio",
+}
+
+func TestSlugBuilderPodGolden(t *testing.T) {
+	pod := goldenPodSpecs.SlugBuilderPod(SlugBuilderOptions{
+		PodOptions: PodOptions{
+			Name:       "slugbuild-myapp-abc1234-0123abcd",
+			Image:      "drycc/slugbuilder:canary",
+			PullPolicy: corev1.PullIfNotPresent,
+			Env:        map[string]interface{}{"DATABASE_URL": "postgres://db", "WEB_CONCURRENCY": 2},
+			TarKey:     "home/myapp:git-abc1234/tar",
+			ShortSha:   "abc1234",
+		},
+		EnvSecretName: "myapp-build-env",
+		PutKey:        "home/myapp:git-abc1234/push",
+		CacheKey:      "home/myapp/cache",
+	})
+	golden.Assert(t, "testdata/slugbuilder-pod.json", pod)
+}
+
+func TestDockerBuilderPodGolden(t *testing.T) {
+	pod := goldenPodSpecs.DockerBuilderPod(DockerBuilderOptions{
+		PodOptions: PodOptions{
+			Name:       "dockerbuild-myapp-abc1234-0123abcd",
+			Image:      "drycc/dockerbuilder:canary",
+			PullPolicy: corev1.PullAlways,
+			Env:        map[string]interface{}{"DRYCC_DOCKER_BUILD_ARGS_ENABLED": "1", "VERSION": "1.0"},
+			TarKey:     "home/myapp:git-abc1234/tar",
+			ShortSha:   "abc1234",
+		},
+		ImageName:    "myapp:git-abc1234",
+		RegistryHost: "fd00::10",
+		RegistryPort: "5555",
+		RegistryEnv:  map[string]string{"DRYCC_REGISTRY_LOCATION": "on-cluster", "DRYCC_REGISTRY_TOKEN": "token"},
+	})
+	golden.Assert(t, "testdata/dockerbuilder-pod.json", pod)
+}
@@ -0,0 +1,83 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// builderPodLabel marks builder pods, for them to be spread over the nodes.
+	builderPodLabel = "builder.drycc.cc/builder-pod"
+	hostnameLabel   = "kubernetes.io/hostname"
+	nodeNameField   = "metadata.name"
+)
+
+// podLister is the subset of a (k8s.io/client-go/kubernetes/typed/core/v1).PodInterface needed to
+// count the builds running on each node.
+type podLister interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error)
+}
+
+// spreadBuilderPods asks the scheduler to prefer nodes that don't run another builder pod for pod.
+func spreadBuilderPods(pod *corev1.Pod) {
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+			Weight: 100,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{builderPodLabel: "true"}},
+				TopologyKey:   hostnameLabel,
+			},
+		}},
+	}
+}
+
+// busyNodes returns the names of the nodes running max builder pods or more.
+func busyNodes(pods podLister, max int) ([]string, error) {
+	list, err := pods.List(context.TODO(), metav1.ListOptions{LabelSelector: builderPodLabel + "=true"})
+	if err != nil {
+		return nil, fmt.Errorf("listing the builder pods (%s)", err)
+	}
+	builds := make(map[string]int)
+	for _, pod := range list.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		builds[pod.Spec.NodeName]++
+	}
+	var busy []string
+	for node, n := range builds {
+		if n >= max {
+			busy = append(busy, node)
+		}
+	}
+	sort.Strings(busy)
+	return busy, nil
+}
+
+// avoidNodes keeps pod from being scheduled on nodes.
+func avoidNodes(pod *corev1.Pod, nodes []string) {
+	if len(nodes) == 0 {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchFields: []corev1.NodeSelectorRequirement{{
+					Key:      nodeNameField,
+					Operator: corev1.NodeSelectorOpNotIn,
+					Values:   nodes,
+				}},
+			}},
+		},
+	}
+}
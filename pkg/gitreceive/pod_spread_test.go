@@ -0,0 +1,72 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakePodLister struct {
+	pods     []corev1.Pod
+	selector string
+	err      error
+}
+
+func (f *fakePodLister) List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error) {
+	f.selector = opts.LabelSelector
+	return &corev1.PodList{Items: f.pods}, f.err
+}
+
+func builderPodOn(node string, phase corev1.PodPhase) corev1.Pod {
+	return corev1.Pod{Spec: corev1.PodSpec{NodeName: node}, Status: corev1.PodStatus{Phase: phase}}
+}
+
+func TestBusyNodes(t *testing.T) {
+	lister := &fakePodLister{pods: []corev1.Pod{
+		builderPodOn("node-b", corev1.PodRunning),
+		builderPodOn("node-b", corev1.PodPending),
+		builderPodOn("node-a", corev1.PodRunning),
+		builderPodOn("node-a", corev1.PodRunning),
+		builderPodOn("node-c", corev1.PodRunning),
+		builderPodOn("node-c", corev1.PodSucceeded),
+		builderPodOn("node-c", corev1.PodFailed),
+		builderPodOn("", corev1.PodPending),
+	}}
+	busy, err := busyNodes(lister, 2)
+	assert.NoErr(t, err)
+	assert.Equal(t, busy, []string{"node-a", "node-b"}, "busy nodes")
+	assert.Equal(t, lister.selector, builderPodLabel+"=true", "label selector")
+
+	busy, err = busyNodes(lister, 3)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(busy), 0, "busy nodes")
+
+	lister.err = errors.New("forbidden")
+	_, err = busyNodes(lister, 2)
+	assert.Err(t, err, errors.New("listing the builder pods (forbidden)"))
+}
+
+func TestSpreadBuilderPods(t *testing.T) {
+	pod := buildPod(false, "slugbuild-app", "drycc", corev1.PullAlways, nil, nil)
+	assert.Equal(t, pod.Labels[builderPodLabel], "true", "builder pod label")
+
+	spreadBuilderPods(&pod)
+	terms := pod.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	assert.Equal(t, len(terms), 1, "anti-affinity terms")
+	assert.Equal(t, terms[0].PodAffinityTerm.TopologyKey, hostnameLabel, "topology key")
+	assert.Equal(t, terms[0].PodAffinityTerm.LabelSelector.MatchLabels, map[string]string{builderPodLabel: "true"}, "selector")
+	assert.True(t, pod.Spec.Affinity.NodeAffinity == nil, "node affinity without busy nodes")
+
+	avoidNodes(&pod, nil)
+	assert.True(t, pod.Spec.Affinity.NodeAffinity == nil, "node affinity without busy nodes")
+	avoidNodes(&pod, []string{"node-a", "node-b"})
+	req := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchFields[0]
+	assert.Equal(t, req.Key, nodeNameField, "field")
+	assert.Equal(t, req.Operator, corev1.NodeSelectorOpNotIn, "operator")
+	assert.Equal(t, req.Values, []string{"node-a", "node-b"}, "avoided nodes")
+	assert.True(t, pod.Spec.Affinity.PodAntiAffinity != nil, "the anti-affinity was dropped")
+}
@@ -0,0 +1,129 @@
+package gitreceive
+
+import (
+	"fmt"
+	"time"
+
+	builderconf "github.com/drycc/builder/pkg/conf"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/builder/pkg/sys"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The env vars holding the pre-signed URLs of the objects builder pods read and write, when
+// they're not given the credentials of the object storage.
+const (
+	tarURL          = "TAR_URL"
+	slugURL         = "SLUG_URL"
+	slugChecksumURL = "SLUG_CHECKSUM_URL"
+	procfileURL     = "PROCFILE_URL"
+	cacheURL        = "CACHE_URL"
+	cachePutURL     = "CACHE_PUT_URL"
+)
+
+// maxPresignedURLTTL is the longest S3 compatible storages accept pre-signed URLs to be valid.
+const maxPresignedURLTTL = 7 * 24 * time.Hour
+
+// presigners sign the URLs of the objects handed to builder pods: the artifacts, and the build
+// caches, which may be kept in a storage of their own.
+type presigners struct {
+	artifacts storage.Presigner
+	cache     storage.Presigner
+}
+
+// newPresigners returns the presigners of the object storages if builder pods are handed pre-signed
+// URLs, nil otherwise. Builder pods only get the credentials of the main object storage, so a
+// storage of its own for the build caches needs pre-signed URLs.
+func newPresigners(conf *Config, env sys.Env) (*presigners, error) {
+	cacheParams, _, err := builderconf.GetClassStorageParams(builderconf.CacheStorageClass)
+	if err != nil {
+		return nil, fmt.Errorf("reading the cache storage credentials (%s)", err)
+	}
+	if !conf.PresignedURLs {
+		if cacheParams != nil {
+			return nil, fmt.Errorf("the cache storage needs PRESIGNED_URLS_ENABLED, builder pods can't reach it otherwise")
+		}
+		return nil, nil
+	}
+	params, err := builderconf.GetStorageParams(env)
+	if err != nil {
+		return nil, fmt.Errorf("reading the storage credentials (%s)", err)
+	}
+	presigner, err := storage.NewS3Presigner(params)
+	if err != nil {
+		return nil, fmt.Errorf("creating the URL presigner (%s)", err)
+	}
+	p := &presigners{artifacts: presigner, cache: presigner}
+	if cacheParams != nil {
+		if p.cache, err = storage.NewS3Presigner(cacheParams); err != nil {
+			return nil, fmt.Errorf("creating the URL presigner of the cache storage (%s)", err)
+		}
+	}
+	return p, nil
+}
+
+// presignedURLTTL returns how long the URLs handed to builder pods are valid: as long as the
+// builder waits for a pod to start, plus the longest the build may then run, or as long as the
+// storage allows for builds without a timeout.
+func presignedURLTTL(conf *Config) time.Duration {
+	ttl := conf.BuilderPodWaitDuration() + conf.BuildTimeout()
+	if conf.BuildTimeout() <= 0 || ttl > maxPresignedURLTTL {
+		return maxPresignedURLTTL
+	}
+	return ttl
+}
+
+// presignedURL is an object handed to builder pods through a pre-signed URL in env, signed by
+// presigner.
+type presignedURL struct {
+	env       string
+	key       string
+	put       bool
+	presigner storage.Presigner
+}
+
+// presignPod hands pod pre-signed URLs of the objects of info it reads and writes, valid for ttl,
+// in place of the object storage credentials.
+func presignPod(pod *corev1.Pod, p *presigners, info *SlugBuilderInfo, ttl time.Duration) error {
+	var volumes []corev1.Volume
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name != objectStore {
+			volumes = append(volumes, volume)
+		}
+	}
+	pod.Spec.Volumes = volumes
+	var mounts []corev1.VolumeMount
+	for _, mount := range pod.Spec.Containers[0].VolumeMounts {
+		if mount.Name != objectStore {
+			mounts = append(mounts, mount)
+		}
+	}
+	pod.Spec.Containers[0].VolumeMounts = mounts
+
+	urls := []presignedURL{{tarURL, info.TarKey(), false, p.artifacts}}
+	if pod.Spec.Containers[0].Name == slugBuilderName {
+		urls = append(urls,
+			presignedURL{slugURL, info.AbsoluteSlugObjectKey(), true, p.artifacts},
+			presignedURL{slugChecksumURL, storage.ChecksumKey(info.AbsoluteSlugObjectKey()), true, p.artifacts},
+			presignedURL{procfileURL, info.AbsoluteProcfileKey(), true, p.artifacts},
+		)
+		if !info.DisableCaching() {
+			urls = append(urls,
+				presignedURL{cacheURL, info.CacheKey(), false, p.cache},
+				presignedURL{cachePutURL, info.CacheKey(), true, p.cache},
+			)
+		}
+	}
+	for _, u := range urls {
+		sign := u.presigner.PresignGet
+		if u.put {
+			sign = u.presigner.PresignPut
+		}
+		url, err := sign(u.key, ttl)
+		if err != nil {
+			return fmt.Errorf("pre-signing the URL of %s (%s)", u.key, err)
+		}
+		addEnvToPod(*pod, u.env, url)
+	}
+	return nil
+}
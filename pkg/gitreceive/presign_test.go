@@ -0,0 +1,75 @@
+package gitreceive
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakePresigner struct {
+	err error
+}
+
+func (f fakePresigner) PresignGet(key string, ttl time.Duration) (string, error) {
+	return fmt.Sprintf("GET %s %s", key, ttl), f.err
+}
+
+func (f fakePresigner) PresignPut(key string, ttl time.Duration) (string, error) {
+	return fmt.Sprintf("PUT %s %s", key, ttl), f.err
+}
+
+func TestPresignSlugbuilderPod(t *testing.T) {
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.SlugBuilderPod(SlugBuilderOptions{PodOptions: PodOptions{Name: "build", Image: "slugbuilder", PullPolicy: corev1.PullAlways, TarKey: info.TarKey(), ShortSha: "12345678"}, EnvSecretName: "app-build-env", PutKey: info.PushKey(), CacheKey: info.CacheKey()})
+	assert.NoErr(t, presignPod(pod, &presigners{fakePresigner{}, fakePresigner{}}, info, time.Hour))
+
+	for _, volume := range pod.Spec.Volumes {
+		assert.True(t, volume.Name != objectStore, "the object storage credentials are still mounted")
+	}
+	assert.Equal(t, len(pod.Spec.Volumes), 1, "number of volumes")
+	assert.Equal(t, len(pod.Spec.Containers[0].VolumeMounts), 1, "number of volume mounts")
+	assert.Equal(t, podEnv(pod, tarURL), "GET home/app:git-12345678/tar 1h0m0s", tarURL)
+	assert.Equal(t, podEnv(pod, slugURL), "PUT home/app:git-12345678/push/slug.tgz 1h0m0s", slugURL)
+	assert.Equal(t, podEnv(pod, slugChecksumURL), "PUT home/app:git-12345678/push/slug.tgz.sha256 1h0m0s", slugChecksumURL)
+	assert.Equal(t, podEnv(pod, procfileURL), "PUT home/app:git-12345678/push/Procfile 1h0m0s", procfileURL)
+	assert.Equal(t, podEnv(pod, cacheURL), "GET home/app/cache 1h0m0s", cacheURL)
+	assert.Equal(t, podEnv(pod, cachePutURL), "PUT home/app/cache 1h0m0s", cachePutURL)
+}
+
+func TestPresignDockerBuilderPod(t *testing.T) {
+	info := NewSlugBuilderInfo("app", "12345678", true)
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.DockerBuilderPod(DockerBuilderOptions{PodOptions: PodOptions{Name: "build", Image: "dockerbuilder", PullPolicy: corev1.PullAlways, TarKey: info.TarKey(), ShortSha: "12345678"}, ImageName: "app", RegistryHost: "registry", RegistryPort: "5555"})
+	assert.NoErr(t, presignPod(pod, &presigners{fakePresigner{}, fakePresigner{}}, info, time.Minute))
+
+	assert.Equal(t, len(pod.Spec.Volumes), 0, "number of volumes")
+	assert.Equal(t, podEnv(pod, tarURL), "GET home/app:git-12345678/tar 1m0s", tarURL)
+	for _, key := range []string{slugURL, slugChecksumURL, procfileURL, cacheURL, cachePutURL} {
+		assert.Equal(t, podEnv(pod, key), "", key)
+	}
+
+	err := presignPod(pod, &presigners{fakePresigner{err: errors.New("no credentials")}, fakePresigner{}}, info, time.Minute)
+	assert.True(t, err != nil, "presigned a pod without credentials")
+}
+
+func TestPresignCacheStorage(t *testing.T) {
+	p := &presigners{fakePresigner{}, fakePresigner{err: errors.New("no cache credentials")}}
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.SlugBuilderPod(SlugBuilderOptions{PodOptions: PodOptions{Name: "build", Image: "slugbuilder", PullPolicy: corev1.PullAlways, TarKey: info.TarKey(), ShortSha: "12345678"}, EnvSecretName: "app-build-env", PutKey: info.PushKey(), CacheKey: info.CacheKey()})
+	assert.Err(t, presignPod(pod, p, info, time.Hour), fmt.Errorf("pre-signing the URL of %s (no cache credentials)", info.CacheKey()))
+
+	pod = PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.DockerBuilderPod(DockerBuilderOptions{PodOptions: PodOptions{Name: "build", Image: "dockerbuilder", PullPolicy: corev1.PullAlways, TarKey: info.TarKey(), ShortSha: "12345678"}, ImageName: "app", RegistryHost: "registry", RegistryPort: "5555"})
+	assert.NoErr(t, presignPod(pod, p, info, time.Hour))
+}
+
+func TestPresignedURLTTL(t *testing.T) {
+	conf := &Config{BuilderPodWaitDurationMSec: 5 * 60 * 1000, BuildTimeoutMSec: 60 * 60 * 1000}
+	assert.Equal(t, presignedURLTTL(conf), 65*time.Minute, "TTL")
+	conf.BuildTimeoutMSec = 0
+	assert.Equal(t, presignedURLTTL(conf), maxPresignedURLTTL, "TTL without a build timeout")
+	conf.BuildTimeoutMSec = 30 * 24 * 60 * 60 * 1000
+	assert.Equal(t, presignedURLTTL(conf), maxPresignedURLTTL, "TTL of a build timeout past the storage's limit")
+}
@@ -0,0 +1,95 @@
+package gitreceive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	procfileName = "Procfile"
+	// maxObjectNameLength is the length Kubernetes limits the names of the deployments and services
+	// of process types, "<app>-<process type>", to.
+	maxObjectNameLength = 63
+)
+
+// checkProcfile validates the Procfile in dirName, if there's one, for app, so that a Procfile
+// the controller would reject fails the push before the build. Its warnings are printed.
+func checkProcfile(dirName, app string) error {
+	raw, err := ioutil.ReadFile(filepath.Join(dirName, procfileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error in reading %s (%s)", procfileName, err)
+	}
+	warnings, err := validateProcfile(raw, app)
+	for _, warning := range warnings {
+		log.Info("WARNING: %s", warning)
+	}
+	return err
+}
+
+// validateProcfile validates the raw Procfile of app: its process types must be declared once,
+// with a command and a name the controller accepts. It returns the warnings about mistakes that
+// still make a valid Procfile.
+func validateProcfile(raw []byte, app string) ([]string, error) {
+	var warnings []string
+	if bytes.Contains(raw, []byte("\r\n")) {
+		warnings = append(warnings, fmt.Sprintf("the %s has Windows line endings, save it with Unix line endings so that the commands don't end with a carriage return", procfileName))
+	}
+	// YAML takes the last of duplicate keys, so they're looked for in the lines declaring
+	// process types
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t") {
+			continue
+		}
+		colon := strings.Index(text, ":")
+		if colon < 0 {
+			return warnings, fmt.Errorf("line %d of the %s isn't a process type declaration \"<name>: <command>\"", line, procfileName)
+		}
+		name := text[:colon]
+		if first, ok := seen[name]; ok {
+			return warnings, fmt.Errorf("the process type %s is declared twice in the %s, on lines %d and %d", name, procfileName, first, line)
+		}
+		seen[name] = line
+	}
+	procType := dryccAPI.ProcessType{}
+	if err := yaml.Unmarshal(raw, &procType); err != nil {
+		return warnings, fmt.Errorf("procfile %s is malformed (%s)", procfileName, err)
+	}
+	return warnings, validateProcessTypes(procType, app)
+}
+
+// validateProcessTypes checks that procType, the process types of a build of app, is what the
+// controller accepts.
+func validateProcessTypes(procType dryccAPI.ProcessType, app string) error {
+	names := make([]string, 0, len(procType))
+	for name := range procType {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !processTypeRegexp.MatchString(name) {
+			return fmt.Errorf("invalid process type %q, process types can only contain lowercase letters, digits and dashes, and can't start or end with a dash", name)
+		}
+		if max := maxObjectNameLength - len(app) - 1; len(name) > max {
+			return fmt.Errorf("the process type %s is too long, process types of %s can be %d characters long at most", name, app, max)
+		}
+		if strings.TrimSpace(procType[name]) == "" {
+			return fmt.Errorf("the process type %s has no command", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package gitreceive
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestValidateProcfile(t *testing.T) {
+	warnings, err := validateProcfile([]byte("# processes\nweb: bin/web\nworker: >\n  bin/worker\n  --queue default\n"), "app")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(warnings), 0, "warnings of a valid Procfile")
+
+	warnings, err = validateProcfile([]byte("web: bin/web\r\nworker: bin/worker\r\n"), "app")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(warnings), 1, "warnings of a Procfile with Windows line endings")
+
+	_, err = validateProcfile([]byte("web: bin/web\nworker: bin/worker\nweb: bin/other\n"), "app")
+	assert.Err(t, err, errors.New("the process type web is declared twice in the Procfile, on lines 1 and 3"))
+	_, err = validateProcfile([]byte("web: bin/web\nbin/worker\n"), "app")
+	assert.Err(t, err, errors.New(`line 2 of the Procfile isn't a process type declaration "<name>: <command>"`))
+	_, err = validateProcfile([]byte("web:\n"), "app")
+	assert.Err(t, err, errors.New("the process type web has no command"))
+}
+
+func TestValidateProcessTypes(t *testing.T) {
+	assert.NoErr(t, validateProcessTypes(dryccAPI.ProcessType{"web": "bin/web", "worker-2": "bin/worker"}, "app"))
+	err := validateProcessTypes(dryccAPI.ProcessType{"Worker_Queue": "bin/worker"}, "app")
+	assert.True(t, err != nil && strings.Contains(err.Error(), `invalid process type "Worker_Queue"`), "invalid name accepted")
+	err = validateProcessTypes(dryccAPI.ProcessType{strings.Repeat("w", 60): "bin/worker"}, "app")
+	assert.Err(t, err, errors.New("the process type "+strings.Repeat("w", 60)+" is too long, process types of app can be 59 characters long at most"))
+}
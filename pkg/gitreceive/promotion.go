@@ -0,0 +1,228 @@
+package gitreceive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	builderconf "github.com/drycc/builder/pkg/conf"
+	"github.com/drycc/builder/pkg/registry"
+	"github.com/drycc/builder/pkg/release"
+	"github.com/drycc/builder/pkg/storage"
+	drycc "github.com/drycc/controller-sdk-go"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// PromotedManifestKeyPattern is the template for the object storage key of the manifest of a
+// build promoted from another cluster, by app and short git sha.
+const PromotedManifestKeyPattern = "home/%s/promoted/git-%s.json"
+
+// promoter replicates builds to the object storage and registry of another cluster, so that the
+// builder there releases them without rebuilding when the same commit is pushed to it.
+type promoter struct {
+	storage storage.ObjectWriter
+	images  *registry.Client
+	// registry is the registry images are promoted to, optionally followed by a repository
+	// prefix, e.g. "registry.example.com/drycc".
+	registry string
+}
+
+// newPromoter returns a promoter for the storage and registry conf names, or nil if promotion is
+// disabled.
+func newPromoter(conf *Config) (*promoter, error) {
+	if !conf.PromotionEnabled {
+		return nil, nil
+	}
+	params, err := builderconf.GetPromotionStorageParams(conf.PromotionCredsPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading the promotion storage credentials (%s)", err)
+	}
+	driver, err := factory.Create("s3", params)
+	if err != nil {
+		return nil, fmt.Errorf("creating the promotion storage driver (%s)", err)
+	}
+	username := readCredential(conf.PromotionCredsPath, "registry-username")
+	password := readCredential(conf.PromotionCredsPath, "registry-password")
+	return &promoter{
+		storage:  driver,
+		images:   registry.NewClient(username, password, false),
+		registry: conf.PromotionRegistry,
+	}, nil
+}
+
+// readCredential returns the trimmed content of the file name in dir, or "" if it can't be read.
+func readCredential(dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// promoteBuild replicates the build m describes to the other cluster. Failures are logged, never
+// returned, since the build itself succeeded.
+func (p *promoter) promoteBuild(ctx context.Context, conf *Config, secrets typedcorev1.SecretInterface, src storage.ObjectReader, m *BuildManifest) {
+	if p == nil {
+		return
+	}
+	err := pusherTerminal.during(msgPromoting, conf.SessionIdleInterval(), func() error {
+		return p.promote(ctx, conf, secrets, src, m)
+	}, m.Sha)
+	if err != nil {
+		log.Info("The build succeeded, but promoting it failed (%s)", err)
+		return
+	}
+	log.Info("Promoted git-%s, push the same commit to the other cluster to release it without rebuilding", m.Sha)
+}
+
+// promote copies the slug of m from src, or its image from the registry the build pushed it to,
+// then stores m, pointing at the copy, in the other cluster's storage. m.Image is the slug key or,
+// for container builds, the image name as passed to the controller.
+func (p *promoter) promote(ctx context.Context, conf *Config, secrets typedcorev1.SecretInterface, src storage.ObjectReader, m *BuildManifest) error {
+	if m.Stack != "container" {
+		sum, err := storage.CopyObject(src, p.storage, m.Image)
+		if err != nil {
+			return err
+		}
+		m.Checksum = sum
+		return putPromotedManifest(ctx, p.storage, m)
+	}
+
+	if conf.RegistryLocation == "on-cluster" && p.registry == "" {
+		return errors.New("PROMOTION_REGISTRY must be set to promote images from the on-cluster registry")
+	}
+	ref, err := builtImageReference(conf, m.Image, m.Sha)
+	if err != nil {
+		return err
+	}
+	srcImages, err := newImageClient(conf, secrets, ref)
+	if err != nil {
+		return err
+	}
+	if p.registry == "" {
+		// both clusters can pull from the off-cluster registry, so the image is promoted as is
+		_, digest, err := srcImages.ImageManifest(*ref)
+		if err != nil {
+			return err
+		}
+		m.Image, m.Checksum = ref.String(), digest
+		return putPromotedManifest(ctx, p.storage, m)
+	}
+	dst, err := registry.ParseReference(fmt.Sprintf("%s/%s:%s", p.registry, m.App, ref.Tag))
+	if err != nil {
+		return err
+	}
+	digest, err := registry.CopyIndex(srcImages, *ref, p.images, *dst)
+	if err != nil {
+		return fmt.Errorf("copying %s to %s (%s)", ref, dst, err)
+	}
+	m.Image, m.Checksum = dst.String(), digest
+	return putPromotedManifest(ctx, p.storage, m)
+}
+
+func putPromotedManifest(ctx context.Context, putter storage.ObjectPutter, m *BuildManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return putter.PutContent(ctx, fmt.Sprintf(PromotedManifestKeyPattern, m.App, m.Sha), data)
+}
+
+// getPromotedManifest returns the manifest of the build of app at sha promoted from another
+// cluster, or nil if there is none.
+func getPromotedManifest(ctx context.Context, getter storage.ObjectGetter, app, sha string) (*BuildManifest, error) {
+	data, err := getter.GetContent(ctx, fmt.Sprintf(PromotedManifestKeyPattern, app, sha))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := new(BuildManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("promoted build manifest of %s is malformed (%s)", app, err)
+	}
+	return m, nil
+}
+
+// verifyPromoted checks the slug of the promoted build m against the digest recorded when it was
+// promoted. Images are checked by the registry when they're pulled.
+func verifyPromoted(reader storage.ObjectReader, m *BuildManifest) error {
+	if m.Stack == "container" {
+		return nil
+	}
+	sum, err := storage.GetChecksum(reader, m.Image)
+	if err != nil {
+		return fmt.Errorf("verifying promoted slug %s (%s)", m.Image, err)
+	}
+	if sum == "" || sum != m.Checksum {
+		return fmt.Errorf("refusing to release promoted slug %s, it doesn't match the promoted build", m.Image)
+	}
+	if _, err := storage.VerifyChecksum(reader, m.Image); err != nil {
+		return fmt.Errorf("refusing to release promoted slug %s (%s)", m.Image, err)
+	}
+	return nil
+}
+
+// releasePromoted releases the build m promoted from another cluster, without running a builder
+// pod. Its release phase runs in this cluster, with the config of the app here.
+func releasePromoted(
+	ctx context.Context,
+	conf *Config,
+	client *drycc.Client,
+	kubeClient kubernetes.Interface,
+	storageDriver storagedriver.StorageDriver,
+	appConf dryccAPI.Config,
+	m *BuildManifest,
+	info buildInfo,
+	strategy,
+	slugRunner string,
+	recorder *buildRecorder) error {
+
+	pusherTerminal.info(msgReleasePromoted, m.Sha)
+	image := m.Image
+	if m.Stack == "container" {
+		slugRunner = ""
+		// promoted images are released by the digest they were promoted with
+		image = pinnedImage(m.Image, m.Checksum)
+	}
+	if err := verifyPromoted(storageDriver, m); err != nil {
+		return err
+	}
+	processes, err := runReleasePhase(ctx, conf, kubeClient, appConf, nil, m.ProcessTypes,
+		m.App, m.Sha, m.Stack, image, slugRunner, recorder)
+	if err != nil {
+		return err
+	}
+	version, err := createBuild(ctx, conf, client, storageDriver, release.Request{
+		Username:    conf.Username,
+		App:         m.App,
+		Image:       image,
+		Stack:       m.Stack,
+		Sha:         m.Sha,
+		Procfile:    processes,
+		Annotations: info.annotations(time.Now()),
+		Strategy:    strategy,
+		SlugRunner:  slugRunner,
+	})
+	if err == errReleaseDeferred {
+		recorder.record(buildPhaseDeferred, "the controller is unavailable, the release is pending")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recorder.released(version, "released v%d from promoted build git-%s", version, m.Sha)
+	printDeployed(m.App, version)
+	summarizeRelease(ctx, storageDriver, newBuildManifest(m.App, m.Sha, version, m.Stack, m.Image, m.ProcessTypes, appConf.Values))
+	return nil
+}
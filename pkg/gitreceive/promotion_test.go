@@ -0,0 +1,57 @@
+package gitreceive
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/storage"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestPromoteSlug(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	src, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	dst, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	slugKey := NewSlugBuilderInfo("app", "12345678", false).AbsoluteSlugObjectKey()
+	assert.NoErr(t, src.PutContent(context.Background(), slugKey, []byte("slug")))
+
+	p := &promoter{storage: dst}
+	m := newBuildManifest("app", "12345678", 0, "heroku-18", slugKey, dryccAPI.ProcessType{"web": "./web"}, nil)
+	assert.NoErr(t, p.promote(context.Background(), &Config{}, nil, src, m))
+
+	promoted, err := getPromotedManifest(context.Background(), dst, "app", "12345678")
+	assert.NoErr(t, err)
+	assert.Equal(t, promoted.Image, slugKey, "slug key")
+	assert.Equal(t, promoted.ProcessTypes, dryccAPI.ProcessType{"web": "./web"}, "process types")
+	assert.NoErr(t, verifyPromoted(dst, promoted))
+
+	// a slug replaced after it was promoted isn't released
+	assert.NoErr(t, dst.PutContent(context.Background(), slugKey, []byte("other slug")))
+	sum, err := storage.SHA256(strings.NewReader("other slug"))
+	assert.NoErr(t, err)
+	assert.NoErr(t, storage.PutChecksum(dst, slugKey, sum))
+	assert.True(t, verifyPromoted(dst, promoted) != nil, "verified a slug that doesn't match the promoted build")
+
+	missing, err := getPromotedManifest(context.Background(), dst, "app", "87654321")
+	assert.NoErr(t, err)
+	assert.True(t, missing == nil, "found a manifest that wasn't promoted")
+}
+
+func TestPromoteOnClusterImageWithoutRegistry(t *testing.T) {
+	p := &promoter{}
+	m := newBuildManifest("app", "12345678", 0, "container", "app", nil, nil)
+	err := p.promote(context.Background(), &Config{RegistryLocation: "on-cluster"}, nil, nil, m)
+	assert.True(t, err != nil, "promoted an on-cluster image without a promotion registry")
+}
+
+func TestNilPromoter(t *testing.T) {
+	var p *promoter
+	// must not panic
+	p.promoteBuild(context.Background(), &Config{}, nil, nil, newBuildManifest("app", "12345678", 0, "heroku-18", "key", nil, nil))
+}
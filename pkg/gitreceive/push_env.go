@@ -0,0 +1,52 @@
+package gitreceive
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envPushOptionPrefix is the prefix of the push options setting a variable of the build env for
+// the push only, e.g. "-o env:PROFILE=test".
+const envPushOptionPrefix = "env:"
+
+// envNameRegexp matches the names of environment variables.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pushOptionEnv returns the variables given with env:KEY=VALUE push options, which are only added
+// to the env of the builder pod, never to the config of the release. The builder must allow each
+// KEY with the comma separated patterns of allowed, and filter must not deny it.
+func pushOptionEnv(pushOpts PushOptions, allowed string, filter envFilter) (map[string]string, error) {
+	patterns, err := splitPatterns(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("reading the build env push options allow list (%s)", err)
+	}
+	env := make(map[string]string)
+	for opt, value := range pushOpts {
+		if !strings.HasPrefix(opt, envPushOptionPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(opt, envPushOptionPrefix)
+		switch {
+		case !envNameRegexp.MatchString(key):
+			return nil, userError(fmt.Errorf("invalid push option %s, use -o %sKEY=VALUE", opt, envPushOptionPrefix))
+		case len(patterns) == 0:
+			return nil, userError(fmt.Errorf("the builder doesn't allow setting the build env with push options"))
+		case !matchAny(patterns, key) || matchAny(filter.deny, key):
+			return nil, userError(fmt.Errorf("the builder doesn't allow setting %s with push options, only %s", key, strings.Join(patterns, ", ")))
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// sortedKeys returns the keys of env in order.
+func sortedKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
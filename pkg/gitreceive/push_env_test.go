@@ -0,0 +1,36 @@
+package gitreceive
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestPushOptionEnv(t *testing.T) {
+	filter, err := newEnvFilter("", "*_SECRET")
+	assert.NoErr(t, err)
+	opts := PushOptions{"env:PROFILE": "test", "env:FEATURE_X": "", "dry-run": ""}
+	env, err := pushOptionEnv(opts, "PROFILE,FEATURE_*", filter)
+	assert.NoErr(t, err)
+	assert.Equal(t, env, map[string]string{"PROFILE": "test", "FEATURE_X": ""}, "env")
+	assert.Equal(t, sortedKeys(env), []string{"FEATURE_X", "PROFILE"}, "keys")
+
+	env, err = pushOptionEnv(PushOptions{"dry-run": ""}, "", filter)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(env), 0, "env without env push options")
+
+	for _, opts := range []PushOptions{
+		{"env:PROFILE": "test"},
+		{"env:DEBUG": "1"},
+		{"env:FEATURE_SECRET": "1"},
+		{"env:1X": "1"},
+	} {
+		allowed := "PROFILE,FEATURE_*"
+		if _, ok := opts["env:PROFILE"]; ok {
+			allowed = ""
+		}
+		_, err := pushOptionEnv(opts, allowed, filter)
+		assert.True(t, err != nil && KindOf(err) == ErrUser, fmt.Sprintf("accepted push options %v", opts))
+	}
+}
@@ -0,0 +1,68 @@
+package gitreceive
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/drycc/builder/pkg/sys"
+)
+
+const (
+	pushOptionCountEnvVar  = "GIT_PUSH_OPTION_COUNT"
+	pushOptionEnvVarPrefix = "GIT_PUSH_OPTION_"
+
+	// imagePushOption imports an externally built image instead of building the pushed code.
+	imagePushOption = "image"
+	// rebuildPushOption builds the pushed code even if a build of it was promoted from another
+	// cluster.
+	rebuildPushOption = "rebuild"
+	// dryRunPushOption plans the build of the pushed code and prints the plan, without building or
+	// releasing anything.
+	dryRunPushOption = "dry-run"
+)
+
+// PushOptions holds the options given to `git push` with -o/--push-option. Options are either
+// flags ("-o dry-run") or key/value pairs ("-o image=quay.io/org/app:v1").
+type PushOptions map[string]string
+
+// pushOptionsFromEnv reads the push options git passes to the pre-receive hook through the
+// GIT_PUSH_OPTION_COUNT and GIT_PUSH_OPTION_<n> environment variables.
+func pushOptionsFromEnv(env sys.Env) PushOptions {
+	opts := make(PushOptions)
+	count, err := strconv.Atoi(env.Get(pushOptionCountEnvVar))
+	if err != nil {
+		return opts
+	}
+	for i := 0; i < count; i++ {
+		opt := env.Get(pushOptionEnvVarPrefix + strconv.Itoa(i))
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) == 2 {
+			opts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		} else {
+			opts[strings.TrimSpace(kv[0])] = ""
+		}
+	}
+	return opts
+}
+
+// Get returns the value of the push option key and whether it was given at all.
+func (p PushOptions) Get(key string) (string, bool) {
+	val, ok := p[key]
+	return val, ok
+}
+
+// Bool returns true if the push option key was given as a flag or with a true value.
+func (p PushOptions) Bool(key string) bool {
+	val, ok := p[key]
+	if !ok {
+		return false
+	}
+	if val == "" {
+		return true
+	}
+	b, err := strconv.ParseBool(val)
+	return err == nil && b
+}
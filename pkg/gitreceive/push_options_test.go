@@ -0,0 +1,29 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/sys"
+)
+
+func TestPushOptionsFromEnv(t *testing.T) {
+	env := sys.NewFakeEnv()
+	assert.Equal(t, len(pushOptionsFromEnv(env)), 0, "number of push options")
+
+	env.Envs["GIT_PUSH_OPTION_COUNT"] = "4"
+	env.Envs["GIT_PUSH_OPTION_0"] = "image=quay.io/org/app:v1"
+	env.Envs["GIT_PUSH_OPTION_1"] = "dry-run"
+	env.Envs["GIT_PUSH_OPTION_2"] = "cache=false"
+	env.Envs["GIT_PUSH_OPTION_3"] = "note=a=b"
+	opts := pushOptionsFromEnv(env)
+
+	image, ok := opts.Get("image")
+	assert.True(t, ok, "image option not found")
+	assert.Equal(t, image, "quay.io/org/app:v1", "image option")
+	note, _ := opts.Get("note")
+	assert.Equal(t, note, "a=b", "note option")
+	assert.True(t, opts.Bool("dry-run"), "dry-run flag not set")
+	assert.False(t, opts.Bool("cache"), "cache option set")
+	assert.False(t, opts.Bool("missing"), "missing option set")
+}
@@ -24,25 +24,29 @@ func getDetailsFromRegistrySecret(secretGetter typedcorev1.SecretInterface, secr
 	return regDetails, nil
 }
 
-func getRegistryDetails(kubeClient typedcorev1.SecretsGetter, image *string, registryLocation, namespace string) (map[string]string, error) {
-	privateRegistrySecretInterface := kubeClient.Secrets(namespace)
+// getRegistryEnv returns the env telling builder pods how to push to the registry at
+// registryLocation, read from the registry secret of namespace if it's off-cluster.
+func getRegistryEnv(kubeClient typedcorev1.SecretsGetter, registryLocation, namespace string) (map[string]string, error) {
 	registryEnv := make(map[string]string)
-	var regSecretData map[string]string
-	var err error
 	if registryLocation == "off-cluster" {
-		regSecretData, err = getDetailsFromRegistrySecret(privateRegistrySecretInterface, registrySecret)
+		regSecretData, err := getDetailsFromRegistrySecret(kubeClient.Secrets(namespace), registrySecret)
 		if err != nil {
 			return nil, err
 		}
 		for key, value := range regSecretData {
 			registryEnv["DRYCC_REGISTRY_"+strings.ToUpper(key)] = value
 		}
-		if registryEnv["DRYCC_REGISTRY_ORGANIZATION"] != "" {
-			*image = registryEnv["DRYCC_REGISTRY_ORGANIZATION"] + "/" + *image
-		}
-		if registryEnv["DRYCC_REGISTRY_HOSTNAME"] != "" {
-			*image = registryEnv["DRYCC_REGISTRY_HOSTNAME"] + "/" + *image
-		}
 	}
 	return registryEnv, nil
 }
+
+// registryImage returns image in the organization and on the host of the registry of registryEnv.
+func registryImage(registryEnv map[string]string, image string) string {
+	if registryEnv["DRYCC_REGISTRY_ORGANIZATION"] != "" {
+		image = registryEnv["DRYCC_REGISTRY_ORGANIZATION"] + "/" + image
+	}
+	if registryEnv["DRYCC_REGISTRY_HOSTNAME"] != "" {
+		image = registryEnv["DRYCC_REGISTRY_HOSTNAME"] + "/" + image
+	}
+	return image
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/arschles/assert"
 	"github.com/drycc/builder/pkg/k8s"
+	"github.com/drycc/builder/pkg/registry"
 	corev1 "k8s.io/api/core/v1"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
@@ -54,8 +55,7 @@ func TestGetRegistryDetailsOffclusterErr(t *testing.T) {
 			return getter
 		},
 	}
-	image := "test-image"
-	_, err := getRegistryDetails(kubeClient, &image, "off-cluster", dryccNamespace)
+	_, err := getRegistryEnv(kubeClient, "off-cluster", dryccNamespace)
 	assert.Err(t, err, expectedErr)
 }
 
@@ -75,9 +75,38 @@ func TestGetRegistryDetailsOffclusterSuccess(t *testing.T) {
 			return getter
 		},
 	}
-	image := "test-image"
-	regDetails, err := getRegistryDetails(kubeClient, &image, "off-cluster", dryccNamespace)
+	regDetails, err := getRegistryEnv(kubeClient, "off-cluster", dryccNamespace)
 	assert.NoErr(t, err)
 	assert.Equal(t, expectedData, regDetails, "registry details")
-	assert.Equal(t, expectedImage, image, "image")
+	assert.Equal(t, expectedImage, registryImage(regDetails, "test-image"), "image")
+}
+
+func TestNewImageClientCredentials(t *testing.T) {
+	data := map[string][]byte{"username": []byte("bot"), "password": []byte("s3cr3t")}
+	secrets := &k8s.FakeSecret{
+		FnGet: func(string) (*corev1.Secret, error) {
+			return &corev1.Secret{Data: data}, nil
+		},
+	}
+	conf := &Config{RegistryLocation: "off-cluster"}
+	for _, c := range []struct {
+		hostname string
+		image    string
+		username string
+	}{
+		// without a hostname, the credentials are for the default registry only
+		{"", "myorg/myapp:v1", "bot"},
+		{"", "evil.example.com/myorg/myapp:v1", ""},
+		{"quay.io", "quay.io/myorg/myapp:v1", "bot"},
+		{"quay.io", "quay.io.example.com/myorg/myapp:v1", ""},
+		{"quay.io", "myorg/myapp:v1", ""},
+	} {
+		data["hostname"] = []byte(c.hostname)
+		ref, err := registry.ParseReference(c.image)
+		assert.NoErr(t, err)
+		client, err := newImageClient(conf, secrets, ref)
+		assert.NoErr(t, err)
+		assert.Equal(t, client.Username, c.username, c.image+" with hostname "+c.hostname)
+		assert.Equal(t, client.Password != "", c.username != "", c.image+" password")
+	}
 }
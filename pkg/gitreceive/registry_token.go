@@ -0,0 +1,36 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drycc/builder/pkg/registry"
+)
+
+// registryTokenActions are the actions the registry tokens of builds grant on the repository of
+// their image.
+var registryTokenActions = []string{"pull", "push"}
+
+// registryToken returns a token of the on-cluster registry for the build of conf, granting only
+// the push and pull of repository until it expires, or "" if registry tokens are disabled. The
+// repository must be that of app or one under it, whatever the app or its pusher asked for, so
+// that tokens never grant access to the images of other apps. The key is read on every use, so
+// rotating it takes effect without restarting the builder.
+func registryToken(conf *Config, app, repository string, now time.Time) (string, error) {
+	if !conf.RegistryTokens {
+		return "", nil
+	}
+	if repository != app && !strings.HasPrefix(repository, app+"/") {
+		return "", fmt.Errorf("the repository %s isn't the one of %s, no registry token grants access to it", repository, app)
+	}
+	signer, err := registry.LoadTokenSigner(conf.RegistryTokenKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("loading the registry token key (%s)", err)
+	}
+	token, err := signer.RepositoryToken(conf.RegistryTokenIssuer, conf.RegistryTokenService, conf.Username, repository, registryTokenActions, conf.RegistryTokenTTL(), now)
+	if err != nil {
+		return "", fmt.Errorf("signing the registry token of %s (%s)", repository, err)
+	}
+	return token, nil
+}
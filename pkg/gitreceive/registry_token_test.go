@@ -0,0 +1,63 @@
+package gitreceive
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/registry"
+)
+
+func TestRegistryToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-token")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	conf := &Config{
+		Username:             "alice",
+		RegistryTokenKeyPath: filepath.Join(dir, "tls.key"),
+		RegistryTokenIssuer:  "drycc-builder",
+		RegistryTokenService: "drycc-registry",
+		RegistryTokenTTLSec:  600,
+	}
+	token, err := registryToken(conf, "myapp", "myapp", time.Now())
+	assert.NoErr(t, err)
+	assert.Equal(t, token, "", "token with registry tokens disabled")
+
+	conf.RegistryTokens = true
+	_, err = registryToken(conf, "myapp", "myapp", time.Now())
+	assert.True(t, err != nil, "a token was signed without a key")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoErr(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoErr(t, err)
+	assert.NoErr(t, ioutil.WriteFile(conf.RegistryTokenKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	now := time.Unix(1600000000, 0)
+	token, err = registryToken(conf, "myapp", "myapp", now)
+	assert.NoErr(t, err)
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	assert.NoErr(t, err)
+	var claims registry.TokenClaims
+	assert.NoErr(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, claims.Subject, "alice", "subject")
+	assert.Equal(t, claims.Expiration, now.Add(10*time.Minute).Unix(), "expiration")
+	assert.Equal(t, claims.Access, []registry.TokenAccess{{Type: "repository", Name: "myapp", Actions: []string{"pull", "push"}}}, "access")
+
+	_, err = registryToken(conf, "myapp", "myapp/web", now)
+	assert.NoErr(t, err)
+	for _, repository := range []string{"otherapp", "myapp-other", "other/myapp"} {
+		_, err = registryToken(conf, "myapp", repository, now)
+		assert.True(t, err != nil, "a token was signed for the repository "+repository)
+	}
+}
@@ -0,0 +1,159 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drycc/builder/pkg/k8s"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/pborman/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// releasePhaseProcess is the process type whose command runs once before each release of a
+	// build, e.g. to migrate a database, instead of running as processes of the app.
+	releasePhaseProcess = "release"
+	releasePhaseName    = "drycc-release"
+)
+
+// splitReleasePhase returns the process types of procType without the release phase, which aren't
+// run as processes, and the command of the release phase, "" if there's none.
+func splitReleasePhase(procType dryccAPI.ProcessType) (dryccAPI.ProcessType, string) {
+	command, ok := procType[releasePhaseProcess]
+	if !ok {
+		return procType, ""
+	}
+	processes := make(dryccAPI.ProcessType, len(procType)-1)
+	for name, command := range procType {
+		if name != releasePhaseProcess {
+			processes[name] = command
+		}
+	}
+	return processes, command
+}
+
+// releasePhaseEnv returns the environment of the release phase of a build: the app config, with
+// the defaults that are set along with the release.
+func releasePhaseEnv(appConf dryccAPI.Config, configDefaults map[string]string) map[string]interface{} {
+	env := make(map[string]interface{}, len(appConf.Values)+len(configDefaults))
+	for key, value := range configDefaults {
+		env[key] = value
+	}
+	for key, value := range appConf.Values {
+		env[key] = value
+	}
+	return env
+}
+
+func releasePhasePodName(appName, shortSha string) string {
+	uid := uuid.New()[:8]
+	// pod names cannot exceed 63 characters in length
+	if len(appName) > 37 {
+		appName = appName[:37]
+	}
+	return fmt.Sprintf("release-%s-%s-%s", appName, shortSha, uid)
+}
+
+// releasePhasePod returns the pod running command, the release phase of a build, in namespace,
+// with the app config from the secret envSecretName. Container builds run it in their image,
+// image, with a shell. Slug builds run it in the slugrunner image, image, with the slug at slugKey.
+func releasePhasePod(
+	debug bool,
+	name,
+	namespace,
+	image,
+	slugKey,
+	command,
+	envSecretName,
+	storageType string,
+	pullPolicy corev1.PullPolicy,
+	nodeSelector map[string]string,
+) *corev1.Pod {
+
+	pod := buildPod(debug, name, namespace, pullPolicy, nodeSelector, nil)
+	container := &pod.Spec.Containers[0]
+	container.Name = releasePhaseName
+	container.Image = image
+	container.EnvFrom = []corev1.EnvFromSource{{
+		SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: envSecretName}},
+	}}
+	if slugKey == "" {
+		container.Command = []string{"/bin/sh", "-c", command}
+		return &pod
+	}
+	// the slugrunner runs its arguments once it extracted the slug
+	container.Args = []string{command}
+	addEnvToPod(pod, slugURL, slugKey)
+	addEnvToPod(pod, builderStorage, storageType)
+	return &pod
+}
+
+// releasePodImage returns the image of the pods running a release, its slug key if it's a slug
+// build, and their pull policy. Container builds run in their image, image by digest. Slug builds
+// run in the slugrunner, slugRunner unless it's empty, with their slug at image.
+func releasePodImage(conf *Config, stackName, image, slugRunner string) (string, string, corev1.PullPolicy, error) {
+	if stackName == "container" {
+		return image, "", corev1.PullIfNotPresent, nil
+	}
+	podImage := conf.SlugRunnerImage
+	if slugRunner != "" {
+		podImage = slugRunner
+	}
+	pullPolicy, err := k8s.PullPolicyFromString(conf.SlugBuilderImagePullPolicy)
+	return podImage, image, pullPolicy, err
+}
+
+// runReleasePhase runs the release phase of the build of app at sha, if procType has one, with
+// kubeClient and the app config of appConf and configDefaults, streaming its output to the pusher.
+// Container builds run it in their image, image by digest. Slug builds run it in the slugrunner,
+// slugRunner unless it's empty, with their slug at image. It returns the process types to release,
+// without the release phase, or an error if it failed, so that nothing is released.
+func runReleasePhase(
+	ctx context.Context,
+	conf *Config,
+	kubeClient kubernetes.Interface,
+	appConf dryccAPI.Config,
+	configDefaults map[string]string,
+	procType dryccAPI.ProcessType,
+	app,
+	sha,
+	stackName,
+	image,
+	slugRunner string,
+	recorder *buildRecorder) (dryccAPI.ProcessType, error) {
+
+	processes, command := splitReleasePhase(procType)
+	if command == "" {
+		return processes, nil
+	}
+	nodeSelector, err := buildBuilderPodNodeSelector(conf.BuilderPodNodeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("error build builder pod node selector %s", err)
+	}
+	podImage, slugKey, pullPolicy, err := releasePodImage(conf, stackName, image, slugRunner)
+	if err != nil {
+		return nil, err
+	}
+	envSecret := &buildEnvSecret{
+		secrets:    kubeClient.CoreV1().Secrets(conf.PodNamespace),
+		name:       fmt.Sprintf("%s-release-env", app),
+		env:        releasePhaseEnv(appConf, configDefaults),
+		shortLived: conf.ShortLivedEnvSecrets,
+		recorder:   recorder,
+	}
+	defer envSecret.delete()
+	pod := releasePhasePod(conf.Debug, releasePhasePodName(app, sha), conf.PodNamespace, podImage, slugKey,
+		command, envSecret.name, conf.StorageType, pullPolicy, nodeSelector)
+
+	pusherTerminal.info(msgReleasePhase, command)
+	releasePod, err := runBuilderPod(ctx, conf, kubeClient, pod, envSecret, nil, "the release phase", pusherTerminal.out, recorder)
+	if err != nil {
+		return nil, fmt.Errorf("running the release phase (%s)", err)
+	}
+	if err := buildPodError(releasePod); err != nil {
+		return nil, userError(fmt.Errorf("the release phase failed, nothing was released (%s)", err))
+	}
+	return processes, nil
+}
@@ -0,0 +1,45 @@
+package gitreceive
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSplitReleasePhase(t *testing.T) {
+	processes, command := splitReleasePhase(dryccAPI.ProcessType{"web": "bin/web", "release": "bin/migrate"})
+	assert.Equal(t, processes, dryccAPI.ProcessType{"web": "bin/web"}, "processes")
+	assert.Equal(t, command, "bin/migrate", "release phase")
+	processes, command = splitReleasePhase(dryccAPI.ProcessType{"web": "bin/web"})
+	assert.Equal(t, processes, dryccAPI.ProcessType{"web": "bin/web"}, "processes without a release phase")
+	assert.Equal(t, command, "", "release phase")
+}
+
+func TestReleasePhasePod(t *testing.T) {
+	name := releasePhasePodName(strings.Repeat("a", 50), "12345678")
+	assert.True(t, len(name) <= 63, "pod name too long: "+name)
+
+	pod := releasePhasePod(false, "release", "drycc", "quay.io/org/app@sha256:abc", "", "bin/migrate", "app-release-env", "minio", corev1.PullIfNotPresent, nil)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, container.Image, "quay.io/org/app@sha256:abc", "image of a container build")
+	assert.Equal(t, container.Command, []string{"/bin/sh", "-c", "bin/migrate"}, "command of a container build")
+	assert.Equal(t, container.EnvFrom[0].SecretRef.Name, "app-release-env", "config secret")
+
+	pod = releasePhasePod(false, "release", "drycc", "drycc/slugrunner:canary", "home/app:git-12345678/push/slug.tgz", "bin/migrate", "app-release-env", "minio", corev1.PullAlways, nil)
+	container = pod.Spec.Containers[0]
+	assert.Equal(t, len(container.Command), 0, "command of a slug build")
+	assert.Equal(t, container.Args, []string{"bin/migrate"}, "arguments of a slug build")
+	env := make(map[string]string)
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, env[slugURL], "home/app:git-12345678/push/slug.tgz", "slug")
+}
+
+func TestReleasePhaseEnv(t *testing.T) {
+	env := releasePhaseEnv(dryccAPI.Config{Values: map[string]interface{}{"PORT": "5000", "DATABASE_URL": "postgres://db"}}, map[string]string{"PORT": "8080", "SECRET": "s"})
+	assert.Equal(t, env, map[string]interface{}{"PORT": "5000", "DATABASE_URL": "postgres://db", "SECRET": "s"}, "environment")
+}
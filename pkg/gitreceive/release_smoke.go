@@ -0,0 +1,181 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	drycc "github.com/drycc/controller-sdk-go"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/controller-sdk-go/releases"
+	"github.com/pborman/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	smokeTestName = "drycc-smoke-test"
+	// smokeTestFailedReason is the reason of the warning recorded when a smoke test fails.
+	smokeTestFailedReason = "SmokeTestFailed"
+	// defaultSmokeTestTimeoutSec is how long a smoke test runs at most if its app doesn't say.
+	defaultSmokeTestTimeoutSec = 300
+	maxSmokeTestTimeoutSec     = 3600
+)
+
+// errRollbackUnsupported is returned by rollbackRelease when the controller doesn't let the builder
+// roll apps back.
+var errRollbackUnsupported = errors.New("the controller doesn't let the builder roll back releases")
+
+// smokeTest is a command the drycc.yaml of an app runs in a one-off pod once each of its builds is
+// released, to check that the new release works:
+//
+//	release:
+//	  smoke_test:
+//	    command: curl -fsS http://myapp.myapp.svc.cluster.local/healthz
+//	    image: curlimages/curl  # the image of the release if it's omitted
+//	    timeout: 120            # in seconds
+//	    rollback: false         # failed releases are rolled back by default
+type smokeTest struct {
+	Command    string `yaml:"command"`
+	Image      string `yaml:"image"`
+	TimeoutSec int    `yaml:"timeout"`
+	Rollback   *bool  `yaml:"rollback"`
+}
+
+// readSmokeTest returns the smoke test declared in the drycc.yaml in dirName, nil if there's none.
+func readSmokeTest(dirName string) (*smokeTest, error) {
+	d, err := readDryccYAML(dirName)
+	if err != nil {
+		return nil, err
+	}
+	t := d.Release.SmokeTest
+	if t == nil {
+		return nil, nil
+	}
+	if strings.TrimSpace(t.Command) == "" {
+		return nil, fmt.Errorf("the smoke test in %s has no command", dryccYAMLName)
+	}
+	if t.TimeoutSec < 0 || t.TimeoutSec > maxSmokeTestTimeoutSec {
+		return nil, fmt.Errorf("the timeout of the smoke test in %s must be between 1 and %d seconds", dryccYAMLName, maxSmokeTestTimeoutSec)
+	}
+	return t, nil
+}
+
+func (t *smokeTest) timeout() time.Duration {
+	if t.TimeoutSec == 0 {
+		return defaultSmokeTestTimeoutSec * time.Second
+	}
+	return time.Duration(t.TimeoutSec) * time.Second
+}
+
+// rollback returns true if the release is rolled back when t fails.
+func (t *smokeTest) rollback() bool {
+	return t.Rollback == nil || *t.Rollback
+}
+
+func smokeTestPodName(appName, shortSha string) string {
+	uid := uuid.New()[:8]
+	// pod names cannot exceed 63 characters in length
+	if len(appName) > 39 {
+		appName = appName[:39]
+	}
+	return fmt.Sprintf("smoke-%s-%s-%s", appName, shortSha, uid)
+}
+
+// runSmokeTest runs t, if it's set, against version, the release of the build of app at sha, like
+// its release phase, with DRYCC_APP and DRYCC_RELEASE added to its environment. The pusher sees
+// its output. If it fails, or takes longer than its timeout, the release is rolled back to the
+// previous one, unless t says otherwise, and the push fails.
+func runSmokeTest(
+	ctx context.Context,
+	conf *Config,
+	kubeClient kubernetes.Interface,
+	client *drycc.Client,
+	t *smokeTest,
+	appConf dryccAPI.Config,
+	configDefaults map[string]string,
+	app,
+	sha,
+	stackName,
+	image,
+	slugRunner string,
+	version int,
+	recorder *buildRecorder) error {
+
+	if t == nil {
+		return nil
+	}
+	podImage, slugKey, pullPolicy, err := releasePodImage(conf, stackName, image, slugRunner)
+	if err != nil {
+		return err
+	}
+	if t.Image != "" {
+		podImage, slugKey, pullPolicy = t.Image, "", corev1.PullIfNotPresent
+	}
+	nodeSelector, err := buildBuilderPodNodeSelector(conf.BuilderPodNodeSelector)
+	if err != nil {
+		return fmt.Errorf("error build builder pod node selector %s", err)
+	}
+	env := releasePhaseEnv(appConf, configDefaults)
+	env["DRYCC_APP"] = app
+	env["DRYCC_RELEASE"] = fmt.Sprintf("v%d", version)
+	envSecret := &buildEnvSecret{
+		secrets:    kubeClient.CoreV1().Secrets(conf.PodNamespace),
+		name:       fmt.Sprintf("%s-smoke-env", app),
+		env:        env,
+		shortLived: conf.ShortLivedEnvSecrets,
+		recorder:   recorder,
+	}
+	defer envSecret.delete()
+	pod := releasePhasePod(conf.Debug, smokeTestPodName(app, sha), conf.PodNamespace, podImage, slugKey,
+		t.Command, envSecret.name, conf.StorageType, pullPolicy, nodeSelector)
+	pod.Spec.Containers[0].Name = smokeTestName
+
+	pusherTerminal.info(msgSmokeTest, version, t.Command)
+	testCtx, cancel := context.WithTimeout(ctx, t.timeout())
+	defer cancel()
+	testPod, err := runBuilderPod(testCtx, conf, kubeClient, pod, envSecret, nil, "the smoke test", pusherTerminal.out, recorder)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if testCtx.Err() != nil {
+		err = fmt.Errorf("it took longer than %s", t.timeout())
+	} else if err == nil {
+		err = buildPodError(testPod)
+	}
+	if err == nil {
+		pusherTerminal.info(msgSmokeTestPassed)
+		return nil
+	}
+	recorder.warn(smokeTestFailedReason, "the smoke test of v%d failed: %s", version, err)
+	if !t.rollback() {
+		return userError(fmt.Errorf("the smoke test of v%d failed, it's still released (%s)", version, err))
+	}
+	pusherTerminal.info(msgRollingBack, app, version-1)
+	rolledBack, rollbackErr := rollbackRelease(client, app, version)
+	if rollbackErr != nil {
+		return userError(fmt.Errorf("the smoke test of v%d failed, and it couldn't be rolled back: %s (%s)", version, rollbackErr, err))
+	}
+	return userError(fmt.Errorf("the smoke test of v%d failed, %s was rolled back to v%d as v%d (%s)", version, app, version-1, rolledBack, err))
+}
+
+// rollbackRelease rolls app back from version to the release before it, and returns the release
+// the rollback created. It returns errRollbackUnsupported if the controller doesn't let the builder
+// roll back apps.
+func rollbackRelease(client *drycc.Client, app string, version int) (int, error) {
+	if version < 2 {
+		return 0, fmt.Errorf("v%d is the first release of %s", version, app)
+	}
+	rolledBack, err := releases.Rollback(client, app, version-1)
+	if _, ok := err.(drycc.ErrNotFound); ok {
+		return 0, errRollbackUnsupported
+	}
+	switch err {
+	case nil:
+		return rolledBack, nil
+	case drycc.ErrForbidden, drycc.ErrUnauthorized, drycc.ErrMethodNotAllowed:
+		return 0, errRollbackUnsupported
+	}
+	return 0, err
+}
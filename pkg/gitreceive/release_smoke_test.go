@@ -0,0 +1,80 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+func TestReadSmokeTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smoke-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	smoke, err := readSmokeTest(dir)
+	assert.NoErr(t, err)
+	assert.True(t, smoke == nil, "smoke test without a drycc.yaml")
+
+	write := func(content string) {
+		assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, dryccYAMLName), []byte(content), 0644))
+	}
+	write("release:\n  smoke_test:\n    command: curl -fsS http://web/healthz\n")
+	smoke, err = readSmokeTest(dir)
+	assert.NoErr(t, err)
+	assert.Equal(t, smoke.Command, "curl -fsS http://web/healthz", "command")
+	assert.Equal(t, smoke.timeout(), 5*time.Minute, "default timeout")
+	assert.True(t, smoke.rollback(), "not rolled back by default")
+
+	write("release:\n  smoke_test:\n    command: ./bin/smoke\n    image: curlimages/curl\n    timeout: 60\n    rollback: false\n")
+	smoke, err = readSmokeTest(dir)
+	assert.NoErr(t, err)
+	assert.Equal(t, smoke.Image, "curlimages/curl", "image")
+	assert.Equal(t, smoke.timeout(), time.Minute, "timeout")
+	assert.False(t, smoke.rollback(), "rolled back")
+
+	write("release:\n  smoke_test:\n    image: curlimages/curl\n")
+	_, err = readSmokeTest(dir)
+	assert.Err(t, err, errors.New("the smoke test in drycc.yaml has no command"))
+	write("release:\n  smoke_test:\n    command: ./bin/smoke\n    timeout: 7200\n")
+	_, err = readSmokeTest(dir)
+	assert.True(t, err != nil, "accepted a timeout of 2 hours")
+
+	name := smokeTestPodName("a-very-long-application-name-that-goes-on-and-on", "12345678")
+	assert.True(t, len(name) <= 63, "pod name too long: "+name)
+}
+
+func TestRollbackRelease(t *testing.T) {
+	status := http.StatusCreated
+	var requested map[string]int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/v2/apps/myapp/releases/rollback/", "path")
+		assert.NoErr(t, json.NewDecoder(r.Body).Decode(&requested))
+		w.Header().Set("DRYCC_API_VERSION", drycc.APIVersion)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"version": 6}`)
+	}))
+	defer srv.Close()
+	client, err := drycc.New(true, srv.URL, "")
+	assert.NoErr(t, err)
+
+	version, err := rollbackRelease(client, "myapp", 5)
+	assert.NoErr(t, err)
+	assert.Equal(t, version, 6, "version of the rollback")
+	assert.Equal(t, requested, map[string]int{"version": 4}, "request")
+
+	for _, status = range []int{http.StatusForbidden, http.StatusNotFound} {
+		_, err = rollbackRelease(client, "myapp", 5)
+		assert.Err(t, err, errRollbackUnsupported)
+	}
+	_, err = rollbackRelease(client, "myapp", 1)
+	assert.True(t, err != nil, "rolled back the first release")
+}
@@ -0,0 +1,38 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drycc/builder/pkg/release"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+// trackRelease follows the deploy of version, a release of app the controller deploys in the
+// background, telling the pusher how it goes. It returns an error if the deploy failed. A deploy
+// still running after the release timeout goes on, and the pusher is told how to follow it.
+func trackRelease(ctx context.Context, conf *Config, client *drycc.Client, app string, version int) error {
+	start := time.Now()
+	var status release.Status
+	err := pusherTerminal.during(msgWaitingForDeploy, conf.SessionIdleInterval(), func() (err error) {
+		status, err = release.Track(ctx, client, app, version, conf.ReleasePollInterval(), conf.ReleaseTimeout(), func(s release.Status) {
+			if s.Message != "" {
+				pusherTerminal.info(msgReleaseState, version, s.State, s.Message, elapsed(start))
+			}
+		})
+		return err
+	})
+	switch {
+	case err == release.ErrTrackingTimeout:
+		pusherTerminal.info(msgStillDeploying, version, conf.ReleaseTimeout(), version, app)
+		return nil
+	case err == release.ErrUnknownState:
+		return fmt.Errorf("%s of v%d, check it with `drycc releases:info v%d -a %s`", err, version, version, app)
+	case err != nil:
+		return fmt.Errorf("following the deploy of v%d (%s)", version, err)
+	case status.State == release.StateFailed:
+		return fmt.Errorf("the controller failed to deploy v%d (%s)", version, status.Message)
+	}
+	return nil
+}
@@ -6,12 +6,10 @@ import (
 	"os"
 	"strings"
 
-	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	builderconf "github.com/drycc/builder/pkg/conf"
+	"github.com/drycc/builder/pkg/storage"
 	"github.com/drycc/builder/pkg/sys"
 	"github.com/drycc/pkg/log"
-
-	"github.com/drycc/builder/pkg/k8s"
 )
 
 func readLine(line string) (string, string, string, error) {
@@ -24,19 +22,24 @@ func readLine(line string) (string, string, string, error) {
 
 // Run runs the git-receive hook. This func is effectively the main for the git-receive hook,
 // although it is called from the main in boot.go.
-func Run(conf *Config, fs sys.FS, env sys.Env, storageDriver storagedriver.StorageDriver) error {
+func Run(conf *Config, fs sys.FS, env sys.Env, drivers storage.Drivers) error {
 	log.Debug("Running git hook")
 
-	builderKey, err := builderconf.GetBuilderKey()
+	if _, err := builderconf.GetBuilderKey(); err != nil {
+		return err
+	}
+	b, err := NewBuilder(conf, WithStorage(drivers), WithEnv(env))
 	if err != nil {
 		return err
 	}
 
-	//kubeClient, err := client.NewInCluster()
-	kubeClient, err := k8s.NewInCluster()
+	pushOpts := pushOptionsFromEnv(env)
+	dryRun := pushOpts.Bool(dryRunPushOption)
+	term, err := newTerminal(conf, pushOpts, os.Stdout, os.Stderr)
 	if err != nil {
-		return fmt.Errorf("couldn't reach the api server (%s)", err)
+		return err
 	}
+	term.use()
 
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -51,11 +54,18 @@ func Run(conf *Config, fs sys.FS, env sys.Env, storageDriver storagedriver.Stora
 
 		// if we're processing a receive-pack on an existing repo, run a build
 		if strings.HasPrefix(conf.SSHOriginalCommand, "git-receive-pack") {
-			if err := build(conf, storageDriver, kubeClient, fs, env, builderKey, newRev); err != nil {
+			if err := b.Receive(oldRev, newRev, refName, pushOpts); err != nil {
 				return err
 			}
 		}
 	}
 
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// the hook runs for pushes over any transport, none of which may apply a dry run
+	if dryRun {
+		return errDryRun
+	}
+	return nil
 }
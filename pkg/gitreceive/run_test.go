@@ -2,6 +2,8 @@ package gitreceive
 
 import (
 	"testing"
+
+	"github.com/drycc/builder/pkg/storage"
 )
 
 func TestReadLine(t *testing.T) {
@@ -28,7 +30,7 @@ func TestReadLine(t *testing.T) {
 
 func TestRun(t *testing.T) {
 	// NOTE(bacongobbler): not much we can test at this time other than it fails based on bad setup
-	if err := Run(nil, nil, nil, nil); err == nil {
+	if err := Run(nil, nil, nil, storage.Drivers{}); err == nil {
 		t.Errorf("expected error to be non-nil, got nil")
 	}
 }
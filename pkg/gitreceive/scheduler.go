@@ -0,0 +1,458 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ticketLabel        = "builder.drycc.cc/build-ticket"
+	teamAnnotation     = "builder.drycc.cc/team"
+	weightAnnotation   = "builder.drycc.cc/weight"
+	priorityAnnotation = "builder.drycc.cc/priority"
+
+	// slotsLease is the name of the Lease listing the tickets holding a build slot, in its
+	// runningAnnotation. Builds take a slot by updating it, which fails if another build updated
+	// it since it was read, so two builds never take the last slot.
+	slotsLease        = "drycc-build-slots"
+	runningAnnotation = "builder.drycc.cc/running"
+)
+
+// ticketClient is the subset of a (k8s.io/client-go/kubernetes/typed/coordination/v1).LeaseInterface
+// the build scheduler needs. Each build holds a Lease, its ticket, while it waits and runs.
+type ticketClient interface {
+	Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error)
+	List(ctx context.Context, opts metav1.ListOptions) (*coordinationv1.LeaseList, error)
+	Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// buildTicket is a build waiting for, or holding, one of the build slots.
+type buildTicket struct {
+	name     string
+	team     string
+	weight   int
+	priority int
+	created  time.Time
+	running  bool
+}
+
+// parseIntMap parses config of the form "name:1,other:2".
+func parseIntMap(config string) (map[string]int, error) {
+	m := make(map[string]int)
+	if config == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(config, ",") {
+		kv := strings.Split(pair, ":")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value %q, use name:number pairs separated by commas", config)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in %q (%s)", config, err)
+		}
+		m[strings.TrimSpace(kv[0])] = n
+	}
+	return m, nil
+}
+
+// appPattern maps the apps whose names match pattern (see path.Match) to value.
+type appPattern struct {
+	pattern string
+	value   string
+}
+
+// parseAppPatterns parses config of the form "pattern=value,other-*=value".
+func parseAppPatterns(config string) ([]appPattern, error) {
+	var patterns []appPattern
+	for _, raw := range strings.Split(config, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		eq := strings.Index(raw, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid value %q, use <app pattern>=<name> pairs separated by commas", raw)
+		}
+		p := appPattern{pattern: strings.TrimSpace(raw[:eq]), value: strings.TrimSpace(raw[eq+1:])}
+		if _, err := path.Match(p.pattern, ""); err != nil || p.pattern == "" || p.value == "" {
+			return nil, fmt.Errorf("invalid app pattern %q", raw)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchApp returns the value of the first pattern app matches, or "".
+func matchApp(patterns []appPattern, app string) string {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p.pattern, app); ok {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// newBuildTicket returns the ticket of a build of app. Its team and priority class are those the
+// operator mapped app to, and its team defaults to the user that pushed.
+func newBuildTicket(conf *Config, app, shortSha string, now time.Time) (buildTicket, error) {
+	teams, err := parseAppPatterns(conf.BuildAppTeams)
+	if err != nil {
+		return buildTicket{}, fmt.Errorf("reading build app teams (%s)", err)
+	}
+	classes, err := parseAppPatterns(conf.BuildAppPriorities)
+	if err != nil {
+		return buildTicket{}, fmt.Errorf("reading build app priorities (%s)", err)
+	}
+	weights, err := parseIntMap(conf.BuildTeamWeights)
+	if err != nil {
+		return buildTicket{}, fmt.Errorf("reading build team weights (%s)", err)
+	}
+	priorities, err := parseIntMap(conf.BuildPriorityClasses)
+	if err != nil {
+		return buildTicket{}, fmt.Errorf("reading build priority classes (%s)", err)
+	}
+	t := buildTicket{
+		name:    fmt.Sprintf("drycc-build-%s-%s-%s", app, shortSha, uuid.New()[:8]),
+		team:    matchApp(teams, app),
+		weight:  1,
+		created: now,
+	}
+	if t.team == "" {
+		t.team = conf.Username
+	}
+	if w, ok := weights[t.team]; ok && w > 0 {
+		t.weight = w
+	}
+	if class := matchApp(classes, app); class != "" {
+		priority, ok := priorities[class]
+		if !ok {
+			log.Info("WARNING: unknown build priority class %s, using the default priority", class)
+		}
+		t.priority = priority
+	}
+	return t, nil
+}
+
+func (t buildTicket) lease(ttl time.Duration, now time.Time) *coordinationv1.Lease {
+	created := metav1.NewMicroTime(t.created)
+	renewed := metav1.NewMicroTime(now)
+	seconds := int32(ttl / time.Second)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   t.name,
+			Labels: map[string]string{"heritage": "drycc", ticketLabel: "true"},
+			Annotations: map[string]string{
+				teamAnnotation:     t.team,
+				weightAnnotation:   strconv.Itoa(t.weight),
+				priorityAnnotation: strconv.Itoa(t.priority),
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			AcquireTime:          &created,
+			RenewTime:            &renewed,
+			LeaseDurationSeconds: &seconds,
+		},
+	}
+}
+
+// ticketFromLease returns the ticket held by lease, and false if lease expired. Whether it runs is
+// recorded in the slots Lease instead.
+func ticketFromLease(lease coordinationv1.Lease, now time.Time) (buildTicket, bool) {
+	spec := lease.Spec
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil || spec.AcquireTime == nil {
+		return buildTicket{}, false
+	}
+	if now.After(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)) {
+		return buildTicket{}, false
+	}
+	t := buildTicket{
+		name:    lease.Name,
+		team:    lease.Annotations[teamAnnotation],
+		created: spec.AcquireTime.Time,
+	}
+	t.weight, _ = strconv.Atoi(lease.Annotations[weightAnnotation])
+	if t.weight <= 0 {
+		t.weight = 1
+	}
+	t.priority, _ = strconv.Atoi(lease.Annotations[priorityAnnotation])
+	return t, true
+}
+
+// queue returns the tickets waiting for a build slot in the order they get one: higher priorities
+// first, then the teams using the fewest slots for their weight, then the oldest tickets. Every
+// build is ordered as if the builds before it were already running, so that teams share slots in
+// proportion to their weights.
+func queue(tickets []buildTicket) []buildTicket {
+	load := make(map[string]float64)
+	var waiting []buildTicket
+	for _, t := range tickets {
+		if t.running {
+			load[t.team] += 1 / float64(t.weight)
+		} else {
+			waiting = append(waiting, t)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool {
+		if !waiting[i].created.Equal(waiting[j].created) {
+			return waiting[i].created.Before(waiting[j].created)
+		}
+		return waiting[i].name < waiting[j].name
+	})
+	ordered := make([]buildTicket, 0, len(waiting))
+	for len(waiting) > 0 {
+		best := 0
+		for i, t := range waiting[1:] {
+			b := waiting[best]
+			switch {
+			case t.priority != b.priority:
+				if t.priority > b.priority {
+					best = i + 1
+				}
+			case load[t.team] < load[b.team]:
+				best = i + 1
+			}
+		}
+		next := waiting[best]
+		ordered = append(ordered, next)
+		load[next.team] += 1 / float64(next.weight)
+		waiting = append(waiting[:best], waiting[best+1:]...)
+	}
+	return ordered
+}
+
+// position returns the number of builds ahead of the ticket named name in the queue, and whether
+// it may start, given max concurrent builds.
+func position(tickets []buildTicket, name string, max int) (int, bool) {
+	running := 0
+	for _, t := range tickets {
+		if t.running {
+			running++
+		}
+	}
+	for i, t := range queue(tickets) {
+		if t.name == name {
+			return i, i < max-running
+		}
+	}
+	return 0, running < max
+}
+
+// waitForBuildSlot blocks until the build of app may start, if conf limits the number of builds
+// running at once, or ctx is done. The returned func must be called once the build ended.
+func waitForBuildSlot(ctx context.Context, conf *Config, tickets ticketClient, app, shortSha string) (func(), error) {
+	if conf.MaxConcurrentBuilds <= 0 {
+		return func() {}, nil
+	}
+	t, err := newBuildTicket(conf, app, shortSha, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s := &buildScheduler{
+		tickets: tickets,
+		max:     conf.MaxConcurrentBuilds,
+		poll:    conf.BuildQueuePollInterval(),
+		ttl:     conf.BuildTicketTTL(),
+		now:     time.Now,
+	}
+	return s.wait(ctx, t)
+}
+
+// buildScheduler limits the number of builds running at once across all builders.
+type buildScheduler struct {
+	tickets ticketClient
+	max     int
+	poll    time.Duration
+	ttl     time.Duration
+	// now is only replaced in tests.
+	now func() time.Time
+}
+
+// slots returns the Lease listing the tickets holding a build slot, creating it if there's none.
+func (s *buildScheduler) slots(ctx context.Context) (*coordinationv1.Lease, error) {
+	lease, err := s.tickets.Get(ctx, slotsLease, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return lease, err
+	}
+	lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{
+		Name:   slotsLease,
+		Labels: map[string]string{"heritage": "drycc"},
+	}}
+	created, err := s.tickets.Create(ctx, lease, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return s.tickets.Get(ctx, slotsLease, metav1.GetOptions{})
+	}
+	return created, err
+}
+
+// list returns the tickets that didn't expire, those slots lists as running.
+func (s *buildScheduler) list(ctx context.Context, slots *coordinationv1.Lease) ([]buildTicket, error) {
+	leases, err := s.tickets.List(ctx, metav1.ListOptions{LabelSelector: ticketLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool)
+	for _, name := range strings.Split(slots.Annotations[runningAnnotation], ",") {
+		running[name] = true
+	}
+	var tickets []buildTicket
+	for _, lease := range leases.Items {
+		if t, ok := ticketFromLease(lease, s.now()); ok {
+			t.running = running[t.name]
+			tickets = append(tickets, t)
+		} else {
+			// the build holding it went away, any builder may clean it up
+			s.tickets.Delete(ctx, lease.Name, metav1.DeleteOptions{})
+		}
+	}
+	return tickets, nil
+}
+
+// setRunning updates slots to list the running tickets, with name added or removed. Tickets that
+// expired are left out, so their slots are freed. The update fails with a conflict if slots
+// changed since it was read.
+func (s *buildScheduler) setRunning(ctx context.Context, slots *coordinationv1.Lease, tickets []buildTicket, name string, running bool) error {
+	var names []string
+	for _, t := range tickets {
+		if t.running && t.name != name {
+			names = append(names, t.name)
+		}
+	}
+	if running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slots = slots.DeepCopy()
+	if slots.Annotations == nil {
+		slots.Annotations = make(map[string]string)
+	}
+	slots.Annotations[runningAnnotation] = strings.Join(names, ",")
+	_, err := s.tickets.Update(ctx, slots, metav1.UpdateOptions{})
+	return err
+}
+
+// renew updates the lease of t, so that other builds know it's still waiting or running.
+func (s *buildScheduler) renew(ctx context.Context, t buildTicket) error {
+	_, err := s.tickets.Update(ctx, t.lease(s.ttl, s.now()), metav1.UpdateOptions{})
+	return err
+}
+
+// take checks the position of t in the queue and, if it may start, takes a slot for it, in one
+// update of the slots Lease guarded by the version it was read at. It returns the position of t
+// and whether it got a slot, and tries again if another build took or gave back a slot meanwhile.
+func (s *buildScheduler) take(ctx context.Context, t buildTicket) (int, bool, error) {
+	for {
+		slots, err := s.slots(ctx)
+		if err != nil {
+			return 0, false, err
+		}
+		// the slots are read first: a ticket is created before it's listed as running
+		tickets, err := s.list(ctx, slots)
+		if err != nil {
+			return 0, false, err
+		}
+		pos, start := position(tickets, t.name, s.max)
+		if !start {
+			return pos, false, nil
+		}
+		err = s.setRunning(ctx, slots, tickets, t.name, true)
+		if err == nil {
+			return pos, true, nil
+		} else if !apierrors.IsConflict(err) {
+			return 0, false, err
+		}
+	}
+}
+
+// giveBack removes t from the running tickets, even if ctx is done.
+func (s *buildScheduler) giveBack(t buildTicket) error {
+	ctx := context.Background()
+	for {
+		slots, err := s.slots(ctx)
+		if err != nil {
+			return err
+		}
+		tickets, err := s.list(ctx, slots)
+		if err != nil {
+			return err
+		}
+		err = s.setRunning(ctx, slots, tickets, t.name, false)
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+	}
+}
+
+// wait blocks until t gets a build slot or ctx is done, reporting its position in the queue while
+// it waits. The returned func gives the slot back and must be called once the build ended.
+func (s *buildScheduler) wait(ctx context.Context, t buildTicket) (func(), error) {
+	if _, err := s.tickets.Create(ctx, t.lease(s.ttl, s.now()), metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("queueing the build (%s)", err)
+	}
+	release := func() {
+		// deleting the ticket gives its slot back to the next update of the slots anyway
+		if err := s.tickets.Delete(context.Background(), t.name, metav1.DeleteOptions{}); err != nil {
+			log.Debug("unable to delete build ticket %s (%s)", t.name, err)
+		}
+	}
+	reported := -1
+	for {
+		pos, start, err := s.take(ctx, t)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("taking a build slot (%s)", err)
+		}
+		if start {
+			break
+		}
+		if pos != reported {
+			log.Info("Waiting for a build slot, %d build(s) ahead of this one", pos)
+			reported = pos
+		}
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case <-time.After(s.poll):
+		}
+		if err := s.renew(ctx, t); err != nil {
+			log.Debug("unable to renew build ticket %s (%s)", t.name, err)
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := s.renew(ctx, t); err != nil {
+					log.Debug("unable to renew build ticket %s (%s)", t.name, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		if err := s.giveBack(t); err != nil {
+			log.Debug("unable to give back the build slot of %s (%s)", t.name, err)
+		}
+		release()
+	}, nil
+}
@@ -0,0 +1,293 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeTicketClient is a ticketClient that keeps Leases in memory, and rejects updates of Leases
+// that changed since they were read, like the API server.
+type fakeTicketClient struct {
+	mutex   sync.Mutex
+	leases  map[string]coordinationv1.Lease
+	version int
+}
+
+func newFakeTicketClient() *fakeTicketClient {
+	return &fakeTicketClient{leases: make(map[string]coordinationv1.Lease)}
+}
+
+var leaseResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+func (f *fakeTicketClient) put(lease *coordinationv1.Lease) *coordinationv1.Lease {
+	f.version++
+	stored := lease.DeepCopy()
+	stored.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = *stored
+	return stored.DeepCopy()
+}
+
+func (f *fakeTicketClient) Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.leases[lease.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(leaseResource, lease.Name)
+	}
+	return f.put(lease), nil
+}
+
+func (f *fakeTicketClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lease, ok := f.leases[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (f *fakeTicketClient) List(ctx context.Context, opts metav1.ListOptions) (*coordinationv1.LeaseList, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := &coordinationv1.LeaseList{}
+	for _, lease := range f.leases {
+		if lease.Labels[ticketLabel] == "true" {
+			list.Items = append(list.Items, *lease.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeTicketClient) Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	current, ok := f.leases[lease.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, lease.Name)
+	}
+	if lease.ResourceVersion != "" && lease.ResourceVersion != current.ResourceVersion {
+		return nil, apierrors.NewConflict(leaseResource, lease.Name, errors.New("the object has been modified"))
+	}
+	return f.put(lease), nil
+}
+
+func (f *fakeTicketClient) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.leases, name)
+	return nil
+}
+
+// running returns the number of tickets holding a slot.
+func (f *fakeTicketClient) running() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := 0
+	for _, name := range strings.Split(f.leases[slotsLease].Annotations[runningAnnotation], ",") {
+		if name != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// tickets returns the number of tickets.
+func (f *fakeTicketClient) tickets() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := 0
+	for _, lease := range f.leases {
+		if lease.Labels[ticketLabel] == "true" {
+			n++
+		}
+	}
+	return n
+}
+
+func names(tickets []buildTicket) []string {
+	var n []string
+	for _, t := range tickets {
+		n = append(n, t.name)
+	}
+	return n
+}
+
+func TestParseIntMap(t *testing.T) {
+	m, err := parseIntMap("production:100, staging:50")
+	assert.NoErr(t, err)
+	assert.Equal(t, m, map[string]int{"production": 100, "staging": 50}, "map")
+	m, err = parseIntMap("")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(m), 0, "map length")
+	_, err = parseIntMap("production")
+	assert.True(t, err != nil, "parsed a name without a number")
+	_, err = parseIntMap("production:high")
+	assert.True(t, err != nil, "parsed a name with an invalid number")
+}
+
+func TestParseAppPatterns(t *testing.T) {
+	patterns, err := parseAppPatterns("payments-*=payments, *-prod=production")
+	assert.NoErr(t, err)
+	assert.Equal(t, matchApp(patterns, "payments-api"), "payments", "first match")
+	assert.Equal(t, matchApp(patterns, "web-prod"), "production", "second match")
+	assert.Equal(t, matchApp(patterns, "web"), "", "no match")
+	_, err = parseAppPatterns("payments")
+	assert.True(t, err != nil, "parsed a pattern without a name")
+	_, err = parseAppPatterns("[=payments")
+	assert.True(t, err != nil, "parsed an invalid pattern")
+}
+
+func TestNewBuildTicket(t *testing.T) {
+	conf := &Config{
+		Username:             "alice",
+		BuildTeamWeights:     "web:3",
+		BuildPriorityClasses: "production:100",
+		BuildAppTeams:        "web-*=web",
+		BuildAppPriorities:   "*-prod=production",
+	}
+	ticket, err := newBuildTicket(conf, "app", "abc1234", time.Now())
+	assert.NoErr(t, err)
+	assert.Equal(t, ticket.team, "alice", "default team")
+	assert.Equal(t, ticket.weight, 1, "default weight")
+	assert.Equal(t, ticket.priority, 0, "default priority")
+
+	ticket, err = newBuildTicket(conf, "web-prod", "abc1234", time.Now())
+	assert.NoErr(t, err)
+	assert.Equal(t, ticket.team, "web", "team")
+	assert.Equal(t, ticket.weight, 3, "weight")
+	assert.Equal(t, ticket.priority, 100, "priority")
+
+	conf.BuildTeamWeights = "web"
+	_, err = newBuildTicket(conf, "web-prod", "abc1234", time.Now())
+	assert.True(t, err != nil, "created a ticket with invalid team weights")
+	conf.BuildTeamWeights, conf.BuildAppTeams = "", "web-*"
+	_, err = newBuildTicket(conf, "web-prod", "abc1234", time.Now())
+	assert.True(t, err != nil, "created a ticket with invalid app teams")
+}
+
+func TestTicketFromLease(t *testing.T) {
+	now := time.Now()
+	ticket := buildTicket{name: "t1", team: "web", weight: 2, priority: 10, created: now}
+	got, ok := ticketFromLease(*ticket.lease(time.Minute, now), now)
+	assert.True(t, ok, "ticket expired")
+	assert.True(t, got.created.Equal(now), "created time")
+	got.created = now
+	assert.Equal(t, got, ticket, "ticket")
+	_, ok = ticketFromLease(*ticket.lease(time.Minute, now), now.Add(2*time.Minute))
+	assert.False(t, ok, "ticket didn't expire")
+}
+
+func TestQueue(t *testing.T) {
+	now := time.Now()
+	tickets := []buildTicket{
+		{name: "a-running", team: "a", weight: 1, created: now, running: true},
+		{name: "a1", team: "a", weight: 1, created: now.Add(1 * time.Second)},
+		{name: "a2", team: "a", weight: 1, created: now.Add(2 * time.Second)},
+		{name: "b1", team: "b", weight: 1, created: now.Add(3 * time.Second)},
+		{name: "b2", team: "b", weight: 1, created: now.Add(4 * time.Second)},
+		{name: "c1", team: "c", weight: 1, priority: 100, created: now.Add(5 * time.Second)},
+	}
+	// production first, then teams take turns
+	assert.Equal(t, names(queue(tickets)), []string{"c1", "b1", "a1", "b2", "a2"}, "queue")
+
+	// a team with twice the weight gets twice the slots
+	tickets[0].weight, tickets[1].weight, tickets[2].weight = 2, 2, 2
+	assert.Equal(t, names(queue(tickets)), []string{"c1", "b1", "a1", "a2", "b2"}, "weighted queue")
+
+	pos, start := position(tickets, "b1", 3)
+	assert.Equal(t, pos, 1, "position")
+	assert.True(t, start, "second in the queue with two free slots didn't start")
+	pos, start = position(tickets, "a1", 3)
+	assert.Equal(t, pos, 2, "position")
+	assert.False(t, start, "third in the queue with two free slots started")
+}
+
+func TestBuildSchedulerWait(t *testing.T) {
+	tickets := newFakeTicketClient()
+	s := &buildScheduler{tickets: tickets, max: 1, poll: 10 * time.Millisecond, ttl: time.Minute, now: time.Now}
+	release1, err := s.wait(context.Background(), buildTicket{name: "t1", team: "a", weight: 1, created: time.Now()})
+	assert.NoErr(t, err)
+	assert.Equal(t, tickets.running(), 1, "running builds")
+
+	started := make(chan func())
+	go func() {
+		release2, err := s.wait(context.Background(), buildTicket{name: "t2", team: "b", weight: 1, created: time.Now()})
+		assert.NoErr(t, err)
+		started <- release2
+	}()
+	select {
+	case <-started:
+		t.Fatal("second build started while the only slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release1()
+	select {
+	case release2 := <-started:
+		assert.Equal(t, tickets.running(), 1, "running builds")
+		release2()
+	case <-time.After(time.Second):
+		t.Fatal("second build didn't start once the slot was released")
+	}
+	assert.Equal(t, tickets.tickets(), 0, "tickets left behind")
+	assert.Equal(t, tickets.running(), 0, "slots left taken")
+}
+
+func TestBuildSchedulerWaitCanceled(t *testing.T) {
+	tickets := newFakeTicketClient()
+	s := &buildScheduler{tickets: tickets, max: 1, poll: 10 * time.Millisecond, ttl: time.Minute, now: time.Now}
+	release, err := s.wait(context.Background(), buildTicket{name: "t1", team: "a", weight: 1, created: time.Now()})
+	assert.NoErr(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = s.wait(ctx, buildTicket{name: "t2", team: "b", weight: 1, created: time.Now()})
+	assert.Err(t, err, context.DeadlineExceeded)
+	assert.Equal(t, tickets.tickets(), 1, "tickets left behind by the canceled build")
+}
+
+func TestBuildSchedulerWaitRace(t *testing.T) {
+	tickets := newFakeTicketClient()
+	s := &buildScheduler{tickets: tickets, max: 1, poll: 10 * time.Millisecond, ttl: time.Minute, now: time.Now}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// builds queued at once all see a free slot, only one of them takes it
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	started := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.wait(ctx, buildTicket{name: fmt.Sprintf("t%d", i), team: "a", weight: 1, created: time.Now()})
+			if err == nil {
+				mutex.Lock()
+				started++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, started, 1, "started builds")
+	assert.Equal(t, tickets.running(), 1, "running builds")
+}
+
+func TestWaitForBuildSlotUnlimited(t *testing.T) {
+	release, err := waitForBuildSlot(context.Background(), &Config{}, nil, "app", "abc1234")
+	assert.NoErr(t, err)
+	release()
+}
@@ -0,0 +1,108 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/pkg/log"
+)
+
+// selfTestDockerfile is the sample app the self-test builds, a web server listening on the port it
+// exposes.
+const selfTestDockerfile = `FROM busybox
+EXPOSE 8080
+CMD ["httpd", "-f", "-p", "8080"]
+`
+
+// selfTestNotifier prints the phases of the self-test build, and keeps how it ended.
+type selfTestNotifier struct {
+	released string
+	deferred bool
+}
+
+func (n *selfTestNotifier) Phase(app, sha, phase, message string) {
+	log.Info("self-test: %s (%s)", phase, message)
+	switch phase {
+	case buildPhaseReleased:
+		n.released = message
+	case buildPhaseDeferred:
+		n.deferred = true
+	}
+}
+
+func (n *selfTestNotifier) Warning(app, sha, reason, message string) {
+	log.Info("self-test: WARNING %s (%s)", reason, message)
+}
+
+// SelfTest pushes a sample app to app as user, builds it with the storages of drivers and the
+// cluster and controller of conf, and checks that it's released, for a new or upgraded builder to
+// be checked end to end. The repository and the source of the build are deleted once it ended,
+// the release of app is kept. It returns the message of the release.
+func SelfTest(conf *Config, drivers storage.Drivers, app, user string) (string, error) {
+	gitHome, err := ioutil.TempDir("", "self-test")
+	if err != nil {
+		return "", fmt.Errorf("creating the directory of the repository (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	sha, err := selfTestRepo(gitHome, app+".git")
+	if err != nil {
+		return "", err
+	}
+
+	testConf := *conf
+	testConf.GitHome, testConf.Repository, testConf.Username = gitHome, app+".git", user
+	notifier := new(selfTestNotifier)
+	b, err := NewBuilder(&testConf, WithStorage(drivers), WithNotifier(notifier))
+	if err != nil {
+		return "", err
+	}
+	err = b.Receive(zeroRev, sha.Full(), "refs/heads/master", PushOptions{})
+	info := NewShardedSlugBuilderInfo(app, sha.Short(), true, conf.StorageKeyShardLength)
+	if delErr := drivers.Artifacts.Delete(context.Background(), info.TarKey()); delErr != nil {
+		log.Debug("unable to delete the source of the self-test build %s (%s)", info.TarKey(), delErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("the self-test build failed (%s)", err)
+	}
+	if notifier.deferred {
+		return "", fmt.Errorf("the self-test build succeeded, but the controller is unavailable to release it")
+	}
+	if notifier.released == "" {
+		return "", fmt.Errorf("the self-test build wasn't released")
+	}
+	return notifier.released, nil
+}
+
+// selfTestRepo creates the bare repository name in gitHome, with a commit of the sample app, and
+// returns the sha of the commit.
+func selfTestRepo(gitHome, name string) (*git.SHA, error) {
+	work := filepath.Join(gitHome, "work")
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return nil, fmt.Errorf("creating the sample app (%s)", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(work, "Dockerfile"), []byte(selfTestDockerfile), 0644); err != nil {
+		return nil, fmt.Errorf("creating the sample app (%s)", err)
+	}
+	cmds := [][]string{
+		{"git", "init", "-q"},
+		{"git", "add", "Dockerfile"},
+		{"git", "-c", "user.name=drycc-builder", "-c", "user.email=builder@drycc.cc", "commit", "-q", "-m", "Self-test"},
+		{"git", "clone", "-q", "--bare", work, filepath.Join(gitHome, name)},
+	}
+	for _, args := range cmds {
+		if out, err := repoCmd(work, args[0], args[1:]...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("committing the sample app with %s (%s: %s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	out, err := repoCmd(work, "git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading the commit of the sample app (%s)", err)
+	}
+	return git.NewSha(strings.TrimSpace(string(out)))
+}
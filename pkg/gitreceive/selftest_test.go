@@ -0,0 +1,33 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestSelfTestRepo(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "self-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(gitHome)
+
+	sha, err := selfTestRepo(gitHome, "app.git")
+	assert.NoErr(t, err)
+	out, err := repoCmd(filepath.Join(gitHome, "app.git"), "git", "show", sha.Full()+":Dockerfile").Output()
+	assert.NoErr(t, err)
+	assert.Equal(t, string(out), selfTestDockerfile, "Dockerfile of the sample app")
+}
+
+func TestSelfTestNotifier(t *testing.T) {
+	n := new(selfTestNotifier)
+	n.Phase("app", "12345678", buildPhaseStarted, "admin pushed refs/heads/master")
+	assert.Equal(t, n.released, "", "release of a started build")
+	n.Phase("app", "12345678", buildPhaseReleased, "released v3")
+	assert.Equal(t, n.released, "released v3", "release")
+	assert.False(t, n.deferred, "deferred")
+	n.Phase("app", "12345678", buildPhaseDeferred, "the controller is unavailable")
+	assert.True(t, n.deferred, "deferred")
+}
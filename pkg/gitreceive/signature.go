@@ -0,0 +1,212 @@
+package gitreceive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// signedPushesKey is the app config key making the app's pushes signed, "warn" or "require".
+	// Apps can make the policy of the builder stricter, not looser.
+	signedPushesKey = "DRYCC_SIGNED_PUSHES"
+	// allowedSignersKey is the app config key listing the fingerprints of the keys that may sign its
+	// pushes, comma separated, among the keys the builder trusts.
+	allowedSignersKey = "DRYCC_ALLOWED_SIGNERS"
+	// unsignedPushReason is the reason of the event recorded when a push isn't signed by an allowed
+	// key.
+	unsignedPushReason = "UnsignedPush"
+
+	signedPushesOff     = "off"
+	signedPushesWarn    = "warn"
+	signedPushesRequire = "require"
+)
+
+// signatureResult is the result of the verification of the signature of a pushed commit or tag.
+type signatureResult struct {
+	// Object is the commit or tag whose signature was verified.
+	Object string `json:"object"`
+	// Format is gpg or ssh, if the object is signed.
+	Format      string `json:"format,omitempty"`
+	Signer      string `json:"signer,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Verified    bool   `json:"verified"`
+	// Error is why the signature isn't verified.
+	Error string `json:"error,omitempty"`
+}
+
+// signedPushesPolicy returns the strictest of the signed push policies of the builder and the app.
+func signedPushesPolicy(conf *Config, appConf dryccAPI.Config) (string, error) {
+	rank := map[string]int{signedPushesOff: 0, "": 0, signedPushesWarn: 1, signedPushesRequire: 2}
+	policy := strings.TrimSpace(conf.SignedPushes)
+	if _, ok := rank[policy]; !ok {
+		return "", fmt.Errorf("invalid signed pushes policy %q, use off, warn or require", conf.SignedPushes)
+	}
+	appPolicy := configString(appConf, signedPushesKey)
+	if _, ok := rank[appPolicy]; !ok {
+		return "", fmt.Errorf("invalid %s %q, use warn or require", signedPushesKey, appPolicy)
+	}
+	if rank[appPolicy] > rank[policy] {
+		policy = appPolicy
+	}
+	if policy == "" {
+		policy = signedPushesOff
+	}
+	return policy, nil
+}
+
+// parseVerifyOutput returns the signer of object in the output of git verify-commit --raw or git
+// verify-tag --raw, which is verified if git succeeded and the signer could be read from it.
+func parseVerifyOutput(object string, out []byte, verifyErr error) *signatureResult {
+	result := &signatureResult{Object: object}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lines = append(lines, line)
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "[GNUPG:] GOODSIG ") && len(fields) > 3:
+			result.Format = "gpg"
+			result.Signer = strings.Join(fields[3:], " ")
+		case strings.HasPrefix(line, "[GNUPG:] VALIDSIG ") && len(fields) > 2:
+			result.Format = "gpg"
+			// the fingerprint of the primary key, which signed with the subkey of the first field
+			result.Fingerprint = fields[len(fields)-1]
+		case strings.HasPrefix(line, `Good "git" signature`):
+			result.Format = "ssh"
+			if i := strings.Index(line, " signature for "); i >= 0 {
+				rest := line[i+len(" signature for "):]
+				if j := strings.Index(rest, " with "); j >= 0 {
+					result.Signer = rest[:j]
+				}
+			}
+			if len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "SHA256:") {
+				result.Fingerprint = fields[len(fields)-1]
+			}
+		}
+	}
+	switch {
+	case verifyErr != nil:
+		result.Error = "the signature can't be verified with a trusted key"
+		if len(lines) > 0 && !strings.HasPrefix(lines[len(lines)-1], "[GNUPG:]") {
+			result.Error = lines[len(lines)-1]
+		}
+		if len(lines) == 0 {
+			result.Error = "not signed"
+		}
+	case result.Signer == "" || result.Fingerprint == "":
+		result.Error = "the signer can't be identified"
+	default:
+		result.Verified = true
+	}
+	return result
+}
+
+// verifySignature verifies the signature of the commit or tag rev of the repo at repoDir with the
+// GPG keys and SSH allowed signers the builder trusts.
+func verifySignature(conf *Config, repoDir, rev string) (*signatureResult, error) {
+	out, err := repoCmd(repoDir, "git", "cat-file", "-t", rev).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading the type of %s (%s)", rev, err)
+	}
+	verify := "verify-commit"
+	if strings.TrimSpace(string(out)) == "tag" {
+		verify = "verify-tag"
+	}
+
+	// the GPG keys are imported in a keyring of their own, so that no other key is trusted
+	gnupgHome, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		return nil, fmt.Errorf("creating the GPG keyring (%s)", err)
+	}
+	defer os.RemoveAll(gnupgHome)
+	if _, err := os.Stat(conf.TrustedGPGKeysPath); err == nil {
+		imp := repoCmd(repoDir, "gpg", "--batch", "--quiet", "--homedir", gnupgHome, "--import", conf.TrustedGPGKeysPath)
+		if out, err := imp.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("importing the trusted GPG keys of %s (%s: %s)", conf.TrustedGPGKeysPath, err, strings.TrimSpace(string(out)))
+		}
+	}
+	args := []string{"git"}
+	if _, err := os.Stat(conf.AllowedSSHSignersPath); err == nil {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+conf.AllowedSSHSignersPath)
+	}
+	cmd := repoCmd(repoDir, args[0], append(args[1:], verify, "--raw", rev)...)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+gnupgHome)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = run(cmd)
+	return parseVerifyOutput(rev, stderr.Bytes(), err), nil
+}
+
+// signedRev returns the pushed object whose signature is checked for the build of commit: the
+// annotated tag pushed, or commit.
+func signedRev(recorder *buildRecorder, commit string) string {
+	if strings.HasPrefix(recorder.ref(), "refs/tags/") && recorder.audit.NewRev != zeroRev {
+		return recorder.audit.NewRev
+	}
+	return commit
+}
+
+// checkSignature checks that rev is signed by a key the builder trusts, and that the app allows if
+// it lists the keys allowed to sign its pushes, as the signed pushes policy requires. The result is
+// recorded in the audit record of the push. Pushes that aren't signed fail with the require
+// policy, and are warned about with the warn policy.
+func checkSignature(conf *Config, repoDir, rev string, appConf dryccAPI.Config, recorder *buildRecorder) error {
+	policy, err := signedPushesPolicy(conf, appConf)
+	if err != nil {
+		return err
+	}
+	if policy == signedPushesOff {
+		return nil
+	}
+	result, err := verifySignature(conf, repoDir, rev)
+	if err != nil {
+		return err
+	}
+	if allowed := configString(appConf, allowedSignersKey); result.Verified && allowed != "" && !allowsSigner(allowed, result.Fingerprint) {
+		result.Verified = false
+		result.Error = fmt.Sprintf("the key %s of %s isn't allowed to sign the pushes of the app", result.Fingerprint, result.Signer)
+	}
+	if recorder != nil && recorder.audit != nil {
+		recorder.audit.Signature = result
+	}
+	if result.Verified {
+		pusherTerminal.info(msgSignedBy, result.Signer, result.Format, result.Fingerprint)
+		return nil
+	}
+	if policy == signedPushesRequire {
+		return policyError(fmt.Errorf("pushes must be signed by a trusted key, %s isn't (%s)", rev, result.Error))
+	}
+	log.Info("WARNING: the push isn't signed by a trusted key (%s)", result.Error)
+	recorder.warn(unsignedPushReason, "%s isn't signed by a trusted key (%s)", rev, result.Error)
+	return nil
+}
+
+// allowsSigner reports whether fingerprint is one of the comma separated fingerprints of allowed.
+// GPG fingerprints are compared ignoring case and spaces, and may be given as long key IDs.
+func allowsSigner(allowed, fingerprint string) bool {
+	normalize := func(s string) string {
+		if strings.HasPrefix(s, "SHA256:") {
+			return s
+		}
+		return strings.ToUpper(strings.Replace(s, " ", "", -1))
+	}
+	fingerprint = normalize(fingerprint)
+	for _, a := range strings.Split(allowed, ",") {
+		a = normalize(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+		if a == fingerprint || (!strings.HasPrefix(a, "SHA256:") && len(a) >= 16 && strings.HasSuffix(fingerprint, a)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package gitreceive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestSignedPushesPolicy(t *testing.T) {
+	appConf := func(policy string) dryccAPI.Config {
+		return dryccAPI.Config{Values: map[string]interface{}{signedPushesKey: policy}}
+	}
+	policy, err := signedPushesPolicy(&Config{SignedPushes: "off"}, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, policy, signedPushesOff, "policy")
+	policy, err = signedPushesPolicy(&Config{SignedPushes: "off"}, appConf("require"))
+	assert.NoErr(t, err)
+	assert.Equal(t, policy, signedPushesRequire, "policy of the app")
+	policy, err = signedPushesPolicy(&Config{SignedPushes: "require"}, appConf("warn"))
+	assert.NoErr(t, err)
+	assert.Equal(t, policy, signedPushesRequire, "policy loosened by the app")
+	_, err = signedPushesPolicy(&Config{SignedPushes: "always"}, dryccAPI.Config{})
+	assert.True(t, err != nil, "accepted an invalid policy")
+	_, err = signedPushesPolicy(&Config{}, appConf("always"))
+	assert.True(t, err != nil, "accepted an invalid app policy")
+}
+
+func TestParseVerifyOutput(t *testing.T) {
+	gpg := []byte(`[GNUPG:] NEWSIG me@example.com
+[GNUPG:] KEY_CONSIDERED 8ED2C71D5C2D4DF161A6531826F5BDA6E1295B69 0
+[GNUPG:] GOODSIG 26F5BDA6E1295B69 Me <me@example.com>
+[GNUPG:] VALIDSIG 1111C71D5C2D4DF161A6531826F5BDA6E1295B69 2026-10-17 1792215561 0 4 0 22 8 00 8ED2C71D5C2D4DF161A6531826F5BDA6E1295B69
+[GNUPG:] TRUST_UNDEFINED 0 pgp
+`)
+	assert.Equal(t, parseVerifyOutput("abc", gpg, nil), &signatureResult{
+		Object:      "abc",
+		Format:      "gpg",
+		Signer:      "Me <me@example.com>",
+		Fingerprint: "8ED2C71D5C2D4DF161A6531826F5BDA6E1295B69",
+		Verified:    true,
+	}, "gpg signature")
+
+	ssh := []byte(`Good "git" signature for me@example.com with ED25519 key SHA256:0evvVoVrbLQW+EQjeWO9LPgqH1tR96UFMEb7Peq71EI` + "\n")
+	assert.Equal(t, parseVerifyOutput("abc", ssh, nil), &signatureResult{
+		Object:      "abc",
+		Format:      "ssh",
+		Signer:      "me@example.com",
+		Fingerprint: "SHA256:0evvVoVrbLQW+EQjeWO9LPgqH1tR96UFMEb7Peq71EI",
+		Verified:    true,
+	}, "ssh signature")
+
+	noPrincipal := []byte(`Good "git" signature with ED25519 key SHA256:0evvVoVrbLQW+EQjeWO9LPgqH1tR96UFMEb7Peq71EI
+No principal matched.
+`)
+	result := parseVerifyOutput("abc", noPrincipal, errors.New("exit status 1"))
+	assert.False(t, result.Verified, "verified a key of no allowed signer")
+	assert.Equal(t, result.Error, "No principal matched.", "error")
+
+	unknownKey := []byte(`[GNUPG:] NEWSIG me@example.com
+[GNUPG:] ERRSIG 26F5BDA6E1295B69 22 8 00 1792215561 9 8ED2C71D5C2D4DF161A6531826F5BDA6E1295B69
+[GNUPG:] NO_PUBKEY 26F5BDA6E1295B69
+`)
+	result = parseVerifyOutput("abc", unknownKey, errors.New("exit status 1"))
+	assert.False(t, result.Verified, "verified an unknown key")
+	assert.Equal(t, result.Error, "the signature can't be verified with a trusted key", "error")
+
+	result = parseVerifyOutput("abc", nil, errors.New("exit status 1"))
+	assert.Equal(t, result.Error, "not signed", "error")
+}
+
+func TestAllowsSigner(t *testing.T) {
+	fpr := "8ED2C71D5C2D4DF161A6531826F5BDA6E1295B69"
+	assert.True(t, allowsSigner("8ed2 c71d 5c2d 4df1 61a6 5318 26f5 bda6 e129 5b69", fpr), "fingerprint with spaces")
+	assert.True(t, allowsSigner("SHA256:other, 26F5BDA6E1295B69", fpr), "long key ID")
+	assert.False(t, allowsSigner("E1295B69", fpr), "allowed a short key ID")
+	assert.True(t, allowsSigner("SHA256:abc", "SHA256:abc"), "ssh fingerprint")
+	assert.False(t, allowsSigner("SHA256:ABC", "SHA256:abc"), "ssh fingerprints are case sensitive")
+}
+
+func TestCheckSignature(t *testing.T) {
+	for _, cmd := range []string{"git", "ssh-keygen"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s is not installed", cmd)
+		}
+	}
+	dir, err := ioutil.TempDir("", "signature")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	key, repoDir := filepath.Join(dir, "key"), filepath.Join(dir, "repo")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "me", "-f", key).CombinedOutput()
+	assert.True(t, err == nil, string(out))
+	pub, err := ioutil.ReadFile(key + ".pub")
+	assert.NoErr(t, err)
+	signers := filepath.Join(dir, "allowed_signers")
+	assert.NoErr(t, ioutil.WriteFile(signers, []byte("me@example.com "+string(pub)), 0644))
+	fpr, err := exec.Command("ssh-keygen", "-l", "-E", "sha256", "-f", key+".pub").Output()
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, os.MkdirAll(repoDir, 0755))
+	commit := []string{"-c", "user.name=me", "-c", "user.email=me@example.com", "-c", "gpg.format=ssh", "-c", "user.signingkey=" + key, "commit", "-q", "--allow-empty"}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		append(commit, "-S", "-m", "signed"),
+		{"tag", "signed"},
+		append(commit, "-m", "unsigned"),
+	} {
+		out, err := repoCmd(repoDir, "git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+	}
+
+	conf := &Config{SignedPushes: "require", AllowedSSHSignersPath: signers, TrustedGPGKeysPath: filepath.Join(dir, "missing.asc")}
+	recorder := &buildRecorder{audit: &auditEntry{}}
+	assert.NoErr(t, checkSignature(conf, repoDir, "signed", dryccAPI.Config{}, recorder))
+	assert.True(t, recorder.audit.Signature.Verified, "the signature wasn't verified")
+	assert.Equal(t, recorder.audit.Signature.Signer, "me@example.com", "signer")
+	assert.Equal(t, recorder.audit.Signature.Fingerprint, strings.Fields(string(fpr))[1], "fingerprint")
+
+	err = checkSignature(conf, repoDir, "HEAD", dryccAPI.Config{}, recorder)
+	assert.True(t, err != nil && KindOf(err) == ErrPolicy, "accepted an unsigned push")
+	assert.False(t, recorder.audit.Signature.Verified, "verified an unsigned push")
+
+	appConf := dryccAPI.Config{Values: map[string]interface{}{allowedSignersKey: "SHA256:other"}}
+	err = checkSignature(conf, repoDir, "signed", appConf, recorder)
+	assert.True(t, err != nil && strings.Contains(err.Error(), "isn't allowed"), "accepted a key the app doesn't allow")
+
+	conf.SignedPushes = "warn"
+	assert.NoErr(t, checkSignature(conf, repoDir, "HEAD", dryccAPI.Config{}, recorder))
+	assert.Equal(t, recorder.audit.Decisions, []string{"HEAD isn't signed by a trusted key (not signed)"}, "warning")
+}
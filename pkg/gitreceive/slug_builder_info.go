@@ -17,23 +17,36 @@ const (
 type SlugBuilderInfo struct {
 	pushKey        string
 	tarKey         string
+	sourceIndexKey string
+	blobsKey       string
 	cacheKey       string
+	slugName       string
 	disableCaching bool
 }
 
 // NewSlugBuilderInfo creates and populates a new SlugBuilderInfo based on the given data
 func NewSlugBuilderInfo(appName string, shortSha string, disableCaching bool) *SlugBuilderInfo {
-	basePath := fmt.Sprintf(GitKeyPattern, appName, shortSha)
+	return NewShardedSlugBuilderInfo(appName, shortSha, disableCaching, 0)
+}
+
+// NewShardedSlugBuilderInfo is NewSlugBuilderInfo with keys sharded by the first shardLength hex
+// digits of the hash of appName. See StorageKeyPrefix.
+func NewShardedSlugBuilderInfo(appName string, shortSha string, disableCaching bool, shardLength int) *SlugBuilderInfo {
+	prefix := StorageKeyPrefix(appName, shardLength)
+	basePath := prefix + fmt.Sprintf(GitKeyPattern, appName, shortSha)
 	tarKey := fmt.Sprintf("%s/tar", basePath)
 	// this is where workflow tells slugrunner to download the slug from, so we have to tell slugbuilder to upload it to here
 	pushKey := fmt.Sprintf("%s/push", basePath)
 
-	cacheKey := fmt.Sprintf(CacheKeyPattern, appName)
+	cacheKey := prefix + fmt.Sprintf(CacheKeyPattern, appName)
 
 	return &SlugBuilderInfo{
 		pushKey:        pushKey,
 		tarKey:         tarKey,
+		sourceIndexKey: fmt.Sprintf("%s/%s", basePath, sourceIndexName),
+		blobsKey:       prefix + fmt.Sprintf(BlobsKeyPattern, appName),
 		cacheKey:       cacheKey,
+		slugName:       slugTGZName,
 		disableCaching: disableCaching,
 	}
 }
@@ -47,6 +60,14 @@ func (s SlugBuilderInfo) PushKey() string { return s.pushKey }
 // folder, not including the final filename.
 func (s SlugBuilderInfo) TarKey() string { return s.tarKey }
 
+// SourceIndexKey returns the object storage key of the index of the source, when its files are
+// de-duplicated into the blobs at BlobsKey.
+func (s SlugBuilderInfo) SourceIndexKey() string { return s.sourceIndexKey }
+
+// BlobsKey returns the object storage key of the directory of the file blobs of the sources of the
+// app, shared by all its builds.
+func (s SlugBuilderInfo) BlobsKey() string { return s.blobsKey }
+
 // CacheKey returns the object storage key that the slug builder will use to store the cache in
 // it's application specific and persisted between deploys (doesn't contain git-sha)
 func (s SlugBuilderInfo) CacheKey() string { return s.cacheKey }
@@ -55,7 +76,7 @@ func (s SlugBuilderInfo) CacheKey() string { return s.cacheKey }
 func (s SlugBuilderInfo) DisableCaching() bool { return s.disableCaching }
 
 // AbsoluteSlugObjectKey returns the PushKey plus the final filename of the slug.
-func (s SlugBuilderInfo) AbsoluteSlugObjectKey() string { return s.PushKey() + "/" + slugTGZName }
+func (s SlugBuilderInfo) AbsoluteSlugObjectKey() string { return s.PushKey() + "/" + s.slugName }
 
 // AbsoluteProcfileKey returns the PushKey plus the standard procfile name.
 func (s SlugBuilderInfo) AbsoluteProcfileKey() string { return s.PushKey() + "/Procfile" }
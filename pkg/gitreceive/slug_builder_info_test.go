@@ -15,3 +15,17 @@ func TestSlugBuilderInfo(t *testing.T) {
 	assert.Equal(t, "home/myapp:git-c3b4e4ba/push/Procfile", sbi.AbsoluteProcfileKey(), "key")
 	assert.Equal(t, false, sbi.DisableCaching(), "key")
 }
+
+func TestShardedSlugBuilderInfo(t *testing.T) {
+	sbi := NewShardedSlugBuilderInfo("myapp", "c3b4e4ba", false, 0)
+	assert.Equal(t, "home/myapp:git-c3b4e4ba/tar", sbi.TarKey(), "key without sharding")
+
+	prefix := StorageKeyPrefix("myapp", 2)
+	assert.Equal(t, len(prefix), 3, "length of the prefix")
+	assert.Equal(t, prefix, StorageKeyPrefix("myapp", 2), "prefix of the same app")
+	sbi = NewShardedSlugBuilderInfo("myapp", "c3b4e4ba", false, 2)
+	assert.Equal(t, prefix+"home/myapp:git-c3b4e4ba/push", sbi.PushKey(), "key")
+	assert.Equal(t, prefix+"home/myapp:git-c3b4e4ba/tar", sbi.TarKey(), "key")
+	assert.Equal(t, prefix+"home/myapp/cache", sbi.CacheKey(), "key")
+	assert.Equal(t, prefix+"home/myapp:git-c3b4e4ba/push/slug.tgz", sbi.AbsoluteSlugObjectKey(), "key")
+}
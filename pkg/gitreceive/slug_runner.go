@@ -0,0 +1,33 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+// slugRunnerImageKey is the app config key pinning the slugrunner image the app's slugs run with,
+// e.g. "drycc/slugrunner:1.4.0.heroku-20", so that slugrunner upgrades don't change its runtime.
+const slugRunnerImageKey = "DRYCC_SLUGRUNNER_IMAGE"
+
+// slugRunnerImage returns the slugrunner image the app config pins, or "" if it doesn't. Pinned
+// images must match one of the comma separated patterns (see path.Match) of the allowlist of the
+// builder, e.g. "drycc/slugrunner:*".
+func slugRunnerImage(conf *Config, appConf dryccAPI.Config) (string, error) {
+	image := configString(appConf, slugRunnerImageKey)
+	if image == "" {
+		return "", nil
+	}
+	allowed, err := splitPatterns(conf.SlugRunnerImageAllowlist)
+	if err != nil {
+		return "", fmt.Errorf("reading the slugrunner image allowlist (%s)", err)
+	}
+	if len(allowed) == 0 {
+		return "", fmt.Errorf("%s can't be set, the builder doesn't allow pinning the slugrunner image", slugRunnerImageKey)
+	}
+	if !matchAny(allowed, image) {
+		return "", fmt.Errorf("%s %q isn't allowed, use an image matching %s", slugRunnerImageKey, image, strings.Join(allowed, ", "))
+	}
+	return image, nil
+}
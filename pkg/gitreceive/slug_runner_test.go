@@ -0,0 +1,36 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	dryccAPI "github.com/drycc/controller-sdk-go/api"
+)
+
+func TestSlugRunnerImage(t *testing.T) {
+	conf := &Config{SlugRunnerImageAllowlist: "drycc/slugrunner:*, registry.example.com/slugrunner:1.*"}
+	image, err := slugRunnerImage(conf, dryccAPI.Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, image, "", "image without a pin")
+
+	appConf := dryccAPI.Config{Values: map[string]interface{}{slugRunnerImageKey: "drycc/slugrunner:1.4.0.heroku-20"}}
+	image, err = slugRunnerImage(conf, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, image, "drycc/slugrunner:1.4.0.heroku-20", "pinned image")
+
+	appConf.Values[slugRunnerImageKey] = "registry.example.com/slugrunner:1.2.0"
+	image, err = slugRunnerImage(conf, appConf)
+	assert.NoErr(t, err)
+	assert.Equal(t, image, "registry.example.com/slugrunner:1.2.0", "pinned image")
+
+	appConf.Values[slugRunnerImageKey] = "evil.example.com/slugrunner:1.4.0"
+	_, err = slugRunnerImage(conf, appConf)
+	assert.Err(t, err, errors.New(`DRYCC_SLUGRUNNER_IMAGE "evil.example.com/slugrunner:1.4.0" isn't allowed, use an image matching drycc/slugrunner:*, registry.example.com/slugrunner:1.*`))
+
+	_, err = slugRunnerImage(&Config{}, appConf)
+	assert.Err(t, err, errors.New("DRYCC_SLUGRUNNER_IMAGE can't be set, the builder doesn't allow pinning the slugrunner image"))
+
+	_, err = slugRunnerImage(&Config{SlugRunnerImageAllowlist: "drycc/[slugrunner"}, appConf)
+	assert.True(t, err != nil, "accepted an invalid allowlist")
+}
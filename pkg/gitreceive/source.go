@@ -0,0 +1,134 @@
+package gitreceive
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The ways the pushed source is checked out for the builder to read it.
+const (
+	// ArchiveCheckout writes the archive of the source to the repo, then extracts it.
+	ArchiveCheckout = "archive"
+	// WorktreeCheckout checks the source out straight from the repo, and archives it next to dir.
+	WorktreeCheckout = "worktree"
+)
+
+// sourceBufferSize is the size of the buffer the source archive is read and uploaded through.
+const sourceBufferSize = 1 << 20
+
+// sourceArchive is the tar archive of the source of a build, as uploaded for builder pods. It's
+// kept on disk rather than in memory, however large the push.
+type sourceArchive struct {
+	path string
+	size int64
+	sum  string
+	// temp is true if the archive is removed once the build is over.
+	temp bool
+}
+
+// newSourceArchive returns the archive at path, reading it through once for its size and digest.
+func newSourceArchive(path string, temp bool) (*sourceArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading file %s: (%s)", filepath.Base(path), err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.CopyBuffer(h, f, make([]byte, sourceBufferSize))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading file %s: (%s)", filepath.Base(path), err)
+	}
+	return &sourceArchive{path: path, size: size, sum: fmt.Sprintf("%x", h.Sum(nil)), temp: temp}, nil
+}
+
+// open opens the archive for reading.
+func (a *sourceArchive) open() (*os.File, error) {
+	return os.Open(a.path)
+}
+
+// sourceMemoryLimit returns the size of the largest source archive a build may hold in memory
+// with conf, zero if there's no limit.
+func sourceMemoryLimit(conf *Config) (int64, error) {
+	limit, err := parseMemory(conf.SourceMemoryLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid source memory limit %q (%s)", conf.SourceMemoryLimit, err)
+	}
+	return limit.Value(), nil
+}
+
+// remove removes the archive if it's temporary.
+func (a *sourceArchive) remove() {
+	if a != nil && a.temp {
+		os.Remove(a.path)
+	}
+}
+
+// checkoutSource checks rev out of the repo at repoDir into dir, returning the tar archive,
+// compressed with comp, uploaded for builder pods.
+func checkoutSource(mode, repoDir, appName, rev, dir string, comp compression) (*sourceArchive, error) {
+	switch mode {
+	case ArchiveCheckout, "":
+		return archiveSource(repoDir, appName, rev, dir, comp)
+	case WorktreeCheckout:
+		return worktreeSource(repoDir, rev, dir, comp)
+	}
+	return nil, fmt.Errorf("unknown source checkout %q", mode)
+}
+
+// archiveSource writes the archive of rev to the repo, then extracts it into dir.
+func archiveSource(repoDir, appName, rev, dir string, comp compression) (*sourceArchive, error) {
+	appTgz := fmt.Sprintf("%s.%s", appName, comp.ext())
+	gitArchiveCmd := comp.archiveCmd(repoDir, rev, appTgz)
+	gitArchiveCmd.Stdout = os.Stdout
+	gitArchiveCmd.Stderr = os.Stderr
+	if err := run(gitArchiveCmd); err != nil {
+		return nil, fmt.Errorf("running %s (%s)", strings.Join(gitArchiveCmd.Args, " "), err)
+	}
+
+	tarCmd := repoCmd(repoDir, "tar", append(comp.extractArgs(), appTgz, "-C", fmt.Sprintf("%s/", dir))...)
+	tarCmd.Stdout = os.Stdout
+	tarCmd.Stderr = os.Stderr
+	if err := run(tarCmd); err != nil {
+		return nil, fmt.Errorf("running %s (%s)", strings.Join(tarCmd.Args, " "), err)
+	}
+
+	return newSourceArchive(filepath.Join(repoDir, appTgz), false)
+}
+
+// worktreeSource checks rev out into dir and archives it next to dir, without writing the archive
+// to the repo or extracting it. `git worktree add --detach` can't be used: it updates the HEAD of
+// the new worktree, and git forbids ref updates in the pre-receive hook, before the push is
+// accepted. rev is read into an index of its own instead, which is then checked out into dir.
+func worktreeSource(repoDir, rev, dir string, comp compression) (*sourceArchive, error) {
+	index := dir + ".index"
+	defer os.Remove(index)
+	gitEnv := append(os.Environ(), "GIT_INDEX_FILE="+index)
+
+	readTreeCmd := repoCmd(repoDir, "git", "read-tree", rev)
+	readTreeCmd.Env = gitEnv
+	checkoutCmd := repoCmd(repoDir, "git", "--work-tree="+dir, "checkout-index", "--all")
+	checkoutCmd.Env = gitEnv
+	for _, cmd := range []*exec.Cmd{readTreeCmd, checkoutCmd} {
+		cmd.Stderr = os.Stderr
+		if err := run(cmd); err != nil {
+			return nil, fmt.Errorf("running %s (%s)", strings.Join(cmd.Args, " "), err)
+		}
+	}
+
+	path, err := filepath.Abs(dir + "." + comp.ext())
+	if err != nil {
+		return nil, err
+	}
+	gitArchiveCmd := comp.archiveCmd(repoDir, rev, path)
+	gitArchiveCmd.Stderr = os.Stderr
+	if err := run(gitArchiveCmd); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("running %s (%s)", strings.Join(gitArchiveCmd.Args, " "), err)
+	}
+	return newSourceArchive(path, true)
+}
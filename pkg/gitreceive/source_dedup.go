@@ -0,0 +1,367 @@
+package gitreceive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// BlobsKeyPattern is the template for the directories of the file blobs of the sources of
+	// each app.
+	BlobsKeyPattern = "home/%s/blobs"
+	sourceIndexName = "source.json"
+	// sourceIndexKey is the env var telling the source assembler of builder pods the key of the
+	// index of the source it assembles at TAR_PATH.
+	sourceIndexKey      = "SOURCE_INDEX_PATH"
+	sourceAssemblerName = "assemble-source"
+	// blobTransfers is how many blobs are uploaded or downloaded at once.
+	blobTransfers = 16
+)
+
+// blobStore is the subset of a (github.com/docker/distribution/registry/storage/driver).StorageDriver
+// needed to store the blobs of de-duplicated sources.
+type blobStore interface {
+	storage.ObjectStatter
+	storage.ObjectGetter
+	storage.ObjectPutter
+}
+
+// sourceIndex describes a source archive whose files are kept as blobs addressed by their
+// digest, so that each version of a file is only uploaded and stored once per app.
+type sourceIndex struct {
+	// Blobs is the key of the directory of the blobs.
+	Blobs string `json:"blobs"`
+	// Level is the gzip compression level of the assembled archive.
+	Level int `json:"level"`
+	// SHA256 is the digest of the assembled archive.
+	SHA256  string        `json:"sha256"`
+	Entries []sourceEntry `json:"entries"`
+}
+
+// sourceEntry is an entry of a source archive, with the digest of the blob of its contents if it
+// has any.
+type sourceEntry struct {
+	Header *tar.Header `json:"header"`
+	Blob   string      `json:"blob,omitempty"`
+}
+
+// blobKey returns the key of the blob whose digest is sum.
+func (i *sourceIndex) blobKey(sum string) string {
+	return i.Blobs + "/" + sum
+}
+
+// dedupedSource is a source archive split into its index and the blobs of its files.
+type dedupedSource struct {
+	index *sourceIndex
+	blobs map[string][]byte
+	// archive is the archive assembled from the index, which builder pods get.
+	archive []byte
+	// uploaded and uploadedSize count the blobs the storage didn't have yet.
+	uploaded     int
+	uploadedSize int64
+}
+
+// checkSourceDedup returns an error if the sources of builds can't be de-duplicated with conf.
+func checkSourceDedup(conf *Config, comp compression) error {
+	switch {
+	case !conf.SourceDedup:
+		return nil
+	case conf.SourceAssemblerImage == "":
+		return fmt.Errorf("source de-duplication needs SOURCE_ASSEMBLER_IMAGE")
+	case conf.PresignedURLs:
+		return fmt.Errorf("source de-duplication can't be used with PRESIGNED_URLS_ENABLED, the source assembler needs the storage credentials")
+	case comp.zstd():
+		return fmt.Errorf("source de-duplication only supports %s archives", GzipCompression)
+	}
+	return nil
+}
+
+// dedupSource splits the gzipped source archive data into the index of its entries and the blobs
+// of their contents, kept under blobsKey, and assembles the archive builder pods get from them,
+// compressed with comp.
+func dedupSource(data []byte, blobsKey string, comp compression) (*dedupedSource, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading the source archive (%s)", err)
+	}
+	index := &sourceIndex{Blobs: blobsKey, Level: comp.level}
+	if index.Level == 0 {
+		index.Level = gzip.DefaultCompression
+	}
+	source := &dedupedSource{blobs: make(map[string][]byte)}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading the source archive (%s)", err)
+		}
+		entry := sourceEntry{Header: header}
+		if header.Size > 0 {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s from the source archive (%s)", header.Name, err)
+			}
+			entry.Blob = fmt.Sprintf("%x", sha256.Sum256(content))
+			source.blobs[entry.Blob] = content
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+
+	// the source assembler only gets the index as JSON, the archive is assembled from the same
+	data, err = json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	index = new(sourceIndex)
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	var archive bytes.Buffer
+	err = assembleSource(&archive, index, func(sum string) ([]byte, error) {
+		return source.blobs[sum], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	source.archive = archive.Bytes()
+	index.SHA256 = fmt.Sprintf("%x", sha256.Sum256(source.archive))
+	source.index = index
+	return source, nil
+}
+
+// dedupArchive de-duplicates archive like dedupSource, if it fits in the memory a build may hold
+// the source in with conf. Larger archives aren't de-duplicated but uploaded whole, and nil is
+// returned for them.
+func dedupArchive(conf *Config, archive *sourceArchive, blobsKey string, comp compression) (*dedupedSource, error) {
+	limit, err := sourceMemoryLimit(conf)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && archive.size > limit {
+		log.Info("Not de-duplicating the source, its archive is %s, more than the %s a build may hold in memory", formatSize(archive.size), formatSize(limit))
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(archive.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the source archive (%s)", err)
+	}
+	return dedupSource(data, blobsKey, comp)
+}
+
+// assembleSource writes the archive of index to w, with the contents of each blob returned by
+// blob.
+func assembleSource(w io.Writer, index *sourceIndex, blob func(sum string) ([]byte, error)) error {
+	gz, err := gzip.NewWriterLevel(w, index.Level)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	for _, entry := range index.Entries {
+		if err := tw.WriteHeader(entry.Header); err != nil {
+			return fmt.Errorf("assembling %s (%s)", entry.Header.Name, err)
+		}
+		if entry.Blob == "" {
+			continue
+		}
+		content, err := blob(entry.Blob)
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return fmt.Errorf("assembling %s (%s)", entry.Header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// transferBlobs calls transfer with each of sums, blobTransfers at a time, and returns the first
+// error it returned.
+func transferBlobs(sums []string, transfer func(sum string) error) error {
+	ch := make(chan string)
+	errs := make(chan error, len(sums))
+	var wg sync.WaitGroup
+	for i := 0; i < blobTransfers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sum := range ch {
+				errs <- transfer(sum)
+			}
+		}()
+	}
+	for _, sum := range sums {
+		ch <- sum
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadSourceBlobs uploads the blobs of source the storage doesn't have yet, then its index to
+// indexKey. The index is uploaded last: the source assembler waits for it, and finds every blob
+// once it's there. The upload runs in the background like uploadSource, and the pusher is told how
+// many blobs were uploaded once it's complete.
+func uploadSourceBlobs(ctx context.Context, store blobStore, indexKey string, source *dedupedSource) *sourceUpload {
+	u := startUpload(func() error {
+		sums := make([]string, 0, len(source.blobs))
+		for sum := range source.blobs {
+			sums = append(sums, sum)
+		}
+		sort.Strings(sums)
+		var mu sync.Mutex
+		err := transferBlobs(sums, func(sum string) error {
+			key := source.index.blobKey(sum)
+			if _, err := store.Stat(ctx, key); err == nil {
+				return nil
+			}
+			if err := store.PutContent(ctx, key, source.blobs[sum]); err != nil {
+				return fmt.Errorf("uploading the source blob %s (%v)", key, err)
+			}
+			mu.Lock()
+			source.uploaded++
+			source.uploadedSize += int64(len(source.blobs[sum]))
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(source.index)
+		if err != nil {
+			return err
+		}
+		if err := store.PutContent(ctx, indexKey, data); err != nil {
+			return fmt.Errorf("uploading the source index to %s (%v)", indexKey, err)
+		}
+		return nil
+	})
+	u.summary = func() {
+		pusherTerminal.info(msgSourceDeduped, source.uploaded, len(source.blobs), formatSize(source.uploadedSize))
+	}
+	return u
+}
+
+// AssembleSource assembles the source archive of the index at indexKey from its blobs, and
+// uploads it with its checksum to tarKey. It waits up to wait for the index, which may still be
+// uploading. Builder pods run it before they build, in an init container, until ctx is done.
+func AssembleSource(ctx context.Context, store blobStore, indexKey, tarKey string, wait time.Duration) error {
+	storagedriver.PathRegexp = storagePathRegexp
+	deadline := time.Now().Add(wait)
+	data, err := store.GetContent(ctx, indexKey)
+	for err != nil && ctx.Err() == nil && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		data, err = store.GetContent(ctx, indexKey)
+	}
+	if err != nil {
+		return fmt.Errorf("downloading the source index %s (%s)", indexKey, err)
+	}
+	index := new(sourceIndex)
+	if err := json.Unmarshal(data, index); err != nil {
+		return fmt.Errorf("reading the source index %s (%s)", indexKey, err)
+	}
+
+	var sums []string
+	blobs := make(map[string][]byte)
+	for _, entry := range index.Entries {
+		if _, ok := blobs[entry.Blob]; entry.Blob != "" && !ok {
+			blobs[entry.Blob] = nil
+			sums = append(sums, entry.Blob)
+		}
+	}
+	var mu sync.Mutex
+	err = transferBlobs(sums, func(sum string) error {
+		content, err := store.GetContent(ctx, index.blobKey(sum))
+		if err != nil {
+			return fmt.Errorf("downloading the source blob %s (%s)", index.blobKey(sum), err)
+		}
+		mu.Lock()
+		blobs[sum] = content
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	err = assembleSource(&archive, index, func(sum string) ([]byte, error) {
+		return blobs[sum], nil
+	})
+	if err != nil {
+		return err
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(archive.Bytes()))
+	if sum != index.SHA256 {
+		return storage.ErrChecksumMismatch{Key: tarKey, Expected: index.SHA256, Actual: sum}
+	}
+	if err := store.PutContent(ctx, tarKey, archive.Bytes()); err != nil {
+		return fmt.Errorf("uploading the source to %s (%s)", tarKey, err)
+	}
+	if err := storage.PutChecksum(store, tarKey, sum); err != nil {
+		return fmt.Errorf("uploading checksum of %s (%s)", tarKey, err)
+	}
+	return nil
+}
+
+// addSourceAssembler has pod assemble its source archive from the index at indexKey with an init
+// container running image, before it builds.
+func addSourceAssembler(pod *corev1.Pod, image, indexKey string) {
+	builder := pod.Spec.Containers[0]
+	env := []corev1.EnvVar{{Name: sourceIndexKey, Value: indexKey}}
+	for _, e := range builder.Env {
+		if e.Name == tarPath || e.Name == tarWaitTimeout || e.Name == debugKey {
+			env = append(env, e)
+		}
+	}
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:            sourceAssemblerName,
+		Image:           image,
+		ImagePullPolicy: builder.ImagePullPolicy,
+		Command:         []string{"/usr/bin/boot", "assemble-source"},
+		Env:             env,
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      objectStore,
+			MountPath: objectStorePath,
+			ReadOnly:  true,
+		}},
+	})
+}
+
+// deleteAssembledSource deletes the source archive builder pods assembled at tarKey, and its
+// checksum, once the build is done with them: the index and blobs are kept instead.
+func deleteAssembledSource(driver storagedriver.StorageDriver, tarKey string) {
+	for _, key := range []string{tarKey, storage.ChecksumKey(tarKey)} {
+		if err := driver.Delete(context.Background(), key); err != nil {
+			log.Debug("deleting the assembled source %s (%s)", key, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gitreceive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testArchive returns a gzipped tarball of files, keyed by name.
+func testArchive(t *testing.T, files ...[2]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.NoErr(t, tw.WriteHeader(&tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, file := range files {
+		assert.NoErr(t, tw.WriteHeader(&tar.Header{Name: file[0], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file[1]))}))
+		_, err := tw.Write([]byte(file[1]))
+		assert.NoErr(t, err)
+	}
+	assert.NoErr(t, tw.Close())
+	assert.NoErr(t, gz.Close())
+	return buf.Bytes()
+}
+
+// archiveFiles returns the contents of the files of the gzipped tarball data, keyed by name.
+func archiveFiles(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.NoErr(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		content, err := ioutil.ReadAll(tr)
+		assert.NoErr(t, err)
+		files[header.Name] = string(content)
+	}
+	return files
+}
+
+func TestSourceDedup(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	comp, err := newCompression(GzipCompression, 0)
+	assert.NoErr(t, err)
+
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	archive := testArchive(t, [2]string{"app/main.go", "package main"}, [2]string{"app/README", "hello"}, [2]string{"app/COPY", "hello"})
+	source, err := dedupSource(archive, info.BlobsKey(), comp)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(source.index.Entries), 4, "entries")
+	assert.Equal(t, len(source.blobs), 2, "blobs")
+	assert.NoErr(t, uploadSourceBlobs(context.Background(), driver, info.SourceIndexKey(), source).wait())
+	assert.Equal(t, source.uploaded, 2, "blobs uploaded")
+
+	assert.NoErr(t, AssembleSource(context.Background(), driver, info.SourceIndexKey(), info.TarKey(), 0))
+	assembled, err := driver.GetContent(context.Background(), info.TarKey())
+	assert.NoErr(t, err)
+	assert.Equal(t, assembled, source.archive, "assembled archive")
+	assert.Equal(t, archiveFiles(t, assembled), archiveFiles(t, archive), "files of the assembled archive")
+	ok, err := storage.VerifyChecksum(driver, info.TarKey())
+	assert.NoErr(t, err)
+	assert.True(t, ok, "the checksum of the assembled archive doesn't match")
+
+	// the next build only uploads what changed
+	next := NewSlugBuilderInfo("app", "abcdef12", false)
+	archive = testArchive(t, [2]string{"app/main.go", "package main\n\nfunc main() {}"}, [2]string{"app/README", "hello"})
+	source, err = dedupSource(archive, next.BlobsKey(), comp)
+	assert.NoErr(t, err)
+	assert.NoErr(t, uploadSourceBlobs(context.Background(), driver, next.SourceIndexKey(), source).wait())
+	assert.Equal(t, source.uploaded, 1, "blobs uploaded by the next build")
+	assert.NoErr(t, AssembleSource(context.Background(), driver, next.SourceIndexKey(), next.TarKey(), 0))
+
+	deleteAssembledSource(driver, next.TarKey())
+	_, err = driver.Stat(context.Background(), next.TarKey())
+	assert.True(t, err != nil, "the assembled archive wasn't deleted")
+	_, err = driver.Stat(context.Background(), next.SourceIndexKey())
+	assert.NoErr(t, err)
+}
+
+func TestAssembleSourceMissingBlob(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	source, err := dedupSource(testArchive(t, [2]string{"app/main.go", "package main"}), info.BlobsKey(), compression{name: GzipCompression})
+	assert.NoErr(t, err)
+	assert.NoErr(t, uploadSourceBlobs(context.Background(), driver, info.SourceIndexKey(), source).wait())
+	for sum := range source.blobs {
+		assert.NoErr(t, driver.Delete(context.Background(), source.index.blobKey(sum)))
+	}
+	assert.True(t, AssembleSource(context.Background(), driver, info.SourceIndexKey(), info.TarKey(), 0) != nil, "assembled a source without its blobs")
+	assert.True(t, AssembleSource(context.Background(), driver, "home/app:git-00000000/source.json", info.TarKey(), 0) != nil, "assembled a source without an index")
+}
+
+func TestDedupArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.tar.gz")
+	assert.NoErr(t, ioutil.WriteFile(path, testArchive(t, [2]string{"app/main.go", "package main"}), 0644))
+	archive, err := newSourceArchive(path, false)
+	assert.NoErr(t, err)
+	comp := compression{name: GzipCompression}
+
+	source, err := dedupArchive(&Config{}, archive, "home/app/blobs", comp)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(source.blobs), 1, "blobs")
+	source, err = dedupArchive(&Config{SourceMemoryLimit: "16"}, archive, "home/app/blobs", comp)
+	assert.NoErr(t, err)
+	assert.True(t, source == nil, "de-duplicated an archive over the memory limit")
+}
+
+func TestCheckSourceDedup(t *testing.T) {
+	gzip := compression{name: GzipCompression}
+	assert.NoErr(t, checkSourceDedup(&Config{}, compression{name: ZstdCompression}))
+	assert.NoErr(t, checkSourceDedup(&Config{SourceDedup: true, SourceAssemblerImage: "drycc/builder"}, gzip))
+	assert.Err(t, checkSourceDedup(&Config{SourceDedup: true}, gzip), errors.New("source de-duplication needs SOURCE_ASSEMBLER_IMAGE"))
+	assert.True(t, checkSourceDedup(&Config{SourceDedup: true, SourceAssemblerImage: "drycc/builder", PresignedURLs: true}, gzip) != nil, "de-duplicated with pre-signed URLs")
+	assert.True(t, checkSourceDedup(&Config{SourceDedup: true, SourceAssemblerImage: "drycc/builder"}, compression{name: ZstdCompression}) != nil, "de-duplicated zstd archives")
+}
+
+func TestAddSourceAssembler(t *testing.T) {
+	info := NewSlugBuilderInfo("app", "12345678", false)
+	pod := PodSpecBuilder{Namespace: "drycc", StorageType: "minio"}.SlugBuilderPod(SlugBuilderOptions{PodOptions: PodOptions{Name: "build", Image: "slugbuilder", PullPolicy: corev1.PullAlways, Env: map[string]interface{}{"SECRET": "value"}, TarKey: info.TarKey(), ShortSha: "12345678"}, EnvSecretName: "app-build-env", PutKey: info.PushKey(), CacheKey: info.CacheKey()})
+	addSourceAssembler(pod, "drycc/builder", info.SourceIndexKey())
+
+	assert.Equal(t, len(pod.Spec.InitContainers), 1, "init containers")
+	assembler := pod.Spec.InitContainers[0]
+	assert.Equal(t, assembler.Image, "drycc/builder", "image of the assembler")
+	assert.Equal(t, assembler.Command, []string{"/usr/bin/boot", "assemble-source"}, "command of the assembler")
+	assert.Equal(t, assembler.Env, []corev1.EnvVar{
+		{Name: sourceIndexKey, Value: "home/app:git-12345678/source.json"},
+		{Name: tarPath, Value: info.TarKey()},
+	}, "env of the assembler")
+	assert.Equal(t, assembler.VolumeMounts[0].MountPath, objectStorePath, "mount of the storage credentials")
+}
@@ -0,0 +1,86 @@
+package gitreceive
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestCheckoutSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home, err := ioutil.TempDir("", "githome")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(home)
+	work := filepath.Join(home, "work")
+	repoDir := filepath.Join(home, "app.git")
+	assert.NoErr(t, os.MkdirAll(filepath.Join(work, "bin"), 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(work, "Procfile"), []byte("web: ./bin/web"), 0644))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(work, "bin", "web"), []byte("#!/bin/sh"), 0755))
+	for _, args := range [][]string{
+		{"init", work},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "test"},
+		{"clone", "--bare", work, repoDir},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		assert.True(t, err == nil, string(out))
+	}
+	rev, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
+	assert.NoErr(t, err)
+
+	for _, mode := range []string{ArchiveCheckout, WorktreeCheckout} {
+		dir, err := ioutil.TempDir(home, "tmp")
+		assert.NoErr(t, err)
+		archive, err := checkoutSource(mode, repoDir, "app", strings.TrimSpace(string(rev)), dir, compression{})
+		assert.NoErr(t, err)
+		data, err := ioutil.ReadFile(archive.path)
+		assert.NoErr(t, err)
+		assert.True(t, len(data) > 0, mode+" archive is empty")
+		assert.Equal(t, archive.size, int64(len(data)), mode+" archive size")
+		assert.Equal(t, archive.sum, fmt.Sprintf("%x", sha256.Sum256(data)), mode+" archive digest")
+		assert.Equal(t, archive.temp, mode == WorktreeCheckout, mode+" archive is temporary")
+		archive.remove()
+		_, err = os.Stat(archive.path)
+		assert.Equal(t, os.IsNotExist(err), mode == WorktreeCheckout, mode+" archive removed")
+		procfile, err := ioutil.ReadFile(filepath.Join(dir, "Procfile"))
+		assert.NoErr(t, err)
+		assert.Equal(t, string(procfile), "web: ./bin/web", mode+" Procfile")
+		fi, err := os.Stat(filepath.Join(dir, "bin", "web"))
+		assert.NoErr(t, err)
+		assert.True(t, fi.Mode()&0100 != 0, mode+" lost the executable bit")
+	}
+	_, err = os.Stat(filepath.Join(repoDir, "app.tar.gz"))
+	assert.NoErr(t, err)
+
+	_, err = checkoutSource("sparse", repoDir, "app", "HEAD", home, compression{})
+	assert.True(t, err != nil, "checked out with an unknown mode")
+}
+
+// testSourceArchive writes content to an archive in dir.
+func testSourceArchive(t *testing.T, dir, content string) *sourceArchive {
+	path := filepath.Join(dir, "app.tar.gz")
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(content), 0644))
+	archive, err := newSourceArchive(path, false)
+	assert.NoErr(t, err)
+	return archive
+}
+
+func TestSourceMemoryLimit(t *testing.T) {
+	limit, err := sourceMemoryLimit(&Config{SourceMemoryLimit: "1Mi"})
+	assert.NoErr(t, err)
+	assert.Equal(t, limit, int64(1<<20), "limit")
+	limit, err = sourceMemoryLimit(&Config{})
+	assert.NoErr(t, err)
+	assert.Equal(t, limit, int64(0), "no limit")
+	_, err = sourceMemoryLimit(&Config{SourceMemoryLimit: "lots"})
+	assert.True(t, err != nil, "accepted an invalid limit")
+}
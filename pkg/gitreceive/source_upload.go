@@ -0,0 +1,143 @@
+package gitreceive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/pkg/log"
+)
+
+// tarWaitTimeout is the env var telling builder pods for how many seconds to wait for the source
+// tarball to be uploaded, when it's uploaded while they start.
+const tarWaitTimeout = "TAR_WAIT_TIMEOUT"
+
+// asyncSourceUpload returns true if the source is uploaded while the builder pod running image
+// starts: async uploads are enabled, and image is tagged with a version of at least
+// conf.AsyncSourceUploadMinVersion, the first that waits for TAR_WAIT_TIMEOUT, if it's set. Older
+// builders would fail to find the source.
+func asyncSourceUpload(conf *Config, image string) bool {
+	if !conf.AsyncSourceUpload {
+		return false
+	} else if conf.AsyncSourceUploadMinVersion == "" {
+		return true
+	}
+	min, err := parseImageVersion(conf.AsyncSourceUploadMinVersion)
+	if err != nil {
+		log.Info("WARNING: invalid ASYNC_SOURCE_UPLOAD_MIN_VERSION (%s), uploading the source before the builder starts", err)
+		return false
+	}
+	version, err := parseImageVersion(imageTag(image))
+	if err != nil {
+		log.Debug("the version of %s is unknown (%s), uploading the source before it starts", image, err)
+		return false
+	}
+	for i := range version {
+		if version[i] != min[i] {
+			return version[i] > min[i]
+		}
+	}
+	return true
+}
+
+// parseImageVersion parses the version of an image tag such as v1.2.3 or 1.2, whose missing parts
+// are 0.
+func parseImageVersion(tag string) ([3]int, error) {
+	var version [3]int
+	fields := strings.Split(strings.TrimPrefix(tag, "v"), ".")
+	if len(fields) > len(version) {
+		return version, fmt.Errorf("%q isn't a version", tag)
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return version, fmt.Errorf("%q isn't a version", tag)
+		}
+		version[i] = n
+	}
+	return version, nil
+}
+
+// sourceUpload is the upload of the source tarball of a build to the object storage, which runs
+// in the background while the build prepares its builder pod. A nil *sourceUpload is complete.
+type sourceUpload struct {
+	done chan struct{}
+	err  error
+	// summary tells the pusher about the upload once it's complete, if there's anything to tell.
+	summary func()
+	told    sync.Once
+}
+
+// sourceWriter is a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// compatible interface, restricted to the functions needed to stream the source to the storage.
+type sourceWriter interface {
+	storage.ObjectPutter
+	Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error)
+}
+
+// uploadSource streams archive to key, along with its digest, so that the archive is never held
+// in memory.
+func uploadSource(ctx context.Context, writer sourceWriter, key string, archive *sourceArchive) *sourceUpload {
+	return startUpload(func() error {
+		if err := streamSource(ctx, writer, key, archive); err != nil {
+			return fmt.Errorf("uploading the source to %s (%v)", key, err)
+		}
+		if err := storage.PutChecksum(writer, key, archive.sum); err != nil {
+			return fmt.Errorf("uploading checksum of %s (%v)", key, err)
+		}
+		return nil
+	})
+}
+
+// streamSource copies archive to key through a buffer of sourceBufferSize.
+func streamSource(ctx context.Context, writer sourceWriter, key string, archive *sourceArchive) error {
+	f, err := archive.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fw, err := writer.Writer(ctx, key, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(fw, f, make([]byte, sourceBufferSize)); err != nil {
+		fw.Cancel()
+		return err
+	}
+	if err := fw.Commit(); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+// startUpload runs upload in the background.
+func startUpload(upload func() error) *sourceUpload {
+	u := &sourceUpload{done: make(chan struct{})}
+	go func() {
+		defer close(u.done)
+		u.err = upload()
+	}()
+	return u
+}
+
+// wait returns once the upload is complete, with its error if it failed.
+func (u *sourceUpload) wait() error {
+	if u == nil {
+		return nil
+	}
+	<-u.done
+	return u.err
+}
+
+// tell tells the pusher about the upload, which is complete, once however many builder pods
+// waited for it.
+func (u *sourceUpload) tell() {
+	if u != nil && u.summary != nil {
+		u.told.Do(u.summary)
+	}
+}
@@ -0,0 +1,71 @@
+package gitreceive
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+type failingPutter struct{}
+
+func (failingPutter) PutContent(ctx context.Context, path string, content []byte) error {
+	return errors.New("storage unavailable")
+}
+
+func (failingPutter) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func TestUploadSource(t *testing.T) {
+	storagedriver.PathRegexp = storagePathRegexp
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	archive := testSourceArchive(t, dir, "source")
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	key := NewSlugBuilderInfo("app", "12345678", false).TarKey()
+	assert.NoErr(t, uploadSource(context.Background(), driver, key, archive).wait())
+	data, err := driver.GetContent(context.Background(), key)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "source", "uploaded source")
+	sum, err := storage.GetChecksum(driver, key)
+	assert.NoErr(t, err)
+	assert.Equal(t, sum, archive.sum, "uploaded checksum")
+
+	assert.True(t, uploadSource(context.Background(), failingPutter{}, key, archive).wait() != nil, "failed upload succeeded")
+
+	var u *sourceUpload
+	assert.NoErr(t, u.wait())
+	u.tell()
+}
+
+func TestAsyncSourceUpload(t *testing.T) {
+	conf := &Config{}
+	assert.False(t, asyncSourceUpload(conf, "drycc/slugbuilder:v1.2.0"), "async upload while disabled")
+	conf.AsyncSourceUpload = true
+	assert.True(t, asyncSourceUpload(conf, "drycc/slugbuilder:canary"), "async upload without a minimum version")
+
+	conf.AsyncSourceUploadMinVersion = "v1.2"
+	for image, expected := range map[string]bool{
+		"drycc/slugbuilder:v1.2.0":                   true,
+		"drycc/slugbuilder:1.10":                     true,
+		"registry.example.com:5000/dockerbuilder:v2": true,
+		"drycc/slugbuilder:v1.1.9":                   false,
+		"drycc/slugbuilder:canary":                   false,
+		"drycc/slugbuilder":                          false,
+		"drycc/slugbuilder@sha256:abc":               false,
+	} {
+		assert.Equal(t, asyncSourceUpload(conf, image), expected, image)
+	}
+
+	conf.AsyncSourceUploadMinVersion = "latest"
+	assert.False(t, asyncSourceUpload(conf, "drycc/slugbuilder:v1.2.0"), "async upload with an invalid minimum version")
+}
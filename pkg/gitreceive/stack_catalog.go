@@ -0,0 +1,229 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+const (
+	// stackChannelKey is the app config key selecting the channel the stack image is taken from.
+	stackChannelKey = "DRYCC_STACK_CHANNEL"
+	// stackVersionKey is the app config key pinning the stack to a version.
+	stackVersionKey = "DRYCC_STACK_VERSION"
+
+	defaultStackChannel = "stable"
+	eolDateFormat       = "2006-01-02"
+	// eolNotice is how long before the end of life of a stack its users are warned about it.
+	eolNotice = 90 * 24 * time.Hour
+)
+
+// StackCatalog maps stack names to the versioned images of each stack. It's read from a JSON
+// file, usually mounted from a ConfigMap.
+type StackCatalog struct {
+	Stacks []CatalogStack `json:"stacks"`
+}
+
+// CatalogStack is a stack and its versions, ordered from the oldest to the newest.
+type CatalogStack struct {
+	Name string `json:"name"`
+	// EOL is the date, as YYYY-MM-DD, after which the stack is no longer supported.
+	EOL string `json:"eol,omitempty"`
+	// Deprecation tells the users of a deprecated stack what to do instead.
+	Deprecation string         `json:"deprecation,omitempty"`
+	Versions    []StackVersion `json:"versions"`
+}
+
+// StackVersion is a version of a stack, along with the channels it's published in.
+type StackVersion struct {
+	Version  string   `json:"version"`
+	Image    string   `json:"image"`
+	Channels []string `json:"channels,omitempty"`
+	EOL      string   `json:"eol,omitempty"`
+}
+
+// loadStackCatalog reads the catalog at path. It returns nil if there is no catalog.
+func loadStackCatalog(path string) (*StackCatalog, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	catalog := new(StackCatalog)
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("stack catalog %s is malformed (%s)", path, err)
+	}
+	for _, stack := range catalog.Stacks {
+		if err := checkEOL(stack.EOL); err != nil {
+			return nil, fmt.Errorf("stack %s in %s has an invalid eol (%s)", stack.Name, path, err)
+		}
+		for _, v := range stack.Versions {
+			if err := checkEOL(v.EOL); err != nil {
+				return nil, fmt.Errorf("stack %s %s in %s has an invalid eol (%s)", stack.Name, v.Version, path, err)
+			}
+		}
+	}
+	return catalog, nil
+}
+
+// SupportedStack is a stack builds can use, with the versions of the stack catalog.
+type SupportedStack struct {
+	Name        string   `json:"name"`
+	Versions    []string `json:"versions,omitempty"`
+	EOL         string   `json:"eol,omitempty"`
+	Deprecation string   `json:"deprecation,omitempty"`
+}
+
+// SupportedStacks returns the stacks builds can use, by priority, with the versions the catalog at
+// catalogPath lists for them.
+func SupportedStacks(catalogPath string) ([]SupportedStack, error) {
+	stacks, err := readStacks()
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := loadStackCatalog(catalogPath)
+	if err != nil {
+		return nil, err
+	}
+	return supportedStacks(stacks, catalog), nil
+}
+
+// supportedStacks returns stacks with the versions catalog, which may be nil, lists for them.
+func supportedStacks(stacks []map[string]string, catalog *StackCatalog) []SupportedStack {
+	supported := make([]SupportedStack, 0, len(stacks))
+	for _, stack := range stacks {
+		s := SupportedStack{Name: stack["name"]}
+		if catalog != nil {
+			if cs := catalog.stack(s.Name); cs != nil {
+				s.EOL, s.Deprecation = cs.EOL, cs.Deprecation
+				for _, v := range cs.Versions {
+					s.Versions = append(s.Versions, v.Version)
+				}
+			}
+		}
+		supported = append(supported, s)
+	}
+	return supported
+}
+
+func checkEOL(eol string) error {
+	if eol == "" {
+		return nil
+	}
+	_, err := time.Parse(eolDateFormat, eol)
+	return err
+}
+
+// pastEOL returns true if the date eol is before now.
+func pastEOL(eol string, now time.Time) bool {
+	date, err := time.Parse(eolDateFormat, eol)
+	return err == nil && now.After(date)
+}
+
+// nearEOL returns true if the date eol is less than eolNotice after now.
+func nearEOL(eol string, now time.Time) bool {
+	return pastEOL(eol, now.Add(eolNotice))
+}
+
+func (c *StackCatalog) stack(name string) *CatalogStack {
+	for i := range c.Stacks {
+		if c.Stacks[i].Name == name {
+			return &c.Stacks[i]
+		}
+	}
+	return nil
+}
+
+// resolve returns the version of the stack named name to build with: the pinned version if it's
+// set, otherwise the newest version in channel. It also returns the warnings the pusher should
+// see about it. Stacks missing from c resolve to nil without an error.
+func (c *StackCatalog) resolve(name, channel, pinned string, now time.Time) (*StackVersion, []string, error) {
+	stack := c.stack(name)
+	if stack == nil {
+		return nil, nil, nil
+	}
+	var resolved *StackVersion
+	if pinned != "" {
+		var available []string
+		for i, v := range stack.Versions {
+			available = append(available, v.Version)
+			if v.Version == pinned {
+				resolved = &stack.Versions[i]
+			}
+		}
+		if resolved == nil {
+			return nil, nil, fmt.Errorf("stack %s has no version %s, available versions are %s", name, pinned, strings.Join(available, ", "))
+		}
+	} else {
+		for i, v := range stack.Versions {
+			for _, ch := range v.Channels {
+				if ch == channel {
+					resolved = &stack.Versions[i]
+				}
+			}
+		}
+		if resolved == nil {
+			return nil, nil, fmt.Errorf("stack %s has no version in the %s channel", name, channel)
+		}
+	}
+
+	var warnings []string
+	if pastEOL(stack.EOL, now) {
+		warnings = append(warnings, fmt.Sprintf("stack %s reached its end of life on %s", name, stack.EOL))
+	} else if nearEOL(stack.EOL, now) {
+		warnings = append(warnings, fmt.Sprintf("stack %s reaches its end of life on %s", name, stack.EOL))
+	}
+	if stack.Deprecation != "" {
+		warnings = append(warnings, fmt.Sprintf("stack %s is deprecated: %s", name, stack.Deprecation))
+	}
+	if pastEOL(resolved.EOL, now) {
+		warnings = append(warnings, fmt.Sprintf("stack %s %s reached its end of life on %s, unpin it with `drycc config:unset %s`", name, resolved.Version, resolved.EOL, stackVersionKey))
+	}
+	return resolved, warnings, nil
+}
+
+// configString returns the app config value key as a string, or "" if it's not set.
+func configString(config api.Config, key string) string {
+	if val, ok := config.Values[key]; ok {
+		if str, ok := val.(string); ok {
+			return strings.TrimSpace(str)
+		}
+	}
+	return ""
+}
+
+// resolveStack returns stack with its image replaced by the one the catalog at catalogPath lists
+// for the app's channel or pinned version, and prints the catalog's warnings about it. Stacks are
+// returned as they are if there is no catalog or the catalog doesn't list them.
+func resolveStack(catalogPath string, stack map[string]string, config api.Config, now time.Time) (map[string]string, error) {
+	catalog, err := loadStackCatalog(catalogPath)
+	if err != nil || catalog == nil {
+		return stack, err
+	}
+	channel := configString(config, stackChannelKey)
+	if channel == "" {
+		channel = defaultStackChannel
+	}
+	version, warnings, err := catalog.resolve(stack["name"], channel, configString(config, stackVersionKey), now)
+	if err != nil || version == nil {
+		return stack, err
+	}
+	for _, warning := range warnings {
+		log.Info("WARNING: %s", warning)
+	}
+	resolved := make(map[string]string, len(stack)+1)
+	for k, v := range stack {
+		resolved[k] = v
+	}
+	resolved["image"] = version.Image
+	resolved["version"] = version.Version
+	log.Info("Using stack %s %s", stack["name"], version.Version)
+	return resolved, nil
+}
@@ -0,0 +1,99 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/controller-sdk-go/api"
+)
+
+const catalogFixture = `{
+  "stacks": [
+    {
+      "name": "heroku-18",
+      "eol": "2023-04-30",
+      "deprecation": "use heroku-20",
+      "versions": [
+        {"version": "18.1", "image": "drycc/slugrunner:18.1", "channels": ["stable"]}
+      ]
+    },
+    {
+      "name": "heroku-20",
+      "versions": [
+        {"version": "20.1", "image": "drycc/slugrunner:20.1", "eol": "2023-01-01"},
+        {"version": "20.2", "image": "drycc/slugrunner:20.2", "channels": ["stable"]},
+        {"version": "20.3", "image": "drycc/slugrunner:20.3", "channels": ["edge"]}
+      ]
+    }
+  ]
+}`
+
+func writeCatalog(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "catalog")
+	assert.NoErr(t, err)
+	path := filepath.Join(dir, "catalog.json")
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestStackCatalogResolve(t *testing.T) {
+	path, cleanup := writeCatalog(t, catalogFixture)
+	defer cleanup()
+	catalog, err := loadStackCatalog(path)
+	assert.NoErr(t, err)
+	now := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	v, warnings, err := catalog.resolve("heroku-20", "stable", "", now)
+	assert.NoErr(t, err)
+	assert.Equal(t, v.Image, "drycc/slugrunner:20.2", "stable image")
+	assert.Equal(t, len(warnings), 0, "number of warnings")
+
+	v, _, err = catalog.resolve("heroku-20", "edge", "", now)
+	assert.NoErr(t, err)
+	assert.Equal(t, v.Image, "drycc/slugrunner:20.3", "edge image")
+
+	v, warnings, err = catalog.resolve("heroku-20", "stable", "20.1", now)
+	assert.NoErr(t, err)
+	assert.Equal(t, v.Image, "drycc/slugrunner:20.1", "pinned image")
+	assert.Equal(t, len(warnings), 1, "number of warnings for an EOL version")
+
+	_, warnings, err = catalog.resolve("heroku-18", "stable", "", now)
+	assert.NoErr(t, err)
+	assert.Equal(t, warnings, []string{
+		"stack heroku-18 reaches its end of life on 2023-04-30",
+		"stack heroku-18 is deprecated: use heroku-20",
+	}, "warnings")
+
+	_, _, err = catalog.resolve("heroku-20", "stable", "19.0", now)
+	assert.True(t, err != nil, "resolved a missing version")
+	_, _, err = catalog.resolve("heroku-18", "edge", "", now)
+	assert.True(t, err != nil, "resolved a missing channel")
+	v, _, err = catalog.resolve("heroku-22", "stable", "", now)
+	assert.NoErr(t, err)
+	assert.True(t, v == nil, "resolved a stack missing from the catalog")
+}
+
+func TestResolveStack(t *testing.T) {
+	stack := map[string]string{"name": "heroku-20", "image": "drycc/slugrunner:canary.heroku-20"}
+	resolved, err := resolveStack("/nonexistent/catalog.json", stack, api.Config{}, time.Now())
+	assert.NoErr(t, err)
+	assert.Equal(t, resolved, stack, "stack without a catalog")
+
+	path, cleanup := writeCatalog(t, catalogFixture)
+	defer cleanup()
+	config := api.Config{Values: map[string]interface{}{stackChannelKey: "edge"}}
+	resolved, err = resolveStack(path, stack, config, time.Now())
+	assert.NoErr(t, err)
+	assert.Equal(t, resolved["image"], "drycc/slugrunner:20.3", "image")
+	assert.Equal(t, resolved["version"], "20.3", "version")
+	assert.Equal(t, stack["image"], "drycc/slugrunner:canary.heroku-20", "original stack image")
+
+	bad, cleanupBad := writeCatalog(t, `{"stacks":[{"name":"heroku-20","eol":"soon"}]}`)
+	defer cleanupBad()
+	_, err = resolveStack(bad, stack, config, time.Now())
+	assert.True(t, err != nil, "loaded a catalog with an invalid eol")
+}
@@ -0,0 +1,28 @@
+package gitreceive
+
+import "sync"
+
+// stepGroup runs independent steps of a build concurrently, e.g. the steps before the builder pod
+// is created, which would otherwise add up on every build. The zero value is ready to use.
+type stepGroup struct {
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+// run runs step in the background.
+func (g *stepGroup) run(step func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := step(); err != nil {
+			g.once.Do(func() { g.err = err })
+		}
+	}()
+}
+
+// wait returns once all the steps are over, with the error of the first one that failed.
+func (g *stepGroup) wait() error {
+	g.wg.Wait()
+	return g.err
+}
@@ -0,0 +1,36 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestStepGroup(t *testing.T) {
+	var g stepGroup
+	assert.NoErr(t, g.wait())
+
+	// the steps run concurrently: each waits for the other
+	first, second := make(chan bool), make(chan bool)
+	g.run(func() error {
+		close(first)
+		<-second
+		return nil
+	})
+	g.run(func() error {
+		<-first
+		close(second)
+		return nil
+	})
+	assert.NoErr(t, g.wait())
+
+	failing := &stepGroup{}
+	failing.run(func() error { return errors.New("secret not created") })
+	failing.run(func() error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("upload failed")
+	})
+	assert.Err(t, failing.wait(), errors.New("secret not created"))
+}
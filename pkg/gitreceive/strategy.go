@@ -0,0 +1,86 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+const (
+	// strategyPushOption selects how the release of a push is rolled out, e.g. "-o strategy=canary".
+	strategyPushOption = "strategy"
+
+	// CanaryStrategy moves traffic to the new release gradually.
+	CanaryStrategy = "canary"
+	// BlueGreenStrategy starts the new release next to the old one, then switches all traffic to it.
+	BlueGreenStrategy = "bluegreen"
+)
+
+// releaseStrategy returns the rollout strategy requested with the strategy push option, or "" to
+// leave it to the controller. It fails if the strategy is unknown, or if the API of the controller,
+// as reported in its last response to client, is older than conf.ReleaseStrategyAPIVersion, so
+// that a requested strategy is never silently ignored.
+func releaseStrategy(conf *Config, client *drycc.Client, pushOpts PushOptions) (string, error) {
+	strategy, ok := pushOpts.Get(strategyPushOption)
+	if !ok {
+		return "", nil
+	}
+	strategy = strings.ToLower(strategy)
+	if strategy != CanaryStrategy && strategy != BlueGreenStrategy {
+		return "", fmt.Errorf("unknown release strategy %q, use %s or %s", strategy, CanaryStrategy, BlueGreenStrategy)
+	}
+	supported, err := apiVersionAtLeast(client.ControllerAPIVersion, conf.ReleaseStrategyAPIVersion)
+	if err != nil {
+		return "", fmt.Errorf("invalid release strategy API version %q (%s)", conf.ReleaseStrategyAPIVersion, err)
+	}
+	if !supported {
+		return "", fmt.Errorf("the controller (API %s) doesn't support release strategies, push without -o %s", client.ControllerAPIVersion, strategyPushOption)
+	}
+	return strategy, nil
+}
+
+// controllerSupports returns true if the API of the controller, as reported in its last response
+// to client, is min or later. No controller supports the features whose min is empty.
+func controllerSupports(client *drycc.Client, min string) (bool, error) {
+	if min == "" {
+		return false, nil
+	}
+	return apiVersionAtLeast(client.ControllerAPIVersion, min)
+}
+
+// apiVersionAtLeast returns true if the major.minor API version is min or later. Unknown versions
+// are never recent enough.
+func apiVersionAtLeast(version, min string) (bool, error) {
+	minParts, err := parseAPIVersion(min)
+	if err != nil {
+		return false, err
+	}
+	parts, err := parseAPIVersion(version)
+	if err != nil {
+		return false, nil
+	}
+	for i := range parts {
+		if parts[i] != minParts[i] {
+			return parts[i] > minParts[i], nil
+		}
+	}
+	return true, nil
+}
+
+func parseAPIVersion(version string) ([2]int, error) {
+	var parts [2]int
+	fields := strings.SplitN(version, ".", 2)
+	if len(fields) != 2 {
+		return parts, fmt.Errorf("%q isn't a major.minor version", version)
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, fmt.Errorf("%q isn't a major.minor version", version)
+		}
+		parts[i] = n
+	}
+	return parts, nil
+}
@@ -0,0 +1,52 @@
+package gitreceive
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+func TestReleaseStrategy(t *testing.T) {
+	conf := &Config{ReleaseStrategyAPIVersion: "2.4"}
+	client := &drycc.Client{ControllerAPIVersion: "2.10"}
+
+	strategy, err := releaseStrategy(conf, client, PushOptions{})
+	assert.NoErr(t, err)
+	assert.Equal(t, strategy, "", "strategy without the push option")
+
+	strategy, err = releaseStrategy(conf, client, PushOptions{strategyPushOption: "BlueGreen"})
+	assert.NoErr(t, err)
+	assert.Equal(t, strategy, BlueGreenStrategy, "strategy")
+
+	_, err = releaseStrategy(conf, client, PushOptions{strategyPushOption: "rolling"})
+	assert.True(t, err != nil, "unknown strategies must be rejected")
+
+	client.ControllerAPIVersion = "2.3"
+	_, err = releaseStrategy(conf, client, PushOptions{strategyPushOption: CanaryStrategy})
+	assert.True(t, err != nil, "strategies must be rejected by older controllers")
+	strategy, err = releaseStrategy(conf, client, PushOptions{})
+	assert.NoErr(t, err)
+	assert.Equal(t, strategy, "", "older controllers without the push option")
+}
+
+func TestAPIVersionAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		ok      bool
+	}{
+		{"2.4", true},
+		{"2.10", true},
+		{"3.0", true},
+		{"2.3", false},
+		{"1.9", false},
+		{"", false},
+		{"unknown", false},
+	} {
+		ok, err := apiVersionAtLeast(test.version, "2.4")
+		assert.NoErr(t, err)
+		assert.Equal(t, ok, test.ok, test.version)
+	}
+	_, err := apiVersionAtLeast("2.4", "latest")
+	assert.True(t, err != nil, "invalid minimum versions must be rejected")
+}
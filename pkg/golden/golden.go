@@ -0,0 +1,78 @@
+// Package golden compares values with golden files, the indented JSON they're expected to encode
+// to, for tests to catch the changes of specs across versions, such as those of the builder pods
+// of gitreceive.PodSpecBuilder. Tests rewrite their golden files with their values when they run
+// with UPDATE_GOLDEN=true, for the changes to be reviewed in the diff of the files.
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// UpdateEnv is the env var that makes tests rewrite their golden files when it's true.
+const UpdateEnv = "UPDATE_GOLDEN"
+
+// Encode returns v as it's stored in golden files.
+func Encode(v interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Assert fails t if v isn't encoded to the content of the golden file at path, telling the first
+// line that differs. With UPDATE_GOLDEN=true, it writes v to path instead.
+func Assert(t testing.TB, path string, v interface{}) {
+	t.Helper()
+	got, err := Encode(v)
+	if err != nil {
+		t.Fatalf("encoding the value of %s (%s)", path, err)
+		return
+	}
+	if os.Getenv(UpdateEnv) == "true" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("writing %s (%s)", path, err)
+			return
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("writing %s (%s)", path, err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("no golden file %s, write it with %s=true", path, UpdateEnv)
+		return
+	} else if err != nil {
+		t.Fatalf("reading %s (%s)", path, err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the value differs from the golden file %s, %s (rewrite it with %s=true if the change is expected)", path, firstDiff(want, got), UpdateEnv)
+	}
+}
+
+// firstDiff describes the first line that differs between want and got.
+func firstDiff(want, got []byte) string {
+	wantLines, gotLines := strings.Split(string(want), "\n"), strings.Split(string(got), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("at line %d:\n- %s\n+ %s", i+1, strings.TrimSpace(w), strings.TrimSpace(g))
+		}
+	}
+	return "in its line endings"
+}
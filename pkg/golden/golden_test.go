@@ -0,0 +1,57 @@
+package golden
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+// fakeT records the failures of the tests it's passed to.
+type fakeT struct {
+	testing.TB
+	failures []string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+}
+
+func TestAssert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "spec.json")
+	spec := map[string]string{"image": "drycc/slugbuilder", "name": "slugbuild"}
+
+	f := &fakeT{}
+	Assert(f, path, spec)
+	assert.Equal(t, len(f.failures), 1, "failures without a golden file")
+	assert.True(t, strings.HasPrefix(f.failures[0], "no golden file"), "failure without a golden file")
+
+	os.Setenv(UpdateEnv, "true")
+	Assert(f, path, spec)
+	os.Unsetenv(UpdateEnv)
+	data, err := ioutil.ReadFile(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "{\n  \"image\": \"drycc/slugbuilder\",\n  \"name\": \"slugbuild\"\n}\n", "golden file")
+
+	f = &fakeT{}
+	Assert(f, path, spec)
+	assert.Equal(t, len(f.failures), 0, "failures of the same value")
+
+	spec["image"] = "drycc/dockerbuilder"
+	Assert(f, path, spec)
+	assert.Equal(t, len(f.failures), 1, "failures of a changed value")
+	assert.True(t, strings.Contains(f.failures[0], "at line 2:\n- \"image\": \"drycc/slugbuilder\",\n+ \"image\": \"drycc/dockerbuilder\","), "failure of a changed value: "+f.failures[0])
+}
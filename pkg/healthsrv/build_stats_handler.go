@@ -0,0 +1,48 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc/builder/pkg/buildstats"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+// defaultStatsDays is how many days of builds the statistics cover by default.
+const defaultStatsDays = 30
+
+// buildStatsHandler serves the statistics of the builds of an app, read from getter, at
+// /apps/<app>/build-stats. The days query parameter sets how many days of builds they cover.
+func buildStatsHandler(getter storage.ObjectGetter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[0] != "apps" || parts[1] == "" || parts[2] != "build-stats" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		days := defaultStatsDays
+		if raw := r.URL.Query().Get("days"); raw != "" {
+			var err error
+			if days, err = strconv.Atoi(raw); err != nil || days < 1 {
+				http.Error(w, "days must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		history, err := buildstats.Load(getter, parts[1])
+		if err != nil {
+			log.Printf("Error reading the build stats (%s)", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history.Stats(time.Now().AddDate(0, 0, -days)))
+	})
+}
@@ -0,0 +1,51 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/drycc/builder/pkg/buildstats"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+func TestBuildStatsHandler(t *testing.T) {
+	storagedriver.PathRegexp = storage.KeyRegexp
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	h := &buildstats.History{App: "myapp"}
+	h.Add(buildstats.Build{Finished: now.AddDate(0, 0, -10), Duration: 120}, now)
+	h.Add(buildstats.Build{Finished: now, Duration: 60, FailureReason: "timeout"}, now)
+	assert.NoErr(t, h.Save(store))
+	handler := buildStatsHandler(store)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/apps/myapp/build-stats", nil))
+	assert.Equal(t, w.Code, http.StatusOK, "response code")
+	var stats buildstats.Stats
+	assert.NoErr(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, stats.Builds, 2, "builds")
+	assert.Equal(t, stats.MedianDuration, 120.0, "median duration")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/apps/myapp/build-stats?days=7", nil))
+	assert.NoErr(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, stats.Builds, 1, "builds of the last 7 days")
+
+	for path, code := range map[string]int{
+		"/apps/myapp/build-stats?days=0": http.StatusBadRequest,
+		"/apps/myapp":                    http.StatusNotFound,
+		"/apps//build-stats":             http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, w.Code, code, "response code of "+path)
+	}
+}
@@ -0,0 +1,30 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/drycc/builder/pkg/tunables"
+)
+
+// configHandler serves the tunables of builds in effect, as recorded in the snapshot at path, with
+// the reason the last change of them was rejected, if it was.
+func configHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := tunables.ReadSnapshot(path)
+		if err != nil {
+			log.Printf("Error reading the tunables of builds (%s)", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		} else if s == nil {
+			s = &tunables.Snapshot{Values: map[string]string{}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+}
@@ -0,0 +1,45 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/tunables"
+)
+
+func TestConfigHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-handler")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, tunables.SnapshotFile)
+	handler := configHandler(path)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(t, w.Code, http.StatusOK, "response code")
+	var s tunables.Snapshot
+	assert.NoErr(t, json.NewDecoder(w.Body).Decode(&s))
+	assert.Equal(t, len(s.Values), 0, "tunables before the first reload")
+
+	config := filepath.Join(dir, "config")
+	assert.NoErr(t, os.Mkdir(config, 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(config, "BUILD_TIMEOUT"), []byte("3600000"), 0644))
+	_, err = tunables.Reload(config, path, func(map[string]string) error { return nil }, time.Now())
+	assert.NoErr(t, err)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	assert.NoErr(t, json.NewDecoder(w.Body).Decode(&s))
+	assert.Equal(t, s.Source, config, "source")
+	assert.Equal(t, s.Values, map[string]string{"BUILD_TIMEOUT": "3600000"}, "tunables")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/config", nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed, "response code")
+}
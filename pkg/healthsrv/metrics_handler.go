@@ -0,0 +1,31 @@
+package healthsrv
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/drycc/builder/pkg/buildcost"
+	"github.com/drycc/builder/pkg/cleaner"
+	"github.com/drycc/builder/pkg/sshd"
+)
+
+// metricsHandler serves the builder's metrics in the Prometheus text format, with the costs of
+// the builds recorded in the ledger of gitHome.
+func metricsHandler(gitHome string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		removed, reclaimed := cleaner.BuildArtifactStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP builder_stale_build_artifacts_removed_total Stale build artifacts removed from the git home.")
+		fmt.Fprintln(w, "# TYPE builder_stale_build_artifacts_removed_total counter")
+		fmt.Fprintf(w, "builder_stale_build_artifacts_removed_total %d\n", removed)
+		fmt.Fprintln(w, "# HELP builder_stale_build_artifacts_reclaimed_bytes_total Bytes reclaimed by removing stale build artifacts.")
+		fmt.Fprintln(w, "# TYPE builder_stale_build_artifacts_reclaimed_bytes_total counter")
+		fmt.Fprintf(w, "builder_stale_build_artifacts_reclaimed_bytes_total %d\n", reclaimed)
+		sshd.WriteTransportMetrics(w)
+		if err := buildcost.WriteMetrics(w, filepath.Join(gitHome, buildcost.LedgerFile)); err != nil {
+			log.Printf("Error reading the build costs (%s)", err)
+		}
+	})
+}
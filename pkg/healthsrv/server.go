@@ -1,16 +1,21 @@
 package healthsrv
 
 import (
-	"fmt"
 	"net/http"
+	"path/filepath"
 
 	"github.com/drycc/builder/pkg/controller"
 	"github.com/drycc/builder/pkg/sshd"
+	"github.com/drycc/builder/pkg/storage"
+	"github.com/drycc/builder/pkg/tunables"
 )
 
-// Start starts the healthcheck server on :$port and blocks. It only returns if the server fails,
-// with the indicative error.
-func Start(cnf *sshd.Config, nsLister NamespaceLister, bLister BucketLister, sshServerCircuit *sshd.Circuit) error {
+// Start starts the healthcheck server on $HEALTH_SERVER_HOST_IP:$HEALTH_SERVER_PORT and blocks. It only returns if the server fails,
+// with the indicative error. The metrics include the costs of the builds recorded in gitHome, and
+// the statistics of the builds of apps are read from artifacts. The tunables of builds in effect
+// are those of the snapshot in gitHome, and the features of builds those of the config hookConf
+// returns.
+func Start(cnf *sshd.Config, gitHome string, nsLister NamespaceLister, bLister BucketLister, artifacts storage.ObjectGetter, sshServerCircuit *sshd.Circuit, hookConf HookConfig) error {
 	mux := http.NewServeMux()
 	client, err := controller.New(cnf.ControllerHost, cnf.ControllerPort)
 	if err != nil {
@@ -18,7 +23,10 @@ func Start(cnf *sshd.Config, nsLister NamespaceLister, bLister BucketLister, ssh
 	}
 	mux.Handle("/healthz", healthZHandler(bLister, sshServerCircuit))
 	mux.Handle("/readiness", readinessHandler(client, nsLister))
+	mux.Handle("/metrics", metricsHandler(gitHome))
+	mux.Handle("/apps/", buildStatsHandler(artifacts))
+	mux.Handle("/config", configHandler(filepath.Join(gitHome, tunables.SnapshotFile)))
+	mux.Handle("/version", versionHandler(cnf, hookConf))
 
-	hostStr := fmt.Sprintf(":%d", cnf.HealthSrvPort)
-	return http.ListenAndServe(hostStr, mux)
+	return http.ListenAndServe(cnf.HealthSrvAddr(), mux)
 }
@@ -0,0 +1,73 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/drycc/builder/pkg/controller"
+	"github.com/drycc/builder/pkg/gitreceive"
+	"github.com/drycc/builder/pkg/sshd"
+)
+
+// HookConfig returns the config of the git-receive hook the next push reads.
+type HookConfig func() (*gitreceive.Config, error)
+
+// versionInfo is what the builder serves at /version.
+type versionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	// ControllerAPI is the range of the controller API versions the builder is compatible with,
+	// from Min up to Below, excluded.
+	ControllerAPI struct {
+		Min   string `json:"min"`
+		Below string `json:"below"`
+	} `json:"controllerAPI"`
+	Stacks   []gitreceive.SupportedStack `json:"stacks"`
+	Features []string                    `json:"features"`
+}
+
+// versionHandler serves the version of the builder, the controller API versions it's compatible
+// with, the stacks builds can use and the optional features enabled by cnf and by the config of
+// the hook that hookConf returns, for clients to check the capabilities of the builder.
+func versionHandler(cnf *sshd.Config, hookConf HookConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		info := versionInfo{Version: cnf.BuilderVersion, Commit: cnf.BuilderCommit}
+		info.ControllerAPI.Min, info.ControllerAPI.Below = controller.CompatibleAPI()
+		conf, err := hookConf()
+		if err == nil {
+			info.Stacks, err = gitreceive.SupportedStacks(conf.StackCatalogPath)
+		}
+		if err != nil {
+			log.Printf("Error reading the capabilities of the builder (%s)", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		info.Features = append(serverFeatures(cnf), gitreceive.Features(conf)...)
+		sort.Strings(info.Features)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
+
+// serverFeatures returns the names of the optional features of the server that cnf enables.
+func serverFeatures(cnf *sshd.Config) []string {
+	var features []string
+	for name, on := range map[string]bool{
+		"git-http":           cnf.GitHTTPEnabled,
+		"image-warming":      cnf.WarmImages,
+		"scoped-hook-tokens": cnf.HookTokenMode != "" && cnf.HookTokenMode != "global",
+		"session-recording":  cnf.SessionRecording,
+		"ssh-proxy-protocol": cnf.SSHProxyProtocol,
+	} {
+		if on {
+			features = append(features, name)
+		}
+	}
+	return features
+}
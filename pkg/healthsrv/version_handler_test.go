@@ -0,0 +1,51 @@
+package healthsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/gitreceive"
+	"github.com/drycc/builder/pkg/sshd"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+func TestVersionHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "version-handler")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	catalog := filepath.Join(dir, "catalog.json")
+	assert.NoErr(t, ioutil.WriteFile(catalog, []byte(`{"stacks": [{"name": "heroku-20", "versions": [{"version": "20.1", "image": "drycc/slugrunner:20.1"}]}]}`), 0644))
+	cnf := &sshd.Config{BuilderVersion: "v1.2.3", BuilderCommit: "0123abcd", GitHTTPEnabled: true, HookTokenMode: "global"}
+	hookConf := func() (*gitreceive.Config, error) {
+		return &gitreceive.Config{StackCatalogPath: catalog, BuildKit: true, SignedPushes: "off"}, nil
+	}
+
+	w := httptest.NewRecorder()
+	versionHandler(cnf, hookConf).ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, w.Code, http.StatusOK, "response code")
+	var info versionInfo
+	assert.NoErr(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, info.Version, "v1.2.3", "version")
+	assert.Equal(t, info.Commit, "0123abcd", "commit")
+	assert.Equal(t, info.ControllerAPI.Min, drycc.APIVersion, "minimum controller API")
+	assert.Equal(t, info.Features, []string{"buildkit", "git-http"}, "features")
+	var stacked bool
+	for _, s := range info.Stacks {
+		if s.Name == "heroku-20" {
+			stacked = true
+			assert.Equal(t, s.Versions, []string{"20.1"}, "versions of heroku-20")
+		}
+	}
+	assert.True(t, stacked, "heroku-20 isn't a supported stack")
+
+	w = httptest.NewRecorder()
+	versionHandler(cnf, func() (*gitreceive.Config, error) { return nil, errors.New("invalid config") }).ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, w.Code, http.StatusServiceUnavailable, "response code without a config")
+}
@@ -1,8 +1,10 @@
 package k8s
 
 import (
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func NewInCluster() (*kubernetes.Clientset, error) {
@@ -18,3 +20,26 @@ func NewInCluster() (*kubernetes.Clientset, error) {
 	}
 	return clientset, nil
 }
+
+// NewDynamicInCluster returns a dynamic client for the cluster the builder runs in, for resources
+// that have no typed client, such as custom resources.
+func NewDynamicInCluster() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// NewForKubeconfig returns a client for the cluster of context in the kubeconfig file at path, or
+// of its current context if context is empty.
+func NewForKubeconfig(path, context string) (*kubernetes.Clientset, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
@@ -2,69 +2,195 @@ package k8s
 
 import (
 	"context"
-	"k8s.io/api/core/v1"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"time"
 )
 
 var (
 	resyncPeriod = 30 * time.Second
 )
 
-type StoreToPodLister struct {
-	cache.Store
+// PodTransition is a change of a pod seen by a PodWaiter: its creation, a change of its status or
+// its deletion.
+type PodTransition struct {
+	// Pod is the pod after the change, or its last known state if it was deleted.
+	Pod *v1.Pod
+	// From is the phase of the pod before the change, "" if the waiter didn't know the pod yet.
+	From v1.PodPhase
+	// To is the phase of the pod after the change, "" if it was deleted.
+	To v1.PodPhase
+}
+
+// Deleted returns true if the pod of t was deleted.
+func (t PodTransition) Deleted() bool {
+	return t.To == ""
+}
+
+// PodCondition returns true once a pod waited for with a PodWaiter reached the state waited for.
+// An error ends the wait.
+type PodCondition func(PodTransition) (bool, error)
+
+// podWait is a pending PodWaiter.Wait call.
+type podWait struct {
+	condition PodCondition
+	done      chan podWaitResult
+}
+
+type podWaitResult struct {
+	pod *v1.Pod
+	err error
+}
+
+// PodWaiter waits for the pods of a namespace to reach a state. It watches them with an informer
+// and evaluates the conditions waited for on every change of the pods, in order, so that no
+// transition goes unnoticed, however quick.
+type PodWaiter struct {
+	namespace  string
+	store      cache.Store
+	controller cache.Controller
+
+	mu      sync.Mutex
+	phases  map[string]v1.PodPhase
+	waiters map[string][]*podWait
+}
+
+// NewPodWaiter returns a PodWaiter of the pods in the namespace ns. It waits for nothing until it's
+// started with Start.
+func NewPodWaiter(c kubernetes.Interface, ns string) *PodWaiter {
+	return newPodWaiter(&cache.ListWatch{
+		ListFunc:  podListFunc(c, ns),
+		WatchFunc: podWatchFunc(c, ns),
+	}, ns)
+}
+
+func newPodWaiter(lw cache.ListerWatcher, ns string) *PodWaiter {
+	w := &PodWaiter{
+		namespace: ns,
+		phases:    make(map[string]v1.PodPhase),
+		waiters:   make(map[string][]*podWait),
+	}
+	w.store, w.controller = cache.NewInformer(lw, &v1.Pod{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				w.notify(pod, false)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				w.notify(pod, false)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				w.notify(pod, true)
+			}
+		},
+	})
+	return w
 }
 
-//PodWatcher is a struct which holds the return values of (k8s.io/kubernetes/pkg/controller/framework).NewIndexerInformer together.
-type PodWatcher struct {
-	Store      StoreToPodLister
-	Controller cache.Controller
+// Start watches the pods until ctx is done.
+func (w *PodWaiter) Start(ctx context.Context) {
+	go w.controller.Run(ctx.Done())
 }
 
-func (s *StoreToPodLister) List(selector labels.Selector) (pods []*v1.Pod, err error) {
-	// TODO: it'd be great to just call
-	// s.Pods(api.NamespaceAll).List(selector), however then we'd have to
-	// remake the list.Items as a []*api.Pod. So leave this separate for
-	// now.
-	for _, m := range s.Store.List() {
-		pod := m.(*v1.Pod)
-		if selector.Matches(labels.Set(pod.Labels)) {
-			pods = append(pods, pod)
+// notify evaluates the conditions waited for on pod, which changed or was deleted.
+func (w *PodWaiter) notify(pod *v1.Pod, deleted bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := PodTransition{Pod: pod, From: w.phases[pod.Name], To: pod.Status.Phase}
+	if deleted {
+		t.To = ""
+		delete(w.phases, pod.Name)
+	} else {
+		w.phases[pod.Name] = t.To
+	}
+	var pending []*podWait
+	for _, wait := range w.waiters[pod.Name] {
+		if !wait.evaluate(t) {
+			pending = append(pending, wait)
 		}
 	}
-	return pods, nil
+	w.setWaiters(pod.Name, pending)
 }
 
-//NewPodWatcher creates a new BuildPodWatcher useful to list the pods using a cache which gets updated based on the watch func.
-func NewPodWatcher(c kubernetes.Clientset, ns string) *PodWatcher {
-	pw := &PodWatcher{}
+// evaluate evaluates the condition of wait on t, and returns true if the wait is over.
+func (wait *podWait) evaluate(t PodTransition) bool {
+	done, err := wait.condition(t)
+	if !done && err == nil {
+		return false
+	}
+	wait.done <- podWaitResult{pod: t.Pod, err: err}
+	return true
+}
 
-	pw.Store.Store, pw.Controller = cache.NewIndexerInformer(
-		&cache.ListWatch{
-			ListFunc:  podListFunc(c, ns),
-			WatchFunc: podWatchFunc(c, ns),
-		},
-		&v1.Pod{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{},
-		cache.Indexers{},
-	)
-	return pw
+func (w *PodWaiter) setWaiters(name string, waiters []*podWait) {
+	if len(waiters) == 0 {
+		delete(w.waiters, name)
+	} else {
+		w.waiters[name] = waiters
+	}
+}
+
+// Wait waits for condition to be true for the pod name, and returns the pod in the state it was in
+// then. The condition is evaluated on the pod as currently known, if it is, then on each of its
+// transitions until ctx is done.
+func (w *PodWaiter) Wait(ctx context.Context, name string, condition PodCondition) (*v1.Pod, error) {
+	wait := &podWait{condition: condition, done: make(chan podWaitResult, 1)}
+	w.mu.Lock()
+	obj, exists, _ := w.store.GetByKey(w.namespace + "/" + name)
+	pod, ok := obj.(*v1.Pod)
+	if !exists || !ok || !wait.evaluate(PodTransition{Pod: pod, From: w.phases[name], To: pod.Status.Phase}) {
+		w.waiters[name] = append(w.waiters[name], wait)
+	}
+	w.mu.Unlock()
+
+	select {
+	case result := <-wait.done:
+		return result.pod, result.err
+	case <-ctx.Done():
+		w.mu.Lock()
+		var pending []*podWait
+		for _, other := range w.waiters[name] {
+			if other != wait {
+				pending = append(pending, other)
+			}
+		}
+		w.setWaiters(name, pending)
+		w.mu.Unlock()
+		// the condition may have been met while ctx was ending
+		select {
+		case result := <-wait.done:
+			return result.pod, result.err
+		default:
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out waiting for pod %s/%s", w.namespace, name)
+		}
+		return nil, ctx.Err()
+	}
 }
 
-func podListFunc(c kubernetes.Clientset, ns string) func(options metav1.ListOptions) (runtime.Object, error) {
+func podListFunc(c kubernetes.Interface, ns string) func(options metav1.ListOptions) (runtime.Object, error) {
 	return func(opts metav1.ListOptions) (runtime.Object, error) {
-		return c.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{})
+		return c.CoreV1().Pods(ns).List(context.TODO(), opts)
 	}
 }
 
-func podWatchFunc(c kubernetes.Clientset, ns string) func(options metav1.ListOptions) (watch.Interface, error) {
+func podWatchFunc(c kubernetes.Interface, ns string) func(options metav1.ListOptions) (watch.Interface, error) {
 	return func(opts metav1.ListOptions) (watch.Interface, error) {
-		return c.CoreV1().Pods(ns).Watch(context.TODO(), metav1.ListOptions{})
+		// the watch resumes from the version listed, for no change to be missed in between
+		return c.CoreV1().Pods(ns).Watch(context.TODO(), opts)
 	}
 }
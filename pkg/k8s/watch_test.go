@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testPod(name string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "drycc"},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+}
+
+// startWaiter starts a PodWaiter listing pods and watching w.
+func startWaiter(w *watch.FakeWatcher, pods ...v1.Pod) (*PodWaiter, func()) {
+	waiter := newPodWaiter(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.PodList{Items: pods}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return w, nil
+		},
+	}, "drycc")
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter.Start(ctx)
+	return waiter, cancel
+}
+
+// waitRegistered waits for a Wait call on the pod name to be registered with waiter.
+func waitRegistered(waiter *PodWaiter, name string) {
+	for {
+		waiter.mu.Lock()
+		registered := len(waiter.waiters[name]) > 0
+		waiter.mu.Unlock()
+		if registered {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPodWaiterTransitions(t *testing.T) {
+	w := watch.NewFake()
+	waiter, stop := startWaiter(w)
+	defer stop()
+
+	var transitions []PodTransition
+	done := make(chan error)
+	go func() {
+		_, err := waiter.Wait(context.Background(), "builder", func(tr PodTransition) (bool, error) {
+			transitions = append(transitions, tr)
+			return tr.To == v1.PodSucceeded, nil
+		})
+		done <- err
+	}()
+	waitRegistered(waiter, "builder")
+	// changes quicker than any polling
+	w.Add(testPod("other", v1.PodRunning))
+	w.Add(testPod("builder", v1.PodPending))
+	w.Modify(testPod("builder", v1.PodRunning))
+	w.Modify(testPod("builder", v1.PodSucceeded))
+	assert.NoErr(t, <-done)
+	assert.Equal(t, len(transitions), 3, "transitions")
+	assert.Equal(t, transitions[0].From, v1.PodPhase(""), "phase before the pod was known")
+	assert.Equal(t, transitions[1].From, v1.PodPending, "phase before running")
+	assert.Equal(t, transitions[2].To, v1.PodSucceeded, "last phase")
+}
+
+func TestPodWaiterKnownPod(t *testing.T) {
+	waiter, stop := startWaiter(watch.NewFake(), *testPod("builder", v1.PodFailed))
+	defer stop()
+
+	pod, err := waiter.Wait(context.Background(), "builder", func(tr PodTransition) (bool, error) {
+		if tr.To == v1.PodFailed {
+			return true, errors.New("failed")
+		}
+		return false, nil
+	})
+	assert.Err(t, err, errors.New("failed"))
+	assert.Equal(t, pod.Name, "builder", "pod")
+}
+
+func TestPodWaiterDeleted(t *testing.T) {
+	w := watch.NewFake()
+	waiter, stop := startWaiter(w, *testPod("builder", v1.PodRunning))
+	defer stop()
+
+	done := make(chan error)
+	go func() {
+		_, err := waiter.Wait(context.Background(), "builder", func(tr PodTransition) (bool, error) {
+			return tr.Deleted(), nil
+		})
+		done <- err
+	}()
+	waitRegistered(waiter, "builder")
+	w.Delete(testPod("builder", v1.PodRunning))
+	assert.NoErr(t, <-done)
+}
+
+func TestPodWaiterTimeout(t *testing.T) {
+	waiter, stop := startWaiter(watch.NewFake())
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := waiter.Wait(ctx, "builder", func(PodTransition) (bool, error) { return false, nil })
+	assert.Err(t, err, errors.New("timed out waiting for pod drycc/builder"))
+	assert.Equal(t, len(waiter.waiters), 0, "waiters left")
+}
@@ -0,0 +1,372 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaTypeManifest is the Docker image manifest, schema 2.
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// MediaTypeManifestList is the Docker multi-platform manifest list.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// MediaTypeOCIManifest is the OCI image manifest.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	// MediaTypeOCIIndex is the OCI multi-platform image index.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	digestHeader = "Docker-Content-Digest"
+)
+
+var manifestMediaTypes = []string{
+	MediaTypeManifest,
+	MediaTypeManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeOCIIndex,
+}
+
+// ErrNotFound is returned when the registry reports that an image doesn't exist.
+type ErrNotFound struct {
+	Ref string
+}
+
+// Error is the error interface implementation.
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("image %s was not found in the registry", e.Ref)
+}
+
+// Descriptor references content stored in a registry.
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform describes the OS and architecture an image in a manifest list runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns p in the os/architecture[/variant] format of --platform flags, e.g. linux/arm64.
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// ParsePlatform parses a platform in the os/architecture[/variant] format, e.g. linux/arm64 or
+// linux/arm/v7.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q, use os/architecture[/variant]", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q, use os/architecture[/variant]", s)
+		}
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// Manifest is either an image manifest or a manifest list, depending on MediaType.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config,omitempty"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	Manifests     []Descriptor `json:"manifests,omitempty"`
+}
+
+// IsList returns true if m is a manifest list or an OCI index.
+func (m Manifest) IsList() bool {
+	return m.MediaType == MediaTypeManifestList || m.MediaType == MediaTypeOCIIndex || len(m.Manifests) > 0
+}
+
+// ImageConfig is the part of the image configuration blob the builder cares about.
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Labels       map[string]string   `json:"Labels"`
+	} `json:"config"`
+}
+
+// Client talks to Docker V2 registries.
+type Client struct {
+	HTTPClient *http.Client
+	// Username and Password are optional basic credentials, used both directly and to obtain
+	// bearer tokens from the registry's token service.
+	Username string
+	Password string
+	// Insecure makes the client talk plain HTTP to the registry.
+	Insecure bool
+	// Platform selects the image to use when a reference points at a manifest list.
+	Platform Platform
+
+	tokens map[string]string
+}
+
+// NewClient returns a Client with the given credentials, selecting linux/amd64 images from
+// manifest lists.
+func NewClient(username, password string, insecure bool) *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		Username:   username,
+		Password:   password,
+		Insecure:   insecure,
+		Platform:   Platform{OS: "linux", Architecture: "amd64"},
+		tokens:     make(map[string]string),
+	}
+}
+
+func (c *Client) url(ref Reference, format string, args ...interface{}) string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.Host, ref.Repository, fmt.Sprintf(format, args...))
+}
+
+// Manifest fetches the manifest ref points to, returning it along with its digest.
+func (c *Client) Manifest(ref Reference) (*Manifest, string, error) {
+	raw, mediaType, digest, err := c.RawManifest(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest := new(Manifest)
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, "", fmt.Errorf("decoding manifest for %s (%s)", ref, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaType
+	}
+	return manifest, digest, nil
+}
+
+// RawManifest fetches the manifest ref points to as it's stored in the registry, returning it
+// along with its media type and digest.
+func (c *Client) RawManifest(ref Reference) ([]byte, string, string, error) {
+	res, err := c.do("GET", c.url(ref, "manifests/%s", ref.Object()), ref, manifestMediaTypes, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("reading manifest for %s (%s)", ref, err)
+	}
+	return raw, strings.Split(res.Header.Get("Content-Type"), ";")[0], res.Header.Get(digestHeader), nil
+}
+
+// ImageManifest behaves like Manifest but resolves manifest lists to the manifest of the image
+// matching c.Platform.
+func (c *Client) ImageManifest(ref Reference) (*Manifest, string, error) {
+	manifest, digest, err := c.Manifest(ref)
+	if err != nil || !manifest.IsList() {
+		return manifest, digest, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == c.Platform.OS && desc.Platform.Architecture == c.Platform.Architecture {
+			byDigest := ref
+			byDigest.Tag, byDigest.Digest = "", desc.Digest
+			return c.Manifest(byDigest)
+		}
+	}
+	return nil, "", fmt.Errorf("image %s has no %s/%s variant", ref, c.Platform.OS, c.Platform.Architecture)
+}
+
+// ImageConfig fetches the configuration of the image ref points to.
+func (c *Client) ImageConfig(ref Reference) (*ImageConfig, error) {
+	manifest, _, err := c.ImageManifest(ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.Blob(ref, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	config := new(ImageConfig)
+	if err := json.NewDecoder(rc).Decode(config); err != nil {
+		return nil, fmt.Errorf("decoding image config for %s (%s)", ref, err)
+	}
+	return config, nil
+}
+
+// Blob returns the content of the blob with the given digest in ref's repository. Callers must
+// close the returned reader.
+func (c *Client) Blob(ref Reference, digest string) (io.ReadCloser, error) {
+	res, err := c.do("GET", c.url(ref, "blobs/%s", digest), ref, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// do performs a request against the registry, authenticating and retrying once if the registry
+// asks for it.
+func (c *Client) do(method, rawurl string, ref Reference, accept []string, body io.Reader) (*http.Response, error) {
+	header := make(http.Header)
+	for _, mt := range accept {
+		header.Add("Accept", mt)
+	}
+	return c.send(method, rawurl, ref, header, body)
+}
+
+// send performs a request with the given headers against the registry, authenticating and
+// retrying once if the registry asks for it. Bodies are only resent if they implement io.Seeker.
+func (c *Client) send(method, rawurl string, ref Reference, header http.Header, body io.Reader) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, rawurl, body)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		// net/http only sends the length of bodies it knows the size of
+		if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			req.ContentLength = size
+		}
+		if token, ok := c.tokens[ref.Name()]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if c.Username != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		return c.HTTPClient.Do(req)
+	}
+	res, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		if err := c.authenticate(ref, challenge); err != nil {
+			return nil, err
+		}
+		if seeker, ok := body.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		if res, err = send(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound{Ref: ref.String()}
+	case res.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %d (%s)", method, rawurl, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+// authenticate obtains a bearer token for ref's repository from the token service named in the
+// given WWW-Authenticate challenge.
+func (c *Client) authenticate(ref Reference, challenge string) error {
+	params := parseChallenge(challenge)
+	realm, ok := params["realm"]
+	if !ok {
+		return fmt.Errorf("registry %s rejected the credentials for %s", ref.Host, ref)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid token realm %s (%s)", realm, err)
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	scope, ok := params["scope"]
+	if !ok {
+		scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("token service %s returned %d for %s", realm, res.StatusCode, ref)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return fmt.Errorf("decoding token from %s (%s)", realm, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[ref.Name()] = token.Token
+	return nil
+}
+
+// parseChallenge parses the parameters of a `Bearer realm="...",service="..."` challenge.
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	if i := strings.Index(challenge, " "); i != -1 {
+		challenge = challenge[i+1:]
+	}
+	for challenge != "" {
+		eq := strings.Index(challenge, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(challenge[:eq]))
+		challenge = challenge[eq+1:]
+		var value string
+		if strings.HasPrefix(challenge, `"`) {
+			end := strings.Index(challenge[1:], `"`)
+			if end == -1 {
+				value, challenge = challenge[1:], ""
+			} else {
+				value, challenge = challenge[1:end+1], challenge[end+2:]
+			}
+		} else if comma := strings.Index(challenge, ","); comma != -1 {
+			value, challenge = challenge[:comma], challenge[comma:]
+		} else {
+			value, challenge = challenge, ""
+		}
+		params[key] = value
+		challenge = strings.TrimLeft(challenge, ", ")
+	}
+	return params
+}
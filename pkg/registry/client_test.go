@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+const (
+	configDigest   = "sha256:c0ffee"
+	manifestDigest = "sha256:beef"
+	configFixture  = `{"architecture":"amd64","os":"linux","config":{"Entrypoint":["/bin/app"],"Cmd":["serve"],"ExposedPorts":{"8080/tcp":{}},"Labels":{"foo":"bar"}}}`
+)
+
+type fakeRegistry struct {
+	token string
+}
+
+func (f fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		fmt.Fprintf(w, `{"token":"%s"}`, f.token)
+		return
+	}
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/v2/org/app/manifests/list":
+		w.Header().Set("Content-Type", MediaTypeManifestList)
+		fmt.Fprintf(w, `{"schemaVersion":2,"manifests":[{"digest":"sha256:arm","platform":{"os":"linux","architecture":"arm64"}},{"digest":"%s","platform":{"os":"linux","architecture":"amd64"}}]}`, manifestDigest)
+	case "/v2/org/app/manifests/v1", "/v2/org/app/manifests/" + manifestDigest:
+		w.Header().Set("Content-Type", MediaTypeManifest)
+		w.Header().Set(digestHeader, manifestDigest)
+		fmt.Fprintf(w, `{"schemaVersion":2,"mediaType":"%s","config":{"digest":"%s"}}`, MediaTypeManifest, configDigest)
+	case "/v2/org/app/blobs/" + configDigest:
+		fmt.Fprint(w, configFixture)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testRef(t *testing.T, srv *httptest.Server, ref string) Reference {
+	r, err := ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/" + ref)
+	assert.NoErr(t, err)
+	return *r
+}
+
+func TestManifest(t *testing.T) {
+	srv := httptest.NewServer(fakeRegistry{})
+	defer srv.Close()
+	c := NewClient("", "", true)
+
+	manifest, digest, err := c.Manifest(testRef(t, srv, "org/app:v1"))
+	assert.NoErr(t, err)
+	assert.Equal(t, digest, manifestDigest, "manifest digest")
+	assert.Equal(t, manifest.Config.Digest, configDigest, "config digest")
+	assert.False(t, manifest.IsList(), "manifest is a list")
+
+	_, _, err = c.Manifest(testRef(t, srv, "org/app:missing"))
+	if _, ok := err.(ErrNotFound); !ok {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestImageConfigFromList(t *testing.T) {
+	srv := httptest.NewServer(fakeRegistry{token: "secret"})
+	defer srv.Close()
+	c := NewClient("user", "pass", true)
+
+	config, err := c.ImageConfig(testRef(t, srv, "org/app:list"))
+	assert.NoErr(t, err)
+	assert.Equal(t, config.Config.Entrypoint, []string{"/bin/app"}, "entrypoint")
+	assert.Equal(t, config.Config.Cmd, []string{"serve"}, "cmd")
+	assert.Equal(t, config.Config.Labels["foo"], "bar", "label")
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	assert.Equal(t, params["realm"], "https://auth.docker.io/token", "realm")
+	assert.Equal(t, params["service"], "registry.docker.io", "service")
+	assert.Equal(t, params["scope"], "repository:library/alpine:pull", "scope")
+}
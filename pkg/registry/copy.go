@@ -0,0 +1,234 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ErrDigestMismatch is returned when content read from a registry doesn't match its digest.
+type ErrDigestMismatch struct {
+	Ref      string
+	Expected string
+	Actual   string
+}
+
+// Error is the error interface implementation.
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch for %s: expected %s, got %s", e.Ref, e.Expected, e.Actual)
+}
+
+// Digest returns the digest of content, in the sha256:<hex> format registries use.
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// HasBlob returns true if ref's repository has the blob with the given digest.
+func (c *Client) HasBlob(ref Reference, digest string) (bool, error) {
+	res, err := c.do("HEAD", c.url(ref, "blobs/%s", digest), ref, nil, nil)
+	if _, ok := err.(ErrNotFound); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return true, nil
+}
+
+// PutBlob uploads size bytes read from r as the blob with the given digest to ref's repository,
+// in a single request. A size of 0 means the size is unknown.
+func (c *Client) PutBlob(ref Reference, digest string, size int64, r io.Reader) error {
+	uploadURL := c.url(ref, "blobs/uploads/")
+	res, err := c.do("POST", uploadURL, ref, nil, nil)
+	if err != nil {
+		return fmt.Errorf("starting the upload of %s to %s (%s)", digest, ref.Name(), err)
+	}
+	res.Body.Close()
+	base, err := url.Parse(uploadURL)
+	if err != nil {
+		return err
+	}
+	location, err := base.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q (%s)", res.Header.Get("Location"), err)
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/octet-stream")
+	if size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	res, err = c.send("PUT", location.String(), ref, header, r)
+	if err != nil {
+		return fmt.Errorf("uploading %s to %s (%s)", digest, ref.Name(), err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// PutManifest uploads the manifest raw, of the given media type, as ref.
+func (c *Client) PutManifest(ref Reference, mediaType string, raw []byte) error {
+	header := make(http.Header)
+	header.Set("Content-Type", mediaType)
+	res, err := c.send("PUT", c.url(ref, "manifests/%s", ref.Object()), ref, header, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("uploading the manifest of %s (%s)", ref, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Copy copies the image src points to from the registry c talks to, to dst in the registry to
+// talks to. Blobs that dst's repository already has aren't copied again. Every blob and the
+// manifest are checked against their digest on the way, and the digest of the copied manifest is
+// returned.
+func Copy(c *Client, src Reference, to *Client, dst Reference) (string, error) {
+	_, digest, err := c.ImageManifest(src)
+	if err != nil {
+		return "", err
+	}
+	return copyImage(c, src, digest, to, dst)
+}
+
+// CopyIndex behaves like Copy, but copies every image of the manifest list src points to, then
+// the list itself, so that dst runs on the same platforms. Images that aren't in a list are copied
+// as Copy does.
+func CopyIndex(c *Client, src Reference, to *Client, dst Reference) (string, error) {
+	raw, mediaType, digest, err := c.RawManifest(src)
+	if err != nil {
+		return "", err
+	}
+	if actual := Digest(raw); digest != "" && actual != digest {
+		return "", ErrDigestMismatch{Ref: src.String(), Expected: digest, Actual: actual}
+	}
+	index := new(Manifest)
+	if err := json.Unmarshal(raw, index); err != nil {
+		return "", fmt.Errorf("decoding manifest for %s (%s)", src, err)
+	}
+	if index.MediaType == "" {
+		index.MediaType = mediaType
+	}
+	if !index.IsList() {
+		return Copy(c, src, to, dst)
+	}
+	for _, desc := range index.Manifests {
+		image := dst
+		image.Tag, image.Digest = "", desc.Digest
+		if _, err := copyImage(c, src, desc.Digest, to, image); err != nil {
+			return "", err
+		}
+	}
+	if err := to.PutManifest(dst, index.MediaType, raw); err != nil {
+		return "", err
+	}
+	return Digest(raw), nil
+}
+
+// PutIndex uploads, as dst, the manifest list of the images images point to in the registry c
+// talks to, each running on the platform of the same index. The list is an OCI index if the images
+// are OCI manifests. It returns the list and its digest.
+func (c *Client) PutIndex(dst Reference, platforms []Platform, images []Reference) (*Manifest, string, error) {
+	index := &Manifest{SchemaVersion: 2, MediaType: MediaTypeManifestList}
+	for i, image := range images {
+		raw, mediaType, digest, err := c.RawManifest(image)
+		if err != nil {
+			return nil, "", err
+		}
+		if digest == "" {
+			digest = Digest(raw)
+		}
+		if mediaType == MediaTypeOCIManifest {
+			index.MediaType = MediaTypeOCIIndex
+		}
+		platform := platforms[i]
+		index.Manifests = append(index.Manifests, Descriptor{MediaType: mediaType, Size: int64(len(raw)), Digest: digest, Platform: &platform})
+	}
+	// the config and layers of image manifests don't belong in lists
+	raw, err := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []Descriptor `json:"manifests"`
+	}{index.SchemaVersion, index.MediaType, index.Manifests})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := c.PutManifest(dst, index.MediaType, raw); err != nil {
+		return nil, "", err
+	}
+	return index, Digest(raw), nil
+}
+
+// copyImage copies the image manifest of src with the given digest, or the one src points to if
+// digest is empty, and its blobs, to dst.
+func copyImage(c *Client, src Reference, digest string, to *Client, dst Reference) (string, error) {
+	byDigest := src
+	if digest != "" {
+		byDigest.Tag, byDigest.Digest = "", digest
+	}
+	raw, mediaType, _, err := c.RawManifest(byDigest)
+	if err != nil {
+		return "", err
+	}
+	if actual := Digest(raw); digest != "" && actual != digest {
+		return "", ErrDigestMismatch{Ref: src.String(), Expected: digest, Actual: actual}
+	}
+	manifest := new(Manifest)
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return "", fmt.Errorf("decoding manifest for %s (%s)", src, err)
+	}
+
+	for _, desc := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := copyBlob(c, src, to, dst, desc); err != nil {
+			return "", err
+		}
+	}
+	if err := to.PutManifest(dst, mediaType, raw); err != nil {
+		return "", err
+	}
+	return Digest(raw), nil
+}
+
+// copyBlob copies the blob desc describes from src's repository to dst's, unless dst's already
+// has it.
+func copyBlob(c *Client, src Reference, to *Client, dst Reference, desc Descriptor) error {
+	exists, err := to.HasBlob(dst, desc.Digest)
+	if err != nil || exists {
+		return err
+	}
+	rc, err := c.Blob(src, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if err := to.PutBlob(dst, desc.Digest, desc.Size, &digestReader{r: rc, h: h}); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != desc.Digest {
+		return ErrDigestMismatch{Ref: src.Name() + "@" + desc.Digest, Expected: desc.Digest, Actual: actual}
+	}
+	return nil
+}
+
+// digestReader hashes everything read through it.
+type digestReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	return n, err
+}
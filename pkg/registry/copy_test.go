@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+// memRegistry is a registry that keeps blobs and manifests in memory, accepting monolithic
+// uploads.
+type memRegistry struct {
+	mut       sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   int
+}
+
+func newMemRegistry() *memRegistry {
+	return &memRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+}
+
+func (m *memRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	path := strings.TrimPrefix(r.URL.Path, "/v2/org/app/")
+	switch {
+	case strings.HasPrefix(path, "blobs/uploads/") && r.Method == "POST":
+		w.Header().Set("Location", "/v2/org/app/blobs/uploads/1")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(path, "blobs/uploads/") && r.Method == "PUT":
+		digest := r.URL.Query().Get("digest")
+		if Digest(body) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.blobs[digest] = body
+		m.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "blobs/"):
+		blob, ok := m.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	case strings.HasPrefix(path, "manifests/") && r.Method == "PUT":
+		m.manifests[strings.TrimPrefix(path, "manifests/")] = body
+		m.manifests[Digest(body)] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "manifests/"):
+		manifest, ok := m.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeManifest)
+		w.Header().Set(digestHeader, Digest(manifest))
+		w.Write(manifest)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := newMemRegistry(), newMemRegistry()
+	config, layer := []byte(configFixture), []byte("layer")
+	src.blobs[Digest(config)] = config
+	src.blobs[Digest(layer)] = layer
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"digest":"%s","size":%d},"layers":[{"digest":"%s","size":%d}]}`,
+		MediaTypeManifest, Digest(config), len(config), Digest(layer), len(layer)))
+	src.manifests["v1"] = manifest
+	src.manifests[Digest(manifest)] = manifest
+	// the destination already has the layer, so only the config is uploaded
+	dst.blobs[Digest(layer)] = layer
+
+	srcSrv, dstSrv := httptest.NewServer(src), httptest.NewServer(dst)
+	defer srcSrv.Close()
+	defer dstSrv.Close()
+	c := NewClient("", "", true)
+
+	digest, err := Copy(c, testRef(t, srcSrv, "org/app:v1"), c, testRef(t, dstSrv, "org/app:v2"))
+	assert.NoErr(t, err)
+	assert.Equal(t, digest, Digest(manifest), "manifest digest")
+	assert.Equal(t, dst.uploads, 1, "uploaded blobs")
+	assert.Equal(t, string(dst.blobs[Digest(config)]), configFixture, "copied config")
+	assert.Equal(t, string(dst.manifests["v2"]), string(manifest), "copied manifest")
+
+	// a corrupted blob is never pushed
+	src.blobs[Digest(config)] = []byte("corrupted")
+	delete(dst.blobs, Digest(config))
+	_, err = Copy(c, testRef(t, srcSrv, "org/app:v1"), c, testRef(t, dstSrv, "org/app:v3"))
+	assert.True(t, err != nil, "copying a corrupted blob succeeded")
+	_, ok := dst.manifests["v3"]
+	assert.False(t, ok, "manifest pushed despite a corrupted blob")
+}
+
+func TestPutAndCopyIndex(t *testing.T) {
+	src, dst := newMemRegistry(), newMemRegistry()
+	var images []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := []byte(fmt.Sprintf(`{"architecture":"%s","os":"linux"}`, arch))
+		src.blobs[Digest(config)] = config
+		manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"digest":"%s","size":%d}}`, MediaTypeManifest, Digest(config), len(config)))
+		src.manifests["v1-"+arch] = manifest
+		src.manifests[Digest(manifest)] = manifest
+		images = append(images, Digest(manifest))
+	}
+	srcSrv, dstSrv := httptest.NewServer(src), httptest.NewServer(dst)
+	defer srcSrv.Close()
+	defer dstSrv.Close()
+	c := NewClient("", "", true)
+
+	platforms := []Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	index, digest, err := c.PutIndex(testRef(t, srcSrv, "org/app:v1"), platforms,
+		[]Reference{testRef(t, srcSrv, "org/app:v1-amd64"), testRef(t, srcSrv, "org/app:v1-arm64")})
+	assert.NoErr(t, err)
+	assert.Equal(t, digest, Digest(src.manifests["v1"]), "index digest")
+	assert.Equal(t, index.MediaType, MediaTypeManifestList, "media type")
+	assert.Equal(t, len(index.Manifests), 2, "images")
+	assert.Equal(t, index.Manifests[1].Digest, images[1], "digest of the arm64 image")
+	assert.Equal(t, index.Manifests[1].Platform.String(), "linux/arm64", "platform")
+	assert.False(t, strings.Contains(string(src.manifests["v1"]), `"config"`), "index with a config")
+
+	// every image of the index is copied along with it
+	copied, err := CopyIndex(c, testRef(t, srcSrv, "org/app:v1"), c, testRef(t, dstSrv, "org/app:v1"))
+	assert.NoErr(t, err)
+	assert.Equal(t, copied, digest, "copied index digest")
+	for _, image := range images {
+		_, ok := dst.manifests[image]
+		assert.True(t, ok, "image "+image+" wasn't copied")
+	}
+	assert.Equal(t, dst.uploads, 2, "uploaded configs")
+
+	// images outside of an index are copied as they are
+	copied, err = CopyIndex(c, testRef(t, srcSrv, "org/app:v1-arm64"), c, testRef(t, dstSrv, "org/app:v2"))
+	assert.NoErr(t, err)
+	assert.Equal(t, copied, images[1], "copied image digest")
+}
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm/v7")
+	assert.NoErr(t, err)
+	assert.Equal(t, p, Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "platform")
+	assert.Equal(t, p.String(), "linux/arm/v7", "string")
+	for _, invalid := range []string{"linux", "linux/", "linux/arm/v7/extra"} {
+		_, err := ParsePlatform(invalid)
+		assert.True(t, err != nil, "parsed "+invalid)
+	}
+}
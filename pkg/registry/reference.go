@@ -0,0 +1,97 @@
+// Package registry implements the small subset of the Docker Registry HTTP API V2 that the
+// builder needs to inspect images that it did not build itself.
+//
+// See https://docs.docker.com/registry/spec/api/
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultHost is the registry used for references that don't name one.
+	DefaultHost = "registry-1.docker.io"
+	defaultTag  = "latest"
+)
+
+// ErrInvalidReference is returned by ParseReference if the given image reference is malformed.
+type ErrInvalidReference struct {
+	ref string
+}
+
+// Error is the error interface implementation.
+func (e ErrInvalidReference) Error() string {
+	return fmt.Sprintf("image reference %s was invalid", e.ref)
+}
+
+// Reference is a parsed image reference such as quay.io/drycc/example-go:v1.
+type Reference struct {
+	// Host is the registry host, including the port if there is one.
+	Host string
+	// Repository is the repository path inside the registry.
+	Repository string
+	// Tag is the image tag. It's empty if the reference was made by digest.
+	Tag string
+	// Digest is the image digest. It's empty if the reference was made by tag.
+	Digest string
+}
+
+// ParseReference parses ref into a Reference. References without a registry host use
+// DefaultHost and references without a tag or digest use the "latest" tag.
+func ParseReference(ref string) (*Reference, error) {
+	if ref == "" || strings.ContainsAny(ref, " \t\n") {
+		return nil, ErrInvalidReference{ref: ref}
+	}
+	r := &Reference{Host: DefaultHost}
+	rest := ref
+	if i := strings.Index(rest, "/"); i != -1 {
+		first := rest[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.Host = first
+			rest = rest[i+1:]
+		}
+	}
+	if i := strings.Index(rest, "@"); i != -1 {
+		r.Digest = rest[i+1:]
+		rest = rest[:i]
+		if !strings.Contains(r.Digest, ":") {
+			return nil, ErrInvalidReference{ref: ref}
+		}
+	} else if i := strings.LastIndex(rest, ":"); i != -1 {
+		r.Tag = rest[i+1:]
+		rest = rest[:i]
+	}
+	if rest == "" || (r.Digest == "" && r.Tag == "" && strings.HasSuffix(ref, ":")) {
+		return nil, ErrInvalidReference{ref: ref}
+	}
+	if r.Digest == "" && r.Tag == "" {
+		r.Tag = defaultTag
+	}
+	if r.Host == DefaultHost && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	r.Repository = rest
+	return r, nil
+}
+
+// Name returns the reference without its tag or digest.
+func (r Reference) Name() string {
+	return r.Host + "/" + r.Repository
+}
+
+// Object returns the tag or digest the reference points to, suitable for use in a manifest URL.
+func (r Reference) Object() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String is the fmt.Stringer interface implementation.
+func (r Reference) String() string {
+	if r.Digest != "" {
+		return r.Name() + "@" + r.Digest
+	}
+	return r.Name() + ":" + r.Tag
+}
@@ -0,0 +1,44 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+type referenceCase struct {
+	ref      string
+	expected Reference
+}
+
+func TestParseReference(t *testing.T) {
+	cases := []referenceCase{
+		{"alpine", Reference{Host: DefaultHost, Repository: "library/alpine", Tag: "latest"}},
+		{"drycc/example-go:v1", Reference{Host: DefaultHost, Repository: "drycc/example-go", Tag: "v1"}},
+		{"quay.io/drycc/example-go:v1", Reference{Host: "quay.io", Repository: "drycc/example-go", Tag: "v1"}},
+		{"localhost:5000/example", Reference{Host: "localhost:5000", Repository: "example", Tag: "latest"}},
+		{"10.0.0.1:5000/org/example@sha256:abcd", Reference{Host: "10.0.0.1:5000", Repository: "org/example", Digest: "sha256:abcd"}},
+		{"[fd00::1]:5000/example:v2", Reference{Host: "[fd00::1]:5000", Repository: "example", Tag: "v2"}},
+	}
+	for _, c := range cases {
+		ref, err := ParseReference(c.ref)
+		assert.NoErr(t, err)
+		assert.Equal(t, *ref, c.expected, "reference "+c.ref)
+	}
+
+	for _, bad := range []string{"", "foo bar", "example@abcd", "example:"} {
+		if _, err := ParseReference(bad); err == nil {
+			t.Errorf("expected parsing %q to fail", bad)
+		}
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	ref, err := ParseReference("quay.io/drycc/example-go")
+	assert.NoErr(t, err)
+	assert.Equal(t, ref.String(), "quay.io/drycc/example-go:latest", "reference string")
+	assert.Equal(t, ref.Object(), "latest", "reference object")
+	ref.Digest = "sha256:abcd"
+	assert.Equal(t, ref.String(), "quay.io/drycc/example-go@sha256:abcd", "reference string")
+	assert.Equal(t, ref.Object(), "sha256:abcd", "reference object")
+}
@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// TokenAccess is the access to a repository a token grants, e.g. the pull and push actions.
+type TokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// TokenClaims are the claims of a token of the Docker registry token authentication.
+type TokenClaims struct {
+	Issuer     string        `json:"iss"`
+	Subject    string        `json:"sub"`
+	Audience   string        `json:"aud"`
+	Expiration int64         `json:"exp"`
+	NotBefore  int64         `json:"nbf"`
+	IssuedAt   int64         `json:"iat"`
+	JWTID      string        `json:"jti"`
+	Access     []TokenAccess `json:"access"`
+}
+
+// TokenSigner signs the tokens registries with token authentication accept, as their token
+// service would, with a key whose certificate is in the root certificate bundle of the registry.
+type TokenSigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+}
+
+// LoadTokenSigner returns the signer of the PEM encoded EC or RSA private key at path.
+func LoadTokenSigner(path string) (*TokenSigner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key in %s", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing the key in %s (%s)", path, err)
+	}
+	return NewTokenSigner(key)
+}
+
+// NewTokenSigner returns the signer of key, an *ecdsa.PrivateKey or an *rsa.PrivateKey.
+func NewTokenSigner(key interface{}) (*TokenSigner, error) {
+	s := new(TokenSigner)
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			s.alg = "ES256"
+		case elliptic.P384():
+			s.alg = "ES384"
+		case elliptic.P521():
+			s.alg = "ES512"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		s.key = k
+	case *rsa.PrivateKey:
+		s.alg, s.key = "RS256", k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	s.kid = keyID(der)
+	return s, nil
+}
+
+// keyID returns the ID registries know the public key der by: the first 240 bits of its SHA-256
+// digest, in groups of 4 base32 characters.
+func keyID(der []byte) string {
+	digest := sha256.Sum256(der)
+	encoded := base32.StdEncoding.EncodeToString(digest[:30])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// Sign returns claims as a signed JSON Web Token.
+func (s *TokenSigner) Sign(claims TokenClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": s.alg, "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch key := s.key.(type) {
+	case *ecdsa.PrivateKey:
+		signature, err = signECDSA(key, []byte(signed))
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signECDSA signs data with key, hashed as its curve requires, as the concatenation of r and s.
+func signECDSA(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	var digest []byte
+	switch key.Curve {
+	case elliptic.P256():
+		d := sha256.Sum256(data)
+		digest = d[:]
+	case elliptic.P384():
+		d := sha512.Sum384(data)
+		digest = d[:]
+	default:
+		d := sha512.Sum512(data)
+		digest = d[:]
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[size-len(rb):size], rb)
+	copy(signature[2*size-len(sb):], sb)
+	return signature, nil
+}
+
+// RepositoryToken returns a token of issuer for service, the registry, granting subject the
+// actions on repository from now until ttl elapsed.
+func (s *TokenSigner) RepositoryToken(issuer, service, subject, repository string, actions []string, ttl time.Duration, now time.Time) (string, error) {
+	jti, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+	return s.Sign(TokenClaims{
+		Issuer:     issuer,
+		Subject:    subject,
+		Audience:   service,
+		Expiration: now.Add(ttl).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      jti.Text(36),
+		Access:     []TokenAccess{{Type: "repository", Name: repository, Actions: actions}},
+	})
+}
+
+// UseToken makes c authenticate to the repository of ref with token, instead of obtaining one
+// from the token service of the registry.
+func (c *Client) UseToken(ref Reference, token string) {
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[ref.Name()] = token
+}
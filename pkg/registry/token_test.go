@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+// decodeToken returns the header, the claims and the signed part and signature of token.
+func decodeToken(t *testing.T, token string) (map[string]string, TokenClaims, []byte, []byte) {
+	parts := strings.Split(token, ".")
+	assert.Equal(t, len(parts), 3, "token parts")
+	var header map[string]string
+	var claims TokenClaims
+	for i, v := range []interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		assert.NoErr(t, err)
+		assert.NoErr(t, json.Unmarshal(data, v))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.NoErr(t, err)
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature
+}
+
+func TestRepositoryTokenECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoErr(t, err)
+	signer, err := NewTokenSigner(key)
+	assert.NoErr(t, err)
+
+	now := time.Unix(1600000000, 0)
+	token, err := signer.RepositoryToken("drycc-builder", "drycc-registry", "alice", "myapp", []string{"pull", "push"}, time.Hour, now)
+	assert.NoErr(t, err)
+	header, claims, signed, signature := decodeToken(t, token)
+	assert.Equal(t, header["alg"], "ES256", "algorithm")
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoErr(t, err)
+	assert.Equal(t, header["kid"], keyID(der), "key ID")
+	assert.Equal(t, len(strings.Split(header["kid"], ":")), 12, "key ID groups")
+	assert.Equal(t, claims.Issuer, "drycc-builder", "issuer")
+	assert.Equal(t, claims.Audience, "drycc-registry", "audience")
+	assert.Equal(t, claims.Subject, "alice", "subject")
+	assert.Equal(t, claims.Expiration, now.Add(time.Hour).Unix(), "expiration")
+	assert.Equal(t, claims.Access, []TokenAccess{{Type: "repository", Name: "myapp", Actions: []string{"pull", "push"}}}, "access")
+	assert.True(t, claims.JWTID != "", "the token has no ID")
+
+	digest := sha256.Sum256(signed)
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s), "invalid signature")
+}
+
+func TestLoadTokenSignerRSA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-token")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoErr(t, err)
+	path := filepath.Join(dir, "tls.key")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.NoErr(t, ioutil.WriteFile(path, data, 0600))
+
+	signer, err := LoadTokenSigner(path)
+	assert.NoErr(t, err)
+	token, err := signer.Sign(TokenClaims{Issuer: "drycc-builder"})
+	assert.NoErr(t, err)
+	header, _, signed, signature := decodeToken(t, token)
+	assert.Equal(t, header["alg"], "RS256", "algorithm")
+	digest := sha256.Sum256(signed)
+	assert.NoErr(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = LoadTokenSigner(path)
+	assert.True(t, err != nil, "a file without a key was loaded")
+}
@@ -0,0 +1,287 @@
+// Package release keeps track of releases that the builder couldn't publish to the controller
+// because it was unavailable, and publishes them once it's back.
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/builder/pkg/controller"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/pkg/log"
+)
+
+// PendingPrefix is the object storage prefix under which pending releases are stored.
+const PendingPrefix = "/releases/pending"
+
+// Request is a build that was completed but still needs to be published to the controller.
+type Request struct {
+	Username   string          `json:"username"`
+	App        string          `json:"app"`
+	Image      string          `json:"image"`
+	Stack      string          `json:"stack"`
+	Sha        string          `json:"sha"`
+	Procfile   api.ProcessType `json:"procfile"`
+	Dockerfile bool            `json:"dockerfile"`
+	// Config holds config defaults to set on the app along with the release, for the keys it
+	// doesn't have yet.
+	Config map[string]string `json:"config,omitempty"`
+	// Secrets are the keys of Config whose values are generated secrets, which are never stored in
+	// the queue.
+	Secrets   []string  `json:"-"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+
+	// Annotations trace the release back to its build, for the controller to set on its pods.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Strategy is how the controller rolls the release out, e.g. canary, or "" for its default.
+	Strategy string `json:"strategy,omitempty"`
+	// SlugRunner is the slugrunner image the app pinned its slugs to run with, or "" for the
+	// controller's default.
+	SlugRunner string `json:"slugrunner,omitempty"`
+}
+
+// Key returns the object storage key r is stored under. An app has one pending release at most,
+// so a newer build replaces an older pending one rather than being rolled back by it.
+func (r Request) Key() string {
+	return pendingKey(r.App)
+}
+
+// pendingKey returns the object storage key of the pending release of app.
+func pendingKey(app string) string {
+	return path.Join(PendingPrefix, app+".json")
+}
+
+// Store is the subset of a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// the queue needs.
+type Store interface {
+	GetContent(ctx context.Context, path string) ([]byte, error)
+	PutContent(ctx context.Context, path string, content []byte) error
+	List(ctx context.Context, path string) ([]string, error)
+	Delete(ctx context.Context, path string) error
+}
+
+// Enqueue durably stores r so it gets published once the controller is available again, without
+// its secrets.
+func Enqueue(store Store, r Request) error {
+	if r.Queued.IsZero() {
+		r.Queued = time.Now().UTC()
+	}
+	if len(r.Secrets) > 0 {
+		config := make(map[string]string, len(r.Config))
+		for k, v := range r.Config {
+			config[k] = v
+		}
+		for _, k := range r.Secrets {
+			delete(config, k)
+		}
+		r.Config, r.Secrets = config, nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return store.PutContent(context.Background(), r.Key(), data)
+}
+
+// Drop removes the pending release of app, if it has one, once a newer release was published
+// or the app was deleted.
+func Drop(store Store, app string) error {
+	err := store.Delete(context.Background(), pendingKey(app))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Pending returns all queued requests.
+func Pending(store Store) ([]Request, error) {
+	keys, err := store.List(context.Background(), PendingPrefix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var reqs []Request
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		data, err := store.GetContent(context.Background(), key)
+		if err != nil {
+			log.Err("Release queue error reading %s (%s)", key, err)
+			continue
+		}
+		var r Request
+		if err := json.Unmarshal(data, &r); err != nil {
+			log.Err("Release queue error decoding %s (%s)", key, err)
+			continue
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// buildHookRequest is the build hook request of the controller SDK, extended with the config
+// defaults, the annotations, the rollout strategy and the pinned slugrunner of the release.
+type buildHookRequest struct {
+	api.BuildHookRequest
+	// Config is only set for the controllers whose build hook accepts it.
+	Config      map[string]string `json:"config,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Strategy    string            `json:"strategy,omitempty"`
+	SlugRunner  string            `json:"slugrunner,omitempty"`
+	// Async asks the controller to answer once the release is created, and deploy it in the
+	// background.
+	Async bool `json:"async,omitempty"`
+}
+
+// Publish creates the build described by r on the controller, returning the new release version.
+// The request is canceled once ctx is done.
+func Publish(ctx context.Context, client *drycc.Client, r Request) (int, error) {
+	res, err := postBuild(controller.WithContext(ctx, client), newBuildHookRequest(r))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return decodeRelease(res)
+}
+
+// newBuildHookRequest returns the build hook request creating the build described by r.
+func newBuildHookRequest(r Request) buildHookRequest {
+	req := buildHookRequest{
+		BuildHookRequest: api.BuildHookRequest{
+			Sha:      r.Sha,
+			User:     r.Username,
+			App:      r.App,
+			Image:    r.Image,
+			Stack:    r.Stack,
+			Procfile: r.Procfile,
+		},
+		Config:      r.Config,
+		Annotations: r.Annotations,
+		Strategy:    r.Strategy,
+		SlugRunner:  r.SlugRunner,
+	}
+	if r.Dockerfile {
+		req.Dockerfile = "true"
+	}
+	return req
+}
+
+// postBuild sends req to the build hook of the controller.
+func postBuild(client *drycc.Client, req buildHookRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Request("POST", "/v2/hooks/build/", body)
+	if controller.CheckAPICompat(client, err) != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// decodeRelease returns the version of the release in the build hook response res.
+func decodeRelease(res *http.Response) (int, error) {
+	resMap := make(map[string]map[string]int)
+	if err := json.NewDecoder(res.Body).Decode(&resMap); err != nil {
+		return 0, fmt.Errorf("decoding the build hook response (%s)", err)
+	}
+	return resMap["release"]["version"], nil
+}
+
+// Lock is the subset of a (github.com/drycc/builder/pkg/sshd).RepositoryLock the queue needs, for
+// replicas of the builder not to publish the same release twice.
+type Lock interface {
+	Lock(repoName string) error
+	Unlock(repoName string) error
+}
+
+// get returns the request stored under key, or nil if there's none.
+func get(store Store, key string) (*Request, error) {
+	data, err := store.GetContent(context.Background(), key)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r := new(Request)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("decoding the pending release %s (%s)", key, err)
+	}
+	return r, nil
+}
+
+// processQueue tries to publish every pending request once, each with its app locked. Requests
+// are removed from the queue when they're published, when the controller rejects them or when
+// they're older than maxAge.
+func processQueue(store Store, lock Lock, publish func(Request) (int, error), maxAge time.Duration) error {
+	reqs, err := Pending(store)
+	if err != nil {
+		return err
+	}
+	for _, r := range reqs {
+		if err := lock.Lock(r.App); err != nil {
+			log.Debug("Release queue skipping %s (git-%s), %s is locked (%s)", r.App, r.Sha, r.App, err)
+			continue
+		}
+		publishPending(store, r, publish, maxAge)
+		if err := lock.Unlock(r.App); err != nil {
+			log.Err("Release queue error unlocking %s (%s)", r.App, err)
+		}
+	}
+	return nil
+}
+
+// publishPending publishes r, unless another replica already published or retried it since it
+// was listed, and removes it from the queue or stores the failed attempt.
+func publishPending(store Store, r Request, publish func(Request) (int, error), maxAge time.Duration) {
+	current, err := get(store, r.Key())
+	if err != nil || current == nil || current.Attempts != r.Attempts || !current.Queued.Equal(r.Queued) {
+		return
+	}
+	release, err := publish(r)
+	switch {
+	case err == nil:
+		log.Info("Release queue published %s:v%d (git-%s)", r.App, release, r.Sha)
+	case !controller.IsUnavailable(err):
+		log.Err("Release queue dropping %s (git-%s), the controller rejected it (%s)", r.App, r.Sha, err)
+	case time.Since(r.Queued) > maxAge:
+		log.Err("Release queue dropping %s (git-%s) after %d attempts (%s)", r.App, r.Sha, r.Attempts+1, err)
+	default:
+		r.Attempts++
+		r.LastError = err.Error()
+		if err := Enqueue(store, r); err != nil {
+			log.Err("Release queue error updating %s (%s)", r.Key(), err)
+		}
+		return
+	}
+	if err := store.Delete(context.Background(), r.Key()); err != nil {
+		log.Err("Release queue error deleting %s (%s)", r.Key(), err)
+	}
+}
+
+// Run publishes pending releases every pollSleepDuration until the process exits. Releases that
+// couldn't be published within maxAge are dropped. Errors are logged rather than returned. Each
+// release is published with the client clientFor returns for its app, with the app locked with
+// lock, which replicas of the builder must share.
+func Run(store Store, lock Lock, clientFor func(app string) *drycc.Client, pollSleepDuration, maxAge time.Duration) error {
+	publish := func(r Request) (int, error) { return Publish(context.Background(), clientFor(r.App), r) }
+	for {
+		if err := processQueue(store, lock, publish, maxAge); err != nil {
+			log.Err("Release queue error listing pending releases (%s)", err)
+		}
+		time.Sleep(pollSleepDuration)
+	}
+}
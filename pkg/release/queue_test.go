@@ -0,0 +1,161 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+type fakeLock map[string]bool
+
+func (l fakeLock) Lock(repo string) error {
+	if l[repo] {
+		return errors.New("locked")
+	}
+	l[repo] = true
+	return nil
+}
+
+func (l fakeLock) Unlock(repo string) error {
+	delete(l, repo)
+	return nil
+}
+
+var errUnavailable = &url.Error{Op: "Post", URL: "http://controller/", Err: errors.New("connection refused")}
+
+func TestEnqueuePending(t *testing.T) {
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	reqs, err := Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 0, "number of pending releases")
+
+	assert.NoErr(t, Enqueue(store, Request{App: "app", Sha: "12345678", Image: "app:git-12345678"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "app", Sha: "12345678", Image: "app:git-12345678"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "other", Sha: "87654321"}))
+	reqs, err = Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 2, "number of pending releases")
+	assert.False(t, reqs[0].Queued.IsZero(), "queued time not set")
+
+	// generated secrets aren't stored
+	config := map[string]string{"FOO": "bar", "KEY": "secret"}
+	assert.NoErr(t, Enqueue(store, Request{App: "other", Sha: "87654321", Config: config, Secrets: []string{"KEY"}}))
+	r, err := get(store, Request{App: "other", Sha: "87654321"}.Key())
+	assert.NoErr(t, err)
+	assert.Equal(t, r.Config, map[string]string{"FOO": "bar"}, "stored config")
+	assert.Equal(t, config["KEY"], "secret", "config of the request")
+
+	// the newest build of an app replaces its pending release, and is dropped once published
+	assert.NoErr(t, Enqueue(store, Request{App: "app", Sha: "abcdef12", Image: "app:git-abcdef12"}))
+	reqs, err = Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 2, "number of pending releases")
+	r, err = get(store, pendingKey("app"))
+	assert.NoErr(t, err)
+	assert.Equal(t, r.Sha, "abcdef12", "pending commit")
+	assert.NoErr(t, Drop(store, "app"))
+	assert.NoErr(t, Drop(store, "app"))
+	reqs, err = Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 1, "number of pending releases")
+}
+
+func TestProcessQueue(t *testing.T) {
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, Enqueue(store, Request{App: "ok", Sha: "11111111"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "down", Sha: "22222222"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "rejected", Sha: "33333333"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "expired", Sha: "44444444", Queued: time.Now().Add(-2 * time.Hour)}))
+
+	publish := func(r Request) (int, error) {
+		switch r.App {
+		case "ok":
+			return 2, nil
+		case "rejected":
+			return 0, drycc.ErrForbidden
+		default:
+			return 0, errUnavailable
+		}
+	}
+	assert.NoErr(t, processQueue(store, fakeLock{}, publish, time.Hour))
+
+	reqs, err := Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 1, "number of pending releases")
+	assert.Equal(t, reqs[0].App, "down", "pending app")
+	assert.Equal(t, reqs[0].Attempts, 1, "attempts")
+	assert.Equal(t, reqs[0].LastError, errUnavailable.Error(), "last error")
+}
+
+func TestProcessQueueReplicas(t *testing.T) {
+	store, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, Enqueue(store, Request{App: "app", Sha: "11111111"}))
+	assert.NoErr(t, Enqueue(store, Request{App: "locked", Sha: "22222222"}))
+
+	// the releases of apps another replica or a push locked are left to them
+	published := 0
+	publish := func(r Request) (int, error) {
+		published++
+		return 2, nil
+	}
+	lock := fakeLock{"locked": true}
+	assert.NoErr(t, processQueue(store, lock, publish, time.Hour))
+	assert.Equal(t, published, 1, "published releases")
+	assert.Equal(t, lock, fakeLock{"locked": true}, "locks")
+
+	// and those another replica published since they were listed aren't published again
+	reqs, err := Pending(store)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(reqs), 1, "number of pending releases")
+	delete(lock, "locked")
+	publishPending(store, reqs[0], publish, time.Hour)
+	publishPending(store, reqs[0], publish, time.Hour)
+	assert.Equal(t, published, 2, "published releases")
+}
+
+func TestPublish(t *testing.T) {
+	var received map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/v2/hooks/build/", "path")
+		assert.NoErr(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("DRYCC_API_VERSION", drycc.APIVersion)
+		fmt.Fprint(w, `{"release": {"version": 3}}`)
+	}))
+	defer srv.Close()
+	client, err := drycc.New(true, srv.URL, "")
+	assert.NoErr(t, err)
+
+	version, err := Publish(context.Background(), client, Request{
+		Username:    "alice",
+		App:         "app",
+		Image:       "app",
+		Sha:         "12345678",
+		Dockerfile:  true,
+		Config:      map[string]string{"FOO": "bar"},
+		Annotations: map[string]string{"builder.drycc.cc/git-sha": "12345678"},
+		Strategy:    "canary",
+		SlugRunner:  "drycc/slugrunner:1.4.0.heroku-20",
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, version, 3, "version")
+	assert.Equal(t, received["receive_repo"], "app", "app")
+	assert.Equal(t, received["dockerfile"], "true", "dockerfile")
+	assert.Equal(t, received["config"], map[string]interface{}{"FOO": "bar"}, "config")
+	assert.Equal(t, received["annotations"], map[string]interface{}{"builder.drycc.cc/git-sha": "12345678"}, "annotations")
+	assert.Equal(t, received["strategy"], "canary", "strategy")
+	assert.Equal(t, received["slugrunner"], "drycc/slugrunner:1.4.0.heroku-20", "slugrunner")
+}
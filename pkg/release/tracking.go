@@ -0,0 +1,123 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/drycc/builder/pkg/controller"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/pkg/log"
+)
+
+// The states of a release the controller deploys in the background, which only the controllers
+// that deploy in the background report.
+const (
+	StateDeploying = "deploying"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// ErrTrackingTimeout is returned by Track when the release is still deploying once its timeout
+// elapsed. The controller goes on deploying it.
+var ErrTrackingTimeout = errors.New("the release is still deploying")
+
+// ErrUnknownState is returned by GetStatus and Track when the controller doesn't report the state
+// of the deploy of a release, which is then unknown.
+var ErrUnknownState = errors.New("the controller doesn't report the state of the deploy")
+
+// Submission is a release the controller created for a build.
+type Submission struct {
+	Version int
+	// Deployed is true if the controller deployed the release before it answered, as the
+	// controllers that don't deploy in the background do.
+	Deployed bool
+}
+
+// Submit creates the build described by r on the controller, asking it to deploy the new release
+// in the background. Controllers that deploy it first answer with the release deployed. The
+// request is canceled once ctx is done.
+func Submit(ctx context.Context, client *drycc.Client, r Request) (Submission, error) {
+	req := newBuildHookRequest(r)
+	req.Async = true
+	res, err := postBuild(controller.WithContext(ctx, client), req)
+	if err != nil {
+		return Submission{}, err
+	}
+	defer res.Body.Close()
+	version, err := decodeRelease(res)
+	if err != nil {
+		return Submission{}, err
+	}
+	return Submission{Version: version, Deployed: res.StatusCode != http.StatusAccepted}, nil
+}
+
+// Status is the state of the deploy of a release.
+type Status struct {
+	Version int    `json:"version"`
+	State   string `json:"state"`
+	// Message tells what the deploy is doing, or why it failed.
+	Message string `json:"message,omitempty"`
+}
+
+// done returns true if the deploy of the release is over.
+func (s Status) done() bool {
+	return s.State == StateSucceeded || s.State == StateFailed
+}
+
+// GetStatus returns the state of the deploy of version, a release of app, or ErrUnknownState if
+// the controller didn't report a known one. The request is canceled once ctx is done.
+func GetStatus(ctx context.Context, client *drycc.Client, app string, version int) (Status, error) {
+	client = controller.WithContext(ctx, client)
+	res, err := client.Request("GET", fmt.Sprintf("/v2/apps/%s/releases/v%d/", app, version), nil)
+	if controller.CheckAPICompat(client, err) != nil {
+		return Status{}, err
+	}
+	defer res.Body.Close()
+	var s Status
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return Status{}, fmt.Errorf("decoding the release v%d of %s (%s)", version, app, err)
+	}
+	if s.State != StateDeploying && !s.done() {
+		return s, ErrUnknownState
+	}
+	return s, nil
+}
+
+// Track polls the state of the deploy of version, a release of app, every interval until it's
+// over, calling progress with each state it changes to. It returns the last state, or
+// ErrTrackingTimeout with it if the deploy isn't over once timeout elapsed, and ErrUnknownState
+// if the controller doesn't report it. The controller being unavailable for a while doesn't stop
+// the tracking, but ctx being done does, with its error.
+func Track(ctx context.Context, client *drycc.Client, app string, version int, interval, timeout time.Duration, progress func(Status)) (Status, error) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last Status
+	for {
+		s, err := GetStatus(ctx, client, app, version)
+		if ctx.Err() != nil {
+			return last, ctx.Err()
+		} else if err != nil && !controller.IsUnavailable(err) {
+			return last, err
+		} else if err != nil {
+			log.Debug("unable to get the state of %s:v%d (%s)", app, version, err)
+		} else if s != last {
+			last = s
+			progress(s)
+		}
+		if last.done() {
+			return last, nil
+		}
+		select {
+		case <-deadline:
+			return last, ErrTrackingTimeout
+		case <-ctx.Done():
+			return last, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	drycc "github.com/drycc/controller-sdk-go"
+)
+
+func TestSubmit(t *testing.T) {
+	status := http.StatusAccepted
+	var received map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/v2/hooks/build/", "path")
+		assert.NoErr(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("DRYCC_API_VERSION", drycc.APIVersion)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"release": {"version": 4}}`)
+	}))
+	defer srv.Close()
+	client, err := drycc.New(true, srv.URL, "")
+	assert.NoErr(t, err)
+
+	submitted, err := Submit(context.Background(), client, Request{App: "app", Sha: "12345678"})
+	assert.NoErr(t, err)
+	assert.Equal(t, submitted, Submission{Version: 4}, "submission")
+	assert.Equal(t, received["async"], true, "async")
+
+	// controllers that don't deploy in the background answer once the release is deployed
+	status = http.StatusCreated
+	submitted, err = Submit(context.Background(), client, Request{App: "app", Sha: "12345678"})
+	assert.NoErr(t, err)
+	assert.Equal(t, submitted, Submission{Version: 4, Deployed: true}, "submission")
+}
+
+func TestTrack(t *testing.T) {
+	states := []string{
+		`{"version": 4, "state": "deploying", "message": "scaling web"}`,
+		"unavailable",
+		`{"version": 4, "state": "deploying", "message": "scaling web"}`,
+		`{"version": 4, "state": "failed", "message": "web crashed"}`,
+	}
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/v2/apps/app/releases/v4/", "path")
+		w.Header().Set("DRYCC_API_VERSION", drycc.APIVersion)
+		state := states[polls]
+		if polls < len(states)-1 {
+			polls++
+		}
+		if state == "unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, state)
+	}))
+	defer srv.Close()
+	client, err := drycc.New(true, srv.URL, "")
+	assert.NoErr(t, err)
+
+	var progress []Status
+	status, err := Track(context.Background(), client, "app", 4, time.Millisecond, time.Minute, func(s Status) { progress = append(progress, s) })
+	assert.NoErr(t, err)
+	assert.Equal(t, status, Status{Version: 4, State: StateFailed, Message: "web crashed"}, "status")
+	assert.Equal(t, len(progress), 2, "progress")
+
+	states, polls = []string{`{"version": 4, "state": "deploying"}`}, 0
+	status, err = Track(context.Background(), client, "app", 4, time.Millisecond, 10*time.Millisecond, func(Status) {})
+	assert.Err(t, err, ErrTrackingTimeout)
+	assert.Equal(t, status.State, StateDeploying, "state")
+
+	// a canceled build stops the tracking
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Track(ctx, client, "app", 4, time.Millisecond, time.Minute, func(Status) {})
+	assert.Err(t, err, context.Canceled)
+
+	// releases without a state aren't taken as deployed
+	for _, state := range []string{`{"version": 4}`, `{"version": 4, "state": "pending"}`} {
+		states, polls = []string{state}, 0
+		_, err = Track(context.Background(), client, "app", 4, time.Millisecond, time.Minute, func(Status) {})
+		assert.Err(t, err, ErrUnknownState)
+	}
+}
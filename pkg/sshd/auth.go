@@ -0,0 +1,342 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/drycc/builder/pkg/controller"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/controller-sdk-go/hooks"
+	"github.com/drycc/pkg/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// allApps is the apps permission of users that may push to any app. The controller still checks
+// that they have access to the app when the build asks for its config.
+const allApps = "*"
+
+// ErrUnknownKey is returned by an Authenticator that doesn't know a key, so that the next one is
+// asked.
+var ErrUnknownKey = errors.New("unknown public key")
+
+// User is an authenticated user.
+type User struct {
+	Username string
+	// Apps are the apps the user may push to, or allApps.
+	Apps []string
+	// AppUsers are the names of the user on the controllers of the apps whose controller knows
+	// them by another name than Username.
+	AppUsers map[string]string
+}
+
+// Authenticator looks up the user that a public key belongs to.
+type Authenticator interface {
+	// Name identifies the authenticator in logs and in the AUTH_BACKENDS setting.
+	Name() string
+	// Authenticate returns the owner of key, or ErrUnknownKey if it doesn't know the key.
+	Authenticate(key ssh.PublicKey) (*User, error)
+}
+
+// AuthChain asks a list of authenticators in order of precedence. The first one that knows a key
+// decides who it belongs to.
+type AuthChain []Authenticator
+
+// Name is the Authenticator interface implementation.
+func (c AuthChain) Name() string {
+	names := make([]string, len(c))
+	for i, a := range c {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Authenticate is the Authenticator interface implementation. Authenticators that fail are
+// skipped. If none of them knows key, the last failure is returned, or ErrUnknownKey if there was
+// none.
+func (c AuthChain) Authenticate(key ssh.PublicKey) (*User, error) {
+	lastErr := ErrUnknownKey
+	for _, a := range c {
+		user, err := a.Authenticate(key)
+		if err == nil {
+			log.Debug("Key %s authenticated by %s", fingerprint(key), a.Name())
+			return user, nil
+		}
+		if err != ErrUnknownKey {
+			log.Info("Failed to authenticate user ssh key %s with %s: %s", fingerprint(key), a.Name(), err)
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// NewAuthenticator returns the authenticators named in cnf.AuthBackends, in that order.
+func NewAuthenticator(cnf *Config) (Authenticator, error) {
+	var chain AuthChain
+	for _, name := range strings.Split(cnf.AuthBackends, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "controller":
+			routes, err := controller.ParseRoutes(cnf.ControllerRoutes, cnf.ControllerHost, cnf.ControllerPort)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, &ControllerAuthenticator{Routes: routes})
+		case "authorized-keys":
+			chain = append(chain, &AuthorizedKeysAuthenticator{Path: cnf.AuthorizedKeysPath})
+		case "certificate":
+			chain = append(chain, &CertificateAuthenticator{
+				CAKeysPath:     cnf.TrustedUserCAKeysPath,
+				PrincipalsPath: cnf.CertPrincipalsPath,
+				RevokedPath:    cnf.RevokedKeysPath,
+			})
+		case "ldap":
+			chain = append(chain, &LDAPAuthenticator{
+				URL:           cnf.LDAPURL,
+				BindDN:        cnf.LDAPBindDN,
+				PasswordFile:  cnf.LDAPBindPasswordFile,
+				BaseDN:        cnf.LDAPBaseDN,
+				KeyAttribute:  cnf.LDAPKeyAttribute,
+				UserAttribute: cnf.LDAPUserAttribute,
+			})
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %s", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no authentication backends configured")
+	}
+	return chain, nil
+}
+
+// ControllerAuthenticator authenticates keys registered with the controllers of Routes. App names
+// are only unique on a controller, so the owner of a key may push to the apps each controller
+// lists for it that are routed to that controller, as the user that controller knows the key by.
+type ControllerAuthenticator struct {
+	Routes controller.Routes
+}
+
+// Name is the Authenticator interface implementation.
+func (a *ControllerAuthenticator) Name() string {
+	return "controller"
+}
+
+// Authenticate is the Authenticator interface implementation.
+func (a *ControllerAuthenticator) Authenticate(key ssh.PublicKey) (*User, error) {
+	var user *User
+	lastErr := ErrUnknownKey
+	for _, e := range a.Routes.Endpoints() {
+		client, err := controller.New(e.Host, e.Port)
+		if err != nil {
+			return nil, err
+		}
+		userInfo, err := hooks.UserFromKey(client, fingerprint(key))
+		if _, ok := err.(drycc.ErrNotFound); ok {
+			continue
+		}
+		if controller.CheckAPICompat(client, err) != nil {
+			log.Info("Failed to look up ssh key %s with the controller %s:%s: %s", fingerprint(key), e.Host, e.Port, err)
+			lastErr = err
+			continue
+		}
+		if user == nil {
+			user = &User{Username: userInfo.Username}
+		}
+		user.addApps(a.Routes, e, userInfo.Username, userInfo.Apps)
+	}
+	if user == nil {
+		return nil, lastErr
+	}
+	return user, nil
+}
+
+// addApps adds the apps that the controller at e lists for username, except those routed to
+// another controller, which may have an app of the same name.
+func (u *User) addApps(routes controller.Routes, e controller.Endpoint, username string, apps []string) {
+	for _, app := range apps {
+		if routes.For(app) != e {
+			continue
+		}
+		u.Apps = append(u.Apps, app)
+		if username != u.Username {
+			if u.AppUsers == nil {
+				u.AppUsers = map[string]string{}
+			}
+			u.AppUsers[app] = username
+		}
+	}
+}
+
+// AuthorizedKeysAuthenticator authenticates keys listed in an OpenSSH authorized_keys file. The
+// comment of each key is the name of the user it belongs to. An apps="app1,app2" option restricts
+// the apps the user may push to, otherwise the controller decides.
+//
+// The file is read on every authentication so that changes to a mounted secret are picked up
+// without a restart.
+type AuthorizedKeysAuthenticator struct {
+	Path string
+}
+
+// Name is the Authenticator interface implementation.
+func (a *AuthorizedKeysAuthenticator) Name() string {
+	return "authorized-keys"
+}
+
+// Authenticate is the Authenticator interface implementation.
+func (a *AuthorizedKeysAuthenticator) Authenticate(key ssh.PublicKey) (*User, error) {
+	data, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	want := key.Marshal()
+	for rest := data; len(rest) > 0; {
+		pub, comment, options, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			// ParseAuthorizedKey skips invalid lines, so this only happens at the end of the file
+			break
+		}
+		rest = next
+		if !bytes.Equal(pub.Marshal(), want) {
+			continue
+		}
+		if comment == "" {
+			return nil, fmt.Errorf("key %s in %s has no user name", fingerprint(key), a.Path)
+		}
+		user := &User{Username: comment, Apps: []string{allApps}}
+		for _, opt := range options {
+			if strings.HasPrefix(opt, "apps=") {
+				user.Apps = strings.Split(strings.Trim(strings.TrimPrefix(opt, "apps="), `"`), ",")
+			}
+		}
+		return user, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// LDAPAuthenticator authenticates keys stored in an LDAP directory, for example in the
+// sshPublicKey attribute of the openssh-lpk schema. It runs ldapsearch, so it needs the OpenLDAP
+// client tools.
+type LDAPAuthenticator struct {
+	URL           string
+	BindDN        string
+	PasswordFile  string
+	BaseDN        string
+	KeyAttribute  string
+	UserAttribute string
+}
+
+// Name is the Authenticator interface implementation.
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate is the Authenticator interface implementation.
+func (a *LDAPAuthenticator) Authenticate(key ssh.PublicKey) (*User, error) {
+	cmd := exec.Command("ldapsearch", a.args(key)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("searching %s (%s: %s)", a.URL, err, strings.TrimSpace(stderr.String()))
+	}
+	usernames, err := ldifValues(out, a.UserAttribute)
+	if err != nil {
+		return nil, err
+	}
+	switch len(usernames) {
+	case 0:
+		return nil, ErrUnknownKey
+	case 1:
+		return &User{Username: usernames[0], Apps: []string{allApps}}, nil
+	default:
+		return nil, fmt.Errorf("key %s belongs to %d users", fingerprint(key), len(usernames))
+	}
+}
+
+// args returns the ldapsearch arguments that look up the owner of key. Stored keys usually end
+// with a comment, so only their type and data are matched.
+func (a *LDAPAuthenticator) args(key ssh.PublicKey) []string {
+	value := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	args := []string{"-x", "-LLL", "-o", "ldif-wrap=no", "-H", a.URL, "-b", a.BaseDN}
+	if a.BindDN != "" {
+		args = append(args, "-D", a.BindDN, "-y", a.PasswordFile)
+	}
+	filter := fmt.Sprintf("(|(%s=%s)(%s=%s *))", a.KeyAttribute, ldapEscape(value), a.KeyAttribute, ldapEscape(value))
+	return append(args, filter, a.UserAttribute)
+}
+
+// ldapEscape escapes the characters that are special in LDAP search filter values (RFC 4515).
+func ldapEscape(s string) string {
+	return strings.NewReplacer(`\`, `\5c`, `*`, `\2a`, `(`, `\28`, `)`, `\29`, "\x00", `\00`).Replace(s)
+}
+
+// ldifValues returns the values of attr in the LDIF output of ldapsearch.
+func ldifValues(ldif []byte, attr string) ([]string, error) {
+	var values []string
+	scanner := bufio.NewScanner(bytes.NewReader(ldif))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, attr+":: "):
+			value, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, attr+":: "))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, string(value))
+		case strings.HasPrefix(line, attr+": "):
+			values = append(values, strings.TrimPrefix(line, attr+": "))
+		}
+	}
+	return values, scanner.Err()
+}
+
+// permissions returns the SSH permissions of user, authenticated with key.
+func permissions(user *User, key ssh.PublicKey) *ssh.Permissions {
+	log.Debug("Key accepted for user %s.", user.Username)
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":        user.Username,
+			"fingerprint": fingerprint(key),
+			"apps":        strings.Join(user.Apps, ", "),
+		},
+	}
+	if len(user.AppUsers) > 0 {
+		var appUsers []string
+		for app, username := range user.AppUsers {
+			appUsers = append(appUsers, app+"="+username)
+		}
+		sort.Strings(appUsers)
+		perms.Extensions["app-users"] = strings.Join(appUsers, ",")
+	}
+	return perms
+}
+
+// pushUser returns the name of the user of a connection with perms on the controller of app.
+func pushUser(perms *ssh.Permissions, app string) string {
+	for _, appUser := range strings.Split(perms.Extensions["app-users"], ",") {
+		if strings.HasPrefix(appUser, app+"=") {
+			return strings.TrimPrefix(appUser, app+"=")
+		}
+	}
+	return perms.Extensions["user"]
+}
+
+// canPush reports whether the apps permission of a connection, a comma separated list of app
+// names, allows pushing to app.
+func canPush(apps, app string) bool {
+	if apps == allApps {
+		return true
+	}
+	for _, name := range strings.Split(apps, ",") {
+		if strings.TrimSpace(name) == app {
+			return true
+		}
+	}
+	return false
+}
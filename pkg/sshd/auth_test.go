@@ -0,0 +1,139 @@
+package sshd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/controller"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeAuthenticator struct {
+	name string
+	user *User
+	err  error
+}
+
+func (f fakeAuthenticator) Name() string { return f.name }
+
+func (f fakeAuthenticator) Authenticate(key ssh.PublicKey) (*User, error) {
+	return f.user, f.err
+}
+
+func testingUserKey(t *testing.T) ssh.PublicKey {
+	signer, err := sshTestingHostKey()
+	assert.NoErr(t, err)
+	return signer.PublicKey()
+}
+
+func TestAuthChain(t *testing.T) {
+	key := testingUserKey(t)
+	errDown := errors.New("down")
+	alice := &User{Username: "alice", Apps: []string{"demo"}}
+	bob := &User{Username: "bob", Apps: []string{allApps}}
+
+	chain := AuthChain{
+		fakeAuthenticator{name: "unknown", err: ErrUnknownKey},
+		fakeAuthenticator{name: "broken", err: errDown},
+		fakeAuthenticator{name: "alice", user: alice},
+		fakeAuthenticator{name: "bob", user: bob},
+	}
+	assert.Equal(t, chain.Name(), "unknown,broken,alice,bob", "chain name")
+	user, err := chain.Authenticate(key)
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "alice", "user")
+
+	_, err = chain[:2].Authenticate(key)
+	assert.Err(t, errDown, err)
+	_, err = chain[:1].Authenticate(key)
+	assert.Err(t, ErrUnknownKey, err)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(&Config{AuthBackends: "authorized-keys, controller"})
+	assert.NoErr(t, err)
+	assert.Equal(t, auth.Name(), "authorized-keys,controller", "backends")
+
+	_, err = NewAuthenticator(&Config{AuthBackends: "kerberos"})
+	assert.True(t, err != nil, "no error for an unknown backend")
+	_, err = NewAuthenticator(&Config{AuthBackends: ""})
+	assert.True(t, err != nil, "no error without backends")
+}
+
+func TestAuthorizedKeysAuthenticator(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "authorized-keys")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	key := testingUserKey(t)
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	path := filepath.Join(tmpDir, "authorized_keys")
+	auth := &AuthorizedKeysAuthenticator{Path: path}
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte("# no keys yet\n"), 0644))
+	_, err = auth.Authenticate(key)
+	assert.Err(t, ErrUnknownKey, err)
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(authorized+" alice\n"), 0644))
+	user, err := auth.Authenticate(key)
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "alice", "user")
+	assert.Equal(t, user.Apps, []string{allApps}, "apps")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`apps="demo,other" `+authorized+" bob\n"), 0644))
+	user, err = auth.Authenticate(key)
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "bob", "user")
+	assert.Equal(t, user.Apps, []string{"demo", "other"}, "apps")
+}
+
+func TestLDAPAuthenticatorArgs(t *testing.T) {
+	key := testingUserKey(t)
+	auth := &LDAPAuthenticator{URL: "ldap://ldap", BaseDN: "dc=example", KeyAttribute: "sshPublicKey", UserAttribute: "uid"}
+	args := auth.args(key)
+	assert.Equal(t, args[len(args)-1], "uid", "requested attribute")
+	assert.True(t, strings.HasPrefix(args[len(args)-2], "(|(sshPublicKey=ssh-rsa "), "search filter")
+	for _, arg := range args {
+		assert.False(t, arg == "-D", "bound without a bind DN")
+	}
+	assert.Equal(t, ldapEscape(`a*(b)\`), `a\2a\28b\29\5c`, "escaped value")
+}
+
+func TestLDIFValues(t *testing.T) {
+	ldif := "dn: uid=alice,dc=example\nuid: alice\n\ndn: uid=bob,dc=example\nuid:: Ym9i\n"
+	values, err := ldifValues([]byte(ldif), "uid")
+	assert.NoErr(t, err)
+	assert.Equal(t, values, []string{"alice", "bob"}, "values")
+}
+
+func TestCanPush(t *testing.T) {
+	assert.True(t, canPush(allApps, "demo"), "wildcard")
+	assert.True(t, canPush("demo, other", "other"), "listed app")
+	assert.False(t, canPush("demo, other", "third"), "unlisted app")
+	for _, app := range []string{"app", "prod", "myapp", "myapp-", "p-prod", ""} {
+		assert.False(t, canPush("myapp-prod", app), "part of a listed app "+app)
+	}
+}
+
+func TestControllerUserApps(t *testing.T) {
+	routes, err := controller.ParseRoutes("team-b-*=controller-b:80", "controller-a", "80")
+	assert.NoErr(t, err)
+	a, b := routes.Default, routes.For("team-b-web")
+
+	// each controller only grants the apps routed to it, as the user it knows the key by
+	user := &User{Username: "alice"}
+	user.addApps(routes, a, "alice", []string{"web", "team-b-web"})
+	user.addApps(routes, b, "alice2", []string{"web", "team-b-web"})
+	assert.Equal(t, user.Apps, []string{"web", "team-b-web"}, "apps")
+	assert.Equal(t, user.AppUsers, map[string]string{"team-b-web": "alice2"}, "users of the apps")
+
+	perms := permissions(user, testingUserKey(t))
+	assert.Equal(t, pushUser(perms, "web"), "alice", "user of web")
+	assert.Equal(t, pushUser(perms, "team-b-web"), "alice2", "user of team-b-web")
+	assert.Equal(t, pushUser(perms, "team-b"), "alice", "user of an app with a similar name")
+}
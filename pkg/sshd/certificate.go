@@ -0,0 +1,187 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errNoPrincipal = errors.New("no certificate principal maps to a user")
+
+// CertificateAuthenticator authenticates short-lived user certificates signed by a trusted SSH
+// certificate authority, such as one that issues certificates after an OIDC login. Plain keys are
+// left to the other authenticators.
+//
+// All files are read on every authentication so that changes to a mounted secret, such as newly
+// revoked certificates, are picked up without a restart.
+type CertificateAuthenticator struct {
+	// CAKeysPath is an authorized_keys style file listing the trusted CA public keys.
+	CAKeysPath string
+	// PrincipalsPath optionally maps certificate principals to user names, one "principal user"
+	// pair per line. Without it, principals are user names.
+	PrincipalsPath string
+	// RevokedPath optionally lists revoked certificates and CA keys, one per line, either as a
+	// public key, a SHA256 fingerprint ("SHA256:...") or a certificate serial ("serial:123").
+	RevokedPath string
+}
+
+// Name is the Authenticator interface implementation.
+func (a *CertificateAuthenticator) Name() string {
+	return "certificate"
+}
+
+// Authenticate is the Authenticator interface implementation.
+func (a *CertificateAuthenticator) Authenticate(key ssh.PublicKey) (*User, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate %s is not a user certificate", cert.KeyId)
+	}
+	cas, err := readAuthorizedKeys(a.CAKeysPath)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := readRevocations(a.RevokedPath)
+	if err != nil {
+		return nil, err
+	}
+	principals, err := readPrincipals(a.PrincipalsPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cas[string(cert.SignatureKey.Marshal())]; !ok {
+		return nil, fmt.Errorf("certificate %s is signed by an untrusted authority", cert.KeyId)
+	}
+	checker := &ssh.CertChecker{IsRevoked: revoked.contains}
+	for _, principal := range cert.ValidPrincipals {
+		username := principal
+		if principals != nil {
+			if username, ok = principals[principal]; !ok {
+				continue
+			}
+		}
+		// CheckCert verifies the principal, the validity period, the revocation list, critical options
+		// and the signature
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return nil, fmt.Errorf("certificate %s (%s)", cert.KeyId, err)
+		}
+		return &User{Username: username, Apps: []string{allApps}}, nil
+	}
+	return nil, errNoPrincipal
+}
+
+// readAuthorizedKeys returns the public keys in the authorized_keys style file at path, indexed
+// by their wire format.
+func readAuthorizedKeys(path string) (map[string]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ssh.PublicKey)
+	for rest := data; len(rest) > 0; {
+		pub, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		keys[string(pub.Marshal())] = pub
+		rest = next
+	}
+	return keys, nil
+}
+
+// readPrincipals returns the principal to user mapping at path, or nil if path is empty.
+func readPrincipals(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	principals := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed principal mapping [%s] in %s", scanner.Text(), path)
+		}
+		principals[fields[0]] = fields[1]
+	}
+	return principals, scanner.Err()
+}
+
+// revocations is a list of revoked certificates and keys.
+type revocations struct {
+	keys         map[string]struct{}
+	fingerprints map[string]struct{}
+	serials      map[uint64]struct{}
+}
+
+// readRevocations returns the revocation list at path. A missing file revokes nothing.
+func readRevocations(path string) (*revocations, error) {
+	r := &revocations{
+		keys:         make(map[string]struct{}),
+		fingerprints: make(map[string]struct{}),
+		serials:      make(map[uint64]struct{}),
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "SHA256:"):
+			r.fingerprints[line] = struct{}{}
+		case strings.HasPrefix(line, "serial:"):
+			serial, err := strconv.ParseUint(strings.TrimPrefix(line, "serial:"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed serial [%s] in %s", line, path)
+			}
+			r.serials[serial] = struct{}{}
+		default:
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("malformed revoked key [%s] in %s (%s)", line, path, err)
+			}
+			r.keys[string(pub.Marshal())] = struct{}{}
+		}
+	}
+	return r, scanner.Err()
+}
+
+// contains reports whether cert, its key or its signing CA is revoked.
+func (r *revocations) contains(cert *ssh.Certificate) bool {
+	if _, ok := r.serials[cert.Serial]; ok {
+		return true
+	}
+	for _, key := range []ssh.PublicKey{cert, cert.Key, cert.SignatureKey} {
+		if _, ok := r.keys[string(key.Marshal())]; ok {
+			return true
+		}
+		if _, ok := r.fingerprints[ssh.FingerprintSHA256(key)]; ok {
+			return true
+		}
+	}
+	return false
+}
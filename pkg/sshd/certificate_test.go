@@ -0,0 +1,87 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestingSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoErr(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoErr(t, err)
+	return signer
+}
+
+func newTestingCert(t *testing.T, ca ssh.Signer, serial uint64, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newTestingSigner(t).PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.NoErr(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "certificates")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestingSigner(t)
+	caPath := filepath.Join(tmpDir, "trusted_user_ca_keys")
+	assert.NoErr(t, ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644))
+	revokedPath := filepath.Join(tmpDir, "revoked_keys")
+	auth := &CertificateAuthenticator{CAKeysPath: caPath, RevokedPath: revokedPath}
+
+	// plain keys are left to other authenticators
+	_, err = auth.Authenticate(newTestingSigner(t).PublicKey())
+	assert.Err(t, ErrUnknownKey, err)
+
+	user, err := auth.Authenticate(newTestingCert(t, ca, 1, "alice"))
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "alice", "user")
+
+	_, err = auth.Authenticate(newTestingCert(t, newTestingSigner(t), 1, "alice"))
+	assert.True(t, err != nil, "accepted a certificate signed by an untrusted authority")
+
+	assert.NoErr(t, ioutil.WriteFile(revokedPath, []byte("# revoked\nserial:2\n"), 0644))
+	_, err = auth.Authenticate(newTestingCert(t, ca, 2, "alice"))
+	assert.True(t, err != nil, "accepted a revoked certificate")
+	revokedCert := newTestingCert(t, ca, 3, "alice")
+	assert.NoErr(t, ioutil.WriteFile(revokedPath, []byte(ssh.FingerprintSHA256(revokedCert.Key)+"\n"), 0644))
+	_, err = auth.Authenticate(revokedCert)
+	assert.True(t, err != nil, "accepted a certificate for a revoked key")
+}
+
+func TestCertificatePrincipals(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "certificates")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestingSigner(t)
+	caPath := filepath.Join(tmpDir, "trusted_user_ca_keys")
+	assert.NoErr(t, ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644))
+	principalsPath := filepath.Join(tmpDir, "principals")
+	assert.NoErr(t, ioutil.WriteFile(principalsPath, []byte("# principal user\nalice@example.com alice\n"), 0644))
+	auth := &CertificateAuthenticator{CAKeysPath: caPath, PrincipalsPath: principalsPath}
+
+	user, err := auth.Authenticate(newTestingCert(t, ca, 1, "root", "alice@example.com"))
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "alice", "user")
+
+	_, err = auth.Authenticate(newTestingCert(t, ca, 1, "bob@example.com"))
+	assert.Err(t, errNoPrincipal, err)
+}
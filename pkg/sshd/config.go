@@ -1,22 +1,121 @@
 package sshd
 
 import (
+	"net"
+	"strconv"
 	"time"
 )
 
 // Config represents the required SSH server configuration.
+//
+// The *HostIP fields are the addresses the builder's listeners bind to. An empty address binds
+// every IPv4 and IPv6 address of the pod, and IPv6 addresses are given without brackets.
 type Config struct {
-	ControllerHost               string `envconfig:"DRYCC_CONTROLLER_SERVICE_HOST" required:"true"`
-	ControllerPort               string `envconfig:"DRYCC_CONTROLLER_SERVICE_PORT" required:"true"`
-	SSHHostIP                    string `envconfig:"SSH_HOST_IP" default:"0.0.0.0" required:"true"`
-	SSHHostPort                  int    `envconfig:"SSH_HOST_PORT" default:"2223" required:"true"`
-	HealthSrvPort                int    `envconfig:"HEALTH_SERVER_PORT" default:"8092"`
-	HealthSrvTestStorageRegion   string `envconfig:"STORAGE_REGION" default:"us-east-1"`
-	CleanerPollSleepDurationSec  int    `envconfig:"CLEANER_POLL_SLEEP_DURATION_SEC" default:"5"`
-	StorageType                  string `envconfig:"BUILDER_STORAGE" default:"minio"`
-	SlugBuilderImagePullPolicy   string `envconfig:"SLUGBUILDER_IMAGE_PULL_POLICY" default:"Always"`
-	DockerBuilderImagePullPolicy string `envconfig:"DOCKERBUILDER_IMAGE_PULL_POLICY" default:"Always"`
-	LockTimeout                  int    `envconfig:"GIT_LOCK_TIMEOUT" default:"10"`
+	ControllerHost                   string `envconfig:"DRYCC_CONTROLLER_SERVICE_HOST" required:"true"`
+	ControllerPort                   string `envconfig:"DRYCC_CONTROLLER_SERVICE_PORT" required:"true"`
+	ControllerRoutes                 string `envconfig:"CONTROLLER_ROUTES" default:""`
+	SSHHostIP                        string `envconfig:"SSH_HOST_IP" default:""`
+	SSHHostPort                      int    `envconfig:"SSH_HOST_PORT" default:"2223" required:"true"`
+	HealthSrvHostIP                  string `envconfig:"HEALTH_SERVER_HOST_IP" default:""`
+	HealthSrvPort                    int    `envconfig:"HEALTH_SERVER_PORT" default:"8092"`
+	HealthSrvTestStorageRegion       string `envconfig:"STORAGE_REGION" default:"us-east-1"`
+	CleanerPollSleepDurationSec      int    `envconfig:"CLEANER_POLL_SLEEP_DURATION_SEC" default:"5"`
+	BuildArtifactTTLMin              int    `envconfig:"BUILD_ARTIFACT_TTL_MIN" default:"360"`
+	BuildArtifactGCIntervalMin       int    `envconfig:"BUILD_ARTIFACT_GC_INTERVAL_MIN" default:"60"`
+	BuildTmpDir                      string `envconfig:"BUILD_TMP_DIR" default:""`
+	StorageType                      string `envconfig:"BUILDER_STORAGE" default:"minio"`
+	SlugBuilderImagePullPolicy       string `envconfig:"SLUGBUILDER_IMAGE_PULL_POLICY" default:"Always"`
+	DockerBuilderImagePullPolicy     string `envconfig:"DOCKERBUILDER_IMAGE_PULL_POLICY" default:"Always"`
+	LockTimeout                      int    `envconfig:"GIT_LOCK_TIMEOUT" default:"10"`
+	ReleaseQueuePollSleepDurationSec int    `envconfig:"RELEASE_QUEUE_POLL_SLEEP_DURATION_SEC" default:"30"`
+	ReleaseQueueMaxAgeMin            int    `envconfig:"RELEASE_QUEUE_MAX_AGE_MIN" default:"1440"`
+	OffPeakWindow                    string `envconfig:"OFF_PEAK_WINDOW" default:""`
+	BuildQueuePollSleepDurationSec   int    `envconfig:"BUILD_QUEUE_POLL_SLEEP_DURATION_SEC" default:"60"`
+	BuildQueueMaxAgeMin              int    `envconfig:"BUILD_QUEUE_MAX_AGE_MIN" default:"10080"`
+	AuthBackends                     string `envconfig:"AUTH_BACKENDS" default:"controller"`
+	AuthorizedKeysPath               string `envconfig:"AUTHORIZED_KEYS_PATH" default:"/var/run/secrets/drycc/builder/auth/authorized_keys"`
+	TrustedUserCAKeysPath            string `envconfig:"TRUSTED_USER_CA_KEYS_PATH" default:"/var/run/secrets/drycc/builder/auth/trusted_user_ca_keys"`
+	CertPrincipalsPath               string `envconfig:"CERT_PRINCIPALS_PATH" default:""`
+	RevokedKeysPath                  string `envconfig:"REVOKED_KEYS_PATH" default:"/var/run/secrets/drycc/builder/auth/revoked_keys"`
+	LDAPURL                          string `envconfig:"LDAP_URL" default:""`
+	LDAPBindDN                       string `envconfig:"LDAP_BIND_DN" default:""`
+	LDAPBindPasswordFile             string `envconfig:"LDAP_BIND_PASSWORD_FILE" default:"/var/run/secrets/drycc/builder/auth/ldap-password"`
+	LDAPBaseDN                       string `envconfig:"LDAP_BASE_DN" default:""`
+	LDAPKeyAttribute                 string `envconfig:"LDAP_KEY_ATTRIBUTE" default:"sshPublicKey"`
+	LDAPUserAttribute                string `envconfig:"LDAP_USER_ATTRIBUTE" default:"uid"`
+	PushesPerUser                    int    `envconfig:"PUSH_RATE_LIMIT_PER_USER" default:"0"`
+	PushesPerIP                      int    `envconfig:"PUSH_RATE_LIMIT_PER_IP" default:"0"`
+	PushRateWindowSec                int    `envconfig:"PUSH_RATE_LIMIT_WINDOW_SEC" default:"60"`
+	SessionsPerUser                  int    `envconfig:"MAX_SESSIONS_PER_USER" default:"0"`
+	SessionsPerIP                    int    `envconfig:"MAX_SESSIONS_PER_IP" default:"0"`
+	AuthFailuresBeforeBan            int    `envconfig:"AUTH_FAILURES_BEFORE_BAN" default:"0"`
+	AuthFailureWindowSec             int    `envconfig:"AUTH_FAILURE_WINDOW_SEC" default:"300"`
+	BanDurationSec                   int    `envconfig:"AUTH_FAILURE_BAN_DURATION_SEC" default:"600"`
+	GitHTTPEnabled                   bool   `envconfig:"GIT_HTTP_ENABLED" default:"false"`
+	GitHTTPHostIP                    string `envconfig:"GIT_HTTP_HOST_IP" default:""`
+	GitHTTPPort                      int    `envconfig:"GIT_HTTP_PORT" default:"8080"`
+	GitHTTPTLSCertFile               string `envconfig:"GIT_HTTP_TLS_CERT_FILE" default:""`
+	GitHTTPTLSKeyFile                string `envconfig:"GIT_HTTP_TLS_KEY_FILE" default:""`
+	TarballMaxBytes                  int64  `envconfig:"TARBALL_MAX_BYTES" default:"536870912"`            // 512 MiB
+	TarballMaxExtractedBytes         int64  `envconfig:"TARBALL_MAX_EXTRACTED_BYTES" default:"2147483648"` // 2 GiB
+	RepoStorage                      string `envconfig:"REPO_STORAGE" default:"volume"`
+	ExternalGitURL                   string `envconfig:"EXTERNAL_GIT_URL" default:""`
+	LockBackend                      string `envconfig:"GIT_LOCK_BACKEND" default:"memory"`
+	PodName                          string `envconfig:"POD_NAME" default:""`
+	PodNamespace                     string `envconfig:"POD_NAMESPACE" default:""`
+	StorageKeyShardLength            int    `envconfig:"STORAGE_KEY_SHARD_LENGTH" default:"0"`
+	WarmImages                       bool   `envconfig:"WARM_IMAGES_ENABLED" default:"false"`
+	WarmImagesIntervalMin            int    `envconfig:"WARM_IMAGES_INTERVAL_MIN" default:"30"`
+	BuilderPodNodeSelector           string `envconfig:"BUILDER_POD_NODE_SELECTOR" default:""`
+	StackCatalogPath                 string `envconfig:"STACK_CATALOG_PATH" default:"/etc/drycc/stacks/catalog.json"`
+	TunablesPath                     string `envconfig:"TUNABLES_PATH" default:"/etc/drycc/builder/tunables"`
+	TunablesReloadIntervalSec        int    `envconfig:"TUNABLES_RELOAD_INTERVAL_SEC" default:"30"`
+
+	// SessionRecording records the I/O of push sessions, except their pack data, to the object
+	// storage, up to SessionRecordingMaxBytes per session, for SessionRecordingRetentionDays.
+	// Common secrets are redacted, and so is what matches the SessionRecordingRedact regexp.
+	SessionRecording              bool   `envconfig:"SESSION_RECORDING_ENABLED" default:"false"`
+	SessionRecordingMaxBytes      int    `envconfig:"SESSION_RECORDING_MAX_BYTES" default:"1048576"`
+	SessionRecordingRetentionDays int    `envconfig:"SESSION_RECORDING_RETENTION_DAYS" default:"7"`
+	SessionRecordingRedact        string `envconfig:"SESSION_RECORDING_REDACT" default:""`
+
+	// HookTokenMode is how the hooks of pushes authenticate to the controller: with the builder key
+	// in the "global" mode, or with a token the controller mints for the app and the user of each
+	// push, which expires after HookTokenTTLSec, in the "scoped" mode. The "prefer-scoped" mode
+	// falls back to the builder key for the controllers that don't mint tokens.
+	HookTokenMode   string `envconfig:"HOOK_TOKEN_MODE" default:"global"`
+	HookTokenTTLSec int    `envconfig:"HOOK_TOKEN_TTL_SEC" default:"3600"`
+
+	// SSHProxyProtocol reads the address of SSH clients from the PROXY protocol header, version 1
+	// or 2, that load balancers start connections with, for the limits, the logs and the audit
+	// records of pushes to have it rather than the address of the load balancer. Only the
+	// connections from SSHProxyProtocolTrustedCIDRs, comma separated, which must be set, are
+	// expected to start with a header.
+	SSHProxyProtocol             bool   `envconfig:"SSH_PROXY_PROTOCOL_ENABLED" default:"false"`
+	SSHProxyProtocolTrustedCIDRs string `envconfig:"SSH_PROXY_PROTOCOL_TRUSTED_CIDRS" default:""`
+
+	BuilderVersion string `ignored:"true"` // set by main
+	BuilderCommit  string `ignored:"true"` // set by main
+}
+
+// SSHAddr returns the address the SSH server listens on.
+func (c Config) SSHAddr() string {
+	return listenAddr(c.SSHHostIP, c.SSHHostPort)
+}
+
+// HealthSrvAddr returns the address the health check server listens on.
+func (c Config) HealthSrvAddr() string {
+	return listenAddr(c.HealthSrvHostIP, c.HealthSrvPort)
+}
+
+// GitHTTPAddr returns the address the git HTTP server listens on.
+func (c Config) GitHTTPAddr() string {
+	return listenAddr(c.GitHTTPHostIP, c.GitHTTPPort)
+}
+
+// listenAddr joins ip and port into a listen address, bracketing IPv6 literals.
+func listenAddr(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
 }
 
 // CleanerPollSleepDuration returns c.CleanerPollSleepDurationSec as a time.Duration.
@@ -24,7 +123,66 @@ func (c Config) CleanerPollSleepDuration() time.Duration {
 	return time.Duration(c.CleanerPollSleepDurationSec) * time.Second
 }
 
-//GitLockTimeout return LockTimeout in minutes
+// BuildArtifactTTL returns how long build artifacts are kept after they were last modified.
+func (c Config) BuildArtifactTTL() time.Duration {
+	return time.Duration(c.BuildArtifactTTLMin) * time.Minute
+}
+
+// BuildArtifactGCInterval returns how often stale build artifacts are removed.
+func (c Config) BuildArtifactGCInterval() time.Duration {
+	return time.Duration(c.BuildArtifactGCIntervalMin) * time.Minute
+}
+
+// WarmImagesInterval returns the interval between the rounds of the image warmer.
+func (c Config) WarmImagesInterval() time.Duration {
+	return time.Duration(c.WarmImagesIntervalMin) * time.Minute
+}
+
+// GitLockTimeout return LockTimeout in minutes
 func (c Config) GitLockTimeout() time.Duration {
 	return time.Duration(c.LockTimeout) * time.Minute
 }
+
+// ReleaseQueuePollSleepDuration returns c.ReleaseQueuePollSleepDurationSec as a time.Duration.
+func (c Config) ReleaseQueuePollSleepDuration() time.Duration {
+	return time.Duration(c.ReleaseQueuePollSleepDurationSec) * time.Second
+}
+
+// ReleaseQueueMaxAge returns how long a pending release is retried before it's dropped.
+func (c Config) ReleaseQueueMaxAge() time.Duration {
+	return time.Duration(c.ReleaseQueueMaxAgeMin) * time.Minute
+}
+
+// BuildQueuePollSleepDuration returns c.BuildQueuePollSleepDurationSec as a time.Duration.
+func (c Config) BuildQueuePollSleepDuration() time.Duration {
+	return time.Duration(c.BuildQueuePollSleepDurationSec) * time.Second
+}
+
+// BuildQueueMaxAge returns how long the status of a queued build that ended can be looked up.
+func (c Config) BuildQueueMaxAge() time.Duration {
+	return time.Duration(c.BuildQueueMaxAgeMin) * time.Minute
+}
+
+// TunablesReloadInterval returns how often the tunables of builds are reloaded.
+func (c Config) TunablesReloadInterval() time.Duration {
+	return time.Duration(c.TunablesReloadIntervalSec) * time.Second
+}
+
+// HookTokenTTL returns how long the tokens minted for the hooks of pushes are valid.
+func (c Config) HookTokenTTL() time.Duration {
+	return time.Duration(c.HookTokenTTLSec) * time.Second
+}
+
+// Limits returns the push, session and authentication failure limits configured in c.
+func (c Config) Limits() Limits {
+	return Limits{
+		PushesPerUser:     c.PushesPerUser,
+		PushesPerIP:       c.PushesPerIP,
+		PushWindow:        time.Duration(c.PushRateWindowSec) * time.Second,
+		SessionsPerUser:   c.SessionsPerUser,
+		SessionsPerIP:     c.SessionsPerIP,
+		AuthFailures:      c.AuthFailuresBeforeBan,
+		AuthFailureWindow: time.Duration(c.AuthFailureWindowSec) * time.Second,
+		BanDuration:       time.Duration(c.BanDurationSec) * time.Second,
+	}
+}
@@ -0,0 +1,17 @@
+package sshd
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestListenAddrs(t *testing.T) {
+	cnf := Config{SSHHostPort: 2223, HealthSrvPort: 8092, GitHTTPHostIP: "fd00::1", GitHTTPPort: 8080}
+	assert.Equal(t, cnf.SSHAddr(), ":2223", "dual-stack SSH address")
+	assert.Equal(t, cnf.HealthSrvAddr(), ":8092", "dual-stack health server address")
+	assert.Equal(t, cnf.GitHTTPAddr(), "[fd00::1]:8080", "IPv6 git HTTP address")
+
+	cnf.SSHHostIP = "10.0.0.1"
+	assert.Equal(t, cnf.SSHAddr(), "10.0.0.1:2223", "IPv4 SSH address")
+}
@@ -0,0 +1,140 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The kinds of repository locks.
+const (
+	// MemoryLockBackend locks repos in the memory of a single builder.
+	MemoryLockBackend = "memory"
+	// LeaseLockBackend locks repos with Lease objects shared by all replicas of the builder.
+	LeaseLockBackend = "lease"
+)
+
+// leasePrefix is the prefix of the names of the Leases that lock repos.
+const leasePrefix = "drycc-builder-repo-"
+
+// LeaseClient is the subset of a (k8s.io/client-go/kubernetes/typed/coordination/v1).LeaseInterface
+// a lease lock needs.
+type LeaseClient interface {
+	Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error)
+	Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// NewRepositoryLock returns the RepositoryLock of the lock backend in c. leases is only used by
+// the lease backend.
+func NewRepositoryLock(c *Config, leases LeaseClient) (RepositoryLock, error) {
+	switch c.LockBackend {
+	case MemoryLockBackend, "":
+		return NewInMemoryRepositoryLock(c.GitLockTimeout()), nil
+	case LeaseLockBackend:
+		if c.PodName == "" {
+			return nil, fmt.Errorf("the %s lock backend needs POD_NAME to identify the builder", LeaseLockBackend)
+		}
+		return NewLeaseRepositoryLock(leases, c.PodName, c.GitLockTimeout()), nil
+	}
+	return nil, fmt.Errorf("unknown git lock backend %q", c.LockBackend)
+}
+
+// NewLeaseRepositoryLock returns a RepositoryLock that locks repos with Leases, so that a repo is
+// locked across all replicas of the builder. holder identifies this replica. A Lease is held for
+// at most timeout, after which other replicas may take it over, in case its holder went away
+// without unlocking it.
+func NewLeaseRepositoryLock(leases LeaseClient, holder string, timeout time.Duration) RepositoryLock {
+	return &leaseRepoLock{leases: leases, holder: holder, timeout: timeout, now: time.Now}
+}
+
+type leaseRepoLock struct {
+	leases  LeaseClient
+	holder  string
+	timeout time.Duration
+	// now is only replaced in tests.
+	now func() time.Time
+}
+
+func leaseName(repoName string) string {
+	return leasePrefix + repoName
+}
+
+// expired returns true if lease wasn't renewed for longer than its duration.
+func (rl *leaseRepoLock) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return rl.now().After(lease.Spec.RenewTime.Add(duration))
+}
+
+func (rl *leaseRepoLock) acquire(lease *coordinationv1.Lease) {
+	now := metav1.NewMicroTime(rl.now())
+	seconds := int32(rl.timeout / time.Second)
+	lease.Spec.HolderIdentity = &rl.holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+}
+
+// Lock acquires the Lease of the specified repo, unless another replica holds it.
+func (rl *leaseRepoLock) Lock(repoName string) error {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{
+		Name:   leaseName(repoName),
+		Labels: map[string]string{"heritage": "drycc", "app": "drycc-builder"},
+	}}
+	rl.acquire(lease)
+	_, err := rl.leases.Create(context.TODO(), lease, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	} else if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating lease for repository %q (%s)", repoName, err)
+	}
+
+	lease, err = rl.leases.Get(context.TODO(), leaseName(repoName), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting lease for repository %q (%s)", repoName, err)
+	}
+	if !rl.expired(lease) {
+		holder := ""
+		if lease.Spec.HolderIdentity != nil {
+			holder = *lease.Spec.HolderIdentity
+		}
+		return fmt.Errorf("repository %q already locked by %s", repoName, holder)
+	}
+	// the update fails if another replica took the lease over in the meantime
+	rl.acquire(lease)
+	if _, err := rl.leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("taking over lease for repository %q (%s)", repoName, err)
+	}
+	return nil
+}
+
+// Unlock releases the Lease of the specified repo, or returns an error if this replica doesn't
+// hold it.
+func (rl *leaseRepoLock) Unlock(repoName string) error {
+	lease, err := rl.leases.Get(context.TODO(), leaseName(repoName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("repository %q not found", repoName)
+	} else if err != nil {
+		return fmt.Errorf("getting lease for repository %q (%s)", repoName, err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != rl.holder {
+		return fmt.Errorf("repository %q isn't locked by %s", repoName, rl.holder)
+	}
+	uid := lease.UID
+	return rl.leases.Delete(context.TODO(), lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &lease.ResourceVersion},
+	})
+}
+
+// Timeout returns the time duration for which a gitpush should hold the lock
+func (rl *leaseRepoLock) Timeout() time.Duration {
+	return rl.timeout
+}
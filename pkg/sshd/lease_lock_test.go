@@ -0,0 +1,130 @@
+package sshd
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var leaseResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+// fakeLeaseClient is a LeaseClient that keeps Leases in memory, with the optimistic concurrency
+// of the API server.
+type fakeLeaseClient struct {
+	mutex   sync.Mutex
+	leases  map[string]coordinationv1.Lease
+	version int
+}
+
+func newFakeLeaseClient() *fakeLeaseClient {
+	return &fakeLeaseClient{leases: make(map[string]coordinationv1.Lease)}
+}
+
+func (f *fakeLeaseClient) Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.leases[lease.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(leaseResource, lease.Name)
+	}
+	f.version++
+	created := *lease.DeepCopy()
+	created.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = created
+	return &created, nil
+}
+
+func (f *fakeLeaseClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lease, ok := f.leases[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (f *fakeLeaseClient) Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cur, ok := f.leases[lease.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, lease.Name)
+	}
+	if cur.ResourceVersion != lease.ResourceVersion {
+		return nil, apierrors.NewConflict(leaseResource, lease.Name, nil)
+	}
+	f.version++
+	updated := *lease.DeepCopy()
+	updated.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = updated
+	return &updated, nil
+}
+
+func (f *fakeLeaseClient) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cur, ok := f.leases[name]
+	if !ok {
+		return apierrors.NewNotFound(leaseResource, name)
+	}
+	if opts.Preconditions != nil && opts.Preconditions.ResourceVersion != nil && *opts.Preconditions.ResourceVersion != cur.ResourceVersion {
+		return apierrors.NewConflict(leaseResource, name, nil)
+	}
+	delete(f.leases, name)
+	return nil
+}
+
+func TestLeaseRepositoryLock(t *testing.T) {
+	const repo = "repo1"
+	leases := newFakeLeaseClient()
+	replica1 := NewLeaseRepositoryLock(leases, "builder-1", time.Minute)
+	replica2 := NewLeaseRepositoryLock(leases, "builder-2", time.Minute)
+
+	assert.NoErr(t, replica1.Lock(repo))
+	assert.True(t, replica1.Lock(repo) != nil, "lock of already locked repo should return error")
+	assert.True(t, replica2.Lock(repo) != nil, "lock of a repo locked by another replica should return error")
+	assert.True(t, replica2.Unlock(repo) != nil, "unlock of a repo locked by another replica should return error")
+	assert.NoErr(t, replica1.Lock("repo2"))
+
+	assert.NoErr(t, replica1.Unlock(repo))
+	assert.True(t, replica1.Unlock(repo) != nil, "unlock of already unlocked repo should return error")
+	assert.NoErr(t, replica2.Lock(repo))
+	assert.NoErr(t, replica2.Unlock(repo))
+}
+
+func TestLeaseRepositoryLockTakeOver(t *testing.T) {
+	const repo = "repo1"
+	leases := newFakeLeaseClient()
+	replica1 := NewLeaseRepositoryLock(leases, "builder-1", time.Minute)
+	replica2 := NewLeaseRepositoryLock(leases, "builder-2", time.Minute).(*leaseRepoLock)
+	assert.NoErr(t, replica1.Lock(repo))
+
+	// replica1 went away without unlocking the repo
+	replica2.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.NoErr(t, replica2.Lock(repo))
+	assert.True(t, replica1.Unlock(repo) != nil, "unlock of a repo taken over by another replica should return error")
+	assert.NoErr(t, replica2.Unlock(repo))
+}
+
+func TestNewRepositoryLock(t *testing.T) {
+	lck, err := NewRepositoryLock(&Config{}, nil)
+	assert.NoErr(t, err)
+	_, ok := lck.(*inMemoryRepoLock)
+	assert.True(t, ok, "default lock isn't in memory")
+	lck, err = NewRepositoryLock(&Config{LockBackend: LeaseLockBackend, PodName: "builder-1"}, newFakeLeaseClient())
+	assert.NoErr(t, err)
+	_, ok = lck.(*leaseRepoLock)
+	assert.True(t, ok, "lease lock isn't a lease lock")
+	_, err = NewRepositoryLock(&Config{LockBackend: LeaseLockBackend}, newFakeLeaseClient())
+	assert.True(t, err != nil, "created a lease lock without a holder")
+	_, err = NewRepositoryLock(&Config{LockBackend: "etcd"}, nil)
+	assert.True(t, err != nil, "created an unknown lock")
+}
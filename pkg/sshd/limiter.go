@@ -0,0 +1,185 @@
+package sshd
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManySessions = errors.New("too many concurrent sessions")
+	errTooManyPushes   = errors.New("too many pushes, try again later")
+)
+
+// Limits configures a Limiter. A zero limit is disabled.
+type Limits struct {
+	// PushesPerUser and PushesPerIP limit the pushes in every PushWindow.
+	PushesPerUser int
+	PushesPerIP   int
+	PushWindow    time.Duration
+	// SessionsPerUser and SessionsPerIP limit the concurrent SSH connections.
+	SessionsPerUser int
+	SessionsPerIP   int
+	// AuthFailures failed authentications from an address within AuthFailureWindow ban it for
+	// BanDuration.
+	AuthFailures      int
+	AuthFailureWindow time.Duration
+	BanDuration       time.Duration
+}
+
+// Limiter protects the SSH server from misbehaving clients. It rate limits pushes, limits
+// concurrent sessions and bans addresses that repeatedly fail to authenticate. Its methods are
+// safe for concurrent use, and a nil *Limiter limits nothing.
+type Limiter struct {
+	limits Limits
+	now    func() time.Time
+
+	mutex    sync.Mutex
+	pushes   map[string][]time.Time
+	sessions map[string]int
+	failures map[string][]time.Time
+	bans     map[string]time.Time
+}
+
+// NewLimiter returns a new Limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:   limits,
+		now:      time.Now,
+		pushes:   make(map[string][]time.Time),
+		sessions: make(map[string]int),
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+// remoteIP returns the IP of addr, without its port.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func userKey(user string) string { return "user:" + user }
+func ipKey(ip string) string     { return "ip:" + ip }
+
+// Banned reports whether ip is banned.
+func (l *Limiter) Banned(ip string) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	until, ok := l.bans[ip]
+	if !ok {
+		return false
+	}
+	if l.now().After(until) {
+		delete(l.bans, ip)
+		return false
+	}
+	return true
+}
+
+// AuthFailed records a failed authentication from ip, and reports whether ip is now banned.
+func (l *Limiter) AuthFailed(ip string) bool {
+	if l == nil || l.limits.AuthFailures <= 0 {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	prune(l.failures, now, l.limits.AuthFailureWindow)
+	for banned, until := range l.bans {
+		if now.After(until) {
+			delete(l.bans, banned)
+		}
+	}
+	failures := append(recent(l.failures[ip], now, l.limits.AuthFailureWindow), now)
+	if len(failures) < l.limits.AuthFailures {
+		l.failures[ip] = failures
+		return false
+	}
+	delete(l.failures, ip)
+	l.bans[ip] = now.Add(l.limits.BanDuration)
+	return true
+}
+
+// OpenSession records a new connection of user from ip, or returns an error if either already has
+// too many. Every successful call must be followed by a call to CloseSession.
+func (l *Limiter) OpenSession(ip, user string) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if exceeds(l.sessions[ipKey(ip)], l.limits.SessionsPerIP) || exceeds(l.sessions[userKey(user)], l.limits.SessionsPerUser) {
+		return errTooManySessions
+	}
+	l.sessions[ipKey(ip)]++
+	l.sessions[userKey(user)]++
+	return nil
+}
+
+// CloseSession records the end of a connection opened with OpenSession.
+func (l *Limiter) CloseSession(ip, user string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range []string{ipKey(ip), userKey(user)} {
+		if l.sessions[key] <= 1 {
+			delete(l.sessions, key)
+		} else {
+			l.sessions[key]--
+		}
+	}
+}
+
+// AllowPush records a push of user from ip, or returns an error if either pushed too often
+// recently.
+func (l *Limiter) AllowPush(ip, user string) error {
+	if l == nil || (l.limits.PushesPerIP <= 0 && l.limits.PushesPerUser <= 0) {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	prune(l.pushes, now, l.limits.PushWindow)
+	ipPushes := recent(l.pushes[ipKey(ip)], now, l.limits.PushWindow)
+	userPushes := recent(l.pushes[userKey(user)], now, l.limits.PushWindow)
+	if exceeds(len(ipPushes), l.limits.PushesPerIP) || exceeds(len(userPushes), l.limits.PushesPerUser) {
+		l.pushes[ipKey(ip)], l.pushes[userKey(user)] = ipPushes, userPushes
+		return errTooManyPushes
+	}
+	l.pushes[ipKey(ip)] = append(ipPushes, now)
+	l.pushes[userKey(user)] = append(userPushes, now)
+	return nil
+}
+
+// exceeds reports whether count has reached limit. A limit of zero or less is disabled.
+func exceeds(count, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+// recent returns the times within window of now.
+func recent(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	return times[i:]
+}
+
+// prune forgets the keys of m without times within window of now.
+func prune(m map[string][]time.Time, now time.Time, window time.Duration) {
+	for key, times := range m {
+		if len(recent(times, now, window)) == 0 {
+			delete(m, key)
+		}
+	}
+}
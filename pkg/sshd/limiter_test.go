@@ -0,0 +1,78 @@
+package sshd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestingLimiter(limits Limits) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	l := NewLimiter(limits)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLimiterPushes(t *testing.T) {
+	l, clock := newTestingLimiter(Limits{PushesPerUser: 2, PushesPerIP: 2, PushWindow: time.Minute})
+	assert.NoErr(t, l.AllowPush("10.0.0.1", "alice"))
+	assert.NoErr(t, l.AllowPush("10.0.0.2", "alice"))
+	assert.Err(t, errTooManyPushes, l.AllowPush("10.0.0.3", "alice"))
+	assert.NoErr(t, l.AllowPush("10.0.0.1", "bob"))
+	assert.Err(t, errTooManyPushes, l.AllowPush("10.0.0.1", "carol"))
+
+	clock.advance(time.Minute)
+	assert.NoErr(t, l.AllowPush("10.0.0.3", "alice"))
+	assert.NoErr(t, l.AllowPush("10.0.0.1", "carol"))
+}
+
+func TestLimiterSessions(t *testing.T) {
+	l, _ := newTestingLimiter(Limits{SessionsPerUser: 1, SessionsPerIP: 2})
+	assert.NoErr(t, l.OpenSession("10.0.0.1", "alice"))
+	assert.Err(t, errTooManySessions, l.OpenSession("10.0.0.2", "alice"))
+	assert.NoErr(t, l.OpenSession("10.0.0.1", "bob"))
+	assert.Err(t, errTooManySessions, l.OpenSession("10.0.0.1", "carol"))
+
+	l.CloseSession("10.0.0.1", "alice")
+	assert.NoErr(t, l.OpenSession("10.0.0.2", "alice"))
+	assert.NoErr(t, l.OpenSession("10.0.0.1", "carol"))
+}
+
+func TestLimiterBans(t *testing.T) {
+	l, clock := newTestingLimiter(Limits{AuthFailures: 3, AuthFailureWindow: time.Minute, BanDuration: time.Hour})
+	assert.False(t, l.AuthFailed("10.0.0.1"), "banned after 1 failure")
+	clock.advance(time.Minute)
+	// the first failure is outside the window by now
+	assert.False(t, l.AuthFailed("10.0.0.1"), "banned after 1 recent failure")
+	assert.False(t, l.AuthFailed("10.0.0.1"), "banned after 2 recent failures")
+	assert.True(t, l.AuthFailed("10.0.0.1"), "not banned after 3 recent failures")
+	assert.True(t, l.Banned("10.0.0.1"), "address not banned")
+	assert.False(t, l.Banned("10.0.0.2"), "other address banned")
+
+	clock.advance(time.Hour + time.Second)
+	assert.False(t, l.Banned("10.0.0.1"), "ban didn't expire")
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	assert.NoErr(t, l.AllowPush("10.0.0.1", "alice"))
+	assert.NoErr(t, l.OpenSession("10.0.0.1", "alice"))
+	l.CloseSession("10.0.0.1", "alice")
+	assert.False(t, l.AuthFailed("10.0.0.1"), "nil limiter banned an address")
+	assert.False(t, l.Banned("10.0.0.1"), "nil limiter banned an address")
+}
+
+func TestRemoteIP(t *testing.T) {
+	assert.Equal(t, remoteIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2223}), "10.0.0.1", "IPv4")
+	assert.Equal(t, remoteIP(&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 2223}), "fd00::1", "IPv6")
+}
@@ -0,0 +1,214 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is how long a proxy is given to send the PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is the longest header of the version 1 of the PROXY protocol.
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature starts the headers of the version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol reads the address of the clients of the connections accepted from load balancers
+// in the PROXY protocol header, version 1 or 2, they start them with. Connections from other
+// sources than the trusted networks are taken as they are, so that nobody else can claim another
+// address.
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewProxyProtocol returns the ProxyProtocol of c, or nil if the PROXY protocol is disabled. It
+// can't be enabled without the trusted networks of the load balancers.
+func NewProxyProtocol(c *Config) (*ProxyProtocol, error) {
+	if !c.SSHProxyProtocol {
+		return nil, nil
+	}
+	p := &ProxyProtocol{timeout: proxyHeaderTimeout}
+	for _, cidr := range strings.Split(c.SSHProxyProtocolTrustedCIDRs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH_PROXY_PROTOCOL_TRUSTED_CIDRS (%s)", err)
+		}
+		p.trusted = append(p.trusted, network)
+	}
+	if len(p.trusted) == 0 {
+		return nil, fmt.Errorf("SSH_PROXY_PROTOCOL_TRUSTED_CIDRS must list the networks of the load balancers to enable the PROXY protocol")
+	}
+	return p, nil
+}
+
+// listener returns l, whose connections from trusted sources have the address of their client.
+func (p *ProxyProtocol) listener(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	return &proxyListener{Listener: l, proxy: p}
+}
+
+// trusts returns true if the connections from addr are expected to start with a header.
+func (p *ProxyProtocol) trusts(addr net.Addr) bool {
+	ip := net.ParseIP(remoteIP(addr))
+	for _, network := range p.trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyListener struct {
+	net.Listener
+	proxy *ProxyProtocol
+}
+
+// Accept returns the next connection. Its header is read by the goroutine handling it, for slow
+// proxies never to hold up the others.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.proxy.trusts(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReaderSize(conn, proxyV1MaxLength), timeout: l.proxy.timeout}, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header, which is read before anything
+// else of it.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+// readHeader reads the header of c once. A malformed header fails the connection.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("reading the PROXY protocol header of %s (%s)", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client, or that of the proxy if it didn't tell it.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the address of the client it
+// tells, nil for the connections proxies open themselves, such as health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2Header(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1Header(r)
+	}
+	return nil, fmt.Errorf("the connection doesn't start with a header")
+}
+
+// readProxyV1Header reads a text header of the version 1, e.g.
+// "PROXY TCP4 192.0.2.1 10.0.0.1 51234 2223\r\n".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("the header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2Header reads a binary header of the version 2.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", verCmd&0xf)
+	}
+	var ipLen int
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		ipLen = net.IPv4len
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// UNIX sockets and unspecified families don't tell an IP address
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("truncated addresses")
+	}
+	ip := net.IP(append([]byte{}, payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen : 2*ipLen+2])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
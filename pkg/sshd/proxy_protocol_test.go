@@ -0,0 +1,100 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewProxyProtocol(t *testing.T) {
+	p, err := NewProxyProtocol(&Config{})
+	assert.NoErr(t, err)
+	assert.True(t, p == nil, "PROXY protocol enabled by default")
+	p, err = NewProxyProtocol(&Config{SSHProxyProtocol: true, SSHProxyProtocolTrustedCIDRs: "10.0.0.0/8, fd00::/8"})
+	assert.NoErr(t, err)
+	assert.True(t, p.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}), "trusted network not trusted")
+	assert.True(t, p.trusts(&net.TCPAddr{IP: net.ParseIP("fd00::1")}), "trusted network not trusted")
+	assert.False(t, p.trusts(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}), "untrusted network trusted")
+	_, err = NewProxyProtocol(&Config{SSHProxyProtocol: true, SSHProxyProtocolTrustedCIDRs: "10.0.0.0"})
+	assert.True(t, err != nil, "accepted an invalid network")
+	_, err = NewProxyProtocol(&Config{SSHProxyProtocol: true, SSHProxyProtocolTrustedCIDRs: " , "})
+	assert.True(t, err != nil, "enabled without trusted networks")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs []byte) []byte {
+		header := append(append([]byte{}, proxyV2Signature...), 0x20|cmd, family, 0, 0)
+		binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+		return append(header, addrs...)
+	}
+	v4Addrs := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0xc8, 0x22, 0x08, 0xaf}
+	for header, expected := range map[string]string{
+		"PROXY TCP4 192.0.2.1 10.0.0.1 51234 2223\r\n":        "192.0.2.1:51234",
+		"PROXY TCP6 2001:db8::1 fd00::1 51234 2223\r\n":       "[2001:db8::1]:51234",
+		"PROXY UNKNOWN\r\n":                                   "",
+		string(v2(1, 0x11, v4Addrs)):                          "192.0.2.1:51234",
+		string(v2(1, 0x11, append(v4Addrs, 0x04, 0, 1, 'x'))): "192.0.2.1:51234",
+		string(v2(0, 0x00, nil)):                              "",
+	} {
+		r := bufio.NewReader(bytes.NewBufferString(header + "SSH-2.0-OpenSSH\r\n"))
+		addr, err := readProxyHeader(r)
+		assert.NoErr(t, err)
+		if expected == "" {
+			assert.True(t, addr == nil, "address of "+header)
+		} else {
+			assert.Equal(t, addr.String(), expected, "address of "+header)
+		}
+		rest, err := ioutil.ReadAll(r)
+		assert.NoErr(t, err)
+		assert.Equal(t, string(rest), "SSH-2.0-OpenSSH\r\n", "data after "+header)
+	}
+	for _, header := range []string{
+		"SSH-2.0-OpenSSH\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 not-an-ip 10.0.0.1 51234 2223\r\n",
+		"PROXY TCP4 192.0.2.1 10.0.0.1 51234 2223 and a very long tail that makes the header longer than the protocol allows",
+		string(v2(1, 0x11, v4Addrs[:4])),
+	} {
+		_, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString(header)))
+		assert.True(t, err != nil, "accepted the header "+header)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoErr(t, err)
+	defer l.Close()
+	p, err := NewProxyProtocol(&Config{SSHProxyProtocol: true, SSHProxyProtocolTrustedCIDRs: "127.0.0.0/8"})
+	assert.NoErr(t, err)
+	l = p.listener(l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.NoErr(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 2223\r\nSSH-2.0-OpenSSH\r\n"))
+	assert.NoErr(t, err)
+	conn, err := l.Accept()
+	assert.NoErr(t, err)
+	defer conn.Close()
+	assert.Equal(t, remoteIP(conn.RemoteAddr()), "192.0.2.1", "remote IP")
+	assert.Equal(t, sshConnection(conn)[:16], "192.0.2.1 51234 ", "SSH_CONNECTION")
+	data := make([]byte, 17)
+	_, err = conn.Read(data)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "SSH-2.0-OpenSSH\r\n", "data after the header")
+
+	// connections from untrusted networks are taken as they are
+	p.trusted = []*net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}}
+	direct, err := net.Dial("tcp", l.Addr().String())
+	assert.NoErr(t, err)
+	defer direct.Close()
+	conn, err = l.Accept()
+	assert.NoErr(t, err)
+	defer conn.Close()
+	assert.Equal(t, remoteIP(conn.RemoteAddr()), "127.0.0.1", "remote IP of an untrusted connection")
+}
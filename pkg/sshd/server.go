@@ -10,10 +10,11 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"time"
 
+	"github.com/drycc/builder/pkg/buildqueue"
 	"github.com/drycc/builder/pkg/controller"
 	"github.com/drycc/builder/pkg/git"
-	"github.com/drycc/controller-sdk-go/hooks"
 	"github.com/drycc/pkg/log"
 	"golang.org/x/crypto/ssh"
 )
@@ -32,39 +33,23 @@ const (
 var errBuildAppPerm = errors.New("user has no permission to build the app")
 var errDirPerm = errors.New("cannot change directory in file name")
 var errDirCreatePerm = errors.New("empty repo name")
+var errBanned = errors.New("too many authentication failures")
 
-// AuthKey authenticates based on a public key.
-func AuthKey(key ssh.PublicKey, cnf *Config) (*ssh.Permissions, error) {
+// AuthKey authenticates a public key with auth.
+func AuthKey(key ssh.PublicKey, auth Authenticator) (*ssh.Permissions, error) {
 	log.Info("Starting ssh authentication")
-	client, err := controller.New(cnf.ControllerHost, cnf.ControllerPort)
+	user, err := auth.Authenticate(key)
 	if err != nil {
+		log.Info("Failed to authenticate user ssh key %s: %s", fingerprint(key), err)
 		return nil, err
 	}
-
-	fp := fingerprint(key)
-
-	userInfo, err := hooks.UserFromKey(client, fp)
-	if controller.CheckAPICompat(client, err) != nil {
-		log.Info("Failed to authenticate user ssh key %s with the controller: %s", fp, err)
-		return nil, err
-	}
-
-	apps := strings.Join(userInfo.Apps, ", ")
-	log.Debug("Key accepted for user %s.", userInfo.Username)
-	perm := &ssh.Permissions{
-		Extensions: map[string]string{
-			"user":        userInfo.Username,
-			"fingerprint": fp,
-			"apps":        apps,
-		},
-	}
-	return perm, nil
+	return permissions(user, key), nil
 }
 
 // Configure creates a new SSH configuration object.
 //
-// Config sets a PublicKeyCallback handler that forwards public key auth
-// requests to the route named "pubkeyAuth".
+// Config sets a PublicKeyCallback handler that authenticates public keys with
+// the backends configured in cnf.AuthBackends.
 //
 // This assumes certain details about our environment, like the location of the
 // host keys. It also provides only key-based authentication.
@@ -72,10 +57,25 @@ func AuthKey(key ssh.PublicKey, cnf *Config) (*ssh.Permissions, error) {
 //
 // Returns:
 //  An *ssh.ServerConfig
-func Configure(cnf *Config) (*ssh.ServerConfig, error) {
+func Configure(cnf *Config, limiter *Limiter) (*ssh.ServerConfig, error) {
+	auth, err := NewAuthenticator(cnf)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Authenticating users with %s", auth.Name())
 	cfg := &ssh.ServerConfig{
 		PublicKeyCallback: func(m ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
-			return AuthKey(k, cnf)
+			ip := remoteIP(m.RemoteAddr())
+			if limiter.Banned(ip) {
+				return nil, errBanned
+			}
+			start := time.Now()
+			perm, err := AuthKey(k, auth)
+			transportMetrics.observe(spanAuth, time.Since(start))
+			if err != nil {
+				transportMetrics.authFailed()
+			}
+			return perm, err
 		},
 	}
 	hostKeyTypes := []string{"rsa", "ecdsa"}
@@ -100,26 +100,56 @@ func Configure(cnf *Config) (*ssh.ServerConfig, error) {
 	return cfg, nil
 }
 
+// ServeOptions are what the SSH server serves pushes with.
+type ServeOptions struct {
+	// Addr is the address to listen on.
+	Addr string
+	// GitHome is the directory the repos are checked out in.
+	GitHome string
+	// Repos loads the repos to the git home and saves them back, they're only kept in the git home
+	// if it's nil.
+	Repos git.RepoStore
+	// PushLock keeps pushes to the same repo from running concurrently.
+	PushLock RepositoryLock
+	// Limiter bans clients and limits their sessions and pushes, nothing is limited if it's nil.
+	Limiter *Limiter
+	// Store is where the status of the builds queued off-peak is looked up.
+	Store ObjectStore
+	// Recorder records push sessions, if it isn't nil.
+	Recorder *SessionRecorder
+	// Tokens mints the tokens the hooks authenticate to the controller with, they use the builder
+	// key if it's nil.
+	Tokens *controller.HookTokens
+	// Proxy reads the address of clients from the PROXY protocol header, if it isn't nil.
+	Proxy *ProxyProtocol
+	// ReceiveType is the command that receives pushes.
+	ReceiveType string
+}
+
 // Serve starts a native SSH server.
-func Serve(
-	cfg *ssh.ServerConfig,
-	serverCircuit *Circuit,
-	gitHomeDir string,
-	concurrentPushLock RepositoryLock,
-	addr, receivetype string) error {
-
-	listener, err := net.Listen("tcp", addr)
+func Serve(cfg *ssh.ServerConfig, serverCircuit *Circuit, opts ServeOptions) error {
+	listener, err := net.Listen("tcp", opts.Addr)
 	if err != nil {
 		return err
 	}
+	listener = opts.Proxy.listener(listener)
 
+	repos := opts.Repos
+	if repos == nil {
+		repos = git.VolumeStore{}
+	}
 	srv := &server{
-		gitHome:     gitHomeDir,
-		pushLock:    concurrentPushLock,
-		receivetype: receivetype,
+		gitHome:     opts.GitHome,
+		repos:       repos,
+		pushLock:    opts.PushLock,
+		limiter:     opts.Limiter,
+		store:       opts.Store,
+		recorder:    opts.Recorder,
+		tokens:      opts.Tokens,
+		receivetype: opts.ReceiveType,
 	}
 
-	log.Info("Listening on %s", addr)
+	log.Info("Listening on %s", opts.Addr)
 	serverCircuit.Close()
 	srv.listen(listener, cfg)
 
@@ -129,7 +159,12 @@ func Serve(
 // server is the struct that encapsulates the SSH server.
 type server struct {
 	gitHome     string
+	repos       git.RepoStore
 	pushLock    RepositoryLock
+	limiter     *Limiter
+	store       ObjectStore
+	recorder    *SessionRecorder
+	tokens      *controller.HookTokens
 	receivetype string
 }
 
@@ -156,13 +191,34 @@ func (s *server) listen(l net.Listener, conf *ssh.ServerConfig) error {
 // It manages the connection, but passes channels on to `answer()`.
 func (s *server) handleConn(conn net.Conn, conf *ssh.ServerConfig) {
 	defer conn.Close()
-	log.Info("Accepted connection.")
+	ip := remoteIP(conn.RemoteAddr())
+	if s.limiter.Banned(ip) {
+		log.Info("Rejected connection from banned address %s.", ip)
+		return
+	}
+	log.Info("Accepted connection from %s.", ip)
+	transportMetrics.session()
+	trace := newTransportTrace(time.Now())
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	trace.span(spanHandshake, trace.start, "")
 	if err != nil {
 		// Handshake failure.
+		transportMetrics.handshakeFailed()
 		log.Err("Failed handshake: %s", err)
+		if authFailed(err) && s.limiter.AuthFailed(ip) {
+			log.Info("Banning %s after repeated authentication failures", ip)
+		}
+		return
+	}
+	user := sshConn.Permissions.Extensions["user"]
+	trace.user = user
+	defer trace.finish()
+	if err := s.limiter.OpenSession(ip, user); err != nil {
+		log.Info("Rejected connection of %s from %s: %s", user, ip, err)
+		sshConn.Close()
 		return
 	}
+	defer s.limiter.CloseSession(ip, user)
 
 	// Discard global requests. We're only concerned with channels.
 	go ssh.DiscardRequests(reqs)
@@ -181,11 +237,32 @@ func (s *server) handleConn(conn net.Conn, conf *ssh.ServerConfig) {
 			// Should close request and move on.
 			panic(err)
 		}
-		go s.answer(channel, req, condata, sshConn)
+		go s.answer(channel, req, condata, sshConn, trace)
 	}
 	conn.Close()
 }
 
+// authFailed returns true if err, the error of a handshake, is that none of the keys the client
+// offered authenticated it, which counts as one failure however many keys it offered. Keys an
+// unavailable controller couldn't check are not the client's fault, and don't count.
+func authFailed(err error) bool {
+	authErr, ok := err.(*ssh.ServerAuthError)
+	if !ok {
+		return false
+	}
+	failed := false
+	for _, err := range authErr.Errors {
+		switch {
+		case err == ssh.ErrNoAuth:
+		case err == errBanned || controller.IsUnavailable(err):
+			return false
+		default:
+			failed = true
+		}
+	}
+	return failed
+}
+
 // sshConnection generates the SSH_CONNECTION environment variable.
 //
 // This is untested on UNIX sockets.
@@ -206,15 +283,18 @@ func sendExitStatus(status uint32, channel ssh.Channel) error {
 
 // answer handles answering requests and channel requests
 //
-// Currently, an exec must be either "ping", "git-receive-pack" or
+// Currently, an exec must be either "ping", "build-status", "git-receive-pack" or
 // "git-upload-pack". Anything else will result in a failure response. Right
 // now, we leave the channel open on failure because it is unclear what the
 // correct behavior for a failed exec is.
 //
 // Support for setting environment variables via `env` has been disabled.
-func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, condata string, sshconn *ssh.ServerConn) error {
+func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, condata string, sshconn *ssh.ServerConn, trace *transportTrace) error {
 	defer channel.Close()
 
+	// term is the terminal type of the client, if it requested a pty
+	var term string
+
 	// Answer all the requests on this connection.
 	for req := range requests {
 		ok := false
@@ -225,6 +305,16 @@ func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, conda
 			ssh.Unmarshal(req.Payload, o)
 			log.Info("Key='%s', Value='%s'\n", o.Name, o.Value)
 			req.Reply(true, nil)
+		case "pty-req":
+			// no pty is allocated, but builds render their output for the client's terminal
+			p := &PtyRequest{}
+			if err := ssh.Unmarshal(req.Payload, p); err != nil {
+				log.Info("Malformed pty request: %s", err)
+				req.Reply(false, nil)
+				break
+			}
+			term = p.Term
+			req.Reply(true, nil)
 		case "exec":
 			clean := cleanExec(req.Payload)
 			parts := strings.SplitN(clean, " ", 2)
@@ -235,6 +325,13 @@ func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, conda
 					log.Info("Error pinging: %s", err)
 				}
 				return err
+			case "build-status":
+				if len(parts) < 2 {
+					log.Info("Expected two-part command.")
+					req.Reply(ok, nil)
+					break
+				}
+				return s.buildStatus(channel, req, sshconn, strings.TrimSpace(parts[1]))
 			case "git-receive-pack", "git-upload-pack":
 				if len(parts) < 2 {
 					log.Info("Expected two-part command.")
@@ -247,7 +344,18 @@ func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, conda
 					channel.Stderr().Write([]byte("No repo given"))
 					return err
 				}
-				wrapErr := wrapInLock(s.pushLock, repoName, s.runReceive(req, sshconn, channel, repoName, parts, condata))
+				if parts[0] == "git-receive-pack" {
+					user := sshconn.Permissions.Extensions["user"]
+					if err := s.limiter.AllowPush(remoteIP(sshconn.RemoteAddr()), user); err != nil {
+						log.Info("Rejected push of %s by %s: %s", repoName, user, err)
+						if pktErr := gitPktLine(channel, fmt.Sprintf("ERR %v\n", err)); pktErr != nil {
+							log.Err("Failed to write to channel: %s", pktErr)
+						}
+						sendExitStatus(1, channel)
+						return nil
+					}
+				}
+				wrapErr := wrapInLock(s.pushLock, repoName, s.runReceive(req, sshconn, channel, repoName, parts, condata, term, trace))
 				if wrapErr == errAlreadyLocked {
 					log.Info(multiplePush)
 					// The error must be in git format
@@ -293,23 +401,43 @@ func (s *server) runReceive(
 	channel ssh.Channel,
 	repoName string,
 	parts []string,
-	connData string,
+	connData,
+	term string,
+	trace *transportTrace,
 ) func() error {
-	return func() error {
+	return func() (recvErr error) {
 		req.Reply(true, nil) // We processed. Yay.
-		if !strings.Contains(sshConn.Permissions.Extensions["apps"], repoName) {
+		if !canPush(sshConn.Permissions.Extensions["apps"], repoName) {
 			return errBuildAppPerm
 		}
+		var hookEnv []string
+		if parts[0] == "git-receive-pack" {
+			var err error
+			if hookEnv, err = s.tokens.Env(repoName, pushUser(sshConn.Permissions, repoName)); err != nil {
+				return err
+			}
+		}
 		repo := repoName + ".git"
-		recvErr := git.Receive(
+		receiveTrace := &git.ReceiveTrace{ID: trace.id}
+		defer trace.receive(repo, receiveTrace)
+		if s.recorder != nil && parts[0] == "git-receive-pack" {
+			rec := s.recorder.start(trace, remoteIP(sshConn.RemoteAddr()), sessionCommand(parts, term))
+			channel = rec.wrap(channel)
+			defer func() { rec.save(recvErr) }()
+		}
+		recvErr = git.Receive(
 			repo,
 			parts[0],
 			s.gitHome,
+			s.repos,
 			channel,
 			sshConn.Permissions.Extensions["fingerprint"],
-			sshConn.Permissions.Extensions["user"],
+			pushUser(sshConn.Permissions, repoName),
 			connData,
 			s.receivetype,
+			term,
+			hookEnv,
+			receiveTrace,
 		)
 
 		return recvErr
@@ -321,6 +449,16 @@ type ExecCmd struct {
 	Value string
 }
 
+// PtyRequest is an SSH pty-req request.
+type PtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
 // EnvVar is an SSH env request.
 type EnvVar struct {
 	Name  string
@@ -360,6 +498,30 @@ func Ping(channel ssh.Channel, req *ssh.Request) error {
 	return nil
 }
 
+// buildStatus writes the status of the queued build of ticket to the channel, if the user of
+// sshConn can push to its app.
+func (s *server) buildStatus(channel ssh.Channel, req *ssh.Request, sshConn *ssh.ServerConn, ticket string) error {
+	req.Reply(true, nil)
+	var b *buildqueue.Build
+	var err error
+	if s.store != nil {
+		b, err = buildqueue.Get(s.store, ticket)
+	}
+	if err != nil {
+		log.Err("Failed to read the queued build %s: %s", ticket, err)
+		channel.Stderr().Write([]byte("Failed to read the queued build\n"))
+		return sendExitStatus(1, channel)
+	}
+	if b == nil || !canPush(sshConn.Permissions.Extensions["apps"], b.App) {
+		channel.Stderr().Write([]byte(fmt.Sprintf("No queued build %s\n", ticket)))
+		return sendExitStatus(1, channel)
+	}
+	if _, err := channel.Write([]byte(b.Describe() + "\n")); err != nil {
+		log.Err("Failed to write to channel: %s", err)
+	}
+	return sendExitStatus(0, channel)
+}
+
 // cleanRepoName cleans a repository name for a git-sh operation.
 func cleanRepoName(name string) (string, error) {
 	if len(name) == 0 {
@@ -2,6 +2,7 @@ package sshd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -16,6 +17,14 @@ const (
 	gitHome = "/git"
 )
 
+func TestAuthFailed(t *testing.T) {
+	rejected := errors.New("unknown key")
+	assert.True(t, authFailed(&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth, rejected, rejected, rejected}}), "keys rejected")
+	assert.False(t, authFailed(&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth}}), "no key offered")
+	assert.False(t, authFailed(&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth, errBanned}}), "banned address")
+	assert.False(t, authFailed(errors.New("EOF")), "handshake failure")
+}
+
 func TestGitPktLine(t *testing.T) {
 	b := new(bytes.Buffer)
 	str := "hello world"
@@ -87,6 +96,9 @@ func TestReceive(t *testing.T) {
 	if err := sess.Setenv("HELLO", "world"); err != nil {
 		t.Fatal(err)
 	}
+	if err := sess.RequestPty("xterm-256color", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
 
 	if out, err := sess.Output("ping"); err != nil {
 		t.Errorf("Output '%s' Error %s", out, err)
@@ -249,7 +261,7 @@ func runServer(
 	t *testing.T) {
 
 	go func() {
-		if err := Serve(config, c, gitHome, pushLock, testAddr, "mock"); err != nil {
+		if err := Serve(config, c, ServeOptions{Addr: testAddr, GitHome: gitHome, PushLock: pushLock, ReceiveType: "mock"}); err != nil {
 			t.Fatalf("Failed serving with %s", err)
 		}
 	}()
@@ -0,0 +1,296 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/drycc/pkg/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// RecordingsPrefix is the object storage prefix under which session recordings are stored, in a
+// directory per day: /sessions/<YYYY-MM-DD>/<trace-id>.log.
+const RecordingsPrefix = "/sessions"
+
+// maxPendingBytes is how much of a line is held back from a recording until its end, for longer
+// lines to be recorded in parts.
+const maxPendingBytes = 4096
+
+// packSignature starts the pack data of a push, which isn't recorded.
+var packSignature = []byte("PACK")
+
+// redactions replace the secrets commonly found in build output and push options.
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// the values of env push options are app config, whatever their key, and run up to the end of
+	// their pkt-line, which also redacts the options following one without a line feed
+	{regexp.MustCompile(`(env:[A-Za-z_][A-Za-z0-9_]*=)[^\n\x00]*`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)\b([a-z0-9_]*(?:password|passwd|secret|token|api_?key|credentials?)[a-z0-9_]*)(\s*[=:]\s*)\S+`), "${1}${2}[REDACTED]"},
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[a-z0-9._~+/=-]+`), "${1} [REDACTED]"},
+	{regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`), "://[REDACTED]@"},
+	{regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), "[REDACTED]"},
+}
+
+// SessionRecorder records the I/O of push sessions, except their pack data, to the object
+// storage, for support to look into the problems of clients. Secrets are redacted from the
+// recordings, which are deleted after their retention.
+type SessionRecorder struct {
+	store     ObjectStore
+	maxBytes  int
+	retention time.Duration
+	redact    *regexp.Regexp
+	now       func() time.Time
+}
+
+// NewSessionRecorder returns the SessionRecorder of c, storing recordings in store, or nil if
+// session recording is disabled.
+func NewSessionRecorder(c *Config, store ObjectStore) (*SessionRecorder, error) {
+	if !c.SessionRecording {
+		return nil, nil
+	}
+	r := &SessionRecorder{
+		store:     store,
+		maxBytes:  c.SessionRecordingMaxBytes,
+		retention: time.Duration(c.SessionRecordingRetentionDays) * 24 * time.Hour,
+		now:       time.Now,
+	}
+	if c.SessionRecordingRetentionDays <= 0 {
+		return nil, fmt.Errorf("SESSION_RECORDING_RETENTION_DAYS must be positive")
+	}
+	if c.SessionRecordingRedact != "" {
+		var err error
+		if r.redact, err = regexp.Compile(c.SessionRecordingRedact); err != nil {
+			return nil, fmt.Errorf("invalid SESSION_RECORDING_REDACT (%s)", err)
+		}
+	}
+	return r, nil
+}
+
+// redacted returns s with its secrets replaced.
+func (r *SessionRecorder) redacted(s string) string {
+	for _, redaction := range redactions {
+		s = redaction.re.ReplaceAllString(s, redaction.repl)
+	}
+	if r.redact != nil {
+		s = r.redact.ReplaceAllString(s, "[REDACTED]")
+	}
+	return s
+}
+
+// start starts the recording of the session traced by trace, running command.
+func (r *SessionRecorder) start(trace *transportTrace, addr, command string) *sessionRecording {
+	rec := &sessionRecording{recorder: r, id: trace.id, start: r.now()}
+	fmt.Fprintf(&rec.buf, "# session %s of %s from %s at %s\n", trace.id, trace.user, addr, rec.start.UTC().Format(time.RFC3339))
+	rec.write("exec", []byte(command))
+	return rec
+}
+
+// Prune deletes the recordings of the days older than the retention.
+func (r *SessionRecorder) Prune() error {
+	days, err := r.store.List(context.Background(), RecordingsPrefix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	oldest := r.now().UTC().Add(-r.retention).Format("2006-01-02")
+	for _, day := range days {
+		if path.Base(day) >= oldest {
+			continue
+		}
+		if err := r.store.Delete(context.Background(), day); err != nil {
+			log.Err("Failed to delete the session recordings of %s: %s", path.Base(day), err)
+		}
+	}
+	return nil
+}
+
+// RunRetention prunes the recordings every interval until the process exits. Errors are logged
+// rather than returned.
+func (r *SessionRecorder) RunRetention(interval time.Duration) {
+	for {
+		if err := r.Prune(); err != nil {
+			log.Err("Failed to list the session recordings: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sessionRecording is the recording of a session in progress.
+type sessionRecording struct {
+	recorder *SessionRecorder
+	id       string
+	start    time.Time
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	packBytes int64
+	truncated bool
+	// tail is the end of the input read so far, for the pack signature to be found across reads.
+	tail []byte
+	// pending is the data of each direction after its last line end, which is recorded once the
+	// line ends, for the secrets split across reads and writes to be redacted.
+	pending map[string][]byte
+}
+
+// record adds the data sent in direction dir, "in", "out" or "err", to the recording, a line at
+// a time.
+func (s *sessionRecording) record(dir string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.truncated || len(data) == 0 {
+		return
+	}
+	if s.pending == nil {
+		s.pending = map[string][]byte{}
+	}
+	pending := append(s.pending[dir], data...)
+	end := bytes.LastIndexAny(pending, "\r\n") + 1
+	if len(pending)-end > maxPendingBytes {
+		end = len(pending)
+	}
+	s.pending[dir] = append([]byte(nil), pending[end:]...)
+	s.write(dir, pending[:end])
+}
+
+// flush records the data of dir held back until the end of its line. s.mu must be held.
+func (s *sessionRecording) flush(dir string) {
+	pending := s.pending[dir]
+	delete(s.pending, dir)
+	s.write(dir, pending)
+}
+
+// write adds data to the recording as it is. s.mu must be held.
+func (s *sessionRecording) write(dir string, data []byte) {
+	if s.truncated || len(data) == 0 {
+		return
+	}
+	elapsed := s.recorder.now().Sub(s.start).Seconds()
+	line := fmt.Sprintf("%.3f %s %q\n", elapsed, dir, s.recorder.redacted(string(data)))
+	if s.recorder.maxBytes > 0 && s.buf.Len()+len(line) > s.recorder.maxBytes {
+		s.truncated = true
+		s.buf.WriteString("# truncated\n")
+		return
+	}
+	s.buf.WriteString(line)
+}
+
+// input records data read from the client, until its pack data starts.
+func (s *sessionRecording) input(data []byte) {
+	s.mu.Lock()
+	inPack := s.packBytes > 0
+	s.mu.Unlock()
+	if !inPack {
+		joined := append(s.tail, data...)
+		i := bytes.Index(joined, packSignature)
+		if i < 0 {
+			s.record("in", data)
+			if len(joined) >= len(packSignature) {
+				joined = joined[len(joined)-len(packSignature)+1:]
+			}
+			s.tail = append([]byte(nil), joined...)
+			return
+		}
+		// the start of a signature split across reads was already recorded
+		if i -= len(s.tail); i < 0 {
+			i = 0
+		}
+		s.record("in", data[:i])
+		data = data[i:]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush("in")
+	s.packBytes += int64(len(data))
+}
+
+// wrap returns channel, with its I/O recorded.
+func (s *sessionRecording) wrap(channel ssh.Channel) ssh.Channel {
+	return &recordedChannel{Channel: channel, rec: s}
+}
+
+// save stores the recording once the session ended with err.
+func (s *sessionRecording) save(err error) {
+	s.mu.Lock()
+	for _, dir := range []string{"in", "out", "err"} {
+		s.flush(dir)
+	}
+	if s.packBytes > 0 {
+		fmt.Fprintf(&s.buf, "# pack data not recorded, %d bytes\n", s.packBytes)
+	}
+	status := "ok"
+	if err != nil {
+		status = s.recorder.redacted(err.Error())
+	}
+	fmt.Fprintf(&s.buf, "# ended after %s: %s\n", s.recorder.now().Sub(s.start).Round(time.Millisecond), status)
+	data := s.buf.Bytes()
+	s.mu.Unlock()
+	key := path.Join(RecordingsPrefix, s.start.UTC().Format("2006-01-02"), s.id+".log")
+	if err := s.recorder.store.PutContent(context.Background(), key, data); err != nil {
+		log.Err("Failed to store the session recording %s: %s", key, err)
+		return
+	}
+	log.Info("Recorded session %s to %s", s.id, key)
+}
+
+// recordedChannel is an ssh.Channel whose I/O is recorded.
+type recordedChannel struct {
+	ssh.Channel
+	rec *sessionRecording
+}
+
+func (c *recordedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.rec.input(p[:n])
+	return n, err
+}
+
+func (c *recordedChannel) Write(p []byte) (int, error) {
+	c.rec.record("out", p)
+	return c.Channel.Write(p)
+}
+
+func (c *recordedChannel) Stderr() io.ReadWriter {
+	return &recordedStderr{ReadWriter: c.Channel.Stderr(), rec: c.rec}
+}
+
+// recordedStderr is the stderr of a recordedChannel.
+type recordedStderr struct {
+	io.ReadWriter
+	rec *sessionRecording
+}
+
+func (e *recordedStderr) Write(p []byte) (int, error) {
+	e.rec.record("err", p)
+	return e.ReadWriter.Write(p)
+}
+
+// ObjectStore is the subset of a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// the SSH server needs, to look up queued builds and store session recordings.
+type ObjectStore interface {
+	GetContent(ctx context.Context, path string) ([]byte, error)
+	PutContent(ctx context.Context, path string, content []byte) error
+	List(ctx context.Context, path string) ([]string, error)
+	Delete(ctx context.Context, path string) error
+}
+
+// sessionCommand returns the command of a recorded session, with the terminal of the client if
+// it requested one.
+func sessionCommand(parts []string, term string) string {
+	command := strings.Join(parts, " ")
+	if term != "" {
+		command += " (pty " + term + ")"
+	}
+	return command
+}
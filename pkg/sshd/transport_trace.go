@@ -0,0 +1,194 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drycc/builder/pkg/git"
+	"github.com/drycc/pkg/log"
+	"github.com/pborman/uuid"
+)
+
+// The spans of the transport traces of SSH sessions.
+const (
+	// spanHandshake is the SSH handshake of a session, including the authentication of its key.
+	spanHandshake = "handshake"
+	// spanAuth is the authentication of the key of a session, only measured by the metrics, as
+	// it's part of the handshake.
+	spanAuth = "auth"
+	// spanReceive is the transfer of the pack of a push, from the client to git-receive-pack.
+	spanReceive = "receive"
+	// spanHook is the pre-receive hook of a push, which builds and releases it.
+	spanHook = "hook"
+)
+
+// transportDurationBuckets are the upper bounds, in seconds, of the buckets of the duration
+// histograms of the transport.
+var transportDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// transportSpan is a timed phase of a session.
+type transportSpan struct {
+	name     string
+	duration time.Duration
+	// detail is what the phase handled, e.g. the repo and the size of a pack.
+	detail string
+}
+
+// transportTrace follows an SSH session through the transport: its handshake and, for pushes,
+// the receive of the pack and the hook. It's logged as one line when the session ends, for
+// operators to tell whether a slow push was slow to transfer or to build.
+type transportTrace struct {
+	id    string
+	user  string
+	start time.Time
+
+	mu    sync.Mutex
+	spans []transportSpan
+}
+
+// newTransportTrace returns the trace of a session that started at start.
+func newTransportTrace(start time.Time) *transportTrace {
+	return &transportTrace{id: strings.Split(uuid.New(), "-")[0], start: start}
+}
+
+// span records the phase name that started at start and ended now, and observes its duration.
+func (t *transportTrace) span(name string, start time.Time, detail string) {
+	d := time.Since(start)
+	transportMetrics.observe(name, d)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, transportSpan{name: name, duration: d, detail: detail})
+}
+
+// receive records the spans of a receive of repo.
+func (t *transportTrace) receive(repo string, rt *git.ReceiveTrace) {
+	if rt.PackDuration > 0 {
+		transportMetrics.received(rt.PackBytes)
+		t.span(spanReceive, time.Now().Add(-rt.PackDuration), fmt.Sprintf("%s, %d bytes", repo, rt.PackBytes))
+	}
+	if rt.HookDuration > 0 {
+		t.span(spanHook, time.Now().Add(-rt.HookDuration), repo)
+	}
+}
+
+// String returns the spans of t, e.g. "handshake 12ms, receive 1.2s (app.git, 5242880 bytes)".
+func (t *transportTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.spans))
+	for _, s := range t.spans {
+		part := fmt.Sprintf("%s %s", s.name, s.duration.Round(time.Millisecond))
+		if s.detail != "" {
+			part += " (" + s.detail + ")"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// finish logs t once its session ended.
+func (t *transportTrace) finish() {
+	log.Info("Transport trace %s of %s: %s, total %s", t.id, t.user, t, time.Since(t.start).Round(time.Millisecond))
+}
+
+// histogram is a Prometheus histogram of durations.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// transportStats holds the metrics of the transport since the builder started.
+type transportStats struct {
+	mu                sync.Mutex
+	sessions          int64
+	handshakeFailures int64
+	authFailures      int64
+	receivedBytes     int64
+	durations         map[string]*histogram
+}
+
+var transportMetrics = &transportStats{durations: map[string]*histogram{}}
+
+func (s *transportStats) session() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions++
+}
+
+func (s *transportStats) handshakeFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakeFailures++
+}
+
+func (s *transportStats) authFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authFailures++
+}
+
+func (s *transportStats) received(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receivedBytes += bytes
+}
+
+// observe adds the duration d of the span name to its histogram.
+func (s *transportStats) observe(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.durations[name]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(transportDurationBuckets))}
+		s.durations[name] = h
+	}
+	for i, bound := range transportDurationBuckets {
+		if d.Seconds() <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d.Seconds()
+}
+
+// WriteTransportMetrics writes the metrics of the SSH transport to w in the Prometheus text
+// format: the sessions, the handshake and authentication failures, the bytes received and the
+// durations of the handshakes, authentications, pack receives and hooks.
+func WriteTransportMetrics(w io.Writer) {
+	s := transportMetrics
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"builder_ssh_sessions_total", "SSH sessions accepted.", s.sessions},
+		{"builder_ssh_handshake_failures_total", "SSH handshakes that failed, including authentications.", s.handshakeFailures},
+		{"builder_ssh_auth_failures_total", "SSH keys that failed to authenticate.", s.authFailures},
+		{"builder_git_received_bytes_total", "Bytes of the packs received by git-receive-pack.", s.receivedBytes},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+	const name = "builder_git_transport_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Durations of the phases of the git transport: handshake, auth, receive and hook.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, span := range []string{spanHandshake, spanAuth, spanReceive, spanHook} {
+		h, ok := s.durations[span]
+		if !ok {
+			continue
+		}
+		for i, bound := range transportDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"%g\"} %d\n", name, span, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"+Inf\"} %d\n", name, span, h.count)
+		fmt.Fprintf(w, "%s_sum{phase=%q} %g\n", name, span, h.sum)
+		fmt.Fprintf(w, "%s_count{phase=%q} %d\n", name, span, h.count)
+	}
+}
@@ -0,0 +1,42 @@
+package sshd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/git"
+)
+
+func TestTransportTrace(t *testing.T) {
+	trace := newTransportTrace(time.Now())
+	assert.Equal(t, len(trace.id), 8, "length of the trace ID")
+	trace.span(spanHandshake, time.Now().Add(-20*time.Millisecond), "")
+	trace.receive("app.git", &git.ReceiveTrace{PackBytes: 2048, PackDuration: 1500 * time.Millisecond, HookDuration: 40 * time.Second})
+	trace.receive("other.git", &git.ReceiveTrace{})
+
+	spans := trace.String()
+	assert.True(t, strings.HasPrefix(spans, "handshake "), "spans "+spans)
+	assert.True(t, strings.HasSuffix(spans, ", receive 1.5s (app.git, 2048 bytes), hook 40s (app.git)"), "spans "+spans)
+}
+
+func TestWriteTransportMetrics(t *testing.T) {
+	transportMetrics = &transportStats{durations: map[string]*histogram{}}
+	transportMetrics.observe(spanHook, 45*time.Second)
+	transportMetrics.received(1024)
+	var out bytes.Buffer
+	WriteTransportMetrics(&out)
+	metrics := out.String()
+	for _, line := range []string{
+		"# TYPE builder_git_transport_duration_seconds histogram",
+		`builder_git_transport_duration_seconds_bucket{phase="hook",le="30"} 0`,
+		`builder_git_transport_duration_seconds_bucket{phase="hook",le="60"} 1`,
+		`builder_git_transport_duration_seconds_bucket{phase="hook",le="+Inf"} 1`,
+		`builder_git_transport_duration_seconds_count{phase="hook"} 1`,
+		"# TYPE builder_git_received_bytes_total counter",
+	} {
+		assert.True(t, strings.Contains(metrics, line+"\n"), "metrics lack "+line+":\n"+metrics)
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// ChecksumSuffix is appended to an object key to get the key of the object holding its SHA256
+// digest.
+const ChecksumSuffix = ".sha256"
+
+// ErrChecksumMismatch is returned by VerifyChecksum when the digest of an object doesn't match the
+// digest recorded for it.
+type ErrChecksumMismatch struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+// Error is the error interface implementation.
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected sha256 %s, got %s", e.Key, e.Expected, e.Actual)
+}
+
+// ObjectReader is a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// compatible interface, restricted to the functions needed to read objects.
+type ObjectReader interface {
+	ObjectGetter
+	Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
+}
+
+// ObjectPutter is a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// compatible interface, restricted to just the PutContent function.
+type ObjectPutter interface {
+	PutContent(ctx context.Context, path string, content []byte) error
+}
+
+// ChecksumKey returns the key of the object holding the digest of the object at key.
+func ChecksumKey(key string) string {
+	return key + ChecksumSuffix
+}
+
+// SHA256 returns the hex encoded SHA256 digest of everything read from r.
+func SHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PutChecksum records sum as the digest of the object at key.
+func PutChecksum(putter ObjectPutter, key, sum string) error {
+	return putter.PutContent(context.Background(), ChecksumKey(key), []byte(sum))
+}
+
+// GetChecksum returns the digest recorded for the object at key, or "" if none was recorded.
+func GetChecksum(getter ObjectGetter, key string) (string, error) {
+	data, err := getter.GetContent(context.Background(), ChecksumKey(key))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// VerifyChecksum streams the object at key and compares its digest with the one recorded for
+// it. Returns false, nil if no digest was recorded, true, nil if the digests match and
+// ErrChecksumMismatch if they don't.
+func VerifyChecksum(reader ObjectReader, key string) (bool, error) {
+	expected, err := GetChecksum(reader, key)
+	if err != nil || expected == "" {
+		return false, err
+	}
+	rc, err := reader.Reader(context.Background(), key, 0)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	actual, err := SHA256(rc)
+	if err != nil {
+		return false, err
+	}
+	if actual != expected {
+		return false, ErrChecksumMismatch{Key: key, Expected: expected, Actual: actual}
+	}
+	return true, nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+const (
+	slugKey = "/home/app/push/slug.tgz"
+	// a digest that doesn't match the test slug
+	badSlugSum = "96ee3a8dd1f4ec7ebc3e1ea8b1f2ef3b5d62b1e1bcd33fa8cf9f4c1ff4d9fdc7"
+)
+
+func TestSHA256(t *testing.T) {
+	sum, err := SHA256(strings.NewReader("hello"))
+	assert.NoErr(t, err)
+	assert.Equal(t, sum, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "digest")
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	driver, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, driver.PutContent(context.Background(), slugKey, []byte("slug")))
+
+	verified, err := VerifyChecksum(driver, slugKey)
+	assert.NoErr(t, err)
+	assert.False(t, verified, "verified an object without a recorded checksum")
+
+	sum, err := SHA256(strings.NewReader("slug"))
+	assert.NoErr(t, err)
+	assert.NoErr(t, PutChecksum(driver, slugKey, sum))
+	verified, err = VerifyChecksum(driver, slugKey)
+	assert.NoErr(t, err)
+	assert.True(t, verified, "object was not verified")
+
+	assert.NoErr(t, PutChecksum(driver, slugKey, badSlugSum))
+	_, err = VerifyChecksum(driver, slugKey)
+	if _, ok := err.(ErrChecksumMismatch); !ok {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// ObjectWriter is a *(github.com/docker/distribution/registry/storage/driver).StorageDriver
+// compatible interface, restricted to the functions needed to write objects and check them once
+// written.
+type ObjectWriter interface {
+	ObjectReader
+	ObjectPutter
+	Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error)
+}
+
+// CopyObject streams the object at key from src to the same key in dst and returns its digest.
+// If src has a digest recorded for the object, the copy is refused when the object doesn't match
+// it. The digest is recorded in dst as well, and the copy verified against it once written.
+func CopyObject(src ObjectReader, dst ObjectWriter, key string) (string, error) {
+	expected, err := GetChecksum(src, key)
+	if err != nil {
+		return "", err
+	}
+	rc, err := src.Reader(context.Background(), key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	fw, err := dst.Writer(context.Background(), key, false)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fw, h), rc); err != nil {
+		fw.Cancel()
+		return "", fmt.Errorf("copying %s (%s)", key, err)
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && actual != expected {
+		fw.Cancel()
+		return "", ErrChecksumMismatch{Key: key, Expected: expected, Actual: actual}
+	}
+	if err := fw.Commit(); err != nil {
+		return "", fmt.Errorf("copying %s (%s)", key, err)
+	}
+	if err := fw.Close(); err != nil {
+		return "", fmt.Errorf("copying %s (%s)", key, err)
+	}
+	if err := PutChecksum(dst, key, actual); err != nil {
+		return "", err
+	}
+	if _, err := VerifyChecksum(dst, key); err != nil {
+		return "", err
+	}
+	return actual, nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+func TestCopyObject(t *testing.T) {
+	src, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	dst, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, src.PutContent(context.Background(), slugKey, []byte("slug")))
+	sum, err := SHA256(strings.NewReader("slug"))
+	assert.NoErr(t, err)
+	assert.NoErr(t, PutChecksum(src, slugKey, sum))
+
+	copied, err := CopyObject(src, dst, slugKey)
+	assert.NoErr(t, err)
+	assert.Equal(t, copied, sum, "digest")
+	data, err := dst.GetContent(context.Background(), slugKey)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(data), "slug", "copied object")
+	recorded, err := GetChecksum(dst, slugKey)
+	assert.NoErr(t, err)
+	assert.Equal(t, recorded, sum, "recorded digest")
+
+	// corrupted objects aren't copied
+	other, err := factory.Create("inmemory", nil)
+	assert.NoErr(t, err)
+	assert.NoErr(t, PutChecksum(src, slugKey, badSlugSum))
+	_, err = CopyObject(src, other, slugKey)
+	if _, ok := err.(ErrChecksumMismatch); !ok {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+	exists, err := ObjectExists(other, slugKey)
+	assert.NoErr(t, err)
+	assert.False(t, exists, "corrupted object was copied")
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// expirationRuleID is the ID of the lifecycle rule SetExpiration adds to buckets.
+const expirationRuleID = "drycc-builder-expiration"
+
+// KeyRegexp matches the keys the builder stores objects under. Unlike the paths the storage
+// drivers of the registry accept by default, they may contain ':' and have no leading '/'.
+var KeyRegexp = regexp.MustCompile(`^([A-Za-z0-9._:-]*(/[A-Za-z0-9._:-]+)*)+$`)
+
+// Drivers are the storages of the classes of objects the builder keeps. The build caches and the
+// audit log can each be kept in a storage of their own, the other objects (sources, slugs,
+// manifests and repositories) are artifacts. Classes without a storage of their own use the
+// artifacts driver.
+type Drivers struct {
+	Artifacts storagedriver.StorageDriver
+	Cache     storagedriver.StorageDriver
+	Logs      storagedriver.StorageDriver
+}
+
+// NewDrivers returns the Drivers keeping every class of objects in driver.
+func NewDrivers(driver storagedriver.StorageDriver) Drivers {
+	return Drivers{Artifacts: driver, Cache: driver, Logs: driver}
+}
+
+// SetExpiration sets the lifecycle policy of the bucket that the s3 storage driver created with
+// params stores objects in, for the objects it stores to expire after days. The policy replaces
+// any other of the bucket, which should be dedicated to the objects.
+func SetExpiration(params map[string]interface{}, days int) error {
+	client, bucket, rootDirectory, err := newS3Client(params)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimLeft(strings.TrimRight(rootDirectory, "/")+"/", "/")
+	_, err = client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: []*s3.LifecycleRule{{
+				ID:         aws.String(expirationRuleID),
+				Status:     aws.String(s3.ExpirationStatusEnabled),
+				Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+				Expiration: &s3.LifecycleExpiration{Days: aws.Int64(int64(days))},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("setting the lifecycle policy of bucket %s (%s)", bucket, err)
+	}
+	return nil
+}
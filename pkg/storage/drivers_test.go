@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestSetExpiration(t *testing.T) {
+	var method, path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.RequestURI(), string(data)
+	}))
+	defer srv.Close()
+
+	params := map[string]interface{}{
+		"accesskey":      "access",
+		"secretkey":      "secret",
+		"bucket":         "builder-cache",
+		"region":         "us-east-1",
+		"regionendpoint": srv.URL,
+		"secure":         false,
+		"rootdirectory":  "/caches",
+	}
+	assert.NoErr(t, SetExpiration(params, 30))
+	assert.Equal(t, method, "PUT", "method")
+	assert.Equal(t, path, "/builder-cache?lifecycle=", "path")
+	assert.True(t, strings.Contains(body, "<Days>30</Days>"), "expiration of the rule")
+	assert.True(t, strings.Contains(body, "<Prefix>caches/</Prefix>"), "prefix of the rule")
+
+	delete(params, "bucket")
+	assert.True(t, SetExpiration(params, 30) != nil, "set the expiration without a bucket")
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Presigner signs URLs through which an object can be read or written for a limited time,
+// without the credentials of the object storage.
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+	PresignPut(key string, ttl time.Duration) (string, error)
+}
+
+// S3Presigner is the Presigner of an S3 compatible object storage.
+type S3Presigner struct {
+	client        *s3.S3
+	bucket        string
+	rootDirectory string
+}
+
+// NewS3Presigner returns the S3Presigner of the object storage that the s3 storage driver created
+// with params connects to.
+func NewS3Presigner(params map[string]interface{}) (*S3Presigner, error) {
+	client, bucket, rootDirectory, err := newS3Client(params)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Presigner{client: client, bucket: bucket, rootDirectory: rootDirectory}, nil
+}
+
+// newS3Client returns a client of the object storage that the s3 storage driver created with params
+// connects to, with the bucket and root directory the driver stores objects in.
+func newS3Client(params map[string]interface{}) (*s3.S3, string, string, error) {
+	param := func(key string) string {
+		if value, ok := params[key]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+	bucket := param("bucket")
+	if bucket == "" {
+		return nil, "", "", fmt.Errorf("no bucket parameter provided")
+	}
+	region := param("region")
+	if region == "" {
+		return nil, "", "", fmt.Errorf("no region parameter provided")
+	}
+
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if accessKey := param("accesskey"); accessKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKey, param("secretkey"), ""))
+	}
+	if endpoint := param("regionendpoint"); endpoint != "" {
+		awsConfig.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	if param("secure") == "false" {
+		awsConfig.WithDisableSSL(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return s3.New(sess), bucket, param("rootdirectory"), nil
+}
+
+// objectKey returns the key of the object the storage driver stores at key, the same way the s3
+// storage driver does.
+func (p *S3Presigner) objectKey(key string) string {
+	return strings.TrimLeft(strings.TrimRight(p.rootDirectory, "/")+key, "/")
+}
+
+// PresignGet is the Presigner interface implementation.
+func (p *S3Presigner) PresignGet(key string, ttl time.Duration) (string, error) {
+	req, _ := p.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(p.objectKey(key)),
+	})
+	return req.Presign(ttl)
+}
+
+// PresignPut is the Presigner interface implementation.
+func (p *S3Presigner) PresignPut(key string, ttl time.Duration) (string, error) {
+	req, _ := p.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(p.objectKey(key)),
+	})
+	return req.Presign(ttl)
+}
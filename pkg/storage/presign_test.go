@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewS3Presigner(t *testing.T) {
+	_, err := NewS3Presigner(map[string]interface{}{"region": "us-east-1"})
+	assert.True(t, err != nil, "created a presigner without a bucket")
+	_, err = NewS3Presigner(map[string]interface{}{"bucket": "builder"})
+	assert.True(t, err != nil, "created a presigner without a region")
+}
+
+func TestS3Presigner(t *testing.T) {
+	p, err := NewS3Presigner(map[string]interface{}{
+		"accesskey":      "access",
+		"secretkey":      "secret",
+		"bucket":         "builder",
+		"region":         "us-east-1",
+		"regionendpoint": "http://minio:9000",
+		"secure":         false,
+	})
+	assert.NoErr(t, err)
+
+	get, err := p.PresignGet("home/app:git-12345678/tar", time.Hour)
+	assert.NoErr(t, err)
+	u, err := url.Parse(get)
+	assert.NoErr(t, err)
+	assert.Equal(t, u.Scheme, "http", "scheme")
+	assert.Equal(t, u.Host, "minio:9000", "host")
+	assert.Equal(t, u.Path, "/builder/home/app:git-12345678/tar", "path")
+	assert.Equal(t, u.Query().Get("X-Amz-Expires"), "3600", "expiry")
+	assert.True(t, u.Query().Get("X-Amz-Signature") != "", "the URL isn't signed")
+	assert.Equal(t, u.Query().Get("X-Amz-Credential")[:len("access/")], "access/", "credential")
+
+	put, err := p.PresignPut("/home/app:git-12345678/push/slug.tgz", time.Minute)
+	assert.NoErr(t, err)
+	u, err = url.Parse(put)
+	assert.NoErr(t, err)
+	assert.Equal(t, u.Path, "/builder/home/app:git-12345678/push/slug.tgz", "path")
+	assert.True(t, get != put, "GET and PUT URLs are the same")
+}
@@ -0,0 +1,159 @@
+package testing
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/controller-sdk-go/api"
+)
+
+// keyHookPath is the path of the hook returning the user of an SSH key, by fingerprint.
+const keyHookPath = "/v2/hooks/key/"
+
+// BuildRequest is a request of the builder to release a build, as the Controller received it.
+type BuildRequest struct {
+	api.BuildHookRequest
+	Config      map[string]string `json:"config,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Strategy    string            `json:"strategy,omitempty"`
+	SlugRunner  string            `json:"slugrunner,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+}
+
+// Controller is a fake of the hooks of the controller the builder calls: it serves the configs of
+// apps and the users of SSH keys it's given, and records the builds it's asked to release.
+type Controller struct {
+	server *httptest.Server
+
+	mu          sync.Mutex
+	configs     map[string]api.Config
+	users       map[string]api.UserApps
+	builds      []BuildRequest
+	unavailable bool
+}
+
+// NewController starts a Controller. It must be closed once the test ended.
+func NewController() *Controller {
+	c := &Controller{
+		configs: make(map[string]api.Config),
+		users:   make(map[string]api.UserApps),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/hooks/config/", c.serveConfig)
+	mux.HandleFunc("/v2/hooks/build/", c.serveBuild)
+	mux.HandleFunc(keyHookPath, c.serveKey)
+	c.server = httptest.NewServer(c.withHeaders(mux))
+	return c
+}
+
+// Close stops c.
+func (c *Controller) Close() {
+	c.server.Close()
+}
+
+// Host returns the host c listens on, to set as the ControllerHost of the builder.
+func (c *Controller) Host() string {
+	host, _, _ := net.SplitHostPort(c.server.Listener.Addr().String())
+	return host
+}
+
+// Port returns the port c listens on, to set as the ControllerPort of the builder.
+func (c *Controller) Port() string {
+	_, port, _ := net.SplitHostPort(c.server.Listener.Addr().String())
+	return port
+}
+
+// SetConfig sets the config of app to config.
+func (c *Controller) SetConfig(app string, config api.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configs[app] = config
+}
+
+// AddKey makes c return user as the user of the SSH key with fingerprint.
+func (c *Controller) AddKey(fingerprint string, user api.UserApps) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[fingerprint] = user
+}
+
+// SetUnavailable makes c answer every request with 503 Service Unavailable while unavailable is
+// set, like a controller that's restarting.
+func (c *Controller) SetUnavailable(unavailable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unavailable = unavailable
+}
+
+// Builds returns the builds c was asked to release, in order. The version of each release is its
+// index plus one.
+func (c *Controller) Builds() []BuildRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]BuildRequest(nil), c.builds...)
+}
+
+func (c *Controller) withHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("DRYCC_API_VERSION", drycc.APIVersion)
+		c.mu.Lock()
+		unavailable := c.unavailable
+		c.mu.Unlock()
+		if unavailable {
+			http.Error(w, "the controller is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c *Controller) serveConfig(w http.ResponseWriter, r *http.Request) {
+	var req api.ConfigHookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	config, ok := c.configs[req.App]
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"detail":"Not found."}`, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, config)
+}
+
+func (c *Controller) serveBuild(w http.ResponseWriter, r *http.Request) {
+	var req BuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.builds = append(c.builds, req)
+	version := len(c.builds)
+	c.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]map[string]int{"release": {"version": version}})
+}
+
+func (c *Controller) serveKey(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	user, ok := c.users[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, keyHookPath), "/")]
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"detail":"Not found."}`, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,42 @@
+package testing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/arschles/assert"
+	drycc "github.com/drycc/controller-sdk-go"
+	"github.com/drycc/controller-sdk-go/api"
+	"github.com/drycc/controller-sdk-go/hooks"
+)
+
+func TestController(t *testing.T) {
+	c := NewController()
+	defer c.Close()
+	client, err := drycc.New(true, "http://"+net.JoinHostPort(c.Host(), c.Port())+"/", "")
+	assert.NoErr(t, err)
+
+	_, err = hooks.GetAppConfig(client, "alice", "app")
+	assert.True(t, err != nil, "config of an unknown app")
+	c.SetConfig("app", api.Config{Values: map[string]interface{}{"FOO": "bar"}})
+	config, err := hooks.GetAppConfig(client, "alice", "app")
+	assert.NoErr(t, err)
+	assert.Equal(t, config.Values["FOO"], "bar", "config value")
+
+	c.AddKey("fp", api.UserApps{Username: "alice", Apps: []string{"app"}})
+	user, err := hooks.UserFromKey(client, "fp")
+	assert.NoErr(t, err)
+	assert.Equal(t, user.Username, "alice", "user of the key")
+
+	version, err := hooks.CreateBuild(client, "alice", "app", "app:git-12345678", "heroku-18", "12345678", api.ProcessType{"web": "start"}, false)
+	assert.NoErr(t, err)
+	assert.Equal(t, version, 1, "version")
+	builds := c.Builds()
+	assert.Equal(t, len(builds), 1, "builds")
+	assert.Equal(t, builds[0].Sha, "12345678", "sha of the build")
+	assert.Equal(t, builds[0].Procfile, api.ProcessType{"web": "start"}, "procfile of the build")
+
+	c.SetUnavailable(true)
+	_, err = hooks.GetAppConfig(client, "alice", "app")
+	assert.True(t, err != nil, "config from an unavailable controller")
+}
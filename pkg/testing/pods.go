@@ -0,0 +1,269 @@
+package testing
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// watchBuffer is the number of events a watch of a PodScript buffers for a slow watcher.
+const watchBuffer = 100
+
+// Step is a change of a pod played by a PodScript.
+type Step struct {
+	change func(*corev1.Pod)
+	delete bool
+}
+
+// Phase is the step of a pod entering phase.
+func Phase(phase corev1.PodPhase) Step {
+	return Step{change: func(pod *corev1.Pod) {
+		pod.Status.Phase = phase
+	}}
+}
+
+// Ready is the step of a pod whose containers are all running and ready, with ip as its IP.
+func Ready(ip string) Step {
+	return Step{change: func(pod *corev1.Pod) {
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.PodIP = ip
+		pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{Type: corev1.PodReady, Status: corev1.ConditionTrue})
+		pod.Status.ContainerStatuses = nil
+		for _, c := range pod.Spec.Containers {
+			pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+				Name:  c.Name,
+				Ready: true,
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			})
+		}
+	}}
+}
+
+// Exited is the step of the container of a pod exiting with exitCode, for reason. The pod ends
+// with it, it succeeded if exitCode is 0.
+func Exited(container string, exitCode int32, reason string) Step {
+	return Step{change: func(pod *corev1.Pod) {
+		pod.Status.Phase = corev1.PodSucceeded
+		if exitCode != 0 {
+			pod.Status.Phase = corev1.PodFailed
+		}
+		status := corev1.ContainerStatus{
+			Name:  container,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode, Reason: reason}},
+		}
+		for i, s := range pod.Status.ContainerStatuses {
+			if s.Name == container {
+				pod.Status.ContainerStatuses[i] = status
+				return
+			}
+		}
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, status)
+	}}
+}
+
+// Evicted is the step of a pod evicted by its node, for message.
+func Evicted(message string) Step {
+	return Step{change: func(pod *corev1.Pod) {
+		pod.Status.Phase = corev1.PodFailed
+		pod.Status.Reason = "Evicted"
+		pod.Status.Message = message
+	}}
+}
+
+// Deleted is the step of a pod being deleted.
+func Deleted() Step {
+	return Step{delete: true}
+}
+
+// script is the steps the pods created with a name starting with prefix go through.
+type script struct {
+	prefix string
+	steps  []Step
+}
+
+// PodScript is a fake of the pods of a cluster whose changes are scripted, for a fake clientset
+// to list and watch them. The watches see every change, in order, however quick, and resume from
+// the version of the pods they list, the way a k8s.PodWaiter watches pods.
+type PodScript struct {
+	mu      sync.Mutex
+	pods    map[string]*corev1.Pod
+	history []watch.Event
+	watches []*podWatch
+	scripts []script
+}
+
+// NewPodScript returns a PodScript of pods.
+func NewPodScript(pods ...*corev1.Pod) *PodScript {
+	s := &PodScript{pods: make(map[string]*corev1.Pod)}
+	for _, pod := range pods {
+		s.emit(watch.Added, pod.DeepCopy())
+	}
+	return s
+}
+
+// Install makes client create, delete, list and watch pods through s.
+func (s *PodScript) Install(client *fake.Clientset) {
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).DeepCopy()
+		if pod.Namespace == "" {
+			pod.Namespace = action.GetNamespace()
+		}
+		s.create(pod)
+		// the tracker of client keeps the pod too, for it to be read or deleted
+		return false, nil, nil
+	})
+	client.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		s.Play(action.GetNamespace(), action.(k8stesting.DeleteAction).GetName(), Deleted())
+		return false, nil, nil
+	})
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, s.list(action.GetNamespace()), nil
+	})
+	client.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		rv := action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion
+		return true, s.watch(action.GetNamespace(), rv), nil
+	})
+}
+
+// Script makes the pods created with a name starting with prefix go through steps, in order, right
+// after they're created.
+func (s *PodScript) Script(prefix string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = append(s.scripts, script{prefix: prefix, steps: steps})
+}
+
+// Play makes the pod name in namespace go through steps, in order. Pods that don't exist are left
+// alone.
+func (s *PodScript) Play(namespace, name string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.play(podKey(namespace, name), steps)
+}
+
+// Pod returns the pod name in namespace, as its steps left it.
+func (s *PodScript) Pod(namespace, name string) (*corev1.Pod, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pod, ok := s.pods[podKey(namespace, name)]
+	if !ok {
+		return nil, false
+	}
+	return pod.DeepCopy(), true
+}
+
+func (s *PodScript) create(pod *corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emit(watch.Added, pod)
+	for _, sc := range s.scripts {
+		if strings.HasPrefix(pod.Name, sc.prefix) {
+			s.play(podKey(pod.Namespace, pod.Name), sc.steps)
+		}
+	}
+}
+
+func (s *PodScript) play(key string, steps []Step) {
+	for _, step := range steps {
+		pod, ok := s.pods[key]
+		if !ok {
+			return
+		}
+		pod = pod.DeepCopy()
+		if step.delete {
+			s.emit(watch.Deleted, pod)
+			continue
+		}
+		step.change(pod)
+		s.emit(watch.Modified, pod)
+	}
+}
+
+// emit records that pod changed, as eventType, and sends it to the watches of its namespace.
+func (s *PodScript) emit(eventType watch.EventType, pod *corev1.Pod) {
+	pod.ResourceVersion = strconv.Itoa(len(s.history) + 1)
+	event := watch.Event{Type: eventType, Object: pod}
+	s.history = append(s.history, event)
+	if eventType == watch.Deleted {
+		delete(s.pods, podKey(pod.Namespace, pod.Name))
+	} else {
+		s.pods[podKey(pod.Namespace, pod.Name)] = pod
+	}
+	var watching []*podWatch
+	for _, w := range s.watches {
+		if w.send(event) {
+			watching = append(watching, w)
+		}
+	}
+	s.watches = watching
+}
+
+func (s *PodScript) list(namespace string) *corev1.PodList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := &corev1.PodList{ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(len(s.history))}}
+	for _, pod := range s.pods {
+		if namespace == "" || pod.Namespace == namespace {
+			list.Items = append(list.Items, *pod.DeepCopy())
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list
+}
+
+// watch returns a watch of the pods of namespace, which resumes after the resource version rv.
+func (s *PodScript) watch(namespace, rv string) watch.Interface {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &podWatch{namespace: namespace, result: make(chan watch.Event, watchBuffer), done: make(chan struct{})}
+	if from, err := strconv.Atoi(rv); err == nil && from > 0 && from <= len(s.history) {
+		for _, event := range s.history[from:] {
+			w.send(event)
+		}
+	}
+	s.watches = append(s.watches, w)
+	return w
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// podWatch is a watch of the pods of a namespace of a PodScript.
+type podWatch struct {
+	namespace string
+	result    chan watch.Event
+	done      chan struct{}
+	once      sync.Once
+}
+
+// send sends event to w, if it's about a pod of its namespace, and returns false once w stopped.
+func (w *podWatch) send(event watch.Event) bool {
+	if pod := event.Object.(*corev1.Pod); w.namespace != "" && pod.Namespace != w.namespace {
+		return true
+	}
+	select {
+	case w.result <- watch.Event{Type: event.Type, Object: event.Object.DeepCopyObject()}:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// Stop is the watch.Interface implementation of podWatch.
+func (w *podWatch) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// ResultChan is the watch.Interface implementation of podWatch.
+func (w *podWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
@@ -0,0 +1,62 @@
+package testing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/drycc/builder/pkg/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodScript(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	script := NewPodScript()
+	script.Install(client)
+	script.Script("slugbuild-", Phase(corev1.PodPending), Phase(corev1.PodRunning), Exited("builder", 0, "Completed"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	waiter := k8s.NewPodWaiter(client, "drycc")
+	waiter.Start(ctx)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "slugbuild-app-12345678", Namespace: "drycc"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "builder"}}},
+	}
+	_, err := client.CoreV1().Pods("drycc").Create(ctx, pod, metav1.CreateOptions{})
+	assert.NoErr(t, err)
+
+	ended, err := waiter.Wait(ctx, pod.Name, func(tr k8s.PodTransition) (bool, error) {
+		return tr.To == corev1.PodSucceeded, nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, ended.Status.ContainerStatuses[0].State.Terminated.Reason, "Completed", "reason")
+
+	assert.NoErr(t, client.CoreV1().Pods("drycc").Delete(ctx, pod.Name, metav1.DeleteOptions{}))
+	_, err = waiter.Wait(ctx, pod.Name, func(tr k8s.PodTransition) (bool, error) {
+		return tr.Deleted(), nil
+	})
+	assert.NoErr(t, err)
+	_, ok := script.Pod("drycc", pod.Name)
+	assert.False(t, ok, "deleted pod exists")
+}
+
+func TestPodScriptWatchResumes(t *testing.T) {
+	script := NewPodScript(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "builder", Namespace: "drycc"}})
+	list := script.list("drycc")
+	assert.Equal(t, list.ResourceVersion, "1", "version of the list")
+	script.Play("drycc", "builder", Phase(corev1.PodRunning), Evicted("The node was low on resource: memory."))
+
+	// a watch from the listed version gets the changes made since
+	w := script.watch("drycc", list.ResourceVersion)
+	defer w.Stop()
+	for _, phase := range []corev1.PodPhase{corev1.PodRunning, corev1.PodFailed} {
+		event := <-w.ResultChan()
+		assert.Equal(t, event.Object.(*corev1.Pod).Status.Phase, phase, "phase")
+	}
+	assert.Equal(t, len(script.watch("other", list.ResourceVersion).ResultChan()), 0, "events of another namespace")
+}
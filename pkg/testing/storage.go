@@ -0,0 +1,16 @@
+// Package testing provides fakes of the storage, the controller and the Kubernetes API the builder
+// talks to, for programs embedding or extending the builder to be tested without a cluster.
+package testing
+
+import (
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/drycc/builder/pkg/storage"
+)
+
+// NewStorage returns Drivers keeping every class of objects in a new in-memory storage. It makes
+// the storage drivers accept the keys of the builder, as the builder does when it starts.
+func NewStorage() storage.Drivers {
+	storagedriver.PathRegexp = storage.KeyRegexp
+	return storage.NewDrivers(inmemory.New())
+}
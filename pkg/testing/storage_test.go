@@ -0,0 +1,19 @@
+package testing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewStorage(t *testing.T) {
+	drivers := NewStorage()
+	ctx := context.Background()
+	// the keys of slugs have no leading '/' and contain ':'
+	key := "home/app:git-12345678/push/slug.tgz"
+	assert.NoErr(t, drivers.Artifacts.PutContent(ctx, key, []byte("slug")))
+	content, err := drivers.Cache.GetContent(ctx, key)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(content), "slug", "content")
+}
@@ -0,0 +1,257 @@
+// Package tunables reloads the tunables of builds, such as timeouts, limits, the stack catalog or
+// node selectors, from a directory of files, a mounted ConfigMap, without restarting the builder.
+// The server watches the directory and records the tunables it accepted in a snapshot, which each
+// push applies over the environment before reading its config, so changes apply to the next build.
+package tunables
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc/pkg/log"
+)
+
+// SnapshotFile is the file of the git home the accepted tunables are recorded in.
+const SnapshotFile = ".builder-config.json"
+
+// Snapshot is the record of the tunables in effect for the next builds.
+type Snapshot struct {
+	// Source is the directory the tunables are loaded from.
+	Source string            `json:"source"`
+	Values map[string]string `json:"values"`
+	// Loaded is when Values were loaded.
+	Loaded time.Time `json:"loaded"`
+	// Error is why the current content of Source was rejected, in which case the builds keep
+	// Values, the last accepted tunables.
+	Error string `json:"error,omitempty"`
+}
+
+// Load returns the tunables in dir, keyed by the names of its files, which are env var names. The
+// hidden files and directories of a mounted ConfigMap are skipped. A missing dir has no tunables.
+func Load(dir string) (map[string]string, error) {
+	values := make(map[string]string)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		// the files of a ConfigMap are symlinks into its hidden data directory
+		fi, err := os.Stat(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		values[file.Name()] = strings.TrimRight(string(data), "\n")
+	}
+	return values, nil
+}
+
+// Validate returns an error if a key of values isn't the env var of a field of spec, a pointer to
+// an envconfig struct, or if its value can't be assigned to the field. The required fields, which
+// are set for each push or wire the builder to the cluster, aren't tunables.
+func Validate(spec interface{}, values map[string]string) error {
+	fields := tunableFields(spec)
+	for _, key := range sortedKeys(values) {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("%s isn't a tunable of builds", key)
+		}
+		if err := assign(reflect.New(field.Type).Elem(), values[key]); err != nil {
+			return fmt.Errorf("invalid %s %q (%s)", key, values[key], err)
+		}
+	}
+	return nil
+}
+
+// Resolve sets the tunable fields of spec, a pointer to an envconfig struct, as a push would read
+// them with the envconfig prefix once the tunables of the snapshot at path are applied, without
+// setting them in the environment. The fields without a value are left as they are.
+func Resolve(spec interface{}, prefix, path string) error {
+	s, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(spec).Elem()
+	for key, field := range tunableFields(spec) {
+		value, ok := "", false
+		if s != nil {
+			value, ok = s.Values[key]
+		}
+		if !ok {
+			value, ok = os.LookupEnv(strings.ToUpper(prefix + "_" + key))
+		}
+		if !ok {
+			value, ok = os.LookupEnv(key)
+		}
+		if !ok {
+			value, ok = field.Tag.Lookup("default")
+		}
+		if !ok {
+			continue
+		}
+		if err := assign(v.FieldByIndex(field.Index), value); err != nil {
+			return fmt.Errorf("invalid %s %q (%s)", key, value, err)
+		}
+	}
+	return nil
+}
+
+// tunableFields returns the tunable fields of spec by their env var.
+func tunableFields(spec interface{}) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeOf(spec).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if key := field.Tag.Get("envconfig"); key != "" && field.Tag.Get("ignored") != "true" && field.Tag.Get("required") != "true" {
+			fields[strings.ToUpper(key)] = field
+		}
+	}
+	return fields
+}
+
+// assign parses value into v, returning an error if it isn't a value of its kind.
+func assign(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("%s tunables aren't supported", v.Kind())
+	}
+	return nil
+}
+
+// ReadSnapshot returns the snapshot at path, nil if there's none.
+func ReadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := new(Snapshot)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("the tunables snapshot %s is malformed (%s)", path, err)
+	}
+	return s, nil
+}
+
+// writeSnapshot writes s to path, replacing it at once for pushes never to read half of it.
+func writeSnapshot(path string, s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Apply sets the tunables of the snapshot at path in the environment, as the env vars of the
+// envconfig prefix, for them to override the config of the process read next. It returns the
+// keys it set.
+func Apply(path, prefix string) ([]string, error) {
+	s, err := ReadSnapshot(path)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	keys := sortedKeys(s.Values)
+	for _, key := range keys {
+		if err := os.Setenv(strings.ToUpper(prefix+"_"+key), s.Values[key]); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Reload loads the tunables in dir and, if they changed since the snapshot at path, records them
+// in it once validate accepted them. Rejected tunables are recorded as the error of the snapshot,
+// which keeps the last accepted ones, and returned the first time they're found. It returns true
+// if the tunables in effect changed.
+func Reload(dir, path string, validate func(map[string]string) error, now time.Time) (bool, error) {
+	current, err := ReadSnapshot(path)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		current = &Snapshot{Source: dir, Values: map[string]string{}}
+	}
+	values, err := Load(dir)
+	if err == nil {
+		err = validate(values)
+	}
+	if err != nil {
+		if current.Error == err.Error() {
+			return false, nil
+		}
+		current.Error = err.Error()
+		if err := writeSnapshot(path, current); err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("rejected the tunables in %s, the builds keep the last ones accepted (%s)", dir, current.Error)
+	}
+	if current.Error == "" && current.Source == dir && reflect.DeepEqual(current.Values, values) && !current.Loaded.IsZero() {
+		return false, nil
+	}
+	return true, writeSnapshot(path, &Snapshot{Source: dir, Values: values, Loaded: now.UTC()})
+}
+
+// Watch reloads the tunables in dir into the snapshot at path at startup, then every interval,
+// until the process exits.
+func Watch(dir, path string, interval time.Duration, validate func(map[string]string) error) {
+	for {
+		changed, err := Reload(dir, path, validate, time.Now())
+		if err != nil {
+			log.Err("Error reloading the tunables of builds (%s)", err)
+		} else if changed {
+			log.Info("Reloaded the tunables of builds from %s", dir)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
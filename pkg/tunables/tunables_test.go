@@ -0,0 +1,126 @@
+package tunables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+type spec struct {
+	Timeout   int    `envconfig:"BUILDER_POD_TIMEOUT" default:"1200"`
+	Stack     string `envconfig:"DRYCC_STACK" default:"heroku-18"`
+	Scan      bool   `envconfig:"MALWARE_SCAN" default:"false"`
+	Resources string `envconfig:"BUILDER_RESOURCES" ignored:"true"`
+	Username  string `envconfig:"USERNAME" required:"true"`
+}
+
+func validate(values map[string]string) error {
+	return Validate(new(spec), values)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoErr(t, validate(map[string]string{}))
+	assert.NoErr(t, validate(map[string]string{"BUILDER_POD_TIMEOUT": "600", "DRYCC_STACK": "heroku-20", "MALWARE_SCAN": "true"}))
+	for _, bad := range []map[string]string{
+		{"BUILDER_POD_TIMEOUT": "10m"},
+		{"MALWARE_SCAN": "sometimes"},
+		{"BUILDER_RESOURCES": "{}"},
+		{"USERNAME": "admin"},
+		{"UNKNOWN": "1"},
+	} {
+		assert.True(t, validate(bad) != nil, "accepted the tunables %v", bad)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunables")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	config, path := filepath.Join(dir, "config"), filepath.Join(dir, SnapshotFile)
+	now := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	// a missing directory has no tunables
+	changed, err := Reload(config, path, validate, now)
+	assert.NoErr(t, err)
+	assert.True(t, changed, "the first reload didn't change the tunables")
+	s, err := ReadSnapshot(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(s.Values), 0, "tunables")
+
+	assert.NoErr(t, os.MkdirAll(filepath.Join(config, "..data"), 0755))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(config, "..data", "BUILDER_POD_TIMEOUT"), []byte("600\n"), 0644))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(config, "DRYCC_STACK"), []byte("heroku-20\n"), 0644))
+	changed, err = Reload(config, path, validate, now.Add(time.Minute))
+	assert.NoErr(t, err)
+	assert.True(t, changed, "the tunables didn't change")
+	s, err = ReadSnapshot(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, s.Values, map[string]string{"DRYCC_STACK": "heroku-20"}, "tunables")
+	assert.Equal(t, s.Loaded, now.Add(time.Minute), "loaded")
+
+	changed, err = Reload(config, path, validate, now.Add(2*time.Minute))
+	assert.NoErr(t, err)
+	assert.False(t, changed, "the tunables changed without a change of the directory")
+
+	// rejected tunables are reported once, and the builds keep the last accepted ones
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(config, "BUILDER_POD_TIMEOUT"), []byte("10m"), 0644))
+	_, err = Reload(config, path, validate, now.Add(3*time.Minute))
+	assert.True(t, err != nil, "accepted an invalid timeout")
+	changed, err = Reload(config, path, validate, now.Add(4*time.Minute))
+	assert.NoErr(t, err)
+	assert.False(t, changed, "the tunables changed while rejected")
+	s, err = ReadSnapshot(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, s.Values, map[string]string{"DRYCC_STACK": "heroku-20"}, "tunables")
+	assert.True(t, s.Error != "", "the snapshot doesn't tell why the tunables were rejected")
+
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(config, "BUILDER_POD_TIMEOUT"), []byte("600"), 0644))
+	changed, err = Reload(config, path, validate, now.Add(5*time.Minute))
+	assert.NoErr(t, err)
+	assert.True(t, changed, "the fixed tunables weren't accepted")
+	s, err = ReadSnapshot(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, s.Values, map[string]string{"BUILDER_POD_TIMEOUT": "600", "DRYCC_STACK": "heroku-20"}, "tunables")
+	assert.Equal(t, s.Error, "", "error")
+}
+
+func TestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunables")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, SnapshotFile)
+
+	keys, err := Apply(path, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(keys), 0, "keys applied without a snapshot")
+
+	assert.NoErr(t, writeSnapshot(path, &Snapshot{Values: map[string]string{"DRYCC_STACK": "heroku-20"}}))
+	defer os.Unsetenv("TEST_DRYCC_STACK")
+	keys, err = Apply(path, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, keys, []string{"DRYCC_STACK"}, "keys")
+	assert.Equal(t, os.Getenv("TEST_DRYCC_STACK"), "heroku-20", "env var")
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunables")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, SnapshotFile)
+	os.Setenv("TEST_MALWARE_SCAN", "true")
+	defer os.Unsetenv("TEST_MALWARE_SCAN")
+
+	s := new(spec)
+	assert.NoErr(t, Resolve(s, "test", path))
+	assert.Equal(t, *s, spec{Timeout: 1200, Stack: "heroku-18", Scan: true}, "config without tunables")
+
+	assert.NoErr(t, writeSnapshot(path, &Snapshot{Values: map[string]string{"BUILDER_POD_TIMEOUT": "600", "MALWARE_SCAN": "false"}}))
+	s = new(spec)
+	assert.NoErr(t, Resolve(s, "test", path))
+	assert.Equal(t, *s, spec{Timeout: 600, Stack: "heroku-18"}, "config with tunables")
+	assert.Equal(t, os.Getenv("TEST_BUILDER_POD_TIMEOUT"), "", "env var of a resolved tunable")
+}
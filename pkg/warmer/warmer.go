@@ -0,0 +1,256 @@
+// Package warmer keeps the images builder pods run pulled on the nodes builds run on, so that
+// builds don't wait for a cold pull of a large stack image.
+package warmer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drycc/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// warmPodLabel marks the pods that warm the images of a node.
+	warmPodLabel = "builder.drycc.cc/image-warmer"
+	// warmPodPrefix is the prefix of the names of the pods that warm the images of a node, followed
+	// by the name of the node.
+	warmPodPrefix = "image-warmer-"
+	// maxPodName is the longest name of a pod that's also a valid label value.
+	maxPodName = 63
+)
+
+// StackConfigs are the stack configs of the slugbuilder and dockerbuilder, which list the images
+// builder pods run.
+var StackConfigs = []string{"/etc/slugbuilder/images.json", "/etc/dockerbuilder/images.json"}
+
+// Images returns the images to keep pulled: the images of the stacks listed in stackConfigs, and
+// the newest image of each channel of each stack of the stack catalog at catalogPath. Missing
+// files are skipped.
+func Images(stackConfigs []string, catalogPath string) ([]string, error) {
+	seen := make(map[string]bool)
+	var images []string
+	add := func(image string) {
+		if image != "" && !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	for _, path := range stackConfigs {
+		var stacks []map[string]string
+		if found, err := readJSON(path, &stacks); err != nil {
+			return nil, err
+		} else if !found {
+			continue
+		}
+		for _, stack := range stacks {
+			add(stack["image"])
+		}
+	}
+
+	var catalog struct {
+		Stacks []struct {
+			Versions []struct {
+				Image    string   `json:"image"`
+				Channels []string `json:"channels"`
+			} `json:"versions"`
+		} `json:"stacks"`
+	}
+	if _, err := readJSON(catalogPath, &catalog); err != nil {
+		return nil, err
+	}
+	for _, stack := range catalog.Stacks {
+		// versions are ordered from the oldest to the newest, the last one of a channel is built with
+		newest := make(map[string]string)
+		var channels []string
+		for _, v := range stack.Versions {
+			for _, ch := range v.Channels {
+				if _, ok := newest[ch]; !ok {
+					channels = append(channels, ch)
+				}
+				newest[ch] = v.Image
+			}
+		}
+		for _, ch := range channels {
+			add(newest[ch])
+		}
+	}
+	return images, nil
+}
+
+// readJSON decodes the JSON file at path into v, and returns false if there's no such file.
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s is malformed (%s)", path, err)
+	}
+	return true, nil
+}
+
+// warmPodName returns the name of the pod warming the images of node.
+func warmPodName(node string) string {
+	name := warmPodPrefix + node
+	if len(name) > maxPodName {
+		name = strings.TrimRight(name[:maxPodName], "-.")
+	}
+	return name
+}
+
+// warmPod returns the pod pulling images on node. Each image is a container exiting right away,
+// so that the pod ends once all of them are pulled.
+func warmPod(namespace, node string, images []string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      warmPodName(node),
+			Namespace: namespace,
+			Labels:    map[string]string{"heritage": "drycc", warmPodLabel: "true"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      node,
+			RestartPolicy: corev1.RestartPolicyNever,
+			// warm pods run on nodes builds run on, whatever keeps other pods off them
+			Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+		},
+	}
+	for i, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("image-%d", i),
+			Image: image,
+			// moving tags are pulled again, for builds to find their latest layers
+			ImagePullPolicy: corev1.PullAlways,
+			Command:         []string{"/bin/sh", "-c", "exit 0"},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("1m"),
+					corev1.ResourceMemory: resource.MustParse("4Mi"),
+				},
+			},
+		})
+	}
+	return pod
+}
+
+// parseNodeSelector parses a node selector in the format of BUILDER_POD_NODE_SELECTOR, e.g.
+// "pool:build,disk:ssd".
+func parseNodeSelector(config string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, pair := range strings.Split(config, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.Split(pair, ":")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid node selector %q, use label:value pairs separated by commas", config)
+		}
+		selector[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return selector, nil
+}
+
+// buildNodes returns the names of the ready nodes builder pods may run on, those matching
+// nodeSelector.
+func buildNodes(ctx context.Context, client kubernetes.Interface, nodeSelector map[string]string) ([]string, error) {
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(nodeSelector).String()})
+	if err != nil {
+		return nil, fmt.Errorf("listing the build nodes (%s)", err)
+	}
+	var nodes []string
+	for _, node := range list.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, c := range node.Status.Conditions {
+			if c.Type == corev1.NodeReady && c.Status == corev1.ConditionTrue {
+				nodes = append(nodes, node.Name)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// Warm pulls images on each build node, the nodes matching nodeSelector, with a pod of namespace
+// per node. The pods of the previous round that ended are deleted first, pods still pulling are
+// left to end. It returns the number of pods created.
+func Warm(ctx context.Context, client kubernetes.Interface, namespace string, images []string, nodeSelector map[string]string) (int, error) {
+	if len(images) == 0 {
+		return 0, nil
+	}
+	pods := client.CoreV1().Pods(namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: warmPodLabel + "=true"})
+	if err != nil {
+		return 0, fmt.Errorf("listing the image warmer pods (%s)", err)
+	}
+	pulling := make(map[string]bool)
+	for _, pod := range list.Items {
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded, corev1.PodFailed:
+			if pod.Status.Phase == corev1.PodFailed {
+				log.Info("Image warmer pod %s failed to pull the images of node %s", pod.Name, pod.Spec.NodeName)
+			}
+			if err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return 0, fmt.Errorf("deleting the image warmer pod %s (%s)", pod.Name, err)
+			}
+		default:
+			pulling[pod.Name] = true
+		}
+	}
+
+	nodes, err := buildNodes(ctx, client, nodeSelector)
+	if err != nil {
+		return 0, err
+	}
+	created := 0
+	for _, node := range nodes {
+		pod := warmPod(namespace, node, images)
+		if pulling[pod.Name] {
+			continue
+		}
+		_, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// the pod of the previous round is still being deleted, the node is warmed next round
+			continue
+		} else if err != nil {
+			return created, fmt.Errorf("creating the image warmer pod of node %s (%s)", node, err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// Run warms the images images returns on the build nodes matching nodeSelector, in the format of
+// BUILDER_POD_NODE_SELECTOR, every interval, until the process exits. Errors are logged rather
+// than returned.
+func Run(client kubernetes.Interface, namespace string, images func() ([]string, error), nodeSelector string, interval time.Duration) error {
+	selector, err := parseNodeSelector(nodeSelector)
+	if err != nil {
+		return err
+	}
+	for {
+		imgs, err := images()
+		if err != nil {
+			log.Err("Image warmer error listing the images (%s)", err)
+		} else if n, err := Warm(context.Background(), client, namespace, imgs, selector); err != nil {
+			log.Err("Image warmer error (%s)", err)
+		} else if n > 0 {
+			log.Info("Image warmer pulling %d images on %d nodes", len(imgs), n)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,111 @@
+package warmer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmer")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	slugbuilder := filepath.Join(dir, "slugbuilder.json")
+	assert.NoErr(t, ioutil.WriteFile(slugbuilder, []byte(`[
+		{"name": "heroku-20", "image": "drycc/slugbuilder:canary.heroku-20"},
+		{"name": "heroku-18", "image": "drycc/slugbuilder:canary.heroku-18"}
+	]`), 0644))
+	catalog := filepath.Join(dir, "catalog.json")
+	assert.NoErr(t, ioutil.WriteFile(catalog, []byte(`{"stacks": [{"name": "heroku-20", "versions": [
+		{"version": "1", "image": "drycc/slugbuilder:1.heroku-20", "channels": ["stable"]},
+		{"version": "2", "image": "drycc/slugbuilder:2.heroku-20", "channels": ["stable", "beta"]},
+		{"version": "3", "image": "drycc/slugbuilder:3.heroku-20", "channels": ["beta"]},
+		{"version": "4", "image": "drycc/slugbuilder:canary.heroku-20"}
+	]}]}`), 0644))
+
+	images, err := Images([]string{slugbuilder, filepath.Join(dir, "missing.json")}, catalog)
+	assert.NoErr(t, err)
+	assert.Equal(t, images, []string{
+		"drycc/slugbuilder:canary.heroku-20",
+		"drycc/slugbuilder:canary.heroku-18",
+		"drycc/slugbuilder:2.heroku-20",
+		"drycc/slugbuilder:3.heroku-20",
+	}, "images")
+
+	assert.NoErr(t, ioutil.WriteFile(catalog, []byte("{"), 0644))
+	_, err = Images(nil, catalog)
+	assert.True(t, err != nil, "read a malformed catalog")
+}
+
+func TestWarmPodName(t *testing.T) {
+	assert.Equal(t, warmPodName("node-1"), "image-warmer-node-1", "name")
+	name := warmPodName("ip-10-0-0-1.eu-west-1.compute.internal-with-a-very-long-suffix")
+	assert.True(t, len(name) <= maxPodName && !strings.HasSuffix(name, "-"), "invalid name "+name)
+}
+
+func TestParseNodeSelector(t *testing.T) {
+	selector, err := parseNodeSelector("pool:build, disk:ssd")
+	assert.NoErr(t, err)
+	assert.Equal(t, selector, map[string]string{"pool": "build", "disk": "ssd"}, "selector")
+	_, err = parseNodeSelector("pool")
+	assert.True(t, err != nil, "parsed an invalid selector")
+}
+
+func node(name string, ready, unschedulable bool) *corev1.Node {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{Unschedulable: unschedulable},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}},
+	}
+}
+
+func TestWarm(t *testing.T) {
+	done := warmPod("drycc", "node-2", []string{"old"})
+	done.Status.Phase = corev1.PodSucceeded
+	pulling := warmPod("drycc", "node-3", []string{"old"})
+	pulling.Status.Phase = corev1.PodPending
+	client := fake.NewSimpleClientset(
+		node("node-1", true, false),
+		node("node-2", true, false),
+		node("node-3", true, false),
+		node("not-ready", false, false),
+		node("cordoned", true, true),
+		done, pulling,
+	)
+	ctx := context.Background()
+	images := []string{"drycc/slugbuilder:canary", "drycc/dockerbuilder:canary"}
+
+	created, err := Warm(ctx, client, "drycc", images, nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, created, 2, "pods created")
+	pods, err := client.CoreV1().Pods("drycc").List(ctx, metav1.ListOptions{})
+	assert.NoErr(t, err)
+	names := map[string]*corev1.Pod{}
+	for i := range pods.Items {
+		names[pods.Items[i].Name] = &pods.Items[i]
+	}
+	assert.Equal(t, len(names), 3, "warm pods")
+	pod := names["image-warmer-node-1"]
+	assert.True(t, pod != nil, "node-1 isn't warmed")
+	assert.Equal(t, pod.Spec.NodeName, "node-1", "node")
+	assert.Equal(t, len(pod.Spec.Containers), 2, "containers")
+	assert.Equal(t, pod.Spec.Containers[1].Image, "drycc/dockerbuilder:canary", "image")
+	assert.Equal(t, names["image-warmer-node-2"].Spec.Containers[0].Image, "drycc/slugbuilder:canary", "image of the new round")
+	assert.Equal(t, names["image-warmer-node-3"].Spec.Containers[0].Image, "old", "image of a pod still pulling")
+
+	created, err = Warm(ctx, client, "drycc", nil, nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, created, 0, "pods created without images")
+}